@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"github.com/liamzebedee/tinychain-go/core/bench"
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/urfave/cli/v2"
+
+	"io"
+	"os"
+)
+
+// Prints the reports of a benchmark, as a table or JSON depending on the --json flag.
+func printBenchReports(cCtx *cli.Context, reports []bench.Report) error {
+	if cCtx.Bool("json") {
+		return bench.PrintReportsJSON(os.Stdout, reports)
+	}
+	return bench.PrintReports(os.Stdout, reports)
+}
+
+func BenchPOW(cCtx *cli.Context) error {
+	nakamoto.SetLogOutput(io.Discard)
+	reports, err := bench.BenchPOW(cCtx.Duration("duration"), cCtx.Int("batch-size"))
+	if err != nil {
+		return err
+	}
+	return printBenchReports(cCtx, reports)
+}
+
+func BenchIngest(cCtx *cli.Context) error {
+	nakamoto.SetLogOutput(io.Discard)
+	reports, err := bench.BenchIngest(cCtx.Int("blocks"), cCtx.Int("txs-per-block"))
+	if err != nil {
+		return err
+	}
+	return printBenchReports(cCtx, reports)
+}
+
+func BenchSign(cCtx *cli.Context) error {
+	nakamoto.SetLogOutput(io.Discard)
+	reports, err := bench.BenchSign(cCtx.Int("count"))
+	if err != nil {
+		return err
+	}
+	return printBenchReports(cCtx, reports)
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/urfave/cli/v2"
+
+	"fmt"
+	"os"
+)
+
+func BackupDB(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("Usage: db backup <path>")
+	}
+	dbPath := cCtx.String("db")
+	destPath := cCtx.Args().First()
+
+	src, err := nakamoto.OpenDBReadOnly(dbPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := nakamoto.BackupDB(src, destPath); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %s to %s\n", dbPath, destPath)
+	return nil
+}
+
+func RestoreDB(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("Usage: db restore <path>")
+	}
+	dbPath := cCtx.String("db")
+	backupPath := cCtx.Args().First()
+
+	if _, err := os.Stat(dbPath); err == nil && !cCtx.Bool("force") {
+		return fmt.Errorf("Database %s already exists. Use --force to overwrite it.", dbPath)
+	}
+	if err := nakamoto.RestoreDB(backupPath, dbPath); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s from %s\n", dbPath, backupPath)
+	return nil
+}
+
+func CompactDB(cCtx *cli.Context) error {
+	dbPath := cCtx.String("db")
+	if _, err := os.Stat(dbPath); err != nil {
+		return err
+	}
+	db, err := nakamoto.OpenDB(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	report, err := nakamoto.CompactDB(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Compacted %s from %d to %d bytes in %s\n", dbPath, report.SizeBefore, report.SizeAfter, report.Duration)
+	return nil
+}
+
+func VerifyDB(cCtx *cli.Context) error {
+	dbPath := cCtx.String("db")
+	if cCtx.NArg() == 1 {
+		dbPath = cCtx.Args().First()
+	}
+	if err := nakamoto.VerifyDBIntegrity(dbPath); err != nil {
+		return err
+	}
+	fmt.Printf("%s: ok\n", dbPath)
+	return nil
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/urfave/cli/v2"
+
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// devnet init sets up a local network of nodes in a directory:
+//
+//	genesis.json    the consensus config, funding each node's wallet in the genesis allocations
+//	wallets.json    the wallets, derived from the seed so the network is reproducible
+//	node<i>.key     the private key of node i's wallet, which its miner is rewarded to
+//	node<i>.json    the flags of node i, for tinychain node --config
+//	start.sh        runs every node
+//
+// Node 0 is the bootstrap peer of the others. The wallets' keys are derived from a public seed, and must never hold
+// real funds.
+
+type devnetWallet struct {
+	Index   int    `json:"index"`
+	Pubkey  string `json:"pubkey"`
+	Prvkey  string `json:"prvkey"`
+	Address string `json:"address"`
+}
+
+func RunDevnetInit(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("Usage: devnet init <dir>")
+	}
+	dir, err := filepath.Abs(cCtx.Args().First())
+	if err != nil {
+		return err
+	}
+	numNodes := cCtx.Int("nodes")
+	seed := cCtx.String("seed")
+	basePort := cCtx.Int("base-port")
+	rpcBasePort := cCtx.Int("rpc-base-port")
+	if numNodes < 1 {
+		return fmt.Errorf("The network needs at least 1 node.")
+	}
+	if basePort < rpcBasePort+numNodes && rpcBasePort < basePort+numNodes {
+		return fmt.Errorf("The node ports overlap the API ports.")
+	}
+
+	genesisPath := filepath.Join(dir, "genesis.json")
+	if _, err := os.Stat(genesisPath); err == nil && !cCtx.Bool("force") {
+		return fmt.Errorf("Devnet %s already exists. Use --force to overwrite it.", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	// Wallets.
+	wallets := []devnetWallet{}
+	conf := defaultConsensusConfig()
+	for i := 0; i < numNodes; i++ {
+		wallet, err := core.WalletFromSeed(seed, uint64(i))
+		if err != nil {
+			return err
+		}
+		wallets = append(wallets, devnetWallet{
+			Index:   i,
+			Pubkey:  wallet.PubkeyStr(),
+			Prvkey:  wallet.PrvkeyStr(),
+			Address: wallet.Address(),
+		})
+		conf.GenesisAlloc = append(conf.GenesisAlloc, nakamoto.GenesisAlloc{
+			Pubkey: wallet.PubkeyStr(),
+			Amount: cCtx.Uint64("alloc"),
+		})
+	}
+	if err := writeJSONFile(genesisPath, &conf); err != nil {
+		return err
+	}
+	if err := writeJSONFile(filepath.Join(dir, "wallets.json"), wallets); err != nil {
+		return err
+	}
+
+	// Node configs.
+	bootstrapPeer := fmt.Sprintf("http://127.0.0.1:%d", basePort)
+	script := []string{
+		"#!/bin/sh",
+		"# Runs the devnet nodes. Ctrl-C stops them.",
+		"trap 'kill 0' INT TERM EXIT",
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	for i, wallet := range wallets {
+		name := fmt.Sprintf("node%d", i)
+		keyPath := filepath.Join(dir, name+".key")
+		if err := os.WriteFile(keyPath, []byte(wallet.Prvkey+"\n"), 0600); err != nil {
+			return err
+		}
+		config := map[string]interface{}{
+			"port":         fmt.Sprint(basePort + i),
+			"rpc-port":     fmt.Sprint(rpcBasePort + i),
+			"db":           filepath.Join(dir, name+".db"),
+			"genesis":      genesisPath,
+			"miner-wallet": keyPath,
+			"miner":        i < cCtx.Int("miners"),
+			"nodiscoverip": true,
+		}
+		if 0 < i {
+			config["peers"] = bootstrapPeer
+		}
+		configPath := filepath.Join(dir, name+".json")
+		if err := writeJSONFile(configPath, config); err != nil {
+			return err
+		}
+		script = append(script, fmt.Sprintf("%q node --config %q > %q 2>&1 &", executable, configPath, filepath.Join(dir, name+".log")))
+		fmt.Printf("%s: port %d, API http://127.0.0.1:%d, wallet %s\n", name, basePort+i, rpcBasePort+i, wallet.Pubkey)
+	}
+	script = append(script, "wait")
+	startPath := filepath.Join(dir, "start.sh")
+	if err := os.WriteFile(startPath, []byte(strings.Join(script, "\n")+"\n"), 0755); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created a devnet of %d nodes in %s. Run it with %s\n", numNodes, dir, startPath)
+	return nil
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(buf, '\n'), 0644)
+}
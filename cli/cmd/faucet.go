@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/liamzebedee/tinychain-go/core/faucet"
+	"github.com/urfave/cli/v2"
+
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func RunFaucet(cCtx *cli.Context) error {
+	// The funded wallet, from a file containing its hex-encoded private key.
+	keyPath := cCtx.String("wallet")
+	if keyPath == "" {
+		return fmt.Errorf("The --wallet flag is required.")
+	}
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return fmt.Errorf("Failed to read wallet from %s: %s", keyPath, err)
+	}
+	wallet, err := core.WalletFromPrivateKey(strings.TrimSpace(string(key)))
+	if err != nil {
+		return fmt.Errorf("Failed to load wallet from %s: %s", keyPath, err)
+	}
+
+	config := faucet.Config{
+		Amount:         cCtx.Uint64("amount"),
+		Fee:            cCtx.Uint64("fee"),
+		Cooldown:       cCtx.Duration("cooldown"),
+		DailyLimit:     cCtx.Uint64("daily-limit"),
+		ClientIPHeader: cCtx.String("client-ip-header"),
+	}
+	if secret := cCtx.String("captcha-secret"); secret != "" {
+		verifyURL := cCtx.String("captcha-verify-url")
+		switch verifyURL {
+		case "hcaptcha":
+			verifyURL = faucet.HCAPTCHA_VERIFY_URL
+		case "recaptcha":
+			verifyURL = faucet.RECAPTCHA_VERIFY_URL
+		case "turnstile":
+			verifyURL = faucet.TURNSTILE_VERIFY_URL
+		}
+		config.Captcha = faucet.SiteVerifyCaptcha(verifyURL, secret)
+	}
+
+	node := faucet.NewRPCNode(cCtx.String("rpc-url"), cCtx.String("rpc-token"))
+	f, err := faucet.NewFaucet(config, node, wallet)
+	if err != nil {
+		return err
+	}
+
+	addr := cCtx.String("addr")
+	fmt.Printf("Faucet address: %s\n", wallet.PubkeyStr())
+	fmt.Printf("Dispensing %d per request on http://%s\n", config.Amount, addr)
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           f.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return server.ListenAndServe()
+}
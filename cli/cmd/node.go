@@ -5,39 +5,23 @@ import (
 	"github.com/liamzebedee/tinychain-go/core/nakamoto"
 	"github.com/urfave/cli/v2"
 
+	"bytes"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
-type MockStateMachine struct{}
-
-func newMockStateMachine() *MockStateMachine {
-	return &MockStateMachine{}
-}
-func (m *MockStateMachine) VerifyTx(tx nakamoto.RawTransaction) error {
-	return nil
-}
-
-func newBlockdag(dbPath string) (nakamoto.BlockDAG, nakamoto.ConsensusConfig, *sql.DB) {
-	// TODO validate connection string.
-	db, err := nakamoto.OpenDB(dbPath)
-	if err != nil {
-		panic(err)
-	}
-	_, err = db.Exec("PRAGMA journal_mode = WAL;")
-	if err != nil {
-		panic(err)
-	}
-
-	stateMachine := newMockStateMachine()
-
+// The consensus config of the network the node joins, unless --genesis is given.
+func defaultConsensusConfig() nakamoto.ConsensusConfig {
 	genesis_difficulty := new(big.Int)
 	genesis_difficulty.SetString("0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
 
@@ -49,44 +33,266 @@ func newBlockdag(dbPath string) (nakamoto.BlockDAG, nakamoto.ConsensusConfig, *s
 	genesisBlockHash := [32]byte{}
 	copy(genesisBlockHash[:], genesisBlockHash_)
 
-	conf := nakamoto.ConsensusConfig{
+	return nakamoto.ConsensusConfig{
 		EpochLengthBlocks:       10,
 		TargetEpochLengthMillis: 1000 * 60 * 5, // 5 minutes
 		GenesisDifficulty:       *genesis_difficulty,
 		GenesisParentBlockHash:  genesisBlockHash,
 		MaxBlockSizeBytes:       2 * 1024 * 1024, // 2MB
+		CoinbaseMaturity:        100,
+	}
+}
+
+// Loads a consensus config from a JSON file, over the defaults.
+func loadConsensusConfig(path string) (nakamoto.ConsensusConfig, error) {
+	conf := defaultConsensusConfig()
+	if path == "" {
+		return conf, nil
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return conf, fmt.Errorf("Failed to read genesis config from %s: %s", path, err)
 	}
+	if err := json.Unmarshal(buf, &conf); err != nil {
+		return conf, fmt.Errorf("Failed to parse genesis config from %s: %s", path, err)
+	}
+	return conf, nil
+}
 
+// Sets the flags of a command from a JSON file of flag names and values. Flags given on the command line take
+// precedence over the file.
+func loadConfigFile(cmdCtx *cli.Context, path string) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Failed to read config from %s: %s", path, err)
+	}
+	// Decode numbers as written, since large ones would be formatted in exponent notation.
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	values := map[string]interface{}{}
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("Failed to parse config from %s: %s", path, err)
+	}
+	for name, value := range values {
+		if cmdCtx.IsSet(name) {
+			continue
+		}
+		if err := cmdCtx.Set(name, fmt.Sprint(value)); err != nil {
+			return fmt.Errorf("Invalid config value for %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func newBlockdag(dbPath string, conf nakamoto.ConsensusConfig) (nakamoto.BlockDAG, *sql.DB) {
+	// TODO validate connection string.
+	db, err := nakamoto.OpenDB(dbPath)
+	if err != nil {
+		panic(err)
+	}
+	_, err = db.Exec("PRAGMA journal_mode = WAL;")
+	if err != nil {
+		panic(err)
+	}
+
+	// Blocks are checked against the state machine's transaction rules when they are ingested.
+	stateMachine, err := nakamoto.NewStateMachineFromConfig(conf)
+	if err != nil {
+		panic(err)
+	}
 	blockdag, err := nakamoto.NewBlockDAGFromDB(db, stateMachine, conf)
 	if err != nil {
 		panic(err)
 	}
 
-	return blockdag, conf, db
+	return blockdag, db
 }
 
 func RunNode(cmdCtx *cli.Context) error {
+	if configPath := cmdCtx.String("config"); configPath != "" {
+		if err := loadConfigFile(cmdCtx, configPath); err != nil {
+			return err
+		}
+	}
 	port := cmdCtx.String("port")
+	rpcPort := cmdCtx.String("rpc-port")
 	dbPath := cmdCtx.String("db")
 	bootstrapPeers := cmdCtx.String("peers")
 	runMiner := cmdCtx.Bool("miner")
 
 	// DAG.
-	dag, _, _ := newBlockdag(dbPath)
+	conf, err := loadConsensusConfig(cmdCtx.String("genesis"))
+	if err != nil {
+		return err
+	}
+	dag, _ := newBlockdag(dbPath, conf)
+	dag.FinalityDepth = cmdCtx.Uint64("finality-depth")
+	dag.AllowDeepReorgs = cmdCtx.Bool("allow-deep-reorgs")
+	dag.MaxReorgDepth = cmdCtx.Uint64("max-reorg-depth")
 
 	// Miner.
-	minerWallet, err := core.CreateRandomWallet()
-	if err != nil {
+	var minerWallet *core.Wallet
+	if keyPath := cmdCtx.String("miner-wallet"); keyPath != "" {
+		key, err := os.ReadFile(keyPath)
+		if err != nil {
+			return fmt.Errorf("Failed to read miner wallet from %s: %s", keyPath, err)
+		}
+		if minerWallet, err = core.WalletFromPrivateKey(strings.TrimSpace(string(key))); err != nil {
+			return fmt.Errorf("Failed to load miner wallet from %s: %s", keyPath, err)
+		}
+	} else if minerWallet, err = core.CreateRandomWallet(); err != nil {
 		return err
 	}
 
 	miner := nakamoto.NewMiner(dag, minerWallet)
+	miner.Threads = cmdCtx.Int("miner-threads")
+	if err := miner.SetTipPolicy(cmdCtx.String("miner-tip-policy"), cmdCtx.Bool("miner-prefer-own-txs")); err != nil {
+		return err
+	}
 
 	// Peer.
-	peer := nakamoto.NewPeerCore(nakamoto.NewPeerConfig("0.0.0.0", port, []string{}))
+	// Listen dual-stack, on both IPv4 and IPv6.
+	peerConfig := nakamoto.NewPeerConfig("::", port, []string{})
+	peerConfig.NoDiscoverIP = cmdCtx.Bool("nodiscoverip")
+	peerConfig.NoQuic = cmdCtx.Bool("noquic")
+	if externalAddrs := cmdCtx.String("externaladdr"); externalAddrs != "" {
+		peerConfig.ExternalAddrs = strings.Split(externalAddrs, ",")
+		if _, _, _, err := nakamoto.ParseExternalAddrs(peerConfig.ExternalAddrs, port); err != nil {
+			return err
+		}
+	}
+	peer := nakamoto.NewPeerCore(peerConfig)
+	peer.HeartbeatIntervalSeconds = cmdCtx.Int("heartbeat-interval")
+	peer.HeartbeatTimeoutSeconds = cmdCtx.Int("heartbeat-timeout")
+	peer.StaleTipTimeoutSeconds = cmdCtx.Int("stale-tip-timeout")
+	peer.TargetPeers = cmdCtx.Int("target-peers")
+	peer.MaxPeers = cmdCtx.Int("max-peers")
+	peer.MinOutboundPeers = cmdCtx.Int("min-outbound-peers")
+	peer.BlocksOnly = cmdCtx.Bool("blocks-only")
+	if txFilter := cmdCtx.String("tx-filter"); txFilter != "" {
+		pubkeys := [][65]byte{}
+		for _, pubkeyStr := range strings.Split(txFilter, ",") {
+			pubkey, err := hex.DecodeString(strings.TrimSpace(pubkeyStr))
+			if err != nil || len(pubkey) != 65 {
+				return fmt.Errorf("Invalid transaction filter pubkey: %s", pubkeyStr)
+			}
+			pubkeys = append(pubkeys, [65]byte(pubkey))
+		}
+		peer.TxFilter = nakamoto.NewPubkeyBloomFilter(pubkeys, cmdCtx.Float64("tx-filter-fp-rate"))
+	}
+	peer.PrivateNetwork = cmdCtx.Bool("private-network")
+	if peer.InboundAllowlist, err = nakamoto.ParseCIDRs(strings.Split(cmdCtx.String("inbound-allow"), ",")); err != nil {
+		return err
+	}
+	if peer.InboundDenylist, err = nakamoto.ParseCIDRs(strings.Split(cmdCtx.String("inbound-deny"), ",")); err != nil {
+		return err
+	}
+
+	// Node identity.
+	identityPath := cmdCtx.String("identity")
+	if identityPath == "" {
+		identityPath = dbPath + ".identity"
+	}
+	identity, err := nakamoto.LoadOrCreateNodeIdentity(identityPath)
+	if err != nil {
+		return err
+	}
+	peer.SetIdentity(identity)
+	fmt.Printf("Node ID: %s\n", peer.NodeID())
+
+	// DHT routing table.
+	dhtPath := cmdCtx.String("dht-table")
+	if dhtPath == "" {
+		dhtPath = dbPath + ".dht"
+	}
+	if err := peer.LoadRoutingTable(dhtPath); err != nil {
+		return err
+	}
+
+	// Recently seen blocks and transactions.
+	knownInvPath := cmdCtx.String("known-inventory")
+	if knownInvPath == "" {
+		knownInvPath = dbPath + ".known"
+	}
+	if err := peer.LoadKnownInventory(knownInvPath); err != nil {
+		return err
+	}
+
+	// Networking backend.
+	var peerBackend nakamoto.PeerInterface = peer
+	if cmdCtx.Bool("libp2p") {
+		libp2pPeer, err := nakamoto.NewLibp2pPeer(peerConfig, identity)
+		if err != nil {
+			return err
+		}
+		libp2pPeer.Rendezvous = nakamoto.Libp2pRendezvous(conf)
+		libp2pPeer.TargetPeers = peer.TargetPeers
+		libp2pPeer.HeartbeatIntervalSeconds = peer.HeartbeatIntervalSeconds
+		libp2pPeer.HeartbeatTimeoutSeconds = peer.HeartbeatTimeoutSeconds
+		libp2pPeer.BlocksOnly = peer.BlocksOnly
+		libp2pPeer.TxFilter = peer.TxFilter
+		libp2pPeer.InboundAllowlist = peer.InboundAllowlist
+		libp2pPeer.InboundDenylist = peer.InboundDenylist
+		peerBackend = libp2pPeer
+	}
 
 	// Create the node.
-	node := nakamoto.NewNode(&dag, miner, peer)
+	node := nakamoto.NewNode(&dag, miner, peerBackend)
+	node.Mempool.MinRelayFeePerByte = cmdCtx.Uint64("min-relay-fee")
+	node.Mempool.DustThreshold = cmdCtx.Uint64("dust-threshold")
+	node.ForkMonitor.AlertDepth = cmdCtx.Uint64("fork-alert-depth")
+	node.ForkMonitor.AlertWorkShare = cmdCtx.Float64("fork-alert-work-share")
+	node.ClockMonitor.MaxDrift = time.Duration(cmdCtx.Int("max-clock-drift")) * time.Second
+	node.DBMaintainer.Interval = time.Duration(cmdCtx.Int("db-maintenance-interval")) * time.Second
+	node.Auditor.Interval = time.Duration(cmdCtx.Int("audit-interval")) * time.Second
+	node.BlockQueue.Capacity = cmdCtx.Int("block-queue-capacity")
+	node.Analytics.Windows = []uint64{}
+	for _, window := range strings.Split(cmdCtx.String("analytics-windows"), ",") {
+		w, err := strconv.ParseUint(strings.TrimSpace(window), 10, 64)
+		if err != nil || w == 0 || nakamoto.MAX_ANALYTICS_WINDOW < w {
+			return fmt.Errorf("Invalid analytics window: %s", window)
+		}
+		node.Analytics.Windows = append(node.Analytics.Windows, w)
+	}
+
+	// Address book.
+	contactsPath := cmdCtx.String("contacts")
+	if contactsPath == "" {
+		contactsPath = dbPath + ".contacts"
+	}
+	if node.AddressBook, err = nakamoto.LoadAddressBook(contactsPath); err != nil {
+		return err
+	}
+
+	// Notifications.
+	if pubAddr := cmdCtx.String("pub-addr"); pubAddr != "" {
+		publisher, err := nakamoto.NewPublisher(pubAddr, strings.Split(cmdCtx.String("pub-topics"), ","))
+		if err != nil {
+			return err
+		}
+		node.Publisher = publisher
+	}
+
+	// API.
+	if rpcPort != "" {
+		apiConfig := nakamoto.NewAPIConfig("0.0.0.0", rpcPort)
+		apiConfig.AuthToken = cmdCtx.String("rpc-token")
+		apiConfig.AuthUsername = cmdCtx.String("rpc-user")
+		apiConfig.AuthPassword = cmdCtx.String("rpc-password")
+		apiConfig.RateLimit = cmdCtx.Float64("rpc-rate-limit")
+		apiConfig.RateLimitBurst = cmdCtx.Int("rpc-rate-limit-burst")
+		if cors := cmdCtx.String("rpc-cors"); cors != "" {
+			apiConfig.CORSOrigins = strings.Split(cors, ",")
+		}
+		apiConfig.TLSCertFile = cmdCtx.String("rpc-tls-cert")
+		apiConfig.TLSKeyFile = cmdCtx.String("rpc-tls-key")
+
+		api := nakamoto.NewAPIServer(apiConfig)
+		err = node.ServeAPI(api)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Handle process signals.
 	c := make(chan os.Signal, 1)
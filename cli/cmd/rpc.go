@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/urfave/cli/v2"
+
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Calls a JSON-RPC method on a running node, using the --rpc-url and --rpc-token flags.
+func callNodeRPC(cCtx *cli.Context, method string, params ...interface{}) (json.RawMessage, error) {
+	paramsJson, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(nakamoto.RPCRequest{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage("1"),
+		Method:  method,
+		Params:  paramsJson,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, cCtx.String("rpc-url")+"/rpc", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := cCtx.String("rpc-token"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("RPC request failed, status=%d", res.StatusCode)
+	}
+
+	var rpcRes nakamoto.RPCResponse
+	if err := json.NewDecoder(res.Body).Decode(&rpcRes); err != nil {
+		return nil, err
+	}
+	if rpcRes.Error != nil {
+		return nil, rpcRes.Error
+	}
+	return rpcRes.Result, nil
+}
+
+// Calls a JSON-RPC method on a running node, decoding its result into res.
+func callNodeRPCResult(cCtx *cli.Context, res interface{}, method string, params ...interface{}) error {
+	result, err := callNodeRPC(cCtx, method, params...)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(result, res)
+}
+
+func InvalidateBlock(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("Usage: invalidateblock <hash>")
+	}
+
+	tip, err := callNodeRPC(cCtx, "invalidateblock", cCtx.Args().First())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Block invalidated. New tip: %s\n", tip)
+	return nil
+}
+
+func ReconsiderBlock(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("Usage: reconsiderblock <hash>")
+	}
+
+	tip, err := callNodeRPC(cCtx, "reconsiderblock", cCtx.Args().First())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Block reconsidered. New tip: %s\n", tip)
+	return nil
+}
+
+func WatchAddress(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("Usage: watchaddress <pubkey>")
+	}
+
+	// Resolve contacts in our address book. Other names are resolved by the node's.
+	address := cCtx.Args().First()
+	if book, err := loadContactsFlag(cCtx); err == nil {
+		if pubkey, ok := book.Get(address); ok {
+			address = hex.EncodeToString(pubkey[:])
+		}
+	}
+	params := []interface{}{address}
+	if webhook := cCtx.String("webhook"); webhook != "" {
+		params = append(params, webhook)
+	}
+	if _, err := callNodeRPC(cCtx, "watchaddress", params...); err != nil {
+		return err
+	}
+	fmt.Printf("Watching address %s\n", cCtx.Args().First())
+	return nil
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/liamzebedee/tinychain-go/core/sim"
+	"github.com/urfave/cli/v2"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+func RunSimulation(cCtx *cli.Context) error {
+	nakamoto.SetLogOutput(io.Discard)
+
+	config := sim.Config{
+		Strategy:       sim.Strategy(cCtx.String("strategy")),
+		AdversaryShare: cCtx.Float64("adversary-share"),
+		Blocks:         cCtx.Int("blocks"),
+		Seed:           cCtx.Int64("seed"),
+		WithholdBlocks: cCtx.Int("withhold-blocks"),
+		ReorgDepth:     cCtx.Int("reorg-depth"),
+		GiveUpBlocks:   cCtx.Int("give-up-blocks"),
+	}
+	s, err := sim.NewSimulation(config)
+	if err != nil {
+		return err
+	}
+	r, err := s.Run()
+	if err != nil {
+		return err
+	}
+
+	if cCtx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	fmt.Printf("Strategy: %s (adversary share %.2f)\n", r.Strategy, r.AdversaryShare)
+	fmt.Printf("Blocks mined: honest=%d adversary=%d\n", r.HonestBlocks, r.AdversaryBlocks)
+	fmt.Printf("Main chain: length=%d honest=%d adversary=%d\n", r.MainChainLength, r.HonestMainChainBlocks, r.AdversaryMainChainBlocks)
+	fmt.Printf("Chain quality: %.4f\n", r.ChainQuality)
+	fmt.Printf("Adversary revenue share: %.4f\n", r.AdversaryRevenueShare)
+	fmt.Printf("Stale blocks: %d (rate %.4f)\n", r.StaleBlocks, r.StaleRate)
+	fmt.Printf("Reorgs: %d (max depth %d)\n", r.Reorgs, r.MaxReorgDepth)
+	if r.Strategy == sim.STRATEGY_DEEP_REORG {
+		fmt.Printf("Deep reorg attempts: %d (successful %d)\n", r.ReorgAttempts, r.SuccessfulReorgs)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/urfave/cli/v2"
+
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The number of log lines shown at the bottom of the dashboard.
+const TOP_LOG_LINES = 15
+
+// Clears the terminal and moves the cursor to the top left.
+const ansiClearScreen = "\x1b[H\x1b[2J"
+
+// A snapshot of a node's status, as shown by `tinychain top`.
+type topSnapshot struct {
+	SyncStatus struct {
+		FullTipHeight    uint64  `json:"fullTipHeight"`
+		HeadersTipHeight uint64  `json:"headersTipHeight"`
+		BestPeerHeight   uint64  `json:"bestPeerHeight"`
+		Progress         float64 `json:"progress"`
+		IBD              bool    `json:"ibd"`
+	}
+	MiningInfo struct {
+		Mining          bool    `json:"mining"`
+		Hashrate        float64 `json:"hashrate"`
+		NetworkHashrate float64 `json:"networkHashrate"`
+	}
+	Mempool struct {
+		Count uint64 `json:"count"`
+		Bytes uint64 `json:"bytes"`
+	}
+	Peers []nakamoto.RPCPeer
+	Logs  []string
+}
+
+// Fetches a snapshot of the node's status over its API.
+func fetchTopSnapshot(cCtx *cli.Context) (topSnapshot, error) {
+	snapshot := topSnapshot{}
+	calls := []struct {
+		method string
+		res    interface{}
+		params []interface{}
+	}{
+		{"getsyncstatus", &snapshot.SyncStatus, nil},
+		{"getmininginfo", &snapshot.MiningInfo, nil},
+		{"mempool_info", &snapshot.Mempool, nil},
+		{"admin_listPeers", &snapshot.Peers, nil},
+		{"admin_logs", &snapshot.Logs, []interface{}{TOP_LOG_LINES}},
+	}
+	for _, call := range calls {
+		result, err := callNodeRPC(cCtx, call.method, call.params...)
+		if err != nil {
+			return topSnapshot{}, fmt.Errorf("Failed to call %s: %s", call.method, err)
+		}
+		if err := json.Unmarshal(result, call.res); err != nil {
+			return topSnapshot{}, fmt.Errorf("Failed to decode %s: %s", call.method, err)
+		}
+	}
+	return snapshot, nil
+}
+
+// Formats a hashrate with an SI prefix, ie. "12.3 MH/s".
+func formatHashrate(hashrate float64) string {
+	units := []string{"H/s", "kH/s", "MH/s", "GH/s", "TH/s", "PH/s"}
+	i := 0
+	for 1000 <= hashrate && i < len(units)-1 {
+		hashrate /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", hashrate, units[i])
+}
+
+// Draws the dashboard for a snapshot.
+func renderTop(w io.Writer, rpcURL string, snapshot topSnapshot, now time.Time) {
+	sync := snapshot.SyncStatus
+	fmt.Fprintf(w, "tinychain top - %s - %s\n\n", rpcURL, now.Format("15:04:05"))
+
+	// Sync.
+	const barWidth = 40
+	filled := int(sync.Progress * barWidth)
+	fmt.Fprintf(w, "Tip height:     %d\n", sync.FullTipHeight)
+	fmt.Fprintf(w, "Headers height: %d\n", sync.HeadersTipHeight)
+	fmt.Fprintf(w, "Best peer:      %d\n", sync.BestPeerHeight)
+	ibd := ""
+	if sync.IBD {
+		ibd = " (initial block download)"
+	}
+	fmt.Fprintf(w, "Sync:           [%s%s] %.2f%%%s\n\n", strings.Repeat("#", filled), strings.Repeat(".", barWidth-filled), sync.Progress*100, ibd)
+
+	// Mining and the mempool.
+	mining := "off"
+	if snapshot.MiningInfo.Mining {
+		mining = formatHashrate(snapshot.MiningInfo.Hashrate)
+	}
+	fmt.Fprintf(w, "Hashrate:       %s (network %s)\n", mining, formatHashrate(snapshot.MiningInfo.NetworkHashrate))
+	fmt.Fprintf(w, "Mempool:        %d txs, %d bytes\n\n", snapshot.Mempool.Count, snapshot.Mempool.Bytes)
+
+	// Peers.
+	fmt.Fprintf(w, "Peers (%d)\n", len(snapshot.Peers))
+	fmt.Fprintf(w, "  %-40s %-4s %10s %10s %12s\n", "URL", "DIR", "HEIGHT", "LATENCY", "LAST SEEN")
+	for _, peer := range snapshot.Peers {
+		dir := "out"
+		if peer.Inbound {
+			dir = "in"
+		}
+		lastSeen := now.Sub(time.UnixMilli(int64(peer.LastSeen))).Truncate(time.Second)
+		fmt.Fprintf(w, "  %-40s %-4s %10d %8.0fms %12s\n", peer.URL, dir, peer.TipHeight, peer.LatencyMs, lastSeen)
+	}
+
+	// Logs.
+	fmt.Fprintf(w, "\nLogs\n")
+	for _, line := range snapshot.Logs {
+		fmt.Fprintf(w, "  %s\n", line)
+	}
+}
+
+// Shows a live dashboard of a running node's status, redrawn every interval.
+func RunTop(cCtx *cli.Context) error {
+	interval := cCtx.Duration("interval")
+	if interval <= 0 {
+		return fmt.Errorf("Interval must be greater than zero.")
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		snapshot, err := fetchTopSnapshot(cCtx)
+		fmt.Print(ansiClearScreen)
+		if err != nil {
+			// The node may be restarting, so keep polling.
+			fmt.Printf("tinychain top - %s\n\n%s\n", cCtx.String("rpc-url"), err)
+		} else {
+			renderTop(os.Stdout, cCtx.String("rpc-url"), snapshot, time.Now())
+		}
+
+		select {
+		case <-sigs:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
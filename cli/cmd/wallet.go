@@ -0,0 +1,724 @@
+package cmd
+
+import (
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/liamzebedee/tinychain-go/core/faucet"
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/urfave/cli/v2"
+
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The wallet commands sign transactions locally with a key file, and submit them through a running node's API.
+//
+// Wherever a command takes an address, it also takes the name of a contact in the address book, which is managed with
+// `wallet contact`. See addressbook.go.
+//
+// `wallet label` attaches local notes to transactions, which `wallet export-history` includes in the CSV of the wallet's
+// history, for accounting. See txlabels.go.
+//
+// `wallet rotate` replaces the wallet's key with a new one: it creates the new key in the keystore, sweeps the old
+// key's spendable balance to it, waits for the sweep to confirm, then marks the old key retired. The old key is kept in
+// the keystore, since coins sent to it afterwards, or coinbase rewards which were immature at the time of the sweep,
+// need it to be recovered. See keystore.go.
+//
+// `wallet statement` produces a statement of the wallet's balance and history as of a block, with proofs of its
+// transactions, signed by the wallet, for audits and proof-of-funds attestations. `wallet verify-statement` checks the
+// signature and proofs, and that the node agrees on the block and balance. See statement.go.
+//
+// `wallet rescan --from-height H` replays the chain from height H through the node's block filters, to discover the
+// historical transactions of keys newly imported into the keystore, or of watch-only addresses. With --watch, the
+// addresses are watched on the node first, so their transfers are recorded as its activity. See rescan.go.
+//
+// `wallet sweep <dest>` empties the wallet: it sends the spendable balance (excluding immature coinbase coins), less
+// the fee for the transaction's size, to the destination.
+//
+// `wallet send --wait-confirmations N` waits until the transaction has N confirmations before exiting, so scripts can
+// act on a payment once it's settled. It checks the transaction's status whenever the node publishes a new tip (see
+// publisher.go), if --sub-addr is set, and polls otherwise. A transaction dropped from the mempool, ie. by a reorg, may
+// be included again, so only a rejection or the timeout passing ends the wait early.
+
+// Loads the wallet from the file given by the --wallet flag, containing its hex-encoded private key.
+func loadWalletFlag(cCtx *cli.Context) (*core.Wallet, error) {
+	keyPath := cCtx.String("wallet")
+	if keyPath == "" {
+		return nil, fmt.Errorf("The --wallet flag is required.")
+	}
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read wallet from %s: %s", keyPath, err)
+	}
+	wallet, err := core.WalletFromPrivateKey(strings.TrimSpace(string(key)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load wallet from %s: %s", keyPath, err)
+	}
+	return wallet, nil
+}
+
+// Loads the address book from the file given by the --contacts flag, by default in the user's home directory.
+func loadContactsFlag(cCtx *cli.Context) (*nakamoto.AddressBook, error) {
+	path := cCtx.String("contacts")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".tinychain", "contacts.json")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return nakamoto.LoadAddressBook(path)
+}
+
+// Loads the transaction labels from the file given by the --labels flag, by default in the user's home directory.
+func loadLabelsFlag(cCtx *cli.Context) (*nakamoto.TxLabels, error) {
+	path := cCtx.String("labels")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".tinychain", "labels.json")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	return nakamoto.LoadTxLabels(path)
+}
+
+// Opens the keystore in the directory given by the --keystore flag, by default in the user's home directory.
+func loadKeystoreFlag(cCtx *cli.Context) (*core.Keystore, error) {
+	dir := cCtx.String("keystore")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(home, ".tinychain", "keystore")
+	}
+	return core.OpenKeystore(dir)
+}
+
+// Resolves an address argument, which is a hex-encoded pubkey or the name of a contact.
+func resolveAddress(cCtx *cli.Context, address string) ([65]byte, error) {
+	book, err := loadContactsFlag(cCtx)
+	if err != nil {
+		return [65]byte{}, err
+	}
+	return book.Resolve(address)
+}
+
+func WalletSend(cCtx *cli.Context) error {
+	wallet, err := loadWalletFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	to, err := resolveAddress(cCtx, cCtx.String("to"))
+	if err != nil {
+		return err
+	}
+
+	// Build the transaction, after those of ours pending in the mempool.
+	node := faucet.NewRPCNode(cCtx.String("rpc-url"), cCtx.String("rpc-token"))
+	nonce, err := node.GetNextNonce(wallet.PubkeyBytes())
+	if err != nil {
+		return fmt.Errorf("Failed to get nonce: %s", err)
+	}
+	fee := cCtx.Uint64("fee")
+	if fee == 0 {
+		if fee, err = node.EstimateFee(); err != nil {
+			return fmt.Errorf("Failed to estimate fee: %s", err)
+		}
+	}
+	tx := nakamoto.RawTransaction{
+		Version:    1,
+		FromPubkey: wallet.PubkeyBytes(),
+		ToPubkey:   to,
+		Amount:     cCtx.Uint64("amount"),
+		Fee:        fee,
+		Nonce:      nonce,
+	}
+	return signAndSend(cCtx, wallet, tx)
+}
+
+// Sends the wallet's whole spendable balance, less the fee, to an account.
+func WalletSweep(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("Usage: wallet sweep <dest>")
+	}
+	wallet, err := loadWalletFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	to, err := resolveAddress(cCtx, cCtx.Args().First())
+	if err != nil {
+		return err
+	}
+	tx, err := buildSweepTx(cCtx, wallet, to)
+	if err != nil {
+		return err
+	}
+	if tx == nil {
+		return fmt.Errorf("The wallet has no spendable balance to sweep.")
+	}
+	fmt.Fprintf(os.Stderr, "Sweeping %d with a fee of %d\n", tx.Amount, tx.Fee)
+	return signAndSend(cCtx, wallet, *tx)
+}
+
+// Builds a transaction sending the wallet's whole spendable balance, less the fee given by --fee or estimated by the
+// node, to an account. Returns nil if the balance is zero.
+func buildSweepTx(cCtx *cli.Context, wallet *core.Wallet, to [65]byte) (*nakamoto.RawTransaction, error) {
+	from := wallet.PubkeyStr()
+
+	// Transactions pending in the mempool would spend from the balance we're sweeping.
+	var status struct {
+		NextNonce  uint64   `json:"nextNonce"`
+		Executable []uint64 `json:"executable"`
+		Parked     []uint64 `json:"parked"`
+	}
+	if err := callNodeRPCResult(cCtx, &status, "mempool_account", from); err != nil {
+		return nil, err
+	}
+	if 0 < len(status.Executable)+len(status.Parked) {
+		return nil, fmt.Errorf("The wallet has transactions pending in the mempool. Wait for them to confirm before sweeping.")
+	}
+
+	balance := uint64(0)
+	if err := callNodeRPCResult(cCtx, &balance, "getspendablebalance", from); err != nil {
+		return nil, err
+	}
+	if balance == 0 {
+		return nil, nil
+	}
+	tx := nakamoto.RawTransaction{
+		Version:    1,
+		FromPubkey: wallet.PubkeyBytes(),
+		ToPubkey:   to,
+		Nonce:      status.NextNonce,
+	}
+	if fee := cCtx.Uint64("fee"); fee != 0 {
+		if balance <= fee {
+			return nil, fmt.Errorf("Balance of %d doesn't cover the fee of %d.", balance, fee)
+		}
+		tx.Amount, tx.Fee = balance-fee, fee
+	} else {
+		var estimate struct {
+			FeePerByte uint64 `json:"feePerByte"`
+		}
+		if err := callNodeRPCResult(cCtx, &estimate, "estimatefee", nakamoto.DEFAULT_TX_BUILDER_FEE_BLOCKS); err != nil {
+			return nil, err
+		}
+		var err error
+		if tx.Amount, tx.Fee, err = nakamoto.SweepAmount(balance, estimate.FeePerByte, tx); err != nil {
+			return nil, err
+		}
+	}
+	return &tx, nil
+}
+
+// Signs and submits a transaction, printing its hash, then waits for the confirmations given by --wait-confirmations.
+func signAndSend(cCtx *cli.Context, wallet *core.Wallet, tx nakamoto.RawTransaction) error {
+	hash, err := sendTx(cCtx, wallet, tx)
+	if err != nil {
+		return err
+	}
+	fmt.Println(hex.EncodeToString(hash[:]))
+
+	confirmations := cCtx.Uint64("wait-confirmations")
+	if confirmations == 0 {
+		return nil
+	}
+	return waitForConfirmations(cCtx, hash, confirmations)
+}
+
+// Signs and submits a transaction, returning its hash.
+func sendTx(cCtx *cli.Context, wallet *core.Wallet, tx nakamoto.RawTransaction) ([32]byte, error) {
+	sig, err := wallet.Sign(tx.Envelope())
+	if err != nil {
+		return [32]byte{}, err
+	}
+	copy(tx.Sig[:], sig)
+
+	if _, err := callNodeRPC(cCtx, "sendrawtransaction", tx); err != nil {
+		return [32]byte{}, fmt.Errorf("Failed to send transaction: %s", err)
+	}
+	return tx.Hash(), nil
+}
+
+// Waits until a transaction has the given number of confirmations, checking its status on each new tip.
+func waitForConfirmations(cCtx *cli.Context, hash [32]byte, confirmations uint64) error {
+	tips := make(chan struct{}, 1)
+	if subAddr := cCtx.String("sub-addr"); subAddr != "" {
+		conn, err := net.Dial("tcp", subAddr)
+		if err != nil {
+			return fmt.Errorf("Failed to subscribe to %s: %s", subAddr, err)
+		}
+		defer conn.Close()
+		go func() {
+			for {
+				topic, _, _, err := nakamoto.ReadPubMessage(conn)
+				if err != nil {
+					return
+				}
+				if topic != nakamoto.PUB_TOPIC_HASHTIP {
+					continue
+				}
+				select {
+				case tips <- struct{}{}:
+				default:
+				}
+			}
+		}()
+	}
+
+	timeout := time.After(cCtx.Duration("timeout"))
+	poll := time.NewTicker(cCtx.Duration("poll-interval"))
+	defer poll.Stop()
+	last, lastStatus := uint64(0), ""
+	for {
+		var status nakamoto.RPCTxStatus
+		if err := callNodeRPCResult(cCtx, &status, "gettxstatus", hex.EncodeToString(hash[:])); err != nil {
+			return err
+		}
+
+		if nakamoto.TxStatus(status.Status) == nakamoto.TX_STATUS_REJECTED {
+			return fmt.Errorf("Transaction rejected: %s", status.Reason)
+		}
+		if status.Status != lastStatus || status.Confirmations != last {
+			fmt.Fprintf(os.Stderr, "Status: %s, confirmations: %d/%d\n", status.Status, status.Confirmations, confirmations)
+			lastStatus, last = status.Status, status.Confirmations
+		}
+		if confirmations <= status.Confirmations {
+			return nil
+		}
+
+		select {
+		case <-tips:
+		case <-poll.C:
+		case <-timeout:
+			return fmt.Errorf("Timed out waiting for %d confirmations, the transaction has %d.", confirmations, last)
+		}
+	}
+}
+
+func ContactAdd(cCtx *cli.Context) error {
+	if cCtx.NArg() != 2 {
+		return fmt.Errorf("Usage: wallet contact add <name> <pubkey>")
+	}
+	book, err := loadContactsFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	buf, err := hex.DecodeString(cCtx.Args().Get(1))
+	if err != nil || len(buf) != 65 {
+		return fmt.Errorf("Invalid pubkey, expected 65 hex-encoded bytes: %s", cCtx.Args().Get(1))
+	}
+	return book.Add(cCtx.Args().Get(0), [65]byte(buf))
+}
+
+func ContactRemove(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("Usage: wallet contact remove <name>")
+	}
+	book, err := loadContactsFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	return book.Remove(cCtx.Args().First())
+}
+
+func ContactList(cCtx *cli.Context) error {
+	book, err := loadContactsFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	for _, contact := range book.Contacts() {
+		fmt.Printf("%s\t%s\n", contact.Name, contact.Pubkey)
+	}
+	return nil
+}
+
+func ContactImport(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("Usage: wallet contact import <file>")
+	}
+	book, err := loadContactsFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	contacts, err := nakamoto.ReadContactsFile(cCtx.Args().First())
+	if err != nil {
+		return err
+	}
+	added, err := book.Import(contacts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d new contacts\n", added)
+	return nil
+}
+
+func ContactExport(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("Usage: wallet contact export <file>")
+	}
+	book, err := loadContactsFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	contacts := book.Contacts()
+	if err := nakamoto.WriteContactsFile(cCtx.Args().First(), contacts); err != nil {
+		return err
+	}
+	fmt.Printf("Exported %d contacts\n", len(contacts))
+	return nil
+}
+
+func parseTxHashArg(s string) ([32]byte, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil || len(buf) != 32 {
+		return [32]byte{}, fmt.Errorf("Invalid tx hash, expected 32 hex-encoded bytes: %s", s)
+	}
+	return [32]byte(buf), nil
+}
+
+func LabelSet(cCtx *cli.Context) error {
+	if cCtx.NArg() != 2 || cCtx.Args().Get(1) == "" {
+		return fmt.Errorf("Usage: wallet label set <txhash> <label>")
+	}
+	hash, err := parseTxHashArg(cCtx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	labels, err := loadLabelsFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	return labels.Set(hash, cCtx.Args().Get(1))
+}
+
+func LabelRemove(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("Usage: wallet label remove <txhash>")
+	}
+	hash, err := parseTxHashArg(cCtx.Args().First())
+	if err != nil {
+		return err
+	}
+	labels, err := loadLabelsFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	return labels.Set(hash, "")
+}
+
+func LabelList(cCtx *cli.Context) error {
+	labels, err := loadLabelsFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	for _, label := range labels.Labels() {
+		fmt.Printf("%s\t%s\n", label.TxHash, label.Label)
+	}
+	return nil
+}
+
+// Exports the full history of the wallet, or of the address given by --address, to CSV.
+func WalletExportHistory(cCtx *cli.Context) error {
+	var account [65]byte
+	if address := cCtx.String("address"); address != "" {
+		var err error
+		if account, err = resolveAddress(cCtx, address); err != nil {
+			return err
+		}
+	} else {
+		wallet, err := loadWalletFlag(cCtx)
+		if err != nil {
+			return fmt.Errorf("One of --wallet or --address is required: %s", err)
+		}
+		account = wallet.PubkeyBytes()
+	}
+	labels, err := loadLabelsFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	contacts, err := loadContactsFlag(cCtx)
+	if err != nil {
+		return err
+	}
+
+	// Read the history a page at a time, newest first.
+	const pageSize = 1000
+	history := []nakamoto.RPCAddressHistoryEntry{}
+	for {
+		page := []nakamoto.RPCAddressHistoryEntry{}
+		if err := callNodeRPCResult(cCtx, &page, "getaddresshistory", hex.EncodeToString(account[:]), pageSize, len(history)); err != nil {
+			return err
+		}
+		history = append(history, page...)
+		if len(page) < pageSize {
+			break
+		}
+	}
+
+	out := os.Stdout
+	if path := cCtx.String("out"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := nakamoto.WriteHistoryCSV(out, account, history, labels, contacts); err != nil {
+		return err
+	}
+	if out != os.Stdout {
+		fmt.Fprintf(os.Stderr, "Exported %d transactions\n", len(history))
+		return out.Close()
+	}
+	return nil
+}
+
+// Writes a signed statement of the wallet's balance and history as of a block, by default the tip, as JSON.
+func WalletStatement(cCtx *cli.Context) error {
+	wallet, err := loadWalletFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	account := wallet.PubkeyBytes()
+	params := []interface{}{hex.EncodeToString(account[:])}
+	if block := cCtx.String("block"); block != "" {
+		// The block is given by its hash, or its height on the main chain.
+		if height, err := strconv.ParseUint(block, 10, 64); err == nil {
+			params = append(params, height)
+		} else {
+			params = append(params, block)
+		}
+	}
+
+	statement := nakamoto.AccountStatement{}
+	if err := callNodeRPCResult(cCtx, &statement, "getaccountstatement", params...); err != nil {
+		return err
+	}
+	if err := nakamoto.SignAccountStatement(&statement, wallet); err != nil {
+		return err
+	}
+	// Check the node's proofs before attesting to them.
+	if err := nakamoto.VerifyAccountStatement(statement); err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return err
+	}
+	if path := cCtx.String("out"); path != "" {
+		if err := os.WriteFile(path, buf, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote statement of %d transactions at height %d to %s\n", len(statement.Transactions), statement.Height, path)
+		return nil
+	}
+	fmt.Println(string(buf))
+	return nil
+}
+
+// Verifies a statement's signature and proofs, and that the node's main chain includes its block with the same
+// balance.
+func WalletVerifyStatement(cCtx *cli.Context) error {
+	if cCtx.NArg() != 1 {
+		return fmt.Errorf("Usage: wallet verify-statement <file>")
+	}
+	buf, err := os.ReadFile(cCtx.Args().First())
+	if err != nil {
+		return err
+	}
+	statement := nakamoto.AccountStatement{}
+	if err := json.Unmarshal(buf, &statement); err != nil {
+		return fmt.Errorf("Failed to decode statement: %s", err)
+	}
+	if err := nakamoto.VerifyAccountStatement(statement); err != nil {
+		return err
+	}
+
+	onChain := struct {
+		Balance uint64 `json:"balance"`
+		Hash    string `json:"hash"`
+	}{}
+	if err := callNodeRPCResult(cCtx, &onChain, "getbalanceat", hex.EncodeToString(statement.Account[:]), statement.Height); err != nil {
+		return err
+	}
+	if onChain.Hash != hex.EncodeToString(statement.BlockHash[:]) {
+		return fmt.Errorf("Block %x at height %d is not on the node's main chain.", statement.BlockHash, statement.Height)
+	}
+	if onChain.Balance != statement.Balance {
+		return fmt.Errorf("Statement balance %d doesn't match the node's balance %d.", statement.Balance, onChain.Balance)
+	}
+	fmt.Printf("Statement is valid: balance %d and %d transactions at height %d (%x)\n", statement.Balance, len(statement.Transactions), statement.Height, statement.BlockHash)
+	return nil
+}
+
+// Rescans the chain from --from-height for the transactions of the wallet, the addresses given by --address, or every
+// key in the keystore.
+func WalletRescan(cCtx *cli.Context) error {
+	addresses := []string{}
+	for _, address := range cCtx.StringSlice("address") {
+		pubkey, err := resolveAddress(cCtx, address)
+		if err != nil {
+			return err
+		}
+		addresses = append(addresses, hex.EncodeToString(pubkey[:]))
+	}
+	if cCtx.String("wallet") != "" {
+		wallet, err := loadWalletFlag(cCtx)
+		if err != nil {
+			return err
+		}
+		addresses = append(addresses, wallet.PubkeyStr())
+	}
+	if len(addresses) == 0 {
+		ks, err := loadKeystoreFlag(cCtx)
+		if err != nil {
+			return err
+		}
+		for _, key := range ks.Keys() {
+			addresses = append(addresses, key.Pubkey)
+		}
+	}
+	if len(addresses) == 0 {
+		return fmt.Errorf("No addresses to rescan. Use --wallet, --address, or import keys into the keystore.")
+	}
+
+	if cCtx.Bool("watch") {
+		for _, address := range addresses {
+			if _, err := callNodeRPC(cCtx, "watchaddress", address); err != nil {
+				return fmt.Errorf("Failed to watch %s: %s", address, err)
+			}
+		}
+	}
+
+	res := struct {
+		FromHeight    uint64                            `json:"fromHeight"`
+		ToHeight      uint64                            `json:"toHeight"`
+		BlocksScanned uint64                            `json:"blocksScanned"`
+		BlocksMatched uint64                            `json:"blocksMatched"`
+		Transactions  []nakamoto.RPCAddressHistoryEntry `json:"transactions"`
+	}{}
+	if err := callNodeRPCResult(cCtx, &res, "rescanaddresses", addresses, cCtx.Uint64("from-height")); err != nil {
+		return err
+	}
+	for _, tx := range res.Transactions {
+		fmt.Printf("%d\t%s\t%s\t%s\t%d\n", tx.Height, tx.TxHash, tx.From, tx.To, tx.Amount)
+	}
+	fmt.Fprintf(
+		os.Stderr, "Rescanned %d blocks from height %d to %d for %d addresses: %d blocks matched, %d transactions found\n",
+		res.BlocksScanned, res.FromHeight, res.ToHeight, len(addresses), res.BlocksMatched, len(res.Transactions),
+	)
+	return nil
+}
+
+// Names a key after its pubkey, for keys which aren't named by the user.
+func defaultKeyName(wallet *core.Wallet) string {
+	// Skip the uncompressed point prefix, 04.
+	return "key-" + wallet.PubkeyStr()[2:14]
+}
+
+func WalletRotate(cCtx *cli.Context) error {
+	oldWallet, err := loadWalletFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	ks, err := loadKeystoreFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	oldKey, archived := ks.FindByPubkey(oldWallet.PubkeyStr())
+	if archived && oldKey.Status == core.KEY_STATUS_RETIRED {
+		return fmt.Errorf("Key %s was already retired, replaced by %s.", oldKey.Name, oldKey.ReplacedBy)
+	}
+
+	// Build the sweep before saving anything, so a wallet which can't be swept is left as it was.
+	newWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		return err
+	}
+	newName := cCtx.String("name")
+	if newName == "" {
+		newName = defaultKeyName(newWallet)
+	}
+	tx, err := buildSweepTx(cCtx, oldWallet, newWallet.PubkeyBytes())
+	if err != nil {
+		return err
+	}
+
+	// 1. Save the new key, and archive the old key if it isn't in the keystore already.
+	if !archived {
+		oldKey.Name = defaultKeyName(oldWallet)
+		if err := ks.Import(oldKey.Name, oldWallet); err != nil {
+			return fmt.Errorf("Failed to archive the old key: %s", err)
+		}
+	}
+	if err := ks.Import(newName, newWallet); err != nil {
+		return fmt.Errorf("Failed to save the new key: %s", err)
+	}
+	fmt.Fprintf(os.Stderr, "Step 1/3: Created key %s with pubkey %s, saved to %s\n", newName, newWallet.PubkeyStr(), ks.KeyPath(newName))
+
+	// 2. Sweep the old key's balance to the new key, and wait for it to confirm.
+	if tx == nil {
+		fmt.Fprintf(os.Stderr, "Step 2/3: The old key has no spendable balance to sweep\n")
+	} else {
+		hash, err := sendTx(cCtx, oldWallet, *tx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Step 2/3: Sweeping %d with a fee of %d in transaction %s\n", tx.Amount, tx.Fee, hex.EncodeToString(hash[:]))
+		confirmations := max(cCtx.Uint64("wait-confirmations"), 1)
+		if err := waitForConfirmations(cCtx, hash, confirmations); err != nil {
+			return fmt.Errorf("%s\nThe new key is saved. Once the sweep confirms, retire the old key with: wallet keys retire %s %s", err, oldKey.Name, newName)
+		}
+	}
+
+	// 3. Retire the old key.
+	if err := ks.Retire(oldKey.Name, newName); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Step 3/3: Retired key %s. Use the new key from now on\n", oldKey.Name)
+	fmt.Println(ks.KeyPath(newName))
+	return nil
+}
+
+func KeysList(cCtx *cli.Context) error {
+	ks, err := loadKeystoreFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	for _, key := range ks.Keys() {
+		line := fmt.Sprintf("%s\t%s\t%s", key.Name, key.Status, key.Pubkey)
+		if key.Status == core.KEY_STATUS_RETIRED {
+			line += fmt.Sprintf("\treplaced by %s", key.ReplacedBy)
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func KeysRetire(cCtx *cli.Context) error {
+	if cCtx.NArg() != 2 {
+		return fmt.Errorf("Usage: wallet keys retire <name> <replaced-by>")
+	}
+	ks, err := loadKeystoreFlag(cCtx)
+	if err != nil {
+		return err
+	}
+	return ks.Retire(cCtx.Args().Get(0), cCtx.Args().Get(1))
+}
@@ -3,11 +3,94 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
 	"github.com/liamzebedee/tinychain-go/cli/cmd"
+	"github.com/liamzebedee/tinychain-go/core/bench"
+	"github.com/liamzebedee/tinychain-go/core/faucet"
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/liamzebedee/tinychain-go/core/sim"
 	"github.com/urfave/cli/v2"
 )
 
+// Flags for commands which call the JSON-RPC API of a running node.
+var rpcClientFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "rpc-url",
+		Usage: "The URL of the node's API",
+		Value: "http://127.0.0.1:8081",
+	},
+	&cli.StringFlag{
+		Name:  "rpc-token",
+		Usage: "Bearer token for mutating RPC methods",
+		Value: "",
+	},
+}
+
+// The flags of the wallet commands.
+var walletFlag = &cli.StringFlag{
+	Name:  "wallet",
+	Usage: "The path to a file containing the hex-encoded private key of the sender",
+	Value: "",
+}
+
+var contactsFlag = &cli.StringFlag{
+	Name:  "contacts",
+	Usage: "The path to the address book. Defaults to ~/.tinychain/contacts.json",
+	Value: "",
+}
+
+var labelsFlag = &cli.StringFlag{
+	Name:  "labels",
+	Usage: "The path to the transaction labels. Defaults to ~/.tinychain/labels.json",
+	Value: "",
+}
+
+var keystoreFlag = &cli.StringFlag{
+	Name:  "keystore",
+	Usage: "The path to the keystore directory. Defaults to ~/.tinychain/keystore",
+	Value: "",
+}
+
+var walletWaitFlags = []cli.Flag{
+	&cli.Uint64Flag{
+		Name:  "wait-confirmations",
+		Usage: "Wait until the transaction has this many confirmations before exiting. Zero doesn't wait",
+		Value: 0,
+	},
+	&cli.DurationFlag{
+		Name:  "timeout",
+		Usage: "How long to wait for the confirmations before failing",
+		Value: 10 * time.Minute,
+	},
+	&cli.StringFlag{
+		Name:  "sub-addr",
+		Usage: "The node's notification address (its --pub-addr), to check the transaction on each new tip rather than polling",
+		Value: "",
+	},
+	&cli.DurationFlag{
+		Name:  "poll-interval",
+		Usage: "How often to check the transaction's confirmations",
+		Value: 5 * time.Second,
+	},
+}
+
+// The database path flag, for the db commands.
+var dbFlag = &cli.StringFlag{
+	Name:  "db",
+	Usage: "The path to the tinychain database",
+	Value: "tinychain.db",
+}
+
+// Flags for the benchmark commands.
+var benchFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "json",
+		Usage: "Print the reports as JSON",
+		Value: false,
+	},
+}
+
 func main() {
 	app := &cli.App{
 		Name:                 "tinychain",
@@ -19,26 +102,764 @@ func main() {
 				Usage:  "runs the tinychain node",
 				Action: cmd.RunNode,
 				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "config",
+						Usage: "A JSON file of flag names and values, ie. generated by devnet init. Flags given on the command line take precedence",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "genesis",
+						Usage: "A JSON file with the consensus config of the network, over the defaults",
+						Value: "",
+					},
 					&cli.StringFlag{
 						Name:  "port",
 						Usage: "The port to run the node on",
 						Value: "8080",
 					},
+					&cli.StringFlag{
+						Name:  "rpc-port",
+						Usage: "The port to run the node's API (GraphQL, JSON-RPC) on. Disabled if empty",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "rpc-token",
+						Usage: "Bearer token required for mutating RPC methods",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "rpc-user",
+						Usage: "HTTP basic auth username required for mutating RPC methods",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "rpc-password",
+						Usage: "HTTP basic auth password required for mutating RPC methods",
+						Value: "",
+					},
+					&cli.Float64Flag{
+						Name:  "rpc-rate-limit",
+						Usage: "Per-IP rate limit for the API, in requests per second. 0 disables rate limiting",
+						Value: 0,
+					},
+					&cli.IntFlag{
+						Name:  "rpc-rate-limit-burst",
+						Usage: "The number of requests a client can burst above the rate limit",
+						Value: 10,
+					},
+					&cli.StringFlag{
+						Name:  "rpc-cors",
+						Usage: "A list of comma-separated origins allowed to make cross-origin API requests, or \"*\" for all",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "rpc-tls-cert",
+						Usage: "TLS certificate file for serving the API over HTTPS",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "rpc-tls-key",
+						Usage: "TLS key file for serving the API over HTTPS",
+						Value: "",
+					},
 					&cli.StringFlag{
 						Name:  "db",
 						Usage: "The path to the tinychain database",
 						Value: "tinychain.db",
 					},
+					&cli.StringFlag{
+						Name:  "identity",
+						Usage: "The path to the node's identity key, which is created if it doesn't exist. Defaults to the database path with an .identity extension",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "contacts",
+						Usage: "The path to the node's address book, whose contact names the API accepts in place of pubkeys. Defaults to the database path with a .contacts extension",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "dht-table",
+						Usage: "The path the DHT routing table is saved to, and loaded from on startup. Defaults to the database path with a .dht extension",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "known-inventory",
+						Usage: "The path the recently seen block and transaction hashes are saved to, and loaded from on startup. Defaults to the database path with a .known extension",
+						Value: "",
+					},
 					&cli.StringFlag{
 						Name:  "peers",
 						Usage: "A list of comma-separated peer URL's used to bootstrap connection to the network",
 						Value: "",
 					},
+					&cli.IntFlag{
+						Name:  "heartbeat-interval",
+						Usage: "The interval between heartbeats sent to peers, in seconds",
+						Value: 30,
+					},
+					&cli.IntFlag{
+						Name:  "heartbeat-timeout",
+						Usage: "Disconnect peers which haven't responded to a heartbeat within this many seconds",
+						Value: 90,
+					},
+					&cli.IntFlag{
+						Name:  "stale-tip-timeout",
+						Usage: "Disconnect peers whose tip is behind ours and hasn't advanced within this many seconds",
+						Value: 30 * 60,
+					},
+					&cli.IntFlag{
+						Name:  "target-peers",
+						Usage: "The number of outbound peers to maintain connections to",
+						Value: 8,
+					},
+					&cli.IntFlag{
+						Name:  "max-peers",
+						Usage: "The maximum number of peers, inbound and outbound",
+						Value: 32,
+					},
+					&cli.IntFlag{
+						Name:  "min-outbound-peers",
+						Usage: "The number of peer slots reserved for outbound peers",
+						Value: 8,
+					},
+					&cli.BoolFlag{
+						Name:  "blocks-only",
+						Usage: "Don't accept or relay unconfirmed transactions from peers, to minimise bandwidth",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "tx-filter",
+						Usage: "A list of comma-separated pubkeys. If set, peers only relay unconfirmed transactions to or from them, to minimise bandwidth. Peers learn which addresses you're interested in",
+						Value: "",
+					},
+					&cli.Float64Flag{
+						Name:  "tx-filter-fp-rate",
+						Usage: "The false positive rate of the transaction filter. Higher rates hide your addresses among more unrelated transactions, at the cost of bandwidth",
+						Value: 0.001,
+					},
+					&cli.StringFlag{
+						Name:  "inbound-allow",
+						Usage: "A list of comma-separated CIDR ranges or IPs. If set, only hosts in these ranges can connect to the node",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "inbound-deny",
+						Usage: "A list of comma-separated CIDR ranges or IPs which can't connect to the node",
+						Value: "",
+					},
+					&cli.BoolFlag{
+						Name:  "private-network",
+						Usage: "Only connect to the configured peers, and don't share peers with them",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "externaladdr",
+						Usage: "Comma-separated addresses to advertise to peers, as host or host:port, instead of discovering them over STUN. At most one IPv4 address or hostname and one IPv6 address, sharing a port",
+						Value: "",
+					},
+					&cli.BoolFlag{
+						Name:  "nodiscoverip",
+						Usage: "Don't discover the node's external addresses over STUN. Without --externaladdr, the node doesn't advertise an address to peers",
+						Value: false,
+					},
+					&cli.BoolFlag{
+						Name:  "noquic",
+						Usage: "Don't accept peer messages over QUIC, only over TCP",
+						Value: false,
+					},
+					&cli.BoolFlag{
+						Name:  "libp2p",
+						Usage: "Connect to peers over libp2p, instead of the tinychain wire protocol. Bootstrap peers are multiaddrs",
+						Value: false,
+					},
+					&cli.IntFlag{
+						Name:  "block-queue-capacity",
+						Usage: "The maximum number of blocks from peers waiting to be ingested. Peers are told to back off when it's full",
+						Value: nakamoto.DEFAULT_BLOCK_QUEUE_CAPACITY,
+					},
+					&cli.Uint64Flag{
+						Name:  "min-relay-fee",
+						Usage: "The minimum fee per byte for transactions to be accepted into the mempool and relayed",
+						Value: nakamoto.DEFAULT_MIN_RELAY_FEE_PER_BYTE,
+					},
+					&cli.Uint64Flag{
+						Name:  "dust-threshold",
+						Usage: "Reject transactions transferring less than this amount from the mempool and relay",
+						Value: nakamoto.DEFAULT_DUST_THRESHOLD,
+					},
+					&cli.Uint64Flag{
+						Name:  "fork-alert-depth",
+						Usage: "Warn of competing branches and reorgs at least this many blocks deep",
+						Value: 6,
+					},
+					&cli.Float64Flag{
+						Name:  "fork-alert-work-share",
+						Usage: "Warn of competing branches with at least this share of the main chain's work since the fork",
+						Value: 0.5,
+					},
+					&cli.Uint64Flag{
+						Name:  "finality-depth",
+						Usage: "Finalize blocks this many blocks below the tip, and refuse reorgs away from them. Zero disables finality",
+						Value: nakamoto.DEFAULT_FINALITY_DEPTH,
+					},
+					&cli.BoolFlag{
+						Name:  "allow-deep-reorgs",
+						Usage: "Allow reorgs deeper than the finality depth",
+						Value: false,
+					},
+					&cli.Uint64Flag{
+						Name:  "max-reorg-depth",
+						Usage: "Quarantine reorgs deeper than this many blocks for review, instead of switching to them. Zero disables the limit",
+						Value: 0,
+					},
+					&cli.IntFlag{
+						Name:  "max-clock-drift",
+						Usage: "Warn when the local clock is off from the network's by more than this many seconds",
+						Value: int(nakamoto.DEFAULT_MAX_CLOCK_DRIFT / time.Second),
+					},
+					&cli.IntFlag{
+						Name:  "db-maintenance-interval",
+						Usage: "How often to vacuum, analyze and reindex the database while the node is idle, in seconds. 0 disables maintenance",
+						Value: int(nakamoto.DEFAULT_DB_MAINTENANCE_INTERVAL / time.Second),
+					},
+					&cli.IntFlag{
+						Name:  "audit-interval",
+						Usage: "How often to re-verify a random block of the main chain against its stored data, to catch database corruption, in seconds. 0 disables the auditor",
+						Value: 0,
+					},
+					&cli.StringFlag{
+						Name:  "analytics-windows",
+						Usage: "A list of comma-separated windows, in blocks, to compute the chain statistics served at /metrics over",
+						Value: "10,100,1000",
+					},
+					&cli.StringFlag{
+						Name:  "pub-addr",
+						Usage: "Publish block and transaction notifications to subscribers on this TCP address, ie. 127.0.0.1:28332",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "pub-topics",
+						Usage: "The notification topics to publish (rawblock, rawtx, hashtip, hashfinalized, event)",
+						Value: "rawblock,rawtx,hashtip",
+					},
 					&cli.BoolFlag{
 						Name:  "miner",
 						Usage: "Run the miner",
 						Value: false,
 					},
+					&cli.IntFlag{
+						Name:  "miner-threads",
+						Usage: "The number of threads to mine with. The miner can also be started and stopped over RPC",
+						Value: 1,
+					},
+					&cli.StringFlag{
+						Name:  "miner-tip-policy",
+						Usage: "Which of the blocks competing for the same height to mine on: most-work, first-seen or last-seen",
+						Value: nakamoto.TIP_POLICY_MOST_WORK,
+					},
+					&cli.BoolFlag{
+						Name:  "miner-prefer-own-txs",
+						Usage: "Prefer mining on competing blocks which include transactions sent by the miner wallet",
+						Value: false,
+					},
+					&cli.StringFlag{
+						Name:  "miner-wallet",
+						Usage: "The path to a file containing the hex-encoded private key the miner is rewarded to. Defaults to a random wallet",
+						Value: "",
+					},
+				},
+			},
+			{
+				Name:      "invalidateblock",
+				Usage:     "marks a block and its descendants as invalid on a running node, reorging away from it",
+				ArgsUsage: "<hash>",
+				Action:    cmd.InvalidateBlock,
+				Flags:     rpcClientFlags,
+			},
+			{
+				Name:      "reconsiderblock",
+				Usage:     "removes the invalid mark from a block on a running node, reversing invalidateblock",
+				ArgsUsage: "<hash>",
+				Action:    cmd.ReconsiderBlock,
+				Flags:     rpcClientFlags,
+			},
+			{
+				Name:      "watchaddress",
+				Usage:     "registers an address with a running node, which then reports its incoming and outgoing transfers",
+				ArgsUsage: "<pubkey>",
+				Action:    cmd.WatchAddress,
+				Flags: append([]cli.Flag{
+					contactsFlag,
+					&cli.StringFlag{
+						Name:  "webhook",
+						Usage: "A URL the node POSTs the address's transfers to, as JSON",
+						Value: "",
+					},
+				}, rpcClientFlags...),
+			},
+			{
+				Name:  "wallet",
+				Usage: "signs transactions with a local key file, and submits them to a running node",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "send",
+						Usage:  "sends coins, optionally waiting until the transfer is confirmed",
+						Action: cmd.WalletSend,
+						Flags: append(append([]cli.Flag{
+							walletFlag,
+							contactsFlag,
+							&cli.StringFlag{
+								Name:  "to",
+								Usage: "The hex-encoded pubkey, or contact name, of the recipient",
+								Value: "",
+							},
+							&cli.Uint64Flag{
+								Name:  "amount",
+								Usage: "The amount to send",
+								Value: 0,
+							},
+							&cli.Uint64Flag{
+								Name:  "fee",
+								Usage: "The fee paid. If zero, the fee is estimated by the node",
+								Value: 0,
+							},
+						}, walletWaitFlags...), rpcClientFlags...),
+					},
+					{
+						Name:      "sweep",
+						Usage:     "sends the wallet's whole spendable balance, less the fee, emptying it",
+						ArgsUsage: "<dest>",
+						Action:    cmd.WalletSweep,
+						Flags: append(append([]cli.Flag{
+							walletFlag,
+							contactsFlag,
+							&cli.Uint64Flag{
+								Name:  "fee",
+								Usage: "The fee paid, deducted from the balance. If zero, the fee is estimated by the node",
+								Value: 0,
+							},
+						}, walletWaitFlags...), rpcClientFlags...),
+					},
+					{
+						Name:   "rotate",
+						Usage:  "replaces the wallet's key with a new key in the keystore, sweeping its balance and retiring it once the sweep has at least one confirmation",
+						Action: cmd.WalletRotate,
+						Flags: append(append([]cli.Flag{
+							walletFlag,
+							keystoreFlag,
+							&cli.StringFlag{
+								Name:  "name",
+								Usage: "The name of the new key. Defaults to one derived from its pubkey",
+							},
+							&cli.Uint64Flag{
+								Name:  "fee",
+								Usage: "The fee paid for the sweep, deducted from the balance. If zero, the fee is estimated by the node",
+								Value: 0,
+							},
+						}, walletWaitFlags...), rpcClientFlags...),
+					},
+					{
+						Name:  "keys",
+						Usage: "manages the keystore",
+						Subcommands: []*cli.Command{
+							{
+								Name:   "list",
+								Usage:  "lists the keys and their status",
+								Action: cmd.KeysList,
+								Flags:  []cli.Flag{keystoreFlag},
+							},
+							{
+								Name:      "retire",
+								Usage:     "marks a key retired, replaced by another key",
+								ArgsUsage: "<name> <replaced-by>",
+								Action:    cmd.KeysRetire,
+								Flags:     []cli.Flag{keystoreFlag},
+							},
+						},
+					},
+					{
+						Name:  "label",
+						Usage: "manages local labels attached to transactions, which are included in exported history",
+						Subcommands: []*cli.Command{
+							{
+								Name:      "set",
+								Usage:     "labels a transaction",
+								ArgsUsage: "<txhash> <label>",
+								Action:    cmd.LabelSet,
+								Flags:     []cli.Flag{labelsFlag},
+							},
+							{
+								Name:      "remove",
+								Usage:     "removes the label of a transaction",
+								ArgsUsage: "<txhash>",
+								Action:    cmd.LabelRemove,
+								Flags:     []cli.Flag{labelsFlag},
+							},
+							{
+								Name:   "list",
+								Usage:  "lists the labelled transactions",
+								Action: cmd.LabelList,
+								Flags:  []cli.Flag{labelsFlag},
+							},
+						},
+					},
+					{
+						Name:   "export-history",
+						Usage:  "exports the wallet's history, with labels, to CSV",
+						Action: cmd.WalletExportHistory,
+						Flags: append([]cli.Flag{
+							walletFlag,
+							contactsFlag,
+							labelsFlag,
+							&cli.StringFlag{
+								Name:  "address",
+								Usage: "The address to export the history of, instead of the wallet's",
+							},
+							&cli.StringFlag{
+								Name:  "out",
+								Usage: "The file to write the CSV to. Defaults to stdout",
+							},
+						}, rpcClientFlags...),
+					},
+					{
+						Name:   "statement",
+						Usage:  "writes a statement of the wallet's balance and history as of a block, with proofs, signed by the wallet",
+						Action: cmd.WalletStatement,
+						Flags: append([]cli.Flag{
+							walletFlag,
+							&cli.StringFlag{
+								Name:  "block",
+								Usage: "The hash, or height on the main chain, of the block the statement is as of. Defaults to the tip",
+							},
+							&cli.StringFlag{
+								Name:  "out",
+								Usage: "The file to write the statement to. Defaults to stdout",
+							},
+						}, rpcClientFlags...),
+					},
+					{
+						Name:   "rescan",
+						Usage:  "replays the chain from a height through the block filters, to discover the historical transactions of newly imported keys or watched addresses",
+						Action: cmd.WalletRescan,
+						Flags: append([]cli.Flag{
+							walletFlag,
+							contactsFlag,
+							keystoreFlag,
+							&cli.StringSliceFlag{
+								Name:  "address",
+								Usage: "An address to rescan for, ie. a watch-only address. Can be repeated. Defaults to the wallet, or every key in the keystore",
+							},
+							&cli.Uint64Flag{
+								Name:  "from-height",
+								Usage: "The height to rescan from",
+								Value: 0,
+							},
+							&cli.BoolFlag{
+								Name:  "watch",
+								Usage: "Watch the addresses on the node before rescanning, so their transfers are recorded as its activity",
+								Value: false,
+							},
+						}, rpcClientFlags...),
+					},
+					{
+						Name:      "verify-statement",
+						Usage:     "verifies a statement's signature and proofs, and that the node agrees on its block and balance",
+						ArgsUsage: "<file>",
+						Action:    cmd.WalletVerifyStatement,
+						Flags:     rpcClientFlags,
+					},
+					{
+						Name:  "contact",
+						Usage: "manages the address book of named recipients, which can be used wherever an address is accepted",
+						Subcommands: []*cli.Command{
+							{
+								Name:      "add",
+								Usage:     "adds a contact",
+								ArgsUsage: "<name> <pubkey>",
+								Action:    cmd.ContactAdd,
+								Flags:     []cli.Flag{contactsFlag},
+							},
+							{
+								Name:      "remove",
+								Usage:     "removes a contact",
+								ArgsUsage: "<name>",
+								Action:    cmd.ContactRemove,
+								Flags:     []cli.Flag{contactsFlag},
+							},
+							{
+								Name:   "list",
+								Usage:  "lists the contacts",
+								Action: cmd.ContactList,
+								Flags:  []cli.Flag{contactsFlag},
+							},
+							{
+								Name:      "import",
+								Usage:     "imports contacts from a file exported by export, adding them to the address book",
+								ArgsUsage: "<file>",
+								Action:    cmd.ContactImport,
+								Flags:     []cli.Flag{contactsFlag},
+							},
+							{
+								Name:      "export",
+								Usage:     "exports the contacts to a file",
+								ArgsUsage: "<file>",
+								Action:    cmd.ContactExport,
+								Flags:     []cli.Flag{contactsFlag},
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:   "top",
+				Usage:  "shows a live dashboard of a running node's sync progress, peers, mempool, hashrate and logs",
+				Action: cmd.RunTop,
+				Flags: append([]cli.Flag{
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "How often to refresh the dashboard",
+						Value: 2 * time.Second,
+					},
+				}, rpcClientFlags...),
+			},
+			{
+				Name:  "db",
+				Usage: "backs up, restores and checks the node database",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "backup",
+						Usage:     "takes a consistent backup of the database, which can be done while the node is running",
+						ArgsUsage: "<path>",
+						Action:    cmd.BackupDB,
+						Flags:     []cli.Flag{dbFlag},
+					},
+					{
+						Name:      "restore",
+						Usage:     "restores the database from a backup, after checking its integrity. The node must be stopped",
+						ArgsUsage: "<path>",
+						Action:    cmd.RestoreDB,
+						Flags: []cli.Flag{
+							dbFlag,
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "Overwrite the database if it exists",
+								Value: false,
+							},
+						},
+					},
+					{
+						Name:   "compact",
+						Usage:  "rewrites the database to reclaim free space and enable incremental vacuums. The node should be stopped",
+						Action: cmd.CompactDB,
+						Flags:  []cli.Flag{dbFlag},
+					},
+					{
+						Name:      "verify",
+						Usage:     "checks the integrity of the database, or of a backup",
+						ArgsUsage: "[path]",
+						Action:    cmd.VerifyDB,
+						Flags:     []cli.Flag{dbFlag},
+					},
+				},
+			},
+			{
+				Name:  "bench",
+				Usage: "measures the performance of mining, block ingestion and signature verification on this machine",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "pow",
+						Usage:  "measures the proof-of-work hash rate",
+						Action: cmd.BenchPOW,
+						Flags: append([]cli.Flag{
+							&cli.DurationFlag{
+								Name:  "duration",
+								Usage: "How long to run each mining loop for",
+								Value: bench.DEFAULT_POW_DURATION,
+							},
+							&cli.IntFlag{
+								Name:  "batch-size",
+								Usage: "The number of nonces to precompute at a time",
+								Value: bench.DEFAULT_POW_BATCH_SIZE,
+							},
+						}, benchFlags...),
+					},
+					{
+						Name:   "ingest",
+						Usage:  "measures block ingestion throughput",
+						Action: cmd.BenchIngest,
+						Flags: append([]cli.Flag{
+							&cli.IntFlag{
+								Name:  "blocks",
+								Usage: "The number of blocks to ingest",
+								Value: bench.DEFAULT_INGEST_BLOCKS,
+							},
+							&cli.IntFlag{
+								Name:  "txs-per-block",
+								Usage: "The number of transactions in each block, besides the coinbase",
+								Value: bench.DEFAULT_INGEST_TXS_PER_BLOCK,
+							},
+						}, benchFlags...),
+					},
+					{
+						Name:   "sign",
+						Usage:  "measures transaction signing and signature verification throughput",
+						Action: cmd.BenchSign,
+						Flags: append([]cli.Flag{
+							&cli.IntFlag{
+								Name:  "count",
+								Usage: "The number of transactions to sign and verify",
+								Value: bench.DEFAULT_SIGN_COUNT,
+							},
+						}, benchFlags...),
+					},
+				},
+			},
+			{
+				Name:   "faucet",
+				Usage:  "runs a faucet, which dispenses coins from a funded wallet on test networks over HTTP",
+				Action: cmd.RunFaucet,
+				Flags: append([]cli.Flag{
+					&cli.StringFlag{
+						Name:  "addr",
+						Usage: "The address the faucet listens on",
+						Value: "127.0.0.1:8090",
+					},
+					&cli.StringFlag{
+						Name:  "wallet",
+						Usage: "The path to a file containing the hex-encoded private key of the funded wallet",
+						Value: "",
+					},
+					&cli.Uint64Flag{
+						Name:  "amount",
+						Usage: "The amount dispensed per request",
+						Value: faucet.DefaultConfig().Amount,
+					},
+					&cli.Uint64Flag{
+						Name:  "fee",
+						Usage: "The fee paid per transaction. If zero, the fee is estimated by the node",
+						Value: faucet.DefaultConfig().Fee,
+					},
+					&cli.DurationFlag{
+						Name:  "cooldown",
+						Usage: "How long a client IP, and a recipient address, must wait between requests",
+						Value: faucet.DefaultConfig().Cooldown,
+					},
+					&cli.Uint64Flag{
+						Name:  "daily-limit",
+						Usage: "The maximum amount dispensed in any 24 hours. Zero means no limit",
+						Value: faucet.DefaultConfig().DailyLimit,
+					},
+					&cli.StringFlag{
+						Name:  "captcha-secret",
+						Usage: "The secret key of the captcha service. If set, requests must include a valid captcha response",
+						Value: "",
+					},
+					&cli.StringFlag{
+						Name:  "captcha-verify-url",
+						Usage: "The siteverify URL of the captcha service, or one of hcaptcha, recaptcha and turnstile",
+						Value: "hcaptcha",
+					},
+					&cli.StringFlag{
+						Name:  "client-ip-header",
+						Usage: "The header the client IP is read from behind a reverse proxy, ie. X-Forwarded-For",
+						Value: "",
+					},
+				}, rpcClientFlags...),
+			},
+			{
+				Name:  "devnet",
+				Usage: "sets up a local multi-node network for testing",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "init",
+						Usage:     "generates deterministic wallets, a genesis config funding them, and a config for each node",
+						ArgsUsage: "<dir>",
+						Action:    cmd.RunDevnetInit,
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:  "nodes",
+								Usage: "The number of nodes",
+								Value: 3,
+							},
+							&cli.StringFlag{
+								Name:  "seed",
+								Usage: "The seed the wallets are derived from",
+								Value: "devnet",
+							},
+							&cli.Uint64Flag{
+								Name:  "alloc",
+								Usage: "The balance each wallet is funded with in the genesis config",
+								Value: 1000000000000,
+							},
+							&cli.IntFlag{
+								Name:  "base-port",
+								Usage: "The port of the first node. Each node listens on the next port",
+								Value: 9000,
+							},
+							&cli.IntFlag{
+								Name:  "rpc-base-port",
+								Usage: "The API port of the first node. Each node serves its API on the next port",
+								Value: 9100,
+							},
+							&cli.IntFlag{
+								Name:  "miners",
+								Usage: "The number of nodes which run the miner",
+								Value: 1,
+							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "Overwrite the files if they exist",
+								Value: false,
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:   "sim",
+				Usage:  "simulates mining against an adversary with a share of the hashrate, and reports the chain quality",
+				Action: cmd.RunSimulation,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "strategy",
+						Usage: "The adversary's strategy (honest, selfish, withhold, deepreorg)",
+						Value: string(sim.DefaultConfig().Strategy),
+					},
+					&cli.Float64Flag{
+						Name:  "adversary-share",
+						Usage: "The adversary's share of the hashrate, between 0 and 1",
+						Value: sim.DefaultConfig().AdversaryShare,
+					},
+					&cli.IntFlag{
+						Name:  "blocks",
+						Usage: "The number of blocks to mine",
+						Value: sim.DefaultConfig().Blocks,
+					},
+					&cli.Int64Flag{
+						Name:  "seed",
+						Usage: "The seed for deciding who mines each block",
+						Value: sim.DefaultConfig().Seed,
+					},
+					&cli.IntFlag{
+						Name:  "withhold-blocks",
+						Usage: "The number of blocks the withhold strategy releases at once",
+						Value: sim.DefaultConfig().WithholdBlocks,
+					},
+					&cli.IntFlag{
+						Name:  "reorg-depth",
+						Usage: "The depth of the reorgs the deepreorg strategy attempts",
+						Value: sim.DefaultConfig().ReorgDepth,
+					},
+					&cli.IntFlag{
+						Name:  "give-up-blocks",
+						Usage: "How many blocks the deepreorg strategy can fall behind before abandoning an attempt",
+						Value: sim.DefaultConfig().GiveUpBlocks,
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "Print the report as JSON",
+						Value: false,
+					},
 				},
 			},
 		},
@@ -0,0 +1,85 @@
+// Package bench measures the performance of the node's hot paths on the local machine: proof-of-work hashing, block
+// ingestion and signature verification. Each benchmark returns a set of reports, which are printed in the same format
+// so that runs on different machines, or before and after a change, can be compared directly.
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// A measurement of how many operations ran in a given time.
+type Report struct {
+	// The name of the measurement, ie. "pow/naive".
+	Name string `json:"name"`
+
+	// The number of operations, and their unit, ie. "hashes".
+	Ops  uint64 `json:"ops"`
+	Unit string `json:"unit"`
+
+	Elapsed time.Duration `json:"elapsed_ns"`
+}
+
+// Returns the number of operations per second.
+func (r Report) Rate() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Elapsed.Seconds()
+}
+
+// Returns the mean time per operation.
+func (r Report) PerOp() time.Duration {
+	if r.Ops == 0 {
+		return 0
+	}
+	return r.Elapsed / time.Duration(r.Ops)
+}
+
+// The machine the benchmarks ran on.
+type Environment struct {
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	NumCPU    int    `json:"num_cpu"`
+}
+
+func GetEnvironment() Environment {
+	return Environment{
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		NumCPU:    runtime.NumCPU(),
+	}
+}
+
+// Prints the reports as a table, preceded by the environment.
+func PrintReports(w io.Writer, reports []Report) error {
+	env := GetEnvironment()
+	p := message.NewPrinter(language.English)
+
+	fmt.Fprintf(w, "%s %s/%s cpus=%d\n\n", env.GoVersion, env.OS, env.Arch, env.NumCPU)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "benchmark\tops\telapsed\trate\tper op\t")
+	for _, r := range reports {
+		p.Fprintf(tw, "%s\t%d %s\t%s\t%.2f %s/s\t%s\t\n", r.Name, r.Ops, r.Unit, r.Elapsed.Round(time.Millisecond), r.Rate(), r.Unit, r.PerOp())
+	}
+	return tw.Flush()
+}
+
+// Prints the reports and environment as JSON, for tooling.
+func PrintReportsJSON(w io.Writer, reports []Report) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Environment Environment `json:"environment"`
+		Reports     []Report    `json:"reports"`
+	}{GetEnvironment(), reports})
+}
@@ -0,0 +1,39 @@
+package bench
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBenchmarks(t *testing.T) {
+	assert := assert.New(t)
+	nakamoto.SetLogOutput(io.Discard)
+
+	pow, err := BenchPOW(50*time.Millisecond, 256)
+	assert.Nil(err)
+	ingest, err := BenchIngest(5, 10)
+	assert.Nil(err)
+	sign, err := BenchSign(20)
+	assert.Nil(err)
+
+	reports := append(append(pow, ingest...), sign...)
+	assert.Equal(7, len(reports))
+	for _, r := range reports {
+		assert.Less(uint64(0), r.Ops, r.Name)
+	}
+	assert.Equal(uint64(5), ingest[0].Ops)
+	assert.Equal(uint64(5*11), ingest[1].Ops)
+
+	buf := new(bytes.Buffer)
+	assert.Nil(PrintReports(buf, reports))
+	assert.Contains(buf.String(), "pow/precomputed")
+	assert.Contains(buf.String(), "sign/verify-cached")
+
+	_, err = BenchPOW(time.Millisecond, 0)
+	assert.NotNil(err)
+}
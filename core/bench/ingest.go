@@ -0,0 +1,182 @@
+package bench
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+)
+
+// The ingestion benchmark mines a chain of blocks full of signed transfers into one in-memory DAG, and then measures
+// how quickly a fresh DAG ingests them. This covers the block validation path a syncing node runs: signature
+// verification, the merkle root, proof-of-work and the database writes. Transactions aren't executed, since the state
+// machine is a no-op.
+
+const (
+	DEFAULT_INGEST_BLOCKS        = 100
+	DEFAULT_INGEST_TXS_PER_BLOCK = 100
+)
+
+type noopStateMachine struct{}
+
+func (m *noopStateMachine) VerifyTx(tx nakamoto.RawTransaction) error {
+	return nil
+}
+func (m *noopStateMachine) ExecuteBlock(block nakamoto.Block) error {
+	return nil
+}
+func (m *noopStateMachine) StateRoot() [32]byte {
+	return [32]byte{}
+}
+func (m *noopStateMachine) Snapshot() nakamoto.SnapshotID {
+	return 0
+}
+func (m *noopStateMachine) RevertTo(snapshot nakamoto.SnapshotID) error {
+	return nil
+}
+
+func newMemoryBlockDAG() (*nakamoto.BlockDAG, error) {
+	db, err := nakamoto.OpenDB(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // :memory: only
+
+	genesisDifficulty := new(big.Int)
+	genesisDifficulty.SetString("0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+
+	conf := nakamoto.ConsensusConfig{
+		// A single epoch, so the difficulty stays easy.
+		EpochLengthBlocks:       1 << 32,
+		TargetEpochLengthMillis: 1000,
+		GenesisDifficulty:       *genesisDifficulty,
+		GenesisParentBlockHash:  nakamoto.HexStringToBytes32("000006b15d1327d67e971d1de9116bd60a3a01556c91b6ebaa416ebc0cfaa646"),
+		MaxBlockSizeBytes:       2 * 1024 * 1024, // 2MB
+	}
+
+	dag, err := nakamoto.NewBlockDAGFromDB(db, &noopStateMachine{}, conf)
+	if err != nil {
+		return nil, err
+	}
+	return &dag, nil
+}
+
+// Mines a block on the DAG's tip including the given transactions.
+func mineBlock(dag *nakamoto.BlockDAG, miner *core.Wallet, txs []nakamoto.RawTransaction) (nakamoto.RawBlock, error) {
+	tip, err := dag.GetLatestFullTip()
+	if err != nil {
+		return nakamoto.RawBlock{}, err
+	}
+	version, err := dag.ComputeBlockVersion(tip)
+	if err != nil {
+		return nakamoto.RawBlock{}, err
+	}
+	epoch, err := dag.GetEpochForBlockHash(tip.Hash)
+	if err != nil {
+		return nakamoto.RawBlock{}, err
+	}
+
+	raw := nakamoto.RawBlock{
+		BlockHeader: nakamoto.BlockHeader{
+			ParentHash:      tip.Hash,
+			ParentTotalWork: nakamoto.BigIntToBytes32(tip.AccumulatedWork),
+			Timestamp:       nakamoto.Timestamp(),
+			BaseFee:         dag.GetNextBaseFee(tip),
+			Version:         version,
+		},
+		Transactions: append([]nakamoto.RawTransaction{nakamoto.MakeCoinbaseTx(miner)}, txs...),
+	}
+	envelopes := [][]byte{}
+	for _, tx := range raw.Transactions {
+		envelopes = append(envelopes, tx.Envelope())
+	}
+	raw.NumTransactions = uint64(len(raw.Transactions))
+	raw.TransactionsMerkleRoot = core.ComputeMerkleHash(envelopes)
+
+	solution, err := nakamoto.SolvePOW(raw, *big.NewInt(0), epoch.Difficulty, 0)
+	if err != nil {
+		return nakamoto.RawBlock{}, err
+	}
+	raw.SetNonce(solution)
+
+	if err := dag.IngestBlock(raw); err != nil {
+		return nakamoto.RawBlock{}, err
+	}
+	return raw, nil
+}
+
+// Makes n signed transfers from the wallet, starting at the given nonce.
+func makeTransfers(wallet *core.Wallet, startNonce uint64, n int) ([]nakamoto.RawTransaction, error) {
+	txs := make([]nakamoto.RawTransaction, n)
+	for i := range txs {
+		tx := nakamoto.RawTransaction{
+			Version:    1,
+			FromPubkey: wallet.PubkeyBytes(),
+			ToPubkey:   wallet.PubkeyBytes(),
+			Amount:     1,
+			Fee:        0,
+			Nonce:      startNonce + uint64(i),
+		}
+		sig, err := wallet.Sign(tx.Envelope())
+		if err != nil {
+			return nil, err
+		}
+		copy(tx.Sig[:], sig)
+		txs[i] = tx
+	}
+	return txs, nil
+}
+
+// Measures how quickly a DAG ingests a chain of numBlocks blocks, each with txsPerBlock transfers besides the coinbase.
+func BenchIngest(numBlocks int, txsPerBlock int) ([]Report, error) {
+	if numBlocks <= 0 {
+		return nil, fmt.Errorf("Number of blocks must be positive.")
+	}
+	if txsPerBlock < 0 {
+		return nil, fmt.Errorf("Transactions per block must not be negative.")
+	}
+
+	wallet, err := core.CreateRandomWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	// Mine the chain.
+	source, err := newMemoryBlockDAG()
+	if err != nil {
+		return nil, err
+	}
+	blocks := make([]nakamoto.RawBlock, numBlocks)
+	var numTxs uint64 = 0
+	for i := range blocks {
+		txs, err := makeTransfers(wallet, uint64(i*txsPerBlock), txsPerBlock)
+		if err != nil {
+			return nil, err
+		}
+		blocks[i], err = mineBlock(source, wallet, txs)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to mine block %d: %s", i, err)
+		}
+		numTxs += blocks[i].NumTransactions
+	}
+
+	// Ingest it into a fresh DAG.
+	dest, err := newMemoryBlockDAG()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	for i, block := range blocks {
+		if err := dest.IngestBlock(block); err != nil {
+			return nil, fmt.Errorf("Failed to ingest block %d: %s", i, err)
+		}
+	}
+	elapsed := time.Since(start)
+
+	return []Report{
+		{Name: "ingest/blocks", Ops: uint64(numBlocks), Unit: "blocks", Elapsed: elapsed},
+		{Name: "ingest/txs", Ops: numTxs, Unit: "txs", Elapsed: elapsed},
+	}, nil
+}
@@ -0,0 +1,105 @@
+package bench
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+)
+
+// The proof-of-work benchmark compares two ways of hashing a block template:
+//
+// - naive: the miner's loop (see MineWithStatus). Each iteration increments a big.Int nonce, sets it on the block and
+//   re-encodes the whole header to hash it.
+// - precomputed: the header is encoded once. Nonces are precomputed in batches as bytes, and each is copied into the
+//   encoded header before hashing it.
+//
+// The difference between the two is the overhead of the miner's loop over the hash function itself.
+
+// The offset of the nonce in the encoded block header. See BlockHeader.Bytes.
+const headerNonceOffset = 32 + 32 + 32 + 8 + 8 + 32
+
+const (
+	DEFAULT_POW_DURATION   = 5 * time.Second
+	DEFAULT_POW_BATCH_SIZE = 4096
+)
+
+// Measures the hash rate of the naive and precomputed mining loops, running each for the given duration.
+func BenchPOW(duration time.Duration, batchSize int) ([]Report, error) {
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("Batch size must be positive.")
+	}
+
+	block := newBlockTemplate()
+	naive := benchPOWNaive(block, duration)
+	precomputed, err := benchPOWPrecomputed(block, duration, batchSize)
+	if err != nil {
+		return nil, err
+	}
+	return []Report{naive, precomputed}, nil
+}
+
+func newBlockTemplate() nakamoto.RawBlock {
+	return nakamoto.RawBlock{
+		BlockHeader: nakamoto.BlockHeader{
+			ParentHash:      sha256.Sum256([]byte("parent")),
+			ParentTotalWork: sha256.Sum256([]byte("work")),
+			Timestamp:       nakamoto.Timestamp(),
+			NumTransactions: 1,
+		},
+	}
+}
+
+func benchPOWNaive(block nakamoto.RawBlock, duration time.Duration) Report {
+	nonce := big.NewInt(0)
+	one := big.NewInt(1)
+	var hashes uint64 = 0
+
+	start := time.Now()
+	for time.Since(start) < duration {
+		// Check the clock every 1024 hashes, so it doesn't dominate the loop.
+		for i := 0; i < 1024; i++ {
+			nonce.Add(nonce, one)
+			block.SetNonce(*nonce)
+			block.Hash()
+		}
+		hashes += 1024
+	}
+
+	return Report{Name: "pow/naive", Ops: hashes, Unit: "hashes", Elapsed: time.Since(start)}
+}
+
+func benchPOWPrecomputed(block nakamoto.RawBlock, duration time.Duration, batchSize int) (Report, error) {
+	header := block.Envelope()
+	nonces := make([][32]byte, batchSize)
+	var next uint64 = 0
+	var hashes uint64 = 0
+
+	// Sanity check the header layout, so we're measuring the same work as the miner.
+	block.SetNonce(*big.NewInt(1))
+	binary.BigEndian.PutUint64(header[headerNonceOffset+24:headerNonceOffset+32], 1)
+	if sha256.Sum256(header) != block.Hash() {
+		return Report{}, fmt.Errorf("Precomputed header doesn't match the block encoding.")
+	}
+
+	start := time.Now()
+	for time.Since(start) < duration {
+		// Precompute the batch of nonces.
+		for i := range nonces {
+			next++
+			binary.BigEndian.PutUint64(nonces[i][24:], next)
+		}
+
+		// Hash them.
+		for i := range nonces {
+			copy(header[headerNonceOffset:headerNonceOffset+32], nonces[i][:])
+			sha256.Sum256(header)
+		}
+		hashes += uint64(batchSize)
+	}
+
+	return Report{Name: "pow/precomputed", Ops: hashes, Unit: "hashes", Elapsed: time.Since(start)}, nil
+}
@@ -0,0 +1,65 @@
+package bench
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+)
+
+// The signature benchmark measures signing transactions, verifying their signatures, and verifying them through a warm
+// signature cache, which is what block validation does for transactions already seen in the mempool. See sigcache.go.
+
+const (
+	DEFAULT_SIGN_COUNT = 2000
+)
+
+// Measures signing and verification throughput over n transactions.
+func BenchSign(n int) ([]Report, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("Number of signatures must be positive.")
+	}
+
+	wallet, err := core.CreateRandomWallet()
+	if err != nil {
+		return nil, err
+	}
+	pubkey := wallet.PubkeyStr()
+
+	// Sign.
+	start := time.Now()
+	txs, err := makeTransfers(wallet, 0, n)
+	if err != nil {
+		return nil, err
+	}
+	signElapsed := time.Since(start)
+
+	// Verify.
+	start = time.Now()
+	for i, tx := range txs {
+		if !core.VerifySignature(pubkey, tx.Sig[:], tx.Envelope()) {
+			return nil, fmt.Errorf("Signature %d is invalid.", i)
+		}
+	}
+	verifyElapsed := time.Since(start)
+
+	// Verify through a warm cache.
+	cache := nakamoto.NewSignatureCache(n)
+	for _, tx := range txs {
+		cache.VerifyTransactionSignature(tx)
+	}
+	start = time.Now()
+	for i, tx := range txs {
+		if !cache.VerifyTransactionSignature(tx) {
+			return nil, fmt.Errorf("Signature %d is invalid.", i)
+		}
+	}
+	cachedElapsed := time.Since(start)
+
+	return []Report{
+		{Name: "sign/sign", Ops: uint64(n), Unit: "sigs", Elapsed: signElapsed},
+		{Name: "sign/verify", Ops: uint64(n), Unit: "sigs", Elapsed: verifyElapsed},
+		{Name: "sign/verify-cached", Ops: uint64(n), Unit: "sigs", Elapsed: cachedElapsed},
+	}, nil
+}
@@ -0,0 +1,211 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Canonical JSON is a deterministic encoding of JSON, for payloads which are signed or hashed, so that independent
+// implementations encoding the same value produce the same bytes, and signatures verify across them. It follows the
+// JSON Canonicalization Scheme (RFC 8785):
+//
+//   - No whitespace.
+//   - Object keys are sorted by their UTF-16 code units, and duplicate keys are rejected.
+//   - Strings escape only the quote, the backslash, and control characters, using the short escapes (\n, \t, etc.)
+//     where they exist and lowercase \u00xx otherwise. Other characters, including non-ASCII, are written as is.
+//   - Numbers are written in their shortest form. Integers are written in full, without an exponent, however large,
+//     since amounts are uint64 and don't fit losslessly in a double. Other numbers are written as ECMAScript does,
+//     ie. 0.5, 1e-7, 1e+21.
+//
+// A value is encoded with encoding/json first, so struct tags and Marshalers apply, then canonicalized.
+
+// Encodes a value as canonical JSON.
+func CanonicalJSON(v interface{}) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return CanonicalizeJSON(buf)
+}
+
+// Canonicalizes encoded JSON.
+func CanonicalizeJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	out := &bytes.Buffer{}
+	if err := writeCanonicalValue(out, dec); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err == nil {
+		return nil, fmt.Errorf("Unexpected data after JSON value.")
+	}
+	return out.Bytes(), nil
+}
+
+func writeCanonicalValue(out *bytes.Buffer, dec *json.Decoder) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch t := token.(type) {
+	case json.Delim:
+		if t == '[' {
+			return writeCanonicalArray(out, dec)
+		}
+		if t == '{' {
+			return writeCanonicalObject(out, dec)
+		}
+		return fmt.Errorf("Unexpected delimiter: %s", t)
+	case string:
+		writeCanonicalString(out, t)
+	case json.Number:
+		number, err := canonicalNumber(t)
+		if err != nil {
+			return err
+		}
+		out.WriteString(number)
+	case bool:
+		out.WriteString(strconv.FormatBool(t))
+	case nil:
+		out.WriteString("null")
+	}
+	return nil
+}
+
+func writeCanonicalArray(out *bytes.Buffer, dec *json.Decoder) error {
+	out.WriteByte('[')
+	for i := 0; dec.More(); i++ {
+		if 0 < i {
+			out.WriteByte(',')
+		}
+		if err := writeCanonicalValue(out, dec); err != nil {
+			return err
+		}
+	}
+	// The closing bracket.
+	_, err := dec.Token()
+	out.WriteByte(']')
+	return err
+}
+
+func writeCanonicalObject(out *bytes.Buffer, dec *json.Decoder) error {
+	type member struct {
+		key   string
+		value []byte
+	}
+	members := []member{}
+	seen := map[string]bool{}
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key := token.(string)
+		if seen[key] {
+			return fmt.Errorf("Duplicate key: %q", key)
+		}
+		seen[key] = true
+		value := &bytes.Buffer{}
+		if err := writeCanonicalValue(value, dec); err != nil {
+			return err
+		}
+		members = append(members, member{key, value.Bytes()})
+	}
+	// The closing brace.
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		return lessUTF16(members[i].key, members[j].key)
+	})
+	out.WriteByte('{')
+	for i, m := range members {
+		if 0 < i {
+			out.WriteByte(',')
+		}
+		writeCanonicalString(out, m.key)
+		out.WriteByte(':')
+		out.Write(m.value)
+	}
+	out.WriteByte('}')
+	return nil
+}
+
+// Compares strings by their UTF-16 code units.
+func lessUTF16(a, b string) bool {
+	ua, ub := utf16.Encode([]rune(a)), utf16.Encode([]rune(b))
+	for i := 0; i < len(ua) && i < len(ub); i++ {
+		if ua[i] != ub[i] {
+			return ua[i] < ub[i]
+		}
+	}
+	return len(ua) < len(ub)
+}
+
+func writeCanonicalString(out *bytes.Buffer, s string) {
+	out.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			out.WriteString(`\"`)
+		case '\\':
+			out.WriteString(`\\`)
+		case '\b':
+			out.WriteString(`\b`)
+		case '\f':
+			out.WriteString(`\f`)
+		case '\n':
+			out.WriteString(`\n`)
+		case '\r':
+			out.WriteString(`\r`)
+		case '\t':
+			out.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(out, `\u%04x`, r)
+			} else {
+				// Invalid UTF-8 is replaced by U+FFFD, as encoding/json does.
+				out.WriteRune(r)
+			}
+		}
+	}
+	out.WriteByte('"')
+}
+
+func canonicalNumber(n json.Number) (string, error) {
+	s := string(n)
+	if !strings.ContainsAny(s, ".eE") {
+		i, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return "", fmt.Errorf("Invalid number: %s", s)
+		}
+		return i.String(), nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return "", fmt.Errorf("Invalid number: %s", s)
+	}
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", fmt.Errorf("Number out of range: %s", s)
+	}
+	if f == 0 {
+		return "0", nil
+	}
+	abs := math.Abs(f)
+	if 1e-6 <= abs && abs < 1e21 {
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	}
+	// Exponential notation, with an explicit sign and no leading zeros in the exponent, ie. 1e+21 and 1e-7.
+	mantissa, exponent, _ := strings.Cut(strconv.FormatFloat(f, 'e', -1, 64), "e")
+	sign, digits := exponent[:1], strings.TrimLeft(exponent[1:], "0")
+	return mantissa + "e" + sign + digits, nil
+}
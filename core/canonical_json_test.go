@@ -0,0 +1,50 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalizeJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	vectors := []struct {
+		in       string
+		expected string
+	}{
+		// Whitespace is removed, and keys are sorted, recursively.
+		{` { "b" : [ 1, { "d": 1, "c": 2 } ], "a": null } `, `{"a":null,"b":[1,{"c":2,"d":1}]}`},
+		// Keys are sorted by UTF-16 code units, so a character outside the BMP sorts before U+FB33.
+		{`{"דּ":1,"😀":2,"z":3}`, "{\"z\":3,\"\U0001F600\":2,\"דּ\":1}"},
+		// Only quotes, backslashes and control characters are escaped.
+		{`"<a href=\"x\">é \/\n\u0001"`, "\"<a href=\\\"x\\\">é /\\n\\u0001\""},
+		// Integers are written in full, however large.
+		{`[18446744073709551615, -0, 100]`, `[18446744073709551615,0,100]`},
+		// Other numbers are written as ECMAScript does.
+		{`[1.0, 0.5, 1E-7, 1e21, 123456789012345678901.5, -2.50e2, 0.0]`, `[1,0.5,1e-7,1e+21,123456789012345680000,-250,0]`},
+		{`true`, `true`},
+	}
+	for _, v := range vectors {
+		out, err := CanonicalizeJSON([]byte(v.in))
+		assert.Nil(err, v.in)
+		assert.Equal(v.expected, string(out), v.in)
+	}
+
+	for _, invalid := range []string{`{"a":1,"a":2}`, `[1`, `1 2`, `[1e400]`} {
+		_, err := CanonicalizeJSON([]byte(invalid))
+		assert.NotNil(err, invalid)
+	}
+
+	// Values are encoded with their JSON tags, regardless of field order.
+	type payload struct {
+		Z     uint64   `json:"z"`
+		A     string   `json:"a"`
+		Bytes [2]byte  `json:"bytes"`
+		Skip  string   `json:"skip,omitempty"`
+		List  []string `json:"list"`
+	}
+	out, err := CanonicalJSON(payload{Z: 1 << 63, A: "x", Bytes: [2]byte{1, 2}})
+	assert.Nil(err)
+	assert.Equal(`{"a":"x","bytes":[1,2],"list":null,"z":9223372036854775808}`, string(out))
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+)
+
+// The client package wraps a node's APIs in typed methods, so Go applications can integrate with a node without
+// hand-rolling HTTP calls. Methods are called over the node's JSON-RPC API (see node_rpc.go), and new blocks are
+// streamed from the node's publisher (see publisher.go), which is its streaming API.
+//
+// Calls which fail to reach the node, or which the node fails to serve (a 5xx or 429 status), are retried with
+// exponential backoff, up to MaxRetries times. Errors returned by the method itself (an RPCError) aren't retried, since
+// retrying won't change them. Submitting a transaction the node already has succeeds, so every method is safe to retry.
+//
+// Subscriptions reconnect to the publisher when the connection drops, and catch up on the blocks connected while they
+// were disconnected over RPC. See subscribe.go.
+
+const (
+	DEFAULT_MAX_RETRIES = 3
+	DEFAULT_RETRY_DELAY = 500 * time.Millisecond
+)
+
+type Client struct {
+	// The URL of the node's API, ie. "http://127.0.0.1:8081".
+	URL string
+	// The bearer token for mutating methods, if the node requires one.
+	Token string
+	// The address of the node's publisher, ie. "127.0.0.1:9091", for subscriptions.
+	PubAddr string
+
+	// The number of times a failed call is retried, and the delay before the first retry, which doubles each retry.
+	MaxRetries int
+	RetryDelay time.Duration
+
+	http *http.Client
+	log  *log.Logger
+}
+
+func NewClient(url string, token string) *Client {
+	return &Client{
+		URL:        url,
+		Token:      token,
+		MaxRetries: DEFAULT_MAX_RETRIES,
+		RetryDelay: DEFAULT_RETRY_DELAY,
+		http:       &http.Client{Timeout: 30 * time.Second},
+		log:        nakamoto.NewLogger("client", url),
+	}
+}
+
+// An error reaching the node, or a failed request, which may succeed if retried.
+type transientError struct {
+	err error
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+// Calls a method, decoding its result into res, retrying transient failures.
+func (c *Client) Call(method string, res interface{}, params ...interface{}) error {
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := c.call(method, res, params...)
+		transient, ok := err.(*transientError)
+		if !ok {
+			return err
+		}
+		if c.MaxRetries <= attempt {
+			return transient.err
+		}
+		c.log.Printf("Call to %s failed, retrying in %s: %s\n", method, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (c *Client) call(method string, res interface{}, params ...interface{}) error {
+	paramsJson, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(nakamoto.RPCRequest{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage("1"),
+		Method:  method,
+		Params:  paramsJson,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.URL+"/rpc", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	httpRes, err := c.http.Do(req)
+	if err != nil {
+		return &transientError{err}
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode == http.StatusTooManyRequests || http.StatusInternalServerError <= httpRes.StatusCode {
+		return &transientError{fmt.Errorf("RPC request failed, status=%d", httpRes.StatusCode)}
+	}
+	if httpRes.StatusCode != http.StatusOK {
+		return fmt.Errorf("RPC request failed, status=%d", httpRes.StatusCode)
+	}
+
+	var rpcRes nakamoto.RPCResponse
+	if err := json.NewDecoder(httpRes.Body).Decode(&rpcRes); err != nil {
+		return &transientError{err}
+	}
+	if rpcRes.Error != nil {
+		return rpcRes.Error
+	}
+	if res == nil {
+		return nil
+	}
+	return json.Unmarshal(rpcRes.Result, res)
+}
+
+// Gets the tip of the node's main chain.
+func (c *Client) GetTip() (nakamoto.RPCBlock, error) {
+	hash := ""
+	if err := c.Call("getbestblockhash", &hash); err != nil {
+		return nakamoto.RPCBlock{}, err
+	}
+	block, err := c.getBlock(hash)
+	if err != nil {
+		return nakamoto.RPCBlock{}, err
+	}
+	if block == nil {
+		return nakamoto.RPCBlock{}, fmt.Errorf("Tip %s not found.", hash)
+	}
+	return *block, nil
+}
+
+// Gets a block's header, or nil if the node doesn't have it.
+func (c *Client) GetBlock(hash [32]byte) (*nakamoto.RPCBlock, error) {
+	return c.getBlock(hex.EncodeToString(hash[:]))
+}
+
+func (c *Client) getBlock(hash string) (*nakamoto.RPCBlock, error) {
+	var block *nakamoto.RPCBlock
+	if err := c.Call("getblock", &block, hash); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Gets a block with its transactions, or nil if the node doesn't have it.
+func (c *Client) GetRawBlock(hash [32]byte) (*nakamoto.RawBlock, error) {
+	var blockHex *string
+	if err := c.Call("getblock", &blockHex, hex.EncodeToString(hash[:]), nakamoto.RPC_BLOCK_VERBOSITY_RAW); err != nil {
+		return nil, err
+	}
+	if blockHex == nil {
+		return nil, nil
+	}
+	buf, err := hex.DecodeString(*blockHex)
+	if err != nil {
+		return nil, err
+	}
+	block, err := nakamoto.DecodeRawBlock(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
+
+// Gets the balance of an account at the tip.
+func (c *Client) GetBalance(account [65]byte) (uint64, error) {
+	balance := uint64(0)
+	err := c.Call("getbalance", &balance, hex.EncodeToString(account[:]))
+	return balance, err
+}
+
+// Gets the status of a transaction.
+func (c *Client) GetTxStatus(hash [32]byte) (nakamoto.RPCTxStatus, error) {
+	status := nakamoto.RPCTxStatus{}
+	err := c.Call("gettxstatus", &status, hex.EncodeToString(hash[:]))
+	return status, err
+}
+
+// A page of journaled chain events, and the sequence number of the node's latest event.
+type EventsPage struct {
+	Events    []nakamoto.RPCChainEvent `json:"events"`
+	LatestSeq uint64                   `json:"latestSeq"`
+}
+
+// Gets the journaled chain events after a sequence number, oldest first, up to limit of them. Consumers which must
+// process each event exactly once store the sequence number of the last event they processed, and resume from it.
+func (c *Client) GetEvents(after uint64, limit uint64) (EventsPage, error) {
+	page := EventsPage{}
+	err := c.Call("getevents", &page, after, limit)
+	return page, err
+}
+
+// Submits a signed transaction to the node's mempool, which gossips it to the network. Returns its hash.
+func (c *Client) SubmitTx(tx nakamoto.RawTransaction) ([32]byte, error) {
+	hash := ""
+	if err := c.Call("sendrawtransaction", &hash, tx); err != nil {
+		return [32]byte{}, err
+	}
+	return parseHash(hash)
+}
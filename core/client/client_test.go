@@ -0,0 +1,187 @@
+package client
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/stretchr/testify/assert"
+)
+
+// A fake node serving a chain of blocks over RPC.
+type fakeNode struct {
+	blocks []nakamoto.RawBlock
+	sent   []nakamoto.RawTransaction
+	// The number of requests to fail with a 503 before serving.
+	failures int
+}
+
+func (n *fakeNode) mine() nakamoto.RawBlock {
+	block := nakamoto.RawBlock{Transactions: []nakamoto.RawTransaction{}}
+	if 0 < len(n.blocks) {
+		block.ParentHash = n.blocks[len(n.blocks)-1].Hash()
+	}
+	block.Timestamp = uint64(len(n.blocks))
+	n.blocks = append(n.blocks, block)
+	return block
+}
+
+func (n *fakeNode) find(hashStr string) *nakamoto.RawBlock {
+	for _, block := range n.blocks {
+		hash := block.Hash()
+		if hex.EncodeToString(hash[:]) == hashStr {
+			return &block
+		}
+	}
+	return nil
+}
+
+func newTestClient(t *testing.T, node *fakeNode) *Client {
+	rpc := nakamoto.NewRPCHandler()
+	rpc.RegisterMethod("getbestblockhash", func(params json.RawMessage) (interface{}, error) {
+		hash := node.blocks[len(node.blocks)-1].Hash()
+		return hex.EncodeToString(hash[:]), nil
+	}, false)
+	rpc.RegisterMethod("getblock", func(params json.RawMessage) (interface{}, error) {
+		args := []interface{}{}
+		if err := json.Unmarshal(params, &args); err != nil {
+			return nil, err
+		}
+		block := node.find(args[0].(string))
+		if block == nil {
+			return nil, nil
+		}
+		if len(args) == 2 {
+			return hex.EncodeToString(block.Bytes()), nil
+		}
+		hash := block.Hash()
+		return nakamoto.RPCBlock{Hash: hex.EncodeToString(hash[:]), Timestamp: block.Timestamp}, nil
+	}, false)
+	rpc.RegisterMethod("getbalance", func(params json.RawMessage) (interface{}, error) {
+		return 42, nil
+	}, false)
+	rpc.RegisterMethod("sendrawtransaction", func(params json.RawMessage) (interface{}, error) {
+		txs := []nakamoto.RawTransaction{}
+		if err := json.Unmarshal(params, &txs); err != nil {
+			return nil, err
+		}
+		node.sent = append(node.sent, txs[0])
+		return nakamoto.Bytes32ToHexString(txs[0].Hash()), nil
+	}, true)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if 0 < node.failures {
+			node.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rpc.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	client := NewClient(server.URL, "")
+	client.RetryDelay = time.Millisecond
+	return client
+}
+
+func TestClientCalls(t *testing.T) {
+	assert := assert.New(t)
+
+	node := &fakeNode{}
+	node.mine()
+	tip := node.mine()
+	client := newTestClient(t, node)
+
+	block, err := client.GetTip()
+	assert.Nil(err)
+	tipHash := tip.Hash()
+	assert.Equal(hex.EncodeToString(tipHash[:]), block.Hash)
+	raw, err := client.GetRawBlock(tip.Hash())
+	assert.Nil(err)
+	assert.Equal(tip.Hash(), raw.Hash())
+	raw, err = client.GetRawBlock([32]byte{1})
+	assert.Nil(err)
+	assert.Nil(raw)
+
+	// Transient failures are retried.
+	node.failures = 2
+	balance, err := client.GetBalance([65]byte{})
+	assert.Nil(err)
+	assert.Equal(uint64(42), balance)
+	node.failures = client.MaxRetries + 1
+	_, err = client.GetBalance([65]byte{})
+	assert.ErrorContains(err, "status=503")
+
+	// Errors returned by the method aren't.
+	err = client.Call("unknown", nil)
+	rpcErr, ok := err.(*nakamoto.RPCError)
+	assert.True(ok)
+	assert.Equal(nakamoto.RPCErrMethodNotFound, rpcErr.Code)
+
+	tx := nakamoto.RawTransaction{Version: 1, Amount: 5}
+	hash, err := client.SubmitTx(tx)
+	assert.Nil(err)
+	assert.Equal(tx.Hash(), hash)
+	assert.Equal([]nakamoto.RawTransaction{tx}, node.sent)
+}
+
+func TestSubscribeBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	node := &fakeNode{}
+	node.mine()
+	client := newTestClient(t, node)
+	publisher, err := nakamoto.NewPublisher("127.0.0.1:0", []string{nakamoto.PUB_TOPIC_RAWBLOCK})
+	assert.Nil(err)
+	assert.Nil(publisher.Listen())
+	client.PubAddr = publisher.Addr().String()
+
+	sub, err := client.SubscribeBlocks()
+	assert.Nil(err)
+	defer sub.Close()
+	// Returns the hash of the next block received.
+	receive := func() [32]byte {
+		select {
+		case block := <-sub.Blocks:
+			return block.Hash()
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a block.")
+		}
+		return [32]byte{}
+	}
+	waitForSubscriber := func() {
+		for publisher.NumSubscribers() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	waitForSubscriber()
+	block := node.mine()
+	publisher.Publish(nakamoto.PUB_TOPIC_RAWBLOCK, block.Bytes())
+	assert.Equal(block.Hash(), receive())
+
+	// The blocks connected while disconnected are caught up on after reconnecting, in order.
+	publisher.Stop()
+	missed := []nakamoto.RawBlock{node.mine(), node.mine()}
+	publisher, err = nakamoto.NewPublisher(client.PubAddr, []string{nakamoto.PUB_TOPIC_RAWBLOCK})
+	assert.Nil(err)
+	assert.Nil(publisher.Listen())
+	defer publisher.Stop()
+	assert.Equal(missed[0].Hash(), receive())
+	assert.Equal(missed[1].Hash(), receive())
+
+	// Blocks already delivered aren't repeated.
+	waitForSubscriber()
+	publisher.Publish(nakamoto.PUB_TOPIC_RAWBLOCK, missed[1].Bytes())
+	block = node.mine()
+	publisher.Publish(nakamoto.PUB_TOPIC_RAWBLOCK, block.Bytes())
+	assert.Equal(block.Hash(), receive())
+
+	sub.Close()
+	_, ok := <-sub.Blocks
+	assert.False(ok)
+}
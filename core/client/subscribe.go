@@ -0,0 +1,214 @@
+package client
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+)
+
+// A block subscription delivers each block connected to the node's main chain, in order, including the blocks of a
+// reorg. It reads the node's rawblock notifications, so the node's publisher must have that topic enabled.
+//
+// When the connection to the publisher drops, the subscription reconnects with backoff. Once reconnected, it walks back
+// from the node's tip to the last block it delivered, and delivers the blocks it missed, up to SUBSCRIPTION_BACKFILL_LIMIT
+// of them. Blocks are delivered at most once, so a block both published and caught up on isn't repeated.
+
+const (
+	// The maximum number of blocks caught up on after reconnecting.
+	SUBSCRIPTION_BACKFILL_LIMIT = 100
+	// The number of recently delivered block hashes remembered, to skip duplicates and find where to catch up from.
+	SUBSCRIPTION_DELIVERED_HISTORY = 1000
+	// The longest delay between reconnection attempts.
+	SUBSCRIPTION_MAX_RECONNECT_DELAY = 30 * time.Second
+)
+
+type BlockSubscription struct {
+	// The blocks connected to the main chain. Closed when the subscription is closed.
+	Blocks chan nakamoto.RawBlock
+
+	client *Client
+
+	conn   net.Conn
+	closed bool
+	done   chan struct{}
+	mutex  sync.Mutex
+
+	// The hashes of the recently delivered blocks, oldest first.
+	delivered      map[[32]byte]bool
+	deliveredOrder [][32]byte
+}
+
+// Subscribes to the blocks connected to the node's main chain, from the publisher at PubAddr.
+func (c *Client) SubscribeBlocks() (*BlockSubscription, error) {
+	if c.PubAddr == "" {
+		return nil, fmt.Errorf("The client has no publisher address to subscribe to.")
+	}
+	s := &BlockSubscription{
+		Blocks:    make(chan nakamoto.RawBlock, 100),
+		client:    c,
+		done:      make(chan struct{}),
+		delivered: map[[32]byte]bool{},
+	}
+	conn, err := net.Dial("tcp", c.PubAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to subscribe to %s: %s", c.PubAddr, err)
+	}
+	s.conn = conn
+	go s.run(conn)
+	return s, nil
+}
+
+// Closes the subscription.
+func (s *BlockSubscription) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.done)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *BlockSubscription) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
+
+func (s *BlockSubscription) run(conn net.Conn) {
+	defer close(s.Blocks)
+	for {
+		s.readRoutine(conn)
+		conn = s.reconnect()
+		if conn == nil {
+			return
+		}
+		if err := s.backfill(); err != nil {
+			s.client.log.Printf("Failed to catch up on missed blocks: %s\n", err)
+		}
+	}
+}
+
+// Delivers the blocks published on a connection, until it drops.
+func (s *BlockSubscription) readRoutine(conn net.Conn) {
+	for {
+		topic, body, _, err := nakamoto.ReadPubMessage(conn)
+		if err != nil {
+			if !s.isClosed() {
+				s.client.log.Printf("Subscription to %s dropped: %s\n", s.client.PubAddr, err)
+			}
+			return
+		}
+		if topic != nakamoto.PUB_TOPIC_RAWBLOCK {
+			continue
+		}
+		block, err := nakamoto.DecodeRawBlock(body)
+		if err != nil {
+			s.client.log.Printf("Failed to decode published block: %s\n", err)
+			continue
+		}
+		if !s.deliver(block) {
+			return
+		}
+	}
+}
+
+// Reconnects to the publisher, with backoff. Returns nil once the subscription is closed.
+func (s *BlockSubscription) reconnect() net.Conn {
+	delay := s.client.RetryDelay
+	for {
+		select {
+		case <-s.done:
+			return nil
+		case <-time.After(delay):
+		}
+		conn, err := net.Dial("tcp", s.client.PubAddr)
+		if err == nil {
+			s.mutex.Lock()
+			if s.closed {
+				s.mutex.Unlock()
+				conn.Close()
+				return nil
+			}
+			s.conn = conn
+			s.mutex.Unlock()
+			s.client.log.Printf("Resubscribed to %s\n", s.client.PubAddr)
+			return conn
+		}
+		delay = min(2*delay, SUBSCRIPTION_MAX_RECONNECT_DELAY)
+	}
+}
+
+// Delivers the blocks connected since the last delivered block, walking back from the tip.
+func (s *BlockSubscription) backfill() error {
+	if len(s.deliveredOrder) == 0 {
+		return nil
+	}
+	tip, err := s.client.GetTip()
+	if err != nil {
+		return err
+	}
+	hash, err := parseHash(tip.Hash)
+	if err != nil {
+		return err
+	}
+
+	missed := []nakamoto.RawBlock{}
+	for !s.delivered[hash] {
+		if len(missed) == SUBSCRIPTION_BACKFILL_LIMIT {
+			s.client.log.Printf("Missed more than %d blocks, catching up on the latest\n", SUBSCRIPTION_BACKFILL_LIMIT)
+			break
+		}
+		block, err := s.client.GetRawBlock(hash)
+		if err != nil {
+			return err
+		}
+		if block == nil {
+			// Past the genesis block.
+			break
+		}
+		missed = append(missed, *block)
+		hash = block.ParentHash
+	}
+	for i := len(missed) - 1; 0 <= i; i-- {
+		if !s.deliver(missed[i]) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Delivers a block, unless it was already delivered. Returns false if the subscription was closed.
+func (s *BlockSubscription) deliver(block nakamoto.RawBlock) bool {
+	hash := block.Hash()
+	if s.delivered[hash] {
+		return true
+	}
+	select {
+	case s.Blocks <- block:
+	case <-s.done:
+		return false
+	}
+	s.delivered[hash] = true
+	s.deliveredOrder = append(s.deliveredOrder, hash)
+	if SUBSCRIPTION_DELIVERED_HISTORY < len(s.deliveredOrder) {
+		delete(s.delivered, s.deliveredOrder[0])
+		s.deliveredOrder = s.deliveredOrder[1:]
+	}
+	return true
+}
+
+func parseHash(s string) ([32]byte, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil || len(buf) != 32 {
+		return [32]byte{}, fmt.Errorf("Invalid hash: %s", s)
+	}
+	return [32]byte(buf), nil
+}
@@ -0,0 +1,47 @@
+package faucet
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// The siteverify endpoints of the captcha services which SiteVerifyCaptcha supports.
+const (
+	HCAPTCHA_VERIFY_URL  = "https://api.hcaptcha.com/siteverify"
+	RECAPTCHA_VERIFY_URL = "https://www.google.com/recaptcha/api/siteverify"
+	TURNSTILE_VERIFY_URL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+)
+
+// Returns a verifier for captcha services implementing the siteverify protocol - hCaptcha, reCAPTCHA and Cloudflare
+// Turnstile - which checks a response by POSTing it with the operator's secret to the service's verify URL.
+func SiteVerifyCaptcha(verifyURL string, secret string) CaptchaVerifier {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(response string, remoteIP string) error {
+		if response == "" {
+			return fmt.Errorf("Captcha is required.")
+		}
+		res, err := client.PostForm(verifyURL, url.Values{
+			"secret":   {secret},
+			"response": {response},
+			"remoteip": {remoteIP},
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to verify captcha: %s", err)
+		}
+		defer res.Body.Close()
+
+		var result struct {
+			Success bool `json:"success"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			return fmt.Errorf("Failed to verify captcha: %s", err)
+		}
+		if !result.Success {
+			return fmt.Errorf("Captcha is invalid.")
+		}
+		return nil
+	}
+}
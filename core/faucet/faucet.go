@@ -0,0 +1,348 @@
+// Package faucet runs an HTTP service which dispenses coins from a funded wallet on test networks, so developers can
+// get coins to test with without mining them.
+//
+// Requests are limited by a cooldown per client IP and per recipient address, and by a limit on the amount dispensed
+// per day, so one user can't drain the faucet. Operators exposing a faucet publicly can also require a captcha, which
+// is verified by a hook before anything else - see SiteVerifyCaptcha for hCaptcha, reCAPTCHA and Turnstile.
+//
+// The faucet sends transactions through a node's JSON-RPC API (see Node), and tracks the nonce of its wallet itself, so
+// it can dispense many times per block.
+//
+// The service's API:
+//   - GET /status returns the faucet's address, balance, the amount it dispenses and its limits.
+//   - POST /request dispenses coins to an address, returning the transaction hash. Its parameters, as JSON or a form,
+//     are the "address" (a hex-encoded pubkey) and the "captcha" response, if a captcha is required.
+package faucet
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+)
+
+var ErrInvalidAddress = errors.New("invalid address")
+var ErrRateLimited = errors.New("too many requests, try again later")
+var ErrDailyLimit = errors.New("the faucet has dispensed its daily limit, try again later")
+var ErrInsufficientFunds = errors.New("the faucet is out of funds")
+
+// Verifies a captcha response submitted by a client. Returns an error if it is invalid.
+type CaptchaVerifier func(response string, remoteIP string) error
+
+type Config struct {
+	// The amount dispensed per request.
+	Amount uint64
+
+	// The fee paid per transaction. If zero, the fee is estimated by the node.
+	Fee uint64
+
+	// How long a client IP, and a recipient address, must wait between requests.
+	Cooldown time.Duration
+
+	// The maximum amount dispensed in any 24 hours. Zero means no limit.
+	DailyLimit uint64
+
+	// If set, requests must include a captcha response which it accepts.
+	Captcha CaptchaVerifier
+
+	// The header the client IP is read from, when the faucet is behind a reverse proxy, ie. "X-Forwarded-For". If
+	// empty, the client IP is the address of the connection.
+	ClientIPHeader string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Amount:     1000,
+		Fee:        0,
+		Cooldown:   24 * time.Hour,
+		DailyLimit: 1000 * 1000,
+	}
+}
+
+// A request for coins.
+type Request struct {
+	Address string `json:"address"`
+	Captcha string `json:"captcha"`
+}
+
+type Response struct {
+	TxHash string `json:"txHash"`
+	Amount uint64 `json:"amount"`
+}
+
+type Status struct {
+	Address         string `json:"address"`
+	Balance         uint64 `json:"balance"`
+	Amount          uint64 `json:"amount"`
+	CooldownSeconds uint64 `json:"cooldownSeconds"`
+	DailyLimit      uint64 `json:"dailyLimit"`
+	DispensedToday  uint64 `json:"dispensedToday"`
+	CaptchaRequired bool   `json:"captchaRequired"`
+}
+
+type dispense struct {
+	at     time.Time
+	amount uint64
+}
+
+type Faucet struct {
+	Config Config
+
+	node   Node
+	wallet *core.Wallet
+
+	// The nonce of the next transaction, or nil if it must be fetched from the node.
+	nextNonce *uint64
+	// The last time each client IP and recipient address was dispensed to.
+	lastDispensed map[string]time.Time
+	// The dispenses in the last 24 hours, oldest first.
+	recent []dispense
+	mutex  sync.Mutex
+
+	// For testing.
+	now func() time.Time
+}
+
+func NewFaucet(config Config, node Node, wallet *core.Wallet) (*Faucet, error) {
+	if config.Amount == 0 {
+		return nil, fmt.Errorf("Amount must be greater than zero.")
+	}
+	if 0 < config.DailyLimit && config.DailyLimit < config.Amount {
+		return nil, fmt.Errorf("Daily limit must be at least the amount.")
+	}
+	return &Faucet{
+		Config:        config,
+		node:          node,
+		wallet:        wallet,
+		lastDispensed: map[string]time.Time{},
+		recent:        []dispense{},
+		now:           time.Now,
+	}, nil
+}
+
+// Dispenses coins to an address, for a client at the given IP. Returns the hash of the transaction.
+func (f *Faucet) Dispense(address string, clientIP string) ([32]byte, error) {
+	to, err := parseAddress(address)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	now := f.now()
+	ipKey, addressKey := "ip:"+clientIP, "address:"+hex.EncodeToString(to[:])
+	for _, key := range []string{ipKey, addressKey} {
+		if last, ok := f.lastDispensed[key]; ok && now.Sub(last) < f.Config.Cooldown {
+			return [32]byte{}, ErrRateLimited
+		}
+	}
+	if 0 < f.Config.DailyLimit && f.Config.DailyLimit < f.dispensedSince(now.Add(-24*time.Hour))+f.Config.Amount {
+		return [32]byte{}, ErrDailyLimit
+	}
+
+	fee := f.Config.Fee
+	if fee == 0 {
+		if fee, err = f.node.EstimateFee(); err != nil {
+			return [32]byte{}, err
+		}
+	}
+	balance, err := f.node.GetBalance(f.wallet.PubkeyBytes())
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if balance < f.Config.Amount+fee {
+		return [32]byte{}, ErrInsufficientFunds
+	}
+
+	if f.nextNonce == nil {
+		nonce, err := f.node.GetNextNonce(f.wallet.PubkeyBytes())
+		if err != nil {
+			return [32]byte{}, err
+		}
+		f.nextNonce = &nonce
+	}
+	tx, err := f.makeTransferTx(to, fee, *f.nextNonce)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if err := f.node.SendTransaction(tx); err != nil {
+		// Our nonce may be stale, ie. if the wallet was used elsewhere, so fetch it again next time.
+		f.nextNonce = nil
+		return [32]byte{}, err
+	}
+	*f.nextNonce++
+
+	f.lastDispensed[ipKey] = now
+	f.lastDispensed[addressKey] = now
+	f.recent = append(f.recent, dispense{at: now, amount: f.Config.Amount})
+	return tx.Hash(), nil
+}
+
+// Returns the amount dispensed since a time, and forgets older dispenses and expired cooldowns.
+func (f *Faucet) dispensedSince(since time.Time) uint64 {
+	for 0 < len(f.recent) && f.recent[0].at.Before(since) {
+		f.recent = f.recent[1:]
+	}
+	for key, last := range f.lastDispensed {
+		if f.Config.Cooldown <= f.now().Sub(last) {
+			delete(f.lastDispensed, key)
+		}
+	}
+
+	total := uint64(0)
+	for _, d := range f.recent {
+		total += d.amount
+	}
+	return total
+}
+
+func (f *Faucet) makeTransferTx(to [65]byte, fee uint64, nonce uint64) (nakamoto.RawTransaction, error) {
+	tx := nakamoto.RawTransaction{
+		Version:    1,
+		FromPubkey: f.wallet.PubkeyBytes(),
+		ToPubkey:   to,
+		Amount:     f.Config.Amount,
+		Fee:        fee,
+		Nonce:      nonce,
+	}
+	sig, err := f.wallet.Sign(tx.Envelope())
+	if err != nil {
+		return nakamoto.RawTransaction{}, err
+	}
+	copy(tx.Sig[:], sig)
+	return tx, nil
+}
+
+// Returns the faucet's status.
+func (f *Faucet) GetStatus() (Status, error) {
+	balance, err := f.node.GetBalance(f.wallet.PubkeyBytes())
+	if err != nil {
+		return Status{}, err
+	}
+	f.mutex.Lock()
+	dispensed := f.dispensedSince(f.now().Add(-24 * time.Hour))
+	f.mutex.Unlock()
+
+	return Status{
+		Address:         f.wallet.PubkeyStr(),
+		Balance:         balance,
+		Amount:          f.Config.Amount,
+		CooldownSeconds: uint64(f.Config.Cooldown.Seconds()),
+		DailyLimit:      f.Config.DailyLimit,
+		DispensedToday:  dispensed,
+		CaptchaRequired: f.Config.Captcha != nil,
+	}, nil
+}
+
+func parseAddress(address string) ([65]byte, error) {
+	buf, err := hex.DecodeString(address)
+	if err != nil || len(buf) != 65 {
+		return [65]byte{}, ErrInvalidAddress
+	}
+	pubkey := [65]byte{}
+	copy(pubkey[:], buf)
+	return pubkey, nil
+}
+
+// The HTTP service.
+// =====================================================================================================================
+
+// Serves the faucet's API.
+func (f *Faucet) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", f.statusHandler)
+	mux.HandleFunc("/request", f.requestHandler)
+	return mux
+}
+
+func (f *Faucet) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, err := f.GetStatus()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (f *Faucet) requestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+
+	var req Request
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid request."))
+			return
+		}
+	} else {
+		req.Address = r.FormValue("address")
+		req.Captcha = r.FormValue("captcha")
+	}
+
+	clientIP := f.clientIP(r)
+	if f.Config.Captcha != nil {
+		if err := f.Config.Captcha(req.Captcha, clientIP); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+
+	hash, err := f.Dispense(req.Address, clientIP)
+	switch {
+	case errors.Is(err, ErrRateLimited), errors.Is(err, ErrDailyLimit):
+		writeError(w, http.StatusTooManyRequests, err)
+	case errors.Is(err, ErrInsufficientFunds):
+		writeError(w, http.StatusServiceUnavailable, err)
+	case errors.Is(err, ErrInvalidAddress):
+		writeError(w, http.StatusBadRequest, err)
+	case err != nil:
+		// The node failed.
+		writeError(w, http.StatusBadGateway, err)
+	default:
+		writeJSON(w, http.StatusOK, Response{TxHash: nakamoto.Bytes32ToHexString(hash), Amount: f.Config.Amount})
+	}
+}
+
+// Returns the IP of the client, from the configured header if it's set.
+func (f *Faucet) clientIP(r *http.Request) string {
+	if f.Config.ClientIPHeader != "" {
+		// The proxy appends the address it received the request from, so it is the last in the list.
+		if values := r.Header.Values(f.Config.ClientIPHeader); 0 < len(values) {
+			ips := strings.Split(values[len(values)-1], ",")
+			if ip := strings.TrimSpace(ips[len(ips)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
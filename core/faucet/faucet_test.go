@@ -0,0 +1,228 @@
+package faucet
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeNode struct {
+	balance uint64
+	nonce   uint64
+	sent    []nakamoto.RawTransaction
+	fail    error
+}
+
+func (n *fakeNode) GetBalance(account [65]byte) (uint64, error)   { return n.balance, nil }
+func (n *fakeNode) GetNextNonce(account [65]byte) (uint64, error) { return n.nonce, nil }
+func (n *fakeNode) EstimateFee() (uint64, error)                  { return 7, nil }
+func (n *fakeNode) SendTransaction(tx nakamoto.RawTransaction) error {
+	if n.fail != nil {
+		return n.fail
+	}
+	n.sent = append(n.sent, tx)
+	return nil
+}
+
+func newTestFaucet(t *testing.T, config Config) (*Faucet, *fakeNode) {
+	wallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &fakeNode{balance: 1000 * 1000, nonce: 5}
+	f, err := NewFaucet(config, node, wallet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, node
+}
+
+func newAddress(t *testing.T) string {
+	wallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wallet.PubkeyStr()
+}
+
+func TestFaucetDispense(t *testing.T) {
+	assert := assert.New(t)
+
+	config := DefaultConfig()
+	config.Amount = 100
+	config.Cooldown = time.Hour
+	config.DailyLimit = 300
+	f, node := newTestFaucet(t, config)
+	now := time.Now()
+	f.now = func() time.Time { return now }
+
+	// Transactions are signed by the faucet, with sequential nonces and the estimated fee.
+	alice, bob := newAddress(t), newAddress(t)
+	hash, err := f.Dispense(alice, "10.0.0.1")
+	assert.Nil(err)
+	tx := node.sent[0]
+	assert.Equal(hash, tx.Hash())
+	assert.Equal(uint64(100), tx.Amount)
+	assert.Equal(uint64(7), tx.Fee)
+	assert.Equal(uint64(5), tx.Nonce)
+	assert.Equal(alice, fmt.Sprintf("%x", tx.ToPubkey))
+	assert.True(core.VerifySignature(f.wallet.PubkeyStr(), tx.Sig[:], tx.Envelope()))
+
+	// Each IP and address must wait out the cooldown.
+	_, err = f.Dispense(alice, "10.0.0.2")
+	assert.Equal(ErrRateLimited, err)
+	_, err = f.Dispense(bob, "10.0.0.1")
+	assert.Equal(ErrRateLimited, err)
+	_, err = f.Dispense(bob, "10.0.0.2")
+	assert.Nil(err)
+	assert.Equal(uint64(6), node.sent[1].Nonce)
+
+	_, err = f.Dispense("abcd", "10.0.0.3")
+	assert.Equal(ErrInvalidAddress, err)
+
+	// The daily limit is shared.
+	_, err = f.Dispense(newAddress(t), "10.0.0.3")
+	assert.Nil(err)
+	_, err = f.Dispense(newAddress(t), "10.0.0.4")
+	assert.Equal(ErrDailyLimit, err)
+
+	// Until a day passes.
+	now = now.Add(24*time.Hour + time.Second)
+	_, err = f.Dispense(alice, "10.0.0.1")
+	assert.Nil(err)
+	assert.Len(f.recent, 1)
+
+	// Failed transactions don't count, and the nonce is fetched again.
+	node.fail = fmt.Errorf("nonce is below the account's next nonce")
+	node.nonce = 20
+	_, err = f.Dispense(bob, "10.0.0.2")
+	assert.NotNil(err)
+	assert.Nil(f.nextNonce)
+	node.fail = nil
+	_, err = f.Dispense(bob, "10.0.0.2")
+	assert.Nil(err)
+	assert.Equal(uint64(20), node.sent[len(node.sent)-1].Nonce)
+
+	// The faucet doesn't dispense more than it has.
+	node.balance = 106
+	_, err = f.Dispense(newAddress(t), "10.0.0.5")
+	assert.Equal(ErrInsufficientFunds, err)
+
+	_, err = NewFaucet(Config{Amount: 0}, node, f.wallet)
+	assert.NotNil(err)
+	_, err = NewFaucet(Config{Amount: 10, DailyLimit: 5}, node, f.wallet)
+	assert.NotNil(err)
+}
+
+func TestFaucetHTTP(t *testing.T) {
+	assert := assert.New(t)
+
+	// A captcha service accepting one response.
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("secret", r.FormValue("secret"))
+		json.NewEncoder(w).Encode(map[string]bool{"success": r.FormValue("response") == "ok"})
+	}))
+	defer verifier.Close()
+
+	config := DefaultConfig()
+	config.Fee = 1
+	config.Captcha = SiteVerifyCaptcha(verifier.URL, "secret")
+	config.ClientIPHeader = "X-Forwarded-For"
+	f, node := newTestFaucet(t, config)
+	server := httptest.NewServer(f.Handler())
+	defer server.Close()
+
+	request := func(address string, captcha string, clientIP string) (int, map[string]interface{}) {
+		body := strings.NewReader(url.Values{"address": {address}, "captcha": {captcha}}.Encode())
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/request", body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Forwarded-For", "1.1.1.1, "+clientIP)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		reply := map[string]interface{}{}
+		json.NewDecoder(res.Body).Decode(&reply)
+		return res.StatusCode, reply
+	}
+
+	alice := newAddress(t)
+	status, _ := request(alice, "", "10.0.0.1")
+	assert.Equal(http.StatusForbidden, status)
+	status, _ = request(alice, "bad", "10.0.0.1")
+	assert.Equal(http.StatusForbidden, status)
+	status, _ = request("abcd", "ok", "10.0.0.1")
+	assert.Equal(http.StatusBadRequest, status)
+
+	status, reply := request(alice, "ok", "10.0.0.1")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(nakamoto.Bytes32ToHexString(node.sent[0].Hash()), reply["txHash"])
+	assert.Equal(uint64(1), node.sent[0].Fee)
+
+	// The client IP is read from the proxy's header.
+	status, _ = request(newAddress(t), "ok", "10.0.0.1")
+	assert.Equal(http.StatusTooManyRequests, status)
+
+	// JSON requests are accepted too.
+	body, _ := json.Marshal(Request{Address: newAddress(t), Captcha: "ok"})
+	res, err := http.Post(server.URL+"/request", "application/json", strings.NewReader(string(body)))
+	assert.Nil(err)
+	res.Body.Close()
+	assert.Equal(http.StatusOK, res.StatusCode)
+
+	res, err = http.Get(server.URL + "/status")
+	assert.Nil(err)
+	defer res.Body.Close()
+	var s Status
+	assert.Nil(json.NewDecoder(res.Body).Decode(&s))
+	assert.Equal(f.wallet.PubkeyStr(), s.Address)
+	assert.Equal(uint64(2*config.Amount), s.DispensedToday)
+	assert.True(s.CaptchaRequired)
+}
+
+func TestRPCNode(t *testing.T) {
+	assert := assert.New(t)
+
+	// A node with pending transactions, one parked behind a gap.
+	calls := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req nakamoto.RPCRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		calls = append(calls, req.Method)
+		var result interface{}
+		switch req.Method {
+		case "mempool_account":
+			result = map[string]interface{}{"nextNonce": 3, "executable": []uint64{3, 4}, "parked": []uint64{7}}
+		case "estimatefee":
+			result = map[string]interface{}{"feePerByte": 2, "txSizeBytes": 300}
+		case "sendrawtransaction":
+			assert.Equal("Bearer token", r.Header.Get("Authorization"))
+			json.NewEncoder(w).Encode(nakamoto.RPCResponse{Error: &nakamoto.RPCError{Code: -32602, Message: "nonce is below the account's next nonce"}})
+			return
+		}
+		buf, _ := json.Marshal(result)
+		json.NewEncoder(w).Encode(nakamoto.RPCResponse{Result: buf})
+	}))
+	defer server.Close()
+
+	node := NewRPCNode(server.URL, "token")
+	nonce, err := node.GetNextNonce([65]byte{})
+	assert.Nil(err)
+	assert.Equal(uint64(8), nonce)
+	fee, err := node.EstimateFee()
+	assert.Nil(err)
+	assert.Equal(uint64(600), fee)
+	err = node.SendTransaction(nakamoto.RawTransaction{})
+	assert.ErrorContains(err, "nonce is below")
+	assert.Equal([]string{"mempool_account", "estimatefee", "sendrawtransaction"}, calls)
+}
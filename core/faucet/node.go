@@ -0,0 +1,122 @@
+package faucet
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+)
+
+// The node the faucet sends its transactions through.
+type Node interface {
+	// Returns the balance of an account.
+	GetBalance(account [65]byte) (uint64, error)
+	// Returns the nonce of an account's next transaction, after those pending in the mempool.
+	GetNextNonce(account [65]byte) (uint64, error)
+	// Returns the fee for a transfer to be included promptly.
+	EstimateFee() (uint64, error)
+	// Submits a transaction to the mempool.
+	SendTransaction(tx nakamoto.RawTransaction) error
+}
+
+// A node reached over its JSON-RPC API.
+type RPCNode struct {
+	// The URL of the node's API, ie. "http://127.0.0.1:8081".
+	URL string
+	// The bearer token for mutating methods, if the node requires one.
+	Token string
+
+	client *http.Client
+}
+
+func NewRPCNode(url string, token string) *RPCNode {
+	return &RPCNode{URL: url, Token: token, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Calls a method, decoding its result into res.
+func (n *RPCNode) call(method string, res interface{}, params ...interface{}) error {
+	paramsJson, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(nakamoto.RPCRequest{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage("1"),
+		Method:  method,
+		Params:  paramsJson,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.URL+"/rpc", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.Token)
+	}
+	httpRes, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close()
+	if httpRes.StatusCode != http.StatusOK {
+		return fmt.Errorf("RPC request failed, status=%d", httpRes.StatusCode)
+	}
+
+	var rpcRes nakamoto.RPCResponse
+	if err := json.NewDecoder(httpRes.Body).Decode(&rpcRes); err != nil {
+		return err
+	}
+	if rpcRes.Error != nil {
+		return rpcRes.Error
+	}
+	return json.Unmarshal(rpcRes.Result, res)
+}
+
+func (n *RPCNode) GetBalance(account [65]byte) (uint64, error) {
+	balance := uint64(0)
+	err := n.call("getbalance", &balance, hex.EncodeToString(account[:]))
+	return balance, err
+}
+
+func (n *RPCNode) GetNextNonce(account [65]byte) (uint64, error) {
+	var status struct {
+		NextNonce  uint64   `json:"nextNonce"`
+		Executable []uint64 `json:"executable"`
+		Parked     []uint64 `json:"parked"`
+	}
+	if err := n.call("mempool_account", &status, hex.EncodeToString(account[:])); err != nil {
+		return 0, err
+	}
+	// Continue after the pending transactions, including any parked behind a gap, which our next transaction may fill.
+	nonce := status.NextNonce
+	for _, pending := range append(status.Executable, status.Parked...) {
+		if nonce <= pending {
+			nonce = pending + 1
+		}
+	}
+	return nonce, nil
+}
+
+func (n *RPCNode) EstimateFee() (uint64, error) {
+	var estimate struct {
+		FeePerByte  uint64 `json:"feePerByte"`
+		TxSizeBytes uint64 `json:"txSizeBytes"`
+	}
+	if err := n.call("estimatefee", &estimate, 1); err != nil {
+		return 0, err
+	}
+	return estimate.FeePerByte * estimate.TxSizeBytes, nil
+}
+
+func (n *RPCNode) SendTransaction(tx nakamoto.RawTransaction) error {
+	hash := ""
+	return n.call("sendrawtransaction", &hash, tx)
+}
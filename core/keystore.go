@@ -0,0 +1,202 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The keystore is a directory of named keys, each in a file holding its hex-encoded private key, in the same format
+// as the key files passed to the wallet commands. An index file, keystore.json, records each key's pubkey and status.
+//
+// Keys are never deleted. When a key is rotated, the old key is marked retired, recording the key that replaced it,
+// and its file is kept as an archive, so funds sent to the old key after the rotation can still be recovered.
+
+const (
+	KEY_STATUS_ACTIVE  = "active"
+	KEY_STATUS_RETIRED = "retired"
+
+	KEYSTORE_INDEX_FILE = "keystore.json"
+)
+
+var keyNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+
+type KeyInfo struct {
+	Name   string `json:"name"`
+	Pubkey string `json:"pubkey"`
+	Status string `json:"status"`
+	// Unix timestamps, in seconds.
+	CreatedAt uint64 `json:"createdAt"`
+	RetiredAt uint64 `json:"retiredAt,omitempty"`
+	// The name of the key which replaced a retired key.
+	ReplacedBy string `json:"replacedBy,omitempty"`
+}
+
+type Keystore struct {
+	dir   string
+	keys  map[string]KeyInfo
+	mutex sync.Mutex
+}
+
+// Opens the keystore in a directory, creating it if it doesn't exist.
+func OpenKeystore(dir string) (*Keystore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	ks := &Keystore{dir: dir, keys: make(map[string]KeyInfo)}
+	data, err := os.ReadFile(filepath.Join(dir, KEYSTORE_INDEX_FILE))
+	if os.IsNotExist(err) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := []KeyInfo{}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("Failed to read keystore index in %s: %s", dir, err)
+	}
+	for _, key := range keys {
+		ks.keys[key.Name] = key
+	}
+	return ks, nil
+}
+
+// Returns the path of a key's file.
+func (ks *Keystore) KeyPath(name string) string {
+	return filepath.Join(ks.dir, name+".key")
+}
+
+// Returns the keys, ordered by creation time.
+func (ks *Keystore) Keys() []KeyInfo {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	return ks.sortedKeys()
+}
+
+func (ks *Keystore) sortedKeys() []KeyInfo {
+	keys := []KeyInfo{}
+	for _, key := range ks.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt != keys[j].CreatedAt {
+			return keys[i].CreatedAt < keys[j].CreatedAt
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	return keys
+}
+
+// Finds the key with a pubkey.
+func (ks *Keystore) FindByPubkey(pubkey string) (KeyInfo, bool) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	for _, key := range ks.keys {
+		if key.Pubkey == pubkey {
+			return key, true
+		}
+	}
+	return KeyInfo{}, false
+}
+
+// Creates a new random key.
+func (ks *Keystore) Create(name string) (*Wallet, error) {
+	wallet, err := CreateRandomWallet()
+	if err != nil {
+		return nil, err
+	}
+	if err := ks.Import(name, wallet); err != nil {
+		return nil, err
+	}
+	return wallet, nil
+}
+
+// Adds an existing key. The key file is written before the index, so a key is never listed without its file.
+func (ks *Keystore) Import(name string, wallet *Wallet) error {
+	if !keyNameRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid key name %q: names are at most 64 letters, digits, '.', '_' or '-'.", name)
+	}
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	if _, ok := ks.keys[name]; ok {
+		return fmt.Errorf("Key %s already exists.", name)
+	}
+	for _, key := range ks.keys {
+		if key.Pubkey == wallet.PubkeyStr() {
+			return fmt.Errorf("Key is already in the keystore as %s.", key.Name)
+		}
+	}
+
+	// O_EXCL, so a key file left by a failed import is never overwritten.
+	f, err := os.OpenFile(ks.KeyPath(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(wallet.PrvkeyStr() + "\n"); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	ks.keys[name] = KeyInfo{
+		Name:      name,
+		Pubkey:    wallet.PubkeyStr(),
+		Status:    KEY_STATUS_ACTIVE,
+		CreatedAt: uint64(time.Now().Unix()),
+	}
+	return ks.save()
+}
+
+// Loads a key.
+func (ks *Keystore) Load(name string) (*Wallet, error) {
+	ks.mutex.Lock()
+	_, ok := ks.keys[name]
+	ks.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Key %s not found.", name)
+	}
+	data, err := os.ReadFile(ks.KeyPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return WalletFromPrivateKey(strings.TrimSpace(string(data)))
+}
+
+// Marks a key as retired, replaced by another key.
+func (ks *Keystore) Retire(name string, replacedBy string) error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+	key, ok := ks.keys[name]
+	if !ok {
+		return fmt.Errorf("Key %s not found.", name)
+	}
+	if _, ok := ks.keys[replacedBy]; !ok {
+		return fmt.Errorf("Key %s not found.", replacedBy)
+	}
+	key.Status = KEY_STATUS_RETIRED
+	key.RetiredAt = uint64(time.Now().Unix())
+	key.ReplacedBy = replacedBy
+	ks.keys[name] = key
+	return ks.save()
+}
+
+// Writes the index, replacing the old one atomically.
+func (ks *Keystore) save() error {
+	data, err := json.MarshalIndent(ks.sortedKeys(), "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(ks.dir, KEYSTORE_INDEX_FILE)
+	if err := os.WriteFile(path+".tmp", append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeystore(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	ks, err := OpenKeystore(dir)
+	assert.Nil(err)
+	old, err := CreateRandomWallet()
+	assert.Nil(err)
+	assert.Nil(ks.Import("old", old))
+	assert.NotNil(ks.Import("old2", old))
+	assert.NotNil(ks.Import("../old", old))
+	replacement, err := ks.Create("new")
+	assert.Nil(err)
+	_, err = ks.Create("new")
+	assert.NotNil(err)
+
+	// Retiring keeps the old key, marked as replaced.
+	assert.NotNil(ks.Retire("old", "missing"))
+	assert.Nil(ks.Retire("old", "new"))
+
+	// The keystore is persisted.
+	ks, err = OpenKeystore(dir)
+	assert.Nil(err)
+	keys := ks.Keys()
+	assert.Equal(2, len(keys))
+	key, ok := ks.FindByPubkey(old.PubkeyStr())
+	assert.True(ok)
+	assert.Equal(KEY_STATUS_RETIRED, key.Status)
+	assert.Equal("new", key.ReplacedBy)
+	key, ok = ks.FindByPubkey(replacement.PubkeyStr())
+	assert.True(ok)
+	assert.Equal(KEY_STATUS_ACTIVE, key.Status)
+
+	loaded, err := ks.Load("old")
+	assert.Nil(err)
+	assert.Equal(old.PubkeyStr(), loaded.PubkeyStr())
+	_, err = ks.Load("missing")
+	assert.NotNil(err)
+}
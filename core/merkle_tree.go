@@ -17,3 +17,56 @@ func ComputeMerkleHash(items [][]byte) [32]byte {
 	right := ComputeMerkleHash(items[mid:])
 	return sha256.Sum256(append(left[:], right[:]...))
 }
+
+// Builds a proof that the item at an index is in the Merkle tree of a list of items. The proof is the sibling hashes on
+// the path from the root down to the item.
+func ComputeMerkleProof(items [][]byte, index int) [][32]byte {
+	proof := [][32]byte{}
+	for 1 < len(items) {
+		mid := len(items) / 2
+		if index < mid {
+			proof = append(proof, ComputeMerkleHash(items[mid:]))
+			items = items[:mid]
+		} else {
+			proof = append(proof, ComputeMerkleHash(items[:mid]))
+			items = items[mid:]
+			index -= mid
+		}
+	}
+	return proof
+}
+
+// Verifies a proof that an item is at an index in the Merkle tree of a list of count items, with the given root hash.
+func VerifyMerkleProof(item []byte, index int, count int, proof [][32]byte, root [32]byte) bool {
+	if index < 0 || count <= index {
+		return false
+	}
+
+	// Walk down to the item, recording which side each sibling is on.
+	left := []bool{}
+	for 1 < count {
+		mid := count / 2
+		if index < mid {
+			left = append(left, false)
+			count = mid
+		} else {
+			left = append(left, true)
+			count -= mid
+			index -= mid
+		}
+	}
+	if len(left) != len(proof) {
+		return false
+	}
+
+	// Then hash back up to the root.
+	node := sha256.Sum256(item)
+	for i := len(proof) - 1; 0 <= i; i-- {
+		if left[i] {
+			node = sha256.Sum256(append(proof[i][:], node[:]...))
+		} else {
+			node = sha256.Sum256(append(node[:], proof[i][:]...))
+		}
+	}
+	return node == root
+}
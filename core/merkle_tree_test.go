@@ -26,3 +26,29 @@ func TestMerkleTreeAccumulate(t *testing.T) {
 	expectedStr := hex.EncodeToString(expected[:])
 	assert.Equal(expectedStr, "9d88c165d938bbc80c02fc856ddca3028f30b11fabff4cce14280742b031d5b6")
 }
+
+func TestMerkleProof(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, count := range []int{1, 2, 3, 7, 8, 13} {
+		items := [][]byte{}
+		for i := 0; i < count; i++ {
+			items = append(items, []byte(fmt.Sprintf("item %d", i)))
+		}
+		root := ComputeMerkleHash(items)
+
+		for i := range items {
+			proof := ComputeMerkleProof(items, i)
+			assert.True(VerifyMerkleProof(items[i], i, count, proof, root), "count=%d index=%d", count, i)
+
+			// The proof doesn't hold for another item, index or root.
+			assert.False(VerifyMerkleProof([]byte("other"), i, count, proof, root))
+			assert.False(VerifyMerkleProof(items[i], i, count, proof, [32]byte{}))
+			if 1 < count {
+				other := (i + 1) % count
+				assert.False(VerifyMerkleProof(items[i], other, count, proof, root))
+			}
+		}
+		assert.False(VerifyMerkleProof(items[0], count, count, nil, root))
+	}
+}
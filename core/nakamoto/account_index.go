@@ -0,0 +1,374 @@
+package nakamoto
+
+import (
+	"database/sql"
+)
+
+// The account index records, for each account, the next nonce it should use and the height of the last block on the
+// main chain involving it, so the mempool and wallets can look them up in O(1) rather than scanning the chain.
+//
+// The index follows the full tip. When a block extends the tip, the index applies the block's transactions. On a reorg,
+// the accounts involved in the blocks on either side of the fork are recomputed from the chain. The tip the index
+// reflects is stored with it, so an index left behind by a crash is caught up when the node restarts.
+//
+// The transaction index (tx_index) has an entry for each block including a transaction, on any branch. Along with the
+// account index, the entries of the main chain are marked canonical: on a reorg, the entries of the blocks leaving the
+// main chain are unmarked, and those of the blocks joining it are marked. Address histories only list canonical
+// entries, so they never show transactions on orphaned branches as confirmed.
+//
+// Nonces aren't enforced by consensus, so the next nonce of an account is one more than the highest nonce of its
+// transactions on the main chain, not counting coinbases, whose nonce is always 0.
+
+type AccountActivity struct {
+	// The next nonce of the account's transactions.
+	NextNonce uint64
+	// The height of the last block on the main chain which includes a transaction to or from the account.
+	LastActivityHeight uint64
+	// Whether the account has any transactions on the main chain.
+	Active bool
+}
+
+// Gets the activity of an account on the main chain.
+func (dag *BlockDAG) GetAccountActivity(account [65]byte) (AccountActivity, error) {
+	activity := AccountActivity{}
+	err := dag.db.QueryRow(
+		"select next_nonce, last_height from account_activity where account = ?",
+		account[:],
+	).Scan(&activity.NextNonce, &activity.LastActivityHeight)
+	if err == sql.ErrNoRows {
+		return AccountActivity{}, nil
+	}
+	if err != nil {
+		return AccountActivity{}, err
+	}
+	activity.Active = true
+	return activity, nil
+}
+
+// Returns the next nonce of an account: one more than the highest nonce of its transactions on the main chain, or 0 if
+// it has none. Coinbase transactions aren't counted, since their nonce is always 0.
+func (dag *BlockDAG) GetAccountNonce(account [65]byte) (uint64, error) {
+	activity, err := dag.GetAccountActivity(account)
+	if err != nil {
+		return 0, err
+	}
+	return activity.NextNonce, nil
+}
+
+// A transaction on the main chain sending to or from an account.
+type AddressHistoryEntry struct {
+	TxHash    [32]byte
+	BlockHash [32]byte
+	Height    uint64
+	// The timestamp of the block, in milliseconds.
+	Timestamp uint64
+	TxIndex   uint64
+	From      [65]byte
+	To        [65]byte
+	Amount    uint64
+	Fee       uint64
+}
+
+// Returns the transactions on the main chain sending to or from an account, newest first, up to a limit.
+func (dag *BlockDAG) GetAddressHistory(account [65]byte, limit uint64) ([]AddressHistoryEntry, error) {
+	return dag.GetAddressHistoryPage(account, 0, limit)
+}
+
+// Returns a page of an account's history, skipping the newest offset transactions, for listing the whole history.
+func (dag *BlockDAG) GetAddressHistoryPage(account [65]byte, offset uint64, limit uint64) ([]AddressHistoryEntry, error) {
+	rows, err := dag.db.Query(`
+		select i.tx_hash, i.block_hash, i.height, b.timestamp, i.txindex, t.from_pubkey, t.to_pubkey, t.amount, t.fee
+		from tx_index i join transactions t on t.hash = i.tx_hash join blocks b on b.hash = i.block_hash
+		where i.canonical = 1 and (t.from_pubkey = ? or t.to_pubkey = ?)
+		order by i.height desc, i.txindex desc
+		limit ? offset ?`,
+		account[:],
+		account[:],
+		limit,
+		offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []AddressHistoryEntry{}
+	for rows.Next() {
+		entry := AddressHistoryEntry{}
+		txHash, blockHash, from, to := []byte{}, []byte{}, []byte{}, []byte{}
+		if err := rows.Scan(&txHash, &blockHash, &entry.Height, &entry.Timestamp, &entry.TxIndex, &from, &to, &entry.Amount, &entry.Fee); err != nil {
+			return nil, err
+		}
+		copy(entry.TxHash[:], txHash)
+		copy(entry.BlockHash[:], blockHash)
+		copy(entry.From[:], from)
+		copy(entry.To[:], to)
+		history = append(history, entry)
+	}
+	return history, rows.Err()
+}
+
+// Brings the account index up to date with the full tip.
+func (dag *BlockDAG) updateAccountIndex() error {
+	tip := dag.FullTip
+	var indexTip [32]byte
+	indexTipBuf := []byte{}
+	err := dag.db.QueryRow("select hash from account_activity_tip").Scan(&indexTipBuf)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	copy(indexTip[:], indexTipBuf)
+
+	switch {
+	case indexTip == tip.Hash:
+		return nil
+
+	case err == sql.ErrNoRows:
+		// Build the index from the whole main chain.
+		blocks, err := dag.getMainChainBlocks(0, tip.Height)
+		if err != nil {
+			return err
+		}
+		return dag.applyAccountIndexBlocks(blocks)
+
+	case indexTip == tip.ParentHash:
+		return dag.applyAccountIndexBlocks([]Block{tip})
+	}
+
+	ancestor, err := dag.GetCommonAncestor(indexTip, tip.Hash)
+	if err != nil {
+		return err
+	}
+
+	// The tip advanced by several blocks.
+	if ancestor.Hash == indexTip {
+		blocks, err := dag.getMainChainBlocks(ancestor.Height+1, tip.Height)
+		if err != nil {
+			return err
+		}
+		return dag.applyAccountIndexBlocks(blocks)
+	}
+
+	// Recompute the accounts involved in the blocks on either side of the fork.
+	accounts := map[[65]byte]bool{}
+	for _, branch := range [][32]byte{indexTip, tip.Hash} {
+		if err := dag.getAccountsSince(branch, ancestor.Height, accounts); err != nil {
+			return err
+		}
+	}
+	activities := map[[65]byte]AccountActivity{}
+	for account := range accounts {
+		activity, err := dag.scanAccountActivity(account)
+		if err != nil {
+			return err
+		}
+		activities[account] = activity
+	}
+
+	tx, err := dag.db.Begin()
+	if err != nil {
+		return err
+	}
+	for account, activity := range activities {
+		if !activity.Active {
+			_, err = tx.Exec("delete from account_activity where account = ?", account[:])
+		} else {
+			_, err = tx.Exec(
+				"insert or replace into account_activity (account, next_nonce, last_height) values (?, ?, ?)",
+				account[:], activity.NextNonce, activity.LastActivityHeight,
+			)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := setBranchCanonical(tx, indexTip, ancestor.Height, false); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := setBranchCanonical(tx, tip.Hash, ancestor.Height, true); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := setAccountIndexTip(tx, tip.Hash); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Applies the transactions of blocks extending the index tip, the last of which is the full tip.
+func (dag *BlockDAG) applyAccountIndexBlocks(blocks []Block) error {
+	activities := map[[65]byte]AccountActivity{}
+	touch := func(account [65]byte, height uint64) AccountActivity {
+		activity := activities[account]
+		activity.Active = true
+		activity.LastActivityHeight = height
+		return activity
+	}
+	for _, block := range blocks {
+		txs, err := dag.GetBlockTransactions(block.Hash)
+		if err != nil {
+			return err
+		}
+		for i, tx := range *txs {
+			from := touch(tx.FromPubkey, block.Height)
+			if i != 0 && from.NextNonce < tx.Nonce+1 {
+				from.NextNonce = tx.Nonce + 1
+			}
+			activities[tx.FromPubkey] = from
+			activities[tx.ToPubkey] = touch(tx.ToPubkey, block.Height)
+		}
+	}
+
+	tx, err := dag.db.Begin()
+	if err != nil {
+		return err
+	}
+	for account, activity := range activities {
+		_, err := tx.Exec(
+			`insert into account_activity (account, next_nonce, last_height) values (?, ?, ?)
+			on conflict (account) do update set next_nonce = max(next_nonce, excluded.next_nonce), last_height = max(last_height, excluded.last_height)`,
+			account[:], activity.NextNonce, activity.LastActivityHeight,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, block := range blocks {
+		if _, err := tx.Exec("update tx_index set canonical = 1 where block_hash = ?", block.Hash[:]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := setAccountIndexTip(tx, dag.FullTip.Hash); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Reads the blocks of the main chain between two heights, inclusive.
+func (dag *BlockDAG) getMainChainBlocks(from uint64, to uint64) ([]Block, error) {
+	it, err := dag.IterateMainChain(from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	blocks := []Block{}
+	for it.Next() {
+		blocks = append(blocks, it.Block())
+	}
+	return blocks, it.Err()
+}
+
+func setAccountIndexTip(tx *sql.Tx, hash [32]byte) error {
+	if _, err := tx.Exec("delete from account_activity_tip"); err != nil {
+		return err
+	}
+	_, err := tx.Exec("insert into account_activity_tip (hash) values (?)", hash[:])
+	return err
+}
+
+// Marks the transaction index entries of the blocks from a block back to (not including) the given height as canonical,
+// or not.
+func setBranchCanonical(tx *sql.Tx, hash [32]byte, height uint64, canonical bool) error {
+	_, err := tx.Exec(`
+		with recursive chain(hash, parent_hash, height) as (
+			select hash, parent_hash, height from blocks where hash = ?
+			union all
+			select b.hash, b.parent_hash, b.height from blocks b join chain c on b.hash = c.parent_hash where ? < c.height
+		)
+		update tx_index set canonical = ? where block_hash in (select hash from chain where ? < height)`,
+		hash[:],
+		height,
+		canonical,
+		height,
+	)
+	return err
+}
+
+// Adds the accounts sending or receiving transactions in the blocks from a block back to (not including) the given
+// height.
+func (dag *BlockDAG) getAccountsSince(hash [32]byte, height uint64, accounts map[[65]byte]bool) error {
+	rows, err := dag.db.Query(`
+		with recursive chain(hash, parent_hash, height) as (
+			select hash, parent_hash, height from blocks where hash = ?
+			union all
+			select b.hash, b.parent_hash, b.height from blocks b join chain c on b.hash = c.parent_hash where ? < c.height
+		)
+		select t.from_pubkey, t.to_pubkey from tx_index i join transactions t on t.hash = i.tx_hash join chain c on i.block_hash = c.hash where ? < c.height`,
+		hash[:],
+		height,
+		height,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		from, to := []byte{}, []byte{}
+		if err := rows.Scan(&from, &to); err != nil {
+			return err
+		}
+		var account [65]byte
+		copy(account[:], from)
+		accounts[account] = true
+		account = [65]byte{}
+		copy(account[:], to)
+		accounts[account] = true
+	}
+	return rows.Err()
+}
+
+// Computes the activity of an account by scanning the main chain.
+func (dag *BlockDAG) scanAccountActivity(account [65]byte) (AccountActivity, error) {
+	// Find the lowest block which includes a transaction of the account, to bound the walk back from the tip.
+	var minHeight sql.NullInt64
+	err := dag.db.QueryRow(
+		`select min(i.height) from tx_index i join transactions t on t.hash = i.tx_hash where t.from_pubkey = ? or t.to_pubkey = ?`,
+		account[:],
+		account[:],
+	).Scan(&minHeight)
+	if err != nil {
+		return AccountActivity{}, err
+	}
+	if !minHeight.Valid {
+		return AccountActivity{}, nil
+	}
+
+	var nonce, lastHeight sql.NullInt64
+	err = dag.db.QueryRow(`
+		with recursive chain(hash, parent_hash, height) as (
+			select hash, parent_hash, height from blocks where hash = ?
+			union all
+			select b.hash, b.parent_hash, b.height from blocks b join chain c on b.hash = c.parent_hash where ? < c.height
+		)
+		select
+			max(case when t.from_pubkey = ? and i.txindex != 0 then t.nonce end),
+			max(i.height)
+		from tx_index i join transactions t on t.hash = i.tx_hash join chain c on i.block_hash = c.hash
+		where t.from_pubkey = ? or t.to_pubkey = ?`,
+		dag.FullTip.Hash[:],
+		minHeight.Int64,
+		account[:],
+		account[:],
+		account[:],
+	).Scan(&nonce, &lastHeight)
+	if err != nil {
+		return AccountActivity{}, err
+	}
+	if !lastHeight.Valid {
+		return AccountActivity{}, nil
+	}
+
+	activity := AccountActivity{Active: true, LastActivityHeight: uint64(lastHeight.Int64)}
+	if nonce.Valid {
+		activity.NextNonce = uint64(nonce.Int64) + 1
+	}
+	return activity, nil
+}
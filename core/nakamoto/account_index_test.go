@@ -0,0 +1,136 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDagAccountIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForMiner()
+	wallets := getTestingWallets(t)
+	sender, miner := wallets[1].PubkeyBytes(), wallets[0].PubkeyBytes()
+
+	// Checks the index matches a scan of the main chain.
+	checkIndex := func() {
+		for _, account := range [][65]byte{sender, miner, {}} {
+			indexed, err := dag.GetAccountActivity(account)
+			assert.Nil(err)
+			scanned, err := dag.scanAccountActivity(account)
+			assert.Nil(err)
+			assert.Equal(scanned, indexed)
+		}
+	}
+
+	mempool := NewMempool()
+	assert.Nil(mempool.AddPackage([]*Transaction{makePackageTx(t, &wallets[1], 0, 0), makePackageTx(t, &wallets[1], 1, 2)}))
+	m := NewMiner(dag, &wallets[0])
+	m.Mempool = mempool
+	m.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Start(1)
+	block1 := dag.FullTip.Hash
+	m.Mempool = nil
+	m.Start(2)
+
+	activity, err := dag.GetAccountActivity(sender)
+	assert.Nil(err)
+	assert.Equal(AccountActivity{NextNonce: 2, LastActivityHeight: 1, Active: true}, activity)
+	activity, err = dag.GetAccountActivity(miner)
+	assert.Nil(err)
+	assert.Equal(AccountActivity{NextNonce: 0, LastActivityHeight: 3, Active: true}, activity)
+	other, err := core.CreateRandomWallet()
+	assert.Nil(err)
+	activity, err = dag.GetAccountActivity(other.PubkeyBytes())
+	assert.Nil(err)
+	assert.False(activity.Active)
+	checkIndex()
+
+	// Reorgs update the index.
+	assert.Nil(dag.InvalidateBlock(block1))
+	activity, err = dag.GetAccountActivity(sender)
+	assert.Nil(err)
+	assert.Equal(AccountActivity{}, activity)
+	checkIndex()
+	assert.Nil(dag.ReconsiderBlock(block1))
+	nonce, err := dag.GetAccountNonce(sender)
+	assert.Nil(err)
+	assert.Equal(uint64(2), nonce)
+	checkIndex()
+
+	// The index is rebuilt if it's missing.
+	_, err = dag.db.Exec("delete from account_activity")
+	assert.Nil(err)
+	_, err = dag.db.Exec("delete from account_activity_tip")
+	assert.Nil(err)
+	assert.Nil(dag.updateAccountIndex())
+	checkIndex()
+}
+
+func TestDagAddressHistory(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForMiner()
+	wallets := getTestingWallets(t)
+	sender := wallets[1].PubkeyBytes()
+
+	mempool := NewMempool()
+	assert.Nil(mempool.AddPackage([]*Transaction{makePackageTx(t, &wallets[1], 0, 0), makePackageTx(t, &wallets[1], 1, 2)}))
+	m := NewMiner(dag, &wallets[0])
+	m.Mempool = mempool
+	hashes := [][32]byte{}
+	m.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+	m.Start(1)
+	block1 := dag.FullTip.Hash
+	m.Mempool = nil
+	m.Start(1)
+
+	history, err := dag.GetAddressHistory(sender, 10)
+	assert.Nil(err)
+	assert.Equal(2, len(history))
+	assert.Equal(block1, history[0].BlockHash)
+	assert.Equal(uint64(2), history[0].TxIndex)
+	assert.Equal(sender, history[0].From)
+	history, err = dag.GetAddressHistory(sender, 1)
+	assert.Nil(err)
+	assert.Equal(1, len(history))
+	block, err := dag.GetBlockByHash(block1)
+	assert.Nil(err)
+	assert.Equal(block.Timestamp, history[0].Timestamp)
+	history, err = dag.GetAddressHistoryPage(sender, 1, 10)
+	assert.Nil(err)
+	assert.Equal(1, len(history))
+	assert.Equal(uint64(1), history[0].TxIndex)
+
+	// Transactions on orphaned branches aren't listed, though they're still indexed.
+	assert.Nil(dag.InvalidateBlock(block1))
+	m.Start(3)
+	branch := hashes[2]
+	history, err = dag.GetAddressHistory(sender, 10)
+	assert.Nil(err)
+	assert.Equal(0, len(history))
+	location, err := dag.GetTransactionLocation(makePackageTx(t, &wallets[1], 0, 0).Hash)
+	assert.Nil(err)
+	assert.Nil(location)
+	indexed := 0
+	assert.Nil(dag.db.QueryRow("select count(*) from tx_index where block_hash = ?", block1[:]).Scan(&indexed))
+	assert.Equal(3, indexed)
+
+	// And are listed again if their branch rejoins the main chain.
+	assert.Nil(dag.ReconsiderBlock(block1))
+	assert.Nil(dag.InvalidateBlock(branch))
+	history, err = dag.GetAddressHistory(sender, 10)
+	assert.Nil(err)
+	assert.Equal(2, len(history))
+}
@@ -0,0 +1,195 @@
+package nakamoto
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// The address book names pubkeys, so users can send to "alice" rather than copy-pasting a 65-byte hex pubkey. Wherever
+// the RPC API or CLI accepts an address, it also accepts the name of a contact.
+//
+// Names start with a letter, and are at most 64 letters, digits, '.', '_' or '-', so they're never mistaken for a
+// hex-encoded pubkey, which is 130 characters. The book is saved to a JSON file on each change,
+// in the same format it's exported and imported in: an array of {"name", "pubkey"} objects.
+
+var contactNameRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9._-]{0,63}$`)
+
+type Contact struct {
+	Name string `json:"name"`
+	// The hex-encoded pubkey.
+	Pubkey string `json:"pubkey"`
+}
+
+type AddressBook struct {
+	contacts map[string][65]byte
+	// The file the book is saved to, or "" if it's only kept in memory.
+	path  string
+	mutex sync.Mutex
+}
+
+func NewAddressBook() *AddressBook {
+	return &AddressBook{contacts: make(map[string][65]byte)}
+}
+
+// Loads the address book saved to a file, if it exists, and saves it there on each change.
+func LoadAddressBook(path string) (*AddressBook, error) {
+	b := NewAddressBook()
+	contacts, err := ReadContactsFile(path)
+	if os.IsNotExist(err) {
+		contacts = []Contact{}
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err := b.Import(contacts); err != nil {
+		return nil, fmt.Errorf("Failed to load address book from %s: %s", path, err)
+	}
+	b.path = path
+	return b, nil
+}
+
+func validateContactName(name string) error {
+	if !contactNameRegexp.MatchString(name) {
+		return fmt.Errorf("Invalid contact name %q: names start with a letter, and are at most 64 letters, digits, '.', '_' or '-'.", name)
+	}
+	return nil
+}
+
+// Adds a contact. Adding a name again with a different pubkey is an error; remove it first.
+func (b *AddressBook) Add(name string, pubkey [65]byte) error {
+	if err := validateContactName(name); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if existing, ok := b.contacts[name]; ok && existing != pubkey {
+		return fmt.Errorf("Contact %s already exists.", name)
+	}
+	b.contacts[name] = pubkey
+	return b.save()
+}
+
+func (b *AddressBook) Remove(name string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.contacts[name]; !ok {
+		return fmt.Errorf("Contact %s not found.", name)
+	}
+	delete(b.contacts, name)
+	return b.save()
+}
+
+func (b *AddressBook) Get(name string) ([65]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	pubkey, ok := b.contacts[name]
+	return pubkey, ok
+}
+
+// Returns the contacts, ordered by name.
+func (b *AddressBook) Contacts() []Contact {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.sortedContacts()
+}
+
+func (b *AddressBook) sortedContacts() []Contact {
+	contacts := []Contact{}
+	for name, pubkey := range b.contacts {
+		contacts = append(contacts, Contact{Name: name, Pubkey: hex.EncodeToString(pubkey[:])})
+	}
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].Name < contacts[j].Name
+	})
+	return contacts
+}
+
+// Imports contacts, returning the number added. Either all are imported, or none are if any is invalid or conflicts
+// with an existing contact.
+func (b *AddressBook) Import(contacts []Contact) (int, error) {
+	pubkeys := make(map[string][65]byte)
+	for _, contact := range contacts {
+		if err := validateContactName(contact.Name); err != nil {
+			return 0, err
+		}
+		pubkey, err := parsePubkey(contact.Pubkey)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid pubkey for contact %s: %s", contact.Name, err)
+		}
+		if existing, ok := pubkeys[contact.Name]; ok && existing != pubkey {
+			return 0, fmt.Errorf("Contact %s is listed twice with different pubkeys.", contact.Name)
+		}
+		pubkeys[contact.Name] = pubkey
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for name, pubkey := range pubkeys {
+		if existing, ok := b.contacts[name]; ok && existing != pubkey {
+			return 0, fmt.Errorf("Contact %s already exists.", name)
+		}
+	}
+	added := 0
+	for name, pubkey := range pubkeys {
+		if _, ok := b.contacts[name]; !ok {
+			added++
+		}
+		b.contacts[name] = pubkey
+	}
+	return added, b.save()
+}
+
+// Resolves an address, which is either a hex-encoded pubkey or the name of a contact.
+func (b *AddressBook) Resolve(address string) ([65]byte, error) {
+	if pubkey, err := parsePubkey(address); err == nil {
+		return pubkey, nil
+	}
+	if pubkey, ok := b.Get(address); ok {
+		return pubkey, nil
+	}
+	return [65]byte{}, fmt.Errorf("Invalid address %q: not a hex-encoded pubkey, or the name of a contact.", address)
+}
+
+func (b *AddressBook) save() error {
+	if b.path == "" {
+		return nil
+	}
+	return WriteContactsFile(b.path, b.sortedContacts())
+}
+
+// Reads contacts exported to a file.
+func ReadContactsFile(path string) ([]Contact, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	contacts := []Contact{}
+	if err := json.Unmarshal(data, &contacts); err != nil {
+		return nil, fmt.Errorf("Failed to read contacts from %s: %s", path, err)
+	}
+	return contacts, nil
+}
+
+// Writes contacts to a file, for import elsewhere.
+func WriteContactsFile(path string, contacts []Contact) error {
+	data, err := json.MarshalIndent(contacts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// The node.
+// =====================================================================================================================
+
+// Parses an address given to the RPC API: a hex-encoded pubkey, or the name of a contact in the node's address book.
+func (n *Node) parseAddress(address string) ([65]byte, error) {
+	if n.AddressBook == nil {
+		return parsePubkey(address)
+	}
+	return n.AddressBook.Resolve(address)
+}
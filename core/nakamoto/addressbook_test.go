@@ -0,0 +1,65 @@
+package nakamoto
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressBook(t *testing.T) {
+	assert := assert.New(t)
+	wallets := getTestingWallets(t)
+	alice, bob := wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes()
+
+	path := filepath.Join(t.TempDir(), "contacts.json")
+	book, err := LoadAddressBook(path)
+	assert.Nil(err)
+	assert.Nil(book.Add("alice", alice))
+	assert.Nil(book.Add("alice", alice))
+	assert.EqualError(book.Add("alice", bob), "Contact alice already exists.")
+
+	// Names are validated, and are shorter than pubkeys.
+	assert.NotNil(book.Add("1alice", bob))
+	assert.NotNil(book.Add("a b", bob))
+	assert.NotNil(book.Add(strings.Repeat("a", 130), bob))
+
+	// Addresses resolve to pubkeys, or to contacts by name.
+	pubkey, err := book.Resolve("alice")
+	assert.Nil(err)
+	assert.Equal(alice, pubkey)
+	pubkey, err = book.Resolve(wallets[1].PubkeyStr())
+	assert.Nil(err)
+	assert.Equal(bob, pubkey)
+	_, err = book.Resolve("carol")
+	assert.NotNil(err)
+
+	// The book is saved on each change.
+	book2, err := LoadAddressBook(path)
+	assert.Nil(err)
+	assert.Equal(book.Contacts(), book2.Contacts())
+
+	// Imports are all or nothing.
+	added, err := book2.Import([]Contact{{Name: "bob", Pubkey: wallets[1].PubkeyStr()}, {Name: "alice", Pubkey: wallets[1].PubkeyStr()}})
+	assert.NotNil(err)
+	assert.Equal(0, added)
+	_, ok := book2.Get("bob")
+	assert.False(ok)
+	added, err = book2.Import([]Contact{{Name: "bob", Pubkey: wallets[1].PubkeyStr()}, {Name: "alice", Pubkey: wallets[0].PubkeyStr()}})
+	assert.Nil(err)
+	assert.Equal(1, added)
+
+	// And exports can be imported elsewhere.
+	exported := filepath.Join(t.TempDir(), "export.json")
+	assert.Nil(WriteContactsFile(exported, book2.Contacts()))
+	contacts, err := ReadContactsFile(exported)
+	assert.Nil(err)
+	book3 := NewAddressBook()
+	_, err = book3.Import(contacts)
+	assert.Nil(err)
+	assert.Equal([]Contact{{Name: "alice", Pubkey: wallets[0].PubkeyStr()}, {Name: "bob", Pubkey: wallets[1].PubkeyStr()}}, book3.Contacts())
+
+	assert.Nil(book3.Remove("bob"))
+	assert.EqualError(book3.Remove("bob"), "Contact bob not found.")
+}
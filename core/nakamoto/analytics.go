@@ -0,0 +1,288 @@
+package nakamoto
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chain analytics compute rolling statistics over the most recent blocks of the main chain - block intervals, the
+// number of transactions per block, fees and the orphan rate - for operators tuning the consensus parameters of
+// private networks, ie. the target block time, the difficulty adjustment and the block size.
+//
+// The statistics are served over RPC for any window, and as Prometheus metrics for the configured windows, in the
+// Prometheus text format at /metrics on the API server. They're computed on demand and cached until the full tip
+// changes, so scraping is cheap.
+//
+// An orphan is a block at a height within the window which isn't on the main chain, ie. one which lost a race with
+// another miner or was reorged out. The orphan rate is the share of all blocks at those heights which are orphans.
+
+const (
+	// The maximum number of blocks statistics can be computed over.
+	MAX_ANALYTICS_WINDOW = 10000
+)
+
+// The default windows, in blocks, of the Prometheus metrics.
+var DEFAULT_ANALYTICS_WINDOWS = []uint64{10, 100, 1000}
+
+// Statistics of the most recent blocks of the main chain.
+type ChainStats struct {
+	// The number of blocks requested.
+	Window uint64
+	// The heights of the first and last block in the window, inclusive. The window is shorter than requested when the
+	// chain is.
+	FromHeight uint64
+	ToHeight   uint64
+	Blocks     uint64
+
+	// The intervals between the timestamps of the blocks and their parents.
+	MeanBlockInterval   time.Duration
+	MedianBlockInterval time.Duration
+
+	// The number of transactions per block, including the coinbase.
+	MeanTxsPerBlock   float64
+	MedianTxsPerBlock uint64
+
+	// The median fee of the transactions, not counting coinbases, or 0 if there are none.
+	MedianFee    uint64
+	Transactions uint64
+
+	// The number of blocks at heights within the window which aren't on the main chain, and their share of all blocks
+	// at those heights.
+	Orphans    uint64
+	OrphanRate float64
+}
+
+// Computes the statistics of the most recent blocks of the main chain, up to window blocks.
+func (dag *BlockDAG) GetChainStats(window uint64) (ChainStats, error) {
+	if window == 0 || MAX_ANALYTICS_WINDOW < window {
+		return ChainStats{}, fmt.Errorf("Window must be between 1 and %d blocks.", MAX_ANALYTICS_WINDOW)
+	}
+	tip := dag.FullTip
+	stats := ChainStats{Window: window, ToHeight: tip.Height}
+	if window <= tip.Height {
+		stats.FromHeight = tip.Height - window + 1
+	}
+
+	// Read the blocks, and the parent of the first, for its interval.
+	from := stats.FromHeight
+	if 0 < from {
+		from--
+	}
+	blocks, err := dag.getMainChainBlocks(from, tip.Height)
+	if err != nil {
+		return ChainStats{}, err
+	}
+
+	intervals := []time.Duration{}
+	txCounts := []uint64{}
+	totalInterval := time.Duration(0)
+	totalTxs := uint64(0)
+	for i, block := range blocks {
+		// Skip the parent of the first block.
+		if block.Height < stats.FromHeight {
+			continue
+		}
+		if 0 < i {
+			// Timestamps aren't required to increase, so intervals can be negative.
+			interval := time.Duration(int64(block.Timestamp)-int64(blocks[i-1].Timestamp)) * time.Millisecond
+			intervals = append(intervals, interval)
+			totalInterval += interval
+		}
+		txCounts = append(txCounts, block.NumTransactions)
+		totalTxs += block.NumTransactions
+	}
+	stats.Blocks = uint64(len(txCounts))
+
+	if 0 < len(intervals) {
+		stats.MeanBlockInterval = totalInterval / time.Duration(len(intervals))
+		sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+		stats.MedianBlockInterval = intervals[len(intervals)/2]
+	}
+	if 0 < len(txCounts) {
+		stats.MeanTxsPerBlock = float64(totalTxs) / float64(len(txCounts))
+		sort.Slice(txCounts, func(i, j int) bool { return txCounts[i] < txCounts[j] })
+		stats.MedianTxsPerBlock = txCounts[len(txCounts)/2]
+	}
+
+	fees, err := dag.getMainChainFees(tip.Hash, stats.FromHeight)
+	if err != nil {
+		return ChainStats{}, err
+	}
+	stats.Transactions = uint64(len(fees))
+	if 0 < len(fees) {
+		sort.Slice(fees, func(i, j int) bool { return fees[i] < fees[j] })
+		stats.MedianFee = fees[len(fees)/2]
+	}
+
+	total := uint64(0)
+	err = dag.db.QueryRow(
+		"select count(*) from blocks where ? <= height and height <= ?",
+		stats.FromHeight,
+		stats.ToHeight,
+	).Scan(&total)
+	if err != nil {
+		return ChainStats{}, err
+	}
+	if stats.Blocks < total {
+		stats.Orphans = total - stats.Blocks
+		stats.OrphanRate = float64(stats.Orphans) / float64(total)
+	}
+
+	return stats, nil
+}
+
+// Estimates the hashrate of the network, in hashes per second, from the work done on the most recent blocks of the
+// main chain, up to window blocks, and the time taken. Returns 0 if there are too few blocks to tell.
+func (dag *BlockDAG) EstimateNetworkHashrate(window uint64) (float64, error) {
+	if window == 0 || MAX_ANALYTICS_WINDOW < window {
+		return 0, fmt.Errorf("Window must be between 1 and %d blocks.", MAX_ANALYTICS_WINDOW)
+	}
+	tip := dag.FullTip
+	from := uint64(0)
+	if window <= tip.Height {
+		from = tip.Height - window
+	}
+	blocks, err := dag.getMainChainBlocks(from, tip.Height)
+	if err != nil {
+		return 0, err
+	}
+	if len(blocks) < 2 {
+		return 0, nil
+	}
+
+	first, last := blocks[0], blocks[len(blocks)-1]
+	if last.Timestamp <= first.Timestamp {
+		return 0, nil
+	}
+	work := new(big.Int).Sub(&last.AccumulatedWork, &first.AccumulatedWork)
+	seconds := float64(last.Timestamp-first.Timestamp) / 1000
+	hashes, _ := new(big.Float).SetInt(work).Float64()
+	return hashes / seconds, nil
+}
+
+// Reads the fees of the transactions, not counting coinbases, in the blocks from a block back to the given height.
+func (dag *BlockDAG) getMainChainFees(hash [32]byte, fromHeight uint64) ([]uint64, error) {
+	rows, err := dag.db.Query(`
+		with recursive chain(hash, parent_hash, height) as (
+			select hash, parent_hash, height from blocks where hash = ?
+			union all
+			select b.hash, b.parent_hash, b.height from blocks b join chain c on b.hash = c.parent_hash where ? < c.height
+		)
+		select t.fee from tx_index i join transactions t on t.hash = i.tx_hash join chain c on i.block_hash = c.hash where i.txindex != 0`,
+		hash[:],
+		fromHeight,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fees := []uint64{}
+	for rows.Next() {
+		fee := uint64(0)
+		if err := rows.Scan(&fee); err != nil {
+			return nil, err
+		}
+		fees = append(fees, fee)
+	}
+	return fees, rows.Err()
+}
+
+// The chain analytics component, which caches the statistics of the configured windows and serves them to Prometheus.
+type ChainAnalytics struct {
+	// The windows, in blocks, of the Prometheus metrics.
+	Windows []uint64
+
+	dag *BlockDAG
+	// The statistics computed for the cached tip, by window.
+	cache    map[uint64]ChainStats
+	cacheTip [32]byte
+	mutex    sync.Mutex
+}
+
+func NewChainAnalytics(dag *BlockDAG) *ChainAnalytics {
+	return &ChainAnalytics{
+		Windows: DEFAULT_ANALYTICS_WINDOWS,
+		dag:     dag,
+		cache:   map[uint64]ChainStats{},
+	}
+}
+
+// Gets the statistics of the most recent blocks of the main chain, up to window blocks, from the cache if the full tip
+// hasn't changed since they were computed.
+func (a *ChainAnalytics) GetStats(window uint64) (ChainStats, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	tip := a.dag.FullTip.Hash
+	if tip != a.cacheTip {
+		a.cache = map[uint64]ChainStats{}
+		a.cacheTip = tip
+	}
+	if stats, ok := a.cache[window]; ok {
+		return stats, nil
+	}
+	stats, err := a.dag.GetChainStats(window)
+	if err != nil {
+		return ChainStats{}, err
+	}
+	a.cache[window] = stats
+	return stats, nil
+}
+
+// Serves the statistics of the configured windows as Prometheus metrics, in the text exposition format.
+func (a *ChainAnalytics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	allStats := []ChainStats{}
+	for _, window := range a.Windows {
+		stats, err := a.GetStats(window)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		allStats = append(allStats, stats)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(a.formatMetrics(allStats)))
+}
+
+// Formats statistics as Prometheus metrics, labelled by window.
+func (a *ChainAnalytics) formatMetrics(allStats []ChainStats) string {
+	metrics := []struct {
+		name  string
+		help  string
+		value func(s ChainStats) float64
+	}{
+		{"tinychain_blocks", "The number of main chain blocks in the window.", func(s ChainStats) float64 { return float64(s.Blocks) }},
+		{"tinychain_block_interval_mean_seconds", "The mean interval between blocks.", func(s ChainStats) float64 { return s.MeanBlockInterval.Seconds() }},
+		{"tinychain_block_interval_median_seconds", "The median interval between blocks.", func(s ChainStats) float64 { return s.MedianBlockInterval.Seconds() }},
+		{"tinychain_txs_per_block_mean", "The mean number of transactions per block, including the coinbase.", func(s ChainStats) float64 { return s.MeanTxsPerBlock }},
+		{"tinychain_txs_per_block_median", "The median number of transactions per block, including the coinbase.", func(s ChainStats) float64 { return float64(s.MedianTxsPerBlock) }},
+		{"tinychain_tx_fee_median", "The median fee of transactions, not counting coinbases.", func(s ChainStats) float64 { return float64(s.MedianFee) }},
+		{"tinychain_orphans", "The number of blocks at heights in the window which aren't on the main chain.", func(s ChainStats) float64 { return float64(s.Orphans) }},
+		{"tinychain_orphan_rate", "The share of blocks at heights in the window which aren't on the main chain.", func(s ChainStats) float64 { return s.OrphanRate }},
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP tinychain_height The height of the full tip.\n")
+	fmt.Fprintf(&b, "# TYPE tinychain_height gauge\n")
+	fmt.Fprintf(&b, "tinychain_height %d\n", a.dag.FullTip.Height)
+	for _, metric := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n", metric.name, metric.help)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", metric.name)
+		for _, stats := range allStats {
+			fmt.Fprintf(&b, "%s{window=\"%d\"} %g\n", metric.name, stats.Window, metric.value(stats))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,143 @@
+package nakamoto
+
+import (
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainStats(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForMiner()
+	wallets := getTestingWallets(t)
+	txs := []*Transaction{
+		makePackageTx(t, &wallets[1], 0, 1),
+		makePackageTx(t, &wallets[1], 1, 2),
+		makePackageTx(t, &wallets[1], 2, 3),
+	}
+	mempool := NewMempool()
+	assert.Nil(mempool.AddPackage(txs))
+
+	m := NewMiner(dag, &wallets[0])
+	m.Mempool = mempool
+	m.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Start(1)
+	m.Mempool = nil
+	m.Start(2)
+
+	// The last 3 blocks: one with the transactions and a coinbase, then two with only coinbases.
+	stats, err := dag.GetChainStats(3)
+	assert.Nil(err)
+	assert.Equal(uint64(1), stats.FromHeight)
+	assert.Equal(uint64(3), stats.ToHeight)
+	assert.Equal(uint64(3), stats.Blocks)
+	assert.Equal(float64(2), stats.MeanTxsPerBlock)
+	assert.Equal(uint64(1), stats.MedianTxsPerBlock)
+	assert.Equal(uint64(3), stats.Transactions)
+	assert.Equal(txs[1].Fee, stats.MedianFee)
+	assert.Equal(uint64(0), stats.Orphans)
+
+	// The intervals include the one between the first block and its parent.
+	blocks, err := dag.getMainChainBlocks(0, 3)
+	assert.Nil(err)
+	intervals := []time.Duration{}
+	for i := 1; i < len(blocks); i++ {
+		intervals = append(intervals, time.Duration(blocks[i].Timestamp-blocks[i-1].Timestamp)*time.Millisecond)
+	}
+	assert.Equal((intervals[0]+intervals[1]+intervals[2])/3, stats.MeanBlockInterval)
+	assert.Contains(intervals, stats.MedianBlockInterval)
+
+	// The window is shorter than requested when the chain is.
+	stats, err = dag.GetChainStats(100)
+	assert.Nil(err)
+	assert.Equal(uint64(0), stats.FromHeight)
+	assert.Equal(uint64(4), stats.Blocks)
+
+	_, err = dag.GetChainStats(0)
+	assert.NotNil(err)
+	_, err = dag.GetChainStats(MAX_ANALYTICS_WINDOW + 1)
+	assert.NotNil(err)
+}
+
+func TestChainAnalyticsMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForMiner()
+	wallets := getTestingWallets(t)
+	m := NewMiner(dag, &wallets[0])
+	m.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Start(3)
+	orphaned, err := dag.getMainChainBlocks(2, 2)
+	assert.Nil(err)
+
+	analytics := NewChainAnalytics(&dag)
+	analytics.Windows = []uint64{10}
+	stats, err := analytics.GetStats(10)
+	assert.Nil(err)
+	assert.Equal(uint64(0), stats.Orphans)
+
+	// Orphan the blocks at heights 2 and 3, by mining a competing branch.
+	assert.Nil(dag.InvalidateBlock(orphaned[0].Hash))
+	m.Start(2)
+	stats, err = analytics.GetStats(10)
+	assert.Nil(err)
+	assert.Equal(uint64(4), stats.Blocks)
+	assert.Equal(uint64(2), stats.Orphans)
+	assert.Equal(float64(2)/6, stats.OrphanRate)
+
+	res := httptest.NewRecorder()
+	analytics.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(http.StatusOK, res.Code)
+	body := res.Body.String()
+	assert.Contains(body, "# TYPE tinychain_orphan_rate gauge\n")
+	assert.Contains(body, "tinychain_height 3\n")
+	assert.Contains(body, "tinychain_blocks{window=\"10\"} 4\n")
+	assert.Contains(body, "tinychain_orphans{window=\"10\"} 2\n")
+}
+
+func TestEstimateNetworkHashrate(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForMiner()
+	wallets := getTestingWallets(t)
+
+	// Too few blocks to tell.
+	hashrate, err := dag.EstimateNetworkHashrate(10)
+	assert.Nil(err)
+	assert.Equal(float64(0), hashrate)
+
+	m := NewMiner(dag, &wallets[0])
+	m.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Start(3)
+
+	// The work done between the first and last block in the window, over the time taken.
+	blocks, err := dag.getMainChainBlocks(1, 3)
+	assert.Nil(err)
+	work := new(big.Int).Sub(&blocks[2].AccumulatedWork, &blocks[0].AccumulatedWork)
+	hashes, _ := new(big.Float).SetInt(work).Float64()
+	hashrate, err = dag.EstimateNetworkHashrate(2)
+	assert.Nil(err)
+	if blocks[2].Timestamp > blocks[0].Timestamp {
+		assert.Equal(hashes/(float64(blocks[2].Timestamp-blocks[0].Timestamp)/1000), hashrate)
+	}
+
+	_, err = dag.EstimateNetworkHashrate(0)
+	assert.NotNil(err)
+}
@@ -0,0 +1,248 @@
+package nakamoto
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type APIConfig struct {
+	address string
+	port    string
+
+	// Credentials for mutating RPC methods.
+	// If AuthToken is set, requests must include the header "Authorization: Bearer <token>".
+	// If AuthUsername is set, requests must include HTTP basic auth credentials.
+	// If neither is set, all requests are authorised.
+	AuthToken    string
+	AuthUsername string
+	AuthPassword string
+
+	// Per-IP rate limit, in requests per second. Zero disables rate limiting.
+	RateLimit float64
+	// The number of requests a client can burst above the rate limit.
+	RateLimitBurst int
+
+	// Origins allowed to make cross-origin requests. "*" allows all origins. Empty disables CORS.
+	CORSOrigins []string
+
+	// TLS certificate and key files. If both are set, the server is served over HTTPS.
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+func NewAPIConfig(address string, port string) APIConfig {
+	return APIConfig{address: address, port: port}
+}
+
+// APIServer is the user-facing HTTP API of the node, used by wallets, explorers and dashboards.
+// It is separate from the PeerServer, which serves the wire protocol to other peers.
+type APIServer struct {
+	config      APIConfig
+	mux         *http.ServeMux
+	log         log.Logger
+	server      *http.Server
+	rateLimiter *rateLimiter
+}
+
+func NewAPIServer(config APIConfig) *APIServer {
+	s := APIServer{
+		config: config,
+		mux:    http.NewServeMux(),
+		log:    *NewLogger("api-server", fmt.Sprintf(":%s", config.port)),
+	}
+
+	if 0 < config.RateLimit {
+		s.rateLimiter = newRateLimiter(config.RateLimit, config.RateLimitBurst)
+	}
+
+	s.server = &http.Server{
+		Addr:         config.address + ":" + config.port,
+		Handler:      s.middleware(s.mux),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	return &s
+}
+
+// Registers a HTTP handler for an API endpoint.
+func (s *APIServer) Handle(path string, handler http.Handler) {
+	s.log.Printf("Registering handler for '%s'\n", path)
+	s.mux.Handle(path, handler)
+}
+
+func (s *APIServer) Start() error {
+	var err error
+	if s.config.TLSCertFile != "" && s.config.TLSKeyFile != "" {
+		s.log.Printf("API server listening on https://%s\n", s.server.Addr)
+		err = s.server.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile)
+	} else {
+		s.log.Printf("API server listening on http://%s\n", s.server.Addr)
+		err = s.server.ListenAndServe()
+	}
+
+	if err != nil {
+		s.log.Println("Error starting server:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s *APIServer) Stop() {
+	s.log.Println("Stopping API server")
+	s.server.Shutdown(context.Background())
+}
+
+// Checks the request's credentials against the configured credentials.
+func (s *APIServer) Authorize(r *http.Request) bool {
+	if s.config.AuthToken == "" && s.config.AuthUsername == "" {
+		return true
+	}
+
+	if s.config.AuthToken != "" {
+		header := r.Header.Get("Authorization")
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.AuthToken)) == 1 {
+				return true
+			}
+		}
+	}
+
+	if s.config.AuthUsername != "" {
+		username, password, ok := r.BasicAuth()
+		if ok &&
+			subtle.ConstantTimeCompare([]byte(username), []byte(s.config.AuthUsername)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.config.AuthPassword)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Wraps all handlers with CORS and rate limiting.
+func (s *APIServer) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// CORS.
+		if origin := r.Header.Get("Origin"); origin != "" && s.isAllowedOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Add("Vary", "Origin")
+
+			// Preflight.
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		// Rate limiting.
+		if s.rateLimiter != nil && !s.rateLimiter.Allow(clientIP(r)) {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Charges n calls against the client's rate limit, for the calls in a JSON-RPC batch.
+func (s *APIServer) AllowCalls(r *http.Request, n int) bool {
+	if s.rateLimiter == nil {
+		return true
+	}
+	return s.rateLimiter.AllowN(clientIP(r), n)
+}
+
+func (s *APIServer) isAllowedOrigin(origin string) bool {
+	for _, allowed := range s.config.CORSOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// A token bucket rate limiter, keyed by client IP.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Returns true if the client is allowed to make a request, consuming a token.
+func (l *rateLimiter) Allow(key string) bool {
+	return l.AllowN(key, 1)
+}
+
+// Returns true if the client is allowed to make n requests, consuming n tokens. If the client doesn't have n tokens,
+// none are consumed.
+func (l *rateLimiter) AllowN(key string, n int) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+
+	// Garbage collect idle buckets, which have refilled to full anyway.
+	if 10000 < len(l.buckets) {
+		for k, b := range l.buckets {
+			if l.burst/l.rate < now.Sub(b.lastSeen).Seconds() {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, lastSeen: now}
+		l.buckets[key] = b
+	}
+
+	// Refill.
+	b.tokens += now.Sub(b.lastSeen).Seconds() * l.rate
+	if l.burst < b.tokens {
+		b.tokens = l.burst
+	}
+	b.lastSeen = now
+
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
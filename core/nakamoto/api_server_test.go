@@ -0,0 +1,298 @@
+package nakamoto
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAPIServer(config APIConfig) (*APIServer, *httptest.Server) {
+	api := NewAPIServer(config)
+
+	rpc := NewRPCHandler()
+	rpc.Authorize = api.Authorize
+	rpc.AllowCalls = api.AllowCalls
+	rpc.RegisterMethod("ping", func(params json.RawMessage) (interface{}, error) {
+		return "pong", nil
+	}, false)
+	rpc.RegisterMethod("mutate", func(params json.RawMessage) (interface{}, error) {
+		return true, nil
+	}, true)
+	rpc.RegisterMethod("admin_logs", func(params json.RawMessage) (interface{}, error) {
+		return []string{}, nil
+	}, false)
+	api.Handle("/rpc", rpc)
+
+	return api, httptest.NewServer(api.server.Handler)
+}
+
+func callRPC(t *testing.T, req *http.Request) RPCResponse {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %s", err)
+	}
+	defer res.Body.Close()
+
+	var rpcRes RPCResponse
+	if err := json.NewDecoder(res.Body).Decode(&rpcRes); err != nil {
+		t.Fatalf("Failed to decode response: %s", err)
+	}
+	return rpcRes
+}
+
+func newRPCRequest(t *testing.T, url string, method string) *http.Request {
+	body, _ := json.Marshal(RPCRequest{JSONRPC: "2.0", ID: json.RawMessage("1"), Method: method})
+	req, err := http.NewRequest(http.MethodPost, url+"/rpc", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %s", err)
+	}
+	return req
+}
+
+func TestAPIServerAuthMutatingMethods(t *testing.T) {
+	assert := assert.New(t)
+
+	config := NewAPIConfig("127.0.0.1", "0")
+	config.AuthToken = "secret"
+	config.AuthUsername = "admin"
+	config.AuthPassword = "hunter2"
+	_, server := newTestAPIServer(config)
+	defer server.Close()
+
+	// Read-only methods don't require auth.
+	res := callRPC(t, newRPCRequest(t, server.URL, "ping"))
+	assert.Nil(res.Error)
+	assert.Equal(`"pong"`, string(res.Result))
+
+	// Mutating methods do.
+	res = callRPC(t, newRPCRequest(t, server.URL, "mutate"))
+	assert.Equal(RPCErrUnauthorized, res.Error.Code)
+
+	req := newRPCRequest(t, server.URL, "mutate")
+	req.Header.Set("Authorization", "Bearer wrong")
+	res = callRPC(t, req)
+	assert.Equal(RPCErrUnauthorized, res.Error.Code)
+
+	req = newRPCRequest(t, server.URL, "mutate")
+	req.Header.Set("Authorization", "Bearer secret")
+	res = callRPC(t, req)
+	assert.Nil(res.Error)
+
+	req = newRPCRequest(t, server.URL, "mutate")
+	req.SetBasicAuth("admin", "hunter2")
+	res = callRPC(t, req)
+	assert.Nil(res.Error)
+
+	// Admin methods do, even when read-only.
+	res = callRPC(t, newRPCRequest(t, server.URL, "admin_logs"))
+	assert.Equal(RPCErrUnauthorized, res.Error.Code)
+
+	req = newRPCRequest(t, server.URL, "admin_logs")
+	req.Header.Set("Authorization", "Bearer secret")
+	res = callRPC(t, req)
+	assert.Nil(res.Error)
+}
+
+func TestAPIServerRateLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	config := NewAPIConfig("127.0.0.1", "0")
+	config.RateLimit = 0.001
+	config.RateLimitBurst = 2
+	_, server := newTestAPIServer(config)
+	defer server.Close()
+
+	statuses := []int{}
+	for i := 0; i < 3; i++ {
+		res, err := http.DefaultClient.Do(newRPCRequest(t, server.URL, "ping"))
+		if err != nil {
+			t.Fatalf("Failed to send request: %s", err)
+		}
+		res.Body.Close()
+		statuses = append(statuses, res.StatusCode)
+	}
+	assert.Equal([]int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, statuses)
+}
+
+func TestAPIServerCORS(t *testing.T) {
+	assert := assert.New(t)
+
+	config := NewAPIConfig("127.0.0.1", "0")
+	config.CORSOrigins = []string{"https://explorer.example"}
+	_, server := newTestAPIServer(config)
+	defer server.Close()
+
+	// Allowed origin preflight.
+	req, _ := http.NewRequest(http.MethodOptions, server.URL+"/rpc", nil)
+	req.Header.Set("Origin", "https://explorer.example")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %s", err)
+	}
+	res.Body.Close()
+	assert.Equal(http.StatusNoContent, res.StatusCode)
+	assert.Equal("https://explorer.example", res.Header.Get("Access-Control-Allow-Origin"))
+
+	// Disallowed origin.
+	req = newRPCRequest(t, server.URL, "ping")
+	req.Header.Set("Origin", "https://evil.example")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %s", err)
+	}
+	res.Body.Close()
+	assert.Equal("", res.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestAPIServerBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	api := NewAPIServer(NewAPIConfig("127.0.0.1", "0"))
+	rpc := NewRPCHandler()
+	rpc.RegisterMethod("ping", func(params json.RawMessage) (interface{}, error) {
+		return "pong", nil
+	}, false)
+	rpc.RegisterMethod("double", func(params json.RawMessage) (interface{}, error) {
+		t.Fatalf("Expected batch handler to be used")
+		return nil, nil
+	}, false)
+	numBatchCalls := 0
+	rpc.RegisterBatchHandler("double", func(params []json.RawMessage) ([]interface{}, []error) {
+		numBatchCalls++
+		results := make([]interface{}, len(params))
+		errs := make([]error, len(params))
+		for i, p := range params {
+			var x int
+			if err := parseRPCParams(p, &x); err != nil {
+				errs[i] = err
+				continue
+			}
+			results[i] = x * 2
+		}
+		return results, errs
+	})
+	api.Handle("/rpc", rpc)
+	server := httptest.NewServer(api.server.Handler)
+	defer server.Close()
+
+	post := func(body string) *http.Response {
+		res, err := http.Post(server.URL+"/rpc", "application/json", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("Failed to send request: %s", err)
+		}
+		return res
+	}
+
+	res := post(`[
+		{"jsonrpc": "2.0", "id": 1, "method": "ping"},
+		{"jsonrpc": "2.0", "id": 2, "method": "double", "params": [2]},
+		{"jsonrpc": "2.0", "id": 3, "method": "missing"},
+		{"jsonrpc": "2.0", "id": 4, "method": "double", "params": ["x"]},
+		{"jsonrpc": "2.0", "id": 5, "method": "double", "params": [21]}
+	]`)
+	var responses []RPCResponse
+	if err := json.NewDecoder(res.Body).Decode(&responses); err != nil {
+		t.Fatalf("Failed to decode response: %s", err)
+	}
+	res.Body.Close()
+
+	assert.Equal(5, len(responses))
+	assert.Equal(1, numBatchCalls)
+	assert.Equal(`"pong"`, string(responses[0].Result))
+	assert.Equal("2", string(responses[1].ID))
+	assert.Equal("4", string(responses[1].Result))
+	assert.Equal(RPCErrMethodNotFound, responses[2].Error.Code)
+	assert.Equal(RPCErrInvalidParams, responses[3].Error.Code)
+	assert.Equal("42", string(responses[4].Result))
+
+	// Empty batch.
+	res = post(`[]`)
+	var rpcRes RPCResponse
+	if err := json.NewDecoder(res.Body).Decode(&rpcRes); err != nil {
+		t.Fatalf("Failed to decode response: %s", err)
+	}
+	res.Body.Close()
+	assert.Equal(RPCErrInvalidRequest, rpcRes.Error.Code)
+}
+
+func TestAPIServerRequestSizeLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	_, server := newTestAPIServer(NewAPIConfig("127.0.0.1", "0"))
+	defer server.Close()
+
+	params := make([]byte, MAX_RPC_REQUEST_SIZE)
+	for i := range params {
+		params[i] = '1'
+	}
+	body := fmt.Sprintf(`{"jsonrpc": "2.0", "id": 1, "method": "ping", "params": [%s]}`, params)
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/rpc", bytes.NewReader([]byte(body)))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %s", err)
+	}
+	defer res.Body.Close()
+	assert.Equal(http.StatusRequestEntityTooLarge, res.StatusCode)
+
+	var rpcRes RPCResponse
+	if err := json.NewDecoder(res.Body).Decode(&rpcRes); err != nil {
+		t.Fatalf("Failed to decode response: %s", err)
+	}
+	assert.Equal(RPCErrInvalidRequest, rpcRes.Error.Code)
+
+	// Requests under the limit are served.
+	res2 := callRPC(t, newRPCRequest(t, server.URL, "ping"))
+	assert.Nil(res2.Error)
+}
+
+func TestAPIServerBatchLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	config := NewAPIConfig("127.0.0.1", "0")
+	config.RateLimit = 0.001
+	config.RateLimitBurst = 5
+	_, server := newTestAPIServer(config)
+	defer server.Close()
+
+	post := func(numCalls int) (*http.Response, []byte) {
+		calls := []string{}
+		for i := 0; i < numCalls; i++ {
+			calls = append(calls, fmt.Sprintf(`{"jsonrpc": "2.0", "id": %d, "method": "ping"}`, i))
+		}
+		body := "[" + strings.Join(calls, ",") + "]"
+		res, err := http.Post(server.URL+"/rpc", "application/json", bytes.NewReader([]byte(body)))
+		if err != nil {
+			t.Fatalf("Failed to send request: %s", err)
+		}
+		defer res.Body.Close()
+		data, _ := io.ReadAll(res.Body)
+		return res, data
+	}
+
+	// Batches over the maximum size are rejected.
+	res, data := post(MAX_RPC_BATCH_SIZE + 1)
+	var rpcRes RPCResponse
+	assert.Nil(json.Unmarshal(data, &rpcRes))
+	assert.Equal(RPCErrInvalidRequest, rpcRes.Error.Code)
+
+	// Each call in a batch is charged against the rate limit. The oversized batch consumed one token, leaving 4.
+	res, data = post(3)
+	assert.Equal(http.StatusOK, res.StatusCode)
+	var responses []RPCResponse
+	assert.Nil(json.Unmarshal(data, &responses))
+	assert.Equal(3, len(responses))
+
+	// One token is left, which the HTTP request consumes, so the rest of the batch is over the limit.
+	res, data = post(2)
+	assert.Equal(http.StatusTooManyRequests, res.StatusCode)
+	rpcRes = RPCResponse{}
+	assert.Nil(json.Unmarshal(data, &rpcRes))
+	assert.Equal(RPCErrRateLimited, rpcRes.Error.Code)
+}
@@ -0,0 +1,220 @@
+package nakamoto
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// The chain auditor re-verifies random historical blocks of the main chain in the background, to catch silent
+// corruption of the database on long-running nodes (bad disks, bit flips, interrupted writes). Blocks are only fully
+// validated once, when they're ingested, so corruption of old blocks otherwise goes unnoticed until they're served to
+// a peer or the state is rebuilt.
+//
+// Each Interval, the auditor picks a block on the main chain at a random height, reads it back from the database, and
+// checks:
+//   - The stored hash is the hash of the stored header.
+//   - The POW solution meets the difficulty of the block's epoch.
+//   - The merkle root of the stored transactions matches the header, if the block's body has been downloaded.
+//   - The stored accumulated work is the parent's accumulated work plus the block's own work.
+//
+// A mismatch raises an alert, which is logged, passed to OnAlert, and kept in the status returned by Status (which is
+// exposed over RPC). The auditor audits one block per Interval, so it adds little load to the node. It's disabled by
+// default.
+
+const (
+	// The number of recent alerts kept in the status.
+	MAX_AUDIT_ALERTS = 100
+)
+
+type AuditAlert struct {
+	Time   time.Time
+	Hash   [32]byte
+	Height uint64
+	// The checks which failed.
+	Mismatches []string
+	Message    string
+}
+
+type ChainAuditorStatus struct {
+	LastCheck time.Time
+	// The number of blocks audited, and the number which failed.
+	BlocksAudited uint64
+	BlocksFailed  uint64
+	// Recent alerts, oldest first.
+	Alerts []AuditAlert
+}
+
+type ChainAuditor struct {
+	dag *BlockDAG
+
+	// How often a block is audited. Zero disables the auditor.
+	Interval time.Duration
+
+	OnAlert func(alert AuditAlert)
+
+	status ChainAuditorStatus
+	rng    *rand.Rand
+	mutex  sync.Mutex
+	log    *log.Logger
+}
+
+func NewChainAuditor(dag *BlockDAG) *ChainAuditor {
+	return &ChainAuditor{
+		dag:      dag,
+		Interval: 0,
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		log:      NewLogger("blockdag", "auditor"),
+	}
+}
+
+func (a *ChainAuditor) Start() {
+	if a.Interval == 0 {
+		return
+	}
+	for {
+		time.Sleep(a.Interval)
+		if err := a.Tick(time.Now()); err != nil {
+			a.log.Printf("Failed to audit block: %s\n", err)
+		}
+	}
+}
+
+// Returns a copy of the auditor's status.
+func (a *ChainAuditor) Status() ChainAuditorStatus {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	status := a.status
+	status.Alerts = append([]AuditAlert{}, a.status.Alerts...)
+	return status
+}
+
+// Audits a block of the main chain at a random height.
+func (a *ChainAuditor) Tick(now time.Time) error {
+	a.mutex.Lock()
+	height := uint64(a.rng.Int63n(int64(a.dag.FullTip.Height) + 1))
+	a.mutex.Unlock()
+
+	block, err := a.dag.GetMainChainBlockAt(height)
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		return fmt.Errorf("No block on the main chain at height %d.", height)
+	}
+
+	_, err = a.AuditBlock(block.Hash, now)
+	return err
+}
+
+// Re-verifies a stored block, raising an alert if it doesn't match. Returns the checks which failed.
+func (a *ChainAuditor) AuditBlock(hash [32]byte, now time.Time) ([]string, error) {
+	mismatches, err := a.dag.auditBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mutex.Lock()
+	a.status.LastCheck = now
+	a.status.BlocksAudited++
+	if 0 < len(mismatches) {
+		a.status.BlocksFailed++
+	}
+	a.mutex.Unlock()
+
+	if 0 < len(mismatches) {
+		block, err := a.dag.GetBlockByHash(hash)
+		height := uint64(0)
+		if err == nil && block != nil {
+			height = block.Height
+		}
+		a.alert(AuditAlert{
+			Time:       now,
+			Hash:       hash,
+			Height:     height,
+			Mismatches: mismatches,
+			Message:    fmt.Sprintf("Block %x at height %d failed its audit: %v. The database may be corrupt.", hash, height, mismatches),
+		})
+	}
+	return mismatches, nil
+}
+
+func (a *ChainAuditor) alert(alert AuditAlert) {
+	a.log.Printf("WARNING: %s\n", alert.Message)
+
+	a.mutex.Lock()
+	a.status.Alerts = append(a.status.Alerts, alert)
+	if MAX_AUDIT_ALERTS < len(a.status.Alerts) {
+		a.status.Alerts = a.status.Alerts[len(a.status.Alerts)-MAX_AUDIT_ALERTS:]
+	}
+	a.mutex.Unlock()
+
+	if a.OnAlert != nil {
+		a.OnAlert(alert)
+	}
+}
+
+// Reads a block back from the database and re-verifies it. Returns the checks which failed.
+func (dag *BlockDAG) auditBlock(hash [32]byte) ([]string, error) {
+	block, err := dag.GetBlockByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("Block not found: %x", hash)
+	}
+	mismatches := []string{}
+
+	// The hash.
+	header := block.ToBlockHeader()
+	if header.BlockHash() != block.Hash {
+		mismatches = append(mismatches, "hash")
+	}
+
+	// The POW solution.
+	epoch, err := dag.GetEpochForBlockHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	if !VerifyPOW(block.Hash, epoch.Difficulty) {
+		mismatches = append(mismatches, "pow")
+	}
+
+	// The merkle root, once the body has been downloaded.
+	if block.SizeBytes != 0 {
+		txs, err := dag.GetBlockTransactions(hash)
+		if err != nil {
+			return nil, err
+		}
+		envelopes := [][]byte{}
+		for _, tx := range *txs {
+			raw := tx.ToRawTransaction()
+			envelopes = append(envelopes, raw.Envelope())
+		}
+		if uint64(len(envelopes)) != block.NumTransactions || core.ComputeMerkleHash(envelopes) != block.TransactionsMerkleRoot {
+			mismatches = append(mismatches, "merkle_root")
+		}
+	}
+
+	// The accumulated work.
+	accWork := CalculateWork(Bytes32ToBigInt(block.Hash))
+	accWork.Add(accWork, &block.ParentTotalWork)
+	workMatches := accWork.Cmp(&block.AccumulatedWork) == 0
+	if workMatches && 0 < block.Height {
+		parent, err := dag.GetBlockByHash(block.ParentHash)
+		if err != nil {
+			return nil, err
+		}
+		workMatches = parent != nil && parent.AccumulatedWork.Cmp(&block.ParentTotalWork) == 0
+	}
+	if !workMatches {
+		mismatches = append(mismatches, "acc_work")
+	}
+
+	return mismatches, nil
+}
@@ -0,0 +1,73 @@
+package nakamoto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainAuditor(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	hashes := [][32]byte{dag.FullTip.Hash}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+	miner.Start(5)
+
+	auditor := NewChainAuditor(&dag)
+	alerts := []AuditAlert{}
+	auditor.OnAlert = func(alert AuditAlert) {
+		alerts = append(alerts, alert)
+	}
+
+	// Intact blocks pass, including the genesis block.
+	now := time.Now()
+	for _, hash := range hashes {
+		mismatches, err := auditor.AuditBlock(hash, now)
+		assert.Nil(err)
+		assert.Empty(mismatches)
+	}
+	for i := 0; i < 10; i++ {
+		assert.Nil(auditor.Tick(now))
+	}
+	assert.Empty(alerts)
+
+	// Corrupt blocks raise alerts.
+	_, err = dag.db.Exec("update blocks set nonce = ? where hash = ?", make([]byte, 32), hashes[1][:])
+	assert.Nil(err)
+	_, err = dag.db.Exec("update blocks set acc_work = ? where hash = ?", make([]byte, 32), hashes[2][:])
+	assert.Nil(err)
+	_, err = dag.db.Exec("delete from transactions_blocks where block_hash = ?", hashes[4][:])
+	assert.Nil(err)
+	dag.blockCache.clear()
+
+	mismatches, err := auditor.AuditBlock(hashes[1], now)
+	assert.Nil(err)
+	assert.Contains(mismatches, "hash")
+	mismatches, err = auditor.AuditBlock(hashes[2], now)
+	assert.Nil(err)
+	assert.Equal([]string{"acc_work"}, mismatches)
+	mismatches, err = auditor.AuditBlock(hashes[4], now)
+	assert.Nil(err)
+	assert.Equal([]string{"merkle_root"}, mismatches)
+
+	assert.Equal(3, len(alerts))
+	assert.Equal(hashes[2], alerts[1].Hash)
+	assert.Equal(uint64(2), alerts[1].Height)
+	status := auditor.Status()
+	assert.Equal(uint64(len(hashes)+10+3), status.BlocksAudited)
+	assert.Equal(uint64(3), status.BlocksFailed)
+	assert.Equal(3, len(status.Alerts))
+}
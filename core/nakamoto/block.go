@@ -10,15 +10,25 @@ import (
 	"math/big"
 )
 
+// A block header contains the fields which are hashed to give the block hash. Headers are enough to verify the proof
+// of work of a chain without its transactions, which is how nodes sync headers first, and how light clients follow the
+// chain.
 type BlockHeader struct {
-	ParentHash             [32]byte
-	ParentTotalWork        [32]byte
-	Difficulty             [32]byte
-	Timestamp              uint64
-	NumTransactions        uint64
-	TransactionsMerkleRoot [32]byte
-	Nonce                  [32]byte
-	Graffiti               [32]byte
+	ParentHash             [32]byte `json:"parent_hash"`
+	ParentTotalWork        [32]byte `json:"parent_total_work"`
+	Difficulty             [32]byte `json:"difficulty"`
+	Timestamp              uint64   `json:"timestamp"`
+	NumTransactions        uint64   `json:"num_transactions"`
+	TransactionsMerkleRoot [32]byte `json:"transactions_merkle_root"`
+	Nonce                  [32]byte `json:"nonce"`
+	Graffiti               [32]byte `json:"graffiti"`
+	// The base fee per byte, when the fee market is enabled. See fees.go.
+	BaseFee uint64 `json:"base_fee,omitempty"`
+	// Signals readiness for soft forks. See versionbits.go.
+	Version uint32 `json:"version,omitempty"`
+	// The root of a Merkle mountain range of the hashes of all prior blocks, once the header_history fork is active.
+	// See history.go.
+	HistoryRoot [32]byte `json:"history_root,omitempty"`
 }
 
 type Block struct {
@@ -31,6 +41,9 @@ type Block struct {
 	TransactionsMerkleRoot [32]byte
 	Nonce                  [32]byte
 	Graffiti               [32]byte
+	BaseFee                uint64
+	Version                uint32
+	HistoryRoot            [32]byte
 
 	// Block body.
 	Transactions []RawTransaction
@@ -47,16 +60,12 @@ type Block struct {
 // A raw block is the block as transmitted on the network.
 // It contains the block header and the block body.
 // It does not contain any block metadata such as height, epoch, or difficulty.
+//
+// The header is embedded, so its fields are accessed directly (ie. b.ParentHash), and it is flattened when encoded to
+// JSON.
 type RawBlock struct {
 	// Block header.
-	ParentHash             [32]byte `json:"parent_hash"`
-	ParentTotalWork        [32]byte `json:"parent_total_work"`
-	Difficulty             [32]byte `json:"difficulty"`
-	Timestamp              uint64   `json:"timestamp"`
-	NumTransactions        uint64   `json:"num_transactions"`
-	TransactionsMerkleRoot [32]byte `json:"transactions_merkle_root"`
-	Nonce                  [32]byte `json:"nonce"`
-	Graffiti               [32]byte `json:"graffiti"`
+	BlockHeader
 
 	// Block body.
 	Transactions []RawTransaction `json:"transactions"`
@@ -73,15 +82,8 @@ func (b *Block) HashStr() string {
 // Convert a block to a raw block.
 func (b *Block) ToRawBlock() RawBlock {
 	return RawBlock{
-		ParentHash:             b.ParentHash,
-		ParentTotalWork:        BigIntToBytes32(b.ParentTotalWork),
-		Difficulty:             BigIntToBytes32(b.Work),
-		Timestamp:              b.Timestamp,
-		NumTransactions:        b.NumTransactions,
-		TransactionsMerkleRoot: b.TransactionsMerkleRoot,
-		Nonce:                  b.Nonce,
-		Graffiti:               b.Graffiti,
-		Transactions:           b.Transactions,
+		BlockHeader:  b.ToBlockHeader(),
+		Transactions: b.Transactions,
 	}
 }
 
@@ -90,12 +92,15 @@ func (b *Block) ToBlockHeader() BlockHeader {
 	return BlockHeader{
 		ParentHash:             b.ParentHash,
 		ParentTotalWork:        BigIntToBytes32(b.ParentTotalWork),
-		Difficulty:             BigIntToBytes32(b.Work),
+		Difficulty:             b.Difficulty,
 		Timestamp:              b.Timestamp,
 		NumTransactions:        b.NumTransactions,
 		TransactionsMerkleRoot: b.TransactionsMerkleRoot,
 		Nonce:                  b.Nonce,
 		Graffiti:               b.Graffiti,
+		BaseFee:                b.BaseFee,
+		Version:                b.Version,
+		HistoryRoot:            b.HistoryRoot,
 	}
 }
 
@@ -108,44 +113,11 @@ func (b *RawBlock) SetNonce(i big.Int) {
 
 func (b *RawBlock) Bytes() []byte {
 	// Encode canonically.
-	buf := new(bytes.Buffer)
-
-	err := binary.Write(buf, binary.BigEndian, b.ParentHash)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.ParentTotalWork)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.Difficulty)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.Timestamp)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.NumTransactions)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.TransactionsMerkleRoot)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.Nonce)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.Graffiti)
-	if err != nil {
-		panic(err)
-	}
+	buf := bytes.NewBuffer(b.BlockHeader.Bytes())
 
 	// Encode transactions.
 	for _, tx := range b.Transactions {
-		err = binary.Write(buf, binary.BigEndian, tx.Bytes())
+		err := binary.Write(buf, binary.BigEndian, tx.Bytes())
 		if err != nil {
 			panic(err)
 		}
@@ -154,45 +126,15 @@ func (b *RawBlock) Bytes() []byte {
 	return buf.Bytes()
 }
 
-// Returns the envelope used for block hashing, which merklizes the transactions list into a merkle root.
+// Returns the envelope used for block hashing, which is the header. The header commits to the transactions through the
+// merkle root.
 func (b *RawBlock) Envelope() []byte {
-	// Encode canonically.
-	buf := new(bytes.Buffer)
-
-	err := binary.Write(buf, binary.BigEndian, b.ParentHash)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.ParentTotalWork)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.Difficulty)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.Timestamp)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.NumTransactions)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.TransactionsMerkleRoot)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.Nonce)
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(buf, binary.BigEndian, b.Graffiti)
-	if err != nil {
-		panic(err)
-	}
+	return b.BlockHeader.Bytes()
+}
 
-	return buf.Bytes()
+// Returns the header of the block.
+func (b *RawBlock) Header() BlockHeader {
+	return b.BlockHeader
 }
 
 func (b *RawBlock) Hash() [32]byte {
@@ -204,14 +146,55 @@ func (b *RawBlock) HashStr() string {
 	return hex.EncodeToString(sl[:])
 }
 
+// Returns the size of the block's canonical encoding, without encoding it. This is the size limited by the consensus
+// MaxBlockSizeBytes, and which miners fill up to.
 func (b *RawBlock) SizeBytes() uint64 {
-	// Calculate the size of the block.
-	return uint64(len(b.Bytes()))
+	size := b.BlockHeader.SizeBytes()
+	for i := range b.Transactions {
+		size += b.Transactions[i].EncodedSizeBytes()
+	}
+	return size
 }
 
 // BlockHeader.
 // =====================================================================================================================
 
+// Encodes the header fields added after launch: the base fee (fees.go), version (versionbits.go) and history root
+// (history.go). They are only encoded when set, so the blocks of chains which don't use them keep their hashes. The base
+// fee and version are encoded together, followed by the history root when it's set, so that no two headers have the
+// same encoding.
+func writeHeaderExtensions(buf *bytes.Buffer, baseFee uint64, version uint32, historyRoot [32]byte) {
+	if baseFee == 0 && version == 0 && historyRoot == [32]byte{} {
+		return
+	}
+	err := binary.Write(buf, binary.BigEndian, baseFee)
+	if err != nil {
+		panic(err)
+	}
+	err = binary.Write(buf, binary.BigEndian, version)
+	if err != nil {
+		panic(err)
+	}
+	if historyRoot == [32]byte{} {
+		return
+	}
+	err = binary.Write(buf, binary.BigEndian, historyRoot)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Returns the size of the header's canonical encoding, which depends on the extensions set. See writeHeaderExtensions.
+func (b *BlockHeader) SizeBytes() uint64 {
+	switch {
+	case b.HistoryRoot != [32]byte{}:
+		return BLOCK_HEADER_BASE_SIZE + BLOCK_HEADER_HISTORY_EXTENSION_SIZE
+	case b.BaseFee != 0 || b.Version != 0:
+		return BLOCK_HEADER_BASE_SIZE + BLOCK_HEADER_EXTENSION_SIZE
+	}
+	return BLOCK_HEADER_BASE_SIZE
+}
+
 func (b *BlockHeader) Bytes() []byte {
 	// Encode canonically.
 	buf := new(bytes.Buffer)
@@ -248,6 +231,7 @@ func (b *BlockHeader) Bytes() []byte {
 	if err != nil {
 		panic(err)
 	}
+	writeHeaderExtensions(buf, b.BaseFee, b.Version, b.HistoryRoot)
 
 	return buf.Bytes()
 }
@@ -0,0 +1,150 @@
+package nakamoto
+
+import (
+	"math/big"
+	"sync"
+)
+
+// The block cache keeps the links between recent blocks and their parents, and the epochs they belong to, so header
+// ingestion doesn't query the database for the parent's epoch, and walks back through recent ancestors (ie. for version
+// bits, or the node's state rebuild) don't run a recursive query each time.
+//
+// A block's parent and epoch never change once it's stored, so entries are only added as blocks are ingested or looked
+// up. The cache is still cleared on reorgs, so a bug in it can't outlive the branch it was found on. It's bounded, and
+// evicts the oldest blocks first.
+
+const (
+	// The default maximum number of blocks in the cache.
+	DEFAULT_BLOCK_CACHE_SIZE = 10_000
+)
+
+type blockCache struct {
+	// The parent link of each block.
+	links map[[32]byte]chainSegmentBlock
+	// The epoch ID of each block.
+	epochIds map[[32]byte]string
+	// The epochs, by ID.
+	epochs map[string]Epoch
+	// The block hashes in insertion order, for eviction.
+	order   [][32]byte
+	maxSize int
+
+	hits   uint64
+	misses uint64
+
+	mutex sync.Mutex
+}
+
+func newBlockCache(maxSize int) *blockCache {
+	return &blockCache{
+		links:    make(map[[32]byte]chainSegmentBlock),
+		epochIds: make(map[[32]byte]string),
+		epochs:   make(map[string]Epoch),
+		order:    [][32]byte{},
+		maxSize:  maxSize,
+	}
+}
+
+// Caches a block's parent link and epoch.
+func (c *blockCache) putBlock(block chainSegmentBlock, epochId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.maxSize <= 0 {
+		return
+	}
+	if _, ok := c.links[block.hash]; !ok {
+		if c.maxSize <= len(c.order) {
+			delete(c.links, c.order[0])
+			delete(c.epochIds, c.order[0])
+			c.order = c.order[1:]
+		}
+		c.order = append(c.order, block.hash)
+	}
+	c.links[block.hash] = block
+	if epochId != "" {
+		c.epochIds[block.hash] = epochId
+	}
+}
+
+// Caches an epoch. Epochs are few, and are only evicted when the cache is cleared.
+func (c *blockCache) putEpoch(blockhash [32]byte, epoch Epoch) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.maxSize <= 0 {
+		return
+	}
+	if _, ok := c.links[blockhash]; ok {
+		c.epochIds[blockhash] = epoch.Id
+	}
+	c.epochs[epoch.Id] = copyEpoch(epoch)
+}
+
+// Gets the epoch of a block.
+func (c *blockCache) getEpoch(blockhash [32]byte) (*Epoch, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	epoch, ok := c.epochs[c.epochIds[blockhash]]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	epoch = copyEpoch(epoch)
+	return &epoch, true
+}
+
+// Gets the chain of `n` blocks ending at the given block, newest first, if they're all cached.
+func (c *blockCache) getChainSegment(hash [32]byte, n uint64) ([]chainSegmentBlock, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	segment := make([]chainSegmentBlock, 0, n)
+	for uint64(len(segment)) < n {
+		block, ok := c.links[hash]
+		if !ok {
+			c.misses++
+			return nil, false
+		}
+		segment = append(segment, block)
+		if block.height == 0 {
+			break
+		}
+		hash = block.parentHash
+	}
+	c.hits++
+	return segment, true
+}
+
+// Clears the cache.
+func (c *blockCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.links = make(map[[32]byte]chainSegmentBlock)
+	c.epochIds = make(map[[32]byte]string)
+	c.epochs = make(map[string]Epoch)
+	c.order = [][32]byte{}
+}
+
+// Returns the number of cache hits and misses.
+func (c *blockCache) stats() (hits uint64, misses uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hits, c.misses
+}
+
+// Copies an epoch, so the difficulty isn't shared with the cache.
+func copyEpoch(epoch Epoch) Epoch {
+	difficulty := new(big.Int).Set(&epoch.Difficulty)
+	epoch.Difficulty = *difficulty
+	return epoch
+}
+
+// Clears the block cache if the new tip doesn't descend from the previous one.
+func (dag *BlockDAG) invalidateBlockCacheOnReorg(tip Block, prevTip Block) {
+	if tip.ParentHash == prevTip.Hash || prevTip.Hash == [32]byte{} {
+		return
+	}
+	extends, err := dag.descendsFrom(tip, prevTip)
+	if err != nil || !extends {
+		dag.blockCache.clear()
+	}
+}
@@ -0,0 +1,90 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockCache(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _, _ := newBlockdag()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes := [][32]byte{}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+	miner.Start(12)
+
+	// Ingested blocks are cached, so their epochs are looked up without the database.
+	hits, _ := dag.blockCache.stats()
+	cached := []Epoch{}
+	for _, hash := range hashes {
+		epoch, err := dag.GetEpochForBlockHash(hash)
+		assert.Nil(err)
+		cached = append(cached, *epoch)
+	}
+	cachedHashes, err := dag.GetLongestChainHashList(dag.FullTip.Hash, 8)
+	assert.Nil(err)
+	hits2, _ := dag.blockCache.stats()
+	assert.Equal(hits+uint64(len(hashes))+1, hits2)
+
+	// And match the database.
+	dag.blockCache.clear()
+	for i, hash := range hashes {
+		epoch, err := dag.GetEpochForBlockHash(hash)
+		assert.Nil(err)
+		assert.Equal(epoch.Id, cached[i].Id)
+		assert.Equal(epoch.StartHeight, cached[i].StartHeight)
+		assert.Equal(0, epoch.Difficulty.Cmp(&cached[i].Difficulty))
+	}
+	dbHashes, err := dag.GetLongestChainHashList(dag.FullTip.Hash, 8)
+	assert.Nil(err)
+	assert.Equal(dbHashes, cachedHashes)
+	assert.Equal(hashes[len(hashes)-8:], cachedHashes)
+	segment, ok := dag.blockCache.getChainSegment(dag.FullTip.Hash, 8)
+	assert.True(ok)
+	assert.Equal(uint64(12), segment[0].height)
+
+	// Cached epochs are copies.
+	epoch, _ := dag.GetEpochForBlockHash(hashes[0])
+	epoch.Difficulty.SetInt64(1)
+	epoch2, _ := dag.GetEpochForBlockHash(hashes[0])
+	assert.NotEqual(0, epoch.Difficulty.Cmp(&epoch2.Difficulty))
+
+	// Extending the tip keeps the cache, and a reorg clears it.
+	miner.Start(1)
+	assert.NotEqual(0, len(dag.blockCache.links))
+	assert.Nil(dag.InvalidateBlock(hashes[len(hashes)-1]))
+	assert.Equal(0, len(dag.blockCache.links))
+	assert.Equal(0, len(dag.blockCache.epochs))
+}
+
+func TestBlockCacheEviction(t *testing.T) {
+	assert := assert.New(t)
+	c := newBlockCache(2)
+
+	c.putBlock(chainSegmentBlock{hash: [32]byte{1}, height: 0}, "a")
+	c.putBlock(chainSegmentBlock{hash: [32]byte{2}, parentHash: [32]byte{1}, height: 1}, "a")
+	c.putEpoch([32]byte{2}, Epoch{Id: "a"})
+	segment, ok := c.getChainSegment([32]byte{2}, 5)
+	assert.True(ok)
+	assert.Equal(2, len(segment))
+
+	c.putBlock(chainSegmentBlock{hash: [32]byte{3}, parentHash: [32]byte{2}, height: 2}, "a")
+	_, ok = c.getChainSegment([32]byte{3}, 3)
+	assert.False(ok)
+	_, ok = c.getEpoch([32]byte{1})
+	assert.False(ok)
+	_, ok = c.getEpoch([32]byte{3})
+	assert.True(ok)
+}
@@ -3,6 +3,7 @@ package nakamoto
 import (
 	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
@@ -21,6 +22,13 @@ func OpenDB(dbPath string) (*sql.DB, error) {
 
 	tx, err := db.Begin()
 
+	// Let freed pages be reclaimed by incremental vacuums. This only takes effect for new databases, existing ones
+	// must be compacted first. See db_maintenance.go.
+	_, err = tx.Exec("pragma auto_vacuum = incremental")
+	if err != nil {
+		return nil, fmt.Errorf("error setting auto vacuum: %s", err)
+	}
+
 	// Check to perform migrations.
 	_, err = tx.Exec("create table if not exists tinychain_version (version int)")
 	if err != nil {
@@ -126,6 +134,451 @@ func OpenDB(dbPath string) (*sql.DB, error) {
 		}
 
 		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	// Migration: v1.
+	if databaseVersion == 1 {
+		dbVersion := 2
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// Blocks which have been manually invalidated (invalidateblock), along with their descendants.
+		_, err = tx.Exec("alter table blocks add column invalid integer not null default 0")
+		if err != nil {
+			return nil, fmt.Errorf("error adding 'invalid' column to 'blocks' table: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	// Migration: v2.
+	if databaseVersion == 2 {
+		dbVersion := 3
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// The base fee of each block, when the fee market is enabled.
+		_, err = tx.Exec("alter table blocks add column base_fee integer not null default 0")
+		if err != nil {
+			return nil, fmt.Errorf("error adding 'base_fee' column to 'blocks' table: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	// Migration: v3.
+	if databaseVersion == 3 {
+		dbVersion := 4
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// The version of each block, used for soft fork signalling.
+		_, err = tx.Exec("alter table blocks add column version integer not null default 0")
+		if err != nil {
+			return nil, fmt.Errorf("error adding 'version' column to 'blocks' table: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	// Migration: v4.
+	if databaseVersion == 4 {
+		dbVersion := 5
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// The predicate and witness of version 2 transactions.
+		_, err = tx.Exec("alter table transactions add column predicate blob")
+		if err != nil {
+			return nil, fmt.Errorf("error adding 'predicate' column to 'transactions' table: %s", err)
+		}
+		_, err = tx.Exec("alter table transactions add column witness blob")
+		if err != nil {
+			return nil, fmt.Errorf("error adding 'witness' column to 'transactions' table: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	// Migration: v5.
+	if databaseVersion == 5 {
+		dbVersion := 6
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// The token operation of version 3 transactions.
+		_, err = tx.Exec("alter table transactions add column token_op integer not null default 0")
+		if err != nil {
+			return nil, fmt.Errorf("error adding 'token_op' column to 'transactions' table: %s", err)
+		}
+		_, err = tx.Exec("alter table transactions add column token text not null default ''")
+		if err != nil {
+			return nil, fmt.Errorf("error adding 'token' column to 'transactions' table: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	// Migration: v6.
+	if databaseVersion == 6 {
+		dbVersion := 7
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// The inputs of version 4 transactions.
+		_, err = tx.Exec("alter table transactions add column inputs blob")
+		if err != nil {
+			return nil, fmt.Errorf("error adding 'inputs' column to 'transactions' table: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	// Migration: v7.
+	if databaseVersion == 7 {
+		dbVersion := 8
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// The receipts of executed transactions. See receipts.go.
+		_, err = tx.Exec(`create table receipts (
+			block_hash blob,
+			txindex integer,
+			tx_hash blob,
+			status integer,
+			error text,
+			fee_paid integer,
+			deltas text,
+
+			primary key (block_hash, txindex)
+		)`)
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'receipts' table: %s", err)
+		}
+		_, err = tx.Exec("create index receipts_tx_hash on receipts (tx_hash)")
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'receipts_tx_hash' index: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	if databaseVersion == 8 {
+		dbVersion := 9
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// Look up an account's transactions, for its next nonce. See GetAccountNonce.
+		_, err = tx.Exec("create index transactions_from_pubkey on transactions (from_pubkey)")
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'transactions_from_pubkey' index: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	if databaseVersion == 9 {
+		dbVersion := 10
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// The history root of each block header, and the peaks of the Merkle mountain range including the block, which
+		// its children's history roots are computed from. See history.go.
+		_, err = tx.Exec("alter table blocks add column history_root blob")
+		if err != nil {
+			return nil, fmt.Errorf("error adding 'history_root' column to 'blocks' table: %s", err)
+		}
+		_, err = tx.Exec("alter table blocks add column history_peaks blob")
+		if err != nil {
+			return nil, fmt.Errorf("error adding 'history_peaks' column to 'blocks' table: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	if databaseVersion == 10 {
+		dbVersion := 11
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// The compact filters of blocks, built when first requested. See blockfilter.go.
+		_, err = tx.Exec(`create table block_filters (
+			block_hash blob primary key,
+			filter blob
+		)`)
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'block_filters' table: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	if databaseVersion == 11 {
+		dbVersion := 12
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// An index of the blocks each transaction is included in, for looking up transactions by hash. See
+		// GetTransactionByHash.
+		_, err = tx.Exec(`create table tx_index (
+			tx_hash blob,
+			block_hash blob,
+			height integer,
+			txindex integer,
+
+			primary key (tx_hash, block_hash, txindex)
+		)`)
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'tx_index' table: %s", err)
+		}
+		_, err = tx.Exec(`insert into tx_index (tx_hash, block_hash, height, txindex)
+			select tb.transaction_hash, tb.block_hash, b.height, tb.txindex from transactions_blocks tb join blocks b on tb.block_hash = b.hash`)
+		if err != nil {
+			return nil, fmt.Errorf("error populating 'tx_index' table: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	if databaseVersion == 12 {
+		dbVersion := 13
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// The next nonce and last activity of each account on the main chain, and the tip they reflect. See
+		// account_index.go.
+		_, err = tx.Exec(`create table account_activity (
+			account blob primary key,
+			next_nonce integer,
+			last_height integer
+		)`)
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'account_activity' table: %s", err)
+		}
+		_, err = tx.Exec("create table account_activity_tip (hash blob)")
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'account_activity_tip' table: %s", err)
+		}
+		_, err = tx.Exec("create index transactions_to_pubkey on transactions (to_pubkey)")
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'transactions_to_pubkey' index: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	if databaseVersion == 13 {
+		dbVersion := 14
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// The finalized block. See finality.go.
+		_, err = tx.Exec("create table finalized_block (hash blob)")
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'finalized_block' table: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	if databaseVersion == 14 {
+		dbVersion := 15
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// Whether each transaction index entry is on the main chain. See account_index.go.
+		_, err = tx.Exec("alter table tx_index add column canonical integer not null default 0")
+		if err != nil {
+			return nil, fmt.Errorf("error adding 'canonical' column to 'tx_index' table: %s", err)
+		}
+		_, err = tx.Exec("create index tx_index_block_hash on tx_index (block_hash)")
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'tx_index_block_hash' index: %s", err)
+		}
+		// Rebuild the account index, which marks the entries of the main chain.
+		_, err = tx.Exec("delete from account_activity_tip")
+		if err != nil {
+			return nil, fmt.Errorf("error resetting 'account_activity_tip' table: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	if databaseVersion == 15 {
+		dbVersion := 16
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// Branches held back by the maximum reorg depth. See reorglimit.go.
+		_, err = tx.Exec(`create table quarantined_branches (
+			hash blob primary key,
+			fork_point_hash blob,
+			tip_hash blob,
+			depth integer,
+			first_seen integer,
+			released integer not null default 0
+		)`)
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'quarantined_branches' table: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	if databaseVersion == 16 {
+		dbVersion := 17
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// The previous epoch on each epoch's branch. See epochs.go.
+		_, err = tx.Exec("alter table epochs add column parent_epoch TEXT")
+		if err != nil {
+			return nil, fmt.Errorf("error adding 'parent_epoch' column to 'epochs' table: %s", err)
+		}
+		_, err = tx.Exec(`update epochs set parent_epoch = (
+			select p.epoch from blocks b join blocks p on p.hash = b.parent_hash where b.hash = epochs.start_block_hash
+		)`)
+		if err != nil {
+			return nil, fmt.Errorf("error backfilling 'parent_epoch' column: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	if databaseVersion == 17 {
+		dbVersion := 18
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// The journal of chain events. See event_journal.go.
+		_, err = tx.Exec(`create table events (
+			seq integer primary key autoincrement,
+			type text not null,
+			block_hash blob,
+			height integer,
+			tx_hash blob,
+			data blob,
+			time integer
+		)`)
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'events' table: %s", err)
+		}
+		_, err = tx.Exec("create index events_tx_hash on events (tx_hash)")
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'events_tx_hash' index: %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
+	}
+
+	if databaseVersion == 18 {
+		dbVersion := 19
+		logger.Printf("Running migration: %d\n", dbVersion)
+
+		// Looking up main chain blocks by height, for ancestry proofs. See history.go.
+		_, err = tx.Exec("create index tx_index_height on tx_index (height, canonical)")
+		if err != nil {
+			return nil, fmt.Errorf("error creating 'tx_index_height' index: %s", err)
+		}
+
+		// Peaks are stored on ingestion from now on.
+		if err := backfillHistoryPeaks(tx); err != nil {
+			return nil, fmt.Errorf("error backfilling 'history_peaks': %s", err)
+		}
+
+		_, err = tx.Exec("update tinychain_version set version = ?", dbVersion)
+		if err != nil {
+			return nil, fmt.Errorf("error updating database version: %s", err)
+		}
+
+		logger.Printf("Database upgraded to: %d\n", dbVersion)
+		databaseVersion = dbVersion
 	}
 
 	err = tx.Commit()
@@ -150,6 +603,11 @@ type BlockDAG struct {
 	// The state machine.
 	stateMachine StateMachineInterface
 
+	// Checks a block's transactions execute on the state after its parent, ie. that no sender overspends. Called once
+	// the block's proof-of-work and stateless checks pass. If nil, blocks are only checked statelessly. The node
+	// registers this, as it keeps the states (see state_at.go).
+	VerifyBlockState func(block Block) error
+
 	// Consensus settings.
 	consensus ConsensusConfig
 
@@ -163,15 +621,52 @@ type BlockDAG struct {
 	OnNewHeadersTip func(tip Block, prevTip Block)
 	OnNewFullTip    func(tip Block, prevTip Block)
 
+	// The number of blocks below the full tip at which blocks are finalized. Zero disables finalization. See
+	// finality.go.
+	FinalityDepth uint64
+	// Allow reorgs away from the finalized block.
+	AllowDeepReorgs bool
+	// Called with each newly finalized block, in order.
+	OnFinalized func(block Block)
+
+	// Called with each event appended to the event journal, in order. See event_journal.go.
+	OnEvent func(event ChainEvent)
+
+	// The deepest reorg accepted without review. Deeper reorgs are quarantined. Zero disables the limit. See
+	// reorglimit.go.
+	MaxReorgDepth uint64
+	// Called when a branch is quarantined.
+	OnReorgQuarantined func(branch QuarantinedBranch)
+
+	// The clock blocks' timestamps are validated against. Nil is DefaultClock. See clock_source.go.
+	Clock Clock
+
+	// Cached deployment states. See versionbits.go.
+	deploymentStates *deploymentStateCache
+
+	// Verified transaction signatures, shared with the mempool. See sigcache.go.
+	SigCache *SignatureCache
+
+	// The parents and epochs of recent blocks. See blockcache.go.
+	blockCache *blockCache
+
 	log *log.Logger
 }
 
 func NewBlockDAGFromDB(db *sql.DB, stateMachine StateMachineInterface, consensus ConsensusConfig) (BlockDAG, error) {
 	dag := BlockDAG{
-		db:           db,
-		stateMachine: stateMachine,
-		consensus:    consensus,
-		log:          NewLogger("blockdag", ""),
+		db:               db,
+		stateMachine:     stateMachine,
+		consensus:        consensus,
+		deploymentStates: newDeploymentStateCache(),
+		SigCache:         NewSignatureCache(DEFAULT_SIGNATURE_CACHE_SIZE),
+		blockCache:       newBlockCache(DEFAULT_BLOCK_CACHE_SIZE),
+		FinalityDepth:    DEFAULT_FINALITY_DEPTH,
+		log:              NewLogger("blockdag", ""),
+	}
+
+	for _, name := range dag.UnsupportedForks() {
+		dag.log.Printf("WARNING: fork %s activates at height %d, but isn't supported by this node. Upgrade your node.\n", name, consensus.Forks[name])
 	}
 
 	err := dag.initialiseBlockDAG()
@@ -240,7 +735,7 @@ func (dag *BlockDAG) initialiseBlockDAG() error {
 
 	// Insert the genesis block.
 	_, err = tx.Exec(
-		"insert into blocks (hash, parent_hash, parent_total_work, difficulty, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		"insert into blocks (hash, parent_hash, parent_total_work, difficulty, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work, base_fee, history_peaks) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		genesisBlockHash[:],
 		genesisBlock.ParentHash[:],
 		genesisBlock.ParentTotalWork[:],
@@ -254,6 +749,8 @@ func (dag *BlockDAG) initialiseBlockDAG() error {
 		epoch0.GetId(),
 		genesisBlock.SizeBytes(),
 		PadBytes(accWorkBuf[:], 32),
+		genesisBlock.BaseFee,
+		encodeHistoryPeaks([][32]byte{historyLeaf(genesisBlockHash)}),
 	)
 	if err != nil {
 		return err
@@ -277,6 +774,7 @@ func (dag *BlockDAG) updateHeadersTip() error {
 
 	if prev_tip.Hash != curr_tip.Hash {
 		dag.log.Printf("New headers tip: height=%d hash=%s\n", curr_tip.Height, curr_tip.HashStr())
+		dag.invalidateBlockCacheOnReorg(curr_tip, prev_tip)
 		dag.HeadersTip = curr_tip
 		if dag.OnNewHeadersTip == nil {
 			return nil
@@ -296,11 +794,17 @@ func (dag *BlockDAG) updateFullTip() error {
 
 	if prev_tip.Hash != curr_tip.Hash {
 		dag.log.Printf("New full tip: height=%d hash=%s\n", curr_tip.Height, curr_tip.HashStr())
+		dag.invalidateBlockCacheOnReorg(curr_tip, prev_tip)
 		dag.FullTip = curr_tip
-		if dag.OnNewFullTip == nil {
-			return nil
+		if err := dag.updateAccountIndex(); err != nil {
+			dag.log.Printf("Failed to update account index: %s\n", err)
+		}
+		if err := dag.updateFinalizedBlock(); err != nil {
+			dag.log.Printf("Failed to update finalized block: %s\n", err)
+		}
+		if err := dag.updateEventJournal(prev_tip); err != nil {
+			dag.log.Printf("Failed to update event journal: %s\n", err)
 		}
-		dag.OnNewFullTip(curr_tip, prev_tip)
 		if dag.OnNewFullTip != nil {
 			dag.OnNewFullTip(curr_tip, prev_tip)
 		}
@@ -330,60 +834,44 @@ func (dag *BlockDAG) IngestHeader(raw BlockHeader) error {
 	if err != nil {
 		return err
 	}
-	if parentBlock == nil {
-		return fmt.Errorf("Unknown parent block.")
+	if parentBlock == nil {
+		return fmt.Errorf("Unknown parent block.")
+	}
+
+	// 2. Verify base fee.
+	if raw.BaseFee != dag.GetNextBaseFee(*parentBlock) {
+		return fmt.Errorf("Base fee is incorrect.")
+	}
+
+	// 2a. Verify fork rules.
+	if err := dag.verifyForkRules(parentBlock.Height+1, raw.Version); err != nil {
+		return err
+	}
+
+	// 2b. Verify history root.
+	if err := dag.verifyHistoryRoot(*parentBlock, raw.HistoryRoot); err != nil {
+		return err
+	}
+
+	// 2c. Verify timestamp isn't too far in the future.
+	if err := dag.verifyTimestamp(raw.Timestamp); err != nil {
+		return err
 	}
 
 	// 6. Verify POW solution is valid.
 	height := uint64(parentBlock.Height + 1)
-	var epoch *Epoch
-
-	// 6a. Compute the current difficulty epoch.
-	//
-
-	// Are we on an epoch boundary?
-	if height%dag.consensus.EpochLengthBlocks == 0 {
-		// Recompute difficulty and create new epoch.
-		dag.log.Printf("Recomputing difficulty for epoch %d\n", height/dag.consensus.EpochLengthBlocks)
 
-		// Get current epoch.
-		epoch, err = dag.GetEpochForBlockHash(raw.ParentHash)
-		if err != nil {
-			return err
-		}
-		newDifficulty := RecomputeDifficulty(epoch.StartTime, raw.Timestamp, epoch.Difficulty, dag.consensus.TargetEpochLengthMillis, dag.consensus.EpochLengthBlocks, height)
-
-		epoch = &Epoch{
-			Number:         height / dag.consensus.EpochLengthBlocks,
-			StartBlockHash: raw.BlockHash(),
-			StartTime:      raw.Timestamp,
-			StartHeight:    height,
-			Difficulty:     newDifficulty,
-		}
-		_, err := dag.db.Exec(
-			"insert into epochs (id, start_block_hash, start_time, start_height, difficulty) values (?, ?, ?, ?, ?)",
-			epoch.GetId(),
-			epoch.StartBlockHash[:],
-			epoch.StartTime,
-			epoch.StartHeight,
-			newDifficulty.Bytes(),
-		)
-		if err != nil {
-			return err
-		}
-	} else {
-		// Lookup current epoch.
-		epoch, err = dag.GetEpochForBlockHash(raw.ParentHash)
-		if epoch == nil {
-			return fmt.Errorf("Parent block epoch not found.")
-		}
-		if err != nil {
-			return err
-		}
+	// 6a. Resolve the difficulty epoch on the parent's branch. See epochs.go.
+	blockHash := raw.BlockHash()
+	epoch, newEpoch, err := dag.resolveEpoch(*parentBlock, blockHash, raw.Timestamp)
+	if err != nil {
+		return err
 	}
 
 	// 6b. Verify POW solution.
-	blockHash := raw.BlockHash()
+	if err := verifyClaimedDifficulty(raw.Difficulty, *epoch); err != nil {
+		return err
+	}
 	if !VerifyPOW(blockHash, epoch.Difficulty) {
 		return fmt.Errorf("POW solution is invalid.")
 	}
@@ -395,6 +883,12 @@ func (dag *BlockDAG) IngestHeader(raw BlockHeader) error {
 		return fmt.Errorf("Parent total work is incorrect.")
 	}
 
+	// 7. Compute the history peaks to store with the block. See history.go.
+	historyPeaks, err := dag.getChildHistoryPeaks(*parentBlock, blockHash)
+	if err != nil {
+		return err
+	}
+
 	// 8. Ingest block into database store.
 	tx, err := dag.db.Begin()
 	if err != nil {
@@ -406,21 +900,34 @@ func (dag *BlockDAG) IngestHeader(raw BlockHeader) error {
 	acc_work.Add(&parentBlock.AccumulatedWork, work)
 	acc_work_buf := BigIntToBytes32(*acc_work)
 
+	if newEpoch {
+		if err := insertEpoch(tx, *epoch); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
 	// Insert block.
 	_, err = tx.Exec(
-		"insert into blocks (hash, parent_hash, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		"insert into blocks (hash, parent_hash, parent_total_work, difficulty, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, base_fee, version, history_root, height, epoch, size_bytes, acc_work, history_peaks, invalid) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, coalesce((select invalid from blocks where hash = ?), 0))",
 		blockHash[:],
 		raw.ParentHash[:],
 		raw.ParentTotalWork[:],
+		new(big.Int).SetBytes(raw.Difficulty[:]).Bytes(),
 		raw.Timestamp,
 		raw.NumTransactions,
 		raw.TransactionsMerkleRoot[:],
 		raw.Nonce[:],
 		raw.Graffiti[:],
+		raw.BaseFee,
+		raw.Version,
+		raw.HistoryRoot[:],
 		height,
 		epoch.GetId(),
 		0, // Block size is 0 until we get transactions.
 		acc_work_buf[:],
+		historyPeaks,
+		raw.ParentHash[:], // Descendants of invalid blocks are invalid.
 	)
 	if err != nil {
 		tx.Rollback()
@@ -428,6 +935,7 @@ func (dag *BlockDAG) IngestHeader(raw BlockHeader) error {
 	}
 
 	tx.Commit()
+	dag.blockCache.putBlock(chainSegmentBlock{hash: blockHash, parentHash: raw.ParentHash, height: height, version: raw.Version}, epoch.GetId())
 
 	// Update the headers tip.
 	err = dag.updateTip()
@@ -450,8 +958,7 @@ func (dag *BlockDAG) IngestBlockBody(blockhash [32]byte, body []RawTransaction)
 	}
 	raw := block.ToRawBlock()
 
-	// 2. Verify timestamp is within bounds.
-	// TODO: subjectivity.
+	// 2. The timestamp was verified when the header was ingested.
 
 	// 3. Verify num transactions is the same as the length of the transactions list.
 	if int(raw.NumTransactions) != len(raw.Transactions) {
@@ -463,13 +970,18 @@ func (dag *BlockDAG) IngestBlockBody(blockhash [32]byte, body []RawTransaction)
 	// This is one of the most expensive operations of the blockchain node.
 	for i, block_tx := range raw.Transactions {
 		dag.log.Printf("Verifying transaction %d\n", i)
-		isValid := core.VerifySignature(
-			hex.EncodeToString(block_tx.FromPubkey[:]),
-			block_tx.Sig[:],
-			block_tx.Envelope(),
-		)
-		if !isValid {
-			return fmt.Errorf("Transaction %d is invalid: signature invalid.", i)
+		if !dag.IsTransactionVersionActive(block_tx.Version, block.Height) {
+			return fmt.Errorf("Transaction %d is invalid: version %d is not active.", i, block_tx.Version)
+		}
+
+		// Coins locked by a predicate are unlocked by its witness, rather than a signature.
+		if err := VerifyPredicate(block_tx, block.Height); err != nil {
+			return fmt.Errorf("Transaction %d is invalid: %s.", i, err)
+		}
+		if !IsPredicateAddress(block_tx.FromPubkey) {
+			if !dag.SigCache.VerifyTransactionSignature(block_tx) {
+				return fmt.Errorf("Transaction %d is invalid: signature invalid.", i)
+			}
 		}
 
 		// This depends on where exactly we are verifying the sig.
@@ -478,6 +990,11 @@ func (dag *BlockDAG) IngestBlockBody(blockhash [32]byte, body []RawTransaction)
 		if err != nil {
 			return fmt.Errorf("Transaction %d is invalid.", i)
 		}
+
+		// The coinbase aside, transactions must pay the base fee.
+		if 0 < i && block_tx.Fee < raw.BaseFee*block_tx.SizeBytes() {
+			return fmt.Errorf("Transaction %d is invalid: fee below base fee.", i)
+		}
 	}
 
 	// 5. Verify transaction merkle root is valid.
@@ -490,10 +1007,16 @@ func (dag *BlockDAG) IngestBlockBody(blockhash [32]byte, body []RawTransaction)
 		return fmt.Errorf("Merkle root does not match computed merkle root.")
 	}
 
-	// 7. Verify block size is within bounds.
+	// 7. Verify block size and weight are within bounds.
 	raw.Transactions = body
-	if dag.consensus.MaxBlockSizeBytes < raw.SizeBytes() {
-		return fmt.Errorf("Block size exceeds maximum block size.")
+	if err := dag.verifyBlockSpace(raw); err != nil {
+		return err
+	}
+
+	// 7a. Verify the transactions execute on the parent's state.
+	block.Transactions = body
+	if err := dag.verifyBlockState(*block); err != nil {
+		return err
 	}
 
 	// 8. Ingest block into database store.
@@ -518,6 +1041,17 @@ func (dag *BlockDAG) IngestBlockBody(blockhash [32]byte, body []RawTransaction)
 			tx.Rollback()
 			return err
 		}
+		_, err = tx.Exec(
+			`insert or ignore into tx_index (tx_hash, block_hash, height, txindex) values (?, ?, ?, ?)`,
+			txhash[:],
+			blockhash[:],
+			block.Height,
+			i,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 
 		// Check if we already have the transaction.
 		rows, err := tx.Query("select count(*) from transactions where hash = ?", txhash[:])
@@ -537,7 +1071,7 @@ func (dag *BlockDAG) IngestBlockBody(blockhash [32]byte, body []RawTransaction)
 
 		// Insert the transaction.
 		_, err = tx.Exec(
-			"insert into transactions (hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version) values (?, ?, ?, ?, ?, ?, ?, ?)",
+			"insert into transactions (hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version, predicate, witness, token_op, token, inputs) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 			txhash[:],
 			block_tx.Sig[:],
 			block_tx.FromPubkey[:],
@@ -546,6 +1080,11 @@ func (dag *BlockDAG) IngestBlockBody(blockhash [32]byte, body []RawTransaction)
 			block_tx.Fee,
 			block_tx.Nonce,
 			block_tx.Version,
+			block_tx.Predicate,
+			block_tx.Witness,
+			block_tx.TokenOp,
+			block_tx.Token,
+			EncodeOutpoints(block_tx.Inputs),
 		)
 		if err != nil {
 			tx.Rollback()
@@ -564,120 +1103,62 @@ func (dag *BlockDAG) IngestBlockBody(blockhash [32]byte, body []RawTransaction)
 }
 
 // Ingests a full block, and recomputes the full tip.
-func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
-	// 1. Verify parent is known.
+var ErrBlockPOWInvalid = errors.New("block POW solution is invalid")
+
+// Checks a block's POW solution against the difficulty expected of it, without verifying the rest of the block.
+// This is cheap compared to full processing (signatures, state, database writes), and is done first for blocks
+// received from peers. Blocks with an unknown parent cannot be checked, and pass.
+func (dag *BlockDAG) PrecheckBlockPOW(raw RawBlock) error {
 	parentBlock, err := dag.GetBlockByHash(raw.ParentHash)
 	if err != nil {
 		return err
 	}
 	if parentBlock == nil {
-		return fmt.Errorf("Unknown parent block.")
-	}
-
-	// 2. Verify timestamp is within bounds.
-	// TODO: subjectivity.
-
-	// 3. Verify num transactions is the same as the length of the transactions list.
-	if int(raw.NumTransactions) != len(raw.Transactions) {
-		return fmt.Errorf("Num transactions does not match length of transactions list.")
+		return nil
 	}
 
-	// 4. Verify transactions are valid.
-	// TODO: We can parallelise this.
-	// This is one of the most expensive operations of the blockchain node.
-	for i, block_tx := range raw.Transactions {
-		dag.log.Printf("Verifying transaction %d\n", i)
-		isValid := core.VerifySignature(
-			hex.EncodeToString(block_tx.FromPubkey[:]),
-			block_tx.Sig[:],
-			block_tx.Envelope(),
-		)
-		if !isValid {
-			return fmt.Errorf("Transaction %d is invalid: signature invalid.", i)
-		}
-
-		// This depends on where exactly we are verifying the sig.
-		err := dag.stateMachine.VerifyTx(block_tx)
-
-		if err != nil {
-			return fmt.Errorf("Transaction %d is invalid.", i)
-		}
+	// On an epoch boundary, the block starts a new epoch with a recomputed difficulty.
+	hash := raw.Hash()
+	epoch, _, err := dag.resolveEpoch(*parentBlock, hash, raw.Timestamp)
+	if err != nil {
+		return err
 	}
 
-	// 5. Verify transaction merkle root is valid.
-	txlist := make([][]byte, len(raw.Transactions))
-	for i, block_tx := range raw.Transactions {
-		txlist[i] = block_tx.Envelope()
-	}
-	expectedMerkleRoot := core.ComputeMerkleHash(txlist)
-	if expectedMerkleRoot != raw.TransactionsMerkleRoot {
-		return fmt.Errorf("Merkle root does not match computed merkle root.")
+	if verifyClaimedDifficulty(raw.Difficulty, *epoch) != nil || !VerifyPOW(hash, epoch.Difficulty) {
+		return ErrBlockPOWInvalid
 	}
+	return nil
+}
 
-	// 6. Verify POW solution is valid.
-	height := uint64(parentBlock.Height + 1)
-	var epoch *Epoch
-
-	// 6a. Compute the current difficulty epoch.
-	//
-
-	// Are we on an epoch boundary?
-	if height%dag.consensus.EpochLengthBlocks == 0 {
-		// Recompute difficulty and create new epoch.
-		dag.log.Printf("Recomputing difficulty for epoch %d\n", height/dag.consensus.EpochLengthBlocks)
+var ErrTxTooLarge = errors.New("transaction is larger than a block")
 
-		// Get current epoch.
-		epoch, err = dag.GetEpochForBlockHash(raw.ParentHash)
-		if err != nil {
-			return err
-		}
-		newDifficulty := RecomputeDifficulty(epoch.StartTime, raw.Timestamp, epoch.Difficulty, dag.consensus.TargetEpochLengthMillis, dag.consensus.EpochLengthBlocks, height)
-
-		epoch = &Epoch{
-			Number:         height / dag.consensus.EpochLengthBlocks,
-			StartBlockHash: raw.Hash(),
-			StartTime:      raw.Timestamp,
-			StartHeight:    height,
-			Difficulty:     newDifficulty,
-		}
-		_, err := dag.db.Exec(
-			"insert into epochs (id, start_block_hash, start_time, start_height, difficulty) values (?, ?, ?, ?, ?)",
-			epoch.GetId(),
-			epoch.StartBlockHash[:],
-			epoch.StartTime,
-			epoch.StartHeight,
-			newDifficulty.Bytes(),
-		)
-		if err != nil {
-			return err
-		}
-	} else {
-		// Lookup current epoch.
-		epoch, err = dag.GetEpochForBlockHash(raw.ParentHash)
-		if epoch == nil {
-			return fmt.Errorf("Parent block epoch not found.")
-		}
-		if err != nil {
-			return err
-		}
+// Checks a transaction's version, size and signature, without checking it against the state. This is cheap compared to
+// adding it to the mempool, and is done for transactions received from peers before they're relayed. Coins locked by a
+// predicate are unlocked by its witness, which is checked when a block including the transaction is ingested.
+func (dag *BlockDAG) PrecheckTransaction(tx RawTransaction) error {
+	if err := dag.stateMachine.VerifyTx(tx); err != nil {
+		return err
 	}
-
-	// 6b. Verify POW solution.
-	blockHash := raw.Hash()
-	if !VerifyPOW(blockHash, epoch.Difficulty) {
-		return fmt.Errorf("POW solution is invalid.")
+	if dag.consensus.MaxBlockSizeBytes < tx.EncodedSizeBytes() {
+		return ErrTxTooLarge
+	}
+	if !IsPredicateAddress(tx.FromPubkey) && !dag.SigCache.VerifyTransactionSignature(tx) {
+		return ErrInvalidSignature
 	}
+	return nil
+}
 
-	// 6c. Verify parent total work is correct.
-	parentTotalWork := Bytes32ToBigInt(raw.ParentTotalWork)
-	if parentBlock.AccumulatedWork.Cmp(&parentTotalWork) != 0 {
-		dag.log.Printf("Comparing parent total work. expected=%s actual=%s\n", parentBlock.AccumulatedWork.String(), parentTotalWork.String())
-		return fmt.Errorf("Parent total work is incorrect.")
+func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
+	check, err := dag.checkBlock(raw, true)
+	if err != nil {
+		return err
 	}
+	parentBlock, height, epoch, blockHash := check.parent, check.height, check.epoch, check.hash
 
-	// 7. Verify block size is within bounds.
-	if dag.consensus.MaxBlockSizeBytes < raw.SizeBytes() {
-		return fmt.Errorf("Block size exceeds maximum block size.")
+	// 7b. Compute the history peaks to store with the block. See history.go.
+	historyPeaks, err := dag.getChildHistoryPeaks(*parentBlock, blockHash)
+	if err != nil {
+		return err
 	}
 
 	// 8. Ingest block into database store.
@@ -685,6 +1166,12 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 	if err != nil {
 		return err
 	}
+	if check.newEpoch {
+		if err := insertEpoch(tx, *epoch); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 
 	acc_work := new(big.Int)
 	work := CalculateWork(Bytes32ToBigInt(blockHash))
@@ -694,19 +1181,25 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 	// Insert block.
 	blockhash := raw.Hash()
 	_, err = tx.Exec(
-		"insert into blocks (hash, parent_hash, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		"insert into blocks (hash, parent_hash, parent_total_work, difficulty, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, base_fee, version, history_root, height, epoch, size_bytes, acc_work, history_peaks, invalid) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, coalesce((select invalid from blocks where hash = ?), 0))",
 		blockhash[:],
 		raw.ParentHash[:],
 		raw.ParentTotalWork[:],
+		new(big.Int).SetBytes(raw.Difficulty[:]).Bytes(),
 		raw.Timestamp,
 		raw.NumTransactions,
 		raw.TransactionsMerkleRoot[:],
 		raw.Nonce[:],
 		raw.Graffiti[:],
+		raw.BaseFee,
+		raw.Version,
+		raw.HistoryRoot[:],
 		height,
 		epoch.GetId(),
 		raw.SizeBytes(),
 		acc_work_buf[:],
+		historyPeaks,
+		raw.ParentHash[:], // Descendants of invalid blocks are invalid.
 	)
 	if err != nil {
 		tx.Rollback()
@@ -727,6 +1220,17 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 			tx.Rollback()
 			return err
 		}
+		_, err = tx.Exec(
+			`insert or ignore into tx_index (tx_hash, block_hash, height, txindex) values (?, ?, ?, ?)`,
+			txhash[:],
+			blockhash[:],
+			height,
+			i,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 
 		// Check if we already have the transaction.
 		rows, err := tx.Query("select count(*) from transactions where hash = ?", txhash[:])
@@ -746,7 +1250,7 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 
 		// Insert the transaction.
 		_, err = tx.Exec(
-			"insert into transactions (hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version) values (?, ?, ?, ?, ?, ?, ?, ?)",
+			"insert into transactions (hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, version, predicate, witness, token_op, token, inputs) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 			txhash[:],
 			block_tx.Sig[:],
 			block_tx.FromPubkey[:],
@@ -755,6 +1259,11 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 			block_tx.Fee,
 			block_tx.Nonce,
 			block_tx.Version,
+			block_tx.Predicate,
+			block_tx.Witness,
+			block_tx.TokenOp,
+			block_tx.Token,
+			EncodeOutpoints(block_tx.Inputs),
 		)
 		if err != nil {
 			tx.Rollback()
@@ -762,6 +1271,7 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 		}
 	}
 	tx.Commit()
+	dag.blockCache.putBlock(chainSegmentBlock{hash: blockHash, parentHash: raw.ParentHash, height: height, version: raw.Version}, epoch.GetId())
 
 	// Update the tip.
 	err = dag.updateTip()
@@ -771,3 +1281,230 @@ func (dag *BlockDAG) IngestBlock(raw RawBlock) error {
 
 	return nil
 }
+
+// Validates a block in full, as IngestBlock does, without storing it. Used to check blocks constructed elsewhere, ie.
+// submitted over RPC, before they are mined or relayed.
+func (dag *BlockDAG) CheckBlock(raw RawBlock) error {
+	_, err := dag.checkBlock(raw, true)
+	return err
+}
+
+// Validates a block template, which is a block without a POW solution yet, so miners can sanity-check their templates
+// before mining them.
+func (dag *BlockDAG) CheckBlockTemplate(raw RawBlock) error {
+	_, err := dag.checkBlock(raw, false)
+	return err
+}
+
+// The result of validating a block, which IngestBlock needs to store it.
+type blockCheck struct {
+	parent *Block
+	height uint64
+	hash   [32]byte
+	// The block's difficulty epoch, which is new if the block starts it.
+	epoch    *Epoch
+	newEpoch bool
+}
+
+// Validates a block, without storing anything.
+func (dag *BlockDAG) checkBlock(raw RawBlock, checkPOW bool) (blockCheck, error) {
+	// 1. Verify parent is known.
+	parentBlock, err := dag.GetBlockByHash(raw.ParentHash)
+	if err != nil {
+		return blockCheck{}, err
+	}
+	if parentBlock == nil {
+		return blockCheck{}, fmt.Errorf("Unknown parent block.")
+	}
+
+	// 2. Verify timestamp isn't too far in the future.
+	if err := dag.verifyTimestamp(raw.Timestamp); err != nil {
+		return blockCheck{}, err
+	}
+
+	// 2a. Verify base fee.
+	if raw.BaseFee != dag.GetNextBaseFee(*parentBlock) {
+		return blockCheck{}, fmt.Errorf("Base fee is incorrect.")
+	}
+
+	// 2b. Verify fork rules.
+	if err := dag.verifyForkRules(parentBlock.Height+1, raw.Version); err != nil {
+		return blockCheck{}, err
+	}
+
+	// 2c. Verify history root.
+	if err := dag.verifyHistoryRoot(*parentBlock, raw.HistoryRoot); err != nil {
+		return blockCheck{}, err
+	}
+
+	// 3. Verify num transactions is the same as the length of the transactions list.
+	if int(raw.NumTransactions) != len(raw.Transactions) {
+		return blockCheck{}, fmt.Errorf("Num transactions does not match length of transactions list.")
+	}
+
+	// 4. Verify transactions are valid.
+	// TODO: We can parallelise this.
+	// This is one of the most expensive operations of the blockchain node.
+	for i, block_tx := range raw.Transactions {
+		dag.log.Printf("Verifying transaction %d\n", i)
+		if !dag.IsTransactionVersionActive(block_tx.Version, parentBlock.Height+1) {
+			return blockCheck{}, fmt.Errorf("Transaction %d is invalid: version %d is not active.", i, block_tx.Version)
+		}
+
+		// Coins locked by a predicate are unlocked by its witness, rather than a signature.
+		if err := VerifyPredicate(block_tx, parentBlock.Height+1); err != nil {
+			return blockCheck{}, fmt.Errorf("Transaction %d is invalid: %s.", i, err)
+		}
+		if !IsPredicateAddress(block_tx.FromPubkey) {
+			if !dag.SigCache.VerifyTransactionSignature(block_tx) {
+				return blockCheck{}, fmt.Errorf("Transaction %d is invalid: signature invalid.", i)
+			}
+		}
+
+		// This depends on where exactly we are verifying the sig.
+		err := dag.stateMachine.VerifyTx(block_tx)
+
+		if err != nil {
+			return blockCheck{}, fmt.Errorf("Transaction %d is invalid.", i)
+		}
+
+		// The coinbase aside, transactions must pay the base fee.
+		if 0 < i && block_tx.Fee < raw.BaseFee*block_tx.SizeBytes() {
+			return blockCheck{}, fmt.Errorf("Transaction %d is invalid: fee below base fee.", i)
+		}
+	}
+
+	// 5. Verify transaction merkle root is valid.
+	txlist := make([][]byte, len(raw.Transactions))
+	for i, block_tx := range raw.Transactions {
+		txlist[i] = block_tx.Envelope()
+	}
+	expectedMerkleRoot := core.ComputeMerkleHash(txlist)
+	if expectedMerkleRoot != raw.TransactionsMerkleRoot {
+		return blockCheck{}, fmt.Errorf("Merkle root does not match computed merkle root.")
+	}
+
+	// 6. Verify POW solution is valid.
+	height := uint64(parentBlock.Height + 1)
+
+	// 6a. Resolve the difficulty epoch on the parent's branch. See epochs.go.
+	blockHash := raw.Hash()
+	epoch, newEpoch, err := dag.resolveEpoch(*parentBlock, blockHash, raw.Timestamp)
+	if err != nil {
+		return blockCheck{}, err
+	}
+
+	// 6b. Verify POW solution.
+	if err := verifyClaimedDifficulty(raw.Difficulty, *epoch); err != nil {
+		return blockCheck{}, err
+	}
+	if checkPOW && !VerifyPOW(blockHash, epoch.Difficulty) {
+		return blockCheck{}, fmt.Errorf("POW solution is invalid.")
+	}
+
+	// 6c. Verify parent total work is correct.
+	parentTotalWork := Bytes32ToBigInt(raw.ParentTotalWork)
+	if parentBlock.AccumulatedWork.Cmp(&parentTotalWork) != 0 {
+		dag.log.Printf("Comparing parent total work. expected=%s actual=%s\n", parentBlock.AccumulatedWork.String(), parentTotalWork.String())
+		return blockCheck{}, fmt.Errorf("Parent total work is incorrect.")
+	}
+
+	// 7. Verify block size and weight are within bounds.
+	if err := dag.verifyBlockSpace(raw); err != nil {
+		return blockCheck{}, err
+	}
+
+	// 7a. Verify the transactions execute on the parent's state. This is the most expensive check, so it's last.
+	block := Block{
+		ParentHash:      raw.ParentHash,
+		Timestamp:       raw.Timestamp,
+		NumTransactions: raw.NumTransactions,
+		BaseFee:         raw.BaseFee,
+		Transactions:    raw.Transactions,
+		Height:          height,
+		Hash:            blockHash,
+	}
+	if err := dag.verifyBlockState(block); err != nil {
+		return blockCheck{}, err
+	}
+
+	return blockCheck{parent: parentBlock, height: height, hash: blockHash, epoch: epoch, newEpoch: newEpoch}, nil
+}
+
+// Verifies a block's transactions execute on the state after its parent, if a verifier is registered.
+func (dag *BlockDAG) verifyBlockState(block Block) error {
+	if dag.VerifyBlockState == nil {
+		return nil
+	}
+	if err := dag.VerifyBlockState(block); err != nil {
+		return fmt.Errorf("Block is invalid on its parent's state: %s", err)
+	}
+	return nil
+}
+
+// Marks a block and all of its descendants as invalid, so they are never chosen as the tip. If the block is in the
+// current chain, the DAG reorgs to the heaviest valid chain. Used by operators to respond to consensus bugs.
+func (dag *BlockDAG) InvalidateBlock(blockhash [32]byte) error {
+	block, err := dag.GetBlockByHash(blockhash)
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		return fmt.Errorf("Block not found.")
+	}
+	if block.Height == 0 {
+		return fmt.Errorf("Cannot invalidate the genesis block.")
+	}
+
+	_, err = dag.db.Exec(`
+		with recursive descendants(hash) as (
+			select ?
+			union all
+			select b.hash from blocks b join descendants d on b.parent_hash = d.hash
+		)
+		update blocks set invalid = 1 where hash in (select hash from descendants)`,
+		blockhash[:],
+	)
+	if err != nil {
+		return err
+	}
+
+	dag.log.Printf("Invalidated block: height=%d hash=%s\n", block.Height, block.HashStr())
+	return dag.updateTip()
+}
+
+// Removes the invalid mark from a block, its descendants and its ancestors, reversing InvalidateBlock. If the block's
+// chain is the heaviest, the DAG reorgs to it.
+func (dag *BlockDAG) ReconsiderBlock(blockhash [32]byte) error {
+	block, err := dag.GetBlockByHash(blockhash)
+	if err != nil {
+		return err
+	}
+	if block == nil {
+		return fmt.Errorf("Block not found.")
+	}
+
+	_, err = dag.db.Exec(`
+		with recursive
+		descendants(hash) as (
+			select ?
+			union all
+			select b.hash from blocks b join descendants d on b.parent_hash = d.hash
+		),
+		ancestors(hash, parent_hash) as (
+			select hash, parent_hash from blocks where hash = ?
+			union all
+			select b.hash, b.parent_hash from blocks b join ancestors a on b.hash = a.parent_hash
+		)
+		update blocks set invalid = 0
+		where hash in (select hash from descendants) or hash in (select hash from ancestors)`,
+		blockhash[:],
+		blockhash[:],
+	)
+	if err != nil {
+		return err
+	}
+
+	dag.log.Printf("Reconsidered block: height=%d hash=%s\n", block.Height, block.HashStr())
+	return dag.updateTip()
+}
@@ -1,7 +1,10 @@
 package nakamoto
 
 import (
+	"database/sql"
 	"fmt"
+	"math/big"
+	"strings"
 )
 
 // The methods of the BlockDAG engine:
@@ -13,45 +16,76 @@ import (
 // Full sync:
 // - IngestBlock
 //
+// Operator controls:
+// - InvalidateBlock
+// - ReconsiderBlock
+//
 
 // The methods of the BlockDAG client:
 //
 // Difficulty:
 // - GetEpochForBlockhash
+// - GetEpochs
+// - GetDifficultyAt
 //
 // Blocks:
 // - GetBlockByHash
+// - GetBlocksByHashes
 // - GetBlockTransactions
 // - GetRawBlockDataByHash
 //
+// Transactions:
+// - IsTransactionInMainChain
+// - GetTransactionByHash
+// - GetAccountNonce
+// - GetAccountActivity
+//
+// Iterators:
+// - IterateMainChain
+// - IterateBlockTransactions
+//
+// Export:
+// - ExportDot
+// - ExportJSON
+//
 // Tip:
 // - GetLatestFullTip
 // - GetLatestHeadersTip
 // - GetPath
 // - GetLongestChainHashList
+// - GetChainTips
+// - GetCommonAncestor
 //
 // Sync:
 // - HasBlock
 //
 
-// Gets the epoch for a given block hash.
+// Gets the epoch for a given block hash. Recent blocks are read from the block cache.
 func (dag *BlockDAG) GetEpochForBlockHash(blockhash [32]byte) (*Epoch, error) {
+	if epoch, ok := dag.blockCache.getEpoch(blockhash); ok {
+		return epoch, nil
+	}
+
 	// Lookup the parent block.
 	parentBlockEpochId := ""
-	rows, err := dag.db.Query("select epoch from blocks where hash = ? limit 1", blockhash[:])
+	link := chainSegmentBlock{hash: blockhash}
+	rows, err := dag.db.Query("select epoch, parent_hash, height, version from blocks where hash = ? limit 1", blockhash[:])
 	if err != nil {
 		return nil, err
 	}
 	if rows.Next() {
-		rows.Scan(&parentBlockEpochId)
+		parentHash := []byte{}
+		rows.Scan(&parentBlockEpochId, &parentHash, &link.height, &link.version)
+		copy(link.parentHash[:], parentHash)
 	} else {
+		rows.Close()
 		return nil, fmt.Errorf("Parent block not found.")
 	}
 	rows.Close()
 
 	// Get the epoch.
 	epoch := Epoch{}
-	rows, err = dag.db.Query("select id, start_block_hash, start_time, start_height, difficulty from epochs where id = ? limit 1", parentBlockEpochId)
+	rows, err = dag.db.Query("select id, coalesce(parent_epoch, ''), start_block_hash, start_time, start_height, difficulty from epochs where id = ? limit 1", parentBlockEpochId)
 	if err != nil {
 		return nil, err
 	}
@@ -60,12 +94,13 @@ func (dag *BlockDAG) GetEpochForBlockHash(blockhash [32]byte) (*Epoch, error) {
 	if rows.Next() {
 		startBlockHash := []byte{}
 		difficulty := []byte{}
-		err := rows.Scan(&epoch.Id, &startBlockHash, &epoch.StartTime, &epoch.StartHeight, &difficulty)
+		err := rows.Scan(&epoch.Id, &epoch.ParentId, &startBlockHash, &epoch.StartTime, &epoch.StartHeight, &difficulty)
 		if err != nil {
 			return nil, err
 		}
 
 		copy(epoch.StartBlockHash[:], startBlockHash)
+		epoch.Number = epoch.StartHeight / dag.consensus.EpochLengthBlocks
 		diffBytes32 := [32]byte{}
 		copy(diffBytes32[:], difficulty)
 		epoch.Difficulty = Bytes32ToBigInt(diffBytes32)
@@ -73,15 +108,115 @@ func (dag *BlockDAG) GetEpochForBlockHash(blockhash [32]byte) (*Epoch, error) {
 		return nil, fmt.Errorf("Epoch not found.")
 	}
 
+	dag.blockCache.putBlock(link, parentBlockEpochId)
+	dag.blockCache.putEpoch(blockhash, epoch)
 	return &epoch, nil
 }
 
-func (dag *BlockDAG) GetBlockByHash(hash [32]byte) (*Block, error) {
-	block := Block{}
+// An epoch on the main chain, with the retarget which started it.
+type EpochInfo struct {
+	Epoch
+
+	// The time from the epoch's start block to the next epoch's, in milliseconds. For the current epoch, this is the time
+	// to the tip.
+	Timespan uint64
+	// The epoch's difficulty target divided by the previous epoch's. Above 1 when the target rose (mining got easier),
+	// and 1 for the genesis epoch.
+	RetargetRatio float64
+}
+
+// Gets the epochs of the main chain, from the current epoch backwards, skipping the latest `offset` epochs.
+func (dag *BlockDAG) GetEpochs(limit uint64, offset uint64) ([]EpochInfo, error) {
+	tip := dag.FullTip
+	currentEpoch := tip.Height / dag.consensus.EpochLengthBlocks
+
+	// Load one epoch beyond the page, for the retarget ratio of the last epoch.
+	minHeight := uint64(0)
+	if offset+limit < currentEpoch {
+		minHeight = (currentEpoch - offset - limit) * dag.consensus.EpochLengthBlocks
+	}
+	epochs, err := dag.getMainChainEpochs(minHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []EpochInfo{}
+	for i := offset; i < uint64(len(epochs)) && i < offset+limit; i++ {
+		info := EpochInfo{Epoch: epochs[i], RetargetRatio: 1}
+		if i == 0 {
+			info.Timespan = tip.Timestamp - info.StartTime
+		} else {
+			info.Timespan = epochs[i-1].StartTime - info.StartTime
+		}
+		if i+1 < uint64(len(epochs)) {
+			ratio := new(big.Float).Quo(new(big.Float).SetInt(&info.Difficulty), new(big.Float).SetInt(&epochs[i+1].Difficulty))
+			info.RetargetRatio, _ = ratio.Float64()
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Gets the difficulty target of the block at a height on the main chain.
+func (dag *BlockDAG) GetDifficultyAt(height uint64) (big.Int, error) {
+	if dag.FullTip.Height < height {
+		return big.Int{}, fmt.Errorf("Height %d is beyond the tip at %d.", height, dag.FullTip.Height)
+	}
+	epochs, err := dag.getMainChainEpochs(height - height%dag.consensus.EpochLengthBlocks)
+	if err != nil {
+		return big.Int{}, err
+	}
+	for _, epoch := range epochs {
+		if epoch.StartHeight <= height {
+			return epoch.Difficulty, nil
+		}
+	}
+	return big.Int{}, fmt.Errorf("Epoch not found.")
+}
 
+// Gets the epochs started by blocks on the main chain at or above minHeight, latest first.
+func (dag *BlockDAG) getMainChainEpochs(minHeight uint64) ([]Epoch, error) {
+	return dag.GetBranchEpochs(dag.FullTip.Hash, minHeight)
+}
+
+// Gets the epochs on the branch ending at a block, started at or above minHeight, latest first. See epochs.go.
+func (dag *BlockDAG) GetBranchEpochs(tip [32]byte, minHeight uint64) ([]Epoch, error) {
+	rows, err := dag.db.Query(`
+		with recursive chain(id) as (
+			select epoch from blocks where hash = ?
+			union all
+			select e.parent_epoch from epochs e join chain c on e.id = c.id where e.parent_epoch is not null and ? < e.start_height
+		)
+		select e.id, coalesce(e.parent_epoch, ''), e.start_block_hash, e.start_time, e.start_height, e.difficulty from epochs e join chain c on e.id = c.id where ? <= e.start_height order by e.start_height desc`,
+		tip[:],
+		minHeight,
+		minHeight,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	epochs := []Epoch{}
+	for rows.Next() {
+		epoch := Epoch{}
+		startBlockHash := []byte{}
+		difficulty := []byte{}
+		if err := rows.Scan(&epoch.Id, &epoch.ParentId, &startBlockHash, &epoch.StartTime, &epoch.StartHeight, &difficulty); err != nil {
+			return nil, err
+		}
+		copy(epoch.StartBlockHash[:], startBlockHash)
+		epoch.Number = epoch.StartHeight / dag.consensus.EpochLengthBlocks
+		epoch.Difficulty.SetBytes(difficulty)
+		epochs = append(epochs, epoch)
+	}
+	return epochs, rows.Err()
+}
+
+func (dag *BlockDAG) GetBlockByHash(hash [32]byte) (*Block, error) {
 	// Query database.
 	rows, err := dag.db.Query(
-		`select hash, parent_hash, difficulty, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work from blocks where hash = ? limit 1`,
+		`select hash, parent_hash, difficulty, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work, base_fee, version, history_root from blocks where hash = ? limit 1`,
 		hash[:],
 	)
 	if err != nil {
@@ -90,54 +225,228 @@ func (dag *BlockDAG) GetBlockByHash(hash [32]byte) (*Block, error) {
 	defer rows.Close()
 
 	if rows.Next() {
-		hash := []byte{}
-		parentHash := []byte{}
-		difficultyBuf := []byte{}
-		transactionsMerkleRoot := []byte{}
-		nonce := []byte{}
-		graffiti := []byte{}
-		accWorkBuf := []byte{}
-		parentTotalWorkBuf := []byte{}
-
-		err := rows.Scan(
-			&hash,
-			&parentHash,
-			&difficultyBuf,
-			&parentTotalWorkBuf,
-			&block.Timestamp,
-			&block.NumTransactions,
-			&transactionsMerkleRoot,
-			&nonce,
-			&graffiti,
-			&block.Height,
-			&block.Epoch,
-			&block.SizeBytes,
-			&accWorkBuf,
-		)
+		block, err := scanBlock(rows)
+		if err != nil {
+			return nil, err
+		}
+		return &block, nil
+	} else {
+		return nil, err
+	}
+}
+
+// Gets a list of blocks by hash in a single query. The returned list is in the same order as `hashes`, with nil
+// entries for blocks which are not found.
+func (dag *BlockDAG) GetBlocksByHashes(hashes [][32]byte) ([]*Block, error) {
+	blocks := make([]*Block, len(hashes))
+	if len(hashes) == 0 {
+		return blocks, nil
+	}
+
+	placeholders := make([]string, len(hashes))
+	args := make([]interface{}, len(hashes))
+	for i, hash := range hashes {
+		placeholders[i] = "?"
+		args[i] = hash[:]
+	}
 
+	rows, err := dag.db.Query(
+		`select hash, parent_hash, difficulty, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work, base_fee, version, history_root from blocks where hash in (`+strings.Join(placeholders, ", ")+`)`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[[32]byte]*Block)
+	for rows.Next() {
+		block, err := scanBlock(rows)
 		if err != nil {
 			return nil, err
 		}
+		found[block.Hash] = &block
+	}
 
-		copy(block.Hash[:], hash)
-		copy(block.ParentHash[:], parentHash)
-		copy(block.Difficulty[:], difficultyBuf)
-		copy(block.TransactionsMerkleRoot[:], transactionsMerkleRoot)
-		copy(block.Nonce[:], nonce)
-		copy(block.Graffiti[:], graffiti)
+	for i, hash := range hashes {
+		blocks[i] = found[hash]
+	}
 
-		accWork := [32]byte{}
-		copy(accWork[:], accWorkBuf)
-		block.AccumulatedWork = Bytes32ToBigInt(accWork)
+	return blocks, nil
+}
 
-		parentTotalWork := [32]byte{}
-		copy(parentTotalWork[:], parentTotalWorkBuf)
-		block.ParentTotalWork = Bytes32ToBigInt(parentTotalWork)
+// The location of a transaction in a block.
+type TxLocation struct {
+	BlockHash [32]byte
+	Height    uint64
+	TxIndex   uint64
+}
 
-		return &block, nil
-	} else {
+// Gets the location of a transaction on the main chain (the chain of the full tip), or nil if it isn't on the main
+// chain. If the transaction was included more than once (ie. identical coinbases), the latest inclusion is returned.
+func (dag *BlockDAG) GetTransactionLocation(txhash [32]byte) (*TxLocation, error) {
+	// Find the lowest block which includes the transaction, to bound the walk back from the tip.
+	var minHeight sql.NullInt64
+	err := dag.db.QueryRow(`select min(height) from tx_index where tx_hash = ?`, txhash[:]).Scan(&minHeight)
+	if err != nil {
+		return nil, err
+	}
+	if !minHeight.Valid {
+		return nil, nil
+	}
+
+	rows, err := dag.db.Query(`
+		with recursive chain(hash, parent_hash, height) as (
+			select hash, parent_hash, height from blocks where hash = ?
+			union all
+			select b.hash, b.parent_hash, b.height from blocks b join chain c on b.hash = c.parent_hash where ? < c.height
+		)
+		select i.block_hash, i.height, i.txindex from tx_index i join chain c on i.block_hash = c.hash where i.tx_hash = ? order by i.height desc limit 1`,
+		dag.FullTip.Hash[:],
+		minHeight.Int64,
+		txhash[:],
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	location := TxLocation{}
+	blockHash := []byte{}
+	if err := rows.Scan(&blockHash, &location.Height, &location.TxIndex); err != nil {
 		return nil, err
 	}
+	copy(location.BlockHash[:], blockHash)
+	return &location, nil
+}
+
+// Gets a transaction on the main chain by its hash, or nil if it isn't on the main chain. The transaction's Blockhash
+// and TxIndex are set to its location, as in GetTransactionLocation.
+func (dag *BlockDAG) GetTransactionByHash(txhash [32]byte) (*Transaction, error) {
+	location, err := dag.GetTransactionLocation(txhash)
+	if err != nil || location == nil {
+		return nil, err
+	}
+	return dag.getTransactionAt(txhash, *location)
+}
+
+// Gets a transaction, with its Blockhash and TxIndex set to the location.
+func (dag *BlockDAG) getTransactionAt(txhash [32]byte, location TxLocation) (*Transaction, error) {
+	rows, err := dag.db.Query(
+		`select hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, ?, version, predicate, witness, token_op, token, inputs from transactions where hash = ?`,
+		location.TxIndex,
+		txhash[:],
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Transaction %x is indexed but missing.", txhash)
+	}
+	tx, err := scanTransaction(rows)
+	if err != nil {
+		return nil, err
+	}
+	tx.Blockhash = location.BlockHash
+	return &tx, nil
+}
+
+// Checks whether a transaction has been included in a block on the main chain (the chain of the full tip).
+func (dag *BlockDAG) IsTransactionInMainChain(txhash [32]byte) (bool, error) {
+	location, err := dag.GetTransactionLocation(txhash)
+	if err != nil {
+		return false, err
+	}
+	return location != nil, nil
+}
+
+// Returns the number of confirmations of a block: 1 for the full tip, 2 for its parent, and so on, or 0 if the block
+// isn't on the main chain.
+func (dag *BlockDAG) GetBlockConfirmations(block Block) (uint64, error) {
+	tip := dag.FullTip
+	if tip.Height < block.Height {
+		return 0, nil
+	}
+	it, err := dag.IterateMainChain(block.Height, block.Height)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	if !it.Next() {
+		return 0, it.Err()
+	}
+	if it.Block().Hash != block.Hash {
+		return 0, nil
+	}
+	return tip.Height - block.Height + 1, nil
+}
+
+// Scans a block from a row with the columns:
+// hash, parent_hash, difficulty, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work, base_fee, version, history_root
+func scanBlock(rows *sql.Rows) (Block, error) {
+	block := Block{}
+
+	hash := []byte{}
+	parentHash := []byte{}
+	difficultyBuf := []byte{}
+	transactionsMerkleRoot := []byte{}
+	nonce := []byte{}
+	graffiti := []byte{}
+	accWorkBuf := []byte{}
+	parentTotalWorkBuf := []byte{}
+	historyRoot := []byte{}
+
+	err := rows.Scan(
+		&hash,
+		&parentHash,
+		&difficultyBuf,
+		&parentTotalWorkBuf,
+		&block.Timestamp,
+		&block.NumTransactions,
+		&transactionsMerkleRoot,
+		&nonce,
+		&graffiti,
+		&block.Height,
+		&block.Epoch,
+		&block.SizeBytes,
+		&accWorkBuf,
+		&block.BaseFee,
+		&block.Version,
+		&historyRoot,
+	)
+	if err != nil {
+		return Block{}, err
+	}
+
+	copy(block.Hash[:], hash)
+	copy(block.ParentHash[:], parentHash)
+	// The difficulty is stored as a big-endian integer without leading zeroes.
+	if len(difficultyBuf) <= 32 {
+		copy(block.Difficulty[32-len(difficultyBuf):], difficultyBuf)
+	}
+	copy(block.TransactionsMerkleRoot[:], transactionsMerkleRoot)
+	copy(block.Nonce[:], nonce)
+	copy(block.Graffiti[:], graffiti)
+	copy(block.HistoryRoot[:], historyRoot)
+
+	accWork := [32]byte{}
+	copy(accWork[:], accWorkBuf)
+	block.AccumulatedWork = Bytes32ToBigInt(accWork)
+
+	parentTotalWork := [32]byte{}
+	copy(parentTotalWork[:], parentTotalWorkBuf)
+	block.ParentTotalWork = Bytes32ToBigInt(parentTotalWork)
+
+	return block, nil
 }
 
 func (dag *BlockDAG) GetBlockTransactions(hash [32]byte) (*[]Transaction, error) {
@@ -161,7 +470,7 @@ func (dag *BlockDAG) GetBlockTransactions(hash [32]byte) (*[]Transaction, error)
 
 	// Load the transactions in.
 	rows, err = dag.db.Query(`
-		SELECT txs.hash, txs.sig, txs.from_pubkey, txs.to_pubkey, txs.amount, txs.fee, txs.nonce, txblocks.txindex, txs.version
+		SELECT txs.hash, txs.sig, txs.from_pubkey, txs.to_pubkey, txs.amount, txs.fee, txs.nonce, txblocks.txindex, txs.version, txs.predicate, txs.witness, txs.token_op, txs.token, txs.inputs
 		FROM transactions txs
 		JOIN transactions_blocks txblocks ON txs.hash = txblocks.transaction_hash
 		WHERE txblocks.block_hash = ?
@@ -172,39 +481,89 @@ func (dag *BlockDAG) GetBlockTransactions(hash [32]byte) (*[]Transaction, error)
 	}
 
 	for rows.Next() {
-		tx := Transaction{}
-
-		hash := []byte{}
-		sig := []byte{}
-		fromPubkey := []byte{}
-		toPubkey := []byte{}
-		amount := uint64(0)
-		fee := uint64(0)
-		nonce := uint64(0)
-		txindex := uint64(0)
-		version := 0 // TODO
-
-		err := rows.Scan(&hash, &sig, &fromPubkey, &toPubkey, &amount, &fee, &nonce, &txindex, &version)
+		tx, err := scanTransaction(rows)
 		if err != nil {
 			return nil, err
 		}
 
-		copy(tx.Hash[:], hash)
-		copy(tx.Sig[:], sig)
-		copy(tx.FromPubkey[:], fromPubkey)
-		copy(tx.ToPubkey[:], toPubkey)
-		tx.Amount = amount
-		tx.Fee = fee
-		tx.Nonce = nonce
-		tx.TxIndex = txindex
-		tx.Version = byte(version)
-
-		txs[txindex] = tx
+		txs[tx.TxIndex] = tx
 	}
 
 	return &txs, nil
 }
 
+// Scans a transaction from a row with the columns:
+// hash, sig, from_pubkey, to_pubkey, amount, fee, nonce, txindex, version, predicate, witness, token_op, token, inputs
+func scanTransaction(rows *sql.Rows) (Transaction, error) {
+	tx := Transaction{}
+
+	hash := []byte{}
+	sig := []byte{}
+	fromPubkey := []byte{}
+	toPubkey := []byte{}
+	amount := uint64(0)
+	fee := uint64(0)
+	nonce := uint64(0)
+	txindex := uint64(0)
+	version := 0 // TODO
+	predicate := []byte{}
+	witness := []byte{}
+	tokenOp := 0
+	token := ""
+	inputs := []byte{}
+
+	err := rows.Scan(&hash, &sig, &fromPubkey, &toPubkey, &amount, &fee, &nonce, &txindex, &version, &predicate, &witness, &tokenOp, &token, &inputs)
+	if err != nil {
+		return Transaction{}, err
+	}
+
+	copy(tx.Hash[:], hash)
+	copy(tx.Sig[:], sig)
+	copy(tx.FromPubkey[:], fromPubkey)
+	copy(tx.ToPubkey[:], toPubkey)
+	tx.Amount = amount
+	tx.Fee = fee
+	tx.Nonce = nonce
+	tx.TxIndex = txindex
+	tx.Version = byte(version)
+	if len(predicate) > 0 {
+		tx.Predicate = predicate
+	}
+	if len(witness) > 0 {
+		tx.Witness = witness
+	}
+	tx.TokenOp = byte(tokenOp)
+	tx.Token = token
+	if len(inputs) > 0 {
+		tx.Inputs, err = DecodeOutpoints(inputs)
+		if err != nil {
+			return Transaction{}, err
+		}
+	}
+
+	return tx, nil
+}
+
+// Reads a block along with its transactions.
+func (dag *BlockDAG) getBlockWithTransactions(hash [32]byte) (*Block, error) {
+	block, err := dag.GetBlockByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("Block not found: %x", hash)
+	}
+	txs, err := dag.GetBlockTransactions(hash)
+	if err != nil {
+		return nil, err
+	}
+	block.Transactions = []RawTransaction{}
+	for _, tx := range *txs {
+		block.Transactions = append(block.Transactions, tx.ToRawTransaction())
+	}
+	return block, nil
+}
+
 func (dag *BlockDAG) GetRawBlockDataByHash(hash [32]byte) ([]byte, error) {
 	// TODO.
 	// get block from disk
@@ -245,7 +604,7 @@ func (dag *BlockDAG) GetLatestHeadersTip() (Block, error) {
 
 	// Query the highest accumulated work block in the database.
 	rows, err := dag.db.Query(`
-		select hash from blocks order by acc_work desc limit 1
+		select hash from blocks where invalid = 0 order by acc_work desc limit 1
 	`)
 	if err != nil {
 		return Block{}, err
@@ -270,7 +629,11 @@ func (dag *BlockDAG) GetLatestHeadersTip() (Block, error) {
 		return Block{}, err
 	}
 
-	return *block, nil
+	tip, err := dag.applyFinality(*block, false)
+	if err != nil {
+		return Block{}, err
+	}
+	return dag.applyReorgLimit(tip, false)
 }
 
 // Gets the latest block in the longest chain.
@@ -287,12 +650,14 @@ func (dag *BlockDAG) GetLatestFullTip() (Block, error) {
 				GROUP BY block_hash
 			) tb ON b.hash = tb.block_hash
 			WHERE b.num_transactions = tb.num_transactions
+			AND b.invalid = 0
 
 			UNION
 
 			SELECT b.hash, b.acc_work
 			FROM blocks b
 			WHERE b.num_transactions = 0
+			AND b.invalid = 0
 			AND NOT EXISTS (
 				SELECT 1 
 				FROM transactions_blocks tb 
@@ -325,12 +690,22 @@ func (dag *BlockDAG) GetLatestFullTip() (Block, error) {
 		return Block{}, err
 	}
 
-	return *block, nil
+	tip, err := dag.applyFinality(*block, true)
+	if err != nil {
+		return Block{}, err
+	}
+	return dag.applyReorgLimit(tip, true)
 }
 
 // Gets the list of hashes for the longest chain, traversing backwards from startHash and accumulating depthFromTip items.
 func (dag *BlockDAG) GetLongestChainHashList(startHash [32]byte, depthFromTip uint64) ([][32]byte, error) {
 	list := make([][32]byte, 0, depthFromTip)
+	if segment, ok := dag.blockCache.getChainSegment(startHash, depthFromTip); ok {
+		for i := len(segment) - 1; 0 <= i; i-- {
+			list = append(list, segment[i].hash)
+		}
+		return list, nil
+	}
 
 	// Hey, I bet you didn't know SQL could do this, right?
 	// Neither did I. It's called a recursive common table expression.
@@ -338,18 +713,18 @@ func (dag *BlockDAG) GetLongestChainHashList(startHash [32]byte, depthFromTip ui
 	// Pretty cool, huh?
 	rows, err := dag.db.Query(`
 		WITH RECURSIVE block_path AS (
-			SELECT hash, parent_hash, 1 AS depth
+			SELECT hash, parent_hash, height, version, 1 AS depth
 			FROM blocks
 			WHERE hash = ?
 
 			UNION ALL
 
-			SELECT b.hash, b.parent_hash, bp.depth + 1
+			SELECT b.hash, b.parent_hash, b.height, b.version, bp.depth + 1
 			FROM blocks b
 			INNER JOIN block_path bp ON b.hash = bp.parent_hash
 			WHERE bp.depth < ?
 		)
-		SELECT hash, parent_hash
+		SELECT hash, parent_hash, height, version
 		FROM block_path
 		ORDER BY depth DESC;`,
 		startHash[:],
@@ -366,13 +741,16 @@ func (dag *BlockDAG) GetLongestChainHashList(startHash [32]byte, depthFromTip ui
 		hash := [32]byte{}
 		parentHash := [32]byte{}
 
-		err := rows.Scan(&hashBuf, &parentHashBuf)
+		link := chainSegmentBlock{}
+		err := rows.Scan(&hashBuf, &parentHashBuf, &link.height, &link.version)
 		if err != nil {
 			return list, err
 		}
 
 		copy(hash[:], hashBuf)
 		copy(parentHash[:], parentHashBuf)
+		link.hash, link.parentHash = hash, parentHash
+		dag.blockCache.putBlock(link, "")
 
 		list = append(list, hash)
 	}
@@ -460,3 +838,139 @@ func (dag *BlockDAG) GetPath(startHash [32]byte, depthFromTip uint64, direction
 
 	return list, nil
 }
+
+// The status of a chain tip.
+const (
+	// The tip of the main chain.
+	CHAIN_TIP_ACTIVE = "active"
+	// The tip of a fully validated branch which is not part of the main chain.
+	CHAIN_TIP_VALID_FORK = "valid-fork"
+	// The tip of a branch we only have the headers of.
+	CHAIN_TIP_HEADERS_ONLY = "headers-only"
+	// The tip of a branch which was invalidated.
+	CHAIN_TIP_INVALID = "invalid"
+)
+
+// The tip of a branch in the block DAG.
+type ChainTip struct {
+	Hash            [32]byte
+	Height          uint64
+	AccumulatedWork big.Int
+	Status          string
+
+	// The main chain block the branch forks from, and the number of blocks on the branch since. The fork point of the
+	// main chain tip is itself.
+	ForkPoint    Block
+	BranchLength uint64
+}
+
+// Gets the tips of all branches in the block DAG, including the main chain.
+func (dag *BlockDAG) GetChainTips() ([]ChainTip, error) {
+	// Tips are blocks without children. The main chain tip may have invalidated children, so it's included too.
+	rows, err := dag.db.Query(`
+		select hash from blocks b
+		where not exists (select 1 from blocks c where c.parent_hash = b.hash)
+		or hash = ?`,
+		dag.FullTip.Hash[:],
+	)
+	if err != nil {
+		return nil, err
+	}
+	hashes := [][32]byte{}
+	for rows.Next() {
+		hashBuf := []byte{}
+		if err := rows.Scan(&hashBuf); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hash := [32]byte{}
+		copy(hash[:], hashBuf)
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+
+	tips := []ChainTip{}
+	for _, hash := range hashes {
+		block, err := dag.GetBlockByHash(hash)
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			continue
+		}
+
+		forkPoint, err := dag.GetCommonAncestor(hash, dag.FullTip.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		status, err := dag.getChainTipStatus(*block)
+		if err != nil {
+			return nil, err
+		}
+
+		tips = append(tips, ChainTip{
+			Hash:            block.Hash,
+			Height:          block.Height,
+			AccumulatedWork: block.AccumulatedWork,
+			Status:          status,
+			ForkPoint:       *forkPoint,
+			BranchLength:    block.Height - forkPoint.Height,
+		})
+	}
+
+	return tips, nil
+}
+
+func (dag *BlockDAG) getChainTipStatus(block Block) (string, error) {
+	if block.Hash == dag.FullTip.Hash {
+		return CHAIN_TIP_ACTIVE, nil
+	}
+
+	var invalid bool
+	var numTransactions uint64
+	err := dag.db.QueryRow(
+		"select invalid, (select count(*) from transactions_blocks where block_hash = blocks.hash) from blocks where hash = ?",
+		block.Hash[:],
+	).Scan(&invalid, &numTransactions)
+	if err != nil {
+		return "", err
+	}
+
+	if invalid {
+		return CHAIN_TIP_INVALID, nil
+	}
+	if numTransactions != block.NumTransactions {
+		return CHAIN_TIP_HEADERS_ONLY, nil
+	}
+	return CHAIN_TIP_VALID_FORK, nil
+}
+
+// Gets the most recent block which is an ancestor of (or is) both blocks.
+func (dag *BlockDAG) GetCommonAncestor(a [32]byte, b [32]byte) (*Block, error) {
+	blockA, err := dag.GetBlockByHash(a)
+	if err != nil {
+		return nil, err
+	}
+	blockB, err := dag.GetBlockByHash(b)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk back from the higher block until the blocks meet.
+	for blockA != nil && blockB != nil && blockA.Hash != blockB.Hash {
+		if blockB.Height < blockA.Height {
+			blockA, err = dag.GetBlockByHash(blockA.ParentHash)
+		} else {
+			blockB, err = dag.GetBlockByHash(blockB.ParentHash)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if blockA == nil || blockB == nil {
+		return nil, fmt.Errorf("No common ancestor found.")
+	}
+
+	return blockA, nil
+}
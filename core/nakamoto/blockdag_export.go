@@ -0,0 +1,158 @@
+package nakamoto
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The block DAG can be exported as a graph for visualisation. This is useful for understanding fork behaviour during
+// testing and simulated attacks, where multiple competing branches exist at once.
+//
+// Two formats are supported:
+// - GraphViz DOT, which can be rendered with `dot -Tsvg dag.dot > dag.svg`.
+// - JSON, which can be consumed by web frontends.
+
+// A node in the exported block DAG graph.
+type DAGGraphNode struct {
+	Hash            string `json:"hash"`
+	ParentHash      string `json:"parentHash"`
+	Height          uint64 `json:"height"`
+	AccumulatedWork string `json:"accumulatedWork"`
+	NumTransactions uint64 `json:"numTransactions"`
+	Timestamp       uint64 `json:"timestamp"`
+	// Whether the block is on the main chain (the chain ending at the full tip).
+	MainChain bool `json:"mainChain"`
+}
+
+// The exported block DAG graph.
+type DAGGraph struct {
+	HeadersTip string         `json:"headersTip"`
+	FullTip    string         `json:"fullTip"`
+	Nodes      []DAGGraphNode `json:"nodes"`
+}
+
+// Gets the graph of all blocks (across all branches) within `depth` blocks of the highest block in the DAG.
+func (dag *BlockDAG) GetDAGGraph(depth uint64) (DAGGraph, error) {
+	graph := DAGGraph{
+		HeadersTip: dag.HeadersTip.HashStr(),
+		FullTip:    dag.FullTip.HashStr(),
+		Nodes:      make([]DAGGraphNode, 0),
+	}
+
+	// Get the max height in the DAG.
+	maxHeight := uint64(0)
+	rows, err := dag.db.Query("select coalesce(max(height), 0) from blocks")
+	if err != nil {
+		return graph, err
+	}
+	if rows.Next() {
+		rows.Scan(&maxHeight)
+	}
+	rows.Close()
+
+	minHeight := uint64(0)
+	if depth < maxHeight {
+		minHeight = maxHeight - depth
+	}
+
+	// Get the main chain, so we can annotate nodes on it.
+	mainChain := make(map[[32]byte]bool)
+	if minHeight <= dag.FullTip.Height {
+		hashes, err := dag.GetLongestChainHashList(dag.FullTip.Hash, dag.FullTip.Height-minHeight+1)
+		if err != nil {
+			return graph, err
+		}
+		for _, hash := range hashes {
+			mainChain[hash] = true
+		}
+	}
+
+	// Get all blocks in range.
+	rows, err = dag.db.Query(
+		`select hash, parent_hash, difficulty, parent_total_work, timestamp, num_transactions, transactions_merkle_root, nonce, graffiti, height, epoch, size_bytes, acc_work, base_fee, version, history_root from blocks where height >= ? order by height asc`,
+		minHeight,
+	)
+	if err != nil {
+		return graph, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		block, err := scanBlock(rows)
+		if err != nil {
+			return graph, err
+		}
+
+		graph.Nodes = append(graph.Nodes, DAGGraphNode{
+			Hash:            block.HashStr(),
+			ParentHash:      Bytes32ToHexString(block.ParentHash),
+			Height:          block.Height,
+			AccumulatedWork: block.AccumulatedWork.String(),
+			NumTransactions: block.NumTransactions,
+			Timestamp:       block.Timestamp,
+			MainChain:       mainChain[block.Hash],
+		})
+	}
+
+	return graph, nil
+}
+
+// Exports the block DAG in GraphViz DOT format, including all branches within `depth` blocks of the highest block.
+// Blocks on the main chain are filled, and the tips are outlined.
+func (dag *BlockDAG) ExportDot(w io.Writer, depth uint64) error {
+	graph, err := dag.GetDAGGraph(depth)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "digraph blockdag {\n")
+	fmt.Fprintf(w, "\trankdir=LR;\n")
+	fmt.Fprintf(w, "\tnode [shape=box, fontname=\"monospace\"];\n")
+
+	known := make(map[string]bool)
+	for _, node := range graph.Nodes {
+		known[node.Hash] = true
+	}
+
+	for _, node := range graph.Nodes {
+		attrs := ""
+		if node.MainChain {
+			attrs += ", style=filled, fillcolor=lightblue"
+		}
+		if node.Hash == graph.FullTip || node.Hash == graph.HeadersTip {
+			attrs += ", penwidth=3"
+		}
+		fmt.Fprintf(
+			w,
+			"\t\"%s\" [label=\"%s\\nheight=%d\\nwork=%s\\ntxs=%d\"%s];\n",
+			node.Hash,
+			node.Hash[:8],
+			node.Height,
+			node.AccumulatedWork,
+			node.NumTransactions,
+			attrs,
+		)
+	}
+
+	// Edges point from parent to child. Skip parents outside of the exported window.
+	for _, node := range graph.Nodes {
+		if !known[node.ParentHash] {
+			continue
+		}
+		fmt.Fprintf(w, "\t\"%s\" -> \"%s\";\n", node.ParentHash, node.Hash)
+	}
+
+	_, err = fmt.Fprintf(w, "}\n")
+	return err
+}
+
+// Exports the block DAG in JSON format, including all branches within `depth` blocks of the highest block.
+func (dag *BlockDAG) ExportJSON(w io.Writer, depth uint64) error {
+	graph, err := dag.GetDAGGraph(depth)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(graph)
+}
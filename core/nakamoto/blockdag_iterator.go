@@ -0,0 +1,157 @@
+package nakamoto
+
+import (
+	"database/sql"
+)
+
+// Iterators stream rows from the block DAG's backing store one at a time, rather than materialising the entire
+// result set in memory. They are used by explorers and analytics tools which walk long stretches of the chain.
+//
+// Usage follows the same pattern as sql.Rows:
+//
+//	it, err := dag.IterateMainChain(0, 1000)
+//	if err != nil { ... }
+//	defer it.Close()
+//	for it.Next() {
+//		block := it.Block()
+//	}
+//	if err := it.Err(); err != nil { ... }
+//
+// NOTE: an iterator holds a database connection open until it is closed. Do not issue other queries on the DAG while
+// iterating if the database is limited to a single connection (ie. :memory: databases).
+
+// BlockIterator iterates over blocks.
+type BlockIterator struct {
+	rows  *sql.Rows
+	block Block
+	err   error
+}
+
+// Next advances the iterator to the next block. It returns false when there are no more blocks, or an error occurred.
+func (it *BlockIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.rows.Next() {
+		it.err = it.rows.Err()
+		return false
+	}
+	it.block, it.err = scanBlock(it.rows)
+	return it.err == nil
+}
+
+// Block returns the current block.
+func (it *BlockIterator) Block() Block {
+	return it.block
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (it *BlockIterator) Err() error {
+	return it.err
+}
+
+// Close closes the iterator, releasing the underlying database rows.
+func (it *BlockIterator) Close() error {
+	return it.rows.Close()
+}
+
+// TransactionIterator iterates over transactions.
+type TransactionIterator struct {
+	rows      *sql.Rows
+	blockhash [32]byte
+	tx        Transaction
+	err       error
+}
+
+// Next advances the iterator to the next transaction. It returns false when there are no more transactions, or an error occurred.
+func (it *TransactionIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.rows.Next() {
+		it.err = it.rows.Err()
+		return false
+	}
+	it.tx, it.err = scanTransaction(it.rows)
+	it.tx.Blockhash = it.blockhash
+	return it.err == nil
+}
+
+// Transaction returns the current transaction.
+func (it *TransactionIterator) Transaction() Transaction {
+	return it.tx
+}
+
+// Err returns the error, if any, that was encountered during iteration.
+func (it *TransactionIterator) Err() error {
+	return it.err
+}
+
+// Close closes the iterator, releasing the underlying database rows.
+func (it *TransactionIterator) Close() error {
+	return it.rows.Close()
+}
+
+// Iterates the blocks of the main chain (the chain ending at the full tip) from height `from` to height `to` inclusive,
+// in ascending order of height.
+func (dag *BlockDAG) IterateMainChain(from uint64, to uint64) (*BlockIterator, error) {
+	// Walk backwards from the tip to the `from` height, then filter to the requested range.
+	rows, err := dag.db.Query(`
+		WITH RECURSIVE main_chain AS (
+			SELECT hash, parent_hash, height
+			FROM blocks
+			WHERE hash = ?
+
+			UNION ALL
+
+			SELECT b.hash, b.parent_hash, b.height
+			FROM blocks b
+			INNER JOIN main_chain mc ON b.hash = mc.parent_hash
+			WHERE mc.height > ?
+		)
+		SELECT b.hash, b.parent_hash, b.difficulty, b.parent_total_work, b.timestamp, b.num_transactions, b.transactions_merkle_root, b.nonce, b.graffiti, b.height, b.epoch, b.size_bytes, b.acc_work, b.base_fee, b.version, b.history_root
+		FROM main_chain mc
+		JOIN blocks b ON b.hash = mc.hash
+		WHERE mc.height BETWEEN ? AND ?
+		ORDER BY mc.height ASC;`,
+		dag.FullTip.Hash[:],
+		from,
+		from,
+		to,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlockIterator{rows: rows}, nil
+}
+
+// Iterates the transactions of a block in order of their index in the block.
+func (dag *BlockDAG) IterateBlockTransactions(hash [32]byte) (*TransactionIterator, error) {
+	rows, err := dag.db.Query(`
+		SELECT txs.hash, txs.sig, txs.from_pubkey, txs.to_pubkey, txs.amount, txs.fee, txs.nonce, txblocks.txindex, txs.version, txs.predicate, txs.witness, txs.token_op, txs.token, txs.inputs
+		FROM transactions txs
+		JOIN transactions_blocks txblocks ON txs.hash = txblocks.transaction_hash
+		WHERE txblocks.block_hash = ?
+		ORDER BY txblocks.txindex ASC;
+	`, hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &TransactionIterator{rows: rows, blockhash: hash}, nil
+}
+
+// Gets the block of the main chain at a height, or nil if the main chain isn't that high.
+func (dag *BlockDAG) GetMainChainBlockAt(height uint64) (*Block, error) {
+	it, err := dag.IterateMainChain(height, height)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	if !it.Next() {
+		return nil, it.Err()
+	}
+	block := it.Block()
+	return &block, nil
+}
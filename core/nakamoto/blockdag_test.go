@@ -6,9 +6,11 @@ package nakamoto
 // - manages reading/writing to the backing SQLite database.
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"testing"
@@ -27,6 +29,18 @@ func newMockStateMachine() *MockStateMachine {
 func (m *MockStateMachine) VerifyTx(tx RawTransaction) error {
 	return nil
 }
+func (m *MockStateMachine) ExecuteBlock(block Block) error {
+	return nil
+}
+func (m *MockStateMachine) StateRoot() [32]byte {
+	return [32]byte{}
+}
+func (m *MockStateMachine) Snapshot() SnapshotID {
+	return 0
+}
+func (m *MockStateMachine) RevertTo(snapshot SnapshotID) error {
+	return nil
+}
 
 func newBlockdag() (BlockDAG, ConsensusConfig, *sql.DB, RawBlock) {
 	db, err := OpenDB(":memory:?journal_mode=WAL&synchronous=NORMAL&locking_mode=IMMEDIATE")
@@ -204,12 +218,14 @@ func TestDagAddBlockUnknownParent(t *testing.T) {
 	blockdag, _, _, _ := newBlockdag()
 
 	b := RawBlock{
-		ParentHash:             [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
-		Timestamp:              0,
-		NumTransactions:        0,
-		TransactionsMerkleRoot: [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
-		Nonce:                  [32]byte{0xBB},
-		Transactions:           []RawTransaction{},
+		BlockHeader: BlockHeader{
+			ParentHash:             [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
+			Timestamp:              0,
+			NumTransactions:        0,
+			TransactionsMerkleRoot: [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
+			Nonce:                  [32]byte{0xBB},
+		},
+		Transactions: []RawTransaction{},
 	}
 
 	err := blockdag.IngestBlock(b)
@@ -226,11 +242,13 @@ func TestDagAddBlockTxCount(t *testing.T) {
 	}
 
 	b := RawBlock{
-		ParentHash:             genesisBlock.Hash(),
-		Timestamp:              0,
-		NumTransactions:        0,
-		TransactionsMerkleRoot: [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
-		Nonce:                  [32]byte{0xBB},
+		BlockHeader: BlockHeader{
+			ParentHash:             genesisBlock.Hash(),
+			Timestamp:              0,
+			NumTransactions:        0,
+			TransactionsMerkleRoot: [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
+			Nonce:                  [32]byte{0xBB},
+		},
 		Transactions: []RawTransaction{
 			tx,
 		},
@@ -253,11 +271,13 @@ func TestDagAddBlockTxsValid(t *testing.T) {
 	tx.Sig = [64]byte{0xCA, 0xFE, 0xBA, 0xBE}
 
 	b := RawBlock{
-		ParentHash:             genesisBlock.Hash(),
-		Timestamp:              0,
-		NumTransactions:        1,
-		TransactionsMerkleRoot: [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
-		Nonce:                  [32]byte{0xBB},
+		BlockHeader: BlockHeader{
+			ParentHash:             genesisBlock.Hash(),
+			Timestamp:              0,
+			NumTransactions:        1,
+			TransactionsMerkleRoot: [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
+			Nonce:                  [32]byte{0xBB},
+		},
 		Transactions: []RawTransaction{
 			tx,
 		},
@@ -277,11 +297,13 @@ func TestDagAddBlockTxMerkleRootValid(t *testing.T) {
 	}
 
 	b := RawBlock{
-		ParentHash:             genesisBlock.Hash(),
-		Timestamp:              0,
-		NumTransactions:        1,
-		TransactionsMerkleRoot: [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
-		Nonce:                  [32]byte{0xBB},
+		BlockHeader: BlockHeader{
+			ParentHash:             genesisBlock.Hash(),
+			Timestamp:              0,
+			NumTransactions:        1,
+			TransactionsMerkleRoot: [32]byte{0xCA, 0xFE, 0xBA, 0xBE},
+			Nonce:                  [32]byte{0xBB},
+		},
 		Transactions: []RawTransaction{
 			tx,
 		},
@@ -322,13 +344,15 @@ func TestDagAddBlockSuccess(t *testing.T) {
 	copy(tx.Sig[:], sigBytes)
 
 	b := RawBlock{
-		ParentHash:             genesisBlock.Hash(),
-		ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
-		Timestamp:              1719379532750,
-		NumTransactions:        1,
-		TransactionsMerkleRoot: [32]byte{},
-		Nonce:                  [32]byte{},
-		Graffiti:               [32]byte{},
+		BlockHeader: BlockHeader{
+			ParentHash:             genesisBlock.Hash(),
+			ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
+			Timestamp:              1719379532750,
+			NumTransactions:        1,
+			TransactionsMerkleRoot: [32]byte{},
+			Nonce:                  [32]byte{},
+			Graffiti:               [32]byte{},
+		},
 		Transactions: []RawTransaction{
 			tx,
 		},
@@ -368,12 +392,14 @@ func TestDagAddBlockWithDynamicSignature(t *testing.T) {
 	t.Logf("Signature: %s\n", hex.EncodeToString(tx.Sig[:]))
 
 	b := RawBlock{
-		ParentHash:             genesisBlock.Hash(),
-		ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
-		Timestamp:              1719379532750,
-		NumTransactions:        1,
-		TransactionsMerkleRoot: [32]byte{},
-		Nonce:                  [32]byte{},
+		BlockHeader: BlockHeader{
+			ParentHash:             genesisBlock.Hash(),
+			ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
+			Timestamp:              1719379532750,
+			NumTransactions:        1,
+			TransactionsMerkleRoot: [32]byte{},
+			Nonce:                  [32]byte{},
+		},
 		Transactions: []RawTransaction{
 			tx,
 		},
@@ -558,12 +584,14 @@ func TestDagGetEpochForBlockHashNewBlock(t *testing.T) {
 	}
 
 	raw := RawBlock{
-		ParentHash:             genesisBlock.Hash(),
-		ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
-		Timestamp:              1719379532750,
-		NumTransactions:        1,
-		TransactionsMerkleRoot: [32]byte{},
-		Nonce:                  [32]byte{},
+		BlockHeader: BlockHeader{
+			ParentHash:             genesisBlock.Hash(),
+			ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
+			Timestamp:              1719379532750,
+			NumTransactions:        1,
+			TransactionsMerkleRoot: [32]byte{},
+			Nonce:                  [32]byte{},
+		},
 		Transactions: []RawTransaction{
 			tx,
 		},
@@ -618,12 +646,14 @@ func TestDagGetLatestTip(t *testing.T) {
 
 	// Construct block template for mining.
 	raw := RawBlock{
-		ParentHash:             current_tip.Hash,
-		ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
-		Timestamp:              Timestamp(),
-		NumTransactions:        1,
-		TransactionsMerkleRoot: [32]byte{},
-		Nonce:                  [32]byte{},
+		BlockHeader: BlockHeader{
+			ParentHash:             current_tip.Hash,
+			ParentTotalWork:        BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
+			Timestamp:              Timestamp(),
+			NumTransactions:        1,
+			TransactionsMerkleRoot: [32]byte{},
+			Nonce:                  [32]byte{},
+		},
 		Transactions: []RawTransaction{
 			tx,
 		},
@@ -684,12 +714,14 @@ func TestMinerProcedural(t *testing.T) {
 
 		// Construct block template for mining.
 		raw := RawBlock{
-			ParentHash:             current_tip,
-			ParentTotalWork:        BigIntToBytes32(acc_work),
-			Timestamp:              Timestamp(),
-			NumTransactions:        1,
-			TransactionsMerkleRoot: [32]byte{},
-			Nonce:                  [32]byte{},
+			BlockHeader: BlockHeader{
+				ParentHash:             current_tip,
+				ParentTotalWork:        BigIntToBytes32(acc_work),
+				Timestamp:              Timestamp(),
+				NumTransactions:        1,
+				TransactionsMerkleRoot: [32]byte{},
+				Nonce:                  [32]byte{},
+			},
 			Transactions: []RawTransaction{
 				tx,
 			},
@@ -778,6 +810,32 @@ func newBlockdagLongEpoch() (BlockDAG, ConsensusConfig, *sql.DB) {
 	return blockdag, conf, db
 }
 
+func TestDagOnNewFullTipCalledOncePerTip(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+
+	tips := [][32]byte{}
+	dag.OnNewFullTip = func(tip Block, prevTip Block) {
+		tips = append(tips, tip.Hash)
+	}
+
+	hashes := [][32]byte{}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+	miner.Start(3)
+	assert.Equal(hashes, tips)
+}
+
 // 2s to mine 10,000 blocks.
 func TestDagGetLongestChainHashList(t *testing.T) {
 	assert := assert.New(t)
@@ -832,3 +890,477 @@ func TestDagGetLongestChainHashList(t *testing.T) {
 	}
 
 }
+
+func TestDagIterateMainChain(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+
+	// Mine 20 blocks.
+	expectedHashList := [][32]byte{dag.FullTip.Hash}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+		expectedHashList = append(expectedHashList, block.Hash())
+	}
+	miner.Start(20)
+
+	// Iterate heights 5..10.
+	it, err := dag.IterateMainChain(5, 10)
+	if err != nil {
+		t.Fatalf("Failed to iterate main chain: %s", err)
+	}
+	heights := []uint64{}
+	for it.Next() {
+		block := it.Block()
+		assert.Equal(expectedHashList[block.Height], block.Hash)
+		heights = append(heights, block.Height)
+	}
+	assert.Nil(it.Err())
+	assert.Nil(it.Close())
+	assert.Equal([]uint64{5, 6, 7, 8, 9, 10}, heights)
+
+	// Iterate the transactions of the tip.
+	txIt, err := dag.IterateBlockTransactions(dag.FullTip.Hash)
+	if err != nil {
+		t.Fatalf("Failed to iterate block transactions: %s", err)
+	}
+	numTxs := 0
+	for txIt.Next() {
+		tx := txIt.Transaction()
+		assert.Equal(uint64(numTxs), tx.TxIndex)
+		assert.Equal(dag.FullTip.Hash, tx.Blockhash)
+		assert.Equal(minerWallet.PubkeyBytes(), tx.ToPubkey)
+		numTxs += 1
+	}
+	assert.Nil(txIt.Err())
+	assert.Nil(txIt.Close())
+	assert.Equal(1, numTxs)
+}
+
+func TestDagGetBlocksByHashes(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+
+	hashes := [][32]byte{}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+	miner.Start(3)
+
+	// Blocks are returned in the requested order, with nil for unknown blocks.
+	unknown := [32]byte{0xca, 0xfe}
+	blocks, err := dag.GetBlocksByHashes([][32]byte{hashes[2], unknown, hashes[0]})
+	if err != nil {
+		t.Fatalf("Failed to get blocks: %s", err)
+	}
+	assert.Equal(3, len(blocks))
+	assert.Equal(hashes[2], blocks[0].Hash)
+	assert.Nil(blocks[1])
+	assert.Equal(hashes[0], blocks[2].Hash)
+	assert.Equal(uint64(1), blocks[2].Height)
+
+	blocks, err = dag.GetBlocksByHashes([][32]byte{})
+	assert.Nil(err)
+	assert.Equal(0, len(blocks))
+}
+
+// Mines a block on the miner's tip, with a hash in [minHash, target). The work of a block depends on its hash, so
+// this bounds the block's work, for tests which need to know in advance which of two branches is heavier.
+func mineBlockInWorkBand(t *testing.T, miner *Miner, minHash *big.Int) RawBlock {
+	puzzle := miner.MakeNewPuzzle()
+	block := *puzzle.block
+	nonce := big.NewInt(0)
+	for {
+		nonce.Add(nonce, big.NewInt(1))
+		block.SetNonce(*nonce)
+		h := block.Hash()
+		hash := new(big.Int).SetBytes(h[:])
+		if hash.Cmp(&puzzle.target) < 0 && minHash.Cmp(hash) <= 0 {
+			return block
+		}
+		if nonce.Cmp(big.NewInt(100_000_000)) > 0 {
+			t.Fatalf("Failed to find a solution in the work band")
+		}
+	}
+}
+
+func TestDagInvalidateReconsiderBlock(t *testing.T) {
+	assert := assert.New(t)
+	dag, conf, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+
+	// The difficulty is fixed for the epoch, at a target just under 2^252. Every block is mined with a hash in
+	// [2^251, 2^252), so its work is between 16 and 32.
+	assert.Equal(252, conf.GenesisDifficulty.BitLen())
+	minHash := new(big.Int).Lsh(big.NewInt(1), 251)
+
+	hashes := [][32]byte{dag.FullTip.Hash}
+	miner := NewMiner(dag, minerWallet)
+	mine := func() {
+		block := mineBlockInWorkBand(t, miner, minHash)
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+	for i := 0; i < 5; i++ {
+		mine()
+	}
+	assert.Equal(uint64(5), dag.FullTip.Height)
+
+	// The genesis block cannot be invalidated.
+	assert.NotNil(dag.InvalidateBlock(hashes[0]))
+
+	// Invalidating block 3 reorgs to block 2.
+	assert.Nil(dag.InvalidateBlock(hashes[3]))
+	assert.Equal(hashes[2], dag.FullTip.Hash)
+	assert.Equal(hashes[2], dag.HeadersTip.Hash)
+
+	// Mine a fork on block 2. The fork is valid, and becomes the tip.
+	mine()
+	assert.Equal(uint64(3), dag.FullTip.Height)
+	assert.Equal(hashes[6], dag.FullTip.Hash)
+
+	// Reconsidering block 3 reorgs back to the original chain. Blocks 3-5 have at least 48 work, and the fork's
+	// block 6 has at most 32, so the original chain is heavier.
+	assert.Nil(dag.ReconsiderBlock(hashes[3]))
+	assert.Equal(hashes[5], dag.FullTip.Hash)
+	assert.Equal(hashes[5], dag.HeadersTip.Hash)
+}
+
+func TestDagIsTransactionInMainChain(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+
+	blocks := []RawBlock{}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+		blocks = append(blocks, block)
+	}
+	miner.Start(3)
+
+	coinbase := blocks[0].Transactions[0].Hash()
+	confirmed, err := dag.IsTransactionInMainChain(coinbase)
+	assert.Nil(err)
+	assert.True(confirmed)
+
+	// Unknown transaction.
+	confirmed, err = dag.IsTransactionInMainChain([32]byte{0xca, 0xfe})
+	assert.Nil(err)
+	assert.False(confirmed)
+
+	// Transactions in blocks which have been reorged out are not in the main chain.
+	assert.Nil(dag.InvalidateBlock(blocks[0].Hash()))
+	confirmed, err = dag.IsTransactionInMainChain(coinbase)
+	assert.Nil(err)
+	assert.False(confirmed)
+}
+
+func TestDagGetTransactionByHash(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	// Mine each block with a different wallet, so the coinbases differ.
+	blocks := []RawBlock{}
+	for i := 0; i < 3; i++ {
+		minerWallet, err := core.CreateRandomWallet()
+		if err != nil {
+			t.Fatalf("Failed to create miner wallet: %s", err)
+		}
+		miner := NewMiner(dag, minerWallet)
+		miner.OnBlockSolution = func(block RawBlock) {
+			err := dag.IngestBlock(block)
+			if err != nil {
+				t.Fatalf("Failed to ingest block: %s", err)
+			}
+			blocks = append(blocks, block)
+		}
+		miner.Start(1)
+	}
+
+	coinbase := blocks[1].Transactions[0]
+	tx, err := dag.GetTransactionByHash(coinbase.Hash())
+	assert.Nil(err)
+	assert.NotNil(tx)
+	assert.Equal(coinbase, tx.ToRawTransaction())
+	assert.Equal(coinbase.Hash(), tx.Hash)
+	assert.Equal(blocks[1].Hash(), tx.Blockhash)
+	assert.Equal(uint64(0), tx.TxIndex)
+
+	location, err := dag.GetTransactionLocation(coinbase.Hash())
+	assert.Nil(err)
+	assert.Equal(TxLocation{BlockHash: blocks[1].Hash(), Height: 2, TxIndex: 0}, *location)
+
+	// Unknown transaction.
+	tx, err = dag.GetTransactionByHash([32]byte{0xca, 0xfe})
+	assert.Nil(err)
+	assert.Nil(tx)
+
+	// Transactions in blocks which have been reorged out aren't found.
+	assert.Nil(dag.InvalidateBlock(blocks[1].Hash()))
+	tx, err = dag.GetTransactionByHash(coinbase.Hash())
+	assert.Nil(err)
+	assert.Nil(tx)
+}
+
+func TestDagGetBlockConfirmations(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	blocks := []RawBlock{}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+		blocks = append(blocks, block)
+	}
+	miner.Start(3)
+
+	for i, raw := range blocks {
+		block, err := dag.GetBlockByHash(raw.Hash())
+		assert.Nil(err)
+		confirmations, err := dag.GetBlockConfirmations(*block)
+		assert.Nil(err)
+		assert.Equal(uint64(len(blocks)-i), confirmations)
+	}
+
+	// Blocks which have been reorged out have no confirmations.
+	block, err := dag.GetBlockByHash(blocks[1].Hash())
+	assert.Nil(err)
+	assert.Nil(dag.InvalidateBlock(blocks[1].Hash()))
+	confirmations, err := dag.GetBlockConfirmations(*block)
+	assert.Nil(err)
+	assert.Equal(uint64(0), confirmations)
+}
+
+func TestDagExportDot(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+	miner.Start(5)
+
+	// Export the 3 most recent blocks.
+	graph, err := dag.GetDAGGraph(2)
+	if err != nil {
+		t.Fatalf("Failed to get DAG graph: %s", err)
+	}
+	assert.Equal(3, len(graph.Nodes))
+	for _, node := range graph.Nodes {
+		assert.True(node.MainChain)
+	}
+	assert.Equal(dag.FullTip.HashStr(), graph.Nodes[2].Hash)
+
+	buf := new(bytes.Buffer)
+	err = dag.ExportDot(buf, 2)
+	assert.Nil(err)
+	assert.Contains(buf.String(), "digraph blockdag {")
+	assert.Contains(buf.String(), fmt.Sprintf("\"%s\" -> \"%s\";", graph.Nodes[1].Hash, graph.Nodes[2].Hash))
+
+	buf.Reset()
+	err = dag.ExportJSON(buf, 2)
+	assert.Nil(err)
+	var graph2 DAGGraph
+	assert.Nil(json.Unmarshal(buf.Bytes(), &graph2))
+	assert.Equal(graph, graph2)
+}
+
+func TestDagPrecheckBlockPOW(t *testing.T) {
+	assert := assert.New(t)
+	blockdag, _, _, genesisBlock := newBlockdag()
+
+	b := RawBlock{
+		BlockHeader: BlockHeader{
+			ParentHash:      genesisBlock.Hash(),
+			ParentTotalWork: BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(genesisBlock.Hash()))),
+			Timestamp:       1719379532750,
+		},
+	}
+	epoch, err := blockdag.GetEpochForBlockHash(b.ParentHash)
+	if err != nil {
+		t.Fatalf("Failed to get epoch for block hash: %s", err)
+	}
+
+	// Find a nonce which doesn't solve the POW puzzle.
+	for i := int64(0); VerifyPOW(b.Hash(), epoch.Difficulty); i++ {
+		b.SetNonce(*big.NewInt(i))
+	}
+	assert.Equal(ErrBlockPOWInvalid, blockdag.PrecheckBlockPOW(b))
+
+	// And one which does.
+	solution, err := SolvePOW(b, *big.NewInt(0), epoch.Difficulty, 1000000000000)
+	if err != nil {
+		t.Fatalf("Failed to solve POW: %s", err)
+	}
+	b.SetNonce(solution)
+	assert.Nil(blockdag.PrecheckBlockPOW(b))
+
+	// Blocks with an unknown parent can't be checked.
+	b.ParentHash = [32]byte{0xca, 0xfe}
+	assert.Nil(blockdag.PrecheckBlockPOW(b))
+}
+
+func TestDagPrecheckTransaction(t *testing.T) {
+	assert := assert.New(t)
+	blockdag, _, _, _ := newBlockdag()
+	stateMachine, err := NewStateMachine(nil)
+	assert.Nil(err)
+	blockdag.stateMachine = stateMachine
+
+	tx, err := newValidTx(t)
+	assert.Nil(err)
+	assert.Nil(blockdag.PrecheckTransaction(tx))
+
+	// Transactions with an invalid signature.
+	forged := tx
+	forged.Amount = 1
+	assert.Equal(ErrInvalidSignature, blockdag.PrecheckTransaction(forged))
+
+	// Of an unsupported version.
+	unsupported := tx
+	unsupported.Version = 99
+	assert.Equal(ErrUnsupportedTxVersion, blockdag.PrecheckTransaction(unsupported))
+
+	// And which couldn't fit in a block.
+	blockdag.consensus.MaxBlockSizeBytes = tx.EncodedSizeBytes() - 1
+	assert.Equal(ErrTxTooLarge, blockdag.PrecheckTransaction(tx))
+}
+
+func TestDagGetEpochs(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForStateMachine()
+	wallets := getTestingWallets(t)
+	miner := NewMiner(dag, &wallets[0])
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	miner.Start(12)
+	assert.Equal(uint64(12), dag.FullTip.Height)
+
+	// Epochs start every 5 blocks, and are listed latest first.
+	epochs, err := dag.GetEpochs(10, 0)
+	assert.Nil(err)
+	assert.Equal(3, len(epochs))
+	for i, epoch := range epochs {
+		assert.Equal(uint64(2-i), epoch.Number)
+		assert.Equal(uint64(10-5*i), epoch.StartHeight)
+	}
+	assert.Equal(1.0, epochs[2].RetargetRatio)
+	assert.Equal(dag.FullTip.Timestamp-epochs[0].StartTime, epochs[0].Timespan)
+	assert.Equal(epochs[0].StartTime-epochs[1].StartTime, epochs[1].Timespan)
+
+	// The retarget ratio is the change in difficulty.
+	ratio, _ := new(big.Float).Quo(new(big.Float).SetInt(&epochs[1].Difficulty), new(big.Float).SetInt(&epochs[2].Difficulty)).Float64()
+	assert.Equal(ratio, epochs[1].RetargetRatio)
+
+	// Paging.
+	page, err := dag.GetEpochs(1, 1)
+	assert.Nil(err)
+	assert.Equal(epochs[1:2], page)
+	page, err = dag.GetEpochs(5, 3)
+	assert.Nil(err)
+	assert.Empty(page)
+
+	// The difficulty of a block is that of its epoch.
+	difficulty, err := dag.GetDifficultyAt(7)
+	assert.Nil(err)
+	assert.Equal(epochs[1].Difficulty, difficulty)
+	difficulty, err = dag.GetDifficultyAt(12)
+	assert.Nil(err)
+	assert.Equal(epochs[0].Difficulty, difficulty)
+	block, err := dag.GetBlockByHash(dag.FullTip.Hash)
+	assert.Nil(err)
+	assert.Equal(epochs[0].Id, block.Epoch)
+	_, err = dag.GetDifficultyAt(13)
+	assert.NotNil(err)
+}
+
+func TestDagCheckBlock(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	blocks := []RawBlock{}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		blocks = append(blocks, block)
+	}
+	miner.Start(1)
+	raw := blocks[0]
+
+	// A valid block passes, and isn't stored.
+	assert.Nil(dag.CheckBlock(raw))
+	assert.False(dag.HasBlock(raw.Hash()))
+	assert.Equal(uint64(0), dag.FullTip.Height)
+
+	// A template doesn't need a POW solution.
+	template := raw
+	for i := 0; i < 256 && dag.CheckBlock(template) == nil; i++ {
+		template.Nonce[0] = byte(i)
+	}
+	assert.EqualError(dag.CheckBlock(template), "POW solution is invalid.")
+	assert.Nil(dag.CheckBlockTemplate(template))
+
+	// But must otherwise be valid.
+	template.NumTransactions++
+	assert.NotNil(dag.CheckBlockTemplate(template))
+	unknownParent := raw
+	unknownParent.ParentHash = [32]byte{1}
+	assert.EqualError(dag.CheckBlock(unknownParent), "Unknown parent block.")
+
+	assert.Nil(dag.IngestBlock(raw))
+	assert.Equal(raw.Hash(), dag.FullTip.Hash)
+}
@@ -0,0 +1,303 @@
+package nakamoto
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"sort"
+)
+
+// Compact block filters let light wallets find the blocks relevant to them without revealing their addresses, in the
+// style of BIP158. A full node builds a filter for each block over the pubkeys involved in its transactions (senders and
+// recipients), and serves them to peers. A wallet downloads the filters, matches them locally against its own pubkeys,
+// and only downloads the blocks which match - from any peer, so no single server learns which blocks it wants.
+//
+// The filter is a Golomb-coded set. Each of the N items is hashed, keyed by the block hash, to a number in [0, N*M),
+// and the sorted numbers are encoded as Golomb-Rice coded deltas with parameter P. Matching an item which isn't in the
+// block gives a false positive with probability 1/M, so wallets download some irrelevant blocks, which also helps hide
+// the relevant ones. BIP158 keys the hash with SipHash; we use SHA256, as elsewhere.
+//
+//	filter = number of items (u32) || Golomb-Rice coded deltas
+//
+// Filters are built from the block's transactions the first time they're requested, and stored.
+
+const (
+	// The Golomb-Rice coding parameter, and the inverse of the false positive rate, from BIP158.
+	BLOCK_FILTER_P = 19
+	BLOCK_FILTER_M = 784931
+
+	// The maximum number of filters in a get_block_filters reply.
+	MAX_BLOCK_FILTERS = 1000
+)
+
+// The filter of a block.
+type BlockFilter struct {
+	Height    uint64   `json:"height"`
+	BlockHash [32]byte `json:"blockHash"`
+	Filter    []byte   `json:"filter"`
+}
+
+// get_block_filters
+type GetBlockFiltersMessage struct {
+	Type       string `json:"type"` // "get_block_filters"
+	FromHeight uint64 `json:"fromHeight"`
+	Count      uint64 `json:"count"`
+}
+
+type GetBlockFiltersReply struct {
+	Type    string        `json:"type"` // "get_block_filters_reply"
+	Filters []BlockFilter `json:"filters"`
+}
+
+// Returns the items a block's filter is built over: the non-empty pubkeys sending and receiving its transactions,
+// without duplicates.
+func BlockFilterItems(txs []RawTransaction) [][]byte {
+	seen := map[[65]byte]bool{}
+	items := [][]byte{}
+	for _, tx := range txs {
+		for _, pubkey := range [][65]byte{tx.FromPubkey, tx.ToPubkey} {
+			if pubkey == [65]byte{} || seen[pubkey] {
+				continue
+			}
+			seen[pubkey] = true
+			items = append(items, append([]byte{}, pubkey[:]...))
+		}
+	}
+	return items
+}
+
+// Builds the filter of a block.
+func BuildBlockFilter(blockHash [32]byte, txs []RawTransaction) []byte {
+	items := BlockFilterItems(txs)
+	n := uint64(len(items))
+	values := hashBlockFilterItems(blockHash, items, n)
+
+	w := &bitWriter{}
+	last := uint64(0)
+	for _, value := range values {
+		delta := value - last
+		last = value
+		// The quotient in unary, then the remainder in P bits.
+		for q := delta >> BLOCK_FILTER_P; 0 < q; q-- {
+			w.writeBit(1)
+		}
+		w.writeBit(0)
+		w.writeBits(delta, BLOCK_FILTER_P)
+	}
+
+	filter := binary.BigEndian.AppendUint32(nil, uint32(n))
+	return append(filter, w.buf...)
+}
+
+// Returns whether any of the items may be in the block. False positives happen with probability 1/M for each item.
+func (f BlockFilter) MatchAny(items [][]byte) (bool, error) {
+	if len(f.Filter) < 4 {
+		return false, fmt.Errorf("Block filter too short.")
+	}
+	n := uint64(binary.BigEndian.Uint32(f.Filter))
+	if n == 0 || len(items) == 0 {
+		return false, nil
+	}
+	targets := hashBlockFilterItems(f.BlockHash, items, n)
+
+	// Walk the filter's values and the targets together, both ascending.
+	r := &bitReader{buf: f.Filter[4:]}
+	value := uint64(0)
+	t := 0
+	for i := uint64(0); i < n; i++ {
+		q := uint64(0)
+		for {
+			bit, err := r.readBit()
+			if err != nil {
+				return false, err
+			}
+			if bit == 0 {
+				break
+			}
+			q++
+		}
+		remainder, err := r.readBits(BLOCK_FILTER_P)
+		if err != nil {
+			return false, err
+		}
+		value += q<<BLOCK_FILTER_P | remainder
+
+		for t < len(targets) && targets[t] < value {
+			t++
+		}
+		if t == len(targets) {
+			return false, nil
+		}
+		if targets[t] == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Hashes items to numbers in [0, n*M), sorted.
+func hashBlockFilterItems(blockHash [32]byte, items [][]byte, n uint64) []uint64 {
+	f := n * BLOCK_FILTER_M
+	values := make([]uint64, len(items))
+	for i, item := range items {
+		h := sha256.New()
+		h.Write(blockHash[:])
+		h.Write(item)
+		hash := binary.BigEndian.Uint64(h.Sum(nil))
+		// Map the hash to [0, f) by multiplying and taking the high bits, which is fairer than a modulo.
+		values[i], _ = bits.Mul64(hash, f)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	return values
+}
+
+// Returns the blocks whose filters match any of the pubkeys.
+func MatchBlockFilters(filters []BlockFilter, pubkeys [][65]byte) ([][32]byte, error) {
+	items := [][]byte{}
+	for _, pubkey := range pubkeys {
+		items = append(items, append([]byte{}, pubkey[:]...))
+	}
+	matches := [][32]byte{}
+	for _, filter := range filters {
+		match, err := filter.MatchAny(items)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid filter for block %x: %s", filter.BlockHash, err)
+		}
+		if match {
+			matches = append(matches, filter.BlockHash)
+		}
+	}
+	return matches, nil
+}
+
+type bitWriter struct {
+	buf []byte
+	// The number of bits used in the last byte.
+	used uint8
+}
+
+func (w *bitWriter) writeBit(bit uint64) {
+	if w.used == 0 || w.used == 8 {
+		w.buf = append(w.buf, 0)
+		w.used = 0
+	}
+	if bit != 0 {
+		w.buf[len(w.buf)-1] |= 0x80 >> w.used
+	}
+	w.used++
+}
+
+// Writes the low n bits of v, most significant first.
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; 0 <= i; i-- {
+		w.writeBit((v >> i) & 1)
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos uint64
+}
+
+func (r *bitReader) readBit() (uint64, error) {
+	if uint64(len(r.buf))*8 <= r.pos {
+		return 0, fmt.Errorf("Unexpected end of block filter.")
+	}
+	bit := uint64(r.buf[r.pos/8]>>(7-r.pos%8)) & 1
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	v := uint64(0)
+	for i := 0; i < n; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | bit
+	}
+	return v, nil
+}
+
+// The block DAG.
+// =====================================================================================================================
+
+// Gets the filter of a block, building and storing it if it hasn't been built.
+func (dag *BlockDAG) GetBlockFilter(hash [32]byte) ([]byte, error) {
+	filter := []byte{}
+	err := dag.db.QueryRow("select filter from block_filters where block_hash = ?", hash[:]).Scan(&filter)
+	if err == nil {
+		return filter, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	block, err := dag.GetBlockByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("Block not found.")
+	}
+	txs, err := dag.GetBlockTransactions(hash)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(*txs)) != block.NumTransactions {
+		return nil, fmt.Errorf("Block body not downloaded.")
+	}
+	raws := []RawTransaction{}
+	for _, tx := range *txs {
+		raws = append(raws, tx.ToRawTransaction())
+	}
+
+	filter = BuildBlockFilter(hash, raws)
+	_, err = dag.db.Exec("insert or ignore into block_filters (block_hash, filter) values (?, ?)", hash[:], filter)
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+// Gets the filters of up to count blocks of the main chain, starting at fromHeight.
+func (dag *BlockDAG) GetBlockFilters(fromHeight uint64, count uint64) ([]BlockFilter, error) {
+	if count == 0 || MAX_BLOCK_FILTERS < count {
+		return nil, fmt.Errorf("Count must be between 1 and %d.", MAX_BLOCK_FILTERS)
+	}
+	tip := dag.FullTip
+	if tip.Height < fromHeight {
+		return []BlockFilter{}, nil
+	}
+	toHeight := fromHeight + count - 1
+	if tip.Height < toHeight {
+		toHeight = tip.Height
+	}
+
+	// Read the blocks first, since building the filters queries the database.
+	it, err := dag.IterateMainChain(fromHeight, toHeight)
+	if err != nil {
+		return nil, err
+	}
+	filters := []BlockFilter{}
+	for it.Next() {
+		block := it.Block()
+		filters = append(filters, BlockFilter{Height: block.Height, BlockHash: block.Hash})
+	}
+	err = it.Err()
+	it.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range filters {
+		filters[i].Filter, err = dag.GetBlockFilter(filters[i].BlockHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return filters, nil
+}
@@ -0,0 +1,112 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	txs := []RawTransaction{}
+	for i := 0; i < 20; i++ {
+		wallet, err := core.CreateRandomWallet()
+		assert.Nil(err)
+		txs = append(txs, MakeTransferTx(wallets[0].PubkeyBytes(), wallet.PubkeyBytes(), 1, &wallets[0], uint64(i)))
+	}
+	items := BlockFilterItems(txs)
+	assert.Equal(21, len(items))
+
+	blockHash := [32]byte{1}
+	filter := BlockFilter{BlockHash: blockHash, Filter: BuildBlockFilter(blockHash, txs)}
+
+	// Every item matches.
+	for _, item := range items {
+		match, err := filter.MatchAny([][]byte{item})
+		assert.Nil(err)
+		assert.True(match)
+	}
+
+	// Other pubkeys don't, except for rare false positives.
+	others := [][]byte{}
+	for i := 0; i < 100; i++ {
+		wallet, err := core.CreateRandomWallet()
+		assert.Nil(err)
+		pubkey := wallet.PubkeyBytes()
+		others = append(others, pubkey[:])
+	}
+	match, err := filter.MatchAny(others)
+	assert.Nil(err)
+	assert.False(match)
+	match, err = filter.MatchAny(append(others, items[5]))
+	assert.Nil(err)
+	assert.True(match)
+
+	// The filter is keyed by the block hash.
+	filter.BlockHash = [32]byte{2}
+	match, err = filter.MatchAny(items)
+	assert.Nil(err)
+	assert.False(match)
+
+	// Empty and truncated filters.
+	empty := BlockFilter{BlockHash: blockHash, Filter: BuildBlockFilter(blockHash, []RawTransaction{})}
+	match, err = empty.MatchAny(items)
+	assert.Nil(err)
+	assert.False(match)
+	truncated := BlockFilter{BlockHash: blockHash, Filter: BuildBlockFilter(blockHash, txs)[:10]}
+	_, err = truncated.MatchAny(others)
+	assert.EqualError(err, "Unexpected end of block filter.")
+}
+
+func TestDagBlockFilters(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+	miner.Start(5)
+
+	filters, err := dag.GetBlockFilters(0, 10)
+	assert.Nil(err)
+	assert.Equal(6, len(filters))
+	assert.Equal(uint64(5), filters[5].Height)
+	assert.Equal(dag.FullTip.Hash, filters[5].BlockHash)
+
+	// The wallet finds the blocks paying it.
+	matches, err := MatchBlockFilters(filters, [][65]byte{minerWallet.PubkeyBytes()})
+	assert.Nil(err)
+	assert.Equal(5, len(matches))
+	for i, hash := range matches {
+		assert.Equal(filters[i+1].BlockHash, hash)
+	}
+	other, err := core.CreateRandomWallet()
+	assert.Nil(err)
+	matches, err = MatchBlockFilters(filters, [][65]byte{other.PubkeyBytes()})
+	assert.Nil(err)
+	assert.Equal(0, len(matches))
+
+	// Filters are stored once built.
+	filter, err := dag.GetBlockFilter(dag.FullTip.Hash)
+	assert.Nil(err)
+	assert.Equal(filters[5].Filter, filter)
+	count := 0
+	assert.Nil(dag.db.QueryRow("select count(*) from block_filters").Scan(&count))
+	assert.Equal(6, count)
+
+	_, err = dag.GetBlockFilters(0, 0)
+	assert.NotNil(err)
+	filters, err = dag.GetBlockFilters(100, 10)
+	assert.Nil(err)
+	assert.Equal(0, len(filters))
+}
@@ -0,0 +1,111 @@
+package nakamoto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Bandwidth-constrained peers, such as mobile wallets and SPV clients, can send a bloom filter over the pubkeys they're
+// interested in with their heartbeat. Full nodes then only relay them unconfirmed transactions sent to or from a
+// matching pubkey, rather than every transaction in the network.
+//
+// The privacy tradeoff: the filter tells the full node which addresses the peer is interested in, up to the filter's
+// false positives. A filter with a higher false positive rate matches more unrelated transactions, hiding the peer's
+// addresses among them, at the cost of bandwidth. A full node which collects a peer's filters over time, or across
+// connections, can still narrow down its addresses. Peers which need privacy shouldn't use a filter.
+//
+// The filter hashes each element with a per-filter tweak, so filters from different peers don't share false positives.
+
+const (
+	// The maximum size of a bloom filter, in bytes.
+	MAX_BLOOM_FILTER_BYTES = 36_000
+	// The maximum number of hash functions of a bloom filter.
+	MAX_BLOOM_FILTER_HASHES = 50
+)
+
+type BloomFilter struct {
+	Bits      []byte `json:"bits"`
+	NumHashes uint32 `json:"numHashes"`
+	Tweak     uint32 `json:"tweak"`
+}
+
+// Creates an empty bloom filter sized for n elements with the given false positive rate, within the maximum size.
+func NewBloomFilter(n int, fpRate float64) *BloomFilter {
+	n = max(n, 1)
+	fpRate = min(max(fpRate, 1e-9), 1)
+	numBits := -float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)
+	numBytes := min(max(int(math.Ceil(numBits/8)), 1), MAX_BLOOM_FILTER_BYTES)
+	numHashes := uint32(float64(numBytes*8) / float64(n) * math.Ln2)
+	numHashes = min(max(numHashes, 1), MAX_BLOOM_FILTER_HASHES)
+
+	tweak := make([]byte, 4)
+	rand.Read(tweak)
+	return &BloomFilter{
+		Bits:      make([]byte, numBytes),
+		NumHashes: numHashes,
+		Tweak:     binary.BigEndian.Uint32(tweak),
+	}
+}
+
+// Checks a filter received from a peer is within the limits.
+func (f *BloomFilter) Validate() error {
+	if len(f.Bits) == 0 || MAX_BLOOM_FILTER_BYTES < len(f.Bits) {
+		return fmt.Errorf("Bloom filter size must be between 1 and %d bytes.", MAX_BLOOM_FILTER_BYTES)
+	}
+	if f.NumHashes == 0 || MAX_BLOOM_FILTER_HASHES < f.NumHashes {
+		return fmt.Errorf("Bloom filter must have between 1 and %d hash functions.", MAX_BLOOM_FILTER_HASHES)
+	}
+	return nil
+}
+
+// Returns the bit indices of an element, by enhanced double hashing, which spreads the indices even when the second hash
+// shares a factor with the filter size.
+func (f *BloomFilter) indices(data []byte) []uint64 {
+	h := sha256.New()
+	h.Write(binary.BigEndian.AppendUint32(nil, f.Tweak))
+	h.Write(data)
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[0:8])
+	h2 := binary.BigEndian.Uint64(sum[8:16])
+
+	numBits := uint64(len(f.Bits)) * 8
+	indices := make([]uint64, f.NumHashes)
+	for i := range indices {
+		j := uint64(i)
+		indices[i] = (h1 + j*h2 + (j*j*j-j)/6) % numBits
+	}
+	return indices
+}
+
+func (f *BloomFilter) Add(data []byte) {
+	for _, i := range f.indices(data) {
+		f.Bits[i/8] |= 1 << (i % 8)
+	}
+}
+
+// Returns whether the filter may contain an element. False positives are possible, false negatives aren't.
+func (f *BloomFilter) Contains(data []byte) bool {
+	for _, i := range f.indices(data) {
+		if f.Bits[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns whether a transaction is sent to or from a pubkey in the filter.
+func (f *BloomFilter) MatchesTransaction(tx RawTransaction) bool {
+	return f.Contains(tx.FromPubkey[:]) || f.Contains(tx.ToPubkey[:])
+}
+
+// Creates a filter over a set of pubkeys.
+func NewPubkeyBloomFilter(pubkeys [][65]byte, fpRate float64) *BloomFilter {
+	filter := NewBloomFilter(len(pubkeys), fpRate)
+	for _, pubkey := range pubkeys {
+		filter.Add(pubkey[:])
+	}
+	return filter
+}
@@ -0,0 +1,56 @@
+package nakamoto
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	filter := NewBloomFilter(100, 0.01)
+	assert.Nil(filter.Validate())
+	for i := uint64(0); i < 100; i++ {
+		filter.Add(binary.BigEndian.AppendUint64(nil, i))
+	}
+	for i := uint64(0); i < 100; i++ {
+		assert.True(filter.Contains(binary.BigEndian.AppendUint64(nil, i)))
+	}
+
+	// The false positive rate is near the target.
+	falsePositives := 0
+	for i := uint64(100); i < 10100; i++ {
+		if filter.Contains(binary.BigEndian.AppendUint64(nil, i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(falsePositives, 300)
+
+	// Filters survive the wire.
+	buf, err := json.Marshal(filter)
+	assert.Nil(err)
+	decoded := BloomFilter{}
+	assert.Nil(json.Unmarshal(buf, &decoded))
+	assert.True(decoded.Contains(binary.BigEndian.AppendUint64(nil, 1)))
+
+	// Filters are capped in size.
+	huge := NewBloomFilter(10_000_000, 0.0001)
+	assert.Equal(MAX_BLOOM_FILTER_BYTES, len(huge.Bits))
+	assert.Nil(huge.Validate())
+	assert.NotNil((&BloomFilter{Bits: make([]byte, MAX_BLOOM_FILTER_BYTES+1), NumHashes: 1}).Validate())
+	assert.NotNil((&BloomFilter{Bits: make([]byte, 1), NumHashes: MAX_BLOOM_FILTER_HASHES + 1}).Validate())
+	assert.NotNil((&BloomFilter{NumHashes: 1}).Validate())
+}
+
+func TestBloomFilterMatchesTransaction(t *testing.T) {
+	assert := assert.New(t)
+	wallets := getTestingWallets(t)
+
+	filter := NewPubkeyBloomFilter([][65]byte{wallets[0].PubkeyBytes()}, 0.0001)
+	assert.True(filter.MatchesTransaction(RawTransaction{FromPubkey: wallets[0].PubkeyBytes()}))
+	assert.True(filter.MatchesTransaction(RawTransaction{FromPubkey: wallets[1].PubkeyBytes(), ToPubkey: wallets[0].PubkeyBytes()}))
+	assert.False(filter.MatchesTransaction(RawTransaction{FromPubkey: wallets[1].PubkeyBytes(), ToPubkey: wallets[1].PubkeyBytes()}))
+}
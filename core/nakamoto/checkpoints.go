@@ -0,0 +1,283 @@
+package nakamoto
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// Checkpoints are sparse headers of a peer's main chain - every Nth block, and the tip - which a syncing node fetches
+// from each of its peers to quickly find the heaviest chain before committing to a full header download.
+//
+// Each header carries the total work of its parent, so a checkpoint proves the accumulated work of the chain up to it:
+// the parent's total work, plus the work of the checkpoint's own POW solution. The checkpoints are checked to be
+// consistent with each other and with our own chain:
+//   - Heights increase, and accumulated work increases by at least the work of each checkpoint.
+//   - The first checkpoint at a height we have on our main chain matches our block there.
+//
+// A peer can still lie about the work between checkpoints. Before trusting a peer's advertised work, a syncing node
+// fetches a sample of headers at random heights between its checkpoints, and checks the checkpoints and samples:
+//   - Each header's POW solution meets the difficulty it claims, unless it claims none (see epochs.go).
+//   - Each sample's accumulated work lies between the accumulated work of the checkpoints either side of it.
+//
+// A peer whose claimed work isn't backed by valid headers is skipped, and the next-heaviest peer is synced from. Any
+// lie which survives the samples is caught once the headers are downloaded and validated in full, after which the
+// peer is punished like any other peer serving invalid headers.
+
+const (
+	// The default number of blocks between checkpoints.
+	DEFAULT_CHECKPOINT_INTERVAL = 1000
+
+	// The maximum number of checkpoints in a get_checkpoints reply.
+	MAX_CHECKPOINTS = 1024
+
+	// The number of headers sampled between a peer's checkpoints to back its claimed work.
+	SYNC_WORK_SAMPLES = 8
+)
+
+var ErrInvalidCheckpoints = errors.New("invalid checkpoints")
+var ErrUnbackedWork = errors.New("claimed work not backed by valid headers")
+
+// A header on a peer's main chain.
+type Checkpoint struct {
+	Height uint64      `json:"height"`
+	Header BlockHeader `json:"header"`
+}
+
+// Returns the accumulated work of the chain up to and including the checkpoint.
+func (c Checkpoint) AccumulatedWork() *big.Int {
+	parentTotalWork := Bytes32ToBigInt(c.Header.ParentTotalWork)
+	work := CalculateWork(Bytes32ToBigInt(c.Header.BlockHash()))
+	return work.Add(work, &parentTotalWork)
+}
+
+// get_checkpoints
+type GetCheckpointsMessage struct {
+	Type       string `json:"type"` // "get_checkpoints"
+	FromHeight uint64 `json:"fromHeight"`
+	Interval   uint64 `json:"interval"`
+}
+
+type GetCheckpointsReply struct {
+	Type        string       `json:"type"` // "get_checkpoints_reply"
+	Checkpoints []Checkpoint `json:"checkpoints"`
+}
+
+// Gets the checkpoints of the main chain at heights fromHeight, fromHeight+interval, ..., and the full tip.
+func (dag *BlockDAG) GetCheckpoints(fromHeight uint64, interval uint64) ([]Checkpoint, error) {
+	if interval == 0 {
+		return nil, fmt.Errorf("Checkpoint interval must be positive.")
+	}
+	tip := dag.FullTip
+	if tip.Height < fromHeight {
+		return []Checkpoint{}, nil
+	}
+	if MAX_CHECKPOINTS < (tip.Height-fromHeight)/interval+1 {
+		return nil, fmt.Errorf("Too many checkpoints. Max is %d", MAX_CHECKPOINTS)
+	}
+
+	it, err := dag.IterateMainChain(fromHeight, tip.Height)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	checkpoints := []Checkpoint{}
+	for it.Next() {
+		block := it.Block()
+		if (block.Height-fromHeight)%interval == 0 || block.Height == tip.Height {
+			checkpoints = append(checkpoints, Checkpoint{Height: block.Height, Header: block.ToBlockHeader()})
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return checkpoints, nil
+}
+
+// Checks a peer's checkpoints are consistent, and returns the accumulated work of its chain.
+func (dag *BlockDAG) VerifyCheckpoints(checkpoints []Checkpoint) (*big.Int, error) {
+	if len(checkpoints) == 0 {
+		return nil, fmt.Errorf("%w: no checkpoints", ErrInvalidCheckpoints)
+	}
+	if MAX_CHECKPOINTS+1 < len(checkpoints) {
+		return nil, fmt.Errorf("%w: too many checkpoints", ErrInvalidCheckpoints)
+	}
+
+	// Check the checkpoints are ordered, and their work adds up.
+	for i := 1; i < len(checkpoints); i++ {
+		prev, next := checkpoints[i-1], checkpoints[i]
+		if next.Height <= prev.Height {
+			return nil, fmt.Errorf("%w: heights aren't increasing at %d", ErrInvalidCheckpoints, next.Height)
+		}
+		parentTotalWork := Bytes32ToBigInt(next.Header.ParentTotalWork)
+		if parentTotalWork.Cmp(prev.AccumulatedWork()) < 0 {
+			return nil, fmt.Errorf("%w: work decreases at height %d", ErrInvalidCheckpoints, next.Height)
+		}
+	}
+
+	// Check the first checkpoint against our own main chain.
+	first := checkpoints[0]
+	if first.Height <= dag.FullTip.Height {
+		it, err := dag.IterateMainChain(first.Height, first.Height)
+		if err != nil {
+			return nil, err
+		}
+		var ours *Block
+		if it.Next() {
+			block := it.Block()
+			ours = &block
+		}
+		err = it.Err()
+		it.Close()
+		if err != nil {
+			return nil, err
+		}
+		if ours != nil && (ours.Hash != first.Header.BlockHash() || ours.AccumulatedWork.Cmp(first.AccumulatedWork()) != 0) {
+			return nil, fmt.Errorf("%w: checkpoint at height %d doesn't match our chain", ErrInvalidCheckpoints, first.Height)
+		}
+	}
+
+	return checkpoints[len(checkpoints)-1].AccumulatedWork(), nil
+}
+
+// The verified checkpoints of a peer.
+type PeerCheckpoints struct {
+	Peer            Peer
+	Checkpoints     []Checkpoint
+	AccumulatedWork *big.Int
+	// Set if the peer couldn't be queried, or its checkpoints are invalid.
+	Err error
+}
+
+// Returns the checkpoint interval to use for a chain, so the checkpoints fit in a reply with room for the chain to grow.
+func checkpointInterval(fromHeight uint64, tipHeight uint64) uint64 {
+	if tipHeight < fromHeight {
+		return DEFAULT_CHECKPOINT_INTERVAL
+	}
+	interval := (tipHeight-fromHeight)/(MAX_CHECKPOINTS/2) + 1
+	if interval < DEFAULT_CHECKPOINT_INTERVAL {
+		return DEFAULT_CHECKPOINT_INTERVAL
+	}
+	return interval
+}
+
+// Gets the checkpoints of all our peers in parallel, and returns them sorted by the accumulated work of their chains,
+// heaviest first. Peers which failed are sorted last, with Err set.
+func (n *Node) GetPeerCheckpoints(fromHeight uint64) []PeerCheckpoints {
+	peers := n.Peer.Peers()
+	results := make([]PeerCheckpoints, len(peers))
+
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer Peer) {
+			defer wg.Done()
+			result := PeerCheckpoints{Peer: peer}
+			interval := checkpointInterval(fromHeight, peer.tipHeight)
+			result.Checkpoints, result.Err = n.Peer.GetCheckpoints(peer, fromHeight, interval)
+			if result.Err == nil {
+				result.AccumulatedWork, result.Err = n.Dag.VerifyCheckpoints(result.Checkpoints)
+			}
+			results[i] = result
+		}(i, peer)
+	}
+	wg.Wait()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if (results[i].Err == nil) != (results[j].Err == nil) {
+			return results[i].Err == nil
+		}
+		if results[i].Err != nil {
+			return false
+		}
+		return results[i].AccumulatedWork.Cmp(results[j].AccumulatedWork) > 0
+	})
+	return results
+}
+
+// Returns up to count distinct heights strictly between the first and last checkpoints, chosen at random, in
+// ascending order.
+func sampleCheckpointHeights(checkpoints []Checkpoint, count int) []uint64 {
+	if len(checkpoints) == 0 {
+		return []uint64{}
+	}
+	low, high := checkpoints[0].Height, checkpoints[len(checkpoints)-1].Height
+	if high <= low+1 {
+		return []uint64{}
+	}
+	span := high - low - 1
+	if span <= uint64(count) {
+		heights := []uint64{}
+		for height := low + 1; height < high; height++ {
+			heights = append(heights, height)
+		}
+		return heights
+	}
+
+	chosen := make(map[uint64]bool)
+	for len(chosen) < count {
+		chosen[low+1+uint64(rand.Int63n(int64(span)))] = true
+	}
+	heights := []uint64{}
+	for height := range chosen {
+		heights = append(heights, height)
+	}
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights
+}
+
+// Checks the headers a peer served back the work claimed by its checkpoints: the checkpoints and samples solve the
+// difficulties they claim, and each sample's accumulated work lies between the checkpoints either side of it.
+func VerifyWorkSamples(checkpoints []Checkpoint, samples []Checkpoint) error {
+	for _, checkpoint := range append(append([]Checkpoint{}, checkpoints...), samples...) {
+		if checkpoint.Header.Difficulty == [32]byte{} {
+			continue
+		}
+		if !VerifyPOW(checkpoint.Header.BlockHash(), Bytes32ToBigInt(checkpoint.Header.Difficulty)) {
+			return fmt.Errorf("%w: header at height %d doesn't solve its claimed difficulty", ErrUnbackedWork, checkpoint.Height)
+		}
+	}
+
+	for _, sample := range samples {
+		i := sort.Search(len(checkpoints), func(i int) bool { return sample.Height <= checkpoints[i].Height })
+		if i < len(checkpoints) && checkpoints[i].Height == sample.Height {
+			if checkpoints[i].Header.BlockHash() != sample.Header.BlockHash() {
+				return fmt.Errorf("%w: sample at height %d doesn't match the checkpoint", ErrUnbackedWork, sample.Height)
+			}
+			continue
+		}
+		if i == 0 || i == len(checkpoints) {
+			return fmt.Errorf("%w: sample at height %d is outside the checkpoints", ErrUnbackedWork, sample.Height)
+		}
+
+		parentTotalWork := Bytes32ToBigInt(sample.Header.ParentTotalWork)
+		prev, next := checkpoints[i-1], checkpoints[i]
+		nextParentTotalWork := Bytes32ToBigInt(next.Header.ParentTotalWork)
+		if parentTotalWork.Cmp(prev.AccumulatedWork()) < 0 || nextParentTotalWork.Cmp(sample.AccumulatedWork()) < 0 {
+			return fmt.Errorf("%w: work of sample at height %d doesn't fit between the checkpoints", ErrUnbackedWork, sample.Height)
+		}
+	}
+	return nil
+}
+
+// Fetches a sample of headers between a peer's checkpoints, and checks they back the peer's claimed work.
+func (n *Node) verifyPeerWork(result PeerCheckpoints) error {
+	tip := result.Checkpoints[len(result.Checkpoints)-1]
+	samples := []Checkpoint{}
+	for _, height := range sampleCheckpointHeights(result.Checkpoints, SYNC_WORK_SAMPLES) {
+		// An interval past the tip returns the header at the height, and the tip.
+		headers, err := n.Peer.GetCheckpoints(result.Peer, height, tip.Height-height+1)
+		if err != nil {
+			return err
+		}
+		if len(headers) == 0 || headers[0].Height != height {
+			return fmt.Errorf("%w: peer didn't serve the header at height %d", ErrUnbackedWork, height)
+		}
+		samples = append(samples, headers[0])
+	}
+	return VerifyWorkSamples(result.Checkpoints, samples)
+}
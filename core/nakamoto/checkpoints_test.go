@@ -0,0 +1,130 @@
+package nakamoto
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDagGetAndVerifyCheckpoints(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+	miner.Start(25)
+
+	// Checkpoints are taken every interval blocks, and at the tip.
+	checkpoints, err := dag.GetCheckpoints(0, 10)
+	assert.Nil(err)
+	heights := []uint64{}
+	for _, checkpoint := range checkpoints {
+		heights = append(heights, checkpoint.Height)
+	}
+	assert.Equal([]uint64{0, 10, 20, 25}, heights)
+	assert.Equal(dag.FullTip.Hash, checkpoints[3].Header.BlockHash())
+
+	checkpoints, err = dag.GetCheckpoints(5, 10)
+	assert.Nil(err)
+	assert.Equal(uint64(5), checkpoints[0].Height)
+	assert.Equal(3, len(checkpoints))
+
+	_, err = dag.GetCheckpoints(0, 0)
+	assert.NotNil(err)
+
+	// The work of the chain is proven by the checkpoints.
+	checkpoints, _ = dag.GetCheckpoints(0, 10)
+	work, err := dag.VerifyCheckpoints(checkpoints)
+	assert.Nil(err)
+	assert.Equal(0, work.Cmp(&dag.FullTip.AccumulatedWork))
+
+	// Out of order.
+	reordered := []Checkpoint{checkpoints[0], checkpoints[2], checkpoints[1]}
+	_, err = dag.VerifyCheckpoints(reordered)
+	assert.ErrorIs(err, ErrInvalidCheckpoints)
+
+	// Work decreases.
+	tampered := append([]Checkpoint{}, checkpoints...)
+	tampered[3].Header.ParentTotalWork = [32]byte{}
+	_, err = dag.VerifyCheckpoints(tampered)
+	assert.ErrorIs(err, ErrInvalidCheckpoints)
+
+	// A different chain.
+	tampered = append([]Checkpoint{}, checkpoints...)
+	tampered[0].Header.Nonce = [32]byte{1}
+	_, err = dag.VerifyCheckpoints(tampered)
+	assert.ErrorIs(err, ErrInvalidCheckpoints)
+
+	_, err = dag.VerifyCheckpoints([]Checkpoint{})
+	assert.ErrorIs(err, ErrInvalidCheckpoints)
+}
+
+func TestCheckpointInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(uint64(DEFAULT_CHECKPOINT_INTERVAL), checkpointInterval(0, 100))
+	assert.Equal(uint64(DEFAULT_CHECKPOINT_INTERVAL), checkpointInterval(100, 0))
+
+	// Long chains fit in half a reply.
+	interval := checkpointInterval(0, 10_000_000)
+	assert.LessOrEqual(10_000_000/interval+1, uint64(MAX_CHECKPOINTS/2))
+}
+
+func TestVerifyWorkSamples(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+	miner.Start(25)
+
+	checkpoints, err := dag.GetCheckpoints(0, 10)
+	assert.Nil(err)
+	heights := sampleCheckpointHeights(checkpoints, SYNC_WORK_SAMPLES)
+	assert.Equal(SYNC_WORK_SAMPLES, len(heights))
+	samples := []Checkpoint{}
+	for _, height := range heights {
+		assert.True(0 < height && height < 25)
+		sample, err := dag.GetCheckpoints(height, 25-height+1)
+		assert.Nil(err)
+		samples = append(samples, sample[0])
+	}
+
+	// Honest samples back the claimed work.
+	assert.Nil(VerifyWorkSamples(checkpoints, samples))
+
+	// A sample which doesn't solve its claimed difficulty.
+	tampered := append([]Checkpoint{}, samples...)
+	tampered[0].Header.Difficulty = [32]byte{31: 1}
+	assert.ErrorIs(VerifyWorkSamples(checkpoints, tampered), ErrUnbackedWork)
+
+	// A sample which claims more work than the checkpoints, with an easy difficulty it solves.
+	inflated := append([]Checkpoint{}, samples...)
+	for i := range inflated[0].Header.Difficulty {
+		inflated[0].Header.Difficulty[i] = 0xff
+	}
+	inflated[0].Header.ParentTotalWork = BigIntToBytes32(*new(big.Int).Lsh(big.NewInt(1), 250))
+	assert.ErrorIs(VerifyWorkSamples(checkpoints, inflated), ErrUnbackedWork)
+
+	// Every height is sampled on short chains.
+	assert.Empty(sampleCheckpointHeights(checkpoints[:1], SYNC_WORK_SAMPLES))
+	assert.Equal([]uint64{11, 12, 13}, sampleCheckpointHeights([]Checkpoint{{Height: 10}, {Height: 14}}, SYNC_WORK_SAMPLES))
+}
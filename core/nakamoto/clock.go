@@ -0,0 +1,152 @@
+package nakamoto
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The clock monitor checks the local clock against the network's, and warns the operator when it's off by more than
+// MaxDrift. A mis-set clock makes the node mine blocks with bad timestamps, and makes other nodes' blocks look like
+// they come from the future or the past, which shows up as confusing validation and difficulty errors.
+//
+// It estimates the offset from two sources:
+//   - Peers. Each heartbeat reply carries the peer's time, from which we estimate the offset of the peer's clock from
+//     ours, correcting for half the round-trip time. The median across peers is used, so a few bad clocks don't skew it.
+//   - Blocks. The timestamps of new blocks gossiped to us are compared with the time they arrive. Timestamps are set
+//     when the miner builds the block template, so they normally lag the arrival time by up to the block time. A block
+//     timestamp ahead of the local clock suggests the local clock is behind.
+
+const (
+	// The default maximum offset of the local clock from the network's before warning.
+	DEFAULT_MAX_CLOCK_DRIFT = 2 * time.Minute
+
+	// The number of recent block timestamp samples kept.
+	MAX_CLOCK_BLOCK_SAMPLES = 64
+)
+
+type ClockStatus struct {
+	LastCheck time.Time
+
+	// The estimated offset of the network's clock from the local clock, as the median of the peers' offsets. Positive
+	// means the local clock is behind.
+	Offset      time.Duration
+	PeerSamples int
+
+	// The median difference between recent block timestamps and the local time they arrived. Positive means blocks
+	// appear to come from the future.
+	BlockDrift   time.Duration
+	BlockSamples int
+
+	// Set while the local clock appears to be off by more than MaxDrift.
+	Warning string
+}
+
+type ClockMonitor struct {
+	// The maximum allowed offset of the local clock from the network's.
+	MaxDrift time.Duration
+	// The minimum number of peer and block samples needed to warn.
+	MinPeerSamples  int
+	MinBlockSamples int
+	// How often the clock is checked.
+	Interval time.Duration
+
+	// Returns the estimated offsets of the peers' clocks from ours. See PeerCore.PeerTimeOffsets.
+	GetPeerOffsets func() []time.Duration
+
+	// Called when the local clock starts being off by more than MaxDrift.
+	OnWarning func(status ClockStatus)
+
+	blockDrifts []time.Duration
+	status      ClockStatus
+	mutex       sync.Mutex
+	log         *log.Logger
+}
+
+func NewClockMonitor() *ClockMonitor {
+	return &ClockMonitor{
+		MaxDrift:        DEFAULT_MAX_CLOCK_DRIFT,
+		MinPeerSamples:  3,
+		MinBlockSamples: 3,
+		Interval:        1 * time.Minute,
+		blockDrifts:     []time.Duration{},
+		log:             NewLogger("clock", ""),
+	}
+}
+
+func (m *ClockMonitor) Start() {
+	for {
+		m.Check(time.Now())
+		time.Sleep(m.Interval)
+	}
+}
+
+// Records the timestamp of a new block, received at the given time.
+func (m *ClockMonitor) RecordBlockTimestamp(timestamp uint64, receivedAt time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	drift := time.Duration(int64(timestamp)-receivedAt.UnixMilli()) * time.Millisecond
+	m.blockDrifts = append(m.blockDrifts, drift)
+	if MAX_CLOCK_BLOCK_SAMPLES < len(m.blockDrifts) {
+		m.blockDrifts = m.blockDrifts[1:]
+	}
+}
+
+// Returns a copy of the monitor's status.
+func (m *ClockMonitor) Status() ClockStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.status
+}
+
+// Recomputes the offset estimates, and warns if the local clock is off by more than MaxDrift.
+func (m *ClockMonitor) Check(now time.Time) ClockStatus {
+	peerOffsets := []time.Duration{}
+	if m.GetPeerOffsets != nil {
+		peerOffsets = m.GetPeerOffsets()
+	}
+
+	m.mutex.Lock()
+	status := ClockStatus{
+		LastCheck:    now,
+		Offset:       medianDuration(peerOffsets),
+		PeerSamples:  len(peerOffsets),
+		BlockDrift:   medianDuration(m.blockDrifts),
+		BlockSamples: len(m.blockDrifts),
+	}
+	if m.MinPeerSamples <= status.PeerSamples && m.MaxDrift < absDuration(status.Offset) {
+		status.Warning = fmt.Sprintf("Local clock is off from %d peers' by %s, more than the allowed %s. Check the system clock.", status.PeerSamples, status.Offset, m.MaxDrift)
+	} else if m.MinBlockSamples <= status.BlockSamples && m.MaxDrift < status.BlockDrift {
+		status.Warning = fmt.Sprintf("Recent blocks are timestamped %s ahead of the local clock, more than the allowed %s. Check the system clock.", status.BlockDrift, m.MaxDrift)
+	}
+	newWarning := status.Warning != "" && m.status.Warning == ""
+	m.status = status
+	m.mutex.Unlock()
+
+	if newWarning {
+		m.log.Printf("Warning: %s\n", status.Warning)
+		if m.OnWarning != nil {
+			m.OnWarning(status)
+		}
+	}
+	return status
+}
+
+func medianDuration(samples []time.Duration) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,95 @@
+package nakamoto
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The consensus code reads the time through a Clock, rather than calling time.Now directly, so simulations and
+// deterministic replays can control it. The time is used for:
+//   - block timestamps, set by Timestamp() when the miner builds a block template. Difficulty retargeting is computed
+//     from these timestamps, so a controlled clock gives reproducible epochs.
+//   - timestamp validation, which rejects blocks with timestamps more than MAX_BLOCK_TIMESTAMP_DRIFT ahead of the
+//     DAG's clock. Such blocks aren't marked invalid, since they become valid once the clock catches up.
+//
+// Timestamp() reads the package's DefaultClock, which is the system clock unless replaced. Each BlockDAG has its own
+// Clock, which defaults to DefaultClock, so concurrent simulations can each control the time of their DAGs.
+//
+// Measurements of the node's own performance, such as the miner's hashrate, and networking timeouts use the system
+// clock, since they measure real elapsed time.
+
+// The furthest a block's timestamp can be ahead of the local clock.
+const MAX_BLOCK_TIMESTAMP_DRIFT = 2 * time.Hour
+
+type Clock interface {
+	Now() time.Time
+}
+
+// The system clock.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// The clock read by Timestamp().
+var DefaultClock Clock = SystemClock{}
+
+// Returns the time of a clock as a block timestamp, in milliseconds.
+func ClockTimestamp(clock Clock) uint64 {
+	return uint64(clock.Now().UnixMilli())
+}
+
+// A simulated clock, which only moves when it's advanced or set.
+type SimClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+func NewSimClock(start time.Time) *SimClock {
+	return &SimClock{now: start}
+}
+
+func (c *SimClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *SimClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *SimClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = now
+}
+
+// The DAG.
+// =====================================================================================================================
+
+// Returns the DAG's clock.
+func (dag *BlockDAG) clock() Clock {
+	if dag.Clock == nil {
+		return DefaultClock
+	}
+	return dag.Clock
+}
+
+// Returns the current time of the DAG's clock as a block timestamp.
+func (dag *BlockDAG) Timestamp() uint64 {
+	return ClockTimestamp(dag.clock())
+}
+
+// Verifies a block's timestamp isn't too far in the future.
+func (dag *BlockDAG) verifyTimestamp(timestamp uint64) error {
+	maxTimestamp := dag.Timestamp() + uint64(MAX_BLOCK_TIMESTAMP_DRIFT.Milliseconds())
+	if maxTimestamp < timestamp {
+		return fmt.Errorf("Block timestamp is too far in the future: %d is more than %s ahead of the local clock.", timestamp, MAX_BLOCK_TIMESTAMP_DRIFT)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package nakamoto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSimClock(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.UnixMilli(1719379532750)
+	clock := NewSimClock(start)
+	assert.Equal(start, clock.Now())
+	clock.Advance(time.Second)
+	assert.Equal(uint64(1719379533750), ClockTimestamp(clock))
+	clock.Set(start)
+	assert.Equal(start, clock.Now())
+}
+
+func TestBlockTimestampUsesDAGClock(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForMiner()
+	clock := NewSimClock(time.Now().Add(24 * time.Hour))
+	dag.Clock = clock
+	wallets := getTestingWallets(t)
+
+	// The miner timestamps blocks with the DAG's clock.
+	miner := NewMiner(dag, &wallets[0])
+	mined := []RawBlock{}
+	miner.OnBlockSolution = func(block RawBlock) {
+		mined = append(mined, block)
+	}
+	miner.Start(1)
+	assert.Equal(1, len(mined))
+	assert.Equal(ClockTimestamp(clock), mined[0].Timestamp)
+
+	// Blocks too far ahead of the clock are rejected, until it catches up.
+	clock.Advance(-MAX_BLOCK_TIMESTAMP_DRIFT - time.Second)
+	assert.ErrorContains(dag.IngestBlock(mined[0]), "too far in the future")
+	assert.ErrorContains(dag.IngestHeader(mined[0].BlockHeader), "too far in the future")
+	clock.Advance(2 * time.Second)
+	assert.Nil(dag.IngestBlock(mined[0]))
+}
@@ -0,0 +1,92 @@
+package nakamoto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClockMonitorPeerOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewClockMonitor()
+	offsets := []time.Duration{}
+	m.GetPeerOffsets = func() []time.Duration { return offsets }
+	warnings := 0
+	m.OnWarning = func(status ClockStatus) { warnings++ }
+
+	// Too few peers to warn.
+	offsets = []time.Duration{10 * time.Minute, 10 * time.Minute}
+	status := m.Check(time.Now())
+	assert.Equal("", status.Warning)
+
+	// Most peers agree our clock is behind.
+	offsets = []time.Duration{5 * time.Minute, 6 * time.Minute, -1 * time.Second}
+	status = m.Check(time.Now())
+	assert.Equal(5*time.Minute, status.Offset)
+	assert.Equal(3, status.PeerSamples)
+	assert.NotEqual("", status.Warning)
+	assert.Equal(1, warnings)
+
+	// Only warn once while the clock stays off.
+	m.Check(time.Now())
+	assert.Equal(1, warnings)
+
+	// One bad peer clock doesn't skew the estimate.
+	offsets = []time.Duration{1 * time.Second, -2 * time.Second, 1 * time.Hour}
+	status = m.Check(time.Now())
+	assert.Equal(1*time.Second, status.Offset)
+	assert.Equal("", status.Warning)
+	assert.Equal(status, m.Status())
+}
+
+func TestClockMonitorBlockDrift(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewClockMonitor()
+	now := time.Now()
+
+	// Blocks normally arrive some time after their template was built.
+	for i := 0; i < 3; i++ {
+		m.RecordBlockTimestamp(uint64(now.Add(-30*time.Second).UnixMilli()), now)
+	}
+	status := m.Check(now)
+	assert.Equal(-30*time.Second, status.BlockDrift)
+	assert.Equal(3, status.BlockSamples)
+	assert.Equal("", status.Warning)
+
+	// Blocks from the future mean our clock is behind.
+	for i := 0; i < 4; i++ {
+		m.RecordBlockTimestamp(uint64(now.Add(10*time.Minute).UnixMilli()), now)
+	}
+	status = m.Check(now)
+	assert.Equal(10*time.Minute, status.BlockDrift)
+	assert.NotEqual("", status.Warning)
+
+	// Only recent samples are kept.
+	for i := 0; i < MAX_CLOCK_BLOCK_SAMPLES+10; i++ {
+		m.RecordBlockTimestamp(uint64(now.UnixMilli()), now)
+	}
+	status = m.Check(now)
+	assert.Equal(MAX_CLOCK_BLOCK_SAMPLES, status.BlockSamples)
+	assert.Equal(time.Duration(0), status.BlockDrift)
+}
+
+func TestEstimateTimeOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	sentAt := time.Now()
+	rtt := 200 * time.Millisecond
+	receivedAt := sentAt.Add(rtt)
+
+	// The peer's clock is 1 minute ahead, and it replied halfway through the round trip.
+	peerTime := sentAt.Add(rtt / 2).Add(1 * time.Minute)
+	assert.Equal(1*time.Minute, estimateTimeOffset(peerTime, rtt, receivedAt))
+
+	peer := Peer{}
+	peer.recordTimeOffset(10 * time.Second)
+	assert.Equal(10*time.Second, peer.timeOffset)
+	peer.recordTimeOffset(0)
+	assert.Equal(8*time.Second, peer.timeOffset)
+}
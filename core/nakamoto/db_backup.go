@@ -0,0 +1,159 @@
+package nakamoto
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// The node database can be backed up while the node is running, using SQLite's online backup API. The backup copies
+// the database a batch of pages at a time, releasing its read lock in between so the node can keep writing. If the
+// node writes to the database during the backup, SQLite restarts the copy, so the backup is always a consistent
+// snapshot.
+//
+// Restoring copies a backup over the database, after checking the backup's integrity. Unlike backups, restores must
+// be done while the node is stopped.
+
+const (
+	// The number of pages copied in each backup step.
+	DB_BACKUP_PAGES_PER_STEP = 1024
+
+	// How long to wait between backup steps, to let the node write.
+	DB_BACKUP_STEP_DELAY = 10 * time.Millisecond
+)
+
+// Opens a database file read-only, without running migrations. Used for backups and integrity checks.
+func OpenDBReadOnly(dbPath string) (*sql.DB, error) {
+	if _, err := os.Stat(dbPath); err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+}
+
+// Backs up a database to the file at destPath, which must not exist.
+func BackupDB(src *sql.DB, destPath string) error {
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("Backup destination %s already exists.", destPath)
+	}
+
+	if err := copyDB(src, destPath); err != nil {
+		os.Remove(destPath)
+		return err
+	}
+	if err := VerifyDBIntegrity(destPath); err != nil {
+		return fmt.Errorf("Backup failed integrity check: %s", err)
+	}
+	return nil
+}
+
+// Restores the database at dbPath from the backup at backupPath. The backup is checked before the database is
+// overwritten. The node must not be running.
+func RestoreDB(backupPath string, dbPath string) error {
+	if err := VerifyDBIntegrity(backupPath); err != nil {
+		return fmt.Errorf("Backup failed integrity check: %s", err)
+	}
+
+	src, err := OpenDBReadOnly(backupPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := copyDB(src, dbPath); err != nil {
+		return err
+	}
+	if err := VerifyDBIntegrity(dbPath); err != nil {
+		return fmt.Errorf("Restored database failed integrity check: %s", err)
+	}
+	return nil
+}
+
+// Checks the integrity of a database file, and that it's a tinychain database.
+func VerifyDBIntegrity(dbPath string) error {
+	db, err := OpenDBReadOnly(dbPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("pragma integrity_check")
+	if err != nil {
+		return err
+	}
+	problems := []string{}
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			rows.Close()
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	rows.Close()
+	if len(problems) != 0 {
+		return fmt.Errorf("Database is corrupt: %v", problems)
+	}
+
+	var version int
+	if err := db.QueryRow("select version from tinychain_version limit 1").Scan(&version); err != nil {
+		return fmt.Errorf("Not a tinychain database: %s", err)
+	}
+	return nil
+}
+
+// Copies the main database of src into the database file at destPath, using the online backup API.
+func copyDB(src *sql.DB, destPath string) error {
+	dest, err := sql.Open("sqlite3", destPath)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	ctx := context.Background()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			destSqliteConn, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("Unexpected database driver.")
+			}
+			srcSqliteConn, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return fmt.Errorf("Unexpected database driver.")
+			}
+
+			backup, err := destSqliteConn.Backup("main", srcSqliteConn, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := backup.Step(DB_BACKUP_PAGES_PER_STEP)
+				if err != nil {
+					backup.Close()
+					return err
+				}
+				if done {
+					break
+				}
+				time.Sleep(DB_BACKUP_STEP_DELAY)
+			}
+			return backup.Finish()
+		})
+	})
+}
@@ -0,0 +1,76 @@
+package nakamoto
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func countBlocks(t *testing.T, dbPath string) int {
+	db, err := OpenDBReadOnly(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	count := 0
+	if err := db.QueryRow("select count(*) from blocks").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestBackupAndRestoreDB(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "node.db")
+	backupPath := filepath.Join(dir, "backup.db")
+	restorePath := filepath.Join(dir, "restored.db")
+
+	// Create a database, and keep it open as the running node would.
+	db, err := OpenDB(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, conf, _, _ := newBlockdag()
+	_, err = NewBlockDAGFromDB(db, newMockStateMachine(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(1, countBlocks(t, dbPath))
+
+	// Back up the open database.
+	src, err := OpenDBReadOnly(dbPath)
+	assert.Nil(err)
+	defer src.Close()
+	assert.Nil(BackupDB(src, backupPath))
+	assert.Nil(VerifyDBIntegrity(backupPath))
+	assert.Equal(1, countBlocks(t, backupPath))
+
+	// Backups don't overwrite existing files.
+	assert.NotNil(BackupDB(src, backupPath))
+
+	// Restore.
+	assert.Nil(RestoreDB(backupPath, restorePath))
+	assert.Equal(1, countBlocks(t, restorePath))
+}
+
+func TestRestoreDBRejectsCorruptBackup(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	backupPath := filepath.Join(dir, "backup.db")
+	dbPath := filepath.Join(dir, "node.db")
+
+	assert.Nil(os.WriteFile(backupPath, []byte("not a database"), 0600))
+	assert.NotNil(VerifyDBIntegrity(backupPath))
+	assert.NotNil(RestoreDB(backupPath, dbPath))
+
+	// The database isn't created.
+	_, err := os.Stat(dbPath)
+	assert.True(os.IsNotExist(err))
+
+	// Missing backups are rejected.
+	assert.NotNil(RestoreDB(filepath.Join(dir, "missing.db"), dbPath))
+}
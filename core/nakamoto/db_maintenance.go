@@ -0,0 +1,221 @@
+package nakamoto
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// The database of a long-running node bloats over time. Pages freed by deleted rows (pruned mempool data, invalidated
+// blocks, rewritten state) are kept in the file, and the query planner's statistics and indexes drift from the data.
+//
+// The DB maintainer runs periodically while the node is idle - when no blocks have been ingested for IdleThreshold -
+// and:
+//   - Runs an incremental vacuum, returning up to VacuumPages free pages to the filesystem.
+//   - Analyzes the tables, refreshing the query planner's statistics.
+//   - Rebuilds the indexes.
+//
+// Incremental vacuums need the database to be created with auto_vacuum=incremental, which OpenDB does for new
+// databases. Older databases must be compacted once with CompactDB (`db compact`), which rewrites the whole file.
+
+const (
+	DEFAULT_DB_MAINTENANCE_INTERVAL = 1 * time.Hour
+
+	// How long since the last block was ingested before the node is considered idle.
+	DEFAULT_DB_IDLE_THRESHOLD = 30 * time.Second
+
+	// The maximum number of free pages reclaimed by each incremental vacuum.
+	DEFAULT_DB_VACUUM_PAGES = 4096
+)
+
+// The values of SQLite's auto_vacuum pragma.
+const (
+	SQLITE_AUTO_VACUUM_NONE        = 0
+	SQLITE_AUTO_VACUUM_FULL        = 1
+	SQLITE_AUTO_VACUUM_INCREMENTAL = 2
+)
+
+// The result of a maintenance run.
+type DBMaintenanceReport struct {
+	StartTime time.Time
+	Duration  time.Duration
+
+	// The size of the database and its free pages, before and after, in bytes.
+	SizeBefore      int64
+	SizeAfter       int64
+	FreeBytesBefore int64
+	FreeBytesAfter  int64
+
+	// Whether the whole database was rewritten.
+	Compacted bool
+}
+
+type DBMaintainer struct {
+	// How often maintenance runs. Zero disables it.
+	Interval time.Duration
+	// How long since the last activity before the node is considered idle.
+	IdleThreshold time.Duration
+	// The maximum number of free pages reclaimed by each incremental vacuum.
+	VacuumPages int
+
+	db           *sql.DB
+	lastActivity time.Time
+	lastReport   *DBMaintenanceReport
+	mutex        sync.Mutex
+	log          *log.Logger
+}
+
+func NewDBMaintainer(db *sql.DB) *DBMaintainer {
+	return &DBMaintainer{
+		Interval:      DEFAULT_DB_MAINTENANCE_INTERVAL,
+		IdleThreshold: DEFAULT_DB_IDLE_THRESHOLD,
+		VacuumPages:   DEFAULT_DB_VACUUM_PAGES,
+		db:            db,
+		log:           NewLogger("blockdag", "maintenance"),
+	}
+}
+
+// Records database activity, such as ingesting a block, which postpones maintenance until the node is idle.
+func (m *DBMaintainer) RecordActivity() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastActivity = time.Now()
+}
+
+// Whether there has been no activity for IdleThreshold.
+func (m *DBMaintainer) IsIdle(now time.Time) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.IdleThreshold <= now.Sub(m.lastActivity)
+}
+
+// Returns the report of the last maintenance run, or nil if it hasn't run.
+func (m *DBMaintainer) LastReport() *DBMaintenanceReport {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.lastReport
+}
+
+func (m *DBMaintainer) Start() {
+	if m.Interval == 0 {
+		return
+	}
+	for {
+		time.Sleep(m.Interval)
+
+		// Wait for the node to be idle.
+		for !m.IsIdle(time.Now()) {
+			time.Sleep(m.IdleThreshold)
+		}
+
+		report, err := m.RunMaintenance()
+		if err != nil {
+			m.log.Printf("Database maintenance failed: %s\n", err)
+			continue
+		}
+		m.log.Printf(
+			"Database maintenance done: duration=%s size=%d->%d free=%d->%d\n",
+			report.Duration, report.SizeBefore, report.SizeAfter, report.FreeBytesBefore, report.FreeBytesAfter,
+		)
+	}
+}
+
+// Runs an incremental vacuum, analyzes the tables and rebuilds the indexes.
+func (m *DBMaintainer) RunMaintenance() (DBMaintenanceReport, error) {
+	report := DBMaintenanceReport{StartTime: time.Now()}
+
+	var err error
+	report.SizeBefore, report.FreeBytesBefore, err = getDBSize(m.db)
+	if err != nil {
+		return report, err
+	}
+
+	autoVacuum := 0
+	if err := m.db.QueryRow("pragma auto_vacuum").Scan(&autoVacuum); err != nil {
+		return report, err
+	}
+	if autoVacuum == SQLITE_AUTO_VACUUM_INCREMENTAL {
+		if err := incrementalVacuum(m.db, m.VacuumPages); err != nil {
+			return report, fmt.Errorf("Failed to vacuum database: %s", err)
+		}
+	}
+	if _, err := m.db.Exec("analyze"); err != nil {
+		return report, fmt.Errorf("Failed to analyze database: %s", err)
+	}
+	if _, err := m.db.Exec("reindex"); err != nil {
+		return report, fmt.Errorf("Failed to rebuild indexes: %s", err)
+	}
+
+	report.SizeAfter, report.FreeBytesAfter, err = getDBSize(m.db)
+	if err != nil {
+		return report, err
+	}
+	report.Duration = time.Since(report.StartTime)
+
+	m.mutex.Lock()
+	m.lastReport = &report
+	m.mutex.Unlock()
+	return report, nil
+}
+
+// Rewrites the whole database, reclaiming all free pages and enabling incremental vacuums. This needs exclusive access
+// to the database, and temporarily up to twice its size in disk space, so it should be run while the node is stopped.
+func CompactDB(db *sql.DB) (DBMaintenanceReport, error) {
+	report := DBMaintenanceReport{StartTime: time.Now(), Compacted: true}
+
+	var err error
+	report.SizeBefore, report.FreeBytesBefore, err = getDBSize(db)
+	if err != nil {
+		return report, err
+	}
+
+	// Changing auto_vacuum only takes effect after a vacuum.
+	if _, err := db.Exec("pragma auto_vacuum = incremental"); err != nil {
+		return report, err
+	}
+	if _, err := db.Exec("vacuum"); err != nil {
+		return report, fmt.Errorf("Failed to vacuum database: %s", err)
+	}
+	if _, err := db.Exec("analyze"); err != nil {
+		return report, fmt.Errorf("Failed to analyze database: %s", err)
+	}
+
+	report.SizeAfter, report.FreeBytesAfter, err = getDBSize(db)
+	if err != nil {
+		return report, err
+	}
+	report.Duration = time.Since(report.StartTime)
+	return report, nil
+}
+
+// Reclaims up to n free pages. The pragma frees pages as it is stepped, so its rows are drained until it is done.
+func incrementalVacuum(db *sql.DB, n int) error {
+	rows, err := db.Query(fmt.Sprintf("pragma incremental_vacuum(%d)", n))
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	return rows.Close()
+}
+
+// Gets the size of the database and of its free pages, in bytes.
+func getDBSize(db *sql.DB) (int64, int64, error) {
+	var pageSize, pageCount, freePages int64
+	if err := db.QueryRow("pragma page_size").Scan(&pageSize); err != nil {
+		return 0, 0, err
+	}
+	if err := db.QueryRow("pragma page_count").Scan(&pageCount); err != nil {
+		return 0, 0, err
+	}
+	if err := db.QueryRow("pragma freelist_count").Scan(&freePages); err != nil {
+		return 0, 0, err
+	}
+	return pageSize * pageCount, pageSize * freePages, nil
+}
@@ -0,0 +1,97 @@
+package nakamoto
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Fills a table with data and deletes it, leaving free pages in the database.
+func bloatDB(t *testing.T, db *sql.DB) {
+	_, err := db.Exec("create table if not exists bloat (data blob)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(strings.Repeat("x", 4096))
+	for i := 0; i < 200; i++ {
+		if _, err := db.Exec("insert into bloat (data) values (?)", data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec("delete from bloat"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDBMaintenanceIncrementalVacuum(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := OpenDB(filepath.Join(t.TempDir(), "node.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// New databases are created with incremental auto vacuum.
+	autoVacuum := 0
+	assert.Nil(db.QueryRow("pragma auto_vacuum").Scan(&autoVacuum))
+	assert.Equal(SQLITE_AUTO_VACUUM_INCREMENTAL, autoVacuum)
+
+	bloatDB(t, db)
+	m := NewDBMaintainer(db)
+	report, err := m.RunMaintenance()
+	assert.Nil(err)
+	assert.Less(int64(0), report.FreeBytesBefore)
+	assert.Equal(int64(0), report.FreeBytesAfter)
+	assert.Less(report.SizeAfter, report.SizeBefore)
+	assert.Equal(&report, m.LastReport())
+
+	// Vacuums are limited to VacuumPages.
+	bloatDB(t, db)
+	m.VacuumPages = 10
+	report, err = m.RunMaintenance()
+	assert.Nil(err)
+	pageSize := int64(0)
+	assert.Nil(db.QueryRow("pragma page_size").Scan(&pageSize))
+	assert.Equal(report.FreeBytesBefore-10*pageSize, report.FreeBytesAfter)
+}
+
+func TestCompactDB(t *testing.T) {
+	assert := assert.New(t)
+
+	// Create a database without auto vacuum, as older nodes did.
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "node.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bloatDB(t, db)
+	autoVacuum := -1
+	assert.Nil(db.QueryRow("pragma auto_vacuum").Scan(&autoVacuum))
+	assert.Equal(SQLITE_AUTO_VACUUM_NONE, autoVacuum)
+
+	report, err := CompactDB(db)
+	assert.Nil(err)
+	assert.True(report.Compacted)
+	assert.Less(report.SizeAfter, report.SizeBefore)
+	assert.Equal(int64(0), report.FreeBytesAfter)
+
+	assert.Nil(db.QueryRow("pragma auto_vacuum").Scan(&autoVacuum))
+	assert.Equal(SQLITE_AUTO_VACUUM_INCREMENTAL, autoVacuum)
+}
+
+func TestDBMaintainerIdle(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewDBMaintainer(nil)
+	m.IdleThreshold = 1 * time.Minute
+	assert.True(m.IsIdle(time.Now()))
+
+	m.RecordActivity()
+	assert.False(m.IsIdle(time.Now()))
+	assert.True(m.IsIdle(time.Now().Add(2 * time.Minute)))
+}
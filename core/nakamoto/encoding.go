@@ -0,0 +1,220 @@
+package nakamoto
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// The canonical byte encoding of blocks and transactions, as produced by RawBlock.Bytes and RawTransaction.Bytes, and
+// parsed by DecodeRawBlock and DecodeRawTransaction. The full specification is in docs/encoding.md, and the test
+// vectors in testdata/encoding_vectors.json. All integers are big-endian.
+//
+// A block is its header followed by its transactions, with no count or length prefix, since the header includes the
+// number of transactions and each transaction's length is determined by its contents. The header extension (base fee
+// and version, then the history root) is only present when set, so a decoder determines its size from the transactions
+// merkle root, which only matches the transactions when they are read from the right offset.
+
+const (
+	// The size of a block header without the extension.
+	BLOCK_HEADER_BASE_SIZE = 32 + 32 + 32 + 8 + 8 + 32 + 32 + 32
+	// The size of the header extension: the base fee and version.
+	BLOCK_HEADER_EXTENSION_SIZE = 8 + 4
+	// The size of the header extension with the history root.
+	BLOCK_HEADER_HISTORY_EXTENSION_SIZE = BLOCK_HEADER_EXTENSION_SIZE + 32
+
+	// The size of the fields common to all transaction versions.
+	TX_BASE_SIZE = 1 + 64 + 65 + 65 + 8 + 8 + 8
+)
+
+// A cursor over an encoded buffer.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) read(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = fmt.Errorf("Unexpected end of data: need %d bytes, have %d.", n, len(d.buf))
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) bytes32() (out [32]byte) {
+	copy(out[:], d.read(32))
+	return out
+}
+
+func (d *decoder) uint8() byte {
+	if b := d.read(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.read(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.read(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.read(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// Reads a byte slice, which is nil if empty, like the fields of a decoded transaction.
+func (d *decoder) slice(n int) []byte {
+	b := d.read(n)
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// Decodes a transaction from the canonical encoding.
+func DecodeRawTransaction(buf []byte) (RawTransaction, error) {
+	d := &decoder{buf: buf}
+	tx := d.transaction()
+	if d.err != nil {
+		return RawTransaction{}, d.err
+	}
+	if len(d.buf) != 0 {
+		return RawTransaction{}, fmt.Errorf("Unexpected %d bytes after transaction.", len(d.buf))
+	}
+	return tx, nil
+}
+
+func (d *decoder) transaction() RawTransaction {
+	tx := RawTransaction{}
+	tx.Version = d.uint8()
+	if LatestTxVersion() < tx.Version && d.err == nil {
+		d.err = fmt.Errorf("Unsupported transaction version: %d", tx.Version)
+		return tx
+	}
+	copy(tx.Sig[:], d.read(64))
+	copy(tx.FromPubkey[:], d.read(65))
+	copy(tx.ToPubkey[:], d.read(65))
+	tx.Amount = d.uint64()
+	tx.Fee = d.uint64()
+	tx.Nonce = d.uint64()
+	for _, v := range txVersionsUpTo(tx.Version) {
+		v.Decode(d, &tx)
+	}
+	return tx
+}
+
+// Decodes a block from the canonical encoding.
+func DecodeRawBlock(buf []byte) (RawBlock, error) {
+	d := &decoder{buf: buf}
+	b := RawBlock{}
+	b.ParentHash = d.bytes32()
+	b.ParentTotalWork = d.bytes32()
+	b.Difficulty = d.bytes32()
+	b.Timestamp = d.uint64()
+	b.NumTransactions = d.uint64()
+	b.TransactionsMerkleRoot = d.bytes32()
+	b.Nonce = d.bytes32()
+	b.Graffiti = d.bytes32()
+	if d.err != nil {
+		return RawBlock{}, d.err
+	}
+	b.Transactions = []RawTransaction{}
+
+	// A block without transactions has the extension if there are bytes left.
+	if b.NumTransactions == 0 {
+		switch len(d.buf) {
+		case 0:
+			return b, nil
+		case BLOCK_HEADER_EXTENSION_SIZE, BLOCK_HEADER_HISTORY_EXTENSION_SIZE:
+			if err := d.headerExtension(&b, len(d.buf)); err != nil {
+				return RawBlock{}, err
+			}
+			return b, nil
+		}
+		return RawBlock{}, fmt.Errorf("Unexpected %d bytes after block header.", len(d.buf))
+	}
+
+	// Otherwise, read the transactions without the extension, then with each size of it, and take whichever matches the
+	// merkle root.
+	body := d.buf
+	txs, err := decodeTransactions(body, b.NumTransactions, b.TransactionsMerkleRoot)
+	if err == nil {
+		b.Transactions = txs
+		return b, nil
+	}
+	for _, size := range []int{BLOCK_HEADER_EXTENSION_SIZE, BLOCK_HEADER_HISTORY_EXTENSION_SIZE} {
+		if len(body) < size {
+			break
+		}
+		txs, errWithExtension := decodeTransactions(body[size:], b.NumTransactions, b.TransactionsMerkleRoot)
+		if errWithExtension != nil {
+			continue
+		}
+		d.buf = body[:size]
+		if err := d.headerExtension(&b, size); err != nil {
+			return RawBlock{}, err
+		}
+		b.Transactions = txs
+		return b, nil
+	}
+	return RawBlock{}, err
+}
+
+func (d *decoder) headerExtension(b *RawBlock, size int) error {
+	b.BaseFee = d.uint64()
+	b.Version = d.uint32()
+	if size == BLOCK_HEADER_HISTORY_EXTENSION_SIZE {
+		b.HistoryRoot = d.bytes32()
+		if b.HistoryRoot == [32]byte{} {
+			return fmt.Errorf("Non-canonical block header: the history root must be omitted when empty.")
+		}
+		return nil
+	}
+	if b.BaseFee == 0 && b.Version == 0 {
+		return fmt.Errorf("Non-canonical block header: the extension must be omitted when empty.")
+	}
+	return nil
+}
+
+func decodeTransactions(buf []byte, n uint64, merkleRoot [32]byte) ([]RawTransaction, error) {
+	// Each transaction is at least TX_BASE_SIZE bytes, which bounds the allocation.
+	if uint64(len(buf))/TX_BASE_SIZE < n {
+		return nil, fmt.Errorf("Block too short for %d transactions.", n)
+	}
+	d := &decoder{buf: buf}
+	txs := make([]RawTransaction, 0, n)
+	envelopes := [][]byte{}
+	for i := uint64(0); i < n; i++ {
+		tx := d.transaction()
+		if d.err != nil {
+			return nil, fmt.Errorf("Transaction %d: %s", i, d.err)
+		}
+		txs = append(txs, tx)
+		envelopes = append(envelopes, tx.Envelope())
+	}
+	if len(d.buf) != 0 {
+		return nil, fmt.Errorf("Unexpected %d bytes after transactions.", len(d.buf))
+	}
+	if core.ComputeMerkleHash(envelopes) != merkleRoot {
+		return nil, fmt.Errorf("Transactions do not match the merkle root.")
+	}
+	return txs, nil
+}
@@ -0,0 +1,212 @@
+package nakamoto
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The test vectors in testdata/encoding_vectors.json, with byte fields in hex.
+type encodingVector struct {
+	Name        string       `json:"name"`
+	Transaction *vectorTx    `json:"transaction,omitempty"`
+	Block       *vectorBlock `json:"block,omitempty"`
+	Encoding    string       `json:"encoding"`
+	Hash        string       `json:"hash"`
+}
+
+type vectorTx struct {
+	Version   byte             `json:"version"`
+	Sig       string           `json:"sig"`
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Amount    uint64           `json:"amount"`
+	Fee       uint64           `json:"fee"`
+	Nonce     uint64           `json:"nonce"`
+	Predicate string           `json:"predicate,omitempty"`
+	Witness   string           `json:"witness,omitempty"`
+	TokenOp   byte             `json:"token_op,omitempty"`
+	Token     string           `json:"token,omitempty"`
+	Inputs    []vectorOutpoint `json:"inputs,omitempty"`
+}
+
+type vectorOutpoint struct {
+	TxHash string `json:"tx_hash"`
+	Index  uint32 `json:"index"`
+}
+
+type vectorBlock struct {
+	ParentHash             string     `json:"parent_hash"`
+	ParentTotalWork        string     `json:"parent_total_work"`
+	Difficulty             string     `json:"difficulty"`
+	Timestamp              uint64     `json:"timestamp"`
+	NumTransactions        uint64     `json:"num_transactions"`
+	TransactionsMerkleRoot string     `json:"transactions_merkle_root"`
+	Nonce                  string     `json:"nonce"`
+	Graffiti               string     `json:"graffiti"`
+	BaseFee                uint64     `json:"base_fee,omitempty"`
+	Version                uint32     `json:"version,omitempty"`
+	Transactions           []vectorTx `json:"transactions"`
+}
+
+func decodeHex(t *testing.T, s string, out []byte) []byte {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil {
+		copy(out, buf)
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	return buf
+}
+
+func (v vectorTx) toRawTransaction(t *testing.T) RawTransaction {
+	tx := RawTransaction{
+		Version:   v.Version,
+		Amount:    v.Amount,
+		Fee:       v.Fee,
+		Nonce:     v.Nonce,
+		Predicate: decodeHex(t, v.Predicate, nil),
+		Witness:   decodeHex(t, v.Witness, nil),
+		TokenOp:   v.TokenOp,
+		Token:     v.Token,
+	}
+	decodeHex(t, v.Sig, tx.Sig[:])
+	decodeHex(t, v.From, tx.FromPubkey[:])
+	decodeHex(t, v.To, tx.ToPubkey[:])
+	for _, input := range v.Inputs {
+		o := Outpoint{Index: input.Index}
+		decodeHex(t, input.TxHash, o.TxHash[:])
+		tx.Inputs = append(tx.Inputs, o)
+	}
+	return tx
+}
+
+func (v vectorBlock) toRawBlock(t *testing.T) RawBlock {
+	b := RawBlock{
+		BlockHeader: BlockHeader{
+			Timestamp:       v.Timestamp,
+			NumTransactions: v.NumTransactions,
+			BaseFee:         v.BaseFee,
+			Version:         v.Version,
+		},
+		Transactions: []RawTransaction{},
+	}
+	decodeHex(t, v.ParentHash, b.ParentHash[:])
+	decodeHex(t, v.ParentTotalWork, b.ParentTotalWork[:])
+	decodeHex(t, v.Difficulty, b.Difficulty[:])
+	decodeHex(t, v.TransactionsMerkleRoot, b.TransactionsMerkleRoot[:])
+	decodeHex(t, v.Nonce, b.Nonce[:])
+	decodeHex(t, v.Graffiti, b.Graffiti[:])
+	for _, tx := range v.Transactions {
+		b.Transactions = append(b.Transactions, tx.toRawTransaction(t))
+	}
+	return b
+}
+
+func TestEncodingVectors(t *testing.T) {
+	assert := assert.New(t)
+
+	buf, err := os.ReadFile("testdata/encoding_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vectors := []encodingVector{}
+	if err := json.Unmarshal(buf, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(8, len(vectors))
+
+	for _, v := range vectors {
+		encoding := decodeHex(t, v.Encoding, nil)
+		if v.Transaction != nil {
+			tx := v.Transaction.toRawTransaction(t)
+			assert.Equal(v.Encoding, hex.EncodeToString(tx.Bytes()), v.Name)
+			assert.Equal(uint64(len(encoding)), tx.EncodedSizeBytes(), v.Name)
+			hash := tx.Hash()
+			assert.Equal(v.Hash, hex.EncodeToString(hash[:]), v.Name)
+
+			decoded, err := DecodeRawTransaction(encoding)
+			assert.Nil(err, v.Name)
+			assert.Equal(tx, decoded, v.Name)
+		} else {
+			b := v.Block.toRawBlock(t)
+			assert.Equal(v.Encoding, hex.EncodeToString(b.Bytes()), v.Name)
+			assert.Equal(uint64(len(encoding)), b.SizeBytes(), v.Name)
+			hash := b.Hash()
+			assert.Equal(v.Hash, hex.EncodeToString(hash[:]), v.Name)
+
+			decoded, err := DecodeRawBlock(encoding)
+			assert.Nil(err, v.Name)
+			assert.Equal(b, decoded, v.Name)
+		}
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	tx := MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 100, &wallets[0], 1)
+	buf := tx.Bytes()
+
+	_, err := DecodeRawTransaction(buf[:len(buf)-1])
+	assert.EqualError(err, "Unexpected end of data: need 8 bytes, have 7.")
+	_, err = DecodeRawTransaction(append(buf, 0))
+	assert.EqualError(err, "Unexpected 1 bytes after transaction.")
+	buf[0] = LatestTxVersion() + 1
+	_, err = DecodeRawTransaction(buf)
+	assert.EqualError(err, "Unsupported transaction version: 5")
+
+	// The header extension must be omitted when empty.
+	b := RawBlock{Transactions: []RawTransaction{}}
+	_, err = DecodeRawBlock(append(b.Bytes(), make([]byte, BLOCK_HEADER_EXTENSION_SIZE)...))
+	assert.EqualError(err, "Non-canonical block header: the extension must be omitted when empty.")
+	_, err = DecodeRawBlock(append(b.Bytes(), make([]byte, BLOCK_HEADER_HISTORY_EXTENSION_SIZE)...))
+	assert.EqualError(err, "Non-canonical block header: the history root must be omitted when empty.")
+
+	// The transactions must match the merkle root.
+	b.NumTransactions = 1
+	b.Transactions = []RawTransaction{tx}
+	_, err = DecodeRawBlock(b.Bytes())
+	assert.EqualError(err, "Transactions do not match the merkle root.")
+}
+
+func TestRawBlockHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, err := newValidTx(t)
+	if err != nil {
+		t.Fatalf("Failed to create tx: %s", err)
+	}
+	b := RawBlock{
+		BlockHeader: BlockHeader{
+			ParentHash:      [32]byte{1},
+			Timestamp:       1234,
+			NumTransactions: 1,
+			BaseFee:         10,
+		},
+		Transactions: []RawTransaction{tx},
+	}
+
+	// The block hash is the header hash, and the block is its header followed by its transactions.
+	header := b.Header()
+	assert.Equal(b.Hash(), header.BlockHash())
+	assert.Equal(header.Bytes(), b.Bytes()[:len(header.Bytes())])
+	assert.Equal(uint64(len(header.Bytes())+len(tx.Bytes())), b.SizeBytes())
+
+	// The header fields are flattened into the block when encoded.
+	buf, err := json.Marshal(b)
+	assert.Nil(err)
+	fields := map[string]any{}
+	assert.Nil(json.Unmarshal(buf, &fields))
+	assert.Contains(fields, "parent_hash")
+	assert.Contains(fields, "transactions")
+	assert.NotContains(fields, "BlockHeader")
+}
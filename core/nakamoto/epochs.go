@@ -0,0 +1,116 @@
+package nakamoto
+
+import (
+	"database/sql"
+	"fmt"
+	"math/big"
+)
+
+// Difficulty epochs are resolved per branch. Every EpochLengthBlocks blocks, the block at the boundary starts a new
+// epoch, with a difficulty retargeted from the timestamps and difficulty of the previous epoch on its branch.
+//
+// When competing blocks claim the same boundary height on different branches, each starts its own epoch, identified by
+// its height and hash (see GetIdForEpoch), and each epoch records the epoch before it on its branch (parent_epoch).
+// A block's epoch is always resolved from its parent's epoch, never by height, so the descendants of each competing
+// block are validated against their own branch's difficulty, whichever branch is the main chain.
+//
+// The parent's epoch is checked to be on the parent's branch: it must be started by the parent, if the parent is on a
+// boundary, or else be the epoch of the parent's own parent. Since every block is checked when it's ingested, this
+// links each block's epoch to its branch.
+//
+// Each block's header claims the difficulty of its epoch, so a peer's claimed work can be spot-checked from its headers
+// alone (see VerifyWorkSamples). Blocks mined before headers claimed their difficulty have a zero difficulty, which
+// claims nothing and is accepted.
+//
+// An epoch is only stored once the block starting it has been validated, in the same transaction as the block, so a
+// block which fails validation doesn't leave its epoch behind. Storing an epoch which already exists is a no-op.
+
+// Resolves the epoch of a block, given its parent: the parent's epoch, or a new epoch started by the block on an
+// epoch boundary. Returns whether the epoch is new.
+func (dag *BlockDAG) resolveEpoch(parent Block, hash [32]byte, timestamp uint64) (*Epoch, bool, error) {
+	parentEpoch, err := dag.GetEpochForBlockHash(parent.Hash)
+	if err != nil {
+		return nil, false, err
+	}
+	if parentEpoch == nil {
+		return nil, false, fmt.Errorf("Parent block epoch not found.")
+	}
+	if err := dag.verifyBlockEpoch(parent, *parentEpoch); err != nil {
+		return nil, false, err
+	}
+
+	epochLength := dag.consensus.EpochLengthBlocks
+	height := parent.Height + 1
+	if height%epochLength != 0 {
+		return parentEpoch, false, nil
+	}
+
+	dag.log.Printf("Recomputing difficulty for epoch %d\n", height/epochLength)
+	epoch := &Epoch{
+		Number:         height / epochLength,
+		ParentId:       parentEpoch.Id,
+		StartBlockHash: hash,
+		StartTime:      timestamp,
+		StartHeight:    height,
+		Difficulty:     RecomputeDifficulty(parentEpoch.StartTime, timestamp, parentEpoch.Difficulty, dag.consensus.TargetEpochLengthMillis, epochLength, height),
+	}
+	epoch.Id = epoch.GetId()
+	return epoch, true, nil
+}
+
+// Verifies a block's epoch is on its branch: started by the block on an epoch boundary, or else its parent's epoch.
+func (dag *BlockDAG) verifyBlockEpoch(block Block, epoch Epoch) error {
+	if block.Height%dag.consensus.EpochLengthBlocks == 0 {
+		if epoch.StartBlockHash != block.Hash || epoch.StartHeight != block.Height {
+			return fmt.Errorf("Epoch %s of block %x is not started by the block, which is on an epoch boundary.", epoch.Id, block.Hash)
+		}
+		return nil
+	}
+	parentEpoch, err := dag.GetEpochForBlockHash(block.ParentHash)
+	if err != nil {
+		return err
+	}
+	if parentEpoch.Id != epoch.Id {
+		return fmt.Errorf("Epoch %s of block %x is not its parent's epoch %s.", epoch.Id, block.Hash, parentEpoch.Id)
+	}
+	return nil
+}
+
+// Encodes a difficulty target as claimed in a block header. A target of 2^256 or more is met by any hash, and is
+// claimed as the largest target that fits.
+func EncodeDifficulty(target big.Int) [32]byte {
+	if 256 < target.BitLen() {
+		max := new(big.Int).Lsh(big.NewInt(1), 256)
+		target = *max.Sub(max, big.NewInt(1))
+	}
+	return BigIntToBytes32(target)
+}
+
+// Verifies the difficulty claimed by a block's header is its epoch's difficulty, unless it claims none.
+func verifyClaimedDifficulty(claimed [32]byte, epoch Epoch) error {
+	if claimed == [32]byte{} {
+		return nil
+	}
+	if expected := EncodeDifficulty(epoch.Difficulty); claimed != expected {
+		return fmt.Errorf("Block claims difficulty %x, but its epoch's difficulty is %x.", claimed, expected)
+	}
+	return nil
+}
+
+// Stores an epoch, unless it already exists.
+func insertEpoch(tx *sql.Tx, epoch Epoch) error {
+	var parentId interface{}
+	if epoch.ParentId != "" {
+		parentId = epoch.ParentId
+	}
+	_, err := tx.Exec(
+		"insert or ignore into epochs (id, start_block_hash, start_time, start_height, difficulty, parent_epoch) values (?, ?, ?, ?, ?, ?)",
+		epoch.GetId(),
+		epoch.StartBlockHash[:],
+		epoch.StartTime,
+		epoch.StartHeight,
+		epoch.Difficulty.Bytes(),
+		parentId,
+	)
+	return err
+}
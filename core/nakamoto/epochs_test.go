@@ -0,0 +1,140 @@
+package nakamoto
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompetingEpochBoundaryBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, conf, _ := newBlockdagForMiner()
+	clock := NewSimClock(time.UnixMilli(1719379532750))
+	dag.Clock = clock
+	dag.FinalityDepth = 0
+	wallets := getTestingWallets(t)
+	genesisEpoch, err := dag.GetEpochForBlockHash(dag.FullTip.Hash)
+	assert.Nil(err)
+
+	miner := NewMiner(dag, &wallets[0])
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mine := func(interval time.Duration) Block {
+		clock.Advance(interval)
+		miner.Start(1)
+		return dag.FullTip
+	}
+
+	// Mine up to the first epoch boundary, at height 5.
+	for i := 0; i < 4; i++ {
+		mine(time.Second)
+	}
+
+	// Two blocks claim the boundary on competing branches, with different timestamps.
+	a5 := mine(time.Second)
+	assert.Nil(dag.InvalidateBlock(a5.Hash))
+	b5 := mine(time.Minute)
+	assert.Equal(uint64(5), b5.Height)
+
+	// Each starts its own epoch, retargeted from its own timestamp.
+	epochA, err := dag.GetEpochForBlockHash(a5.Hash)
+	assert.Nil(err)
+	epochB, err := dag.GetEpochForBlockHash(b5.Hash)
+	assert.Nil(err)
+	assert.NotEqual(epochA.Id, epochB.Id)
+	assert.Equal(uint64(1), epochA.Number)
+	assert.Equal(genesisEpoch.Id, epochA.ParentId)
+	assert.Equal(genesisEpoch.Id, epochB.ParentId)
+	expectedA := RecomputeDifficulty(genesisEpoch.StartTime, a5.Timestamp, genesisEpoch.Difficulty, conf.TargetEpochLengthMillis, conf.EpochLengthBlocks, 5)
+	expectedB := RecomputeDifficulty(genesisEpoch.StartTime, b5.Timestamp, genesisEpoch.Difficulty, conf.TargetEpochLengthMillis, conf.EpochLengthBlocks, 5)
+	storedDifficulty := func(id string) []byte {
+		difficulty := []byte{}
+		assert.Nil(dag.db.QueryRow("select difficulty from epochs where id = ?", id).Scan(&difficulty))
+		return difficulty
+	}
+	assert.Equal(expectedA.Bytes(), storedDifficulty(epochA.Id))
+	assert.Equal(expectedB.Bytes(), storedDifficulty(epochB.Id))
+	assert.NotEqual(epochA.Difficulty.String(), epochB.Difficulty.String())
+
+	// The descendants of each are in their own branch's epoch.
+	b6 := mine(time.Second)
+	epoch, err := dag.GetEpochForBlockHash(b6.Hash)
+	assert.Nil(err)
+	assert.Equal(epochB.Id, epoch.Id)
+	assert.Nil(dag.ReconsiderBlock(a5.Hash))
+	assert.Nil(dag.InvalidateBlock(b5.Hash))
+	assert.Equal(a5.Hash, dag.FullTip.Hash)
+	a6 := mine(time.Second)
+	epoch, err = dag.GetEpochForBlockHash(a6.Hash)
+	assert.Nil(err)
+	assert.Equal(epochA.Id, epoch.Id)
+
+	// Each branch lists its own epochs.
+	epochs, err := dag.GetBranchEpochs(a6.Hash, 0)
+	assert.Nil(err)
+	assert.Equal([]string{epochA.Id, genesisEpoch.Id}, []string{epochs[0].Id, epochs[1].Id})
+	epochs, err = dag.GetBranchEpochs(b6.Hash, 0)
+	assert.Nil(err)
+	assert.Equal([]string{epochB.Id, genesisEpoch.Id}, []string{epochs[0].Id, epochs[1].Id})
+	epochs, err = dag.GetBranchEpochs(b6.Hash, 5)
+	assert.Nil(err)
+	assert.Equal(1, len(epochs))
+
+	// A block whose recorded epoch isn't on its branch is caught when it's built on.
+	_, err = dag.db.Exec("update blocks set epoch = ? where hash = ?", epochB.Id, a6.Hash[:])
+	assert.Nil(err)
+	dag.blockCache.clear()
+	_, _, err = dag.resolveEpoch(a6, [32]byte{}, a6.Timestamp)
+	assert.ErrorContains(err, "is not its parent's epoch")
+}
+
+func TestRecomputeDifficultyTimestampsOutOfOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	// An epoch which ends before it starts is clamped to the shortest duration, rather than underflowing to the
+	// longest.
+	difficulty := *big.NewInt(1_000_000)
+	clamped := RecomputeDifficulty(1000, 1000, difficulty, 1, 1, 1)
+	outOfOrder := RecomputeDifficulty(1000, 999, difficulty, 1, 1, 1)
+	assert.Equal(clamped.String(), outOfOrder.String())
+	assert.Equal("1000000", clamped.String())
+}
+
+func TestBlockClaimsEpochDifficulty(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForMiner()
+	wallets := getTestingWallets(t)
+	epoch, err := dag.GetEpochForBlockHash(dag.FullTip.Hash)
+	assert.Nil(err)
+
+	// Mined blocks claim their epoch's difficulty.
+	miner := NewMiner(dag, &wallets[0])
+	mined := []RawBlock{}
+	miner.OnBlockSolution = func(block RawBlock) {
+		mined = append(mined, block)
+	}
+	miner.Start(1)
+	assert.Equal(EncodeDifficulty(epoch.Difficulty), mined[0].Difficulty)
+
+	// Blocks claiming another difficulty are rejected.
+	claimed := mined[0]
+	claimed.Difficulty = [32]byte{31: 1}
+	assert.ErrorContains(dag.IngestBlock(claimed), "claims difficulty")
+	assert.ErrorContains(dag.IngestHeader(claimed.BlockHeader), "claims difficulty")
+	assert.ErrorIs(dag.PrecheckBlockPOW(claimed), ErrBlockPOWInvalid)
+	assert.Nil(dag.IngestBlock(mined[0]))
+
+	// Targets too large to encode are claimed as the largest.
+	huge := new(big.Int).Lsh(big.NewInt(1), 300)
+	encoded := EncodeDifficulty(*huge)
+	for _, b := range encoded {
+		assert.Equal(byte(0xff), b)
+	}
+}
@@ -0,0 +1,277 @@
+package nakamoto
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The event journal is a persistent, append-only log of the changes to the main chain, for downstream systems which
+// must process each of them exactly once, ie. an exchange crediting deposits. Notifications from the publisher are
+// dropped when a subscriber is disconnected or slow (see publisher.go), whereas the journal is stored in the database
+// and can be read back from any point.
+//
+// Each event has a sequence number, which increases with each event, and is never reused. A consumer stores the
+// sequence number of the last event it processed atomically with the effects of processing it, and after a restart or
+// a disconnect, resumes by reading the events after it (GetEvents, or the getevents RPC method). The events are:
+// - block: a block connected to the main chain.
+// - tx_confirmed: a transaction included in the main chain, following the event of its block.
+// - reorg: blocks disconnected from the main chain, and the transactions they confirmed, which are no longer confirmed.
+//   Followed by the events of the blocks of the new main chain.
+//
+// The journal is updated with each new full tip, from the last tip it recorded, so events are journaled even if the
+// node stopped before it could record them. An empty journal starts at the tip it was first updated from. Events are
+// never deleted.
+
+const (
+	EVENT_BLOCK        = "block"
+	EVENT_TX_CONFIRMED = "tx_confirmed"
+	EVENT_REORG        = "reorg"
+
+	// The maximum number of events returned by GetEvents.
+	MAX_GET_EVENTS = 1000
+)
+
+type ChainEvent struct {
+	Seq  uint64
+	Type string
+	Time time.Time
+	// The block connected, the block the transaction was confirmed in, or the new tip of a reorg.
+	BlockHash [32]byte
+	Height    uint64
+	// Set for tx_confirmed events.
+	Tx *TxConfirmedEvent
+	// Set for reorg events.
+	Reorg *ReorgEvent
+}
+
+type TxConfirmedEvent struct {
+	Hash [32]byte
+	// The index of the transaction in its block.
+	Index  uint64
+	From   [65]byte
+	To     [65]byte
+	Amount uint64
+	Fee    uint64
+}
+
+type ReorgEvent struct {
+	OldTip     [32]byte
+	ForkPoint  [32]byte
+	ForkHeight uint64
+	// The number of blocks disconnected.
+	Depth uint64
+	// The blocks disconnected, and the transactions in them, newest first.
+	Disconnected [][32]byte
+	Unconfirmed  [][32]byte
+}
+
+// Returns the sequence number of the last event, or 0 if the journal is empty.
+func (dag *BlockDAG) GetLatestEventSeq() (uint64, error) {
+	seq := uint64(0)
+	err := dag.db.QueryRow("select coalesce(max(seq), 0) from events").Scan(&seq)
+	return seq, err
+}
+
+// Returns the events after a sequence number, oldest first, up to limit of them.
+func (dag *BlockDAG) GetEvents(after uint64, limit uint64) ([]ChainEvent, error) {
+	if limit == 0 || MAX_GET_EVENTS < limit {
+		return nil, fmt.Errorf("Limit must be between 1 and %d.", MAX_GET_EVENTS)
+	}
+	rows, err := dag.db.Query(
+		"select seq, type, block_hash, height, data, time from events where ? < seq order by seq asc limit ?",
+		after, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []ChainEvent{}
+	for rows.Next() {
+		event := ChainEvent{}
+		blockHash, data := []byte{}, []byte{}
+		timeMillis := int64(0)
+		if err := rows.Scan(&event.Seq, &event.Type, &blockHash, &event.Height, &data, &timeMillis); err != nil {
+			return nil, err
+		}
+		copy(event.BlockHash[:], blockHash)
+		event.Time = time.UnixMilli(timeMillis)
+		switch event.Type {
+		case EVENT_TX_CONFIRMED:
+			event.Tx = &TxConfirmedEvent{}
+			err = json.Unmarshal(data, event.Tx)
+		case EVENT_REORG:
+			event.Reorg = &ReorgEvent{}
+			err = json.Unmarshal(data, event.Reorg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode event %d: %s", event.Seq, err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// Returns the tip the journal was last updated to, or nil if the journal is empty.
+func (dag *BlockDAG) getEventJournalTip() (*[32]byte, error) {
+	buf := []byte{}
+	err := dag.db.QueryRow(
+		"select block_hash from events where type in (?, ?) order by seq desc limit 1", EVENT_BLOCK, EVENT_REORG,
+	).Scan(&buf)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	tip := [32]byte{}
+	copy(tip[:], buf)
+	return &tip, nil
+}
+
+// Journals the changes to the main chain since the journal's tip, or since prevTip if the journal is empty.
+func (dag *BlockDAG) updateEventJournal(prevTip Block) error {
+	tip := dag.FullTip
+	journalTip, err := dag.getEventJournalTip()
+	if err != nil {
+		return err
+	}
+	if journalTip == nil {
+		journalTip = &prevTip.Hash
+	}
+	if *journalTip == tip.Hash {
+		return nil
+	}
+	last, err := dag.GetBlockByHash(*journalTip)
+	if err != nil {
+		return err
+	}
+	if last == nil {
+		return fmt.Errorf("Journal tip not found: %x", *journalTip)
+	}
+	ancestor, err := dag.GetCommonAncestor(tip.Hash, last.Hash)
+	if err != nil {
+		return err
+	}
+
+	// Times are stored to the millisecond.
+	now := dag.clock().Now().Truncate(time.Millisecond)
+	events := []ChainEvent{}
+
+	// The blocks disconnected from the main chain.
+	if ancestor.Hash != last.Hash {
+		reorg := &ReorgEvent{
+			OldTip:       last.Hash,
+			ForkPoint:    ancestor.Hash,
+			ForkHeight:   ancestor.Height,
+			Depth:        last.Height - ancestor.Height,
+			Disconnected: [][32]byte{},
+			Unconfirmed:  [][32]byte{},
+		}
+		for block := last; block.Hash != ancestor.Hash; {
+			reorg.Disconnected = append(reorg.Disconnected, block.Hash)
+			txs, err := dag.GetBlockTransactions(block.Hash)
+			if err != nil {
+				return err
+			}
+			for i := len(*txs) - 1; 0 <= i; i-- {
+				reorg.Unconfirmed = append(reorg.Unconfirmed, (*txs)[i].Hash)
+			}
+			block, err = dag.GetBlockByHash(block.ParentHash)
+			if err != nil {
+				return err
+			}
+			if block == nil {
+				return fmt.Errorf("Parent of disconnected block not found.")
+			}
+		}
+		events = append(events, ChainEvent{
+			Type:      EVENT_REORG,
+			Time:      now,
+			BlockHash: tip.Hash,
+			Height:    tip.Height,
+			Reorg:     reorg,
+		})
+	}
+
+	// The blocks connected to the main chain.
+	connected, err := dag.getMainChainBlocks(ancestor.Height+1, tip.Height)
+	if err != nil {
+		return err
+	}
+	for _, block := range connected {
+		events = append(events, ChainEvent{
+			Type:      EVENT_BLOCK,
+			Time:      now,
+			BlockHash: block.Hash,
+			Height:    block.Height,
+		})
+		txs, err := dag.GetBlockTransactions(block.Hash)
+		if err != nil {
+			return err
+		}
+		for i, tx := range *txs {
+			events = append(events, ChainEvent{
+				Type:      EVENT_TX_CONFIRMED,
+				Time:      now,
+				BlockHash: block.Hash,
+				Height:    block.Height,
+				Tx: &TxConfirmedEvent{
+					Hash:   tx.Hash,
+					Index:  uint64(i),
+					From:   tx.FromPubkey,
+					To:     tx.ToPubkey,
+					Amount: tx.Amount,
+					Fee:    tx.Fee,
+				},
+			})
+		}
+	}
+
+	if err := dag.appendEvents(events); err != nil {
+		return err
+	}
+	if dag.OnEvent != nil {
+		for _, event := range events {
+			dag.OnEvent(event)
+		}
+	}
+	return nil
+}
+
+// Appends events to the journal in one transaction, setting their sequence numbers.
+func (dag *BlockDAG) appendEvents(events []ChainEvent) error {
+	tx, err := dag.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i, event := range events {
+		var data []byte
+		var txHash []byte
+		if event.Tx != nil {
+			data, err = json.Marshal(event.Tx)
+			txHash = event.Tx.Hash[:]
+		} else if event.Reorg != nil {
+			data, err = json.Marshal(event.Reorg)
+		}
+		if err != nil {
+			return err
+		}
+		res, err := tx.Exec(
+			"insert into events (type, block_hash, height, tx_hash, data, time) values (?, ?, ?, ?, ?, ?)",
+			event.Type, event.BlockHash[:], event.Height, txHash, data, event.Time.UnixMilli(),
+		)
+		if err != nil {
+			return err
+		}
+		seq, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		events[i].Seq = uint64(seq)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,93 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventJournal(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	hashes := [][32]byte{dag.FullTip.Hash}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+	delivered := []ChainEvent{}
+	dag.OnEvent = func(event ChainEvent) {
+		delivered = append(delivered, event)
+	}
+
+	// Each block is followed by its coinbase transaction.
+	miner.Start(3)
+	events, err := dag.GetEvents(0, MAX_GET_EVENTS)
+	assert.Nil(err)
+	assert.Equal(6, len(events))
+	assert.Equal(events, delivered)
+	for i, event := range events {
+		assert.Equal(uint64(i+1), event.Seq)
+		assert.Equal(hashes[i/2+1], event.BlockHash)
+		assert.Equal(uint64(i/2+1), event.Height)
+		if i%2 == 0 {
+			assert.Equal(EVENT_BLOCK, event.Type)
+			assert.Nil(event.Tx)
+		} else {
+			assert.Equal(EVENT_TX_CONFIRMED, event.Type)
+			assert.Equal(uint64(0), event.Tx.Index)
+			assert.Equal(minerWallet.PubkeyBytes(), event.Tx.To)
+		}
+	}
+
+	// A consumer resumes after the last event it processed.
+	page, err := dag.GetEvents(3, 2)
+	assert.Nil(err)
+	assert.Equal(events[3:5], page)
+	_, err = dag.GetEvents(0, 0)
+	assert.NotNil(err)
+
+	// A reorg lists the blocks and transactions it disconnected, newest first.
+	assert.Nil(dag.InvalidateBlock(hashes[2]))
+	events, err = dag.GetEvents(6, MAX_GET_EVENTS)
+	assert.Nil(err)
+	assert.Equal(1, len(events))
+	reorg := events[0]
+	assert.Equal(EVENT_REORG, reorg.Type)
+	assert.Equal(hashes[1], reorg.BlockHash)
+	assert.Equal(hashes[3], reorg.Reorg.OldTip)
+	assert.Equal(hashes[1], reorg.Reorg.ForkPoint)
+	assert.Equal(uint64(2), reorg.Reorg.Depth)
+	assert.Equal([][32]byte{hashes[3], hashes[2]}, reorg.Reorg.Disconnected)
+	assert.Equal([][32]byte{delivered[5].Tx.Hash, delivered[3].Tx.Hash}, reorg.Reorg.Unconfirmed)
+
+	// Followed by the blocks of the new main chain.
+	miner.Start(1)
+	events, err = dag.GetEvents(7, MAX_GET_EVENTS)
+	assert.Nil(err)
+	assert.Equal(2, len(events))
+	assert.Equal(EVENT_BLOCK, events[0].Type)
+	assert.Equal(hashes[4], events[0].BlockHash)
+	assert.Equal(uint64(2), events[0].Height)
+
+	// Events the node stopped before recording are journaled from the journal's tip, with new sequence numbers.
+	_, err = dag.db.Exec("delete from events where 7 < seq")
+	assert.Nil(err)
+	assert.Nil(dag.updateEventJournal(dag.FullTip))
+	events, err = dag.GetEvents(7, MAX_GET_EVENTS)
+	assert.Nil(err)
+	assert.Equal(2, len(events))
+	assert.Equal(uint64(10), events[0].Seq)
+	assert.Equal(hashes[4], events[0].BlockHash)
+	latest, err := dag.GetLatestEventSeq()
+	assert.Nil(err)
+	assert.Equal(uint64(11), latest)
+}
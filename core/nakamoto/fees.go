@@ -0,0 +1,70 @@
+package nakamoto
+
+// The fee market (EIP-1559 style).
+//
+// When enabled (ConsensusConfig.InitialBaseFee is non-zero), each block carries a base fee per byte, which is adjusted
+// from the parent's base fee according to how full the parent block was. If the parent used more than the target block
+// size (half the maximum), the base fee increases by up to 1/8th; if it used less, the base fee decreases by up to 1/8th.
+//
+// Every transaction must pay at least the base fee for its size. The base fee portion of the fee is burned, and only
+// the remainder (the tip) goes to the miner. Since miners can't collect the base fee, they can't cheaply pad blocks with
+// their own transactions to drive it up, and users can estimate the fee needed for inclusion from the base fee alone.
+//
+// Block fullness is measured from the number of transactions in the block header, so the base fee can be validated
+// during headers-first sync, before the parent's body is downloaded.
+
+const (
+	// The maximum change of the base fee between blocks is 1/BASE_FEE_MAX_CHANGE_DENOMINATOR.
+	BASE_FEE_MAX_CHANGE_DENOMINATOR = 8
+	// The target block size is the maximum block size divided by the elasticity multiplier.
+	BLOCK_ELASTICITY_MULTIPLIER = 2
+	// The base fee never drops below this, so it can always increase again.
+	MIN_BASE_FEE = 1
+)
+
+// Computes the base fee of a block from its parent's base fee and number of transactions.
+func CalculateBaseFee(parentBaseFee uint64, parentNumTransactions uint64, maxBlockSizeBytes uint64) uint64 {
+	txSize := (&RawTransaction{}).SizeBytes()
+	used := parentNumTransactions * txSize
+	target := maxBlockSizeBytes / BLOCK_ELASTICITY_MULTIPLIER
+	if target == 0 {
+		return parentBaseFee
+	}
+
+	baseFee := parentBaseFee
+	if target < used {
+		delta := parentBaseFee * (used - target) / target / BASE_FEE_MAX_CHANGE_DENOMINATOR
+		baseFee += max(delta, 1)
+	} else if used < target {
+		delta := parentBaseFee * (target - used) / target / BASE_FEE_MAX_CHANGE_DENOMINATOR
+		baseFee -= delta
+	}
+	return max(baseFee, MIN_BASE_FEE)
+}
+
+// Returns whether the fee market is enabled.
+func (dag *BlockDAG) FeeMarketEnabled() bool {
+	return dag.consensus.InitialBaseFee != 0
+}
+
+// Returns the base fee of a child of the given block. Returns 0 if the fee market is disabled.
+func (dag *BlockDAG) GetNextBaseFee(parent Block) uint64 {
+	if !dag.FeeMarketEnabled() {
+		return 0
+	}
+	return CalculateBaseFee(parent.BaseFee, parent.NumTransactions, dag.consensus.MaxBlockSizeBytes)
+}
+
+// Estimates the highest base fee of the next `blocks` blocks after the given block, assuming every block is full. A
+// transaction paying this fee per byte will remain includable for at least that many blocks.
+func (dag *BlockDAG) EstimateMaxBaseFee(parent Block, blocks uint64) uint64 {
+	if !dag.FeeMarketEnabled() {
+		return 0
+	}
+	baseFee := dag.GetNextBaseFee(parent)
+	fullBlockTxs := dag.consensus.MaxBlockSizeBytes / (&RawTransaction{}).EncodedSizeBytes()
+	for i := uint64(1); i < blocks; i++ {
+		baseFee = CalculateBaseFee(baseFee, fullBlockTxs, dag.consensus.MaxBlockSizeBytes)
+	}
+	return baseFee
+}
@@ -0,0 +1,100 @@
+package nakamoto
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCalculateBaseFee(t *testing.T) {
+	assert := assert.New(t)
+
+	txSize := (&RawTransaction{}).SizeBytes()
+	maxBlockSize := 8 * txSize
+
+	// At the target (half full), the base fee is unchanged.
+	assert.Equal(uint64(1000), CalculateBaseFee(1000, 4, maxBlockSize))
+	// Full blocks increase it by 1/8th.
+	assert.Equal(uint64(1125), CalculateBaseFee(1000, 8, maxBlockSize))
+	// Empty blocks decrease it by 1/8th.
+	assert.Equal(uint64(875), CalculateBaseFee(1000, 0, maxBlockSize))
+	assert.Equal(uint64(938), CalculateBaseFee(1000, 2, maxBlockSize))
+
+	// It always increases when blocks are over the target, and never drops below the minimum.
+	assert.Equal(uint64(2), CalculateBaseFee(1, 5, maxBlockSize))
+	assert.Equal(uint64(MIN_BASE_FEE), CalculateBaseFee(1, 0, maxBlockSize))
+}
+
+func TestDagFeeMarket(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := OpenDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	genesisDifficulty := new(big.Int)
+	genesisDifficulty.SetString("0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+	txSize := (&RawTransaction{}).SizeBytes()
+	conf := ConsensusConfig{
+		EpochLengthBlocks:       5,
+		TargetEpochLengthMillis: 2000,
+		GenesisDifficulty:       *genesisDifficulty,
+		GenesisParentBlockHash:  HexStringToBytes32("000006b15d1327d67e971d1de9116bd60a3a01556c91b6ebaa416ebc0cfaa646"),
+		MaxBlockSizeBytes:       16 * txSize,
+		InitialBaseFee:          1000,
+	}
+	dag, err := NewBlockDAGFromDB(db, newMockStateMachine(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(dag.FeeMarketEnabled())
+	assert.Equal(uint64(1000), dag.FullTip.BaseFee)
+
+	// Mined blocks only contain the coinbase, so the base fee decreases.
+	wallets := getTestingWallets(t)
+	miner := NewMiner(dag, &wallets[0])
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+	miner.Start(2)
+	assert.Equal(uint64(2), dag.FullTip.Height)
+	parent, err := dag.GetBlockByHash(dag.FullTip.ParentHash)
+	assert.Nil(err)
+	assert.Equal(uint64(1000), dag.GetNextBaseFee(Block{BaseFee: 1000, NumTransactions: 8}))
+	assert.Equal(CalculateBaseFee(parent.BaseFee, 1, conf.MaxBlockSizeBytes), dag.FullTip.BaseFee)
+	assert.Less(dag.FullTip.BaseFee, uint64(1000))
+
+	// A full block would raise the base fee, so a transaction paying the max estimate remains includable.
+	assert.Less(dag.GetNextBaseFee(dag.FullTip), dag.EstimateMaxBaseFee(dag.FullTip, 3))
+
+	// Blocks with the wrong base fee are rejected.
+	coinbase := MakeCoinbaseTx(&wallets[0])
+	raw := RawBlock{
+		BlockHeader: BlockHeader{
+			ParentHash:      dag.FullTip.Hash,
+			ParentTotalWork: BigIntToBytes32(dag.FullTip.AccumulatedWork),
+			Timestamp:       Timestamp(),
+			NumTransactions: 1,
+			BaseFee:         dag.GetNextBaseFee(dag.FullTip) + 1,
+		},
+		Transactions: []RawTransaction{coinbase},
+	}
+	raw.TransactionsMerkleRoot = core.ComputeMerkleHash([][]byte{coinbase.Envelope()})
+	assert.EqualError(dag.IngestBlock(raw), "Base fee is incorrect.")
+
+	// Transactions must pay the base fee.
+	tx, err := newValidTx(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.BaseFee = dag.GetNextBaseFee(dag.FullTip)
+	raw.NumTransactions = 2
+	raw.Transactions = append(raw.Transactions, tx)
+	assert.EqualError(dag.IngestBlock(raw), "Transaction 1 is invalid: fee below base fee.")
+}
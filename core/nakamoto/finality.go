@@ -0,0 +1,220 @@
+package nakamoto
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Blocks FinalityDepth blocks below the full tip are finalized: the node refuses to reorg away from them, even to a
+// heavier chain. This bounds how far an attacker with a majority of the hashrate can rewrite history, and gives
+// exchanges a point after which deposits can be credited without risk of reversal.
+//
+// The finalized block is stored in the database, so it survives restarts, and only ever advances. Each newly finalized
+// block is delivered in order to OnFinalized. When a heavier chain doesn't include the finalized block, the tip is
+// instead the heaviest chain which does. Operators can override this with AllowDeepReorgs, or by invalidating the
+// finalized block or one of its ancestors with InvalidateBlock, which resets the finalized block to the new main chain.
+// A FinalityDepth of zero disables finality.
+
+// The default number of blocks below the full tip at which blocks are finalized.
+const DEFAULT_FINALITY_DEPTH = 100
+
+var ErrDeepReorg = errors.New("reorg is deeper than the finality depth")
+
+// Returns the finalized block, or the genesis block if no block has been finalized yet.
+func (dag *BlockDAG) GetFinalizedBlock() (Block, error) {
+	hashBuf := []byte{}
+	err := dag.db.QueryRow("select hash from finalized_block").Scan(&hashBuf)
+	if err == sql.ErrNoRows {
+		hashBuf = dag.genesisHash()
+	} else if err != nil {
+		return Block{}, err
+	}
+
+	hash := [32]byte{}
+	copy(hash[:], hashBuf)
+	block, err := dag.GetBlockByHash(hash)
+	if err != nil {
+		return Block{}, err
+	}
+	if block == nil {
+		return Block{}, fmt.Errorf("Finalized block not found.")
+	}
+	return *block, nil
+}
+
+func (dag *BlockDAG) genesisHash() []byte {
+	genesis := GetRawGenesisBlockFromConfig(dag.consensus)
+	hash := genesis.Hash()
+	return hash[:]
+}
+
+// Returns whether block descends from, or is, ancestor.
+func (dag *BlockDAG) descendsFrom(block Block, ancestor Block) (bool, error) {
+	if block.Height < ancestor.Height {
+		return false, nil
+	}
+	hashBuf := []byte{}
+	err := dag.db.QueryRow(`
+		with recursive chain(hash, parent_hash, height) as (
+			select hash, parent_hash, height from blocks where hash = ?
+			union all
+			select b.hash, b.parent_hash, b.height from blocks b join chain c on b.hash = c.parent_hash where ? < c.height
+		)
+		select hash from chain where height = ?`,
+		block.Hash[:],
+		ancestor.Height,
+		ancestor.Height,
+	).Scan(&hashBuf)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(hashBuf) == string(ancestor.Hash[:]), nil
+}
+
+// Returns the tip to use in place of the heaviest tip: the heaviest tip itself, unless switching to it would reorg the
+// finalized block, in which case the heaviest tip descending from the finalized block. If full is set, only blocks
+// whose transactions have all been ingested are considered.
+func (dag *BlockDAG) applyFinality(heaviest Block, full bool) (Block, error) {
+	if dag.FinalityDepth == 0 || dag.AllowDeepReorgs {
+		return heaviest, nil
+	}
+	// Extending the current tip, which was already checked, is the common case, ie. during sync.
+	prevTip := dag.HeadersTip
+	if full {
+		prevTip = dag.FullTip
+	}
+	if heaviest.Hash == prevTip.Hash || heaviest.ParentHash == prevTip.Hash {
+		return heaviest, nil
+	}
+	finalized, err := dag.GetFinalizedBlock()
+	if err != nil {
+		return Block{}, err
+	}
+	ok, err := dag.descendsFrom(heaviest, finalized)
+	if err != nil || ok {
+		return heaviest, err
+	}
+
+	// An operator invalidating the finalized block overrides finality.
+	invalid := false
+	if err := dag.db.QueryRow("select invalid from blocks where hash = ?", finalized.Hash[:]).Scan(&invalid); err != nil {
+		return Block{}, err
+	}
+	if invalid {
+		return heaviest, nil
+	}
+
+	tip, err := dag.getHeaviestDescendant(finalized.Hash, full)
+	if err != nil {
+		return Block{}, err
+	}
+	dag.log.Printf("Refusing reorg to height=%d hash=%s: %s (finalized height=%d)\n", heaviest.Height, heaviest.HashStr(), ErrDeepReorg, finalized.Height)
+	return tip, nil
+}
+
+// Returns the heaviest valid block descending from, or being, the given block. If full is set, only blocks whose
+// transactions have all been ingested are considered.
+func (dag *BlockDAG) getHeaviestDescendant(hash [32]byte, full bool) (Block, error) {
+	fullCondition := ""
+	if full {
+		fullCondition = "and b.num_transactions = (select count(*) from transactions_blocks tb where tb.block_hash = b.hash)"
+	}
+	hashBuf := []byte{}
+	err := dag.db.QueryRow(fmt.Sprintf(`
+		with recursive descendants(hash) as (
+			select ?
+			union all
+			select b.hash from blocks b join descendants d on b.parent_hash = d.hash where b.invalid = 0
+		)
+		select b.hash from blocks b join descendants d on b.hash = d.hash
+		where 1 = 1 %s
+		order by b.acc_work desc
+		limit 1`, fullCondition),
+		hash[:],
+	).Scan(&hashBuf)
+	if err != nil {
+		return Block{}, err
+	}
+
+	copy(hash[:], hashBuf)
+	tip, err := dag.GetBlockByHash(hash)
+	if err != nil {
+		return Block{}, err
+	}
+	if tip == nil {
+		return Block{}, fmt.Errorf("Block not found.")
+	}
+	return *tip, nil
+}
+
+// Advances the finalized block to FinalityDepth blocks below the full tip, and delivers the newly finalized blocks to
+// OnFinalized. Called when the full tip changes.
+func (dag *BlockDAG) updateFinalizedBlock() error {
+	if dag.FinalityDepth == 0 {
+		return nil
+	}
+	finalized, err := dag.GetFinalizedBlock()
+	if err != nil {
+		return err
+	}
+	onMainChain, err := dag.descendsFrom(dag.FullTip, finalized)
+	if err != nil {
+		return err
+	}
+
+	tip := dag.FullTip
+	if tip.Height < dag.FinalityDepth {
+		if !onMainChain {
+			return dag.setFinalizedBlock(dag.genesisHash())
+		}
+		return nil
+	}
+	target := tip.Height - dag.FinalityDepth
+
+	if !onMainChain {
+		// The finality was overridden. Restart from the new main chain, without delivering the blocks again.
+		blocks, err := dag.getMainChainBlocks(target, target)
+		if err != nil || len(blocks) == 0 {
+			return err
+		}
+		dag.log.Printf("Finalized block reset: height=%d hash=%s\n", blocks[0].Height, blocks[0].HashStr())
+		return dag.setFinalizedBlock(blocks[0].Hash[:])
+	}
+	if target <= finalized.Height {
+		return nil
+	}
+
+	blocks, err := dag.getMainChainBlocks(finalized.Height+1, target)
+	if err != nil || len(blocks) == 0 {
+		return err
+	}
+	last := blocks[len(blocks)-1]
+	if err := dag.setFinalizedBlock(last.Hash[:]); err != nil {
+		return err
+	}
+	if dag.OnFinalized != nil {
+		for _, block := range blocks {
+			dag.OnFinalized(block)
+		}
+	}
+	return nil
+}
+
+func (dag *BlockDAG) setFinalizedBlock(hash []byte) error {
+	tx, err := dag.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("delete from finalized_block"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("insert into finalized_block (hash) values (?)", hash); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
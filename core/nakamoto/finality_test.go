@@ -0,0 +1,72 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFinality(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+	dag.FinalityDepth = 0
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	hashes := [][32]byte{dag.FullTip.Hash}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+
+	// Mine a main chain of 8 blocks, and a heavier branch of at least 10 blocks forking from block 1, which is set
+	// aside. The work of a block depends on its hash, so the branch is mined until it's heavier.
+	miner.Start(8)
+	mainTip := dag.FullTip
+	assert.Nil(dag.InvalidateBlock(hashes[2]))
+	miner.Start(10)
+	for dag.FullTip.AccumulatedWork.Cmp(&mainTip.AccumulatedWork) <= 0 {
+		miner.Start(1)
+	}
+	branchTip := dag.FullTip
+	assert.Nil(dag.InvalidateBlock(hashes[9]))
+	assert.Nil(dag.ReconsiderBlock(hashes[2]))
+	assert.Equal(hashes[8], dag.FullTip.Hash)
+
+	// Blocks 3 below the tip are finalized, and delivered in order.
+	finalizedHeights := []uint64{}
+	dag.OnFinalized = func(block Block) {
+		finalizedHeights = append(finalizedHeights, block.Height)
+	}
+	dag.FinalityDepth = 3
+	assert.Nil(dag.updateFinalizedBlock())
+	assert.Equal([]uint64{1, 2, 3, 4, 5}, finalizedHeights)
+	finalized, err := dag.GetFinalizedBlock()
+	assert.Nil(err)
+	assert.Equal(hashes[5], finalized.Hash)
+
+	// The heavier branch doesn't include the finalized block, so the node doesn't reorg to it.
+	assert.Nil(dag.ReconsiderBlock(hashes[9]))
+	assert.Equal(hashes[8], dag.FullTip.Hash)
+	assert.Equal(hashes[8], dag.HeadersTip.Hash)
+
+	// Unless deep reorgs are allowed, after which the finalized block is reset to the new main chain.
+	dag.AllowDeepReorgs = true
+	assert.Nil(dag.updateTip())
+	assert.Equal(branchTip.Hash, dag.FullTip.Hash)
+	finalized, err = dag.GetFinalizedBlock()
+	assert.Nil(err)
+	assert.Equal(branchTip.Height-3, finalized.Height)
+	assert.Equal(hashes[len(hashes)-4], finalized.Hash)
+	assert.Equal(5, len(finalizedHeights))
+
+	// The finalized block advances with the tip.
+	miner.Start(1)
+	assert.Equal([]uint64{1, 2, 3, 4, 5, branchTip.Height - 2}, finalizedHeights)
+}
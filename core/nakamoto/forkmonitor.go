@@ -0,0 +1,231 @@
+package nakamoto
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// The fork monitor watches the chain tips for competing branches, and alerts the operator when the main chain may be
+// under attack. It raises an alert when:
+//
+//   - A branch at least AlertDepth blocks deep has at least AlertWorkShare of the work of the main chain since their
+//     fork point. A deep branch with comparable work suggests a miner with a large share of the hashrate is mining in
+//     private, ie. a 51% attack in progress.
+//   - The main chain reorgs by at least AlertDepth blocks, which is what a successful 51% attack looks like.
+//   - A reorg deeper than the DAG's MaxReorgDepth is quarantined, and needs an operator to review it.
+//
+// Alerts are logged, passed to OnAlert, and kept in the status returned by Status (which is exposed over RPC).
+type ForkMonitor struct {
+	dag *BlockDAG
+
+	// Branches and reorgs at least this many blocks deep raise an alert.
+	AlertDepth uint64
+	// Branches with at least this share of the main chain's work since the fork point raise an alert, ie. 0.5 alerts
+	// when the branch has half the work of the main chain.
+	AlertWorkShare float64
+	// How often the chain tips are checked.
+	Interval time.Duration
+
+	OnAlert func(alert ForkAlert)
+
+	status ForkMonitorStatus
+	// Fork points we have already raised an alert for, so a growing branch only alerts once.
+	alertedForks map[[32]byte]bool
+	mutex        sync.Mutex
+	log          *log.Logger
+}
+
+// Fork alert kinds.
+const (
+	FORK_ALERT_COMPETING_BRANCH = "competing-branch"
+	FORK_ALERT_DEEP_REORG       = "deep-reorg"
+	// A reorg deeper than the maximum reorg depth was quarantined. See reorglimit.go.
+	FORK_ALERT_QUARANTINED_REORG = "quarantined-reorg"
+
+	// The number of recent alerts kept in the status.
+	MAX_FORK_ALERTS = 100
+)
+
+type ForkAlert struct {
+	Kind string
+	Time time.Time
+	// The tip of the competing branch, or the new main chain tip after a reorg.
+	Tip [32]byte
+	// The block the branch forks from the main chain, or the common ancestor of the old and new main chain.
+	ForkPoint [32]byte
+	// The length of the branch, or the number of blocks reorged out of the main chain.
+	Depth uint64
+	// The branch's share of the main chain's work since the fork point.
+	WorkShare float64
+	Message   string
+}
+
+type ForkMonitorStatus struct {
+	LastCheck time.Time
+	Tips      []ChainTip
+	// The depth of the most recent reorg of the main chain.
+	LastReorgDepth uint64
+	LastReorgTime  time.Time
+	// Recent alerts, oldest first.
+	Alerts []ForkAlert
+}
+
+func NewForkMonitor(dag *BlockDAG) *ForkMonitor {
+	return &ForkMonitor{
+		dag:            dag,
+		AlertDepth:     6,
+		AlertWorkShare: 0.5,
+		Interval:       1 * time.Minute,
+		alertedForks:   make(map[[32]byte]bool),
+		log:            NewLogger("fork-monitor", ""),
+	}
+}
+
+func (m *ForkMonitor) Start() {
+	for {
+		if err := m.Tick(time.Now()); err != nil {
+			m.log.Printf("Failed to check chain tips: %s\n", err)
+		}
+		time.Sleep(m.Interval)
+	}
+}
+
+// Returns a copy of the monitor's status.
+func (m *ForkMonitor) Status() ForkMonitorStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	status := m.status
+	status.Tips = append([]ChainTip{}, m.status.Tips...)
+	status.Alerts = append([]ForkAlert{}, m.status.Alerts...)
+	return status
+}
+
+// Checks the chain tips for competing branches.
+func (m *ForkMonitor) Tick(now time.Time) error {
+	tips, err := m.dag.GetChainTips()
+	if err != nil {
+		return err
+	}
+	mainTip := m.dag.FullTip
+
+	alerts := []ForkAlert{}
+	m.mutex.Lock()
+	for _, tip := range tips {
+		if tip.Status == CHAIN_TIP_ACTIVE || tip.Status == CHAIN_TIP_INVALID {
+			continue
+		}
+		if tip.BranchLength < m.AlertDepth || m.alertedForks[tip.ForkPoint.Hash] {
+			continue
+		}
+
+		share := workShare(tip.AccumulatedWork, mainTip.AccumulatedWork, tip.ForkPoint.AccumulatedWork)
+		if share < m.AlertWorkShare {
+			continue
+		}
+
+		m.alertedForks[tip.ForkPoint.Hash] = true
+		alerts = append(alerts, ForkAlert{
+			Kind:      FORK_ALERT_COMPETING_BRANCH,
+			Time:      now,
+			Tip:       tip.Hash,
+			ForkPoint: tip.ForkPoint.Hash,
+			Depth:     tip.BranchLength,
+			WorkShare: share,
+			Message: fmt.Sprintf(
+				"Competing branch %d blocks deep with %.0f%% of the main chain's work, forking at height %d. Possible 51%% attack.",
+				tip.BranchLength, share*100, tip.ForkPoint.Height,
+			),
+		})
+	}
+	m.status.LastCheck = now
+	m.status.Tips = tips
+	m.mutex.Unlock()
+
+	for _, alert := range alerts {
+		m.alert(alert)
+	}
+	return nil
+}
+
+// Checks a change of the main chain tip for a deep reorg. Called when the full tip changes.
+func (m *ForkMonitor) CheckReorg(newTip Block, prevTip Block, now time.Time) error {
+	if prevTip.Hash == [32]byte{} || newTip.ParentHash == prevTip.Hash {
+		return nil
+	}
+
+	ancestor, err := m.dag.GetCommonAncestor(newTip.Hash, prevTip.Hash)
+	if err != nil {
+		return err
+	}
+	depth := prevTip.Height - ancestor.Height
+	if depth == 0 {
+		return nil
+	}
+
+	m.log.Printf("Reorg of depth %d: old_tip=%s new_tip=%s fork_height=%d\n", depth, prevTip.HashStr(), newTip.HashStr(), ancestor.Height)
+	m.mutex.Lock()
+	m.status.LastReorgDepth = depth
+	m.status.LastReorgTime = now
+	m.mutex.Unlock()
+
+	if depth < m.AlertDepth {
+		return nil
+	}
+	m.alert(ForkAlert{
+		Kind:      FORK_ALERT_DEEP_REORG,
+		Time:      now,
+		Tip:       newTip.Hash,
+		ForkPoint: ancestor.Hash,
+		Depth:     depth,
+		Message: fmt.Sprintf(
+			"Deep reorg of %d blocks, forking at height %d. Possible 51%% attack.",
+			depth, ancestor.Height,
+		),
+	})
+	return nil
+}
+
+// Raises an alert for a quarantined branch. Called when the DAG quarantines a branch.
+func (m *ForkMonitor) AlertQuarantined(branch QuarantinedBranch) {
+	m.alert(ForkAlert{
+		Kind:      FORK_ALERT_QUARANTINED_REORG,
+		Time:      branch.FirstSeen,
+		Tip:       branch.Tip,
+		ForkPoint: branch.ForkPoint,
+		Depth:     branch.Depth,
+		Message: fmt.Sprintf(
+			"Quarantined a reorg of %d blocks to branch %x, above the maximum reorg depth. Release it with releasequarantinedbranch, or reject it with invalidateblock.",
+			branch.Depth, branch.Hash,
+		),
+	})
+}
+
+func (m *ForkMonitor) alert(alert ForkAlert) {
+	m.log.Printf("WARNING: %s\n", alert.Message)
+
+	m.mutex.Lock()
+	m.status.Alerts = append(m.status.Alerts, alert)
+	if MAX_FORK_ALERTS < len(m.status.Alerts) {
+		m.status.Alerts = m.status.Alerts[len(m.status.Alerts)-MAX_FORK_ALERTS:]
+	}
+	m.mutex.Unlock()
+
+	if m.OnAlert != nil {
+		m.OnAlert(alert)
+	}
+}
+
+// Computes the work of a branch since the fork point, as a share of the main chain's work since the fork point.
+func workShare(branchWork big.Int, mainWork big.Int, forkWork big.Int) float64 {
+	branch := new(big.Int).Sub(&branchWork, &forkWork)
+	mainChain := new(big.Int).Sub(&mainWork, &forkWork)
+	if mainChain.Sign() <= 0 {
+		return 1
+	}
+	share, _ := new(big.Float).Quo(new(big.Float).SetInt(branch), new(big.Float).SetInt(mainChain)).Float64()
+	return share
+}
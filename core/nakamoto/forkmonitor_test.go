@@ -0,0 +1,99 @@
+package nakamoto
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForkMonitor(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	hashes := [][32]byte{dag.FullTip.Hash}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+
+	// Mine a main chain of 8 blocks, and a competing branch of 7 blocks forking from block 1.
+	miner.Start(8)
+	assert.Nil(dag.InvalidateBlock(hashes[2]))
+	miner.Start(7)
+	assert.Nil(dag.ReconsiderBlock(hashes[2]))
+
+	tips, err := dag.GetChainTips()
+	if err != nil {
+		t.Fatalf("Failed to get chain tips: %s", err)
+	}
+	assert.Equal(2, len(tips))
+	for _, tip := range tips {
+		assert.Equal(uint64(8), tip.Height)
+		if tip.Hash == dag.FullTip.Hash {
+			assert.Equal(CHAIN_TIP_ACTIVE, tip.Status)
+			assert.Equal(tip.Hash, tip.ForkPoint.Hash)
+			assert.Equal(uint64(0), tip.BranchLength)
+		} else {
+			assert.Equal(CHAIN_TIP_VALID_FORK, tip.Status)
+			assert.Equal(hashes[1], tip.ForkPoint.Hash)
+			assert.Equal(uint64(7), tip.BranchLength)
+		}
+	}
+
+	monitor := NewForkMonitor(&dag)
+	alerts := []ForkAlert{}
+	monitor.OnAlert = func(alert ForkAlert) {
+		alerts = append(alerts, alert)
+	}
+
+	// Branches shallower than the alert depth are ignored.
+	monitor.AlertDepth = 8
+	monitor.AlertWorkShare = 0
+	assert.Nil(monitor.Tick(time.Now()))
+	assert.Equal(0, len(alerts))
+
+	// A deep branch raises an alert, once.
+	monitor.AlertDepth = 6
+	assert.Nil(monitor.Tick(time.Now()))
+	assert.Nil(monitor.Tick(time.Now()))
+	assert.Equal(1, len(alerts))
+	assert.Equal(FORK_ALERT_COMPETING_BRANCH, alerts[0].Kind)
+	assert.Equal(uint64(7), alerts[0].Depth)
+	assert.Equal(2, len(monitor.Status().Tips))
+
+	// A deep reorg raises an alert.
+	mainTip, forkTip := hashes[8], hashes[15]
+	blocks, err := dag.GetBlocksByHashes([][32]byte{mainTip, forkTip})
+	if err != nil {
+		t.Fatalf("Failed to get blocks: %s", err)
+	}
+	assert.Nil(monitor.CheckReorg(*blocks[0], *blocks[1], time.Now()))
+	assert.Equal(2, len(alerts))
+	assert.Equal(FORK_ALERT_DEEP_REORG, alerts[1].Kind)
+	assert.Equal(uint64(7), alerts[1].Depth)
+	assert.Equal(hashes[1], alerts[1].ForkPoint)
+	assert.Equal(uint64(7), monitor.Status().LastReorgDepth)
+
+	// Blocks extending the tip aren't reorgs.
+	assert.Nil(monitor.CheckReorg(*blocks[0], Block{Hash: blocks[0].ParentHash}, time.Now()))
+	assert.Equal(2, len(alerts))
+}
+
+func TestForkMonitorWorkShare(t *testing.T) {
+	assert := assert.New(t)
+
+	fork := *big.NewInt(100)
+	assert.Equal(0.5, workShare(*big.NewInt(150), *big.NewInt(200), fork))
+	assert.Equal(2.0, workShare(*big.NewInt(300), *big.NewInt(200), fork))
+	assert.Equal(1.0, workShare(*big.NewInt(150), fork, fork))
+}
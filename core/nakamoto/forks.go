@@ -0,0 +1,78 @@
+package nakamoto
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Hard forks are scheduled by activation height, in ConsensusConfig.Forks. Unlike soft forks (see versionbits.go), a
+// hard fork relaxes the consensus rules, so nodes which haven't upgraded would reject blocks using the new rules. To
+// make this clean, every node checks the forks scheduled in its config against those it implements, and refuses blocks
+// at or after the activation of a fork it doesn't implement, telling the operator to upgrade, rather than failing on
+// some unrelated validation error.
+//
+// A fork which isn't in the config is never active.
+
+const (
+	// Enables the block version header field, used to signal for soft forks. Before this fork, the version must be 0.
+	FORK_BLOCK_VERSION = "block_version"
+	// Enables version 2 transactions, which can spend coins locked by a predicate. See predicate.go.
+	FORK_PREDICATES = "predicates"
+	// Enables version 3 transactions, which can issue and transfer tokens. See tokens.go.
+	FORK_TOKENS = "tokens"
+	// Enables version 4 transactions, which spend outputs in the UTXO state machine. See utxo.go.
+	FORK_UTXO = "utxo"
+	// Commits each block header to the history of its chain, in the history root header field. See history.go. Before
+	// this fork, the history root must be empty.
+	FORK_HEADER_HISTORY = "header_history"
+	// Deducts the fee of a transfer from the sender's balance, as well as the amount. Before this fork, only the amount
+	// is deducted, and the fee is credited to the miner without being paid by anyone.
+	FORK_FEE_DEDUCTION = "fee_deduction"
+)
+
+// The forks implemented by this node, besides those activating transaction versions registered later (see
+// tx_versions.go).
+var KNOWN_FORKS = []string{FORK_BLOCK_VERSION, FORK_PREDICATES, FORK_TOKENS, FORK_UTXO, FORK_HEADER_HISTORY, FORK_FEE_DEDUCTION}
+
+// Returns whether a fork is active at the given height.
+func (dag *BlockDAG) IsForkActive(name string, height uint64) bool {
+	activation, ok := dag.consensus.Forks[name]
+	return ok && activation <= height
+}
+
+// Returns the forks scheduled in the config which this node doesn't implement, in order of activation.
+func (dag *BlockDAG) UnsupportedForks() []string {
+	unsupported := []string{}
+	for name := range dag.consensus.Forks {
+		known := txVersions.hasFork(name)
+		for _, k := range KNOWN_FORKS {
+			known = known || k == name
+		}
+		if !known {
+			unsupported = append(unsupported, name)
+		}
+	}
+	sort.Slice(unsupported, func(i, j int) bool {
+		return dag.consensus.Forks[unsupported[i]] < dag.consensus.Forks[unsupported[j]]
+	})
+	return unsupported
+}
+
+// Returns whether a transaction version is valid at the given height. Each version extends the previous one, so it is
+// only active once the forks of all earlier versions are. See tx_versions.go.
+func (dag *BlockDAG) IsTransactionVersionActive(version byte, height uint64) bool {
+	return IsTxVersionActive(version, height, dag.consensus.Forks)
+}
+
+// Verifies a block header at the given height against the fork rules.
+func (dag *BlockDAG) verifyForkRules(height uint64, version uint32) error {
+	for _, name := range dag.UnsupportedForks() {
+		if dag.IsForkActive(name, height) {
+			return fmt.Errorf("Block at height %d is after the activation of fork %s, which this node doesn't support. Upgrade your node.", height, name)
+		}
+	}
+	if version != 0 && !dag.IsForkActive(FORK_BLOCK_VERSION, height) {
+		return fmt.Errorf("Block version must be 0 before the %s fork.", FORK_BLOCK_VERSION)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package nakamoto
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDagForks(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := OpenDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	genesisDifficulty := new(big.Int)
+	genesisDifficulty.SetString("0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+	conf := ConsensusConfig{
+		EpochLengthBlocks:       5,
+		TargetEpochLengthMillis: 2000,
+		GenesisDifficulty:       *genesisDifficulty,
+		GenesisParentBlockHash:  HexStringToBytes32("000006b15d1327d67e971d1de9116bd60a3a01556c91b6ebaa416ebc0cfaa646"),
+		MaxBlockSizeBytes:       2 * 1024 * 1024,
+		Deployments: []Deployment{
+			{Name: "test", Bit: 0, StartHeight: 0, TimeoutHeight: 1000},
+		},
+		Forks: map[string]uint64{
+			FORK_BLOCK_VERSION: 3,
+			"from_the_future":  6,
+		},
+	}
+	dag, err := NewBlockDAGFromDB(db, newMockStateMachine(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.False(dag.IsForkActive(FORK_BLOCK_VERSION, 2))
+	assert.True(dag.IsForkActive(FORK_BLOCK_VERSION, 3))
+	assert.False(dag.IsForkActive("unscheduled", 1000))
+
+	// Transaction versions are cumulative, so version 3 needs the forks of versions 2 and 3.
+	dag.consensus.Forks = map[string]uint64{FORK_TOKENS: 0}
+	assert.False(dag.IsTransactionVersionActive(3, 0))
+	dag.consensus.Forks = map[string]uint64{FORK_PREDICATES: 0, FORK_TOKENS: 5}
+	assert.True(dag.IsTransactionVersionActive(2, 0))
+	assert.False(dag.IsTransactionVersionActive(3, 4))
+	assert.True(dag.IsTransactionVersionActive(3, 5))
+	dag.consensus.Forks = conf.Forks
+	assert.Equal([]string{"from_the_future"}, dag.UnsupportedForks())
+	assert.True(dag.IsTransactionVersionActive(1, 0))
+	assert.False(dag.IsTransactionVersionActive(2, 1000))
+	assert.False(dag.IsTransactionVersionActive(0, 1000))
+
+	wallets := getTestingWallets(t)
+	miner := NewMiner(dag, &wallets[0])
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+
+	// The miner only sets the version once the fork is active.
+	miner.Start(2)
+	assert.Equal(uint32(0), dag.FullTip.Version)
+	miner.Start(1)
+	assert.Equal(uint64(3), dag.FullTip.Height)
+	assert.Equal(uint32(VERSIONBITS_TOP_BITS), dag.FullTip.Version)
+	miner.Start(2)
+	assert.Equal(uint32(VERSIONBITS_TOP_BITS|1<<0), dag.FullTip.Version)
+
+	newBlock := func(parent Block, version uint32, txs ...RawTransaction) RawBlock {
+		coinbase := MakeCoinbaseTx(&wallets[0])
+		txs = append([]RawTransaction{coinbase}, txs...)
+		envelopes := [][]byte{}
+		for _, tx := range txs {
+			envelopes = append(envelopes, tx.Envelope())
+		}
+		return RawBlock{
+			BlockHeader: BlockHeader{
+				ParentHash:             parent.Hash,
+				ParentTotalWork:        BigIntToBytes32(parent.AccumulatedWork),
+				Timestamp:              Timestamp(),
+				NumTransactions:        uint64(len(txs)),
+				TransactionsMerkleRoot: core.ComputeMerkleHash(envelopes),
+				Version:                version,
+			},
+			Transactions: txs,
+		}
+	}
+
+	// Blocks with a version before the fork are rejected.
+	rawGenesis := GetRawGenesisBlockFromConfig(conf)
+	genesis, err := dag.GetBlockByHash(rawGenesis.Hash())
+	assert.Nil(err)
+	assert.EqualError(dag.IngestBlock(newBlock(*genesis, VERSIONBITS_TOP_BITS)), "Block version must be 0 before the block_version fork.")
+
+	// Transactions with a version which isn't active are rejected.
+	tx := MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 1, &wallets[0], 0)
+	tx.Version = 2
+	sig, err := wallets[0].Sign(tx.Envelope())
+	assert.Nil(err)
+	copy(tx.Sig[:], sig)
+	assert.EqualError(dag.IngestBlock(newBlock(*genesis, 0, tx)), "Transaction 1 is invalid: version 2 is not active.")
+
+	// Blocks after the activation of a fork we don't support are rejected.
+	assert.Equal(uint64(5), dag.FullTip.Height)
+	assert.EqualError(
+		dag.IngestBlock(newBlock(dag.FullTip, VERSIONBITS_TOP_BITS)),
+		"Block at height 6 is after the activation of fork from_the_future, which this node doesn't support. Upgrade your node.",
+	)
+}
@@ -1,6 +1,9 @@
 package nakamoto
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"math/big"
 )
@@ -21,21 +24,83 @@ type ConsensusConfig struct {
 
 	// Maximum block size.
 	MaxBlockSizeBytes uint64 `json:"max_block_size_bytes"`
+
+	// Maximum block weight. 0 disables the limit. See weight.go.
+	MaxBlockWeight uint64 `json:"max_block_weight"`
+
+	// The number of blocks before coinbase coins can be spent. 0 disables the rule.
+	CoinbaseMaturity uint64 `json:"coinbase_maturity"`
+
+	// The base fee per byte of the genesis block, which enables the fee market. 0 disables it. See fees.go.
+	InitialBaseFee uint64 `json:"initial_base_fee"`
+
+	// Soft fork deployments, signalled with version bits. See versionbits.go.
+	Deployments []Deployment `json:"deployments"`
+
+	// The number of blocks in an epoch which must signal for a deployment to lock in. 0 defaults to 95% of the epoch.
+	VersionBitsThreshold uint64 `json:"version_bits_threshold"`
+
+	// Hard forks, by name and activation height. See forks.go.
+	Forks map[string]uint64 `json:"forks"`
+
+	// The state machine which executes transactions, "account" (the default) or "utxo". See NewStateMachineFromConfig.
+	StateMachine string `json:"state_machine"`
+
+	// Balances credited before the genesis block, ie. to fund the wallets of a test network. Only supported by the
+	// account state machine.
+	GenesisAlloc []GenesisAlloc `json:"genesis_alloc"`
+}
+
+// A balance credited to an account before the genesis block.
+type GenesisAlloc struct {
+	// The hex-encoded public key of the account.
+	Pubkey string `json:"pubkey"`
+	Amount uint64 `json:"amount"`
+}
+
+// Returns a commitment to the genesis allocations, so networks with different allocations have different genesis
+// blocks.
+func genesisAllocHash(alloc []GenesisAlloc) [32]byte {
+	h := sha256.New()
+	for _, a := range alloc {
+		h.Write([]byte(a.Pubkey))
+		h.Write(binary.BigEndian.AppendUint64(nil, a.Amount))
+	}
+	return [32]byte(h.Sum(nil))
+}
+
+// Credits the genesis allocations to a fresh state.
+func (c *StateMachine) ApplyGenesisAlloc(alloc []GenesisAlloc) error {
+	for _, a := range alloc {
+		pubkey, err := hex.DecodeString(a.Pubkey)
+		if err != nil || len(pubkey) != 65 {
+			return fmt.Errorf("Invalid genesis allocation pubkey: %s", a.Pubkey)
+		}
+		account := [65]byte(pubkey)
+		c.Apply([]*StateLeaf{{PubKey: account, Balance: c.GetBalance(account) + a.Amount}})
+	}
+	return nil
 }
 
 // Builds the raw genesis block from the consensus configuration.
 func GetRawGenesisBlockFromConfig(consensus ConsensusConfig) RawBlock {
 	block := RawBlock{
-		// Special case: The genesis block has a parent we don't know the preimage for.
-		ParentHash:             consensus.GenesisParentBlockHash,
-		ParentTotalWork:        [32]byte{},
-		Difficulty:             BigIntToBytes32(consensus.GenesisDifficulty),
-		Timestamp:              0,
-		NumTransactions:        0,
-		TransactionsMerkleRoot: [32]byte{},
-		Nonce:                  [32]byte{},
-		Graffiti:               [32]byte{0xca, 0xfe, 0xba, 0xbe, 0xde, 0xca, 0xfb, 0xad, 0xde, 0xad, 0xbe, 0xef}, // 0x cafebabe decafbad deadbeef
-		Transactions:           []RawTransaction{},
+		BlockHeader: BlockHeader{
+			// Special case: The genesis block has a parent we don't know the preimage for.
+			ParentHash:             consensus.GenesisParentBlockHash,
+			ParentTotalWork:        [32]byte{},
+			Difficulty:             BigIntToBytes32(consensus.GenesisDifficulty),
+			Timestamp:              0,
+			NumTransactions:        0,
+			TransactionsMerkleRoot: [32]byte{},
+			Nonce:                  [32]byte{},
+			Graffiti:               [32]byte{0xca, 0xfe, 0xba, 0xbe, 0xde, 0xca, 0xfb, 0xad, 0xde, 0xad, 0xbe, 0xef}, // 0x cafebabe decafbad deadbeef
+			BaseFee:                consensus.InitialBaseFee,
+		},
+		Transactions: []RawTransaction{},
+	}
+	if 0 < len(consensus.GenesisAlloc) {
+		block.Graffiti = genesisAllocHash(consensus.GenesisAlloc)
 	}
 
 	// Mine the block.
@@ -53,6 +118,6 @@ func GetRawGenesisBlockFromConfig(consensus ConsensusConfig) RawBlock {
 	// Calculate work.
 	work := CalculateWork(Bytes32ToBigInt(block.Hash()))
 
-	fmt.Printf("Genesis block hash=%x work=%s\n", block.Hash(), work.String())
+	fmt.Fprintf(logOutput, "Genesis block hash=%x work=%s\n", block.Hash(), work.String())
 	return block
 }
@@ -39,3 +39,38 @@ func TestGetRawGenesisBlockFromConfig(t *testing.T) {
 	assert.Equal([32]byte{}, genesisBlock.TransactionsMerkleRoot)
 	assert.Equal(big.NewInt(21).String(), genesisNonce.String())
 }
+
+func TestGenesisAlloc(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	conf := ConsensusConfig{
+		EpochLengthBlocks:       5,
+		TargetEpochLengthMillis: 2000,
+		GenesisDifficulty:       *big.NewInt(0).Lsh(big.NewInt(1), 252),
+		MaxBlockSizeBytes:       2 * 1024 * 1024,
+	}
+	genesis := GetRawGenesisBlockFromConfig(conf)
+	genesisHash := genesis.Hash()
+
+	// Allocations change the genesis block.
+	conf.GenesisAlloc = []GenesisAlloc{
+		{Pubkey: wallets[0].PubkeyStr(), Amount: 500},
+		{Pubkey: wallets[1].PubkeyStr(), Amount: 20},
+		{Pubkey: wallets[0].PubkeyStr(), Amount: 1},
+	}
+	genesis = GetRawGenesisBlockFromConfig(conf)
+	assert.NotEqual(genesisHash, genesis.Hash())
+
+	state, err := NewStateMachineFromConfig(conf)
+	assert.Nil(err)
+	assert.Equal(uint64(501), state.(*StateMachine).GetBalance(wallets[0].PubkeyBytes()))
+	assert.Equal(uint64(20), state.(*StateMachine).GetBalance(wallets[1].PubkeyBytes()))
+
+	conf.GenesisAlloc = []GenesisAlloc{{Pubkey: "00", Amount: 1}}
+	_, err = NewStateMachineFromConfig(conf)
+	assert.NotNil(err)
+	conf.StateMachine = STATE_MACHINE_UTXO
+	_, err = NewStateMachineFromConfig(conf)
+	assert.NotNil(err)
+}
@@ -0,0 +1,468 @@
+package nakamoto
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// The GraphQL API exposes the node's data to frontend developers building explorers and dashboards.
+//
+// The schema is:
+//
+//	type Query {
+//		block(hash: String!): Block
+//		blocks(from: Uint64!, to: Uint64!): [Block]
+//		tip: Block
+//		headersTip: Block
+//		account(pubkey: String!): Account
+//		epoch(blockHash: String!): Epoch
+//		mempool: [Transaction]
+//	}
+//
+// Blocks resolve their parent, transactions and epoch, and transactions resolve their from/to accounts, so a client
+// can fetch a block and all its related data in a single query.
+
+// Uint64 is serialised as a decimal string, since GraphQL's Int is only 32 bits.
+var graphqlUint64 = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "Uint64",
+	Description: "An unsigned 64-bit integer, encoded as a decimal string.",
+	Serialize: func(value interface{}) interface{} {
+		switch v := value.(type) {
+		case uint64:
+			return strconv.FormatUint(v, 10)
+		case *uint64:
+			return strconv.FormatUint(*v, 10)
+		}
+		return nil
+	},
+	ParseValue: func(value interface{}) interface{} {
+		switch v := value.(type) {
+		case string:
+			i, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return nil
+			}
+			return i
+		case int:
+			return uint64(v)
+		case float64:
+			return uint64(v)
+		}
+		return nil
+	},
+	ParseLiteral: func(valueAST ast.Value) interface{} {
+		switch v := valueAST.(type) {
+		case *ast.StringValue:
+			i, err := strconv.ParseUint(v.Value, 10, 64)
+			if err != nil {
+				return nil
+			}
+			return i
+		case *ast.IntValue:
+			i, err := strconv.ParseUint(v.Value, 10, 64)
+			if err != nil {
+				return nil
+			}
+			return i
+		}
+		return nil
+	},
+})
+
+// Constructs the GraphQL schema for a node.
+func NewGraphQLSchema(n *Node) (graphql.Schema, error) {
+	accountType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Account",
+		Fields: graphql.Fields{
+			"pubkey": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					pubkey := p.Source.([65]byte)
+					return hex.EncodeToString(pubkey[:]), nil
+				},
+			},
+			"balance": &graphql.Field{
+				Type: graphqlUint64,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					pubkey := p.Source.([65]byte)
+					return n.StateMachine1.GetBalance(pubkey), nil
+				},
+			},
+		},
+	})
+
+	transactionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Transaction",
+		Fields: graphql.Fields{
+			"hash": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					tx := p.Source.(Transaction)
+					return Bytes32ToHexString(tx.Hash), nil
+				},
+			},
+			"blockHash": &graphql.Field{
+				Type:        graphql.String,
+				Description: "The block the transaction was included in. Null for mempool transactions.",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					tx := p.Source.(Transaction)
+					if tx.Blockhash == [32]byte{} {
+						return nil, nil
+					}
+					return Bytes32ToHexString(tx.Blockhash), nil
+				},
+			},
+			"txIndex": &graphql.Field{
+				Type: graphqlUint64,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Transaction).TxIndex, nil
+				},
+			},
+			"version": &graphql.Field{
+				Type: graphql.Int,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return int(p.Source.(Transaction).Version), nil
+				},
+			},
+			"sig": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					tx := p.Source.(Transaction)
+					return hex.EncodeToString(tx.Sig[:]), nil
+				},
+			},
+			"from": &graphql.Field{
+				Type: accountType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Transaction).FromPubkey, nil
+				},
+			},
+			"to": &graphql.Field{
+				Type: accountType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Transaction).ToPubkey, nil
+				},
+			},
+			"amount": &graphql.Field{
+				Type: graphqlUint64,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Transaction).Amount, nil
+				},
+			},
+			"fee": &graphql.Field{
+				Type: graphqlUint64,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Transaction).Fee, nil
+				},
+			},
+			"nonce": &graphql.Field{
+				Type: graphqlUint64,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Transaction).Nonce, nil
+				},
+			},
+		},
+	})
+
+	epochType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Epoch",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*Epoch).Id, nil
+				},
+			},
+			"startBlockHash": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return Bytes32ToHexString(p.Source.(*Epoch).StartBlockHash), nil
+				},
+			},
+			"startTime": &graphql.Field{
+				Type: graphqlUint64,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*Epoch).StartTime, nil
+				},
+			},
+			"startHeight": &graphql.Field{
+				Type: graphqlUint64,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*Epoch).StartHeight, nil
+				},
+			},
+			"difficulty": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					difficulty := p.Source.(*Epoch).Difficulty
+					return difficulty.Text(16), nil
+				},
+			},
+		},
+	})
+
+	blockType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Block",
+		Fields: graphql.Fields{
+			"hash": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return Bytes32ToHexString(p.Source.(Block).Hash), nil
+				},
+			},
+			"parentHash": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return Bytes32ToHexString(p.Source.(Block).ParentHash), nil
+				},
+			},
+			"height": &graphql.Field{
+				Type: graphqlUint64,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Block).Height, nil
+				},
+			},
+			"timestamp": &graphql.Field{
+				Type: graphqlUint64,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Block).Timestamp, nil
+				},
+			},
+			"numTransactions": &graphql.Field{
+				Type: graphqlUint64,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Block).NumTransactions, nil
+				},
+			},
+			"transactionsMerkleRoot": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return Bytes32ToHexString(p.Source.(Block).TransactionsMerkleRoot), nil
+				},
+			},
+			"nonce": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return Bytes32ToHexString(p.Source.(Block).Nonce), nil
+				},
+			},
+			"graffiti": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return Bytes32ToHexString(p.Source.(Block).Graffiti), nil
+				},
+			},
+			"sizeBytes": &graphql.Field{
+				Type: graphqlUint64,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(Block).SizeBytes, nil
+				},
+			},
+			"accumulatedWork": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					block := p.Source.(Block)
+					return block.AccumulatedWork.String(), nil
+				},
+			},
+			"transactions": &graphql.Field{
+				Type: graphql.NewList(transactionType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					block := p.Source.(Block)
+					txs, err := n.Dag.GetBlockTransactions(block.Hash)
+					if err != nil {
+						return nil, err
+					}
+					for i := range *txs {
+						(*txs)[i].Blockhash = block.Hash
+					}
+					return *txs, nil
+				},
+			},
+			"epoch": &graphql.Field{
+				Type: epochType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return n.Dag.GetEpochForBlockHash(p.Source.(Block).Hash)
+				},
+			},
+		},
+	})
+
+	// The parent field refers to the block type itself, so it is added after the type is constructed.
+	blockType.AddFieldConfig("parent", &graphql.Field{
+		Type: blockType,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			block, err := n.Dag.GetBlockByHash(p.Source.(Block).ParentHash)
+			if err != nil || block == nil {
+				return nil, err
+			}
+			return *block, nil
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"block": &graphql.Field{
+				Type: blockType,
+				Args: graphql.FieldConfigArgument{
+					"hash": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					hash, err := parseHash32(p.Args["hash"].(string))
+					if err != nil {
+						return nil, err
+					}
+					block, err := n.Dag.GetBlockByHash(hash)
+					if err != nil || block == nil {
+						return nil, err
+					}
+					return *block, nil
+				},
+			},
+			"blocks": &graphql.Field{
+				Type:        graphql.NewList(blockType),
+				Description: "Blocks on the main chain between heights `from` and `to` inclusive.",
+				Args: graphql.FieldConfigArgument{
+					"from": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphqlUint64)},
+					"to":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphqlUint64)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					it, err := n.Dag.IterateMainChain(p.Args["from"].(uint64), p.Args["to"].(uint64))
+					if err != nil {
+						return nil, err
+					}
+					defer it.Close()
+
+					blocks := make([]Block, 0)
+					for it.Next() {
+						blocks = append(blocks, it.Block())
+					}
+					return blocks, it.Err()
+				},
+			},
+			"tip": &graphql.Field{
+				Type: blockType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return n.Dag.FullTip, nil
+				},
+			},
+			"headersTip": &graphql.Field{
+				Type: blockType,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return n.Dag.HeadersTip, nil
+				},
+			},
+			"account": &graphql.Field{
+				Type: accountType,
+				Args: graphql.FieldConfigArgument{
+					"pubkey": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return parsePubkey(p.Args["pubkey"].(string))
+				},
+			},
+			"epoch": &graphql.Field{
+				Type: epochType,
+				Args: graphql.FieldConfigArgument{
+					"blockHash": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					hash, err := parseHash32(p.Args["blockHash"].(string))
+					if err != nil {
+						return nil, err
+					}
+					return n.Dag.GetEpochForBlockHash(hash)
+				},
+			},
+			"mempool": &graphql.Field{
+				Type: graphql.NewList(transactionType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					txs := make([]Transaction, 0)
+					for _, tx := range n.Mempool.GetTransactions() {
+						txs = append(txs, *tx)
+					}
+					return txs, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query: queryType,
+	})
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+// Returns a HTTP handler which executes GraphQL queries against the node.
+func (n *Node) GraphQLHandler() (http.Handler, error) {
+	schema, err := NewGraphQLSchema(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req graphqlRequest
+		switch r.Method {
+		case http.MethodGet:
+			req.Query = r.URL.Query().Get("query")
+			req.OperationName = r.URL.Query().Get("operationName")
+		case http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		result := graphql.Do(graphql.Params{
+			Schema:         schema,
+			RequestString:  req.Query,
+			VariableValues: req.Variables,
+			OperationName:  req.OperationName,
+			Context:        r.Context(),
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}), nil
+}
+
+func parseHash32(s string) ([32]byte, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if len(buf) != 32 {
+		return [32]byte{}, fmt.Errorf("Invalid hash length: %d", len(buf))
+	}
+	hash := [32]byte{}
+	copy(hash[:], buf)
+	return hash, nil
+}
+
+func parsePubkey(s string) ([65]byte, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return [65]byte{}, err
+	}
+	if len(buf) != 65 {
+		return [65]byte{}, fmt.Errorf("Invalid pubkey length: %d", len(buf))
+	}
+	pubkey := [65]byte{}
+	copy(pubkey[:], buf)
+	return pubkey, nil
+}
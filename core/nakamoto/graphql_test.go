@@ -0,0 +1,81 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/graphql-go/graphql"
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphQLNestedQuery(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+	miner.Start(3)
+
+	// Rebuild the state so account balances resolve.
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatalf("Failed to create state machine: %s", err)
+	}
+	hashes, err := dag.GetLongestChainHashList(dag.FullTip.Hash, dag.FullTip.Height+1)
+	if err != nil {
+		t.Fatalf("Failed to get longest chain hash list: %s", err)
+	}
+	stateMachine, err = RebuildState(&dag, *stateMachine, hashes)
+	if err != nil {
+		t.Fatalf("Failed to rebuild state: %s", err)
+	}
+
+	node := &Node{
+		Dag:           &dag,
+		StateMachine1: stateMachine,
+		Mempool:       NewMempool(),
+	}
+	schema, err := NewGraphQLSchema(node)
+	if err != nil {
+		t.Fatalf("Failed to create schema: %s", err)
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema: schema,
+		RequestString: `{
+			tip {
+				height
+				parent { height }
+				transactions { txIndex to { pubkey balance } }
+			}
+			blocks(from: 1, to: 2) { height }
+			mempool { hash }
+		}`,
+	})
+	assert.Empty(result.Errors)
+
+	data := result.Data.(map[string]interface{})
+	tip := data["tip"].(map[string]interface{})
+	assert.Equal("3", tip["height"])
+	assert.Equal("2", tip["parent"].(map[string]interface{})["height"])
+
+	txs := tip["transactions"].([]interface{})
+	assert.Equal(1, len(txs))
+	to := txs[0].(map[string]interface{})["to"].(map[string]interface{})
+	assert.Equal(minerWallet.PubkeyStr(), to["pubkey"])
+	assert.Equal("3000000000", to["balance"])
+
+	blocks := data["blocks"].([]interface{})
+	assert.Equal(2, len(blocks))
+	assert.Equal("1", blocks[0].(map[string]interface{})["height"])
+	assert.Equal(0, len(data["mempool"].([]interface{})))
+}
@@ -0,0 +1,467 @@
+package nakamoto
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Once the header_history fork is active, each block header commits to the hashes of all the blocks before it, in a
+// Merkle mountain range (MMR). This lets a light client holding only the tip's header verify that an old block is an
+// ancestor of the tip, with a proof logarithmic in the length of the chain - for SPV wallets checking a payment, or the
+// explorer serving historical blocks.
+//
+// An MMR is a list of perfect binary Merkle trees (peaks) of decreasing size, one for each bit set in the number of
+// leaves. Appending a leaf adds a peak of size 1, and merges the last two peaks while they are the same size, so a block
+// commits to the history of its parent with O(log n) work, from the peaks stored with its parent. The leaves are the
+// block hashes, in order of height, so the history root of a block at height h commits to the blocks 0..h-1:
+//
+//	leaf = sha256(0x00 || block hash)
+//	node = sha256(0x01 || left || right)
+//	root = sha256(0x02 || number of leaves || peaks, left to right)
+//
+// Committing to the number of leaves tells the light client the tip's height, and fixes the shape of the peaks.
+//
+// The peaks of each block are stored with it when it's ingested, computed from its parent's, so proofs are built from
+// stored peaks rather than by walking the chain.
+
+var ErrInvalidAncestryProof = errors.New("invalid ancestry proof")
+
+// A proof that a block is an ancestor of a tip, against the tip's history root.
+type AncestryProof struct {
+	// The header of the ancestor.
+	Header BlockHeader `json:"header"`
+	// The height of the ancestor, which is its index in the history.
+	Height uint64 `json:"height"`
+	// The number of blocks committed to by the tip's history root, which is the tip's height.
+	Length uint64 `json:"length"`
+	// The siblings on the path from the ancestor's leaf to its peak, bottom-up.
+	Path [][32]byte `json:"path"`
+	// The peaks of the history, left to right.
+	Peaks [][32]byte `json:"peaks"`
+}
+
+// get_ancestry_proof
+type GetAncestryProofMessage struct {
+	Type      string   `json:"type"` // "get_ancestry_proof"
+	BlockHash [32]byte `json:"blockHash"`
+	TipHash   [32]byte `json:"tipHash"`
+}
+
+type GetAncestryProofReply struct {
+	Type  string        `json:"type"` // "get_ancestry_proof_reply"
+	Proof AncestryProof `json:"proof"`
+}
+
+// The Merkle mountain range.
+// =====================================================================================================================
+
+func historyLeaf(blockHash [32]byte) [32]byte {
+	buf := make([]byte, 0, 1+32)
+	buf = append(buf, 0x00)
+	buf = append(buf, blockHash[:]...)
+	return sha256.Sum256(buf)
+}
+
+func historyParent(left [32]byte, right [32]byte) [32]byte {
+	buf := make([]byte, 0, 1+32+32)
+	buf = append(buf, 0x01)
+	buf = append(buf, left[:]...)
+	buf = append(buf, right[:]...)
+	return sha256.Sum256(buf)
+}
+
+// Computes the history root of an MMR with n leaves.
+func historyRoot(n uint64, peaks [][32]byte) [32]byte {
+	buf := make([]byte, 0, 1+8+32*len(peaks))
+	buf = append(buf, 0x02)
+	buf = binary.BigEndian.AppendUint64(buf, n)
+	for _, peak := range peaks {
+		buf = append(buf, peak[:]...)
+	}
+	return sha256.Sum256(buf)
+}
+
+// Appends a leaf to an MMR with n leaves, returning the new peaks.
+func historyAppend(peaks [][32]byte, n uint64, leaf [32]byte) [][32]byte {
+	next := make([][32]byte, len(peaks), len(peaks)+1)
+	copy(next, peaks)
+	next = append(next, leaf)
+	// Each trailing 1 bit of n is a peak the same size as the new one.
+	for c := n; c&1 == 1; c >>= 1 {
+		left, right := next[len(next)-2], next[len(next)-1]
+		next = append(next[:len(next)-2], historyParent(left, right))
+	}
+	return next
+}
+
+// Computes the root of a perfect tree of leaves.
+func historySubtreeRoot(leaves [][32]byte) [32]byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	half := len(leaves) / 2
+	return historyParent(historySubtreeRoot(leaves[:half]), historySubtreeRoot(leaves[half:]))
+}
+
+// Returns the start and size of each peak of an MMR with n leaves, left to right.
+func historyPeakRanges(n uint64) [][2]uint64 {
+	ranges := [][2]uint64{}
+	start := uint64(0)
+	for k := 63; 0 <= k; k-- {
+		size := uint64(1) << k
+		if n&size != 0 {
+			ranges = append(ranges, [2]uint64{start, size})
+			start += size
+		}
+	}
+	return ranges
+}
+
+func encodeHistoryPeaks(peaks [][32]byte) []byte {
+	buf := make([]byte, 0, 32*len(peaks))
+	for _, peak := range peaks {
+		buf = append(buf, peak[:]...)
+	}
+	return buf
+}
+
+func decodeHistoryPeaks(buf []byte) ([][32]byte, error) {
+	if len(buf)%32 != 0 {
+		return nil, fmt.Errorf("Invalid history peaks of length %d.", len(buf))
+	}
+	peaks := make([][32]byte, len(buf)/32)
+	for i := range peaks {
+		copy(peaks[i][:], buf[i*32:])
+	}
+	return peaks, nil
+}
+
+// The block DAG.
+// =====================================================================================================================
+
+// Gets the peaks of the history up to and including a block. Peaks missing from the database are computed from the
+// nearest ancestor with stored peaks, without storing them, so verifying a block never writes to the database.
+func (dag *BlockDAG) getHistoryPeaks(hash [32]byte) ([][32]byte, error) {
+	return getHistoryPeaks(dag.db, hash)
+}
+
+type historyPeaksQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func getHistoryPeaks(db historyPeaksQuerier, hash [32]byte) ([][32]byte, error) {
+	type pendingBlock struct {
+		hash   [32]byte
+		height uint64
+	}
+
+	// Walk back to the nearest block with stored peaks.
+	pending := []pendingBlock{}
+	peaks := [][32]byte{}
+	cur := hash
+	for {
+		parentHash := []byte{}
+		peaksBuf := []byte{}
+		height := uint64(0)
+		err := db.QueryRow("select parent_hash, height, history_peaks from blocks where hash = ?", cur[:]).Scan(&parentHash, &height, &peaksBuf)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("Block not found: %x", cur)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if peaksBuf != nil {
+			peaks, err = decodeHistoryPeaks(peaksBuf)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		pending = append(pending, pendingBlock{cur, height})
+		if height == 0 {
+			break
+		}
+		copy(cur[:], parentHash)
+	}
+
+	// Append the blocks walked over, oldest first.
+	for i := len(pending) - 1; 0 <= i; i-- {
+		block := pending[i]
+		peaks = historyAppend(peaks, block.height, historyLeaf(block.hash))
+	}
+	return peaks, nil
+}
+
+// Computes the peaks of the history up to and including a new child of the parent block, to store with it.
+func (dag *BlockDAG) getChildHistoryPeaks(parent Block, hash [32]byte) ([]byte, error) {
+	peaks, err := dag.getHistoryPeaks(parent.Hash)
+	if err != nil {
+		return nil, err
+	}
+	return encodeHistoryPeaks(historyAppend(peaks, parent.Height+1, historyLeaf(hash))), nil
+}
+
+// Stores the peaks of the blocks ingested before peaks were stored on ingestion, oldest first, so each block's peaks are
+// computed from its parent's.
+func backfillHistoryPeaks(tx *sql.Tx) error {
+	type pendingBlock struct {
+		hash       [32]byte
+		parentHash [32]byte
+		height     uint64
+	}
+
+	rows, err := tx.Query("select hash, parent_hash, height from blocks where history_peaks is null order by height")
+	if err != nil {
+		return err
+	}
+	pending := []pendingBlock{}
+	for rows.Next() {
+		block := pendingBlock{}
+		hash, parentHash := []byte{}, []byte{}
+		if err := rows.Scan(&hash, &parentHash, &block.height); err != nil {
+			rows.Close()
+			return err
+		}
+		copy(block.hash[:], hash)
+		copy(block.parentHash[:], parentHash)
+		pending = append(pending, block)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, block := range pending {
+		peaks := [][32]byte{}
+		if block.height != 0 {
+			peaks, err = getHistoryPeaks(tx, block.parentHash)
+			if err != nil {
+				return err
+			}
+		}
+		peaks = historyAppend(peaks, block.height, historyLeaf(block.hash))
+		_, err := tx.Exec("update blocks set history_peaks = ? where hash = ?", encodeHistoryPeaks(peaks), block.hash[:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Gets the history root for a child of the parent block, which is empty if the header_history fork isn't active.
+func (dag *BlockDAG) GetNextHistoryRoot(parent Block) ([32]byte, error) {
+	if !dag.IsForkActive(FORK_HEADER_HISTORY, parent.Height+1) {
+		return [32]byte{}, nil
+	}
+	peaks, err := dag.getHistoryPeaks(parent.Hash)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return historyRoot(parent.Height+1, peaks), nil
+}
+
+// Verifies the history root of a child of the parent block.
+func (dag *BlockDAG) verifyHistoryRoot(parent Block, root [32]byte) error {
+	if !dag.IsForkActive(FORK_HEADER_HISTORY, parent.Height+1) {
+		if root != [32]byte{} {
+			return fmt.Errorf("History root must be empty before the %s fork.", FORK_HEADER_HISTORY)
+		}
+		return nil
+	}
+	expected, err := dag.GetNextHistoryRoot(parent)
+	if err != nil {
+		return err
+	}
+	if root != expected {
+		return fmt.Errorf("History root is incorrect.")
+	}
+	return nil
+}
+
+// Ancestry proofs.
+// =====================================================================================================================
+
+// Gets the hash of the main chain block at a height. The transaction index marks the entries of main chain blocks as
+// canonical, so this is a lookup rather than a walk of the main chain.
+func (dag *BlockDAG) getMainChainHashAt(height uint64) ([32]byte, error) {
+	hash := [32]byte{}
+	buf := []byte{}
+	err := dag.db.QueryRow("select block_hash from tx_index where height = ? and canonical = 1 limit 1", height).Scan(&buf)
+	if err == nil {
+		copy(hash[:], buf)
+		return hash, nil
+	}
+	if err != sql.ErrNoRows {
+		return hash, err
+	}
+
+	// Blocks without transactions, such as the genesis block, aren't indexed.
+	block, err := dag.GetMainChainBlockAt(height)
+	if err != nil {
+		return hash, err
+	}
+	if block == nil {
+		return hash, fmt.Errorf("Block not found at height %d.", height)
+	}
+	return block.Hash, nil
+}
+
+// Computes the root of the perfect tree of the 2^level main chain blocks starting at a height, which is aligned to the
+// size of the tree. Its left half is the last peak of the history up to the middle, and its right half is computed the
+// same way, so this takes O(level) lookups.
+func (dag *BlockDAG) getHistorySubtreeRoot(start uint64, level int) ([32]byte, error) {
+	if level == 0 {
+		hash, err := dag.getMainChainHashAt(start)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		return historyLeaf(hash), nil
+	}
+
+	half := uint64(1) << (level - 1)
+	middle, err := dag.getMainChainHashAt(start + half - 1)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	peaks, err := dag.getHistoryPeaks(middle)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	right, err := dag.getHistorySubtreeRoot(start+half, level-1)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return historyParent(peaks[len(peaks)-1], right), nil
+}
+
+// Generates a proof that a block is an ancestor of a tip on the main chain, against the tip's history root.
+//
+// The proof is built from the stored peaks, in O(log^2 n) lookups. The peaks are those of the tip's parent. The left
+// siblings on the path are peaks of the block's parent, as the history up to a block is the perfect trees to the left
+// of it. The right siblings are perfect trees after the block, computed by getHistorySubtreeRoot.
+func (dag *BlockDAG) GetAncestryProof(blockHash [32]byte, tipHash [32]byte) (AncestryProof, error) {
+	tip, err := dag.GetBlockByHash(tipHash)
+	if err != nil {
+		return AncestryProof{}, err
+	}
+	if tip == nil {
+		return AncestryProof{}, fmt.Errorf("Tip not found.")
+	}
+	if tip.HistoryRoot == [32]byte{} {
+		return AncestryProof{}, fmt.Errorf("Tip has no history root.")
+	}
+	mainTipHash, err := dag.getMainChainHashAt(tip.Height)
+	if err != nil || mainTipHash != tipHash {
+		return AncestryProof{}, fmt.Errorf("Tip is not on the main chain.")
+	}
+
+	// Find the ancestor.
+	n := tip.Height
+	block, err := dag.GetBlockByHash(blockHash)
+	if err != nil {
+		return AncestryProof{}, err
+	}
+	if block == nil || n <= block.Height {
+		return AncestryProof{}, fmt.Errorf("Block is not an ancestor of the tip.")
+	}
+	height := block.Height
+	mainHash, err := dag.getMainChainHashAt(height)
+	if err != nil {
+		return AncestryProof{}, err
+	}
+	if mainHash != blockHash {
+		return AncestryProof{}, fmt.Errorf("Block is not an ancestor of the tip.")
+	}
+
+	peaks, err := dag.getHistoryPeaks(tip.ParentHash)
+	if err != nil {
+		return AncestryProof{}, err
+	}
+	leftPeaks := [][32]byte{}
+	if 0 < height {
+		leftPeaks, err = dag.getHistoryPeaks(block.ParentHash)
+		if err != nil {
+			return AncestryProof{}, err
+		}
+	}
+
+	proof := AncestryProof{
+		Header: block.ToBlockHeader(),
+		Height: height,
+		Length: n,
+		Path:   [][32]byte{},
+		Peaks:  peaks,
+	}
+	for _, r := range historyPeakRanges(n) {
+		start, size := r[0], r[1]
+		if height < start || start+size <= height {
+			continue
+		}
+		// The peaks of the block's parent are the perfect trees for each bit set in its height, the smallest last.
+		levels := bits.TrailingZeros64(size)
+		left := len(leftPeaks) - 1
+		for level := 0; level < levels; level++ {
+			if height&(1<<level) != 0 {
+				proof.Path = append(proof.Path, leftPeaks[left])
+				left--
+				continue
+			}
+			right, err := dag.getHistorySubtreeRoot((height>>level<<level)+(1<<level), level)
+			if err != nil {
+				return AncestryProof{}, err
+			}
+			proof.Path = append(proof.Path, right)
+		}
+	}
+
+	// The canonical markers of the transaction index are updated with the full tip, so check they were current.
+	if err := VerifyAncestryProof(proof, tip.ToBlockHeader()); err != nil {
+		return AncestryProof{}, err
+	}
+	return proof, nil
+}
+
+// Verifies a proof that a block is an ancestor of the tip.
+func VerifyAncestryProof(proof AncestryProof, tip BlockHeader) error {
+	if tip.HistoryRoot == [32]byte{} {
+		return fmt.Errorf("%w: tip has no history root", ErrInvalidAncestryProof)
+	}
+	if proof.Length <= proof.Height {
+		return fmt.Errorf("%w: height %d is beyond the history of length %d", ErrInvalidAncestryProof, proof.Height, proof.Length)
+	}
+	if len(proof.Peaks) != bits.OnesCount64(proof.Length) {
+		return fmt.Errorf("%w: wrong number of peaks", ErrInvalidAncestryProof)
+	}
+	if historyRoot(proof.Length, proof.Peaks) != tip.HistoryRoot {
+		return fmt.Errorf("%w: peaks don't match the tip's history root", ErrInvalidAncestryProof)
+	}
+
+	for i, r := range historyPeakRanges(proof.Length) {
+		start, size := r[0], r[1]
+		if proof.Height < start || start+size <= proof.Height {
+			continue
+		}
+		if len(proof.Path) != bits.TrailingZeros64(size) {
+			return fmt.Errorf("%w: wrong path length", ErrInvalidAncestryProof)
+		}
+		node := historyLeaf(proof.Header.BlockHash())
+		index := proof.Height - start
+		for _, sibling := range proof.Path {
+			if index&1 == 0 {
+				node = historyParent(node, sibling)
+			} else {
+				node = historyParent(sibling, node)
+			}
+			index >>= 1
+		}
+		if node != proof.Peaks[i] {
+			return fmt.Errorf("%w: path doesn't match the peak", ErrInvalidAncestryProof)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: no peak covers height %d", ErrInvalidAncestryProof, proof.Height)
+}
@@ -0,0 +1,181 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryMMR(t *testing.T) {
+	assert := assert.New(t)
+
+	leaves := [][32]byte{}
+	peaks := [][32]byte{}
+	for n := uint64(0); n < 40; n++ {
+		leaf := historyLeaf([32]byte{byte(n)})
+		peaks = historyAppend(peaks, n, leaf)
+		leaves = append(leaves, leaf)
+
+		// The appended peaks are the roots of the perfect trees of the leaves.
+		ranges := historyPeakRanges(n + 1)
+		assert.Equal(len(ranges), len(peaks))
+		for i, r := range ranges {
+			assert.Equal(historySubtreeRoot(leaves[r[0]:r[0]+r[1]]), peaks[i])
+		}
+	}
+
+	decoded, err := decodeHistoryPeaks(encodeHistoryPeaks(peaks))
+	assert.Nil(err)
+	assert.Equal(peaks, decoded)
+	_, err = decodeHistoryPeaks([]byte{1, 2, 3})
+	assert.NotNil(err)
+}
+
+func TestEncodeHistoryRoot(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, err := newValidTx(t)
+	if err != nil {
+		t.Fatalf("Failed to create tx: %s", err)
+	}
+
+	// The history root is encoded after the base fee and version, even when they're empty.
+	b := RawBlock{
+		BlockHeader:  BlockHeader{ParentHash: [32]byte{1}, HistoryRoot: [32]byte{2}},
+		Transactions: []RawTransaction{},
+	}
+	assert.Equal(BLOCK_HEADER_BASE_SIZE+BLOCK_HEADER_HISTORY_EXTENSION_SIZE, len(b.Bytes()))
+	decoded, err := DecodeRawBlock(b.Bytes())
+	assert.Nil(err)
+	assert.Equal(b, decoded)
+
+	b.NumTransactions = 1
+	b.Transactions = []RawTransaction{tx}
+	b.TransactionsMerkleRoot = core.ComputeMerkleHash([][]byte{tx.Envelope()})
+	decoded, err = DecodeRawBlock(b.Bytes())
+	assert.Nil(err)
+	assert.Equal(b, decoded)
+}
+
+func TestDagHistoryRoot(t *testing.T) {
+	assert := assert.New(t)
+	dag, conf, _ := newBlockdagLongEpoch()
+	dag.consensus.Forks = map[string]uint64{FORK_HEADER_HISTORY: 5}
+
+	wallets := getTestingWallets(t)
+	miner := NewMiner(dag, &wallets[0])
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+
+	// The miner only sets the history root once the fork is active.
+	miner.Start(4)
+	assert.Equal(uint64(4), dag.FullTip.Height)
+	assert.Equal([32]byte{}, dag.FullTip.HistoryRoot)
+	miner.Start(16)
+	tip := dag.FullTip
+	assert.Equal(uint64(20), tip.Height)
+	assert.NotEqual([32]byte{}, tip.HistoryRoot)
+
+	// Every block of the main chain has an ancestry proof against the tip.
+	rawGenesis := GetRawGenesisBlockFromConfig(conf)
+	it, err := dag.IterateMainChain(0, tip.Height-1)
+	assert.Nil(err)
+	hashes := [][32]byte{}
+	for it.Next() {
+		hashes = append(hashes, it.Block().Hash)
+	}
+	it.Close()
+	assert.Equal(rawGenesis.Hash(), hashes[0])
+	for height, hash := range hashes {
+		proof, err := dag.GetAncestryProof(hash, tip.Hash)
+		assert.Nil(err)
+		assert.Equal(uint64(height), proof.Height)
+		assert.Nil(VerifyAncestryProof(proof, tip.ToBlockHeader()))
+	}
+
+	// And against every tip since the fork, for each shape of the history.
+	for n := 5; n < len(hashes); n++ {
+		intermediate, err := dag.GetBlockByHash(hashes[n])
+		assert.Nil(err)
+		for height := 0; height < n; height++ {
+			proof, err := dag.GetAncestryProof(hashes[height], hashes[n])
+			assert.Nil(err)
+			assert.Nil(VerifyAncestryProof(proof, intermediate.ToBlockHeader()))
+		}
+	}
+
+	// The tip isn't its own ancestor.
+	_, err = dag.GetAncestryProof(tip.Hash, tip.Hash)
+	assert.EqualError(err, "Block is not an ancestor of the tip.")
+	// Tips before the fork have no history.
+	_, err = dag.GetAncestryProof(hashes[0], hashes[3])
+	assert.EqualError(err, "Tip has no history root.")
+
+	// Tampered proofs are rejected.
+	proof, err := dag.GetAncestryProof(hashes[7], tip.Hash)
+	assert.Nil(err)
+	tampered := proof
+	tampered.Header.Nonce = [32]byte{1}
+	assert.ErrorIs(VerifyAncestryProof(tampered, tip.ToBlockHeader()), ErrInvalidAncestryProof)
+	tampered = proof
+	tampered.Height = 6
+	assert.ErrorIs(VerifyAncestryProof(tampered, tip.ToBlockHeader()), ErrInvalidAncestryProof)
+	tampered = proof
+	tampered.Length = tip.Height - 1
+	assert.ErrorIs(VerifyAncestryProof(tampered, tip.ToBlockHeader()), ErrInvalidAncestryProof)
+	tampered = proof
+	tampered.Path = proof.Path[1:]
+	assert.ErrorIs(VerifyAncestryProof(tampered, tip.ToBlockHeader()), ErrInvalidAncestryProof)
+	parent, err := dag.GetBlockByHash(tip.ParentHash)
+	assert.Nil(err)
+	assert.ErrorIs(VerifyAncestryProof(proof, parent.ToBlockHeader()), ErrInvalidAncestryProof)
+
+	// Blocks with the wrong history root are rejected.
+	newBlock := func(parent Block, historyRoot [32]byte) RawBlock {
+		coinbase := MakeCoinbaseTx(&wallets[0])
+		return RawBlock{
+			BlockHeader: BlockHeader{
+				ParentHash:             parent.Hash,
+				ParentTotalWork:        BigIntToBytes32(parent.AccumulatedWork),
+				Timestamp:              Timestamp(),
+				NumTransactions:        1,
+				TransactionsMerkleRoot: core.ComputeMerkleHash([][]byte{coinbase.Envelope()}),
+				HistoryRoot:            historyRoot,
+			},
+			Transactions: []RawTransaction{coinbase},
+		}
+	}
+	assert.EqualError(dag.IngestBlock(newBlock(tip, [32]byte{1})), "History root is incorrect.")
+	assert.EqualError(dag.IngestBlock(newBlock(tip, [32]byte{})), "History root is incorrect.")
+	genesis, err := dag.GetBlockByHash(hashes[0])
+	assert.Nil(err)
+	assert.EqualError(dag.IngestBlock(newBlock(*genesis, [32]byte{1})), "History root must be empty before the header_history fork.")
+
+	// Checking a block doesn't store anything, even when peaks are missing.
+	dag.db.Exec("update blocks set history_peaks = null")
+	root, err := dag.GetNextHistoryRoot(*parent)
+	assert.Nil(err)
+	assert.Equal(tip.HistoryRoot, root)
+	assert.EqualError(dag.CheckBlockTemplate(newBlock(tip, [32]byte{1})), "History root is incorrect.")
+	stored := 0
+	dag.db.QueryRow("select count(*) from blocks where history_peaks is not null").Scan(&stored)
+	assert.Equal(0, stored)
+
+	// Missing peaks are backfilled by the migration, and proofs are built from them.
+	tx, err := dag.db.Begin()
+	assert.Nil(err)
+	assert.Nil(backfillHistoryPeaks(tx))
+	assert.Nil(tx.Commit())
+	for height, hash := range hashes {
+		peaks, err := dag.getHistoryPeaks(hash)
+		assert.Nil(err)
+		assert.Equal(len(historyPeakRanges(uint64(height+1))), len(peaks))
+		proof, err := dag.GetAncestryProof(hash, tip.Hash)
+		assert.Nil(err)
+		assert.Nil(VerifyAncestryProof(proof, tip.ToBlockHeader()))
+	}
+}
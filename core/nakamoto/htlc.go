@@ -0,0 +1,142 @@
+package nakamoto
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// Hashed timelock contracts (HTLCs) lock coins so that the recipient can claim them by revealing the preimage of a hash,
+// or, once the timeout height is reached, the sender can refund them. They are built from predicates (see predicate.go):
+//
+//	or(and(hash(H), sig(recipient)), and(after(timeout), sig(sender)))
+//
+// An atomic swap between Alice and Bob, across two chains (or two tinychain networks), works as follows:
+//
+//  1. Alice picks a secret, and locks her coins on chain A in an HTLC to Bob with H = sha256(secret).
+//  2. Bob locks his coins on chain B in an HTLC to Alice with the same H, and a shorter timeout.
+//  3. Alice claims Bob's coins on chain B, revealing the secret in her claim's witness.
+//  4. Bob extracts the secret from Alice's claim (ExtractHTLCPreimage), and claims Alice's coins on chain A.
+//
+// If either party walks away, the other refunds their coins after the timeout. Bob's timeout must be shorter than
+// Alice's, so that he has time to claim after she reveals the secret.
+
+var ErrHTLCWrongRecipient = errors.New("HTLC spent to the wrong recipient")
+
+const (
+	HTLC_CLAIM  = 0
+	HTLC_REFUND = 1
+)
+
+type HTLC struct {
+	// The account which locks the coins, and can refund them after the timeout.
+	Sender [65]byte
+	// The account which can claim the coins with the preimage.
+	Recipient [65]byte
+	// The sha256 hash of the preimage.
+	Hash [32]byte
+	// The height from which the sender can refund the coins.
+	Timeout uint64
+}
+
+func (h HTLC) Predicate() *Predicate {
+	return OrPredicate(
+		AndPredicate(HashPredicate(h.Hash), SigPredicate(h.Recipient)),
+		AndPredicate(AfterPredicate(h.Timeout), SigPredicate(h.Sender)),
+	)
+}
+
+// Returns the address the coins are locked in.
+func (h HTLC) Address() [65]byte {
+	return h.Predicate().Address()
+}
+
+// Parses an HTLC from its predicate. Returns false if the predicate isn't an HTLC.
+func ParseHTLC(predicate []byte) (HTLC, bool) {
+	p, err := ParsePredicate(predicate)
+	if err != nil || p.Type != PREDICATE_OR {
+		return HTLC{}, false
+	}
+	claim, refund := p.Left, p.Right
+	if claim.Type != PREDICATE_AND || claim.Left.Type != PREDICATE_HASH || claim.Right.Type != PREDICATE_SIG {
+		return HTLC{}, false
+	}
+	if refund.Type != PREDICATE_AND || refund.Left.Type != PREDICATE_AFTER || refund.Right.Type != PREDICATE_SIG {
+		return HTLC{}, false
+	}
+	return HTLC{
+		Sender:    refund.Right.Pubkeys[0],
+		Recipient: claim.Right.Pubkeys[0],
+		Hash:      claim.Left.Hash,
+		Timeout:   refund.Left.Height,
+	}, true
+}
+
+// Makes a transaction locking coins from the sender's wallet in an HTLC.
+func MakeHTLCCreateTx(h HTLC, amount uint64, wallet *core.Wallet, fee uint64) RawTransaction {
+	return MakeTransferTx(wallet.PubkeyBytes(), h.Address(), amount, wallet, fee)
+}
+
+// Makes a transaction claiming the coins in an HTLC to the recipient, signed by the recipient's wallet.
+func MakeHTLCClaimTx(h HTLC, preimage []byte, amount uint64, wallet *core.Wallet, fee uint64) (RawTransaction, error) {
+	if sha256.Sum256(preimage) != h.Hash {
+		return RawTransaction{}, fmt.Errorf("Preimage does not match hash.")
+	}
+	tx := MakePredicateSpendTx(h.Predicate(), h.Recipient, amount, fee)
+	sig, err := wallet.Sign(tx.Envelope())
+	if err != nil {
+		return RawTransaction{}, err
+	}
+	tx.Witness = EncodeWitness([][]byte{{HTLC_CLAIM}, preimage, sig})
+	return tx, nil
+}
+
+// Makes a transaction refunding the coins in an HTLC to the sender, signed by the sender's wallet. It is only valid in
+// blocks at or after the timeout.
+func MakeHTLCRefundTx(h HTLC, amount uint64, wallet *core.Wallet, fee uint64) (RawTransaction, error) {
+	tx := MakePredicateSpendTx(h.Predicate(), h.Sender, amount, fee)
+	sig, err := wallet.Sign(tx.Envelope())
+	if err != nil {
+		return RawTransaction{}, err
+	}
+	tx.Witness = EncodeWitness([][]byte{{HTLC_REFUND}, sig})
+	return tx, nil
+}
+
+// Returns the preimage revealed by a transaction claiming an HTLC.
+func ExtractHTLCPreimage(tx RawTransaction) ([]byte, bool) {
+	if _, ok := ParseHTLC(tx.Predicate); !ok {
+		return nil, false
+	}
+	items, err := DecodeWitness(tx.Witness)
+	if err != nil || len(items) != 3 || len(items[0]) != 1 || items[0][0] != HTLC_CLAIM {
+		return nil, false
+	}
+	return items[1], true
+}
+
+// Checks a transaction spending from an HTLC pays the recipient when claiming, and the sender when refunding. Other
+// transactions are ignored.
+func VerifyHTLCSpend(tx RawTransaction) error {
+	h, ok := ParseHTLC(tx.Predicate)
+	if !ok || !IsPredicateAddress(tx.FromPubkey) {
+		return nil
+	}
+	items, err := DecodeWitness(tx.Witness)
+	if err != nil || len(items) == 0 || len(items[0]) != 1 {
+		return ErrPredicateNotSatisfied
+	}
+	switch items[0][0] {
+	case HTLC_CLAIM:
+		if tx.ToPubkey != h.Recipient {
+			return ErrHTLCWrongRecipient
+		}
+	case HTLC_REFUND:
+		if tx.ToPubkey != h.Sender {
+			return ErrHTLCWrongRecipient
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package nakamoto
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTLC(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	alice, bob := wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes()
+	secret := []byte("secret")
+	h := HTLC{
+		Sender:    alice,
+		Recipient: bob,
+		Hash:      sha256.Sum256(secret),
+		Timeout:   100,
+	}
+
+	parsed, ok := ParseHTLC(h.Predicate().Bytes())
+	assert.True(ok)
+	assert.Equal(h, parsed)
+	_, ok = ParseHTLC(SigPredicate(alice).Bytes())
+	assert.False(ok)
+
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.Apply([]*StateLeaf{{PubKey: alice, Balance: 1000}})
+
+	// Alice locks her coins.
+	create := MakeHTLCCreateTx(h, 500, &wallets[0], 0)
+	effects, err := stateMachine.Transition(StateMachineInput{RawTransaction: create, BlockHeight: 1})
+	assert.Nil(err)
+	stateMachine.Apply(effects)
+	assert.Equal(uint64(500), stateMachine.GetBalance(h.Address()))
+
+	// Bob can only claim with the preimage.
+	_, err = MakeHTLCClaimTx(h, []byte("guess"), 500, &wallets[1], 0)
+	assert.EqualError(err, "Preimage does not match hash.")
+	claim, err := MakeHTLCClaimTx(h, secret, 500, &wallets[1], 0)
+	assert.Nil(err)
+
+	// And only to himself.
+	redirected := claim
+	redirected.ToPubkey = alice
+	sig, err := wallets[1].Sign(redirected.Envelope())
+	assert.Nil(err)
+	redirected.Witness = EncodeWitness([][]byte{{HTLC_CLAIM}, secret, sig})
+	_, err = stateMachine.Transition(StateMachineInput{RawTransaction: redirected, BlockHeight: 2})
+	assert.Equal(ErrHTLCWrongRecipient, err)
+
+	// Alice can't refund before the timeout.
+	refund, err := MakeHTLCRefundTx(h, 500, &wallets[0], 0)
+	assert.Nil(err)
+	_, err = stateMachine.Transition(StateMachineInput{RawTransaction: refund, BlockHeight: 99})
+	assert.Equal(ErrPredicateNotSatisfied, err)
+
+	// Bob claims, revealing the preimage to Alice.
+	effects, err = stateMachine.Transition(StateMachineInput{RawTransaction: claim, BlockHeight: 2})
+	assert.Nil(err)
+	stateMachine.Apply(effects)
+	assert.Equal(uint64(500), stateMachine.GetBalance(bob))
+	preimage, ok := ExtractHTLCPreimage(claim)
+	assert.True(ok)
+	assert.Equal(secret, preimage)
+	_, ok = ExtractHTLCPreimage(refund)
+	assert.False(ok)
+}
+
+func TestHTLCRefund(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	alice, bob := wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes()
+	h := HTLC{
+		Sender:    alice,
+		Recipient: bob,
+		Hash:      sha256.Sum256([]byte("secret")),
+		Timeout:   100,
+	}
+
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.Apply([]*StateLeaf{{PubKey: h.Address(), Balance: 500}})
+
+	// Bob can't refund to himself.
+	refund, err := MakeHTLCRefundTx(h, 500, &wallets[1], 0)
+	assert.Nil(err)
+	_, err = stateMachine.Transition(StateMachineInput{RawTransaction: refund, BlockHeight: 100})
+	assert.Equal(ErrPredicateNotSatisfied, err)
+
+	// Alice refunds after the timeout.
+	refund, err = MakeHTLCRefundTx(h, 500, &wallets[0], 0)
+	assert.Nil(err)
+	effects, err := stateMachine.Transition(StateMachineInput{RawTransaction: refund, BlockHeight: 100})
+	assert.Nil(err)
+	stateMachine.Apply(effects)
+	assert.Equal(uint64(500), stateMachine.GetBalance(alice))
+	assert.Equal(uint64(0), stateMachine.GetBalance(h.Address()))
+}
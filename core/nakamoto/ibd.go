@@ -0,0 +1,128 @@
+package nakamoto
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Initial block download (IBD) is the mode a node is in while it's far behind the network, ie. when it first starts,
+// or after being offline for a while. The transactions it receives can't be validated against the state of the
+// network's tip, and blocks it mines would be orphaned, so while in IBD the node:
+//   - drops transactions gossiped by peers, rather than adding them to the mempool, and rejects transactions submitted
+//     to it with ErrInitialBlockDownload.
+//   - doesn't gossip or rebroadcast transactions.
+//   - pauses the miner, if it's running, and refuses to start it.
+//
+// The node is in IBD while its full tip is more than EnterBlocksBehind blocks behind the best known chain, which is
+// the higher of its headers tip and the tips advertised by its peers (see GetSyncStatus). It leaves IBD once it's
+// caught up to within ExitBlocksBehind blocks, and resumes normal operation, restarting the miner if it was paused.
+// The two thresholds differ, so a node near the threshold doesn't flap in and out of IBD.
+//
+// The monitor checks on each new full tip, and every Interval, since peers' tips are learnt from their heartbeats.
+
+const (
+	DEFAULT_IBD_ENTER_BLOCKS_BEHIND = 100
+	DEFAULT_IBD_EXIT_BLOCKS_BEHIND  = 1
+)
+
+var ErrInitialBlockDownload = errors.New("node is in initial block download")
+
+type IBDStatus struct {
+	InIBD bool
+	// When the node last entered or left IBD.
+	Since time.Time
+	// The number of blocks the full tip is behind the best known chain, as of the last check.
+	BlocksBehind uint64
+}
+
+type IBDMonitor struct {
+	EnterBlocksBehind uint64
+	ExitBlocksBehind  uint64
+	// How often the node's sync status is checked.
+	Interval time.Duration
+
+	GetSyncStatus func() (SyncStatus, error)
+
+	// Called when the node enters (true) or leaves (false) IBD.
+	OnChange func(inIBD bool)
+
+	status IBDStatus
+	// Serializes checks, so changes are delivered in order.
+	checkMutex sync.Mutex
+	mutex      sync.Mutex
+	log        *log.Logger
+}
+
+func NewIBDMonitor() *IBDMonitor {
+	return &IBDMonitor{
+		EnterBlocksBehind: DEFAULT_IBD_ENTER_BLOCKS_BEHIND,
+		ExitBlocksBehind:  DEFAULT_IBD_EXIT_BLOCKS_BEHIND,
+		Interval:          5 * time.Second,
+		log:               NewLogger("node", "ibd"),
+	}
+}
+
+func (m *IBDMonitor) Start() {
+	for {
+		if _, err := m.Check(time.Now()); err != nil {
+			m.log.Printf("Failed to check sync status: %s\n", err)
+		}
+		time.Sleep(m.Interval)
+	}
+}
+
+// Returns whether the node is in IBD.
+func (m *IBDMonitor) InIBD() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.status.InIBD
+}
+
+func (m *IBDMonitor) Status() IBDStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.status
+}
+
+// Checks how far behind the node is, entering or leaving IBD.
+func (m *IBDMonitor) Check(now time.Time) (IBDStatus, error) {
+	m.checkMutex.Lock()
+	defer m.checkMutex.Unlock()
+	if m.GetSyncStatus == nil {
+		return m.Status(), nil
+	}
+	syncStatus, err := m.GetSyncStatus()
+	if err != nil {
+		return IBDStatus{}, err
+	}
+	best := max(syncStatus.HeadersTipHeight, syncStatus.BestPeerHeight)
+	behind := uint64(0)
+	if syncStatus.FullTipHeight < best {
+		behind = best - syncStatus.FullTipHeight
+	}
+
+	m.mutex.Lock()
+	changed := false
+	if !m.status.InIBD && m.EnterBlocksBehind < behind {
+		m.status.InIBD, m.status.Since, changed = true, now, true
+	} else if m.status.InIBD && behind <= m.ExitBlocksBehind {
+		m.status.InIBD, m.status.Since, changed = false, now, true
+	}
+	m.status.BlocksBehind = behind
+	status := m.status
+	m.mutex.Unlock()
+
+	if changed {
+		if status.InIBD {
+			m.log.Printf("Entering initial block download, %d blocks behind: tip=%d best=%d\n", behind, syncStatus.FullTipHeight, best)
+		} else {
+			m.log.Printf("Caught up, leaving initial block download: tip=%d best=%d\n", syncStatus.FullTipHeight, best)
+		}
+		if m.OnChange != nil {
+			m.OnChange(status.InIBD)
+		}
+	}
+	return status, nil
+}
@@ -0,0 +1,103 @@
+package nakamoto
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIBDMonitor(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewIBDMonitor()
+	syncStatus := SyncStatus{FullTipHeight: 50, HeadersTipHeight: 50}
+	m.GetSyncStatus = func() (SyncStatus, error) {
+		return syncStatus, nil
+	}
+	changes := []bool{}
+	m.OnChange = func(inIBD bool) {
+		changes = append(changes, inIBD)
+	}
+	now := time.Now()
+
+	// Behind, but not by enough to enter IBD.
+	syncStatus.BestPeerHeight = 50 + DEFAULT_IBD_ENTER_BLOCKS_BEHIND
+	status, err := m.Check(now)
+	assert.Nil(err)
+	assert.False(status.InIBD)
+	assert.Equal(uint64(DEFAULT_IBD_ENTER_BLOCKS_BEHIND), status.BlocksBehind)
+
+	// Far behind a peer.
+	syncStatus.BestPeerHeight = 1000
+	status, err = m.Check(now)
+	assert.Nil(err)
+	assert.True(status.InIBD)
+	assert.Equal(now, status.Since)
+	assert.True(m.InIBD())
+
+	// Or behind our headers, until caught up.
+	syncStatus.BestPeerHeight = 0
+	syncStatus.HeadersTipHeight = 1000
+	syncStatus.FullTipHeight = 990
+	status, err = m.Check(now.Add(time.Minute))
+	assert.Nil(err)
+	assert.True(status.InIBD)
+	assert.Equal(now, status.Since)
+
+	syncStatus.FullTipHeight = 999
+	status, err = m.Check(now.Add(time.Minute))
+	assert.Nil(err)
+	assert.False(status.InIBD)
+	assert.Equal(now.Add(time.Minute), status.Since)
+	assert.Equal([]bool{true, false}, changes)
+}
+
+func TestNodeIBD(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	node.Miner.OnBlockSolution = func(block RawBlock) {
+		node.Dag.IngestBlock(block)
+	}
+	node.Miner.Start(2)
+
+	var mutex sync.Mutex
+	bestPeerHeight := uint64(0)
+	node.IBD.GetSyncStatus = func() (SyncStatus, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return SyncStatus{FullTipHeight: node.Dag.FullTip.Height, BestPeerHeight: bestPeerHeight}, nil
+	}
+	setBestPeerHeight := func(height uint64) {
+		mutex.Lock()
+		bestPeerHeight = height
+		mutex.Unlock()
+		_, err := node.IBD.Check(time.Now())
+		assert.Nil(err)
+	}
+
+	// The miner is paused in IBD.
+	go node.Miner.Start(-1)
+	assert.Eventually(node.Miner.Running, time.Second, time.Millisecond)
+	setBestPeerHeight(1000)
+	assert.True(node.IBD.InIBD())
+	assert.Eventually(func() bool { return !node.Miner.Running() }, time.Second, time.Millisecond)
+
+	// Transactions aren't accepted.
+	tx := MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 1, &wallets[0], 0)
+	_, err := node.SubmitTransaction(tx)
+	assert.ErrorIs(err, ErrInitialBlockDownload)
+	node.Peer.Callbacks().OnNewTransaction(tx)
+	assert.False(node.Mempool.HasTransaction(tx.Hash()))
+
+	// Until the node catches up, when the miner resumes.
+	setBestPeerHeight(node.Dag.FullTip.Height)
+	assert.False(node.IBD.InIBD())
+	assert.Eventually(node.Miner.Running, time.Second, time.Millisecond)
+	node.Miner.Stop()
+}
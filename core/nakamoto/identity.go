@@ -0,0 +1,223 @@
+package nakamoto
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// Each node has an identity keypair, which it signs its peer messages and replies with. The node ID is the hex-encoded
+// public key. This lets peers recognise a node across IP changes, and discard messages which claim to come from a
+// known peer's address but aren't signed by its identity.
+//
+// Signatures are carried in the PEER_NODE_ID_HEADER and PEER_SIGNATURE_HEADER headers, and cover the message body as
+// sent, the time it was signed at, and a random nonce chosen by the sender of the message. The receiver rejects
+// signatures outside PEER_SIGNATURE_MAX_SKEW of its own clock, and nonces it has already seen from the signer, so a
+// signed message can't be replayed. A reply is signed over the nonce of the message it replies to, so it can't be
+// replayed as the reply to another message.
+//
+// Unsigned messages are still accepted from peers without a known identity, for compatibility with older nodes. Once a
+// peer's identity is known, messages claiming its address must be signed by it, and messages from its host must be
+// signed.
+
+// The headers a node sets to sign a message or reply with its identity.
+const (
+	PEER_NODE_ID_HEADER   = "X-Tinychain-Node-Id"
+	PEER_SIGNATURE_HEADER = "X-Tinychain-Signature"
+	// The time the message was signed at, in milliseconds since the Unix epoch.
+	PEER_SIGNED_AT_HEADER = "X-Tinychain-Signed-At"
+	// The nonce of a message, which its reply echoes.
+	PEER_NONCE_HEADER = "X-Tinychain-Nonce"
+)
+
+const (
+	// How far the time a message was signed at can be from our clock.
+	PEER_SIGNATURE_MAX_SKEW = 5 * time.Minute
+	// The maximum number of nonces remembered for replay protection. Past this, the oldest are forgotten early.
+	MAX_PEER_SEEN_NONCES = 100_000
+)
+
+// Prefixed to messages before they are signed, so that identity signatures can't be replayed as other signatures.
+var peerMessageSignaturePrefix = []byte("tinychain peer message:")
+
+var (
+	ErrInvalidNodeID           = errors.New("invalid node ID")
+	ErrInvalidMessageSignature = errors.New("invalid message signature")
+	ErrMessageSignatureExpired = errors.New("message signature expired")
+	ErrMessageReplayed         = errors.New("message replayed")
+)
+
+// Loads the node identity from a file containing the hex-encoded private key, creating it if it doesn't exist.
+func LoadOrCreateNodeIdentity(path string) (*core.Wallet, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		identity, err := core.WalletFromPrivateKey(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load node identity from %s: %s", path, err)
+		}
+		return identity, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	identity, err := core.CreateRandomWallet()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(identity.PrvkeyStr()+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+// Returns the node ID of an identity.
+func NodeID(identity *core.Wallet) string {
+	return identity.PubkeyStr()
+}
+
+// Checks a node ID is a valid public key.
+func validateNodeID(nodeID string) error {
+	pubkey, err := hex.DecodeString(nodeID)
+	if err != nil || len(pubkey) != 65 {
+		return ErrInvalidNodeID
+	}
+	if _, err := ecdh.P256().NewPublicKey(pubkey); err != nil {
+		return ErrInvalidNodeID
+	}
+	return nil
+}
+
+// Returns a random nonce for a message.
+func newPeerMessageNonce() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// The data an identity signs for a message.
+func peerMessageSigningData(signedAt int64, nonce string, body []byte) []byte {
+	data := append([]byte{}, peerMessageSignaturePrefix...)
+	data = binary.BigEndian.AppendUint64(data, uint64(signedAt))
+	data = append(data, byte(len(nonce)))
+	data = append(data, nonce...)
+	return append(data, body...)
+}
+
+// Signs a message body with a nonce, setting the identity headers. A nil identity leaves the message unsigned.
+func signPeerMessage(header http.Header, identity *core.Wallet, body []byte, nonce string, now time.Time) error {
+	if identity == nil {
+		return nil
+	}
+	if 255 < len(nonce) {
+		return fmt.Errorf("nonce too long")
+	}
+	signedAt := now.UnixMilli()
+	sig, err := identity.Sign(peerMessageSigningData(signedAt, nonce, body))
+	if err != nil {
+		return err
+	}
+	header.Set(PEER_NODE_ID_HEADER, NodeID(identity))
+	header.Set(PEER_SIGNATURE_HEADER, hex.EncodeToString(sig))
+	header.Set(PEER_SIGNED_AT_HEADER, strconv.FormatInt(signedAt, 10))
+	header.Set(PEER_NONCE_HEADER, nonce)
+	return nil
+}
+
+// Verifies the identity signature of a message body, returning the signer's node ID, or "" if the message is unsigned.
+// The nonce the message was signed with is in the PEER_NONCE_HEADER.
+func verifyPeerMessage(header http.Header, body []byte, now time.Time) (string, error) {
+	nodeID := header.Get(PEER_NODE_ID_HEADER)
+	sigHex := header.Get(PEER_SIGNATURE_HEADER)
+	if nodeID == "" && sigHex == "" {
+		return "", nil
+	}
+
+	if err := validateNodeID(nodeID); err != nil {
+		return "", err
+	}
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil || len(sig) != 64 {
+		return "", ErrInvalidMessageSignature
+	}
+	signedAt, err := strconv.ParseInt(header.Get(PEER_SIGNED_AT_HEADER), 10, 64)
+	if err != nil {
+		return "", ErrInvalidMessageSignature
+	}
+	nonce := header.Get(PEER_NONCE_HEADER)
+	if nonce == "" || 255 < len(nonce) {
+		return "", ErrInvalidMessageSignature
+	}
+	if !core.VerifySignature(nodeID, sig, peerMessageSigningData(signedAt, nonce, body)) {
+		return "", ErrInvalidMessageSignature
+	}
+	skew := now.Sub(time.UnixMilli(signedAt))
+	if skew < -PEER_SIGNATURE_MAX_SKEW || PEER_SIGNATURE_MAX_SKEW < skew {
+		return "", ErrMessageSignatureExpired
+	}
+	return nodeID, nil
+}
+
+// Remembers the nonces of signed messages, so they can't be replayed. A nonce only needs to be remembered for as long
+// as its signature is within PEER_SIGNATURE_MAX_SKEW, after which the message is rejected as expired anyway.
+type peerNonceCache struct {
+	seen  map[string]time.Time
+	mutex sync.Mutex
+}
+
+func newPeerNonceCache() *peerNonceCache {
+	return &peerNonceCache{seen: make(map[string]time.Time)}
+}
+
+// Records a signer's nonce. Returns ErrMessageReplayed if it was already seen.
+func (c *peerNonceCache) Check(nodeID string, nonce string, now time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := nodeID + ":" + nonce
+	if _, ok := c.seen[key]; ok {
+		return ErrMessageReplayed
+	}
+
+	if MAX_PEER_SEEN_NONCES <= len(c.seen) {
+		c.prune(now)
+	}
+	c.seen[key] = now
+	return nil
+}
+
+// Forgets nonces which are older than a signature can be. If there are still too many, forgets the oldest half.
+func (c *peerNonceCache) prune(now time.Time) {
+	var times []time.Time
+	for key, seenAt := range c.seen {
+		if 2*PEER_SIGNATURE_MAX_SKEW < now.Sub(seenAt) {
+			delete(c.seen, key)
+			continue
+		}
+		times = append(times, seenAt)
+	}
+	if len(c.seen) < MAX_PEER_SEEN_NONCES {
+		return
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	cutoff := times[len(times)/2]
+	for key, seenAt := range c.seen {
+		if !seenAt.After(cutoff) {
+			delete(c.seen, key)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package nakamoto
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadOrCreateNodeIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	path := filepath.Join(t.TempDir(), "node.identity")
+	identity, err := LoadOrCreateNodeIdentity(path)
+	assert.Nil(err)
+
+	// The identity persists.
+	loaded, err := LoadOrCreateNodeIdentity(path)
+	assert.Nil(err)
+	assert.Equal(NodeID(identity), NodeID(loaded))
+}
+
+func TestSignPeerMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	identity, _ := core.CreateRandomWallet()
+	body := []byte(`{"type":"new_block"}`)
+	now := time.Now()
+
+	header := http.Header{}
+	assert.Nil(signPeerMessage(header, identity, body, "nonce", now))
+	nodeID, err := verifyPeerMessage(header, body, now)
+	assert.Nil(err)
+	assert.Equal(NodeID(identity), nodeID)
+	assert.Equal("nonce", header.Get(PEER_NONCE_HEADER))
+
+	// Signatures too far from our clock are rejected.
+	_, err = verifyPeerMessage(header, body, now.Add(PEER_SIGNATURE_MAX_SKEW+time.Second))
+	assert.ErrorIs(err, ErrMessageSignatureExpired)
+	_, err = verifyPeerMessage(header, body, now.Add(-PEER_SIGNATURE_MAX_SKEW-time.Second))
+	assert.ErrorIs(err, ErrMessageSignatureExpired)
+
+	// The nonce and time are signed.
+	tampered := header.Clone()
+	tampered.Set(PEER_NONCE_HEADER, "other")
+	_, err = verifyPeerMessage(tampered, body, now)
+	assert.ErrorIs(err, ErrInvalidMessageSignature)
+	tampered = header.Clone()
+	tampered.Set(PEER_SIGNED_AT_HEADER, "1")
+	_, err = verifyPeerMessage(tampered, body, now)
+	assert.ErrorIs(err, ErrInvalidMessageSignature)
+
+	// Tampered messages are rejected.
+	_, err = verifyPeerMessage(header, []byte(`{"type":"new_tx"}`), now)
+	assert.ErrorIs(err, ErrInvalidMessageSignature)
+
+	// As are signatures by another identity.
+	other, _ := core.CreateRandomWallet()
+	header.Set(PEER_NODE_ID_HEADER, NodeID(other))
+	_, err = verifyPeerMessage(header, body, now)
+	assert.ErrorIs(err, ErrInvalidMessageSignature)
+
+	// Malformed node IDs are rejected without verifying.
+	header.Set(PEER_NODE_ID_HEADER, "04abcd")
+	_, err = verifyPeerMessage(header, body, now)
+	assert.ErrorIs(err, ErrInvalidNodeID)
+
+	// Unsigned messages have no signer.
+	nodeID, err = verifyPeerMessage(http.Header{}, body, now)
+	assert.Nil(err)
+	assert.Equal("", nodeID)
+}
+
+func TestPeerNonceCache(t *testing.T) {
+	assert := assert.New(t)
+
+	cache := newPeerNonceCache()
+	now := time.Now()
+	assert.Nil(cache.Check("a", "1", now))
+	assert.ErrorIs(cache.Check("a", "1", now), ErrMessageReplayed)
+	// Nonces are per signer.
+	assert.Nil(cache.Check("b", "1", now))
+
+	// The cache is bounded.
+	for i := 0; i < MAX_PEER_SEEN_NONCES+10; i++ {
+		cache.Check("c", strconv.Itoa(i), now.Add(time.Duration(i)))
+	}
+	assert.LessOrEqual(len(cache.seen), MAX_PEER_SEEN_NONCES)
+}
+
+func TestPeerServerSignedMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	serverIdentity, _ := core.CreateRandomWallet()
+	server := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	server.Identity = serverIdentity
+	server.RegisterMesageHandler("heartbeat", func(message []byte, codec WireCodec) (interface{}, error) {
+		return HeartbeatMesage{Type: "heartbeat", NodeID: NodeID(serverIdentity)}, nil
+	})
+	// The peer at this address is known by its identity.
+	identity, _ := core.CreateRandomWallet()
+	server.AllowSender = func(peerAddr string, remoteHost string, nodeID string) bool {
+		return peerAddr != "http://10.0.0.1:8000" || nodeID == NodeID(identity)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(server.inboxHandler))
+	defer ts.Close()
+
+	codec := wireCodecs[WIRE_ENCODING_JSON]
+	send := func(msg HeartbeatMesage, identity *core.Wallet) (string, error) {
+		buf, _ := codec.Marshal(msg)
+		_, _, signer, err := sendSignedMessageToPeer(ts.URL, buf, codec, "", "http://10.0.0.1:8000", identity, &server.log)
+		return signer, err
+	}
+
+	// Messages signed by the peer's identity are accepted, and the reply is signed by the server's.
+	signer, err := send(HeartbeatMesage{Type: "heartbeat", NodeID: NodeID(identity)}, identity)
+	assert.Nil(err)
+	assert.Equal(NodeID(serverIdentity), signer)
+
+	// Spoofed messages from the peer's address are discarded.
+	spoofer, _ := core.CreateRandomWallet()
+	_, err = send(HeartbeatMesage{Type: "heartbeat", NodeID: NodeID(spoofer)}, spoofer)
+	assert.NotNil(err)
+	_, err = send(HeartbeatMesage{Type: "heartbeat"}, nil)
+	assert.NotNil(err)
+
+	// Messages must be signed by the node ID they declare.
+	_, err = send(HeartbeatMesage{Type: "heartbeat", NodeID: NodeID(identity)}, spoofer)
+	assert.NotNil(err)
+
+	// Signed messages can't be replayed.
+	buf, _ := codec.Marshal(HeartbeatMesage{Type: "heartbeat", NodeID: NodeID(identity)})
+	header := http.Header{}
+	assert.Nil(signPeerMessage(header, identity, buf, newPeerMessageNonce(), time.Now()))
+	header.Set(PEER_ADDRESS_HEADER, "http://10.0.0.1:8000")
+	post := func() int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL, bytes.NewReader(buf))
+		req.Header = header.Clone()
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to send message: %s", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	assert.Equal(http.StatusOK, post())
+	assert.Equal(http.StatusUnauthorized, post())
+}
+
+func TestPeerReplyBoundToMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	// A server which replays a signed reply to an earlier message.
+	serverIdentity, _ := core.CreateRandomWallet()
+	reply := []byte(`{"type":"heartbeat"}`)
+	replayed := http.Header{}
+	assert.Nil(signPeerMessage(replayed, serverIdentity, reply, "earlier", time.Now()))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range replayed {
+			w.Header()[k] = v
+		}
+		w.Write(reply)
+	}))
+	defer ts.Close()
+
+	codec := wireCodecs[WIRE_ENCODING_JSON]
+	identity, _ := core.CreateRandomWallet()
+	_, _, _, err := sendSignedMessageToPeer(ts.URL, []byte(`{"type":"heartbeat"}`), codec, "", "", identity, NewLogger("peer", "test"))
+	assert.NotNil(err)
+}
+
+func TestAcceptInboundPeerIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &PeerCore{MaxPeers: 8, MinOutboundPeers: 2, peerLogger: *NewLogger("peer", "test")}
+	p.server = &PeerServer{}
+	identity, _ := core.CreateRandomWallet()
+	nodeID := NodeID(identity)
+
+	assert.Nil(p.acceptInboundPeer(HeartbeatMesage{ClientAddress: "http://10.0.0.1:8000", NodeID: nodeID}, time.Now()))
+	assert.False(p.allowSender("http://10.0.0.1:8000", "10.0.0.5", ""))
+	assert.True(p.allowSender("http://10.0.0.1:8000", "10.0.0.1", nodeID))
+
+	// Unsigned messages from the peer's host are rejected, even if they don't claim its address.
+	assert.False(p.allowSender("", "10.0.0.1", ""))
+	// Other nodes at the host can sign with their own identity.
+	other, _ := core.CreateRandomWallet()
+	assert.True(p.allowSender("", "10.0.0.1", NodeID(other)))
+	// Unsigned messages from other hosts are accepted.
+	assert.True(p.allowSender("", "10.0.0.5", ""))
+
+	// Heartbeats can't drop or change the peer's identity.
+	assert.NotNil(p.acceptInboundPeer(HeartbeatMesage{ClientAddress: "http://10.0.0.1:8000"}, time.Now()))
+	assert.NotNil(p.acceptInboundPeer(HeartbeatMesage{ClientAddress: "http://10.0.0.1:8000", NodeID: NodeID(other)}, time.Now()))
+
+	// The peer is recognised after changing its address.
+	assert.Nil(p.acceptInboundPeer(HeartbeatMesage{ClientAddress: "http://10.0.0.9:8000", NodeID: nodeID}, time.Now()))
+	peers := p.Peers()
+	assert.Equal(1, len(peers))
+	assert.Equal("http://10.0.0.9:8000", peers[0].url)
+	assert.Equal(nodeID, NewRPCPeer(peers[0]).NodeID)
+}
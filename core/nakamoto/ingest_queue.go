@@ -0,0 +1,160 @@
+package nakamoto
+
+import (
+	"errors"
+	"log"
+	"sync"
+)
+
+// The block ingestion queue sits between the network layer and the block DAG. Blocks gossiped by peers are queued,
+// and ingested one at a time by a worker, so a burst of blocks from many peers can't tie up every peer server
+// goroutine in validation.
+//
+// The queue is bounded. When it's full, new blocks are rejected with ErrBlockQueueFull, which the peer server replies
+// to with a busy status, signalling the sender to back off (see ErrPeerBusy). Blocks extending the current tip are
+// queued ahead of other blocks, since they're the ones which advance the chain; blocks on other branches or with
+// unknown parents can wait, and are recovered by sync if they're dropped.
+
+const (
+	DEFAULT_BLOCK_QUEUE_CAPACITY = 256
+)
+
+var ErrBlockQueueFull = errors.New("block queue is full")
+
+// Metrics on the queue.
+type BlockQueueStats struct {
+	Depth         int `json:"depth"`
+	PriorityDepth int `json:"priorityDepth"`
+	Capacity      int `json:"capacity"`
+	// The highest depth the queue has reached.
+	MaxDepth int `json:"maxDepth"`
+
+	Enqueued  uint64 `json:"enqueued"`
+	Rejected  uint64 `json:"rejected"`
+	Processed uint64 `json:"processed"`
+	Failed    uint64 `json:"failed"`
+}
+
+type BlockQueue struct {
+	Capacity int
+
+	// Returns whether a block should be ingested ahead of others, such as when it extends the tip.
+	IsPriority func(block RawBlock) bool
+
+	// Ingests a block.
+	Ingest func(block RawBlock) error
+
+	priority []RawBlock
+	normal   []RawBlock
+	queued   map[[32]byte]bool
+	draining bool
+	stats    BlockQueueStats
+	mutex    sync.Mutex
+	log      *log.Logger
+}
+
+func NewBlockQueue(capacity int) *BlockQueue {
+	return &BlockQueue{
+		Capacity: capacity,
+		priority: []RawBlock{},
+		normal:   []RawBlock{},
+		queued:   make(map[[32]byte]bool),
+		log:      NewLogger("node", "queue"),
+	}
+}
+
+// Queues a block for ingestion. Returns ErrBlockQueueFull if the queue is at capacity. Blocks which are already
+// queued are ignored.
+func (q *BlockQueue) Push(block RawBlock) error {
+	hash := block.Hash()
+	priority := q.IsPriority != nil && q.IsPriority(block)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.queued[hash] {
+		return nil
+	}
+	if q.Capacity <= q.depth() {
+		q.stats.Rejected += 1
+		return ErrBlockQueueFull
+	}
+
+	if priority {
+		q.priority = append(q.priority, block)
+	} else {
+		q.normal = append(q.normal, block)
+	}
+	q.queued[hash] = true
+	q.stats.Enqueued += 1
+	if q.stats.MaxDepth < q.depth() {
+		q.stats.MaxDepth = q.depth()
+	}
+
+	// Start a worker to drain the queue, if one isn't running.
+	if !q.draining {
+		q.draining = true
+		go q.drain()
+	}
+	return nil
+}
+
+// Returns the queue's metrics.
+func (q *BlockQueue) Stats() BlockQueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := q.stats
+	stats.Depth = q.depth()
+	stats.PriorityDepth = len(q.priority)
+	stats.Capacity = q.Capacity
+	return stats
+}
+
+func (q *BlockQueue) depth() int {
+	return len(q.priority) + len(q.normal)
+}
+
+// Pops the next block, priority blocks first.
+func (q *BlockQueue) pop() (RawBlock, bool) {
+	var block RawBlock
+	if 0 < len(q.priority) {
+		block, q.priority = q.priority[0], q.priority[1:]
+	} else if 0 < len(q.normal) {
+		block, q.normal = q.normal[0], q.normal[1:]
+	} else {
+		return block, false
+	}
+	delete(q.queued, block.Hash())
+	return block, true
+}
+
+// Ingests queued blocks until the queue is empty.
+func (q *BlockQueue) drain() {
+	for {
+		q.mutex.Lock()
+		block, ok := q.pop()
+		if !ok {
+			q.draining = false
+			q.mutex.Unlock()
+			return
+		}
+		q.mutex.Unlock()
+
+		var err error
+		if q.Ingest != nil {
+			err = q.Ingest(block)
+		}
+
+		q.mutex.Lock()
+		q.stats.Processed += 1
+		if err != nil {
+			q.stats.Failed += 1
+		}
+		q.mutex.Unlock()
+
+		if err != nil {
+			q.log.Printf("Failed to ingest block %s: %s\n", block.HashStr(), err)
+		}
+	}
+}
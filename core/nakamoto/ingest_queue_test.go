@@ -0,0 +1,70 @@
+package nakamoto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newQueueTestBlock(timestamp uint64, parentHash [32]byte) RawBlock {
+	return RawBlock{BlockHeader: BlockHeader{Timestamp: timestamp, ParentHash: parentHash}}
+}
+
+func ingestedHash(ingested chan RawBlock) [32]byte {
+	b := <-ingested
+	return b.Hash()
+}
+
+func TestBlockQueuePriorityAndBackpressure(t *testing.T) {
+	assert := assert.New(t)
+
+	tip := [32]byte{1}
+	q := NewBlockQueue(3)
+	q.IsPriority = func(b RawBlock) bool { return b.ParentHash == tip }
+
+	// Hold the worker on the first block, so the others queue up.
+	ingested := make(chan RawBlock, 10)
+	release := make(chan bool)
+	q.Ingest = func(b RawBlock) error {
+		ingested <- b
+		<-release
+		return nil
+	}
+	first := newQueueTestBlock(1, [32]byte{})
+	assert.Nil(q.Push(first))
+	assert.Equal(first.Hash(), ingestedHash(ingested))
+
+	fork1 := newQueueTestBlock(2, [32]byte{})
+	fork2 := newQueueTestBlock(3, [32]byte{})
+	extendsTip := newQueueTestBlock(4, tip)
+	assert.Nil(q.Push(fork1))
+	assert.Nil(q.Push(fork2))
+	assert.Nil(q.Push(fork2))
+	assert.Nil(q.Push(extendsTip))
+
+	// The queue is full.
+	assert.ErrorIs(q.Push(newQueueTestBlock(5, tip)), ErrBlockQueueFull)
+	stats := q.Stats()
+	assert.Equal(3, stats.Depth)
+	assert.Equal(1, stats.PriorityDepth)
+	assert.Equal(3, stats.MaxDepth)
+	assert.Equal(uint64(4), stats.Enqueued)
+	assert.Equal(uint64(1), stats.Rejected)
+
+	// Blocks extending the tip are ingested first, then the rest in order.
+	release <- true
+	assert.Equal(extendsTip.Hash(), ingestedHash(ingested))
+	release <- true
+	assert.Equal(fork1.Hash(), ingestedHash(ingested))
+	release <- true
+	assert.Equal(fork2.Hash(), ingestedHash(ingested))
+	release <- true
+
+	assert.Eventually(func() bool {
+		return q.Stats().Processed == 4
+	}, time.Second, 10*time.Millisecond)
+	stats = q.Stats()
+	assert.Equal(0, stats.Depth)
+	assert.Equal(uint64(0), stats.Failed)
+}
@@ -0,0 +1,157 @@
+package nakamoto
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// The known inventory is a rolling set of the block and transaction hashes the peer has recently seen, from gossip or
+// its own broadcasts. It's checked before a gossiped block or transaction is processed, so a storm of duplicate
+// announcements (ie. a transaction echoed back by every peer it was relayed to) doesn't trigger repeated validation.
+//
+// The set is bounded, evicting the oldest hashes first. It's saved to a file periodically and loaded on startup, so a
+// restarted node doesn't re-validate everything its peers are still relaying.
+//
+// A hash is added before its block or transaction is processed, so concurrent duplicates are dropped. Blocks which
+// fail to be processed for reasons other than an invalid POW, such as a full ingestion queue, are removed again, so a
+// later announcement is processed. Our own broadcasts are always sent, so rebroadcasts aren't suppressed.
+
+const (
+	// The default maximum number of hashes in the known inventory.
+	DEFAULT_KNOWN_INVENTORY_SIZE = 50_000
+	// How often the known inventory is saved.
+	KNOWN_INVENTORY_SAVE_INTERVAL = 1 * time.Minute
+)
+
+type KnownInventory struct {
+	// The hashes, mapped to the sequence number they were added with.
+	known map[[32]byte]uint64
+	// The hashes in insertion order, for eviction. Entries for hashes which were removed, or added again since, are
+	// skipped.
+	order   []knownInventoryEntry
+	seq     uint64
+	maxSize int
+
+	mutex sync.Mutex
+}
+
+type knownInventoryEntry struct {
+	hash [32]byte
+	seq  uint64
+}
+
+func NewKnownInventory(maxSize int) *KnownInventory {
+	return &KnownInventory{
+		known:   make(map[[32]byte]uint64),
+		order:   []knownInventoryEntry{},
+		maxSize: maxSize,
+	}
+}
+
+// Adds a hash, returning false if it was already known. A nil inventory knows of nothing.
+func (k *KnownInventory) Add(hash [32]byte) bool {
+	if k == nil {
+		return true
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if _, ok := k.known[hash]; ok {
+		return false
+	}
+	if k.maxSize <= 0 {
+		return true
+	}
+	for k.maxSize <= len(k.known) {
+		entry := k.order[0]
+		k.order = k.order[1:]
+		if k.known[entry.hash] == entry.seq {
+			delete(k.known, entry.hash)
+		}
+	}
+	k.seq++
+	k.known[hash] = k.seq
+	k.order = append(k.order, knownInventoryEntry{hash, k.seq})
+	return true
+}
+
+func (k *KnownInventory) Has(hash [32]byte) bool {
+	if k == nil {
+		return false
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	_, ok := k.known[hash]
+	return ok
+}
+
+func (k *KnownInventory) Remove(hash [32]byte) {
+	if k == nil {
+		return
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	delete(k.known, hash)
+}
+
+func (k *KnownInventory) Len() int {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return len(k.known)
+}
+
+// Saves the hashes to a file, oldest first.
+func (k *KnownInventory) Save(path string) error {
+	k.mutex.Lock()
+	data := make([]byte, 0, len(k.known)*32)
+	for _, entry := range k.order {
+		if k.known[entry.hash] == entry.seq {
+			data = append(data, entry.hash[:]...)
+		}
+	}
+	k.mutex.Unlock()
+	return os.WriteFile(path, data, 0600)
+}
+
+// Loads hashes saved to a file, if it exists.
+func (k *KnownInventory) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data)%32 != 0 {
+		return fmt.Errorf("Failed to load known inventory from %s: size is not a multiple of 32 bytes.", path)
+	}
+	for i := 0; i < len(data); i += 32 {
+		k.Add([32]byte(data[i : i+32]))
+	}
+	return nil
+}
+
+// The peer.
+// =====================================================================================================================
+
+// Loads the known inventory saved to a file, and saves it there periodically.
+func (p *PeerCore) LoadKnownInventory(path string) error {
+	if err := p.knownInventory.Load(path); err != nil {
+		return err
+	}
+	p.knownInventoryPath = path
+	return nil
+}
+
+func (p *PeerCore) knownInventoryRoutine() {
+	for {
+		time.Sleep(KNOWN_INVENTORY_SAVE_INTERVAL)
+		if p.knownInventoryPath == "" {
+			continue
+		}
+		if err := p.knownInventory.Save(p.knownInventoryPath); err != nil {
+			p.peerLogger.Printf("Failed to save known inventory: %s\n", err)
+		}
+	}
+}
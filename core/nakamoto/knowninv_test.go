@@ -0,0 +1,94 @@
+package nakamoto
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKnownInventory(t *testing.T) {
+	assert := assert.New(t)
+	k := NewKnownInventory(2)
+
+	assert.True(k.Add([32]byte{1}))
+	assert.False(k.Add([32]byte{1}))
+	assert.True(k.Add([32]byte{2}))
+
+	// The oldest hash is evicted.
+	assert.True(k.Add([32]byte{3}))
+	assert.False(k.Has([32]byte{1}))
+	assert.True(k.Has([32]byte{2}))
+	assert.Equal(2, k.Len())
+
+	// A removed hash can be added again, and is then the newest.
+	k.Remove([32]byte{2})
+	assert.False(k.Has([32]byte{2}))
+	assert.True(k.Add([32]byte{2}))
+	assert.True(k.Add([32]byte{4}))
+	assert.False(k.Has([32]byte{3}))
+	assert.True(k.Has([32]byte{2}))
+
+	// It's saved and loaded, oldest first.
+	path := filepath.Join(t.TempDir(), "known")
+	assert.Nil(k.Save(path))
+	k2 := NewKnownInventory(2)
+	assert.Nil(k2.Load(path))
+	assert.True(k2.Has([32]byte{2}))
+	assert.True(k2.Has([32]byte{4}))
+	assert.True(k2.Add([32]byte{5}))
+	assert.False(k2.Has([32]byte{2}))
+
+	// A missing file is empty.
+	k3 := NewKnownInventory(2)
+	assert.Nil(k3.Load(filepath.Join(t.TempDir(), "missing")))
+	assert.Equal(0, k3.Len())
+}
+
+func TestPeerDropsKnownInventory(t *testing.T) {
+	assert := assert.New(t)
+
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: "0", NoDiscoverIP: true})
+	blocks, txs := 0, 0
+	busy := false
+	peer.OnNewBlock = func(block RawBlock) error {
+		blocks++
+		if busy {
+			return ErrPeerBusy
+		}
+		return nil
+	}
+	peer.OnNewTransaction = func(tx RawTransaction) {
+		txs++
+	}
+	ts := httptest.NewServer(peer.server.server.Handler)
+	defer ts.Close()
+
+	// Duplicate transactions are only processed once.
+	tx := RawTransaction{Amount: 1}
+	for i := 0; i < 3; i++ {
+		_, err := SendMessageToPeer(ts.URL, NewTransactionMessage{Type: "new_tx", RawTransaction: tx}, &peer.peerLogger)
+		assert.Nil(err)
+	}
+	assert.Equal(1, txs)
+
+	// As are transactions we broadcast ourselves.
+	peer.GossipTransaction(RawTransaction{Amount: 2})
+	_, err := SendMessageToPeer(ts.URL, NewTransactionMessage{Type: "new_tx", RawTransaction: RawTransaction{Amount: 2}}, &peer.peerLogger)
+	assert.Nil(err)
+	assert.Equal(1, txs)
+
+	// Blocks we fail to process are processed when announced again.
+	busy = true
+	block := RawBlock{}
+	block.Nonce = [32]byte{1}
+	_, err = SendMessageToPeer(ts.URL, NewBlockMessage{Type: "new_block", RawBlock: block}, &peer.peerLogger)
+	assert.ErrorIs(err, ErrPeerBusy)
+	busy = false
+	for i := 0; i < 3; i++ {
+		_, err = SendMessageToPeer(ts.URL, NewBlockMessage{Type: "new_block", RawBlock: block}, &peer.peerLogger)
+		assert.Nil(err)
+	}
+	assert.Equal(2, blocks)
+}
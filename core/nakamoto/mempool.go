@@ -1,5 +1,40 @@
 package nakamoto
 
+import (
+	"bytes"
+	"errors"
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+var ErrFeeTooLow = errors.New("fee below minimum relay fee")
+var ErrDustAmount = errors.New("amount below dust threshold")
+var ErrEmptyPackage = errors.New("package has no transactions")
+var ErrPackageTooLarge = errors.New("package has too many transactions")
+var ErrPackageSenders = errors.New("package transactions have different senders")
+var ErrPackageNonces = errors.New("package transaction nonces are not sequential")
+var ErrNonceTooLow = errors.New("nonce is below the account's next nonce")
+var ErrNonceTooHigh = errors.New("nonce is too far above the account's next nonce")
+var ErrTooManyParked = errors.New("account has too many parked transactions")
+var ErrInvalidSignature = errors.New("signature invalid")
+
+const (
+	// The default minimum fee per byte for a transaction to be accepted into the mempool and relayed.
+	DEFAULT_MIN_RELAY_FEE_PER_BYTE = 1
+	// The default amount below which transfers are considered dust, and not accepted into the mempool or relayed.
+	DEFAULT_DUST_THRESHOLD = 1000
+	// The maximum number of transactions in a package.
+	MAX_PACKAGE_TXS = 25
+	// The default maximum number of parked transactions per account.
+	DEFAULT_MAX_PARKED_PER_ACCOUNT = 16
+	// How far above an account's next nonce a transaction's nonce can be.
+	MAX_NONCE_AHEAD = 64
+)
+
+// The lower bounds of the fee rate histogram buckets, in fees per byte. The last bucket has no upper bound.
+var FEE_HISTOGRAM_BUCKETS = []uint64{0, 1, 2, 3, 5, 8, 10, 15, 20, 30, 50, 75, 100, 150, 200, 300, 500, 1000}
+
 // The mempool stores transactions that have not yet been confirmed by the network. When a user submits a transaction, it goes into a mempool. Miners request a transaction bundle from the mempool to include in the next block they mine.
 //
 // Building a bundle of transactions involves an auction for blockspace, whereby
@@ -9,26 +44,462 @@ package nakamoto
 //
 // Note that due to how Nakamoto consensus works, there is the possibility of reorgs, which means that a block that was previously mined may be replaced by a longer chain. In this case, transactions which have been taken from the mempool and included in a block that is later reorged out should be "returned" to the mempool. This is the intuition for the mempool's behaviour, however it is designed as a one-way flow.
 type Mempool struct {
+	// Pending transactions, keyed by transaction hash.
+	txs map[[32]byte]*Transaction
+
+	// Relay policy. Transactions paying less than this fee per byte, or transferring less than the dust threshold, are
+	// rejected. This protects small networks from zero-fee spam filling blocks. These are policy rather than consensus
+	// rules, so blocks containing such transactions are still valid.
+	MinRelayFeePerByte uint64
+	DustThreshold      uint64
+
+	// The base fee per byte of the next block, when the fee market is enabled. Transactions paying less can't be
+	// included, so they are rejected.
+	baseFee uint64
+
+	// Pending transactions are queued by sender, in nonce order. Only those continuing from the account's next nonce
+	// without a gap are executable, and can be included in a block. Those after a gap are parked until it is filled.
+	// Transactions with nonces below the next nonce are rejected.
+	//
+	// Returns the next nonce of an account on the main chain. If nil, each account's lowest pending nonce is taken to be
+	// its next nonce.
+	GetAccountNonce func(account [65]byte) (uint64, error)
+	// The maximum number of parked transactions per account.
+	MaxParkedPerAccount int
+
+	// If set, signatures are verified when transactions are added, and cached so they aren't verified again when a block
+	// including them arrives. See sigcache.go.
+	SigCache *SignatureCache
+
+	// If set, transactions are checked against the state of the main chain when they are added, ie. that the sender can
+	// afford them. Each transaction is checked independently of the sender's other pending transactions.
+	VerifyTx func(tx RawTransaction) error
+
+	// Called when a transaction not already in the mempool is added.
+	OnNewTransaction func(tx *Transaction)
+
+	mutex sync.Mutex
+}
+
+// The queue of an account's pending transactions.
+type AccountStatus struct {
+	NextNonce uint64
+	// The nonces of the transactions which can be included in the next block, in order.
+	Executable []uint64
+	// The nonces of the transactions waiting on a missing nonce.
+	Parked []uint64
+	// The missing nonces, which must be submitted before the parked transactions can be included.
+	Gaps []uint64
 }
 
+// The fee rates of the transactions in the mempool, in fees per byte.
 type FeeRates struct {
 	MinFee    uint64
 	MedianFee uint64
 	MaxFee    uint64
 }
 
+// A summary of the mempool's size and fee rates. Sizes are of the transactions' encodings, the block space they take.
+type MempoolInfo struct {
+	Count uint64
+	Bytes uint64
+	FeeRates
+}
+
+// The transactions in the mempool paying a fee rate from FeeRate, up to the next bucket's.
+type FeeHistogramBucket struct {
+	FeeRate uint64
+	Count   uint64
+	Bytes   uint64
+}
+
 // NewMempool creates a new mempool.
 func NewMempool() *Mempool {
-	return &Mempool{}
+	return &Mempool{
+		txs:                 make(map[[32]byte]*Transaction),
+		MinRelayFeePerByte:  DEFAULT_MIN_RELAY_FEE_PER_BYTE,
+		DustThreshold:       DEFAULT_DUST_THRESHOLD,
+		MaxParkedPerAccount: DEFAULT_MAX_PARKED_PER_ACCOUNT,
+	}
 }
 
-func (m *Mempool) AddTransaction(tx *Transaction) {}
+// Adds a transaction to the mempool, if it meets the relay policy.
+func (m *Mempool) AddTransaction(tx *Transaction) error {
+	if err := m.CheckRelayPolicy(tx.ToRawTransaction()); err != nil {
+		return err
+	}
+	if err := m.checkNonces([]RawTransaction{tx.ToRawTransaction()}); err != nil {
+		return err
+	}
+	if err := m.checkSignatures([]RawTransaction{tx.ToRawTransaction()}); err != nil {
+		return err
+	}
+	if err := m.checkState([]RawTransaction{tx.ToRawTransaction()}); err != nil {
+		return err
+	}
 
-func (m *Mempool) GetFeeRates() FeeRates {
-	return FeeRates{}
+	m.mutex.Lock()
+	_, exists := m.txs[tx.Hash]
+	m.txs[tx.Hash] = tx
+	m.mutex.Unlock()
+
+	if !exists && m.OnNewTransaction != nil {
+		m.OnNewTransaction(tx)
+	}
+	return nil
+}
+
+// Adds a package of transactions to the mempool, if together they meet the relay policy. Either all of the transactions
+// are added, or none are.
+//
+// A package is a chain of transactions from the same sender with sequential nonces, ie. a parent and a child. The
+// package only has to pay the minimum relay fee in total, so a child can pay the fee for a parent which pays too little
+// by itself (child pays for parent). Each transaction must still pay the base fee, since that is a consensus rule.
+func (m *Mempool) AddPackage(txs []*Transaction) error {
+	raws := []RawTransaction{}
+	for _, tx := range txs {
+		raws = append(raws, tx.ToRawTransaction())
+	}
+	if err := m.CheckPackagePolicy(raws); err != nil {
+		return err
+	}
+	if err := m.checkNonces(raws); err != nil {
+		return err
+	}
+	if err := m.checkSignatures(raws); err != nil {
+		return err
+	}
+	if err := m.checkState(raws); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	added := []*Transaction{}
+	for _, tx := range txs {
+		if _, exists := m.txs[tx.Hash]; !exists {
+			added = append(added, tx)
+		}
+		m.txs[tx.Hash] = tx
+	}
+	m.mutex.Unlock()
+
+	if m.OnNewTransaction != nil {
+		for _, tx := range added {
+			m.OnNewTransaction(tx)
+		}
+	}
+	return nil
+}
+
+// Returns whether a transaction is in the mempool.
+func (m *Mempool) HasTransaction(hash [32]byte) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, ok := m.txs[hash]
+	return ok
 }
 
-func (m *Mempool) BuildBundle() []*Transaction {
-	txs := []*Transaction{}
+// Removes transactions from the mempool, ie. once they are included in the main chain.
+func (m *Mempool) RemoveTransactions(hashes [][32]byte) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, hash := range hashes {
+		delete(m.txs, hash)
+	}
+}
+
+// Sets the base fee per byte of the next block. Called when the tip changes.
+func (m *Mempool) SetBaseFee(baseFee uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.baseFee = baseFee
+}
+
+// Checks a transaction pays the minimum relay fee and the base fee, and doesn't transfer dust.
+func (m *Mempool) CheckRelayPolicy(tx RawTransaction) error {
+	return m.CheckPackagePolicy([]RawTransaction{tx})
+}
+
+// Checks a package of transactions is a chain from the same sender with sequential nonces, which pays the minimum relay
+// fee in total. Each transaction must pay the base fee, and not transfer dust.
+func (m *Mempool) CheckPackagePolicy(txs []RawTransaction) error {
+	if len(txs) == 0 {
+		return ErrEmptyPackage
+	}
+	if MAX_PACKAGE_TXS < len(txs) {
+		return ErrPackageTooLarge
+	}
+	for i := 1; i < len(txs); i++ {
+		if txs[i].FromPubkey != txs[0].FromPubkey {
+			return ErrPackageSenders
+		}
+		if txs[i].Nonce != txs[i-1].Nonce+1 {
+			return ErrPackageNonces
+		}
+	}
+
+	m.mutex.Lock()
+	baseFee := m.baseFee
+	m.mutex.Unlock()
+
+	fee, size := uint64(0), uint64(0)
+	for _, tx := range txs {
+		if tx.Fee < baseFee*tx.SizeBytes() {
+			return ErrFeeTooLow
+		}
+		fee += tx.Fee
+		size += tx.SizeBytes()
+	}
+	if fee < max(m.MinRelayFeePerByte, baseFee)*size {
+		return ErrFeeTooLow
+	}
+	for _, tx := range txs {
+		// Token amounts aren't in units of the native coin.
+		if tx.TokenOp == TOKEN_OP_NONE && tx.Amount < m.DustThreshold {
+			return ErrDustAmount
+		}
+	}
+	return nil
+}
+
+// Checks new transactions from the same sender continue the account's queue: their nonces aren't below its next nonce,
+// or too far above it, and they don't leave too many transactions parked.
+func (m *Mempool) checkNonces(txs []RawTransaction) error {
+	account := txs[0].FromPubkey
+	pending := append(m.getAccountTransactions(account), txs...)
+	status, _, err := m.getAccountQueue(account, pending)
+	if err != nil {
+		return err
+	}
+	for _, tx := range txs {
+		if tx.Nonce < status.NextNonce {
+			return ErrNonceTooLow
+		}
+		if status.NextNonce+MAX_NONCE_AHEAD < tx.Nonce {
+			return ErrNonceTooHigh
+		}
+	}
+	if m.MaxParkedPerAccount < len(status.Parked) {
+		return ErrTooManyParked
+	}
+	return nil
+}
+
+// Checks transactions against the state of the main chain, if the mempool has a state verifier.
+func (m *Mempool) checkState(txs []RawTransaction) error {
+	if m.VerifyTx == nil {
+		return nil
+	}
+	for _, tx := range txs {
+		if err := m.VerifyTx(tx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verifies the signatures of transactions, if the mempool has a signature cache. Coins locked by a predicate are
+// unlocked by its witness, which is checked when a block including the transaction is ingested.
+func (m *Mempool) checkSignatures(txs []RawTransaction) error {
+	if m.SigCache == nil {
+		return nil
+	}
+	for _, tx := range txs {
+		if !IsPredicateAddress(tx.FromPubkey) && !m.SigCache.VerifyTransactionSignature(tx) {
+			return ErrInvalidSignature
+		}
+	}
+	return nil
+}
+
+func (m *Mempool) getAccountTransactions(account [65]byte) []RawTransaction {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	txs := []RawTransaction{}
+	for _, tx := range m.txs {
+		if tx.FromPubkey == account {
+			txs = append(txs, tx.ToRawTransaction())
+		}
+	}
 	return txs
 }
+
+// Returns the queue of an account's pending transactions, and the executable transactions in nonce order.
+func (m *Mempool) getAccountQueue(account [65]byte, pending []RawTransaction) (AccountStatus, []RawTransaction, error) {
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].Nonce != pending[j].Nonce {
+			return pending[i].Nonce < pending[j].Nonce
+		}
+		hi, hj := pending[i].Hash(), pending[j].Hash()
+		return bytes.Compare(hi[:], hj[:]) < 0
+	})
+
+	status := AccountStatus{Executable: []uint64{}, Parked: []uint64{}, Gaps: []uint64{}}
+	if m.GetAccountNonce != nil {
+		nonce, err := m.GetAccountNonce(account)
+		if err != nil {
+			return status, nil, err
+		}
+		status.NextNonce = nonce
+	} else if 0 < len(pending) {
+		status.NextNonce = pending[0].Nonce
+	}
+
+	// Transactions with the same nonce are all executable, since nonces aren't enforced by consensus.
+	executable := []RawTransaction{}
+	expected := status.NextNonce
+	for _, tx := range pending {
+		switch {
+		case tx.Nonce < status.NextNonce:
+			// Stale, ie. replaced by a transaction on the main chain.
+		case len(status.Parked) == 0 && (tx.Nonce == expected || (0 < len(executable) && tx.Nonce+1 == expected)):
+			executable = append(executable, tx)
+			status.Executable = append(status.Executable, tx.Nonce)
+			expected = tx.Nonce + 1
+		default:
+			for ; expected < tx.Nonce; expected++ {
+				status.Gaps = append(status.Gaps, expected)
+			}
+			status.Parked = append(status.Parked, tx.Nonce)
+			expected = tx.Nonce + 1
+		}
+	}
+	return status, executable, nil
+}
+
+// Returns the queue of an account's pending transactions.
+func (m *Mempool) GetAccountStatus(account [65]byte) (AccountStatus, error) {
+	status, _, err := m.getAccountQueue(account, m.getAccountTransactions(account))
+	return status, err
+}
+
+// Returns all pending transactions in the mempool.
+func (m *Mempool) GetTransactions() []*Transaction {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	txs := make([]*Transaction, 0, len(m.txs))
+	for _, tx := range m.txs {
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+// Returns the minimum, median and maximum fee rates of the transactions in the mempool, or zeroes if it is empty.
+func (m *Mempool) GetFeeRates() FeeRates {
+	rates := []uint64{}
+	for _, tx := range m.GetTransactions() {
+		raw := tx.ToRawTransaction()
+		rates = append(rates, raw.FeeRate())
+	}
+	if len(rates) == 0 {
+		return FeeRates{}
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i] < rates[j] })
+	return FeeRates{
+		MinFee:    rates[0],
+		MedianFee: rates[len(rates)/2],
+		MaxFee:    rates[len(rates)-1],
+	}
+}
+
+// Returns the number of transactions in the mempool, their total size, and their fee rates.
+func (m *Mempool) GetInfo() MempoolInfo {
+	info := MempoolInfo{FeeRates: m.GetFeeRates()}
+	for _, tx := range m.GetTransactions() {
+		raw := tx.ToRawTransaction()
+		info.Count++
+		info.Bytes += raw.EncodedSizeBytes()
+	}
+	return info
+}
+
+// Returns the number and size of the transactions in the mempool in each of the FEE_HISTOGRAM_BUCKETS, from lowest fee
+// rate to highest. Empty buckets are included.
+func (m *Mempool) GetFeeHistogram() []FeeHistogramBucket {
+	buckets := make([]FeeHistogramBucket, len(FEE_HISTOGRAM_BUCKETS))
+	for i, feeRate := range FEE_HISTOGRAM_BUCKETS {
+		buckets[i].FeeRate = feeRate
+	}
+	for _, tx := range m.GetTransactions() {
+		raw := tx.ToRawTransaction()
+		rate := raw.FeeRate()
+		i := sort.Search(len(FEE_HISTOGRAM_BUCKETS), func(i int) bool { return rate < FEE_HISTOGRAM_BUCKETS[i] }) - 1
+		buckets[i].Count++
+		buckets[i].Bytes += raw.EncodedSizeBytes()
+	}
+	return buckets
+}
+
+// Selects transactions to include in the next block, up to maxBytes in encoded size and maxWeight in weight, in the
+// order they should be included.
+//
+// Each sender's executable transactions are included in nonce order, so a child is never included before its parent,
+// and parked transactions are left out. Transactions are selected by the fee rate of the chain of pending transactions
+// up to and including them, so a child paying a high fee pulls in its parent (child pays for parent). Transactions which
+// don't pay the base fee, and those after them, are left out.
+func (m *Mempool) BuildBundle(maxBytes uint64, maxWeight uint64) []RawTransaction {
+	m.mutex.Lock()
+	baseFee := m.baseFee
+	chains := map[[65]byte][]RawTransaction{}
+	for _, tx := range m.txs {
+		chains[tx.FromPubkey] = append(chains[tx.FromPubkey], tx.ToRawTransaction())
+	}
+	m.mutex.Unlock()
+
+	senders := [][65]byte{}
+	for sender, pending := range chains {
+		// Only executable transactions can be included.
+		_, chain, err := m.getAccountQueue(sender, pending)
+		if err != nil {
+			continue
+		}
+		for i, tx := range chain {
+			if tx.Fee < baseFee*tx.SizeBytes() {
+				chain = chain[:i]
+				break
+			}
+		}
+		chains[sender] = chain
+		senders = append(senders, sender)
+	}
+	sort.Slice(senders, func(i, j int) bool { return bytes.Compare(senders[i][:], senders[j][:]) < 0 })
+
+	// Repeatedly include the chain prefix with the highest fee rate which fits.
+	bundle := []RawTransaction{}
+	bundleBytes, bundleWeight := uint64(0), uint64(0)
+	for {
+		var best [65]byte
+		bestLen, bestFee, bestSize, bestBytes, bestWeight := 0, uint64(0), uint64(0), uint64(0), uint64(0)
+		for _, sender := range senders {
+			fee, size, n, weight := uint64(0), uint64(0), uint64(0), uint64(0)
+			for i, tx := range chains[sender] {
+				fee += tx.Fee
+				size += tx.SizeBytes()
+				n += tx.EncodedSizeBytes()
+				weight += tx.Weight()
+				if maxBytes < bundleBytes+n || maxWeight-bundleWeight < weight {
+					break
+				}
+				if bestLen == 0 || feeRateGreater(fee, size, bestFee, bestSize) {
+					best, bestLen, bestFee, bestSize, bestBytes, bestWeight = sender, i+1, fee, size, n, weight
+				}
+			}
+		}
+		if bestLen == 0 {
+			return bundle
+		}
+		bundle = append(bundle, chains[best][:bestLen]...)
+		bundleBytes += bestBytes
+		bundleWeight += bestWeight
+		chains[best] = chains[best][bestLen:]
+	}
+}
+
+// Returns whether feeA/sizeA > feeB/sizeB, without overflow.
+func feeRateGreater(feeA uint64, sizeA uint64, feeB uint64, sizeB uint64) bool {
+	hiA, loA := bits.Mul64(feeA, sizeB)
+	hiB, loB := bits.Mul64(feeB, sizeA)
+	return hiA > hiB || (hiA == hiB && loA > loB)
+}
@@ -2,8 +2,179 @@ package nakamoto
 
 import (
 	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestMempool(t *testing.T) {
 	// TODO implement.
 }
+
+func TestMempoolRelayPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	mempool := NewMempool()
+	mempool.MinRelayFeePerByte = 2
+	mempool.DustThreshold = 500
+
+	add := func(amount uint64, fee uint64) error {
+		raw := RawTransaction{Version: 1, Amount: amount, Fee: fee}
+		tx := raw.ToTransaction()
+		return mempool.AddTransaction(&tx)
+	}
+
+	size := (&RawTransaction{}).SizeBytes()
+	assert.Equal(ErrFeeTooLow, add(1000, 0))
+	assert.Equal(ErrFeeTooLow, add(1000, 2*size-1))
+	assert.Equal(ErrDustAmount, add(499, 2*size))
+	assert.Nil(add(500, 2*size))
+	assert.Equal(1, len(mempool.GetTransactions()))
+
+	// The policy can be disabled.
+	mempool.MinRelayFeePerByte = 0
+	mempool.DustThreshold = 0
+	assert.Nil(add(0, 0))
+	assert.Equal(2, len(mempool.GetTransactions()))
+}
+
+func TestMempoolFeeHistogram(t *testing.T) {
+	assert := assert.New(t)
+
+	mempool := NewMempool()
+	assert.Equal(MempoolInfo{}, mempool.GetInfo())
+
+	size := (&RawTransaction{}).SizeBytes()
+	encodedSize := (&RawTransaction{}).EncodedSizeBytes()
+	for i, feeRate := range []uint64{1, 4, 4, 12, 2000} {
+		raw := RawTransaction{Version: 1, Amount: 1000, Fee: feeRate * size, Nonce: uint64(i)}
+		tx := raw.ToTransaction()
+		assert.Nil(mempool.AddTransaction(&tx))
+	}
+
+	assert.Equal(MempoolInfo{
+		Count:    5,
+		Bytes:    5 * encodedSize,
+		FeeRates: FeeRates{MinFee: 1, MedianFee: 4, MaxFee: 2000},
+	}, mempool.GetInfo())
+
+	histogram := mempool.GetFeeHistogram()
+	assert.Equal(len(FEE_HISTOGRAM_BUCKETS), len(histogram))
+	counts := map[uint64]uint64{}
+	for _, bucket := range histogram {
+		if bucket.Count != 0 {
+			counts[bucket.FeeRate] = bucket.Count
+			assert.Equal(bucket.Count*encodedSize, bucket.Bytes)
+		}
+	}
+	// Rates are bucketed by the highest lower bound below them, and the last bucket is unbounded.
+	assert.Equal(map[uint64]uint64{1: 1, 3: 2, 10: 1, 1000: 1}, counts)
+}
+
+func makePackageTx(t *testing.T, wallet *core.Wallet, nonce uint64, feeRate uint64) *Transaction {
+	raw := RawTransaction{Version: 1, FromPubkey: wallet.PubkeyBytes(), Amount: 1000, Nonce: nonce}
+	raw.Fee = feeRate * raw.SizeBytes()
+	sig, err := wallet.Sign(raw.Envelope())
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(raw.Sig[:], sig)
+	tx := raw.ToTransaction()
+	return &tx
+}
+
+func TestMempoolPackage(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	mempool := NewMempool()
+	mempool.MinRelayFeePerByte = 5
+
+	// The parent doesn't pay the relay fee by itself, but the package does.
+	parent := makePackageTx(t, &wallets[0], 0, 1)
+	child := makePackageTx(t, &wallets[0], 1, 9)
+	assert.Equal(ErrFeeTooLow, mempool.AddTransaction(parent))
+	assert.Equal(ErrFeeTooLow, mempool.AddPackage([]*Transaction{parent, makePackageTx(t, &wallets[0], 1, 8)}))
+	assert.Empty(mempool.GetTransactions())
+
+	assert.Equal(ErrEmptyPackage, mempool.AddPackage(nil))
+	assert.Equal(ErrPackageNonces, mempool.AddPackage([]*Transaction{parent, makePackageTx(t, &wallets[0], 2, 9)}))
+	assert.Equal(ErrPackageSenders, mempool.AddPackage([]*Transaction{parent, makePackageTx(t, &wallets[1], 1, 9)}))
+	assert.Nil(mempool.AddPackage([]*Transaction{parent, child}))
+	assert.Equal(2, len(mempool.GetTransactions()))
+
+	// Each transaction must still pay the base fee.
+	mempool.SetBaseFee(2)
+	assert.Equal(ErrFeeTooLow, mempool.AddPackage([]*Transaction{makePackageTx(t, &wallets[1], 0, 1), makePackageTx(t, &wallets[1], 1, 20)}))
+	mempool.SetBaseFee(0)
+
+	// The package is ordered by its combined fee rate of 5, above a transaction paying 4 and below one paying 6.
+	mempool.MinRelayFeePerByte = 1
+	low := makePackageTx(t, &wallets[1], 0, 4)
+	wallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	high := makePackageTx(t, wallet, 0, 6)
+	assert.Nil(mempool.AddPackage([]*Transaction{low}))
+	assert.Nil(mempool.AddTransaction(high))
+	bundle := mempool.BuildBundle(1024*1024, 4*1024*1024)
+	assert.Equal([]RawTransaction{high.ToRawTransaction(), parent.ToRawTransaction(), child.ToRawTransaction(), low.ToRawTransaction()}, bundle)
+
+	// A child is never included without its parent, so with room for two transactions, the child is left out.
+	raw := parent.ToRawTransaction()
+	bundle = mempool.BuildBundle(2*uint64(len(raw.Bytes())), 4*1024*1024)
+	assert.Equal([]RawTransaction{high.ToRawTransaction(), low.ToRawTransaction()}, bundle)
+
+	// Included transactions are removed.
+	mempool.RemoveTransactions([][32]byte{parent.Hash, child.Hash})
+	assert.Equal(2, len(mempool.GetTransactions()))
+}
+
+func TestMempoolNonceQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	account := wallets[0].PubkeyBytes()
+	mempool := NewMempool()
+	mempool.MaxParkedPerAccount = 2
+	mempool.GetAccountNonce = func(a [65]byte) (uint64, error) {
+		if a == account {
+			return 3, nil
+		}
+		return 0, nil
+	}
+
+	// Nonces below the next nonce are rejected, and those after a gap are parked.
+	assert.Equal(ErrNonceTooLow, mempool.AddTransaction(makePackageTx(t, &wallets[0], 2, 1)))
+	assert.Equal(ErrNonceTooHigh, mempool.AddTransaction(makePackageTx(t, &wallets[0], 3+MAX_NONCE_AHEAD+1, 1)))
+	tx3 := makePackageTx(t, &wallets[0], 3, 1)
+	tx5 := makePackageTx(t, &wallets[0], 5, 1)
+	tx8 := makePackageTx(t, &wallets[0], 8, 1)
+	assert.Nil(mempool.AddTransaction(tx3))
+	assert.Nil(mempool.AddTransaction(tx5))
+	assert.Nil(mempool.AddTransaction(tx8))
+	assert.Equal(ErrTooManyParked, mempool.AddTransaction(makePackageTx(t, &wallets[0], 9, 1)))
+
+	status, err := mempool.GetAccountStatus(account)
+	assert.Nil(err)
+	assert.Equal(AccountStatus{
+		NextNonce:  3,
+		Executable: []uint64{3},
+		Parked:     []uint64{5, 8},
+		Gaps:       []uint64{4, 6, 7},
+	}, status)
+
+	// Only executable transactions are included.
+	assert.Equal([]RawTransaction{tx3.ToRawTransaction()}, mempool.BuildBundle(1024*1024, 4*1024*1024))
+
+	// Filling the first gap makes the parked transaction executable.
+	tx4 := makePackageTx(t, &wallets[0], 4, 1)
+	assert.Nil(mempool.AddTransaction(tx4))
+	status, err = mempool.GetAccountStatus(account)
+	assert.Nil(err)
+	assert.Equal([]uint64{3, 4, 5}, status.Executable)
+	assert.Equal([]uint64{8}, status.Parked)
+	assert.Equal([]uint64{6, 7}, status.Gaps)
+	assert.Equal(3, len(mempool.BuildBundle(1024*1024, 4*1024*1024)))
+}
@@ -19,6 +19,30 @@ type Miner struct {
 	minerWallet *core.Wallet
 	IsRunning   bool
 
+	// The most recently measured hashrate, in hashes per second.
+	hashrate float64
+
+	// The mempool to include transactions from. If nil, blocks only include the coinbase.
+	Mempool *Mempool
+
+	// The number of threads to mine with. Each searches a separate range of nonces.
+	Threads int
+
+	// The pubkey the block reward is paid to, if set, rather than the miner wallet. The coinbase is still signed by
+	// the miner wallet, which receives the fees.
+	coinbase [65]byte
+	// The graffiti included in mined blocks.
+	graffiti [32]byte
+	// The tip selection policy. See tipselect.go.
+	tipPolicy             string
+	preferOwnTransactions bool
+	// The tip the current puzzle builds on.
+	miningTip [32]byte
+
+	// Signals the running miner to stop, or to start on a new puzzle.
+	stop    chan struct{}
+	refresh chan struct{}
+
 	// Mutex.
 	mutex sync.Mutex
 
@@ -30,17 +54,127 @@ func NewMiner(dag BlockDAG, minerWallet *core.Wallet) *Miner {
 		dag:         dag,
 		minerWallet: minerWallet,
 		IsRunning:   false,
+		Threads:     1,
+		tipPolicy:   TIP_POLICY_MOST_WORK,
 		mutex:       sync.Mutex{},
 	}
 }
 
+// Sets the pubkey the block reward is paid to, from the next block mined.
+func (node *Miner) SetCoinbase(pubkey [65]byte) {
+	node.mutex.Lock()
+	node.coinbase = pubkey
+	node.mutex.Unlock()
+	node.refreshPuzzle()
+}
+
+// Sets the graffiti included in mined blocks, from the next block mined.
+func (node *Miner) SetGraffiti(graffiti [32]byte) {
+	node.mutex.Lock()
+	node.graffiti = graffiti
+	node.mutex.Unlock()
+	node.refreshPuzzle()
+}
+
+// Returns the pubkey the block reward is paid to, and the graffiti included in mined blocks.
+func (node *Miner) Config() (coinbase [65]byte, graffiti [32]byte) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	coinbase = node.coinbase
+	if coinbase == [65]byte{} {
+		coinbase = node.minerWallet.PubkeyBytes()
+	}
+	return coinbase, node.graffiti
+}
+
+// Sets the tip selection policy, and whether tips including the miner wallet's transactions are preferred, from the
+// next block mined. See tipselect.go.
+func (node *Miner) SetTipPolicy(policy string, preferOwnTransactions bool) error {
+	policy, err := ParseTipPolicy(policy)
+	if err != nil {
+		return err
+	}
+	node.mutex.Lock()
+	node.tipPolicy = policy
+	node.preferOwnTransactions = preferOwnTransactions
+	node.mutex.Unlock()
+	node.refreshPuzzle()
+	return nil
+}
+
+// Returns the tip selection policy, and whether tips including the miner wallet's transactions are preferred.
+func (node *Miner) TipPolicy() (string, bool) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.tipPolicy, node.preferOwnTransactions
+}
+
+// Returns the hash of the tip the miner is building on, or zero if it hasn't built a block yet.
+func (node *Miner) MiningTip() [32]byte {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.miningTip
+}
+
+// Returns whether the miner is running.
+func (node *Miner) Running() bool {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return node.IsRunning
+}
+
+// Sets the number of threads to mine with, from the next time the miner is started.
+func (node *Miner) SetThreads(threads int) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.Threads = threads
+}
+
+// Stops the miner, if it's running.
+func (node *Miner) Stop() {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.IsRunning && node.stop != nil {
+		close(node.stop)
+		node.stop = nil
+	}
+}
+
+// Tells the running miner to start on a new puzzle, so changes to the block template take effect.
+func (node *Miner) refreshPuzzle() {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if node.refresh == nil {
+		return
+	}
+	select {
+	case node.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the most recently measured hashrate, in hashes per second, or 0 if the miner isn't running.
+func (node *Miner) Hashrate() float64 {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	if !node.IsRunning {
+		return 0
+	}
+	return node.hashrate
+}
+
 func MakeCoinbaseTx(wallet *core.Wallet) RawTransaction {
+	return MakeCoinbaseTxTo(wallet, wallet.PubkeyBytes())
+}
+
+// Makes a coinbase paying the block reward to a pubkey, signed by the miner wallet.
+func MakeCoinbaseTxTo(wallet *core.Wallet, to [65]byte) RawTransaction {
 	// Construct coinbase tx.
 	tx := RawTransaction{
 		Version:    1,
 		Sig:        [64]byte{},
 		FromPubkey: wallet.PubkeyBytes(),
-		ToPubkey:   wallet.PubkeyBytes(),
+		ToPubkey:   to,
 		Amount:     1000000000,
 		Fee:        0,
 		Nonce:      0,
@@ -59,28 +193,41 @@ type POWPuzzle struct {
 	startNonce big.Int
 	target     big.Int
 	solution   big.Int
+	// Identifies the puzzle, so solutions to puzzles which have since been replaced are ignored.
+	id uint64
 }
 
+// Mines the puzzles received on the puzzle channel, until it's closed.
 func MineWithStatus(hashrateChannel chan float64, solutionChannel chan POWPuzzle, puzzleChannel chan POWPuzzle) (big.Int, error) {
 	// Execute in 3s increments.
-	lastHashrateMeasurement := Timestamp()
+	lastHashrateMeasurement := time.Now()
 	numHashes := 0
+	done := make(chan struct{})
+	defer close(done)
 
 	// Routine: Measure hashrate.
 	go (func() {
 		for {
 			// Wait 3s.
-			<-time.After(3 * time.Second)
+			select {
+			case <-time.After(3 * time.Second):
+			case <-done:
+				return
+			}
 
 			// Print iterations using commas.
 			// p := message.NewPrinter(language.English)
 			// p.Printf("Hashes: %d\n", numHashes)
 
 			// Check if 3s has elapsed since last time.
-			now := Timestamp()
-			duration := now - lastHashrateMeasurement
-			hashrate := float64(numHashes) / float64(duration/1000)
-			hashrateChannel <- hashrate
+			now := time.Now()
+			duration := now.Sub(lastHashrateMeasurement)
+			hashrate := float64(numHashes) / duration.Seconds()
+			select {
+			case hashrateChannel <- hashrate:
+			case <-done:
+				return
+			}
 			numHashes = 0
 			lastHashrateMeasurement = now
 		}
@@ -90,7 +237,10 @@ func MineWithStatus(hashrateChannel chan float64, solutionChannel chan POWPuzzle
 	for {
 		var i uint64 = 0
 		minerLog.Println("Waiting for new puzzle")
-		puzzle := <-puzzleChannel
+		puzzle, ok := <-puzzleChannel
+		if !ok {
+			return big.Int{}, nil
+		}
 		block := puzzle.block
 		nonce := puzzle.startNonce
 		target := puzzle.target
@@ -122,7 +272,10 @@ func MineWithStatus(hashrateChannel chan float64, solutionChannel chan POWPuzzle
 
 			// Check if new puzzle has been received.
 			select {
-			case newPuzzle := <-puzzleChannel:
+			case newPuzzle, ok := <-puzzleChannel:
+				if !ok {
+					return big.Int{}, nil
+				}
 				puzzle = newPuzzle
 				block = puzzle.block
 				nonce = puzzle.startNonce
@@ -136,28 +289,64 @@ func MineWithStatus(hashrateChannel chan float64, solutionChannel chan POWPuzzle
 }
 
 func (node *Miner) MakeNewPuzzle() POWPuzzle {
-	current_tip, err := node.dag.GetLatestFullTip()
+	current_tip, full_tip, err := node.selectTip()
 	if err != nil {
 		// fmt.Fatalf("Failed to get current tip: %s", err)
 		panic(err)
 	}
+	node.mutex.Lock()
+	node.miningTip = current_tip.Hash
+	node.mutex.Unlock()
+
+	// Signal for the deployments we're ready for.
+	version, err := node.dag.ComputeBlockVersion(current_tip)
+	if err != nil {
+		panic(err)
+	}
+
+	// Commit to the history of the chain.
+	historyRoot, err := node.dag.GetNextHistoryRoot(current_tip)
+	if err != nil {
+		panic(err)
+	}
 
 	// Construct coinbase tx.
-	tx := MakeCoinbaseTx(node.minerWallet)
+	coinbase, graffiti := node.Config()
+	tx := MakeCoinbaseTxTo(node.minerWallet, coinbase)
 
 	// Construct block template for mining.
 	raw := RawBlock{
-		ParentHash:             current_tip.Hash,
-		ParentTotalWork:        BigIntToBytes32(current_tip.AccumulatedWork),
-		Timestamp:              Timestamp(),
-		NumTransactions:        1,
-		TransactionsMerkleRoot: [32]byte{},
-		Nonce:                  [32]byte{},
+		BlockHeader: BlockHeader{
+			ParentHash:             current_tip.Hash,
+			ParentTotalWork:        BigIntToBytes32(current_tip.AccumulatedWork),
+			Timestamp:              node.dag.Timestamp(),
+			NumTransactions:        1,
+			TransactionsMerkleRoot: [32]byte{},
+			Nonce:                  [32]byte{},
+			BaseFee:                node.dag.GetNextBaseFee(current_tip),
+			Version:                version,
+			HistoryRoot:            historyRoot,
+			Graffiti:               graffiti,
+		},
 		Transactions: []RawTransaction{
 			tx,
 		},
 	}
-	raw.TransactionsMerkleRoot = core.ComputeMerkleHash([][]byte{tx.Envelope()})
+
+	// Fill the rest of the block from the mempool.
+	if node.Mempool != nil && current_tip.Hash == full_tip.Hash {
+		used, usedWeight := raw.SizeBytes(), raw.Weight()
+		maxWeight := node.dag.MaxBlockWeight()
+		if used < node.dag.consensus.MaxBlockSizeBytes && usedWeight < maxWeight {
+			raw.Transactions = append(raw.Transactions, node.Mempool.BuildBundle(node.dag.consensus.MaxBlockSizeBytes-used, maxWeight-usedWeight)...)
+		}
+	}
+	envelopes := [][]byte{}
+	for _, tx := range raw.Transactions {
+		envelopes = append(envelopes, tx.Envelope())
+	}
+	raw.NumTransactions = uint64(len(raw.Transactions))
+	raw.TransactionsMerkleRoot = core.ComputeMerkleHash(envelopes)
 
 	// Mine the POW solution.
 	curr_height := current_tip.Height + 1
@@ -174,6 +363,7 @@ func (node *Miner) MakeNewPuzzle() POWPuzzle {
 	} else {
 		difficulty = epoch.Difficulty
 	}
+	raw.Difficulty = EncodeDifficulty(difficulty)
 
 	puzzle := POWPuzzle{
 		block:      &raw,
@@ -183,34 +373,116 @@ func (node *Miner) MakeNewPuzzle() POWPuzzle {
 	return puzzle
 }
 
+// Mines until mineMaxBlocks blocks are mined (-1 for no limit), or the miner is stopped.
 func (node *Miner) Start(mineMaxBlocks int64) {
 	node.mutex.Lock()
 	if node.IsRunning {
+		node.mutex.Unlock()
 		minerLog.Printf("Miner already running")
 		return
 	}
 	node.IsRunning = true
+	stop := make(chan struct{})
+	refresh := make(chan struct{}, 1)
+	node.stop = stop
+	node.refresh = refresh
+	threads := max(node.Threads, 1)
 	node.mutex.Unlock()
 
-	// The next tip channel.
-	// next_tip := make(chan Block)
-	// block_solutions := make(chan Block)
-	hashrateChannel := make(chan float64, 1)
-	puzzleChannel := make(chan POWPuzzle, 1)
-	solutionChannel := make(chan POWPuzzle, 1)
-
-	go MineWithStatus(hashrateChannel, solutionChannel, puzzleChannel)
+	// Each thread reports its hashrate, which are summed.
+	type threadHashrate struct {
+		thread   int
+		hashrate float64
+	}
+	hashrateChannel := make(chan threadHashrate, threads)
+	// A thread only sends a solution before waiting for its next puzzle, so this never blocks.
+	solutionChannel := make(chan POWPuzzle, threads)
+	puzzleChannels := make([]chan POWPuzzle, threads)
+	hashrates := make([]float64, threads)
+	finished := make(chan struct{})
+	for i := range puzzleChannels {
+		puzzleChannels[i] = make(chan POWPuzzle, 1)
+		threadHashrates := make(chan float64, 1)
+		go MineWithStatus(threadHashrates, solutionChannel, puzzleChannels[i])
+		go func(thread int) {
+			for {
+				select {
+				case hashrate := <-threadHashrates:
+					select {
+					case hashrateChannel <- threadHashrate{thread, hashrate}:
+					case <-finished:
+						return
+					}
+				case <-finished:
+					return
+				}
+			}
+		}(i)
+	}
+	defer func() {
+		close(finished)
+		for _, puzzleChannel := range puzzleChannels {
+			close(puzzleChannel)
+		}
+		node.mutex.Lock()
+		node.IsRunning = false
+		node.hashrate = 0
+		if node.stop == stop {
+			node.stop = nil
+		}
+		node.refresh = nil
+		node.mutex.Unlock()
+	}()
+
+	// Sends a new puzzle to each thread, starting from a separate range of nonces.
+	var puzzleId uint64 = 0
+	newPuzzle := func() {
+		puzzleId++
+		puzzle := node.MakeNewPuzzle()
+		for i, puzzleChannel := range puzzleChannels {
+			block := *puzzle.block
+			threadPuzzle := puzzle
+			threadPuzzle.block = &block
+			threadPuzzle.id = puzzleId
+			threadPuzzle.startNonce = *new(big.Int).Lsh(big.NewInt(int64(i)), 224)
+			// Replace the puzzle the thread hasn't started yet, if any.
+			select {
+			case <-puzzleChannel:
+			default:
+			}
+			puzzleChannel <- threadPuzzle
+		}
+	}
 
 	var blocksMined int64 = 0
 
-	puzzleChannel <- node.MakeNewPuzzle()
+	newPuzzle()
 	for {
 		select {
-		case hashrate := <-hashrateChannel:
+		case <-stop:
+			minerLog.Println("Stopping miner")
+			return
+		case <-refresh:
+			minerLog.Println("Block template changed; making new puzzle")
+			newPuzzle()
+		case h := <-hashrateChannel:
+			hashrates[h.thread] = h.hashrate
+			hashrate := float64(0)
+			for _, threadHashrate := range hashrates {
+				hashrate += threadHashrate
+			}
+			node.mutex.Lock()
+			node.hashrate = hashrate
+			node.mutex.Unlock()
+
 			// Print iterations using commas.
 			p := message.NewPrinter(language.English)
-			minerLog.Printf(p.Sprintf("Hashrate: %.2f H/s\n", hashrate))
+			minerLog.Print(p.Sprintf("Hashrate: %.2f H/s\n", hashrate))
 		case puzzle := <-solutionChannel:
+			if puzzle.id != puzzleId {
+				minerLog.Println("Ignoring solution to a stale puzzle")
+				continue
+			}
 			minerLog.Println("Received solution")
 
 			raw := puzzle.block
@@ -226,15 +498,12 @@ func (node *Miner) Start(mineMaxBlocks int64) {
 			blocksMined += 1
 			if mineMaxBlocks != -1 && mineMaxBlocks <= blocksMined {
 				minerLog.Println("Mined max blocks; stopping miner")
-				node.mutex.Lock()
-				node.IsRunning = false
-				node.mutex.Unlock()
 				return
 			}
 
 			minerLog.Println("Making new puzzle")
 			minerLog.Println("New puzzle ready")
-			puzzleChannel <- node.MakeNewPuzzle()
+			newPuzzle()
 		}
 	}
 }
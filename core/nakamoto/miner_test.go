@@ -5,8 +5,10 @@ import (
 	"encoding/hex"
 	"math/big"
 	"testing"
+	"time"
 
 	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
 )
 
 func newBlockdagForMiner() (BlockDAG, ConsensusConfig, *sql.DB) {
@@ -59,3 +61,116 @@ func TestMiner(t *testing.T) {
 	miner := NewMiner(dag, minerWallet)
 	miner.Start(10)
 }
+
+func TestMinerIncludesMempool(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForMiner()
+	wallets := getTestingWallets(t)
+	mempool := NewMempool()
+	parent := makePackageTx(t, &wallets[1], 0, 0)
+	child := makePackageTx(t, &wallets[1], 1, 2)
+	assert.Nil(mempool.AddPackage([]*Transaction{parent, child}))
+
+	miner := NewMiner(dag, &wallets[0])
+	miner.Mempool = mempool
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	miner.Start(1)
+
+	// The package is included after the coinbase, parent first.
+	txs, err := dag.GetBlockTransactions(dag.FullTip.Hash)
+	assert.Nil(err)
+	assert.Equal(3, len(*txs))
+	assert.Equal(parent.Hash, (*txs)[1].Hash)
+	assert.Equal(child.Hash, (*txs)[2].Hash)
+
+	// The sender's next nonce follows the package. The miner's coinbases don't count.
+	nonce, err := dag.GetAccountNonce(wallets[1].PubkeyBytes())
+	assert.Nil(err)
+	assert.Equal(uint64(2), nonce)
+	nonce, err = dag.GetAccountNonce(wallets[0].PubkeyBytes())
+	assert.Nil(err)
+	assert.Equal(uint64(0), nonce)
+}
+
+func TestMinerFillsBlockToMaxSize(t *testing.T) {
+	assert := assert.New(t)
+
+	// Room for the coinbase and two transactions, measured by their encoding.
+	dag, _, _ := newBlockdagForMiner()
+	txSize := (&RawTransaction{Version: 1}).EncodedSizeBytes()
+	dag.consensus.MaxBlockSizeBytes = BLOCK_HEADER_BASE_SIZE + 3*txSize
+	wallets := getTestingWallets(t)
+	mempool := NewMempool()
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		assert.Nil(mempool.AddTransaction(makePackageTx(t, &wallets[1], nonce, 2)))
+	}
+
+	miner := NewMiner(dag, &wallets[0])
+	miner.Mempool = mempool
+	miner.OnBlockSolution = func(block RawBlock) {
+		assert.Equal(uint64(len(block.Bytes())), block.SizeBytes())
+
+		// Validators measure the block the same way, so it's over a limit one byte smaller.
+		dag.consensus.MaxBlockSizeBytes--
+		assert.NotNil(dag.IngestBlock(block))
+		dag.consensus.MaxBlockSizeBytes++
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	miner.Start(1)
+
+	assert.Equal(uint64(3), dag.FullTip.NumTransactions)
+	assert.Equal(dag.consensus.MaxBlockSizeBytes, dag.FullTip.SizeBytes)
+}
+
+func TestMinerRuntimeControl(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForMiner()
+	wallets := getTestingWallets(t)
+	miner := NewMiner(dag, &wallets[0])
+	miner.Threads = 2
+	miner.SetCoinbase(wallets[1].PubkeyBytes())
+	miner.SetGraffiti([32]byte{'h', 'i'})
+
+	mined := []RawBlock{}
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		mined = append(mined, block)
+		if len(mined) == 3 {
+			miner.Stop()
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		miner.Start(-1)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("Miner didn't stop")
+	}
+
+	// The reward is paid to the coinbase, signed by the miner wallet.
+	assert.Equal(3, len(mined))
+	for _, block := range mined {
+		assert.Equal(wallets[0].PubkeyBytes(), block.Transactions[0].FromPubkey)
+		assert.Equal(wallets[1].PubkeyBytes(), block.Transactions[0].ToPubkey)
+		assert.Equal([32]byte{'h', 'i'}, block.Graffiti)
+	}
+	assert.False(miner.Running())
+	assert.Equal(float64(0), miner.Hashrate())
+
+	// The miner can be started again.
+	miner.Start(1)
+	assert.Equal(4, len(mined))
+}
@@ -1,10 +1,14 @@
 package nakamoto
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/liamzebedee/tinychain-go/core"
@@ -13,6 +17,34 @@ import (
 var CLIENT_VERSION = "tinychain v0.0.0 / aggressive alpha"
 var WIRE_PROTOCOL_VERSION = uint(1)
 
+// Services a node offers to its peers, advertised as a bitfield in the heartbeat.
+const (
+	// The node accepts and relays unconfirmed transactions.
+	NODE_SERVICE_TX_RELAY uint64 = 1 << 0
+	// The node serves compact block filters. See blockfilter.go.
+	NODE_SERVICE_BLOCK_FILTERS uint64 = 1 << 1
+	// The node accepts peer messages over QUIC, on the UDP port of its address. See netpeer_quic.go.
+	NODE_SERVICE_QUIC uint64 = 1 << 2
+)
+
+const (
+	// Hosts are banned when their misbehaviour score reaches this.
+	MISBEHAVIOUR_BAN_SCORE = 100
+	// How long misbehaving hosts are banned for.
+	MISBEHAVIOUR_BAN_DURATION = 24 * time.Hour
+)
+
+// Returned by a message handler when a peer sends a message which shows it is faulty or malicious, such as a block
+// with an invalid POW solution. The peer's host is penalised by the score.
+type PeerMisbehaviourError struct {
+	Score  int
+	Reason string
+}
+
+func (e *PeerMisbehaviourError) Error() string {
+	return fmt.Sprintf("peer misbehaviour (score %d): %s", e.Score, e.Reason)
+}
+
 // Bootstrap by connecting to peers.
 // Fill your peer cache with 20 peers max.
 // Do routines:
@@ -33,21 +65,315 @@ var WIRE_PROTOCOL_VERSION = uint(1)
 // It implements the wire protocol for the network, providing API's to send messages to other peers, and callbacks to handle messages sent to us.
 type PeerCore struct {
 	peers        []Peer
+	peersMutex   sync.Mutex
 	server       *PeerServer
 	config       PeerConfig
 	externalIp   string
 	externalPort string
+	// Our external IPv6 address, if we have IPv6 connectivity. externalIp is our IPv4 address, or a hostname
+	// configured by the operator. See netpeer_dualstack.go.
+	externalIpv6 string
 
 	GossipPeersIntervalSeconds int
+	HeartbeatIntervalSeconds   int
+
+	// In blocks-only mode, the node does not accept or relay unconfirmed transactions from peers, and advertises this
+	// to peers so they don't send us any. Transactions submitted locally are still broadcast.
+	BlocksOnly bool
+
+	// If set, sent to peers in our heartbeats so they only relay us transactions to or from the pubkeys in the filter.
+	// This saves bandwidth, but tells peers which addresses we're interested in. See bloom.go.
+	TxFilter *BloomFilter
+
+	// Hosts in the denylist, or outside the allowlist if it is set, can't send us messages. See netpeer_filter.go.
+	InboundAllowlist []*net.IPNet
+	InboundDenylist  []*net.IPNet
+
+	// In private network mode, the node only connects to the peers it was configured with. It doesn't learn of peers
+	// from gossip, or tell peers about its own. See netpeer_filter.go.
+	PrivateNetwork bool
+
+	// Peers which haven't responded to a heartbeat within this time are disconnected.
+	HeartbeatTimeoutSeconds int
+	// Peers whose tip hasn't advanced within this time, and is behind ours, are disconnected.
+	StaleTipTimeoutSeconds int
+	// The number of outbound peers the connection manager tries to maintain.
+	TargetPeers int
+	// The maximum number of peers, inbound and outbound.
+	MaxPeers int
+	// The number of peer slots reserved for outbound peers. Inbound peers are limited to MaxPeers - MinOutboundPeers.
+	MinOutboundPeers int
+
+	// The interval between DHT refreshes. See netpeer_dht.go.
+	DHTRefreshIntervalSeconds int
+
+	// How long we wait for a reply to a request, and how many times a request which times out is retried. See
+	// netpeer_requests.go.
+	RequestTimeout time.Duration
+	RequestRetries int
+	// The ID of the last request sent.
+	nextRequestID atomic.Uint64
+
+	// The node identity our messages are signed with. See identity.go.
+	identity *core.Wallet
+
+	// The DHT routing table, keyed by our node ID, and the file it's saved to. See netpeer_dht.go.
+	routingTable     *RoutingTable
+	routingTablePath string
+
+	// The block and transaction hashes we've recently seen, and the file it's saved to. See knowninv.go.
+	knownInventory     *KnownInventory
+	knownInventoryPath string
+
+	// Peer addresses we have learnt of, mapped to the earliest time we can next dial them.
+	knownPeers map[string]time.Time
+
+	// Banned hosts, mapped to the time the ban expires. A zero time means the ban is permanent.
+	bannedHosts map[string]time.Time
+	// The misbehaviour scores of hosts.
+	misbehaviourScores map[string]int
+
+	// The callbacks which handle messages from peers.
+	PeerCallbacks
+
+	peerLogger log.Logger
+}
 
-	OnNewBlock          func(block RawBlock)
+// PeerInterface is the networking backend of a node, which it uses to talk to its peers. PeerCore implements it with
+// our own wire protocol, and Libp2pPeer with libp2p (see netpeer_libp2p.go).
+type PeerInterface interface {
+	// Starts serving peers. Blocks until the backend stops.
+	Start()
+	// Connects to the network through the given peers.
+	Bootstrap(peerInfos []string)
+	// Returns the address peers can reach us at.
+	GetLocalAddr() string
+	// Returns the callbacks which handle messages from peers, for the node to set.
+	Callbacks() *PeerCallbacks
+
+	// Gossip.
+	GossipBlock(block RawBlock)
+	GossipTransaction(tx RawTransaction)
+
+	// Sync requests.
+	GetTip(peer Peer) (BlockHeader, error)
+	HasBlock(peer Peer, blockhash [32]byte) (bool, error)
+	SyncGetTipAtDepth(peer Peer, fromBlock [32]byte, depth uint64) (BlockHeader, error)
+	SyncGetBlockHeaders(peer Peer, fromBlock [32]byte, heights core.Bitset) ([]BlockHeader, error)
+	GetCheckpoints(peer Peer, fromHeight uint64, interval uint64) ([]Checkpoint, error)
+
+	// Peer management.
+	Peers() []Peer
+	PeerTimeOffsets() []time.Duration
+	AddPeer(peerInfo string) error
+	RemovePeer(peerInfo string) error
+	BanPeer(peerInfo string, duration time.Duration) error
+	UnbanPeer(peerInfo string) error
+	BannedHosts() map[string]time.Time
+	MisbehaviourScore(host string) int
+	Misbehaving(host string, score int, reason string)
+}
+
+// The callbacks a networking backend calls to handle messages from peers.
+type PeerCallbacks struct {
+	// OnPrecheckBlock cheaply checks a new block before it is passed to OnNewBlock. Blocks failing with
+	// ErrBlockPOWInvalid are dropped, and the peer which relayed them is banned.
+	OnPrecheckBlock func(block RawBlock) error
+	// OnPrecheckTransaction cheaply checks a new transaction before it is passed to OnNewTransaction. Transactions
+	// failing it are dropped, and not relayed.
+	OnPrecheckTransaction func(tx RawTransaction) error
+	// OnNewBlock handles a new block. Returning ErrPeerBusy tells the sender to back off.
+	OnNewBlock          func(block RawBlock) error
 	OnNewTransaction    func(tx RawTransaction)
 	OnGetBlocks         func(msg GetBlocksMessage) ([][]byte, error)
+	OnHasBlock          func(blockhash [32]byte) bool
 	OnGetTip            func(msg GetTipMessage) (BlockHeader, error)
 	OnSyncGetTipAtDepth func(msg SyncGetTipAtDepthMessage) (SyncGetTipAtDepthReply, error)
 	OnSyncGetData       func(msg SyncGetDataMessage) (SyncGetDataReply, error)
+	OnGetFullTip        func() (hash [32]byte, height uint64)
+	OnGetCheckpoints    func(msg GetCheckpointsMessage) (GetCheckpointsReply, error)
+	OnGetWorkProof      func(msg GetWorkProofMessage) (GetWorkProofReply, error)
+	OnGetAncestryProof  func(msg GetAncestryProofMessage) (GetAncestryProofReply, error)
+	OnGetBlockFilters   func(msg GetBlockFiltersMessage) (GetBlockFiltersReply, error)
+}
 
-	peerLogger log.Logger
+func (p *PeerCore) Callbacks() *PeerCallbacks {
+	return &p.PeerCallbacks
+}
+
+// Returns the handlers for the requests peers make of us, which reply with data from the callbacks. They're shared by
+// the networking backends.
+func (cb *PeerCallbacks) requestHandlers() map[string]PeerMessageHandler {
+	handlers := make(map[string]PeerMessageHandler)
+
+	handlers["get_blocks"] = func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg GetBlocksMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+		if MAX_GET_BLOCKS_HASHES < len(msg.BlockHashes) {
+			return nil, fmt.Errorf("Too many hashes requested. Max is %d", MAX_GET_BLOCKS_HASHES)
+		}
+
+		if cb.OnGetBlocks != nil {
+			rawBlocksDatas, err := cb.OnGetBlocks(msg)
+			if err != nil {
+				return nil, err
+			}
+
+			return GetBlocksReply{
+				Type:          "get_blocks_reply",
+				RequestID:     msg.RequestID,
+				RawBlockDatas: rawBlocksDatas,
+			}, nil
+		}
+
+		return nil, nil
+	}
+
+	handlers["has_block"] = func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg HasBlockMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+
+		if cb.OnHasBlock == nil {
+			return nil, fmt.Errorf("HasBlock callback not set")
+		}
+
+		return HasBlockReply{
+			Type:      "has_block_reply",
+			RequestID: msg.RequestID,
+			Has:       cb.OnHasBlock(HexStringToBytes32(msg.BlockHash)),
+		}, nil
+	}
+
+	handlers["get_tip"] = func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg GetTipMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+
+		if cb.OnGetTip == nil {
+			return nil, fmt.Errorf("GetTip callback not set")
+		}
+
+		tip, err := cb.OnGetTip(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		return GetTipMessage{
+			Type:      "get_tip",
+			RequestID: msg.RequestID,
+			Tip:       tip,
+		}, nil
+	}
+
+	handlers["sync_get_tip_at_depth"] = func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg SyncGetTipAtDepthMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+		if MAX_SYNC_WINDOW < msg.Depth {
+			return nil, fmt.Errorf("Depth too large. Max is %d", MAX_SYNC_WINDOW)
+		}
+
+		if cb.OnSyncGetData == nil {
+			return nil, fmt.Errorf("SyncGetData callback not set")
+		}
+
+		reply, err := cb.OnSyncGetTipAtDepth(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		return reply, nil
+	}
+
+	handlers["get_checkpoints"] = func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg GetCheckpointsMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+		if msg.Interval == 0 {
+			return nil, fmt.Errorf("Checkpoint interval must be positive.")
+		}
+
+		if cb.OnGetCheckpoints == nil {
+			return nil, fmt.Errorf("GetCheckpoints callback not set")
+		}
+
+		return cb.OnGetCheckpoints(msg)
+	}
+
+	handlers["get_work_proof"] = func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg GetWorkProofMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+		if msg.Samples <= 0 || MAX_WORK_PROOF_SAMPLES < msg.Samples {
+			return nil, fmt.Errorf("Number of samples must be between 1 and %d.", MAX_WORK_PROOF_SAMPLES)
+		}
+
+		if cb.OnGetWorkProof == nil {
+			return nil, fmt.Errorf("GetWorkProof callback not set")
+		}
+
+		return cb.OnGetWorkProof(msg)
+	}
+
+	handlers["get_ancestry_proof"] = func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg GetAncestryProofMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+
+		if cb.OnGetAncestryProof == nil {
+			return nil, fmt.Errorf("GetAncestryProof callback not set")
+		}
+
+		return cb.OnGetAncestryProof(msg)
+	}
+
+	handlers["get_block_filters"] = func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg GetBlockFiltersMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+		if msg.Count == 0 || MAX_BLOCK_FILTERS < msg.Count {
+			return nil, fmt.Errorf("Count must be between 1 and %d.", MAX_BLOCK_FILTERS)
+		}
+
+		if cb.OnGetBlockFilters == nil {
+			return nil, fmt.Errorf("GetBlockFilters callback not set")
+		}
+
+		return cb.OnGetBlockFilters(msg)
+	}
+
+	handlers["sync_get_data"] = func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg SyncGetDataMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+		if MAX_SYNC_WINDOW < msg.Heights.Size() {
+			return nil, fmt.Errorf("Too many heights requested. Max is %d", MAX_SYNC_WINDOW)
+		}
+
+		if cb.OnSyncGetData == nil {
+			return nil, fmt.Errorf("SyncGetData callback not set")
+		}
+
+		reply, err := cb.OnSyncGetData(msg)
+		if err != nil {
+			return nil, err
+		}
+
+		return reply, nil
+	}
+
+	return handlers
 }
 
 type Peer struct {
@@ -56,6 +382,132 @@ type Peer struct {
 	port          string
 	lastSeen      uint64
 	clientVersion string
+
+	// The peer's node ID, learnt from its signed heartbeats. "" if the peer doesn't sign its messages.
+	nodeID string
+	// The addresses the peer advertised in its heartbeats, its primary address first. See netpeer_dualstack.go.
+	addresses []string
+
+	// Whether the peer connected to us, rather than us to them.
+	inbound     bool
+	connectedAt time.Time
+	// The services the peer advertised in its heartbeat.
+	services uint64
+	// The peer's transaction filter, if it sent one. Only matching transactions are relayed to it.
+	txFilter *BloomFilter
+	// The wire encoding negotiated with the peer.
+	encoding string
+	// The compression negotiated with the peer, or "" if none.
+	compression string
+
+	// Stats.
+	tipHeight uint64
+	// The tip hash the peer advertised in its last heartbeat.
+	tipHash string
+	// The wire protocol version the peer advertised in its last heartbeat.
+	protocolVersion uint
+	// The last time we exchanged heartbeats with the peer.
+	lastHeartbeat time.Time
+	// The last time the peer's reported tip height advanced.
+	tipAdvancedAt time.Time
+	// Smoothed round-trip time, measured by heartbeat echoes.
+	latency time.Duration
+	// Smoothed offset of the peer's clock from ours, measured by heartbeats. Positive means the peer's clock is ahead.
+	timeOffset      time.Duration
+	timeOffsetKnown bool
+	// Messages and bytes sent/received, by message type.
+	messageStats map[string]PeerMessageStats
+	// Set when the peer replies that it's busy. Blocks and transactions aren't gossiped to it until then.
+	busyUntil time.Time
+	// The requests we've sent the peer which haven't been replied to yet, by message type.
+	inFlight map[string]int
+	// The requests we've sent the peer expecting a reply, by request ID, and their outcomes by message type. See
+	// netpeer_requests.go.
+	requests     map[uint64]peerRequest
+	requestStats map[string]PeerRequestStats
+}
+
+type PeerMessageStats struct {
+	MessagesSent     uint64 `json:"messagesSent"`
+	MessagesReceived uint64 `json:"messagesReceived"`
+	BytesSent        uint64 `json:"bytesSent"`
+	BytesReceived    uint64 `json:"bytesReceived"`
+}
+
+// Records the peer's reported tip height.
+func (peer *Peer) recordTip(height uint64, now time.Time) {
+	if peer.tipAdvancedAt.IsZero() || peer.tipHeight < height {
+		peer.tipAdvancedAt = now
+	}
+	peer.tipHeight = height
+}
+
+// Records the chain and protocol state the peer advertised in a heartbeat.
+func (peer *Peer) recordHeartbeat(msg HeartbeatMesage, now time.Time) {
+	peer.tipHash = msg.TipHash
+	peer.protocolVersion = msg.WireProtocolVersion
+	peer.lastHeartbeat = now
+	peer.recordTip(uint64(msg.TipHeight), now)
+}
+
+// Records a request to the peer starting (delta 1) or finishing (delta -1).
+func (peer *Peer) recordInFlight(messageType string, delta int) {
+	if peer.inFlight == nil {
+		peer.inFlight = make(map[string]int)
+	}
+	peer.inFlight[messageType] += delta
+	if peer.inFlight[messageType] <= 0 {
+		delete(peer.inFlight, messageType)
+	}
+}
+
+// Records a round-trip time sample, as an exponentially-weighted moving average.
+func (peer *Peer) recordLatency(rtt time.Duration) {
+	if peer.latency == 0 {
+		peer.latency = rtt
+	} else {
+		peer.latency = (peer.latency*4 + rtt) / 5
+	}
+}
+
+// Records a clock offset sample, as an exponentially-weighted moving average.
+func (peer *Peer) recordTimeOffset(offset time.Duration) {
+	if !peer.timeOffsetKnown {
+		peer.timeOffset = offset
+		peer.timeOffsetKnown = true
+	} else {
+		peer.timeOffset = (peer.timeOffset*4 + offset) / 5
+	}
+}
+
+// Estimates the offset of a peer's clock from ours, from the time in their heartbeat reply. The peer's time is assumed
+// to be taken halfway through the round trip.
+func estimateTimeOffset(peerTime time.Time, rtt time.Duration, receivedAt time.Time) time.Duration {
+	return peerTime.Sub(receivedAt.Add(-rtt / 2))
+}
+
+func (peer *Peer) recordMessage(messageType string, stats PeerMessageStats) {
+	if peer.messageStats == nil {
+		peer.messageStats = make(map[string]PeerMessageStats)
+	}
+	s := peer.messageStats[messageType]
+	s.MessagesSent += stats.MessagesSent
+	s.MessagesReceived += stats.MessagesReceived
+	s.BytesSent += stats.BytesSent
+	s.BytesReceived += stats.BytesReceived
+	peer.messageStats[messageType] = s
+}
+
+// Returns the total messages and bytes sent/received across all message types.
+func (peer *Peer) totalMessageStats() PeerMessageStats {
+	total := PeerMessageStats{}
+	for _, s := range peer.messageStats {
+		total.MessagesSent += s.MessagesSent
+		total.MessagesReceived += s.MessagesReceived
+		total.BytesSent += s.BytesSent
+		total.BytesReceived += s.BytesReceived
+	}
+	return total
 }
 
 func NewPeerCore(config PeerConfig) *PeerCore {
@@ -64,144 +516,174 @@ func NewPeerCore(config PeerConfig) *PeerCore {
 		server:                     nil,
 		config:                     config,
 		GossipPeersIntervalSeconds: 30,
+		HeartbeatIntervalSeconds:   30,
+		HeartbeatTimeoutSeconds:    90,
+		StaleTipTimeoutSeconds:     30 * 60,
+		TargetPeers:                8,
+		MaxPeers:                   32,
+		MinOutboundPeers:           8,
+		DHTRefreshIntervalSeconds:  5 * 60,
+		RequestTimeout:             DEFAULT_PEER_REQUEST_TIMEOUT,
+		RequestRetries:             DEFAULT_PEER_REQUEST_RETRIES,
+		knownPeers:                 make(map[string]time.Time),
+		bannedHosts:                make(map[string]time.Time),
+		misbehaviourScores:         make(map[string]int),
+		knownInventory:             NewKnownInventory(DEFAULT_KNOWN_INVENTORY_SIZE),
 		peerLogger:                 *NewLogger("peer", fmt.Sprintf(":%s", config.port)),
 	}
 
-	externalIp, _, err := DiscoverIP()
-	if err != nil {
-		log.Fatalf("Failed to discover external IP: %v", err)
-	}
-	p.externalIp = externalIp
 	// p.externalPort = fmt.Sprintf("%d", externalPort)
 	p.externalPort = config.port
+	var err error
+	if 0 < len(config.ExternalAddrs) {
+		p.externalIp, p.externalIpv6, p.externalPort, err = ParseExternalAddrs(config.ExternalAddrs, config.port)
+		if err != nil {
+			log.Fatalf("Invalid external address: %v", err)
+		}
+	} else if !config.NoDiscoverIP {
+		p.externalIp, p.externalIpv6, err = DiscoverIPs()
+		if err != nil {
+			log.Fatalf("Failed to discover external IP: %v", err)
+		}
+	}
 	p.server = NewPeerServer(p.config)
+	p.server.AllowRequest = func(r *http.Request) bool {
+		host := clientIP(r)
+		return !p.IsBanned(host) && p.IsInboundAllowed(host)
+	}
+	p.server.AllowSender = p.allowSender
+	identity, err := core.CreateRandomWallet()
+	if err != nil {
+		log.Fatalf("Failed to create node identity: %v", err)
+	}
+	p.SetIdentity(identity)
+	p.server.OnMessage = func(peerAddr string, messageType string, bytesReceived int, bytesSent int) {
+		p.updatePeer(peerAddr, func(peer *Peer) {
+			peer.recordMessage(messageType, PeerMessageStats{
+				MessagesReceived: 1,
+				BytesReceived:    uint64(bytesReceived),
+				BytesSent:        uint64(bytesSent),
+			})
+		})
+	}
+	p.server.OnMessageError = func(r *http.Request, messageType string, err error) {
+		var misbehaviour *PeerMisbehaviourError
+		if errors.As(err, &misbehaviour) {
+			p.Misbehaving(clientIP(r), misbehaviour.Score, misbehaviour.Reason)
+		}
+	}
 
 	// Message handlers.
 	//
 
-	p.server.RegisterMesageHandler("heartbeat", func(message []byte) (interface{}, error) {
+	p.server.RegisterMesageHandler("heartbeat", func(message []byte, codec WireCodec) (interface{}, error) {
 		// Decode message into HeartbeatMessage.
 		var msg HeartbeatMesage
-		if err := json.Unmarshal(message, &msg); err != nil {
+		if err := codec.Unmarshal(message, &msg); err != nil {
 			return nil, err
 		}
 
-		return nil, nil
-	})
-
-	p.server.RegisterMesageHandler("new_block", func(message []byte) (interface{}, error) {
-		var msg NewBlockMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
+		// Update the peer's info, or accept them as an inbound peer.
+		if err := p.acceptInboundPeer(msg, time.Now()); err != nil {
 			return nil, err
 		}
 
-		// Call the OnNewBlock callback.
-		if p.OnNewBlock != nil {
-			p.OnNewBlock(msg.RawBlock)
-		}
-		return nil, nil
+		// Reply with our own heartbeat, echoing the sender's time so they can measure the round-trip time.
+		reply := p.newHeartbeat()
+		reply.EchoTime = msg.Time
+		return reply, nil
 	})
 
-	p.server.RegisterMesageHandler("new_tx", func(message []byte) (interface{}, error) {
-		var msg NewTransactionMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
+	p.server.RegisterMesageHandler("new_block", func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg NewBlockMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
 			return nil, err
 		}
 
-		// Call the OnNewTransaction callback.
-		if p.OnNewTransaction != nil {
-			p.OnNewTransaction(msg.RawTransaction)
+		// Drop blocks we've already seen.
+		hash := msg.RawBlock.Hash()
+		if !p.knownInventory.Add(hash) {
+			return nil, nil
 		}
-		return nil, nil
-	})
 
-	p.server.RegisterMesageHandler("get_blocks", func(message []byte) (interface{}, error) {
-		var msg GetBlocksMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			return nil, err
+		// Check the block's POW before doing any expensive processing.
+		if p.OnPrecheckBlock != nil {
+			err := p.OnPrecheckBlock(msg.RawBlock)
+			if errors.Is(err, ErrBlockPOWInvalid) {
+				return nil, &PeerMisbehaviourError{
+					Score:  MISBEHAVIOUR_BAN_SCORE,
+					Reason: fmt.Sprintf("Relayed block %s with an invalid POW solution", msg.RawBlock.HashStr()),
+				}
+			}
+			if err != nil {
+				p.peerLogger.Printf("Failed to pre-check block %s: %v\n", msg.RawBlock.HashStr(), err)
+				p.knownInventory.Remove(hash)
+				return nil, nil
+			}
 		}
 
-		if p.OnGetBlocks != nil {
-			rawBlocksDatas, err := p.OnGetBlocks(msg)
-			if err != nil {
+		// Call the OnNewBlock callback.
+		if p.OnNewBlock != nil {
+			if err := p.OnNewBlock(msg.RawBlock); err != nil {
+				p.knownInventory.Remove(hash)
 				return nil, err
 			}
-
-			return GetBlocksReply{
-				Type:          "get_blocks_reply",
-				RawBlockDatas: rawBlocksDatas,
-			}, nil
 		}
-
 		return nil, nil
 	})
 
-	p.server.RegisterMesageHandler("get_tip", func(message []byte) (interface{}, error) {
-		var msg GetTipMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
+	p.server.RegisterMesageHandler("new_tx", func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg NewTransactionMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
 			return nil, err
 		}
 
-		if p.OnGetTip == nil {
-			return nil, fmt.Errorf("GetTip callback not set")
+		if p.BlocksOnly {
+			// We don't accept unconfirmed transactions.
+			return nil, nil
 		}
 
-		tip, err := p.OnGetTip(msg)
-		if err != nil {
-			return nil, err
+		// Drop transactions we've already seen.
+		if !p.knownInventory.Add(msg.RawTransaction.Hash()) {
+			return nil, nil
 		}
 
-		return GetTipMessage{
-			Type: "get_tip",
-			Tip:  tip,
-		}, nil
-	})
-
-	p.server.RegisterMesageHandler("sync_get_tip_at_depth", func(message []byte) (interface{}, error) {
-		var msg SyncGetTipAtDepthMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			return nil, err
-		}
-
-		if p.OnSyncGetData == nil {
-			return nil, fmt.Errorf("SyncGetData callback not set")
+		if p.OnPrecheckTransaction != nil {
+			if err := p.OnPrecheckTransaction(msg.RawTransaction); err != nil {
+				return nil, err
+			}
 		}
 
-		reply, err := p.OnSyncGetTipAtDepth(msg)
-		if err != nil {
-			return nil, err
+		// Call the OnNewTransaction callback.
+		if p.OnNewTransaction != nil {
+			p.OnNewTransaction(msg.RawTransaction)
 		}
-
-		return reply, nil
+		return nil, nil
 	})
 
-	p.server.RegisterMesageHandler("sync_get_data", func(message []byte) (interface{}, error) {
-		var msg SyncGetDataMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			return nil, err
-		}
+	for messageKey, handler := range p.PeerCallbacks.requestHandlers() {
+		p.server.RegisterMesageHandler(messageKey, handler)
+	}
 
-		if p.OnSyncGetData == nil {
-			return nil, fmt.Errorf("SyncGetData callback not set")
-		}
+	p.server.RegisterMesageHandler("dht_find_node", p.handleDHTFindNode)
 
-		reply, err := p.OnSyncGetData(msg)
-		if err != nil {
+	p.server.RegisterMesageHandler("gossip_peers", func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg GossipPeersMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
 			return nil, err
 		}
+		if MAX_GOSSIP_PEERS < len(msg.Peers) {
+			return nil, fmt.Errorf("Too many peers. Max is %d", MAX_GOSSIP_PEERS)
+		}
 
-		return reply, nil
-	})
-
-	p.server.RegisterMesageHandler("gossip_peers", func(message []byte) (interface{}, error) {
-		var msg GossipPeersMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			return nil, err
+		// Private networks don't share their peers.
+		if p.PrivateNetwork {
+			return GossipPeersMessage{Type: "gossip_peers", Peers: []string{}}, nil
 		}
 
 		// Ingest new peers.
 		havePeers := make(map[string]bool)
-		for _, peer := range p.peers {
+		for _, peer := range p.Peers() {
 			havePeers[peer.url] = true
 		}
 		for _, peerUrl := range msg.Peers {
@@ -211,14 +693,9 @@ func NewPeerCore(config PeerConfig) *PeerCore {
 		}
 
 		// Reply with our peers.
-		peers := []string{}
-		for _, peer := range p.peers {
-			peers = append(peers, peer.url)
-		}
-
 		return GossipPeersMessage{
 			Type:  "gossip_peers",
-			Peers: peers,
+			Peers: p.gossipPeerAddrs(),
 		}, nil
 	})
 
@@ -228,51 +705,263 @@ func NewPeerCore(config PeerConfig) *PeerCore {
 func (p *PeerCore) Start() {
 	go p.statusLoggerRoutine()
 	go p.gossipPeersRoutine()
+	go p.heartbeatRoutine()
+	go p.connectionManagerRoutine()
+	go p.knownInventoryRoutine()
+	if !p.PrivateNetwork {
+		go p.dhtRoutine()
+	}
 
 	err := p.server.Start()
 	if err != nil {
 		panic(fmt.Sprintf("Failed to start peer server: %v", err))
 	}
-}
+}
+
+func (p *PeerCore) gossipPeersRoutine() {
+	for {
+		p.peerLogger.Printf("gossip-peers-routine start\n")
+		p.GossipPeers()
+		p.peerLogger.Printf("gossip-peers-routine complete\n")
+		time.Sleep(time.Duration(p.GossipPeersIntervalSeconds) * time.Second)
+	}
+}
+
+func (p *PeerCore) heartbeatRoutine() {
+	for {
+		time.Sleep(time.Duration(p.HeartbeatIntervalSeconds) * time.Second)
+
+		for _, peer := range p.Peers() {
+			reply, rtt, err := p.sendHeartbeat(peer.url)
+			if err != nil {
+				p.peerLogger.Printf("Failed to send heartbeat to peer: %v", err)
+				continue
+			}
+			receivedAt := time.Now()
+			p.updatePeer(peer.url, func(peer *Peer) {
+				peer.clientVersion = reply.ClientVersion
+				peer.nodeID = reply.NodeID
+				peer.addresses = parseClientAddresses(reply)
+				peer.services = reply.Services
+				peerTransport.setQuicSupport(peer.url, reply.NodeID, reply.Services&NODE_SERVICE_QUIC != 0)
+				peer.txFilter = parseTxFilter(reply)
+				peer.encoding = NegotiateWireEncoding(reply.Encodings)
+				peer.compression = NegotiateWireCompression(reply.Compressions)
+				peer.recordHeartbeat(reply, time.Now())
+				peer.recordLatency(rtt)
+				if !reply.Time.IsZero() {
+					peer.recordTimeOffset(estimateTimeOffset(reply.Time, rtt, receivedAt))
+				}
+			})
+		}
+
+		p.evictStalePeers(time.Now())
+	}
+}
+
+// Maintains the target number of peers, by dialing known peer addresses.
+func (p *PeerCore) connectionManagerRoutine() {
+	for {
+		time.Sleep(time.Duration(p.HeartbeatIntervalSeconds) * time.Second)
+
+		candidates := p.peersToDial(time.Now())
+		if len(candidates) == 0 {
+			continue
+		}
+		p.peerLogger.Printf("connection-manager dialing %d peers\n", len(candidates))
+
+		var wg sync.WaitGroup
+		for _, peerUrl := range candidates {
+			wg.Add(1)
+			go func(peerUrl string) {
+				defer wg.Done()
+				if err := p.AddPeer(peerUrl); err != nil {
+					// Backoff before retrying.
+					p.setPeerRetry(peerUrl, time.Now().Add(time.Duration(p.HeartbeatTimeoutSeconds)*time.Second))
+				}
+			}(peerUrl)
+		}
+		wg.Wait()
+	}
+}
+
+// Returns the known peer addresses to dial in order to reach the target number of peers.
+func (p *PeerCore) peersToDial(now time.Time) []string {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	connected := make(map[string]bool)
+	numOutbound := 0
+	for _, peer := range p.peers {
+		connected[peer.url] = true
+		if !peer.inbound {
+			numOutbound++
+		}
+	}
+
+	limit := p.TargetPeers - numOutbound
+	if p.MaxPeers-len(p.peers) < limit {
+		limit = p.MaxPeers - len(p.peers)
+	}
+	if limit <= 0 {
+		return []string{}
+	}
+
+	candidates := []string{}
+	for peerUrl, retryAt := range p.knownPeers {
+		if connected[peerUrl] || now.Before(retryAt) {
+			continue
+		}
+		candidates = append(candidates, peerUrl)
+	}
+
+	// Prefer addresses in the families we can reach, and only dial the others when there's nothing better.
+	p.sortByDialPreference(candidates)
+	for i, peerUrl := range candidates {
+		if 0 < i && p.dialRank(candidates[0]) < 2 && 2 <= p.dialRank(peerUrl) {
+			candidates = candidates[:i]
+			break
+		}
+	}
+	if limit < len(candidates) {
+		candidates = candidates[:limit]
+	}
+	return candidates
+}
+
+func (p *PeerCore) setPeerRetry(peerUrl string, retryAt time.Time) {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+	p.knownPeers[peerUrl] = retryAt
+}
+
+// Disconnects peers whose heartbeats have stopped, or whose tip has stopped advancing while behind ours.
+func (p *PeerCore) evictStalePeers(now time.Time) {
+	ourHeight := uint64(0)
+	if p.OnGetFullTip != nil {
+		_, ourHeight = p.OnGetFullTip()
+	}
 
-func (p *PeerCore) gossipPeersRoutine() {
-	for {
-		p.peerLogger.Printf("gossip-peers-routine start\n")
-		p.GossipPeers()
-		p.peerLogger.Printf("gossip-peers-routine complete\n")
-		time.Sleep(time.Duration(p.GossipPeersIntervalSeconds) * time.Second)
+	heartbeatTimeout := time.Duration(p.HeartbeatTimeoutSeconds) * time.Second
+	staleTipTimeout := time.Duration(p.StaleTipTimeoutSeconds) * time.Second
+
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	peers := []Peer{}
+	for _, peer := range p.peers {
+		lastSeen := time.Unix(int64(peer.lastSeen), 0)
+		if heartbeatTimeout < now.Sub(lastSeen) {
+			p.peerLogger.Printf("Disconnecting peer %s: no heartbeat since %s\n", peer.url, lastSeen)
+			p.knownPeers[peer.url] = now.Add(heartbeatTimeout)
+			peerTransport.closePeer(peer.url)
+			continue
+		}
+		if staleTipTimeout < now.Sub(peer.tipAdvancedAt) && peer.tipHeight < ourHeight {
+			p.peerLogger.Printf("Disconnecting peer %s: tip stale at height %d since %s\n", peer.url, peer.tipHeight, peer.tipAdvancedAt)
+			p.knownPeers[peer.url] = now.Add(staleTipTimeout)
+			peerTransport.closePeer(peer.url)
+			continue
+		}
+		peers = append(peers, peer)
 	}
+	p.peers = peers
 }
 
 func (p *PeerCore) statusLoggerRoutine() {
 	for {
 		// Set timeout.
-		p.peerLogger.Printf("Connected to %d peers", len(p.peers))
+		p.peerLogger.Printf("Connected to %d peers", len(p.Peers()))
 		time.Sleep(30 * time.Second)
 	}
 }
 
 func (p *PeerCore) GetLocalAddr() string {
 	// TODO for now.
-	return fmt.Sprintf("http://%s:%s", p.config.address, p.config.port)
+	return formatPeerURL(p.config.address, p.config.port)
+}
+
+// Sets the node identity our messages and replies are signed with. NewPeerCore creates a random identity, which
+// doesn't persist across restarts. See LoadOrCreateNodeIdentity.
+func (p *PeerCore) SetIdentity(identity *core.Wallet) {
+	p.identity = identity
+	p.server.Identity = identity
+
+	// The routing table is keyed by our node ID, so rebuild it around the new one.
+	table, err := NewRoutingTable(NodeID(identity))
+	if err != nil {
+		return
+	}
+	if p.routingTable != nil {
+		for _, contact := range p.routingTable.Contacts() {
+			table.Update(contact)
+		}
+	}
+	p.routingTable = table
+}
+
+// Returns our node ID.
+func (p *PeerCore) NodeID() string {
+	if p.identity == nil {
+		return ""
+	}
+	return NodeID(p.identity)
+}
+
+// Rejects messages which claim to come from a peer with a known identity, but aren't signed by it, and unsigned
+// messages from the host of a peer with a known identity. Several nodes can share a host (ie. behind a NAT), so a
+// message from the host can be signed by another identity, which is attributed to that node rather than the peer.
+func (p *PeerCore) allowSender(peerAddr string, remoteHost string, nodeID string) bool {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	fromKnownHost := false
+	for _, peer := range p.peers {
+		if peer.nodeID == "" {
+			continue
+		}
+		if peer.url == peerAddr && peer.nodeID != nodeID {
+			p.peerLogger.Printf("Discarding message from %s not signed by its identity\n", peerAddr)
+			return false
+		}
+		if u, err := url.Parse(peer.url); err == nil && u.Hostname() == remoteHost {
+			fromKnownHost = true
+		}
+	}
+	if fromKnownHost && nodeID == "" {
+		p.peerLogger.Printf("Discarding unsigned message from %s, the host of a peer with a known identity\n", remoteHost)
+		return false
+	}
+	return true
 }
 
+// Returns our primary external address, which is IPv4 if we have IPv4 connectivity, or "" if we don't advertise one.
 func (p *PeerCore) GetExternalAddr() string {
-	return fmt.Sprintf("http://%s:%s", p.externalIp, p.externalPort)
+	addrs := p.GetExternalAddrs()
+	if len(addrs) == 0 {
+		return ""
+	}
+	return addrs[0]
 }
 
 func (p *PeerCore) GossipBlock(block RawBlock) {
-	p.peerLogger.Printf("Gossiping block %s to %d peers\n", block.HashStr(), len(p.peers))
+	peers := p.Peers()
+	p.peerLogger.Printf("Gossiping block %s to %d peers\n", block.HashStr(), len(peers))
+	p.knownInventory.Add(block.Hash())
 
 	// Send block to all peers.
 	newBlockMsg := NewBlockMessage{
 		Type:     "new_block",
 		RawBlock: block,
 	}
-	for _, peer := range p.peers {
+	for _, peer := range peers {
+		if time.Now().Before(peer.busyUntil) {
+			continue
+		}
+
 		// TODO gossip the block header but not the full block.
 		// Let the peer decide on whether they need to download block.
-		_, err := SendMessageToPeer(peer.url, newBlockMsg, &p.peerLogger)
+		_, _, err := p.sendMessage(peer.url, newBlockMsg)
 		if err != nil {
 			p.peerLogger.Printf("Failed to send block to peer: %v", err)
 			continue
@@ -280,35 +969,68 @@ func (p *PeerCore) GossipBlock(block RawBlock) {
 	}
 }
 
+func (p *PeerCore) GossipTransaction(tx RawTransaction) {
+	peers := p.Peers()
+	p.peerLogger.Printf("Gossiping transaction %x to %d peers\n", tx.Hash(), len(peers))
+	p.knownInventory.Add(tx.Hash())
+
+	// Send transaction to all peers.
+	newTxMsg := NewTransactionMessage{
+		Type:           "new_tx",
+		RawTransaction: tx,
+	}
+	for _, peer := range peers {
+		// Skip peers in blocks-only mode, and busy peers.
+		if peer.services&NODE_SERVICE_TX_RELAY == 0 || time.Now().Before(peer.busyUntil) {
+			continue
+		}
+		// Skip peers whose filter doesn't match.
+		if peer.txFilter != nil && !peer.txFilter.MatchesTransaction(tx) {
+			continue
+		}
+
+		_, _, err := p.sendMessage(peer.url, newTxMsg)
+		if err != nil {
+			p.peerLogger.Printf("Failed to send transaction to peer: %v", err)
+			continue
+		}
+	}
+}
+
 func (p *PeerCore) GossipPeers() {
-	p.peerLogger.Printf("Gossiping peers list to %d peers\n", len(p.peers))
+	if p.PrivateNetwork {
+		return
+	}
+	peers := p.Peers()
+	p.peerLogger.Printf("Gossiping peers list to %d peers\n", len(peers))
 
 	// Send list to all peers.
-	peers := []string{}
-	for _, peer := range p.peers {
-		peers = append(peers, peer.url)
-	}
 	gossipPeersMsg := GossipPeersMessage{
 		Type:  "gossip_peers",
-		Peers: peers,
+		Peers: p.gossipPeerAddrs(),
 	}
 
-	for _, peer := range p.peers {
-		reply, err := SendMessageToPeer(peer.url, gossipPeersMsg, &p.peerLogger)
+	for _, peer := range peers {
+		reply, codec, err := p.sendMessage(peer.url, gossipPeersMsg)
 		if err != nil {
 			p.peerLogger.Printf("Failed to send block to peer: %v", err)
+			continue
 		}
 
 		// Handle reply.
 		var msg GossipPeersMessage
-		if err := json.Unmarshal(reply, &msg); err != nil {
+		if err := codec.Unmarshal(reply, &msg); err != nil {
 			p.peerLogger.Printf("Failed to unmarshal gossip peers reply: %v", err)
 			continue
 		}
+		if MAX_GOSSIP_PEERS < len(msg.Peers) {
+			p.peerLogger.Printf("Peer %s replied with too many peers (%d)", peer.url, len(msg.Peers))
+			continue
+		}
 
 		// Ingest new peers.
 		havePeers := make(map[string]bool)
-		for _, peer := range p.peers {
+		for _, peer := range p.Peers() {
 			havePeers[peer.url] = true
 		}
 		for _, peerUrl := range msg.Peers {
@@ -320,23 +1042,46 @@ func (p *PeerCore) GossipPeers() {
 }
 
 func (p *PeerCore) GetTip(peer Peer) (BlockHeader, error) {
-	msg := GetTipMessage{
-		Type: "get_tip",
-		Tip:  BlockHeader{},
-	}
-	res, err := SendMessageToPeer(peer.url, msg, &p.peerLogger)
+	var reply GetTipMessage
+	err := p.sendRequest(peer.url, "get_tip", func(requestID uint64) any {
+		return GetTipMessage{
+			Type:      "get_tip",
+			RequestID: requestID,
+			Tip:       BlockHeader{},
+		}
+	}, &reply)
 	if err != nil {
-		p.peerLogger.Printf("Failed to send block to peer: %v", err)
+		p.peerLogger.Printf("Failed to get tip from peer: %v", err)
 		return BlockHeader{}, err
 	}
 
-	// Decode reply.
-	var reply GetTipMessage
-	if err := json.Unmarshal(res, &reply); err != nil {
-		return reply.Tip, err
+	return reply.Tip, nil
+}
+
+// Gets the raw block data of blocks from a peer, skipping those it doesn't have.
+func (p *PeerCore) GetBlocks(peer Peer, blockhashes [][32]byte) ([][]byte, error) {
+	if MAX_GET_BLOCKS_HASHES < len(blockhashes) {
+		return nil, fmt.Errorf("Too many hashes requested. Max is %d", MAX_GET_BLOCKS_HASHES)
+	}
+	hashes := []string{}
+	for _, hash := range blockhashes {
+		hashes = append(hashes, fmt.Sprintf("%x", hash))
 	}
 
-	return reply.Tip, nil
+	var reply GetBlocksReply
+	err := p.sendRequest(peer.url, "get_blocks", func(requestID uint64) any {
+		return GetBlocksMessage{
+			Type:        "get_blocks",
+			RequestID:   requestID,
+			BlockHashes: hashes,
+		}
+	}, &reply)
+	if err != nil {
+		p.peerLogger.Printf("Failed to get blocks from peer: %v", err)
+		return nil, err
+	}
+
+	return reply.RawBlockDatas, nil
 }
 
 func (p *PeerCore) SyncGetTipAtDepth(peer Peer, fromBlock [32]byte, depth uint64) (BlockHeader, error) {
@@ -345,7 +1090,7 @@ func (p *PeerCore) SyncGetTipAtDepth(peer Peer, fromBlock [32]byte, depth uint64
 		FromBlock: fromBlock,
 		Depth:     depth,
 	}
-	res, err := SendMessageToPeer(peer.url, msg, &p.peerLogger)
+	res, codec, err := p.sendMessage(peer.url, msg)
 	if err != nil {
 		p.peerLogger.Printf("Failed to send message to peer: %v", err)
 		return BlockHeader{}, err
@@ -353,13 +1098,101 @@ func (p *PeerCore) SyncGetTipAtDepth(peer Peer, fromBlock [32]byte, depth uint64
 
 	// Decode reply.
 	var reply SyncGetTipAtDepthReply
-	if err := json.Unmarshal(res, &reply); err != nil {
+	if err := codec.Unmarshal(res, &reply); err != nil {
 		return reply.Tip, err
 	}
 
 	return reply.Tip, nil
 }
 
+// Gets the checkpoints of a peer's main chain. See checkpoints.go.
+func (p *PeerCore) GetCheckpoints(peer Peer, fromHeight uint64, interval uint64) ([]Checkpoint, error) {
+	msg := GetCheckpointsMessage{
+		Type:       "get_checkpoints",
+		FromHeight: fromHeight,
+		Interval:   interval,
+	}
+	res, codec, err := p.sendMessage(peer.url, msg)
+	if err != nil {
+		p.peerLogger.Printf("Failed to send message to peer: %v", err)
+		return nil, err
+	}
+
+	// Decode reply.
+	var reply GetCheckpointsReply
+	if err := codec.Unmarshal(res, &reply); err != nil {
+		return nil, err
+	}
+
+	return reply.Checkpoints, nil
+}
+
+// Gets a proof of the work of a peer's main chain. See workproof.go.
+func (p *PeerCore) GetWorkProof(peer Peer, seed [32]byte, samples int) (WorkProof, error) {
+	msg := GetWorkProofMessage{
+		Type:    "get_work_proof",
+		Seed:    seed,
+		Samples: samples,
+	}
+	res, codec, err := p.sendMessage(peer.url, msg)
+	if err != nil {
+		p.peerLogger.Printf("Failed to send message to peer: %v", err)
+		return WorkProof{}, err
+	}
+
+	// Decode reply.
+	var reply GetWorkProofReply
+	if err := codec.Unmarshal(res, &reply); err != nil {
+		return WorkProof{}, err
+	}
+
+	return reply.Proof, nil
+}
+
+// Gets a proof that a block is an ancestor of a tip on a peer's main chain. See history.go.
+func (p *PeerCore) GetAncestryProof(peer Peer, blockHash [32]byte, tipHash [32]byte) (AncestryProof, error) {
+	msg := GetAncestryProofMessage{
+		Type:      "get_ancestry_proof",
+		BlockHash: blockHash,
+		TipHash:   tipHash,
+	}
+	res, codec, err := p.sendMessage(peer.url, msg)
+	if err != nil {
+		p.peerLogger.Printf("Failed to send message to peer: %v", err)
+		return AncestryProof{}, err
+	}
+
+	// Decode reply.
+	var reply GetAncestryProofReply
+	if err := codec.Unmarshal(res, &reply); err != nil {
+		return AncestryProof{}, err
+	}
+
+	return reply.Proof, nil
+}
+
+// Gets the compact filters of blocks on a peer's main chain. See blockfilter.go.
+func (p *PeerCore) GetBlockFilters(peer Peer, fromHeight uint64, count uint64) ([]BlockFilter, error) {
+	msg := GetBlockFiltersMessage{
+		Type:       "get_block_filters",
+		FromHeight: fromHeight,
+		Count:      count,
+	}
+	res, codec, err := p.sendMessage(peer.url, msg)
+	if err != nil {
+		p.peerLogger.Printf("Failed to send message to peer: %v", err)
+		return nil, err
+	}
+
+	// Decode reply.
+	var reply GetBlockFiltersReply
+	if err := codec.Unmarshal(res, &reply); err != nil {
+		return nil, err
+	}
+
+	return reply.Filters, nil
+}
+
 func (p *PeerCore) SyncGetBlockHeaders(peer Peer, fromBlock [32]byte, heights core.Bitset) ([]BlockHeader, error) {
 	msg := SyncGetDataMessage{
 		Type:      "get_block_headers",
@@ -368,7 +1201,7 @@ func (p *PeerCore) SyncGetBlockHeaders(peer Peer, fromBlock [32]byte, heights co
 		Headers:   true,
 		Bodies:    false,
 	}
-	res, err := SendMessageToPeer(peer.url, msg, &p.peerLogger)
+	res, codec, err := p.sendMessage(peer.url, msg)
 	if err != nil {
 		p.peerLogger.Printf("Failed to send message to peer: %v", err)
 		return []BlockHeader{}, err
@@ -376,9 +1209,12 @@ func (p *PeerCore) SyncGetBlockHeaders(peer Peer, fromBlock [32]byte, heights co
 
 	// Decode reply.
 	var reply SyncGetDataReply
-	if err := json.Unmarshal(res, &reply); err != nil {
+	if err := codec.Unmarshal(res, &reply); err != nil {
 		return reply.Headers, err
 	}
+	if heights.Count() < len(reply.Headers) {
+		return []BlockHeader{}, fmt.Errorf("Peer replied with too many headers. Requested %d, got %d", heights.Count(), len(reply.Headers))
+	}
 
 	return reply.Headers, nil
 }
@@ -391,7 +1227,7 @@ func (p *PeerCore) SyncGetBlockTransactions(peer Peer, fromBlock [32]byte, heigh
 		Headers:   false,
 		Bodies:    true,
 	}
-	res, err := SendMessageToPeer(peer.url, msg, &p.peerLogger)
+	res, codec, err := p.sendMessage(peer.url, msg)
 	if err != nil {
 		p.peerLogger.Printf("Failed to send message to peer: %v", err)
 		return [][]RawTransaction{}, err
@@ -399,30 +1235,30 @@ func (p *PeerCore) SyncGetBlockTransactions(peer Peer, fromBlock [32]byte, heigh
 
 	// Decode reply.
 	var reply SyncGetDataReply
-	if err := json.Unmarshal(res, &reply); err != nil {
+	if err := codec.Unmarshal(res, &reply); err != nil {
 		return reply.Bodies, err
 	}
+	if heights.Count() < len(reply.Bodies) {
+		return [][]RawTransaction{}, fmt.Errorf("Peer replied with too many bodies. Requested %d, got %d", heights.Count(), len(reply.Bodies))
+	}
 
 	return reply.Bodies, nil
 }
 
 func (p *PeerCore) HasBlock(peer Peer, blockhash [32]byte) (bool, error) {
-	msg := HasBlockMessage{
-		Type:      "has_block",
-		BlockHash: fmt.Sprintf("%x", blockhash),
-	}
-	res, err := SendMessageToPeer(peer.url, msg, &p.peerLogger)
+	var reply HasBlockReply
+	err := p.sendRequest(peer.url, "has_block", func(requestID uint64) any {
+		return HasBlockMessage{
+			Type:      "has_block",
+			RequestID: requestID,
+			BlockHash: fmt.Sprintf("%x", blockhash),
+		}
+	}, &reply)
 	if err != nil {
-		p.peerLogger.Printf("Failed to send block to peer: %v", err)
+		p.peerLogger.Printf("Failed to ask peer for block: %v", err)
 		return false, err
 	}
 
-	// Decode reply.
-	var reply HasBlockReply
-	if err := json.Unmarshal(res, &reply); err != nil {
-		return reply.Has, err
-	}
-
 	return reply.Has, nil
 }
 
@@ -451,12 +1287,20 @@ func (p *PeerCore) Bootstrap(peerInfos []string) {
 	p.peerLogger.Println("Bootstrapping complete.")
 }
 
-func (p *PeerCore) AddPeer(peerInfo string) {
+func (p *PeerCore) AddPeer(peerInfo string) error {
 	// Check URL valid.
-	_, err := url.Parse(peerInfo)
+	peerUrl, err := url.Parse(peerInfo)
 	if err != nil {
 		p.peerLogger.Println("Failed to parse peer address: ", err)
-		return
+		return err
+	}
+
+	if p.IsBanned(peerUrl.Hostname()) {
+		p.peerLogger.Printf("AddPeer skipping banned peer %s\n", peerInfo)
+		return fmt.Errorf("Peer is banned.")
+	}
+	if p.hasPeer(peerInfo) {
+		return fmt.Errorf("Peer already added.")
 	}
 
 	peer := Peer{
@@ -467,31 +1311,384 @@ func (p *PeerCore) AddPeer(peerInfo string) {
 		clientVersion: "",
 	}
 
-	heartbeatMsg := HeartbeatMesage{
+	if p.isOwnAddr(peer.url) {
+		// Skip self.
+		p.peerLogger.Printf("AddPeer found peerInfo corresponding to our peer. Skipping.\n")
+		return fmt.Errorf("Peer is ourselves.")
+	}
+	p.addKnownPeer(peerInfo)
+	if p.MaxPeers <= len(p.Peers()) {
+		return fmt.Errorf("Max peers reached.")
+	}
+
+	// Send heartbeat message to peer.
+	reply, rtt, err := p.sendHeartbeat(peer.url)
+	if err != nil {
+		p.peerLogger.Printf("Failed to send heartbeat to peer: %v", err)
+		return err
+	}
+	peer.lastSeen = uint64(time.Now().Unix())
+	peer.clientVersion = reply.ClientVersion
+	peer.services = reply.Services
+	peerTransport.setQuicSupport(peer.url, reply.NodeID, reply.Services&NODE_SERVICE_QUIC != 0)
+	peer.txFilter = parseTxFilter(reply)
+	peer.encoding = NegotiateWireEncoding(reply.Encodings)
+	peer.compression = NegotiateWireCompression(reply.Compressions)
+	peer.recordHeartbeat(reply, time.Now())
+	peer.recordLatency(rtt)
+	peer.nodeID = reply.NodeID
+	peer.addresses = parseClientAddresses(reply)
+	p.dhtObserve(DHTContact{NodeID: reply.NodeID, URL: peer.url})
+
+	p.peerLogger.Println("Peer is alive, adding to peer list")
+
+	// Add peer to list.
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+	if p.MaxPeers <= len(p.peers) {
+		return fmt.Errorf("Max peers reached.")
+	}
+	// Dual-stack peers can be reached at several addresses, but are only connected to once.
+	for _, other := range p.peers {
+		if peer.nodeID != "" && other.nodeID == peer.nodeID {
+			return fmt.Errorf("Peer already added at %s.", other.url)
+		}
+	}
+	peer.connectedAt = time.Now()
+	p.peers = append(p.peers, peer)
+	return nil
+}
+
+// Records a peer address we have learnt of, for the connection manager to dial.
+func (p *PeerCore) addKnownPeer(peerInfo string) {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	if p.knownPeers == nil {
+		p.knownPeers = make(map[string]time.Time)
+	}
+	if _, ok := p.knownPeers[peerInfo]; !ok {
+		p.knownPeers[peerInfo] = time.Time{}
+	}
+}
+
+// Removes a peer from the peer list.
+func (p *PeerCore) RemovePeer(peerInfo string) error {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	for i, peer := range p.peers {
+		if peer.url == peerInfo {
+			p.peers = append(p.peers[:i], p.peers[i+1:]...)
+			delete(p.knownPeers, peerInfo)
+			peerTransport.closePeer(peerInfo)
+			p.peerLogger.Printf("Removed peer %s\n", peerInfo)
+			return nil
+		}
+	}
+	return fmt.Errorf("Peer not found.")
+}
+
+// Returns a snapshot of the peer list.
+func (p *PeerCore) Peers() []Peer {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	peers := make([]Peer, len(p.peers))
+	for i, peer := range p.peers {
+		peers[i] = peer
+		peers[i].messageStats = make(map[string]PeerMessageStats)
+		for k, v := range peer.messageStats {
+			peers[i].messageStats[k] = v
+		}
+		peers[i].inFlight = make(map[string]int)
+		for k, v := range peer.inFlight {
+			peers[i].inFlight[k] = v
+		}
+		peers[i].requests = make(map[uint64]peerRequest)
+		for k, v := range peer.requests {
+			peers[i].requests[k] = v
+		}
+		peers[i].requestStats = make(map[string]PeerRequestStats)
+		for k, v := range peer.requestStats {
+			peers[i].requestStats[k] = v
+		}
+	}
+	return peers
+}
+
+// Returns the estimated offsets of the peers' clocks from ours, for peers which have replied to a heartbeat.
+func (p *PeerCore) PeerTimeOffsets() []time.Duration {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	offsets := []time.Duration{}
+	for _, peer := range p.peers {
+		if peer.timeOffsetKnown {
+			offsets = append(offsets, peer.timeOffset)
+		}
+	}
+	return offsets
+}
+
+func (p *PeerCore) hasPeer(peerInfo string) bool {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	for _, peer := range p.peers {
+		if peer.url == peerInfo {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *PeerCore) updatePeer(peerInfo string, update func(peer *Peer)) {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	for i := range p.peers {
+		if p.peers[i].url == peerInfo {
+			update(&p.peers[i])
+			return
+		}
+	}
+}
+
+// Bans a peer's host for a duration, disconnecting it. A zero duration bans the host permanently.
+// Banned hosts are not added as peers, and their messages are rejected by our peer server.
+func (p *PeerCore) BanPeer(peerInfo string, duration time.Duration) error {
+	peerUrl, err := url.Parse(peerInfo)
+	if err != nil || peerUrl.Hostname() == "" {
+		return fmt.Errorf("Invalid peer address: %s", peerInfo)
+	}
+	p.banHost(peerUrl.Hostname(), duration)
+	return nil
+}
+
+// Penalises a host for misbehaving, banning it once its score reaches MISBEHAVIOUR_BAN_SCORE.
+func (p *PeerCore) Misbehaving(host string, score int, reason string) {
+	p.peersMutex.Lock()
+	if p.misbehaviourScores == nil {
+		p.misbehaviourScores = make(map[string]int)
+	}
+	p.misbehaviourScores[host] += score
+	total := p.misbehaviourScores[host]
+	if MISBEHAVIOUR_BAN_SCORE <= total {
+		delete(p.misbehaviourScores, host)
+	}
+	p.peersMutex.Unlock()
+
+	p.peerLogger.Printf("Host %s misbehaved (score %d, total %d): %s\n", host, score, total, reason)
+	if MISBEHAVIOUR_BAN_SCORE <= total {
+		p.banHost(host, MISBEHAVIOUR_BAN_DURATION)
+	}
+}
+
+// Bans a host and disconnects all peers on it.
+func (p *PeerCore) banHost(host string, duration time.Duration) {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	until := time.Time{}
+	if duration != 0 {
+		until = time.Now().Add(duration)
+	}
+	p.bannedHosts[host] = until
+	p.peerLogger.Printf("Banned host %s until %s\n", host, until)
+
+	// Disconnect all peers on the host.
+	peers := []Peer{}
+	for _, peer := range p.peers {
+		if u, err := url.Parse(peer.url); err == nil && u.Hostname() == host {
+			peerTransport.closePeer(peer.url)
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	p.peers = peers
+}
+
+// Lifts a ban on a peer's host.
+func (p *PeerCore) UnbanPeer(peerInfo string) error {
+	host := peerInfo
+	if peerUrl, err := url.Parse(peerInfo); err == nil && peerUrl.Hostname() != "" {
+		host = peerUrl.Hostname()
+	}
+
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	if _, ok := p.bannedHosts[host]; !ok {
+		return fmt.Errorf("Host is not banned: %s", host)
+	}
+	delete(p.bannedHosts, host)
+	p.peerLogger.Printf("Unbanned host %s\n", host)
+	return nil
+}
+
+// Returns the banned hosts, mapped to the time their ban expires.
+// Returns the misbehaviour score of a host, which is reset when it's banned.
+func (p *PeerCore) MisbehaviourScore(host string) int {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+	return p.misbehaviourScores[host]
+}
+
+func (p *PeerCore) BannedHosts() map[string]time.Time {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	bans := make(map[string]time.Time)
+	now := time.Now()
+	for host, until := range p.bannedHosts {
+		if until.IsZero() || now.Before(until) {
+			bans[host] = until
+		}
+	}
+	return bans
+}
+
+func (p *PeerCore) IsBanned(host string) bool {
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	until, ok := p.bannedHosts[host]
+	if !ok {
+		return false
+	}
+	if !until.IsZero() && time.Now().After(until) {
+		// Ban expired.
+		delete(p.bannedHosts, host)
+		return false
+	}
+	return true
+}
+
+// Returns the transaction filter of a peer's heartbeat. Invalid filters are ignored, and all transactions are relayed.
+func parseTxFilter(msg HeartbeatMesage) *BloomFilter {
+	if msg.TxFilter == nil || msg.TxFilter.Validate() != nil {
+		return nil
+	}
+	return msg.TxFilter
+}
+
+// Returns the services we advertise to peers.
+func (p *PeerCore) Services() uint64 {
+	services := uint64(0)
+	if !p.BlocksOnly {
+		services |= NODE_SERVICE_TX_RELAY
+	}
+	if p.OnGetBlockFilters != nil {
+		services |= NODE_SERVICE_BLOCK_FILTERS
+	}
+	if p.server != nil && p.server.acceptsQuic() {
+		services |= NODE_SERVICE_QUIC
+	}
+	return services
+}
+
+func (p *PeerCore) newHeartbeat() HeartbeatMesage {
+	msg := HeartbeatMesage{
 		Type:                "heartbeat",
 		TipHash:             "",
 		TipHeight:           0,
 		ClientVersion:       CLIENT_VERSION,
 		WireProtocolVersion: WIRE_PROTOCOL_VERSION,
 		ClientAddress:       p.GetExternalAddr(),
+		ClientAddresses:     p.GetExternalAddrs(),
+		NodeID:              p.NodeID(),
+		TxFilter:            p.TxFilter,
 		Time:                time.Now(),
+		Services:            p.Services(),
+		Encodings:           SUPPORTED_WIRE_ENCODINGS,
+		Compressions:        SUPPORTED_WIRE_COMPRESSIONS,
 	}
+	if p.OnGetFullTip != nil {
+		hash, height := p.OnGetFullTip()
+		msg.TipHash = Bytes32ToHexString(hash)
+		msg.TipHeight = int(height)
+	}
+	return msg
+}
 
-	if peer.url == p.GetExternalAddr() || peer.url == p.GetLocalAddr() {
-		// Skip self.
-		p.peerLogger.Printf("AddPeer found peerInfo corresponding to our peer. Skipping.\n")
-		return
+// Sends a heartbeat to a peer, returning their reply and the round-trip time.
+// Heartbeats are always encoded as uncompressed JSON, as they are used to negotiate the wire encoding.
+func (p *PeerCore) sendHeartbeat(peerUrl string) (HeartbeatMesage, time.Duration, error) {
+	msg := p.newHeartbeat()
+	codec := wireCodecs[WIRE_ENCODING_JSON]
+	res, err := p.sendMessageWithCodec(peerUrl, msg, codec, "")
+	if err != nil {
+		return HeartbeatMesage{}, 0, err
 	}
+	rtt := time.Since(msg.Time)
 
-	// Send heartbeat message to peer.
-	_, err = SendMessageToPeer(peer.url, heartbeatMsg, &p.peerLogger)
+	// Peers reply with their own heartbeat, echoing our time.
+	var reply HeartbeatMesage
+	if err := codec.Unmarshal(res, &reply); err != nil {
+		return HeartbeatMesage{}, 0, err
+	}
+	if reply.EchoTime.Equal(msg.Time) {
+		rtt = time.Since(reply.EchoTime)
+	}
+
+	return reply, rtt, nil
+}
+
+// Sends a message to a peer using the wire encoding and compression negotiated with them. Returns the reply, and the
+// codec to decode it with.
+func (p *PeerCore) sendMessage(peerUrl string, message any) ([]byte, WireCodec, error) {
+	encoding := WIRE_ENCODING_JSON
+	compression := ""
+	for _, peer := range p.Peers() {
+		if peer.url == peerUrl {
+			if peer.encoding != "" {
+				encoding = peer.encoding
+			}
+			compression = peer.compression
+		}
+	}
+	codec, err := GetWireCodec(encoding)
 	if err != nil {
-		p.peerLogger.Printf("Failed to send heartbeat to peer: %v", err)
-		return
+		return nil, nil, err
 	}
 
-	p.peerLogger.Println("Peer is alive, adding to peer list")
+	res, err := p.sendMessageWithCodec(peerUrl, message, codec, compression)
+	return res, codec, err
+}
 
-	// Add peer to list.
-	p.peers = append(p.peers, peer)
+// Sends a message to a peer, accounting for the messages and bytes sent and received.
+func (p *PeerCore) sendMessageWithCodec(peerUrl string, message any, codec WireCodec, compression string) ([]byte, error) {
+	messageBytes, err := codec.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal message: %v", err)
+	}
+	var networkMsg NetworkMessage
+	codec.Unmarshal(messageBytes, &networkMsg)
+	p.updatePeer(peerUrl, func(peer *Peer) {
+		peer.recordInFlight(networkMsg.Type, 1)
+	})
+
+	res, wireSize, signer, err := sendSignedMessageToPeer(peerUrl, messageBytes, codec, compression, p.GetExternalAddr(), p.identity, &p.peerLogger)
+	if err == nil {
+		// Replies declaring a node ID must be signed by it.
+		var reply NetworkMessage
+		if codec.Unmarshal(res, &reply) == nil && reply.NodeID != "" && reply.NodeID != signer {
+			err = fmt.Errorf("reply node ID doesn't match its signature")
+		}
+	}
+	p.updatePeer(peerUrl, func(peer *Peer) {
+		stats := PeerMessageStats{MessagesSent: 1, BytesSent: uint64(len(messageBytes))}
+		if err == nil {
+			stats.BytesReceived = uint64(wireSize)
+			peer.lastSeen = uint64(time.Now().Unix())
+		}
+		var busy *PeerBusyError
+		if errors.As(err, &busy) {
+			peer.busyUntil = time.Now().Add(busy.RetryAfter)
+		}
+		peer.recordMessage(networkMsg.Type, stats)
+		peer.recordInFlight(networkMsg.Type, -1)
+	})
+	return res, err
 }
@@ -0,0 +1,536 @@
+package nakamoto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peers are discovered through a Kademlia-style distributed hash table (DHT) keyed by node ID, so a node can find peers
+// across the network from any one of them, rather than relying on its bootstrap list and the peers its peers gossip.
+//
+// Each node has a key, the SHA256 hash of its node ID, and the distance between two nodes is the XOR of their keys. A
+// node keeps a routing table of contacts (node ID and address) in 256 buckets, where bucket i holds up to DHT_K contacts
+// whose distance from us has i leading zero bits - so it knows many nodes near it, and a few far away. A node looks up
+// a key iteratively: it asks the DHT_ALPHA closest contacts it knows of for their closest contacts to the key, then
+// asks the closest of those, and so on, until the closest DHT_K contacts it has heard of have all replied.
+//
+// Contacts are only added to the routing table once they've replied to us from their address, signed by their node ID,
+// so a node can't fill our table with addresses it doesn't control. Buckets prefer long-lived contacts: when a bucket is
+// full, the least recently seen contact is pinged, and only replaced if it doesn't reply.
+//
+// Periodically, the node looks up its own key, which finds the nodes near it, and refreshes buckets which haven't been
+// looked up in an hour by looking up a random key in them. The contacts found are dialed by the connection manager. The
+// routing table is saved to a file, so a restarted node can rejoin the network without its bootstrap peers.
+
+const (
+	// The size of a bucket, and the number of contacts a lookup returns.
+	DHT_K = 20
+	// The number of contacts queried at once in a lookup.
+	DHT_ALPHA = 3
+	// The number of buckets, one for each bit of a key.
+	DHT_BUCKETS = 256
+	// Buckets which haven't been looked up for this long are refreshed.
+	DHT_BUCKET_REFRESH_AGE = 1 * time.Hour
+)
+
+// A node in the DHT.
+type DHTContact struct {
+	NodeID string `json:"nodeId"`
+	URL    string `json:"url"`
+}
+
+// dht_find_node
+type DHTFindNodeMessage struct {
+	Type string `json:"type"` // "dht_find_node"
+	// The hex-encoded key to find the closest contacts to.
+	Target string `json:"target"`
+	// The sender's node ID and address, so the receiver can add it to its routing table.
+	NodeID  string `json:"nodeId,omitempty"`
+	Address string `json:"address"`
+}
+
+type DHTFindNodeReply struct {
+	Type     string       `json:"type"` // "dht_find_node_reply"
+	NodeID   string       `json:"nodeId,omitempty"`
+	Contacts []DHTContact `json:"contacts"`
+}
+
+// Returns the DHT key of a node ID.
+func dhtKey(nodeID string) ([32]byte, error) {
+	if err := validateNodeID(nodeID); err != nil {
+		return [32]byte{}, err
+	}
+	pubkey, _ := hex.DecodeString(nodeID)
+	return sha256.Sum256(pubkey), nil
+}
+
+func dhtDistance(a [32]byte, b [32]byte) [32]byte {
+	d := [32]byte{}
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// Returns the number of leading zero bits of a distance, which is the index of its bucket.
+func dhtLeadingZeros(d [32]byte) int {
+	for i, b := range d {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return DHT_BUCKETS
+}
+
+// Returns a random key in a bucket, ie. whose distance from self has i leading zero bits.
+func dhtRandomKeyInBucket(self [32]byte, i int) [32]byte {
+	d := [32]byte{}
+	rand.Read(d[:])
+	for j := 0; j < i; j++ {
+		d[j/8] &^= 0x80 >> (j % 8)
+	}
+	d[i/8] |= 0x80 >> (i % 8)
+	return dhtDistance(self, d)
+}
+
+// The routing table.
+// =====================================================================================================================
+
+type dhtEntry struct {
+	contact DHTContact
+	key     [32]byte
+}
+
+// The contacts we know of, bucketed by their distance from us.
+type RoutingTable struct {
+	self [32]byte
+	// Each bucket is ordered from least to most recently seen.
+	buckets     [DHT_BUCKETS][]dhtEntry
+	refreshedAt [DHT_BUCKETS]time.Time
+	mutex       sync.Mutex
+}
+
+func NewRoutingTable(selfNodeID string) (*RoutingTable, error) {
+	self, err := dhtKey(selfNodeID)
+	if err != nil {
+		return nil, err
+	}
+	return &RoutingTable{self: self}, nil
+}
+
+// Returns the bucket index of a key, or -1 for our own key.
+func (t *RoutingTable) bucketIndex(key [32]byte) int {
+	i := dhtLeadingZeros(dhtDistance(t.self, key))
+	if i == DHT_BUCKETS {
+		return -1
+	}
+	return i
+}
+
+// Records that we've heard from a contact, moving it to the end of its bucket. If the bucket is full, the contact
+// isn't added, and the least recently seen contact in the bucket is returned, which should be pinged and removed if it
+// doesn't reply.
+func (t *RoutingTable) Update(contact DHTContact) (*DHTContact, error) {
+	key, err := dhtKey(contact.NodeID)
+	if err != nil {
+		return nil, err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	i := t.bucketIndex(key)
+	if i < 0 {
+		return nil, fmt.Errorf("Contact is ourselves.")
+	}
+	bucket := t.buckets[i]
+	for j, entry := range bucket {
+		if entry.contact.NodeID == contact.NodeID {
+			bucket = append(bucket[:j], bucket[j+1:]...)
+			t.buckets[i] = append(bucket, dhtEntry{contact, key})
+			return nil, nil
+		}
+	}
+	if DHT_K <= len(bucket) {
+		oldest := bucket[0].contact
+		return &oldest, nil
+	}
+	t.buckets[i] = append(bucket, dhtEntry{contact, key})
+	return nil, nil
+}
+
+// Removes a contact.
+func (t *RoutingTable) Remove(nodeID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for i, bucket := range t.buckets {
+		for j, entry := range bucket {
+			if entry.contact.NodeID == nodeID {
+				t.buckets[i] = append(bucket[:j:j], bucket[j+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Returns whether a contact is in the table.
+func (t *RoutingTable) Has(nodeID string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, bucket := range t.buckets {
+		for _, entry := range bucket {
+			if entry.contact.NodeID == nodeID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns up to n contacts closest to a key, closest first.
+func (t *RoutingTable) Closest(target [32]byte, n int) []DHTContact {
+	t.mutex.Lock()
+	entries := []dhtEntry{}
+	for _, bucket := range t.buckets {
+		entries = append(entries, bucket...)
+	}
+	t.mutex.Unlock()
+
+	sortByDistance(entries, target)
+	contacts := []DHTContact{}
+	for i := 0; i < len(entries) && i < n; i++ {
+		contacts = append(contacts, entries[i].contact)
+	}
+	return contacts
+}
+
+// Returns all the contacts in the table.
+func (t *RoutingTable) Contacts() []DHTContact {
+	return t.Closest(t.self, DHT_BUCKETS*DHT_K)
+}
+
+// Records that a key has been looked up, which refreshes its bucket.
+func (t *RoutingTable) markRefreshed(key [32]byte, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if i := t.bucketIndex(key); 0 <= i {
+		t.refreshedAt[i] = now
+	}
+}
+
+// Returns the indexes of the non-empty buckets which haven't been looked up since the given time.
+func (t *RoutingTable) staleBuckets(since time.Time) []int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stale := []int{}
+	for i, bucket := range t.buckets {
+		if 0 < len(bucket) && t.refreshedAt[i].Before(since) {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// Saves the contacts to a file.
+func (t *RoutingTable) Save(path string) error {
+	data, err := json.Marshal(t.Contacts())
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// Loads contacts saved to a file, if it exists, returning them.
+func (t *RoutingTable) Load(path string) ([]DHTContact, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return []DHTContact{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	contacts := []DHTContact{}
+	if err := json.Unmarshal(data, &contacts); err != nil {
+		return nil, fmt.Errorf("Failed to load routing table from %s: %s", path, err)
+	}
+	loaded := []DHTContact{}
+	for _, contact := range contacts {
+		if evict, err := t.Update(contact); err == nil && evict == nil {
+			loaded = append(loaded, contact)
+		}
+	}
+	return loaded, nil
+}
+
+func sortByDistance(entries []dhtEntry, target [32]byte) {
+	sort.Slice(entries, func(i, j int) bool {
+		di, dj := dhtDistance(entries[i].key, target), dhtDistance(entries[j].key, target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
+
+// The peer.
+// =====================================================================================================================
+
+// Handles a dht_find_node message, replying with the closest contacts we know of to the target.
+func (p *PeerCore) handleDHTFindNode(message []byte, codec WireCodec) (interface{}, error) {
+	var msg DHTFindNodeMessage
+	if err := codec.Unmarshal(message, &msg); err != nil {
+		return nil, err
+	}
+	reply := DHTFindNodeReply{Type: "dht_find_node_reply", NodeID: p.NodeID(), Contacts: []DHTContact{}}
+
+	// Private networks don't share their peers.
+	if p.PrivateNetwork || p.routingTable == nil {
+		return reply, nil
+	}
+	target, err := parseDHTKey(msg.Target)
+	if err != nil {
+		return nil, err
+	}
+	reply.Contacts = p.routingTable.Closest(target, DHT_K)
+
+	// The sender's address isn't verified by the message, so check it replies from there before adding it.
+	if msg.NodeID != "" && msg.Address != "" && !p.routingTable.Has(msg.NodeID) {
+		go p.dhtVerifyContact(DHTContact{NodeID: msg.NodeID, URL: msg.Address})
+	}
+	return reply, nil
+}
+
+func parseDHTKey(s string) ([32]byte, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil || len(buf) != 32 {
+		return [32]byte{}, fmt.Errorf("Invalid DHT key.")
+	}
+	key := [32]byte{}
+	copy(key[:], buf)
+	return key, nil
+}
+
+// Asks a node for the closest contacts it knows of to the target. Returns the contacts, and the node ID which signed
+// the reply.
+func (p *PeerCore) DHTFindNode(peerUrl string, target [32]byte) ([]DHTContact, string, error) {
+	msg := DHTFindNodeMessage{
+		Type:    "dht_find_node",
+		Target:  hex.EncodeToString(target[:]),
+		NodeID:  p.NodeID(),
+		Address: p.GetExternalAddr(),
+	}
+	res, codec, err := p.sendMessage(peerUrl, msg)
+	if err != nil {
+		return nil, "", err
+	}
+	var reply DHTFindNodeReply
+	if err := codec.Unmarshal(res, &reply); err != nil {
+		return nil, "", err
+	}
+	// The reply's node ID is checked against its signature when it's received.
+	if reply.NodeID == "" {
+		return nil, "", fmt.Errorf("DHT reply isn't signed.")
+	}
+	if DHT_K < len(reply.Contacts) {
+		return nil, "", fmt.Errorf("Too many contacts. Max is %d", DHT_K)
+	}
+	return reply.Contacts, reply.NodeID, nil
+}
+
+// Pings a contact, returning whether it replied from its address, signed by its node ID.
+func (p *PeerCore) dhtPing(contact DHTContact) bool {
+	_, nodeID, err := p.DHTFindNode(contact.URL, p.routingTable.self)
+	return err == nil && nodeID == contact.NodeID
+}
+
+// Records that we've heard from a contact at its address. If its bucket is full, the least recently seen contact is
+// pinged, and replaced by the new contact if it doesn't reply.
+func (p *PeerCore) dhtObserve(contact DHTContact) {
+	if p.routingTable == nil || contact.NodeID == "" {
+		return
+	}
+	evict, err := p.routingTable.Update(contact)
+	if err != nil || evict == nil {
+		return
+	}
+	go func() {
+		if p.dhtPing(*evict) {
+			p.routingTable.Update(*evict)
+			return
+		}
+		p.routingTable.Remove(evict.NodeID)
+		p.routingTable.Update(contact)
+	}()
+}
+
+// Adds a contact which messaged us, once it replies from its address.
+func (p *PeerCore) dhtVerifyContact(contact DHTContact) {
+	if !p.isValidDHTContact(contact) || !p.dhtPing(contact) {
+		return
+	}
+	p.dhtObserve(contact)
+}
+
+// Checks a contact from another node is worth querying: its node ID is valid, and its address isn't ours or banned.
+func (p *PeerCore) isValidDHTContact(contact DHTContact) bool {
+	if validateNodeID(contact.NodeID) != nil || contact.NodeID == p.NodeID() {
+		return false
+	}
+	u, err := url.Parse(contact.URL)
+	if err != nil || u.Hostname() == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	if p.isOwnAddr(contact.URL) {
+		return false
+	}
+	return !p.IsBanned(u.Hostname())
+}
+
+// Looks up the DHT_K closest nodes to a key, which have replied to us.
+func (p *PeerCore) DHTLookup(target [32]byte) []DHTContact {
+	if p.routingTable == nil {
+		return []DHTContact{}
+	}
+	p.routingTable.markRefreshed(target, time.Now())
+
+	type candidate struct {
+		entry     dhtEntry
+		queried   bool
+		responded bool
+	}
+	candidates := map[string]*candidate{}
+	add := func(contact DHTContact) {
+		if _, ok := candidates[contact.NodeID]; ok || !p.isValidDHTContact(contact) {
+			return
+		}
+		key, _ := dhtKey(contact.NodeID)
+		candidates[contact.NodeID] = &candidate{entry: dhtEntry{contact, key}}
+	}
+	for _, contact := range p.routingTable.Closest(target, DHT_K) {
+		add(contact)
+	}
+
+	// Returns the closest candidates which haven't failed, closest first.
+	closest := func() []*candidate {
+		entries := []dhtEntry{}
+		for _, c := range candidates {
+			if !c.queried || c.responded {
+				entries = append(entries, c.entry)
+			}
+		}
+		sortByDistance(entries, target)
+		res := []*candidate{}
+		for i := 0; i < len(entries) && i < DHT_K; i++ {
+			res = append(res, candidates[entries[i].contact.NodeID])
+		}
+		return res
+	}
+
+	type result struct {
+		c        *candidate
+		contacts []DHTContact
+		ok       bool
+	}
+	for {
+		// Query the closest candidates which haven't been queried.
+		batch := []*candidate{}
+		for _, c := range closest() {
+			if !c.queried && len(batch) < DHT_ALPHA {
+				c.queried = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		results := make(chan result, len(batch))
+		for _, c := range batch {
+			go func(c *candidate) {
+				contacts, nodeID, err := p.DHTFindNode(c.entry.contact.URL, target)
+				results <- result{c, contacts, err == nil && nodeID == c.entry.contact.NodeID}
+			}(c)
+		}
+		for range batch {
+			r := <-results
+			if !r.ok {
+				p.routingTable.Remove(r.c.entry.contact.NodeID)
+				continue
+			}
+			r.c.responded = true
+			p.dhtObserve(r.c.entry.contact)
+			for _, contact := range r.contacts {
+				add(contact)
+			}
+		}
+	}
+
+	found := []DHTContact{}
+	for _, c := range closest() {
+		if c.responded {
+			found = append(found, c.entry.contact)
+		}
+	}
+	return found
+}
+
+// Looks up our own key and refreshes stale buckets, recording the nodes found for the connection manager to dial, and
+// saves the routing table.
+func (p *PeerCore) RefreshDHT() {
+	if p.routingTable == nil {
+		return
+	}
+	now := time.Now()
+	targets := [][32]byte{p.routingTable.self}
+	for _, i := range p.routingTable.staleBuckets(now.Add(-DHT_BUCKET_REFRESH_AGE)) {
+		targets = append(targets, dhtRandomKeyInBucket(p.routingTable.self, i))
+	}
+
+	found := 0
+	for _, target := range targets {
+		for _, contact := range p.DHTLookup(target) {
+			p.addKnownPeer(contact.URL)
+			found++
+		}
+	}
+	p.peerLogger.Printf("DHT refresh looked up %d keys, found %d nodes\n", len(targets), found)
+
+	if p.routingTablePath != "" {
+		if err := p.routingTable.Save(p.routingTablePath); err != nil {
+			p.peerLogger.Printf("Failed to save routing table: %s\n", err)
+		}
+	}
+}
+
+func (p *PeerCore) dhtRoutine() {
+	for {
+		time.Sleep(time.Duration(p.DHTRefreshIntervalSeconds) * time.Second)
+		p.RefreshDHT()
+	}
+}
+
+// Loads the routing table saved to a file, and saves it there as it's refreshed. The contacts loaded are dialed by the
+// connection manager.
+func (p *PeerCore) LoadRoutingTable(path string) error {
+	if p.routingTable == nil {
+		return fmt.Errorf("Node has no identity.")
+	}
+	contacts, err := p.routingTable.Load(path)
+	if err != nil {
+		return err
+	}
+	for _, contact := range contacts {
+		p.addKnownPeer(contact.URL)
+	}
+	p.routingTablePath = path
+	return nil
+}
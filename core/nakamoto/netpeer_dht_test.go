@@ -0,0 +1,179 @@
+package nakamoto
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func newDHTContact(t *testing.T) DHTContact {
+	wallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return DHTContact{NodeID: NodeID(wallet), URL: "http://127.0.0.1:9000"}
+}
+
+// Creates a peer serving DHT messages over HTTP.
+func newDHTTestPeer(t *testing.T) (*PeerCore, *httptest.Server) {
+	server := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	p := &PeerCore{
+		server:                    server,
+		knownPeers:                make(map[string]time.Time),
+		bannedHosts:               make(map[string]time.Time),
+		DHTRefreshIntervalSeconds: 1,
+		peerLogger:                *NewLogger("peer", "test"),
+	}
+	identity, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetIdentity(identity)
+	server.RegisterMesageHandler("dht_find_node", p.handleDHTFindNode)
+
+	ts := httptest.NewServer(server.server.Handler)
+	u, _ := url.Parse(ts.URL)
+	p.externalIp = u.Hostname()
+	p.externalPort = u.Port()
+	return p, ts
+}
+
+func TestRoutingTable(t *testing.T) {
+	assert := assert.New(t)
+
+	self := newDHTContact(t)
+	table, err := NewRoutingTable(self.NodeID)
+	assert.Nil(err)
+
+	_, err = table.Update(self)
+	assert.NotNil(err)
+	_, err = table.Update(DHTContact{NodeID: "00", URL: "http://127.0.0.1:9000"})
+	assert.NotNil(err)
+
+	// Fill the furthest bucket, which holds half the keyspace.
+	bucket := []DHTContact{}
+	for len(bucket) < DHT_K+1 {
+		contact := newDHTContact(t)
+		key, _ := dhtKey(contact.NodeID)
+		if table.bucketIndex(key) == 0 {
+			bucket = append(bucket, contact)
+		}
+	}
+	for _, contact := range bucket[:DHT_K] {
+		evict, err := table.Update(contact)
+		assert.Nil(err)
+		assert.Nil(evict)
+	}
+
+	// A full bucket returns its least recently seen contact, rather than adding the new one.
+	evict, err := table.Update(bucket[DHT_K])
+	assert.Nil(err)
+	assert.Equal(bucket[0], *evict)
+	assert.False(table.Has(bucket[DHT_K].NodeID))
+
+	// Seeing a contact again moves it to the end of its bucket.
+	_, err = table.Update(bucket[0])
+	assert.Nil(err)
+	evict, _ = table.Update(bucket[DHT_K])
+	assert.Equal(bucket[1], *evict)
+
+	table.Remove(bucket[1].NodeID)
+	assert.False(table.Has(bucket[1].NodeID))
+	evict, _ = table.Update(bucket[DHT_K])
+	assert.Nil(evict)
+	assert.True(table.Has(bucket[DHT_K].NodeID))
+
+	// Contacts are returned closest first.
+	target, _ := dhtKey(bucket[5].NodeID)
+	closest := table.Closest(target, 3)
+	assert.Len(closest, 3)
+	assert.Equal(bucket[5], closest[0])
+	for i := 1; i < len(closest); i++ {
+		a, _ := dhtKey(closest[i-1].NodeID)
+		b, _ := dhtKey(closest[i].NodeID)
+		da, db := dhtDistance(a, target), dhtDistance(b, target)
+		assert.True(string(da[:]) < string(db[:]))
+	}
+
+	// Random keys fall in the requested bucket.
+	for _, i := range []int{0, 7, 8, 100, 255} {
+		assert.Equal(i, table.bucketIndex(dhtRandomKeyInBucket(table.self, i)))
+	}
+
+	// Buckets are stale until they're looked up.
+	assert.Equal([]int{0}, table.staleBuckets(time.Now()))
+	table.markRefreshed(target, time.Now())
+	assert.Equal([]int{}, table.staleBuckets(time.Now().Add(-time.Minute)))
+
+	// The table is saved and loaded.
+	path := filepath.Join(t.TempDir(), "dht")
+	assert.Nil(table.Save(path))
+	loaded, _ := NewRoutingTable(self.NodeID)
+	contacts, err := loaded.Load(path)
+	assert.Nil(err)
+	assert.ElementsMatch(table.Contacts(), contacts)
+	assert.ElementsMatch(table.Contacts(), loaded.Contacts())
+
+	contacts, err = loaded.Load(filepath.Join(t.TempDir(), "missing"))
+	assert.Nil(err)
+	assert.Len(contacts, 0)
+}
+
+func TestDHTLookup(t *testing.T) {
+	assert := assert.New(t)
+
+	// A line of nodes, where each only knows the next.
+	nodes := []*PeerCore{}
+	for i := 0; i < 8; i++ {
+		p, ts := newDHTTestPeer(t)
+		defer ts.Close()
+		nodes = append(nodes, p)
+	}
+	for i := 0; i < len(nodes)-1; i++ {
+		nodes[i].dhtObserve(DHTContact{NodeID: nodes[i+1].NodeID(), URL: nodes[i+1].GetExternalAddr()})
+	}
+
+	// A contact whose address is another node's isn't verified, and is dropped.
+	forged := newDHTContact(t)
+	forged.URL = nodes[1].GetExternalAddr()
+	nodes[0].dhtObserve(forged)
+	assert.True(nodes[0].routingTable.Has(forged.NodeID))
+
+	// The first node finds the last, by iteratively querying the nodes between.
+	target, _ := dhtKey(nodes[7].NodeID())
+	found := nodes[0].DHTLookup(target)
+	assert.Len(found, 7)
+	assert.Equal(DHTContact{NodeID: nodes[7].NodeID(), URL: nodes[7].GetExternalAddr()}, found[0])
+	assert.False(nodes[0].routingTable.Has(forged.NodeID))
+	assert.True(nodes[0].routingTable.Has(nodes[7].NodeID()))
+
+	// The nodes queried add the first node, once it replies from its address.
+	assert.Eventually(func() bool {
+		return nodes[7].routingTable.Has(nodes[0].NodeID())
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Refreshing records the nodes found for the connection manager, and saves the table.
+	path := filepath.Join(t.TempDir(), "dht")
+	assert.Nil(nodes[0].LoadRoutingTable(path))
+	nodes[0].RefreshDHT()
+	for _, node := range nodes[1:] {
+		_, ok := nodes[0].knownPeers[node.GetExternalAddr()]
+		assert.True(ok)
+	}
+	table, _ := NewRoutingTable(nodes[0].NodeID())
+	contacts, err := table.Load(path)
+	assert.Nil(err)
+	assert.Len(contacts, 7)
+
+	// Private networks don't share their contacts.
+	nodes[1].PrivateNetwork = true
+	contacts, nodeID, err := nodes[0].DHTFindNode(nodes[1].GetExternalAddr(), target)
+	assert.Nil(err)
+	assert.Equal(nodes[1].NodeID(), nodeID)
+	assert.Len(contacts, 0)
+}
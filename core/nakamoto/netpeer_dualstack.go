@@ -0,0 +1,195 @@
+package nakamoto
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Nodes listen dual-stack, on both IPv4 and IPv6, and may be reachable at an external address in each family. A node
+// advertises all of its addresses in its heartbeats, as ClientAddresses, and the addresses of its peers when gossiping,
+// so peers in either family can reach it. ClientAddress remains the node's primary address - its IPv4 address if it
+// has one - which it is known by to peers which don't read ClientAddresses.
+//
+// When dialing, a node prefers addresses in the families it has connectivity in, ie. has an external address in, and
+// IPv6 over IPv4 when it has both, since IPv6 addresses are rarely behind NAT. Addresses in other families are only
+// dialed when there's nothing better. Hostnames are resolved by the dialer, which races both families. A node reachable
+// at several addresses is only connected to once, recognised by its node ID.
+//
+// Our external addresses are discovered over STUN, unless the operator configures them, ie. when the node is behind a
+// load balancer or has a static IP. See PeerConfig.ExternalAddrs.
+
+const (
+	// The maximum number of addresses a node can advertise in its heartbeat.
+	MAX_CLIENT_ADDRESSES = 4
+)
+
+// Returns the address family of a host, "ipv4" or "ipv6", or "" for a hostname.
+func addrFamily(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// Formats the URL of a peer, bracketing IPv6 hosts.
+func formatPeerURL(host string, port string) string {
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+// Parses the external addresses configured by an operator, as host or host:port, into the IPv4 address or hostname, the
+// IPv6 address, and the port to advertise. Addresses without a port use the default. As we advertise one port, the
+// addresses must share it.
+func ParseExternalAddrs(addrs []string, defaultPort string) (host string, ipv6 string, port string, err error) {
+	for _, addr := range addrs {
+		if u, err := url.Parse(addr); err == nil && u.Scheme != "" && u.Host != "" {
+			addr = u.Host
+		}
+		h, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			// No port.
+			h, p = strings.Trim(addr, "[]"), defaultPort
+		}
+		if h == "" || strings.ContainsAny(h, "/ ") {
+			return "", "", "", fmt.Errorf("Invalid external address %q.", addr)
+		}
+		if n, err := strconv.Atoi(p); err != nil || n <= 0 || 65535 < n {
+			return "", "", "", fmt.Errorf("Invalid port in external address %q.", addr)
+		}
+		if port != "" && p != port {
+			return "", "", "", fmt.Errorf("External addresses must share a port.")
+		}
+		port = p
+
+		if addrFamily(h) == "ipv6" {
+			if ipv6 != "" {
+				return "", "", "", fmt.Errorf("Only one external IPv6 address can be set.")
+			}
+			ipv6 = h
+		} else {
+			if host != "" {
+				return "", "", "", fmt.Errorf("Only one external IPv4 address or hostname can be set.")
+			}
+			host = h
+		}
+	}
+	if port == "" {
+		port = defaultPort
+	}
+	return host, ipv6, port, nil
+}
+
+// Returns our external addresses, the primary first.
+func (p *PeerCore) GetExternalAddrs() []string {
+	addrs := []string{}
+	if p.externalIp != "" {
+		addrs = append(addrs, formatPeerURL(p.externalIp, p.externalPort))
+	}
+	if p.externalIpv6 != "" && p.externalIpv6 != p.externalIp {
+		addrs = append(addrs, formatPeerURL(p.externalIpv6, p.externalPort))
+	}
+	return addrs
+}
+
+// Returns whether a peer address is one of ours.
+func (p *PeerCore) isOwnAddr(peerUrl string) bool {
+	if peerUrl == p.GetExternalAddr() || peerUrl == p.GetLocalAddr() {
+		return true
+	}
+	for _, addr := range p.GetExternalAddrs() {
+		if peerUrl == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the valid addresses a peer advertised in its heartbeat, its primary address first.
+func parseClientAddresses(msg HeartbeatMesage) []string {
+	addrs := []string{}
+	if msg.ClientAddress != "" {
+		addrs = append(addrs, msg.ClientAddress)
+	}
+	for i, addr := range msg.ClientAddresses {
+		if MAX_CLIENT_ADDRESSES <= i {
+			break
+		}
+		u, err := url.Parse(addr)
+		if err != nil || u.Hostname() == "" || addr == msg.ClientAddress {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Returns the addresses a peer can be reached at, for gossip.
+func (peer Peer) advertisedAddrs() []string {
+	if len(peer.addresses) == 0 {
+		return []string{peer.url}
+	}
+	return peer.addresses
+}
+
+// Returns the addresses of our peers, for gossip.
+func (p *PeerCore) gossipPeerAddrs() []string {
+	addrs := []string{}
+	for _, peer := range p.Peers() {
+		for _, addr := range peer.advertisedAddrs() {
+			if MAX_GOSSIP_PEERS <= len(addrs) {
+				return addrs
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Returns whether we have connectivity in an address family. Hostnames, and all families when we don't know our
+// external addresses, are assumed reachable.
+func (p *PeerCore) canReachFamily(family string) bool {
+	if family == "" || (p.externalIp == "" && p.externalIpv6 == "") {
+		return true
+	}
+	// An external hostname may resolve to either family.
+	if p.externalIp != "" && addrFamily(p.externalIp) == "" {
+		return true
+	}
+	for _, ip := range []string{p.externalIp, p.externalIpv6} {
+		if ip != "" && addrFamily(ip) == family {
+			return true
+		}
+	}
+	return false
+}
+
+// Ranks a peer address for dialing, lower first: reachable IPv6, then reachable IPv4 and hostnames, then unreachable.
+func (p *PeerCore) dialRank(peerUrl string) int {
+	u, err := url.Parse(peerUrl)
+	if err != nil {
+		return 3
+	}
+	family := addrFamily(u.Hostname())
+	switch {
+	case !p.canReachFamily(family):
+		return 2
+	case family == "ipv6":
+		return 0
+	default:
+		return 1
+	}
+}
+
+// Orders peer addresses for dialing, by their rank.
+func (p *PeerCore) sortByDialPreference(peerUrls []string) {
+	sort.SliceStable(peerUrls, func(i, j int) bool {
+		return p.dialRank(peerUrls[i]) < p.dialRank(peerUrls[j])
+	})
+}
@@ -0,0 +1,156 @@
+package nakamoto
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerDualStackAddrs(t *testing.T) {
+	assert := assert.New(t)
+
+	peer := &PeerCore{
+		config:       PeerConfig{address: "::", port: "8080"},
+		externalIp:   "203.0.113.1",
+		externalIpv6: "2001:db8::1",
+		externalPort: "8080",
+		bannedHosts:  make(map[string]time.Time),
+		peerLogger:   *NewLogger("peer", "test"),
+	}
+
+	// IPv6 hosts are bracketed, and IPv4 is the primary address.
+	assert.Equal("http://203.0.113.1:8080", peer.GetExternalAddr())
+	assert.Equal([]string{"http://203.0.113.1:8080", "http://[2001:db8::1]:8080"}, peer.GetExternalAddrs())
+	assert.Equal("http://[::]:8080", peer.GetLocalAddr())
+	assert.True(peer.isOwnAddr("http://[2001:db8::1]:8080"))
+	assert.False(peer.isOwnAddr("http://[2001:db8::2]:8080"))
+
+	// Both are advertised in heartbeats.
+	heartbeat := peer.newHeartbeat()
+	assert.Equal("http://203.0.113.1:8080", heartbeat.ClientAddress)
+	assert.Equal(peer.GetExternalAddrs(), heartbeat.ClientAddresses)
+
+	// Without IPv4, IPv6 is the primary address.
+	peer.externalIp = ""
+	assert.Equal("http://[2001:db8::1]:8080", peer.GetExternalAddr())
+	assert.Equal([]string{"http://[2001:db8::1]:8080"}, peer.GetExternalAddrs())
+
+	// Advertised addresses are validated and limited.
+	addrs := parseClientAddresses(HeartbeatMesage{
+		ClientAddress:   "http://203.0.113.2:8080",
+		ClientAddresses: []string{"http://203.0.113.2:8080", "http://[2001:db8::2]:8080", "::bad", "http://a", "http://b", "http://c"},
+	})
+	assert.Equal([]string{"http://203.0.113.2:8080", "http://[2001:db8::2]:8080", "http://a"}, addrs)
+
+	// And gossiped.
+	peer.peers = []Peer{{url: "http://203.0.113.2:8080", addresses: addrs}, {url: "http://203.0.113.3:8080"}}
+	assert.Equal(append(addrs, "http://203.0.113.3:8080"), peer.gossipPeerAddrs())
+}
+
+func TestPeersToDialPrefersReachableFamilies(t *testing.T) {
+	assert := assert.New(t)
+
+	peer := &PeerCore{
+		externalIp:   "203.0.113.1",
+		externalPort: "8080",
+		TargetPeers:  8,
+		MaxPeers:     32,
+		knownPeers:   make(map[string]time.Time),
+		bannedHosts:  make(map[string]time.Time),
+		peerLogger:   *NewLogger("peer", "test"),
+	}
+	now := time.Now()
+
+	// Without IPv6 connectivity, IPv6 addresses are only dialed when there's nothing else.
+	peer.addKnownPeer("http://[2001:db8::2]:8080")
+	assert.Equal([]string{"http://[2001:db8::2]:8080"}, peer.peersToDial(now))
+	peer.addKnownPeer("http://203.0.113.2:8080")
+	peer.addKnownPeer("http://node.example:8080")
+	assert.ElementsMatch([]string{"http://203.0.113.2:8080", "http://node.example:8080"}, peer.peersToDial(now))
+
+	// With it, IPv6 addresses are preferred.
+	peer.externalIpv6 = "2001:db8::1"
+	peer.TargetPeers = 1
+	assert.Equal([]string{"http://[2001:db8::2]:8080"}, peer.peersToDial(now))
+	peer.TargetPeers = 8
+	assert.Len(peer.peersToDial(now), 3)
+}
+
+func TestAddPeerOncePerNode(t *testing.T) {
+	assert := assert.New(t)
+
+	// A remote node reachable at two addresses.
+	identity, _ := core.CreateRandomWallet()
+	remote := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	remote.Identity = identity
+	server1 := httptest.NewServer(remote.server.Handler)
+	defer server1.Close()
+	server2 := httptest.NewServer(remote.server.Handler)
+	defer server2.Close()
+	remote.RegisterMesageHandler("heartbeat", func(message []byte, codec WireCodec) (interface{}, error) {
+		return HeartbeatMesage{
+			Type:            "heartbeat",
+			NodeID:          NodeID(identity),
+			ClientAddress:   server1.URL,
+			ClientAddresses: []string{server1.URL, server2.URL},
+		}, nil
+	})
+
+	local := &PeerCore{
+		externalIp:   "127.0.0.1",
+		externalPort: "9999",
+		MaxPeers:     8,
+		knownPeers:   make(map[string]time.Time),
+		bannedHosts:  make(map[string]time.Time),
+		peerLogger:   *NewLogger("peer", "test"),
+	}
+	assert.Nil(local.AddPeer(server1.URL))
+	assert.Equal([]string{server1.URL, server2.URL}, local.Peers()[0].addresses)
+
+	// It's recognised by its node ID at its other address.
+	assert.NotNil(local.AddPeer(server2.URL))
+	assert.Len(local.Peers(), 1)
+}
+
+func TestParseExternalAddrs(t *testing.T) {
+	assert := assert.New(t)
+
+	host, ipv6, port, err := ParseExternalAddrs([]string{"203.0.113.1:9000", "[2001:db8::1]:9000"}, "8080")
+	assert.Nil(err)
+	assert.Equal("203.0.113.1", host)
+	assert.Equal("2001:db8::1", ipv6)
+	assert.Equal("9000", port)
+
+	// Addresses without a port use the listening port, and may be hostnames or URLs.
+	host, ipv6, port, err = ParseExternalAddrs([]string{"node.example", "2001:db8::1"}, "8080")
+	assert.Nil(err)
+	assert.Equal("node.example", host)
+	assert.Equal("2001:db8::1", ipv6)
+	assert.Equal("8080", port)
+	host, _, port, err = ParseExternalAddrs([]string{"http://node.example:9000"}, "8080")
+	assert.Nil(err)
+	assert.Equal("node.example", host)
+	assert.Equal("9000", port)
+
+	for _, addrs := range [][]string{
+		{""},
+		{"203.0.113.1:0"},
+		{"203.0.113.1:http"},
+		{"203.0.113.1:9000", "[2001:db8::1]:9001"},
+		{"203.0.113.1", "node.example"},
+		{"2001:db8::1", "2001:db8::2"},
+	} {
+		_, _, _, err := ParseExternalAddrs(addrs, "8080")
+		assert.NotNil(err, addrs)
+	}
+
+	// A peer without an external address doesn't advertise one.
+	peer := &PeerCore{externalPort: "8080", peerLogger: *NewLogger("peer", "test")}
+	assert.Equal("", peer.GetExternalAddr())
+	heartbeat := peer.newHeartbeat()
+	assert.Equal("", heartbeat.ClientAddress)
+	assert.Len(heartbeat.ClientAddresses, 0)
+}
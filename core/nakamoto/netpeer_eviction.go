@@ -0,0 +1,200 @@
+package nakamoto
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Inbound peer eviction.
+//
+// When the inbound peer slots are full and a new peer connects to us, we try to evict an existing inbound peer to make
+// room. The policy is modelled on Bitcoin Core's, and is designed so an attacker cannot easily take over all of our
+// inbound slots. Peers are protected from eviction by characteristics which are hard to fake:
+// - network diversity: peers from the least-represented netgroups.
+// - latency: the lowest-latency peers.
+// - uptime: the longest-connected peers.
+// Of the remaining peers, we evict the youngest peer from the netgroup with the most connections.
+
+const (
+	EVICTION_PROTECT_NETGROUP = 4
+	EVICTION_PROTECT_LATENCY  = 8
+)
+
+// Updates an inbound peer's info when they send us a heartbeat, or accepts them as a new inbound peer, evicting an
+// existing inbound peer if our inbound slots are full.
+func (p *PeerCore) acceptInboundPeer(msg HeartbeatMesage, now time.Time) error {
+	peerUrl, err := url.Parse(msg.ClientAddress)
+	if err != nil || peerUrl.Hostname() == "" {
+		// Cannot identify the peer.
+		return nil
+	}
+	if p.isOwnAddr(msg.ClientAddress) {
+		return nil
+	}
+
+	p.peersMutex.Lock()
+	defer p.peersMutex.Unlock()
+
+	for i := range p.peers {
+		// Recognise peers which have changed address by their identity.
+		if p.peers[i].url != msg.ClientAddress && msg.NodeID != "" && p.peers[i].nodeID == msg.NodeID {
+			p.peerLogger.Printf("Peer %s changed address to %s\n", p.peers[i].url, msg.ClientAddress)
+			p.peers[i].url = msg.ClientAddress
+		}
+		if p.peers[i].url == msg.ClientAddress {
+			// The server checks a declared node ID signed the message. A peer's identity can't be dropped or changed.
+			if p.peers[i].nodeID != "" && p.peers[i].nodeID != msg.NodeID {
+				return fmt.Errorf("Heartbeat isn't signed by the peer's identity.")
+			}
+			p.peers[i].lastSeen = uint64(now.Unix())
+			p.peers[i].nodeID = msg.NodeID
+			p.peers[i].addresses = parseClientAddresses(msg)
+			p.peers[i].clientVersion = msg.ClientVersion
+			p.peers[i].services = msg.Services
+			peerTransport.setQuicSupport(msg.ClientAddress, msg.NodeID, msg.Services&NODE_SERVICE_QUIC != 0)
+			p.peers[i].txFilter = parseTxFilter(msg)
+			p.peers[i].encoding = NegotiateWireEncoding(msg.Encodings)
+			p.peers[i].compression = NegotiateWireCompression(msg.Compressions)
+			p.peers[i].recordHeartbeat(msg, now)
+			return nil
+		}
+	}
+
+	// Private networks only accept the peers they were configured with.
+	if _, ok := p.knownPeers[msg.ClientAddress]; p.PrivateNetwork && !ok {
+		return fmt.Errorf("Not accepting unknown peers on a private network.")
+	}
+
+	numInbound := 0
+	for _, peer := range p.peers {
+		if peer.inbound {
+			numInbound++
+		}
+	}
+	maxInbound := p.MaxPeers - p.MinOutboundPeers
+	if maxInbound <= 0 {
+		return fmt.Errorf("Not accepting inbound peers.")
+	}
+
+	if maxInbound <= numInbound || p.MaxPeers <= len(p.peers) {
+		evict, ok := selectInboundPeerToEvict(p.peers)
+		if !ok {
+			return fmt.Errorf("Inbound peer slots are full.")
+		}
+		p.peerLogger.Printf("Evicting inbound peer %s for %s\n", evict, msg.ClientAddress)
+		for i, peer := range p.peers {
+			if peer.url == evict {
+				p.peers = append(p.peers[:i], p.peers[i+1:]...)
+				break
+			}
+		}
+	}
+
+	peer := Peer{
+		url:           msg.ClientAddress,
+		nodeID:        msg.NodeID,
+		addresses:     parseClientAddresses(msg),
+		lastSeen:      uint64(now.Unix()),
+		clientVersion: msg.ClientVersion,
+		services:      msg.Services,
+		txFilter:      parseTxFilter(msg),
+		encoding:      NegotiateWireEncoding(msg.Encodings),
+		compression:   NegotiateWireCompression(msg.Compressions),
+		inbound:       true,
+		connectedAt:   now,
+	}
+	peer.recordHeartbeat(msg, now)
+	peerTransport.setQuicSupport(msg.ClientAddress, msg.NodeID, msg.Services&NODE_SERVICE_QUIC != 0)
+	p.peers = append(p.peers, peer)
+	p.peerLogger.Printf("Accepted inbound peer %s\n", msg.ClientAddress)
+
+	return nil
+}
+
+// Selects an inbound peer to evict. Returns false if all inbound peers are protected.
+func selectInboundPeerToEvict(peers []Peer) (string, bool) {
+	candidates := []Peer{}
+	for _, peer := range peers {
+		if peer.inbound {
+			candidates = append(candidates, peer)
+		}
+	}
+
+	// Protect peers from the least-represented netgroups.
+	netgroupCounts := make(map[string]int)
+	for _, peer := range candidates {
+		netgroupCounts[peerNetgroup(peer.url)]++
+	}
+	candidates = protectPeers(candidates, EVICTION_PROTECT_NETGROUP, func(a, b Peer) bool {
+		return netgroupCounts[peerNetgroup(a.url)] < netgroupCounts[peerNetgroup(b.url)]
+	})
+
+	// Protect the lowest-latency peers. Peers whose latency is unmeasured are not protected.
+	candidates = protectPeers(candidates, EVICTION_PROTECT_LATENCY, func(a, b Peer) bool {
+		if a.latency == 0 || b.latency == 0 {
+			return b.latency == 0 && a.latency != 0
+		}
+		return a.latency < b.latency
+	})
+
+	// Protect the longest-connected half of the remaining peers.
+	candidates = protectPeers(candidates, len(candidates)/2, func(a, b Peer) bool {
+		return a.connectedAt.Before(b.connectedAt)
+	})
+
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	// Evict the youngest peer from the netgroup with the most connections.
+	groups := make(map[string][]Peer)
+	for _, peer := range candidates {
+		group := peerNetgroup(peer.url)
+		groups[group] = append(groups[group], peer)
+	}
+	var largest []Peer
+	for _, group := range groups {
+		if len(largest) < len(group) {
+			largest = group
+		}
+	}
+	youngest := largest[0]
+	for _, peer := range largest[1:] {
+		if youngest.connectedAt.Before(peer.connectedAt) {
+			youngest = peer
+		}
+	}
+	return youngest.url, true
+}
+
+// Sorts the peers by less, and removes the first n.
+func protectPeers(peers []Peer, n int, less func(a, b Peer) bool) []Peer {
+	sort.SliceStable(peers, func(i, j int) bool {
+		return less(peers[i], peers[j])
+	})
+	if len(peers) < n {
+		n = len(peers)
+	}
+	return peers[n:]
+}
+
+// Returns the netgroup of a peer address - the /16 subnet for IPv4, the /32 subnet for IPv6, or the hostname.
+func peerNetgroup(peerUrl string) string {
+	u, err := url.Parse(peerUrl)
+	if err != nil {
+		return peerUrl
+	}
+	host := u.Hostname()
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String() + "/16"
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String() + "/32"
+}
@@ -0,0 +1,77 @@
+package nakamoto
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Peer connection filters restrict who the node talks to, for permissioned or firewalled deployments:
+//
+//   - The inbound denylist rejects messages from hosts in any of its CIDR ranges.
+//   - The inbound allowlist, if set, rejects messages from hosts outside all of its CIDR ranges. The denylist takes
+//     precedence over it.
+//   - In private network mode, the node only connects to the peers it was configured with, ie. its bootstrap peers and
+//     peers added over RPC. It doesn't learn of peers from gossip, doesn't tell peers about its own, and only accepts
+//     inbound peers it was configured with.
+//
+// The filters are checked against the address a message was sent from, rather than the address a peer claims.
+
+// Parses a list of CIDR ranges. Plain IP addresses are parsed as single-address ranges.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	ranges := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address: %s", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR range: %s", cidr)
+		}
+		ranges = append(ranges, ipnet)
+	}
+	return ranges, nil
+}
+
+func ipInRanges(ip net.IP, ranges []*net.IPNet) bool {
+	for _, ipnet := range ranges {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the inbound allowlist and denylist allow messages from a host.
+func (p *PeerCore) IsInboundAllowed(host string) bool {
+	return isInboundAllowed(host, p.InboundAllowlist, p.InboundDenylist)
+}
+
+func isInboundAllowed(host string, allowlist []*net.IPNet, denylist []*net.IPNet) bool {
+	if len(allowlist) == 0 && len(denylist) == 0 {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		// Can't match an unknown address against the lists.
+		return len(allowlist) == 0
+	}
+	if ipInRanges(ip, denylist) {
+		return false
+	}
+	return len(allowlist) == 0 || ipInRanges(ip, allowlist)
+}
@@ -0,0 +1,67 @@
+package nakamoto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	assert := assert.New(t)
+
+	ranges, err := ParseCIDRs([]string{"10.0.0.0/8", " 192.168.1.7 ", "", "fd00::/8", "::1"})
+	assert.Nil(err)
+	assert.Equal(4, len(ranges))
+	assert.Equal("10.0.0.0/8", ranges[0].String())
+	assert.Equal("192.168.1.7/32", ranges[1].String())
+	assert.Equal("::1/128", ranges[3].String())
+
+	_, err = ParseCIDRs([]string{"10.0.0.0/33"})
+	assert.NotNil(err)
+	_, err = ParseCIDRs([]string{"not-an-ip"})
+	assert.NotNil(err)
+}
+
+func TestPeerInboundFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &PeerCore{}
+	assert.True(p.IsInboundAllowed("1.2.3.4"))
+
+	// Deny a range.
+	p.InboundDenylist, _ = ParseCIDRs([]string{"1.2.3.0/24"})
+	assert.False(p.IsInboundAllowed("1.2.3.4"))
+	assert.True(p.IsInboundAllowed("1.2.4.4"))
+	assert.True(p.IsInboundAllowed("unknown"))
+
+	// Only allow a range, except for the denied hosts within it.
+	p.InboundAllowlist, _ = ParseCIDRs([]string{"1.2.0.0/16", "::1"})
+	assert.True(p.IsInboundAllowed("1.2.4.4"))
+	assert.True(p.IsInboundAllowed("::1"))
+	assert.False(p.IsInboundAllowed("1.2.3.4"))
+	assert.False(p.IsInboundAllowed("8.8.8.8"))
+	assert.False(p.IsInboundAllowed("unknown"))
+}
+
+func TestPeerPrivateNetwork(t *testing.T) {
+	assert := assert.New(t)
+
+	p := &PeerCore{
+		MaxPeers:         8,
+		MinOutboundPeers: 2,
+		PrivateNetwork:   true,
+		knownPeers:       map[string]time.Time{},
+		peerLogger:       *NewLogger("peer", "test"),
+	}
+	p.server = &PeerServer{}
+	p.addKnownPeer("http://10.0.0.1:8000")
+
+	// Only configured peers are accepted.
+	assert.NotNil(p.acceptInboundPeer(HeartbeatMesage{ClientAddress: "http://10.0.0.2:8000"}, time.Now()))
+	assert.Nil(p.acceptInboundPeer(HeartbeatMesage{ClientAddress: "http://10.0.0.1:8000"}, time.Now()))
+	assert.Equal(1, len(p.Peers()))
+
+	// Peers aren't gossiped.
+	p.GossipPeers()
+}
@@ -0,0 +1,1005 @@
+package nakamoto
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/libp2p/go-libp2p"
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/control"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	drouting "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	libp2pquic "github.com/libp2p/go-libp2p/p2p/transport/quic"
+	"github.com/libp2p/go-libp2p/p2p/transport/tcp"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// Libp2pPeer is a networking backend built on libp2p, as an alternative to PeerCore. libp2p does the NAT traversal
+// (port mapping, hole punching and relays), and gossipsub propagates blocks and transactions, instead of our own
+// flooding.
+//
+// Peers are discovered through a Kademlia DHT, which is separate from the IPFS one (see LIBP2P_DHT_PREFIX). Each node
+// advertises itself in the DHT under the rendezvous of its network (see Libp2pRendezvous), and while it has fewer than
+// TargetPeers peers, it connects to the other nodes advertised there. The DHT is joined through the bootstrap peers.
+//
+// Peers connect over QUIC, and TCP. QUIC listens on the UDP port of the same number, unless disabled with
+// PeerConfig.NoQuic, like PeerCore.
+//
+// Blocks and transactions are gossiped on the LIBP2P_BLOCKS_TOPIC and LIBP2P_TXS_TOPIC topics, as CBOR-encoded
+// new_block and new_tx messages. Messages are identified by the hash of their contents, so a block relayed by many
+// peers is only propagated once. The block topic is validated with OnPrecheckBlock, so blocks with an invalid POW
+// solution aren't propagated, and the peer which relayed them is banned. The transaction topic is validated with
+// OnPrecheckTransaction, and gossipsub penalises peers relaying invalid transactions.
+//
+// Requests (sync, checkpoints, ...) are sent on a stream protocol per message type, named by libp2pProtocol. The
+// requester writes the CBOR-encoded message and closes its side of the stream. The peer replies with a status byte,
+// followed by the CBOR-encoded reply, or the error message if the status is LIBP2P_REPLY_ERROR. The requests are
+// handled by the same handlers as PeerCore's (see PeerCallbacks.requestHandlers).
+//
+// The libp2p peer ID is derived from the node identity's key (see identity.go), so a node keeps its identity across
+// backends. Since a libp2p peer is identified by its ID rather than its address, bans and misbehaviour scores are kept
+// by peer ID, and the "host" of a peer in the PeerInterface is its peer ID.
+//
+// Peers exchange heartbeats every HeartbeatIntervalSeconds, on the heartbeat stream protocol. These are the same
+// heartbeat messages as PeerCore's, telling us the tips and services of peers, and measuring their latency and clock
+// offset. Peers which stop replying for HeartbeatTimeoutSeconds are disconnected.
+//
+// BlocksOnly, TxFilter and the inbound allowlist and denylist work like PeerCore's, and the external addresses of the
+// config are advertised instead of our listen addresses. Browsers can't connect over libp2p, so the backend isn't a
+// WebRTCSignaller.
+
+const (
+	LIBP2P_BLOCKS_TOPIC = "/tinychain/blocks/1"
+	LIBP2P_TXS_TOPIC    = "/tinychain/txs/1"
+
+	// The protocol prefix of our DHT, which keeps it apart from the IPFS DHT.
+	LIBP2P_DHT_PREFIX = "/tinychain"
+	// How often we look for peers in the DHT, while we have fewer than we want.
+	LIBP2P_DISCOVERY_INTERVAL = 30 * time.Second
+
+	// The status bytes of a reply to a request.
+	LIBP2P_REPLY_OK    byte = 0
+	LIBP2P_REPLY_ERROR byte = 1
+)
+
+// The codec messages are encoded with over libp2p.
+var libp2pCodec = wireCodecs[WIRE_ENCODING_CBOR]
+
+// Returns the rendezvous of a network, which its nodes advertise themselves under in the DHT. Networks are told apart
+// by their genesis block.
+func Libp2pRendezvous(conf ConsensusConfig) string {
+	return fmt.Sprintf("/tinychain/%x", conf.GenesisParentBlockHash)
+}
+
+// Returns the stream protocol of requests of a message type.
+func libp2pProtocol(messageType string) protocol.ID {
+	return protocol.ID(fmt.Sprintf("/tinychain/%s/1", messageType))
+}
+
+type Libp2pPeer struct {
+	// The callbacks which handle messages from peers.
+	PeerCallbacks
+
+	// The rendezvous we advertise ourselves under in the DHT, and find peers through. See Libp2pRendezvous.
+	Rendezvous string
+	// The number of peers we look for in the DHT.
+	TargetPeers int
+	// How often we look for peers.
+	DiscoveryInterval time.Duration
+	// How often we send heartbeats to peers, and how long until we disconnect peers which don't reply.
+	HeartbeatIntervalSeconds int
+	HeartbeatTimeoutSeconds  int
+
+	// In blocks-only mode, we don't subscribe to the transaction topic, so we neither receive nor relay unconfirmed
+	// transactions. Transactions submitted locally are still published. Must be set before Start.
+	BlocksOnly bool
+	// If set, we only handle and relay gossiped transactions to or from the pubkeys in the filter. It's sent to peers
+	// in our heartbeats, like PeerCore's. See bloom.go.
+	TxFilter *BloomFilter
+	// Hosts in the denylist, or outside the allowlist if it is set, can't connect to us. See netpeer_filter.go.
+	InboundAllowlist []*net.IPNet
+	InboundDenylist  []*net.IPNet
+
+	host      host.Host
+	dht       *dht.IpfsDHT
+	discovery *drouting.RoutingDiscovery
+	pubsub    *pubsub.PubSub
+	blocks    *pubsub.Topic
+	txs       *pubsub.Topic
+
+	blocksSub *pubsub.Subscription
+
+	bannedPeers        map[peer.ID]time.Time
+	misbehaviourScores map[peer.ID]int
+	// The state of peers learnt from their heartbeats, merged into Peers.
+	heartbeats map[peer.ID]Peer
+	mutex      sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	log    *log.Logger
+}
+
+// Creates a libp2p peer with the node identity, listening on the config's address and port.
+func NewLibp2pPeer(config PeerConfig, identity *core.Wallet) (*Libp2pPeer, error) {
+	key, _, err := crypto.ECDSAKeyPairFromKey(identity.Prvkey())
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Libp2pPeer{
+		Rendezvous:               LIBP2P_DHT_PREFIX,
+		TargetPeers:              8,
+		DiscoveryInterval:        LIBP2P_DISCOVERY_INTERVAL,
+		HeartbeatIntervalSeconds: 30,
+		HeartbeatTimeoutSeconds:  90,
+		bannedPeers:              make(map[peer.ID]time.Time),
+		misbehaviourScores:       make(map[peer.ID]int),
+		heartbeats:               make(map[peer.ID]Peer),
+		ctx:                      ctx,
+		cancel:                   cancel,
+		log:                      NewLogger("peer", "libp2p"),
+	}
+
+	externalAddrs, err := libp2pExternalAddrs(config)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	opts := []libp2p.Option{
+		libp2p.Identity(key),
+		libp2p.ListenAddrStrings(libp2pListenAddrs(config)...),
+		libp2p.Transport(tcp.NewTCPTransport),
+		libp2p.Transport(libp2pquic.NewTransport),
+		libp2p.ConnectionGater(libp2pGater{l}),
+		libp2p.UserAgent(CLIENT_VERSION),
+	}
+	if !config.NoDiscoverIP {
+		opts = append(opts, libp2p.NATPortMap(), libp2p.EnableHolePunching())
+	}
+	if len(externalAddrs) != 0 {
+		// Advertise the configured external addresses instead of our listen addresses.
+		opts = append(opts, libp2p.AddrsFactory(func([]ma.Multiaddr) []ma.Multiaddr {
+			return externalAddrs
+		}))
+	}
+	if l.host, err = libp2p.New(opts...); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// Serve the DHT unless we know we're unreachable, so nodes on a private network can find each other.
+	l.dht, err = dht.New(ctx, l.host, dht.Mode(dht.ModeAutoServer), dht.ProtocolPrefix(LIBP2P_DHT_PREFIX))
+	if err != nil {
+		l.Stop()
+		return nil, err
+	}
+	l.discovery = drouting.NewRoutingDiscovery(l.dht)
+
+	if err := l.setupPubsub(); err != nil {
+		l.Stop()
+		return nil, err
+	}
+	for messageType, handler := range l.PeerCallbacks.requestHandlers() {
+		l.host.SetStreamHandler(libp2pProtocol(messageType), func(stream network.Stream) {
+			l.handleRequest(stream, handler)
+		})
+	}
+	l.host.SetStreamHandler(libp2pProtocol("heartbeat"), func(stream network.Stream) {
+		from := stream.Conn().RemotePeer()
+		l.handleRequest(stream, func(message []byte, codec WireCodec) (interface{}, error) {
+			return l.handleHeartbeat(from, message, codec)
+		})
+	})
+
+	// Forget the heartbeats of peers once they disconnect.
+	l.host.Network().Notify(&network.NotifyBundle{
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			if n.Connectedness(conn.RemotePeer()) != network.Connected {
+				l.mutex.Lock()
+				delete(l.heartbeats, conn.RemotePeer())
+				l.mutex.Unlock()
+			}
+		},
+	})
+
+	l.log.Printf("Listening on %s\n", l.GetLocalAddr())
+	return l, nil
+}
+
+// Returns the libp2p listen addresses of the config's address and port, over TCP and QUIC.
+func libp2pListenAddrs(config PeerConfig) []string {
+	hosts := []string{fmt.Sprintf("/ip4/%s", config.address)}
+	if ip := net.ParseIP(config.address); ip != nil && ip.To4() == nil {
+		hosts = []string{fmt.Sprintf("/ip6/%s", config.address)}
+		// Listen dual-stack on the unspecified address, like PeerCore.
+		if ip.IsUnspecified() {
+			hosts = append(hosts, "/ip4/0.0.0.0")
+		}
+	}
+
+	addrs := []string{}
+	for _, host := range hosts {
+		addrs = append(addrs, fmt.Sprintf("%s/tcp/%s", host, config.port))
+		if !config.NoQuic {
+			addrs = append(addrs, fmt.Sprintf("%s/udp/%s/quic-v1", host, config.port))
+		}
+	}
+	return addrs
+}
+
+// Returns the libp2p addresses of the config's external addresses, over TCP and QUIC.
+func libp2pExternalAddrs(config PeerConfig) ([]ma.Multiaddr, error) {
+	if len(config.ExternalAddrs) == 0 {
+		return nil, nil
+	}
+	host, ipv6, port, err := ParseExternalAddrs(config.ExternalAddrs, config.port)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []string{}
+	if host != "" {
+		switch ip := net.ParseIP(host); {
+		case ip == nil:
+			hosts = append(hosts, fmt.Sprintf("/dns/%s", host))
+		case ip.To4() != nil:
+			hosts = append(hosts, fmt.Sprintf("/ip4/%s", host))
+		default:
+			hosts = append(hosts, fmt.Sprintf("/ip6/%s", host))
+		}
+	}
+	if ipv6 != "" {
+		hosts = append(hosts, fmt.Sprintf("/ip6/%s", ipv6))
+	}
+
+	addrs := []ma.Multiaddr{}
+	for _, h := range hosts {
+		transports := []string{fmt.Sprintf("%s/tcp/%s", h, port)}
+		if !config.NoQuic {
+			transports = append(transports, fmt.Sprintf("%s/udp/%s/quic-v1", h, port))
+		}
+		for _, transport := range transports {
+			addr, err := ma.NewMultiaddr(transport)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid external address %q.", transport)
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+func (l *Libp2pPeer) setupPubsub() error {
+	var err error
+	l.pubsub, err = pubsub.NewGossipSub(
+		l.ctx,
+		l.host,
+		pubsub.WithPeerExchange(true),
+		pubsub.WithMessageIdFn(func(msg *pb.Message) string {
+			hash := sha256.Sum256(msg.Data)
+			return string(hash[:])
+		}),
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := l.pubsub.RegisterTopicValidator(LIBP2P_BLOCKS_TOPIC, l.validateBlock); err != nil {
+		return err
+	}
+	if err := l.pubsub.RegisterTopicValidator(LIBP2P_TXS_TOPIC, l.validateTransaction); err != nil {
+		return err
+	}
+	if l.blocks, err = l.pubsub.Join(LIBP2P_BLOCKS_TOPIC); err != nil {
+		return err
+	}
+	if l.txs, err = l.pubsub.Join(LIBP2P_TXS_TOPIC); err != nil {
+		return err
+	}
+	if l.blocksSub, err = l.blocks.Subscribe(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (l *Libp2pPeer) Callbacks() *PeerCallbacks {
+	return &l.PeerCallbacks
+}
+
+// Handles gossiped blocks and transactions, discovers peers and sends heartbeats. Blocks until the peer is stopped.
+func (l *Libp2pPeer) Start() {
+	go l.discoveryRoutine()
+	go l.heartbeatRoutine()
+	if !l.BlocksOnly {
+		txsSub, err := l.txs.Subscribe()
+		if err != nil {
+			l.log.Printf("Failed to subscribe to transactions: %v\n", err)
+		} else {
+			go l.readTopic(txsSub, func(msg *pubsub.Message) {
+				if l.OnNewTransaction != nil {
+					l.OnNewTransaction(msg.ValidatorData.(RawTransaction))
+				}
+			})
+		}
+	}
+	l.readTopic(l.blocksSub, func(msg *pubsub.Message) {
+		block := msg.ValidatorData.(RawBlock)
+		if l.OnNewBlock != nil {
+			if err := l.OnNewBlock(block); err != nil {
+				l.log.Printf("Failed to handle block %s: %v\n", block.HashStr(), err)
+			}
+		}
+	})
+}
+
+// Closes the host, disconnecting from all peers.
+func (l *Libp2pPeer) Stop() {
+	l.cancel()
+	if l.dht != nil {
+		l.dht.Close()
+	}
+	l.host.Close()
+}
+
+func (l *Libp2pPeer) readTopic(sub *pubsub.Subscription, handle func(msg *pubsub.Message)) {
+	for {
+		msg, err := sub.Next(l.ctx)
+		if err != nil {
+			return
+		}
+		// Skip the messages we published.
+		if msg.ReceivedFrom == l.host.ID() {
+			continue
+		}
+		handle(msg)
+	}
+}
+
+func (l *Libp2pPeer) validateBlock(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	var newBlockMsg NewBlockMessage
+	if err := libp2pCodec.Unmarshal(msg.Data, &newBlockMsg); err != nil {
+		return pubsub.ValidationReject
+	}
+	block := newBlockMsg.RawBlock
+
+	// Check the block's POW before it's propagated.
+	if l.OnPrecheckBlock != nil {
+		err := l.OnPrecheckBlock(block)
+		if errors.Is(err, ErrBlockPOWInvalid) {
+			if from != l.host.ID() {
+				l.Misbehaving(from.String(), MISBEHAVIOUR_BAN_SCORE, fmt.Sprintf("Relayed block %s with an invalid POW solution", block.HashStr()))
+			}
+			return pubsub.ValidationReject
+		}
+		if err != nil {
+			l.log.Printf("Failed to pre-check block %s: %v\n", block.HashStr(), err)
+			return pubsub.ValidationIgnore
+		}
+	}
+
+	msg.ValidatorData = block
+	return pubsub.ValidationAccept
+}
+
+func (l *Libp2pPeer) validateTransaction(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	var newTxMsg NewTransactionMessage
+	if err := libp2pCodec.Unmarshal(msg.Data, &newTxMsg); err != nil {
+		return pubsub.ValidationReject
+	}
+	// Transactions we published are relayed regardless of our filter.
+	if from != l.host.ID() && l.TxFilter != nil && !l.TxFilter.MatchesTransaction(newTxMsg.RawTransaction) {
+		return pubsub.ValidationIgnore
+	}
+	if l.OnPrecheckTransaction != nil {
+		if err := l.OnPrecheckTransaction(newTxMsg.RawTransaction); err != nil {
+			l.log.Printf("Rejected transaction from %s: %s\n", from, err)
+			return pubsub.ValidationReject
+		}
+	}
+	msg.ValidatorData = newTxMsg.RawTransaction
+	return pubsub.ValidationAccept
+}
+
+// Returns our first listen address, with our peer ID.
+func (l *Libp2pPeer) GetLocalAddr() string {
+	addrs := l.host.Addrs()
+	if len(addrs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s/p2p/%s", addrs[0], l.host.ID())
+}
+
+// Returns our libp2p peer ID.
+func (l *Libp2pPeer) PeerID() string {
+	return l.host.ID().String()
+}
+
+func (l *Libp2pPeer) GossipBlock(block RawBlock) {
+	l.publish(l.blocks, NewBlockMessage{Type: "new_block", RawBlock: block})
+}
+
+func (l *Libp2pPeer) GossipTransaction(tx RawTransaction) {
+	l.publish(l.txs, NewTransactionMessage{Type: "new_tx", RawTransaction: tx})
+}
+
+func (l *Libp2pPeer) publish(topic *pubsub.Topic, message any) {
+	buf, err := libp2pCodec.Marshal(message)
+	if err != nil {
+		l.log.Printf("Failed to encode message: %v\n", err)
+		return
+	}
+	if err := topic.Publish(l.ctx, buf); err != nil {
+		l.log.Printf("Failed to publish to %s: %v\n", topic.String(), err)
+	}
+}
+
+// The client.
+// ====================================================================================================================
+
+// Sends a request to a peer, and decodes its reply.
+func (l *Libp2pPeer) request(p Peer, messageType string, message any, reply any) error {
+	id, err := peer.Decode(p.nodeID)
+	if err != nil {
+		return fmt.Errorf("Invalid peer ID: %s", p.nodeID)
+	}
+
+	ctx, cancel := context.WithTimeout(l.ctx, DEFAULT_PEER_REQUEST_TIMEOUT)
+	defer cancel()
+	stream, err := l.host.NewStream(ctx, id, libp2pProtocol(messageType))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	deadline, _ := ctx.Deadline()
+	stream.SetDeadline(deadline)
+
+	buf, err := libp2pCodec.Marshal(message)
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+	if _, err := stream.Write(buf); err != nil {
+		stream.Reset()
+		return err
+	}
+	if err := stream.CloseWrite(); err != nil {
+		stream.Reset()
+		return err
+	}
+
+	res, err := io.ReadAll(io.LimitReader(stream, MAX_MESSAGE_SIZE+1))
+	if err != nil {
+		stream.Reset()
+		return err
+	}
+	if len(res) == 0 || MAX_MESSAGE_SIZE < len(res) {
+		return fmt.Errorf("Invalid reply to %s from peer %s", messageType, id)
+	}
+	if res[0] != LIBP2P_REPLY_OK {
+		return fmt.Errorf("Peer %s replied with error: %s", id, res[1:])
+	}
+	return libp2pCodec.Unmarshal(res[1:], reply)
+}
+
+func (l *Libp2pPeer) GetTip(p Peer) (BlockHeader, error) {
+	var reply GetTipMessage
+	err := l.request(p, "get_tip", GetTipMessage{Type: "get_tip"}, &reply)
+	if err != nil {
+		l.log.Printf("Failed to get tip from peer: %v\n", err)
+		return BlockHeader{}, err
+	}
+	return reply.Tip, nil
+}
+
+func (l *Libp2pPeer) HasBlock(p Peer, blockhash [32]byte) (bool, error) {
+	var reply HasBlockReply
+	msg := HasBlockMessage{
+		Type:      "has_block",
+		BlockHash: fmt.Sprintf("%x", blockhash),
+	}
+	if err := l.request(p, "has_block", msg, &reply); err != nil {
+		l.log.Printf("Failed to ask peer for block: %v\n", err)
+		return false, err
+	}
+	return reply.Has, nil
+}
+
+func (l *Libp2pPeer) SyncGetTipAtDepth(p Peer, fromBlock [32]byte, depth uint64) (BlockHeader, error) {
+	var reply SyncGetTipAtDepthReply
+	msg := SyncGetTipAtDepthMessage{
+		Type:      "sync_get_tip_at_depth",
+		FromBlock: fromBlock,
+		Depth:     depth,
+	}
+	if err := l.request(p, "sync_get_tip_at_depth", msg, &reply); err != nil {
+		l.log.Printf("Failed to send message to peer: %v\n", err)
+		return BlockHeader{}, err
+	}
+	return reply.Tip, nil
+}
+
+func (l *Libp2pPeer) SyncGetBlockHeaders(p Peer, fromBlock [32]byte, heights core.Bitset) ([]BlockHeader, error) {
+	var reply SyncGetDataReply
+	msg := SyncGetDataMessage{
+		Type:      "sync_get_data",
+		FromBlock: fromBlock,
+		Heights:   heights,
+		Headers:   true,
+		Bodies:    false,
+	}
+	if err := l.request(p, "sync_get_data", msg, &reply); err != nil {
+		l.log.Printf("Failed to send message to peer: %v\n", err)
+		return []BlockHeader{}, err
+	}
+	if heights.Count() < len(reply.Headers) {
+		return []BlockHeader{}, fmt.Errorf("Peer replied with too many headers. Requested %d, got %d", heights.Count(), len(reply.Headers))
+	}
+	return reply.Headers, nil
+}
+
+func (l *Libp2pPeer) GetCheckpoints(p Peer, fromHeight uint64, interval uint64) ([]Checkpoint, error) {
+	var reply GetCheckpointsReply
+	msg := GetCheckpointsMessage{
+		Type:       "get_checkpoints",
+		FromHeight: fromHeight,
+		Interval:   interval,
+	}
+	if err := l.request(p, "get_checkpoints", msg, &reply); err != nil {
+		l.log.Printf("Failed to send message to peer: %v\n", err)
+		return nil, err
+	}
+	return reply.Checkpoints, nil
+}
+
+// The server.
+// ====================================================================================================================
+
+// Handles a request from a peer, replying on the stream.
+func (l *Libp2pPeer) handleRequest(stream network.Stream, handler PeerMessageHandler) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(DEFAULT_PEER_REQUEST_TIMEOUT))
+
+	message, err := io.ReadAll(io.LimitReader(stream, MAX_MESSAGE_SIZE+1))
+	if err != nil || MAX_MESSAGE_SIZE < len(message) {
+		stream.Reset()
+		return
+	}
+
+	reply, err := handler(message, libp2pCodec)
+	var buf []byte
+	if err == nil {
+		buf, err = libp2pCodec.Marshal(reply)
+	}
+	if err != nil {
+		var misbehaviour *PeerMisbehaviourError
+		if errors.As(err, &misbehaviour) {
+			l.Misbehaving(stream.Conn().RemotePeer().String(), misbehaviour.Score, misbehaviour.Reason)
+		}
+		stream.Write(append([]byte{LIBP2P_REPLY_ERROR}, err.Error()...))
+		return
+	}
+	stream.Write(append([]byte{LIBP2P_REPLY_OK}, buf...))
+}
+
+// Heartbeats.
+// ====================================================================================================================
+
+// Returns the services we advertise to peers.
+func (l *Libp2pPeer) Services() uint64 {
+	services := uint64(0)
+	if !l.BlocksOnly {
+		services |= NODE_SERVICE_TX_RELAY
+	}
+	if l.OnGetBlockFilters != nil {
+		services |= NODE_SERVICE_BLOCK_FILTERS
+	}
+	return services
+}
+
+// Returns our heartbeat. Addresses and the node ID aren't included, since libp2p exchanges them when connecting.
+func (l *Libp2pPeer) newHeartbeat() HeartbeatMesage {
+	msg := HeartbeatMesage{
+		Type:                "heartbeat",
+		ClientVersion:       CLIENT_VERSION,
+		WireProtocolVersion: WIRE_PROTOCOL_VERSION,
+		TxFilter:            l.TxFilter,
+		Time:                time.Now(),
+		Services:            l.Services(),
+	}
+	if l.OnGetFullTip != nil {
+		hash, height := l.OnGetFullTip()
+		msg.TipHash = Bytes32ToHexString(hash)
+		msg.TipHeight = int(height)
+	}
+	return msg
+}
+
+// Records a peer's heartbeat, and replies with our own, echoing the peer's time so it can measure the round-trip time.
+func (l *Libp2pPeer) handleHeartbeat(from peer.ID, message []byte, codec WireCodec) (interface{}, error) {
+	var msg HeartbeatMesage
+	if err := codec.Unmarshal(message, &msg); err != nil {
+		return nil, err
+	}
+	l.updateHeartbeat(from, func(heartbeat *Peer) {
+		heartbeat.services = msg.Services
+		heartbeat.txFilter = parseTxFilter(msg)
+		heartbeat.recordHeartbeat(msg, time.Now())
+	})
+
+	reply := l.newHeartbeat()
+	reply.EchoTime = msg.Time
+	return reply, nil
+}
+
+// Sends a heartbeat to a peer, and records its reply.
+func (l *Libp2pPeer) sendHeartbeat(p Peer) error {
+	msg := l.newHeartbeat()
+	var reply HeartbeatMesage
+	if err := l.request(p, "heartbeat", msg, &reply); err != nil {
+		return err
+	}
+	receivedAt := time.Now()
+	rtt := receivedAt.Sub(msg.Time)
+
+	id, _ := peer.Decode(p.nodeID)
+	l.updateHeartbeat(id, func(heartbeat *Peer) {
+		heartbeat.services = reply.Services
+		heartbeat.txFilter = parseTxFilter(reply)
+		heartbeat.recordHeartbeat(reply, receivedAt)
+		heartbeat.recordLatency(rtt)
+		if !reply.Time.IsZero() {
+			heartbeat.recordTimeOffset(estimateTimeOffset(reply.Time, rtt, receivedAt))
+		}
+	})
+	return nil
+}
+
+// Updates the heartbeat state of a connected peer.
+func (l *Libp2pPeer) updateHeartbeat(id peer.ID, update func(heartbeat *Peer)) {
+	if l.host.Network().Connectedness(id) != network.Connected {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	heartbeat := l.heartbeats[id]
+	update(&heartbeat)
+	l.heartbeats[id] = heartbeat
+}
+
+// Sends heartbeats to peers, and disconnects peers which have stopped replying. Blocks until the peer is stopped.
+func (l *Libp2pPeer) heartbeatRoutine() {
+	for {
+		var wg sync.WaitGroup
+		for _, p := range l.Peers() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := l.sendHeartbeat(p); err != nil {
+					l.log.Printf("Failed to send heartbeat to peer: %v\n", err)
+				}
+			}()
+		}
+		wg.Wait()
+		l.evictStalePeers(time.Now())
+
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-time.After(time.Duration(l.HeartbeatIntervalSeconds) * time.Second):
+		}
+	}
+}
+
+// Disconnects peers which haven't replied to a heartbeat for HeartbeatTimeoutSeconds.
+func (l *Libp2pPeer) evictStalePeers(now time.Time) {
+	heartbeatTimeout := time.Duration(l.HeartbeatTimeoutSeconds) * time.Second
+	for _, p := range l.Peers() {
+		lastSeen := p.lastHeartbeat
+		if lastSeen.IsZero() {
+			lastSeen = p.connectedAt
+		}
+		if heartbeatTimeout < now.Sub(lastSeen) {
+			l.log.Printf("Disconnecting peer %s: no heartbeat since %s\n", p.nodeID, lastSeen)
+			l.RemovePeer(p.nodeID)
+		}
+	}
+}
+
+// Peer management.
+// ====================================================================================================================
+
+// Connects to the network through the given peers, as multiaddrs with a peer ID.
+func (l *Libp2pPeer) Bootstrap(peerInfos []string) {
+	l.log.Println("Bootstrapping network from peers...")
+
+	var wg sync.WaitGroup
+	for i, peerInfo := range peerInfos {
+		l.log.Printf("Connecting to bootstrap peer #%d at %s\n", i, peerInfo)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.AddPeer(peerInfo)
+		}()
+	}
+	wg.Wait()
+
+	// Join the DHT through the peers.
+	if err := l.dht.Bootstrap(l.ctx); err != nil {
+		l.log.Printf("Failed to bootstrap DHT: %v\n", err)
+	}
+	l.log.Println("Bootstrapping complete.")
+}
+
+// Advertises us under the rendezvous in the DHT, and connects to the peers advertised there while we have fewer than
+// TargetPeers. Blocks until the peer is stopped.
+func (l *Libp2pPeer) discoveryRoutine() {
+	advertiseAt := time.Time{}
+	for {
+		// The advertisement expires, so it's renewed before then. It fails until we've joined the DHT.
+		if !time.Now().Before(advertiseAt) {
+			if ttl, err := l.discovery.Advertise(l.ctx, l.Rendezvous); err == nil {
+				advertiseAt = time.Now().Add(ttl / 2)
+			}
+		}
+		if len(l.Peers()) < l.TargetPeers {
+			l.findPeers()
+		}
+
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-time.After(l.DiscoveryInterval):
+		}
+	}
+}
+
+// Connects to peers advertised under the rendezvous, until we have TargetPeers.
+func (l *Libp2pPeer) findPeers() {
+	ctx, cancel := context.WithTimeout(l.ctx, DEFAULT_PEER_REQUEST_TIMEOUT)
+	defer cancel()
+	infos, err := l.discovery.FindPeers(ctx, l.Rendezvous)
+	if err != nil {
+		return
+	}
+	for info := range infos {
+		if l.TargetPeers <= len(l.Peers()) {
+			return
+		}
+		if info.ID == l.host.ID() || len(info.Addrs) == 0 || l.host.Network().Connectedness(info.ID) == network.Connected {
+			continue
+		}
+		if err := l.host.Connect(ctx, info); err != nil {
+			continue
+		}
+		l.log.Printf("Discovered peer %s\n", info.ID)
+	}
+}
+
+func (l *Libp2pPeer) AddPeer(peerInfo string) error {
+	info, err := peer.AddrInfoFromString(peerInfo)
+	if err != nil {
+		return fmt.Errorf("Invalid peer address: %s", peerInfo)
+	}
+
+	ctx, cancel := context.WithTimeout(l.ctx, DEFAULT_PEER_REQUEST_TIMEOUT)
+	defer cancel()
+	if err := l.host.Connect(ctx, *info); err != nil {
+		l.log.Printf("Failed to connect to peer %s: %v\n", peerInfo, err)
+		return err
+	}
+	return nil
+}
+
+func (l *Libp2pPeer) RemovePeer(peerInfo string) error {
+	id, err := parseLibp2pPeerID(peerInfo)
+	if err != nil {
+		return err
+	}
+	return l.host.Network().ClosePeer(id)
+}
+
+// Returns the peers we're connected to which speak our protocol.
+func (l *Libp2pPeer) Peers() []Peer {
+	peers := []Peer{}
+	for _, id := range l.host.Network().Peers() {
+		if protocols, _ := l.host.Peerstore().SupportsProtocols(id, libp2pProtocol("get_tip")); len(protocols) == 0 {
+			continue
+		}
+		conns := l.host.Network().ConnsToPeer(id)
+		if len(conns) == 0 {
+			continue
+		}
+		conn := conns[0]
+
+		p := Peer{
+			url:         fmt.Sprintf("%s/p2p/%s", conn.RemoteMultiaddr(), id),
+			nodeID:      id.String(),
+			inbound:     conn.Stat().Direction == network.DirInbound,
+			connectedAt: conn.Stat().Opened,
+			latency:     l.host.Peerstore().LatencyEWMA(id),
+		}
+		if ip, err := manet.ToIP(conn.RemoteMultiaddr()); err == nil {
+			p.addr = ip.String()
+		}
+		if agent, err := l.host.Peerstore().Get(id, "AgentVersion"); err == nil {
+			p.clientVersion, _ = agent.(string)
+		}
+
+		l.mutex.Lock()
+		if heartbeat, ok := l.heartbeats[id]; ok {
+			p.services = heartbeat.services
+			p.txFilter = heartbeat.txFilter
+			p.tipHeight = heartbeat.tipHeight
+			p.tipHash = heartbeat.tipHash
+			p.protocolVersion = heartbeat.protocolVersion
+			p.lastHeartbeat = heartbeat.lastHeartbeat
+			p.tipAdvancedAt = heartbeat.tipAdvancedAt
+			p.timeOffset = heartbeat.timeOffset
+			p.timeOffsetKnown = heartbeat.timeOffsetKnown
+			if heartbeat.latency != 0 {
+				p.latency = heartbeat.latency
+			}
+		}
+		l.mutex.Unlock()
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Returns the estimated offsets of the peers' clocks from ours, for peers which have replied to a heartbeat.
+func (l *Libp2pPeer) PeerTimeOffsets() []time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	offsets := []time.Duration{}
+	for _, heartbeat := range l.heartbeats {
+		if heartbeat.timeOffsetKnown {
+			offsets = append(offsets, heartbeat.timeOffset)
+		}
+	}
+	return offsets
+}
+
+// Bans a peer for a duration, disconnecting it. A zero duration bans the peer permanently.
+func (l *Libp2pPeer) BanPeer(peerInfo string, duration time.Duration) error {
+	id, err := parseLibp2pPeerID(peerInfo)
+	if err != nil {
+		return err
+	}
+	l.banPeer(id, duration)
+	return nil
+}
+
+func (l *Libp2pPeer) banPeer(id peer.ID, duration time.Duration) {
+	until := time.Time{}
+	if duration != 0 {
+		until = time.Now().Add(duration)
+	}
+	l.mutex.Lock()
+	l.bannedPeers[id] = until
+	l.mutex.Unlock()
+
+	l.log.Printf("Banned peer %s until %s\n", id, until)
+	l.host.Network().ClosePeer(id)
+}
+
+func (l *Libp2pPeer) UnbanPeer(peerInfo string) error {
+	id, err := parseLibp2pPeerID(peerInfo)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.bannedPeers[id]; !ok {
+		return fmt.Errorf("Peer is not banned: %s", id)
+	}
+	delete(l.bannedPeers, id)
+	l.log.Printf("Unbanned peer %s\n", id)
+	return nil
+}
+
+// Returns the banned peer IDs, mapped to the time their ban expires.
+func (l *Libp2pPeer) BannedHosts() map[string]time.Time {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	bans := make(map[string]time.Time)
+	now := time.Now()
+	for id, until := range l.bannedPeers {
+		if until.IsZero() || now.Before(until) {
+			bans[id.String()] = until
+		}
+	}
+	return bans
+}
+
+func (l *Libp2pPeer) isBanned(id peer.ID) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	until, ok := l.bannedPeers[id]
+	return ok && (until.IsZero() || time.Now().Before(until))
+}
+
+func (l *Libp2pPeer) MisbehaviourScore(host string) int {
+	id, err := peer.Decode(host)
+	if err != nil {
+		return 0
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.misbehaviourScores[id]
+}
+
+// Penalises a peer for misbehaving, banning it once its score reaches MISBEHAVIOUR_BAN_SCORE.
+func (l *Libp2pPeer) Misbehaving(host string, score int, reason string) {
+	id, err := peer.Decode(host)
+	if err != nil {
+		return
+	}
+
+	l.mutex.Lock()
+	l.misbehaviourScores[id] += score
+	total := l.misbehaviourScores[id]
+	if MISBEHAVIOUR_BAN_SCORE <= total {
+		delete(l.misbehaviourScores, id)
+	}
+	l.mutex.Unlock()
+
+	l.log.Printf("Peer %s misbehaved (score %d, total %d): %s\n", id, score, total, reason)
+	if MISBEHAVIOUR_BAN_SCORE <= total {
+		l.banPeer(id, MISBEHAVIOUR_BAN_DURATION)
+	}
+}
+
+// Parses a peer ID, or a multiaddr ending in one.
+func parseLibp2pPeerID(peerInfo string) (peer.ID, error) {
+	if info, err := peer.AddrInfoFromString(peerInfo); err == nil {
+		return info.ID, nil
+	}
+	id, err := peer.Decode(peerInfo)
+	if err != nil {
+		return "", fmt.Errorf("Invalid peer ID: %s", peerInfo)
+	}
+	return id, nil
+}
+
+// Refuses connections to and from banned peers, and inbound connections the allowlist and denylist don't allow.
+type libp2pGater struct {
+	l *Libp2pPeer
+}
+
+func (g libp2pGater) InterceptPeerDial(id peer.ID) bool                    { return !g.l.isBanned(id) }
+func (g libp2pGater) InterceptAddrDial(id peer.ID, addr ma.Multiaddr) bool { return !g.l.isBanned(id) }
+func (g libp2pGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	host := ""
+	if ip, err := manet.ToIP(addrs.RemoteMultiaddr()); err == nil {
+		host = ip.String()
+	}
+	return isInboundAllowed(host, g.l.InboundAllowlist, g.l.InboundDenylist)
+}
+func (g libp2pGater) InterceptUpgraded(conn network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
+func (g libp2pGater) InterceptSecured(dir network.Direction, id peer.ID, addrs network.ConnMultiaddrs) bool {
+	return !g.l.isBanned(id)
+}
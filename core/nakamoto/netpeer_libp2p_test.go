@@ -0,0 +1,391 @@
+package nakamoto
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLibp2pPeer(t *testing.T) *Libp2pPeer {
+	peer := newUnstartedTestLibp2pPeer(t)
+	go peer.Start()
+	return peer
+}
+
+func newUnstartedTestLibp2pPeer(t *testing.T) *Libp2pPeer {
+	identity, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := NewPeerConfig("127.0.0.1", "0", []string{})
+	config.NoDiscoverIP = true
+	peer, err := NewLibp2pPeer(config, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(peer.Stop)
+	return peer
+}
+
+// Connects two libp2p peers, and waits until they're subscribed to each other's topics.
+func connectTestLibp2pPeers(t *testing.T, a *Libp2pPeer, b *Libp2pPeer) {
+	assert := assert.New(t)
+	assert.Nil(b.AddPeer(a.GetLocalAddr()))
+	assert.Eventually(func() bool {
+		return len(a.Peers()) == 1 && len(b.Peers()) == 1 &&
+			len(a.blocks.ListPeers()) == 1 && len(b.txs.ListPeers()) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestLibp2pPeerIDFromIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	identity, err := core.CreateRandomWallet()
+	assert.Nil(err)
+	config := NewPeerConfig("127.0.0.1", "0", []string{})
+	config.NoDiscoverIP = true
+	peer1, err := NewLibp2pPeer(config, identity)
+	assert.Nil(err)
+	peer1.Stop()
+	peer2, err := NewLibp2pPeer(config, identity)
+	assert.Nil(err)
+	peer2.Stop()
+
+	// The peer ID is derived from the node identity, so it persists across restarts.
+	assert.Equal(peer1.PeerID(), peer2.PeerID())
+}
+
+func TestLibp2pPeerDiscovery(t *testing.T) {
+	assert := assert.New(t)
+
+	// Two peers which only know the bootstrap peer find each other through the DHT.
+	peers := []*Libp2pPeer{}
+	for i := 0; i < 3; i++ {
+		peer := newUnstartedTestLibp2pPeer(t)
+		peer.Rendezvous = Libp2pRendezvous(ConsensusConfig{GenesisParentBlockHash: [32]byte{1}})
+		peer.DiscoveryInterval = 100 * time.Millisecond
+		go peer.Start()
+		peers = append(peers, peer)
+	}
+	peers[1].Bootstrap([]string{peers[0].GetLocalAddr()})
+	peers[2].Bootstrap([]string{peers[0].GetLocalAddr()})
+
+	isConnected := func(a *Libp2pPeer, b *Libp2pPeer) bool {
+		for _, remote := range a.Peers() {
+			if remote.nodeID == b.PeerID() {
+				return true
+			}
+		}
+		return false
+	}
+	assert.Eventually(func() bool {
+		return isConnected(peers[1], peers[2]) && isConnected(peers[2], peers[1])
+	}, 20*time.Second, 50*time.Millisecond)
+
+	// They advertise themselves under the rendezvous.
+	infos, err := peers[1].discovery.FindPeers(peers[1].ctx, peers[1].Rendezvous)
+	assert.Nil(err)
+	found := map[string]bool{}
+	for info := range infos {
+		found[info.ID.String()] = true
+	}
+	assert.True(found[peers[2].PeerID()])
+}
+
+func TestLibp2pPeerQuic(t *testing.T) {
+	assert := assert.New(t)
+
+	peer1 := newTestLibp2pPeer(t)
+	peer2 := newTestLibp2pPeer(t)
+	quicAddr := ""
+	for _, addr := range peer1.host.Addrs() {
+		if _, err := addr.ValueForProtocol(ma.P_QUIC_V1); err == nil {
+			quicAddr = fmt.Sprintf("%s/p2p/%s", addr, peer1.PeerID())
+		}
+	}
+	assert.NotEqual("", quicAddr)
+
+	// Peers connect over QUIC when dialled on its address.
+	assert.Nil(peer2.AddPeer(quicAddr))
+	conns := peer2.host.Network().ConnsToPeer(peer1.host.ID())
+	assert.Equal(1, len(conns))
+	_, err := conns[0].RemoteMultiaddr().ValueForProtocol(ma.P_QUIC_V1)
+	assert.Nil(err)
+
+	// QUIC can be disabled.
+	assert.Equal([]string{"/ip4/127.0.0.1/tcp/0"}, libp2pListenAddrs(PeerConfig{address: "127.0.0.1", port: "0", NoQuic: true}))
+}
+
+func TestLibp2pPeerHeartbeats(t *testing.T) {
+	assert := assert.New(t)
+
+	peer1 := newUnstartedTestLibp2pPeer(t)
+	peer2 := newUnstartedTestLibp2pPeer(t)
+	peer1.OnGetFullTip = func() ([32]byte, uint64) {
+		return [32]byte{1}, 5
+	}
+	for _, peer := range []*Libp2pPeer{peer1, peer2} {
+		peer.HeartbeatIntervalSeconds = 1
+		go peer.Start()
+	}
+	connectTestLibp2pPeers(t, peer1, peer2)
+
+	// Heartbeats tell peers each other's tips and services, and measure their clock offsets.
+	assert.Eventually(func() bool {
+		return len(peer2.PeerTimeOffsets()) == 1 && len(peer1.PeerTimeOffsets()) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	remote := peer2.Peers()[0]
+	assert.Equal(uint64(5), remote.tipHeight)
+	assert.Equal(Bytes32ToHexString([32]byte{1}), remote.tipHash)
+	assert.Equal(NODE_SERVICE_TX_RELAY, remote.services)
+	assert.False(remote.lastHeartbeat.IsZero())
+	assert.Less(peer2.PeerTimeOffsets()[0].Abs(), time.Second)
+
+	// Peers are disconnected when their heartbeats stop.
+	peer2.evictStalePeers(time.Now())
+	assert.Equal(1, len(peer2.Peers()))
+	peer2.evictStalePeers(time.Now().Add(time.Duration(peer2.HeartbeatTimeoutSeconds+1) * time.Second))
+	assert.Equal(0, len(peer2.Peers()))
+	assert.Eventually(func() bool {
+		return len(peer2.PeerTimeOffsets()) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestLibp2pPeerGossip(t *testing.T) {
+	assert := assert.New(t)
+
+	peer1 := newTestLibp2pPeer(t)
+	peer2 := newTestLibp2pPeer(t)
+	txs := make(chan RawTransaction, 100)
+	peer1.OnNewTransaction = func(tx RawTransaction) {
+		txs <- tx
+	}
+	connectTestLibp2pPeers(t, peer1, peer2)
+
+	// Gossipsub sets up its streams to a new peer in the background, so gossip new transactions until one arrives.
+	sent := map[[32]byte]bool{}
+	assert.Eventually(func() bool {
+		tx := RawTransaction{Amount: uint64(len(sent) + 1)}
+		sent[tx.Hash()] = true
+		peer2.GossipTransaction(tx)
+		select {
+		case got := <-txs:
+			return sent[got.Hash()]
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestLibp2pPeerRejectsInvalidTransactions(t *testing.T) {
+	assert := assert.New(t)
+
+	peer1 := newTestLibp2pPeer(t)
+	peer2 := newTestLibp2pPeer(t)
+	peer1.OnPrecheckTransaction = func(tx RawTransaction) error {
+		if tx.Fee == 0 {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	txs := make(chan RawTransaction, 100)
+	peer1.OnNewTransaction = func(tx RawTransaction) {
+		txs <- tx
+	}
+	connectTestLibp2pPeers(t, peer1, peer2)
+
+	// Gossip invalid transactions along with valid ones, until a valid one arrives. None of the invalid ones do.
+	amount := uint64(0)
+	assert.Eventually(func() bool {
+		amount++
+		peer2.GossipTransaction(RawTransaction{Amount: amount})
+		peer2.GossipTransaction(RawTransaction{Amount: amount, Fee: 1})
+		return 0 < len(txs)
+	}, 10*time.Second, 100*time.Millisecond)
+	for 0 < len(txs) {
+		assert.NotEqual(uint64(0), (<-txs).Fee)
+	}
+}
+
+func TestLibp2pPeerBlocksOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	peer1 := newUnstartedTestLibp2pPeer(t)
+	peer1.BlocksOnly = true
+	go peer1.Start()
+	peer2 := newTestLibp2pPeer(t)
+	peer1.OnNewTransaction = func(tx RawTransaction) {
+		t.Error("Transaction was handled in blocks-only mode")
+	}
+	txs := make(chan RawTransaction, 100)
+	peer2.OnNewTransaction = func(tx RawTransaction) {
+		txs <- tx
+	}
+	assert.Nil(peer2.AddPeer(peer1.GetLocalAddr()))
+	assert.Eventually(func() bool {
+		return len(peer1.txs.ListPeers()) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// We don't receive transactions, but still publish our own.
+	amount := uint64(0)
+	assert.Eventually(func() bool {
+		amount++
+		peer2.GossipTransaction(RawTransaction{Amount: amount})
+		peer1.GossipTransaction(RawTransaction{Amount: amount, Fee: 1})
+		return 0 < len(txs)
+	}, 10*time.Second, 100*time.Millisecond)
+	assert.Equal(uint64(0), peer1.Services()&NODE_SERVICE_TX_RELAY)
+}
+
+func TestLibp2pPeerTxFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	peer1 := newUnstartedTestLibp2pPeer(t)
+	peer1.TxFilter = NewPubkeyBloomFilter([][65]byte{wallets[0].PubkeyBytes()}, 0.0001)
+	go peer1.Start()
+	peer2 := newTestLibp2pPeer(t)
+	txs := make(chan RawTransaction, 100)
+	peer1.OnNewTransaction = func(tx RawTransaction) {
+		txs <- tx
+	}
+	connectTestLibp2pPeers(t, peer1, peer2)
+
+	// Only transactions matching the filter are handled.
+	amount := uint64(0)
+	assert.Eventually(func() bool {
+		amount++
+		peer2.GossipTransaction(RawTransaction{Amount: amount, FromPubkey: wallets[1].PubkeyBytes()})
+		peer2.GossipTransaction(RawTransaction{Amount: amount, FromPubkey: wallets[0].PubkeyBytes()})
+		return 0 < len(txs)
+	}, 10*time.Second, 100*time.Millisecond)
+	for 0 < len(txs) {
+		assert.Equal(wallets[0].PubkeyBytes(), (<-txs).FromPubkey)
+	}
+	assert.Equal(peer1.TxFilter, peer1.newHeartbeat().TxFilter)
+}
+
+func TestLibp2pPeerInboundFilters(t *testing.T) {
+	assert := assert.New(t)
+
+	peer1 := newUnstartedTestLibp2pPeer(t)
+	peer2 := newUnstartedTestLibp2pPeer(t)
+	peer3 := newTestLibp2pPeer(t)
+	var err error
+	peer1.InboundDenylist, err = ParseCIDRs([]string{"127.0.0.0/8"})
+	assert.Nil(err)
+	peer2.InboundAllowlist, err = ParseCIDRs([]string{"127.0.0.1"})
+	assert.Nil(err)
+	go peer1.Start()
+	go peer2.Start()
+
+	// Connections from the denylist are refused.
+	assert.NotNil(peer3.AddPeer(peer1.GetLocalAddr()))
+	assert.Equal(0, len(peer1.Peers()))
+
+	// Connections from the allowlist are accepted.
+	connectTestLibp2pPeers(t, peer2, peer3)
+	assert.False(isInboundAllowed("10.0.0.1", peer2.InboundAllowlist, peer2.InboundDenylist))
+}
+
+func TestLibp2pPeerExternalAddrs(t *testing.T) {
+	assert := assert.New(t)
+
+	identity, err := core.CreateRandomWallet()
+	assert.Nil(err)
+	config := NewPeerConfig("127.0.0.1", "0", []string{})
+	config.NoDiscoverIP = true
+	config.ExternalAddrs = []string{"1.2.3.4:1234", "[2001:db8::1]:1234"}
+	peer, err := NewLibp2pPeer(config, identity)
+	assert.Nil(err)
+	defer peer.Stop()
+
+	// The external addresses are advertised instead of the listen addresses.
+	addrs := []string{}
+	for _, addr := range peer.host.Addrs() {
+		addrs = append(addrs, addr.String())
+	}
+	assert.Equal([]string{
+		"/ip4/1.2.3.4/tcp/1234",
+		"/ip4/1.2.3.4/udp/1234/quic-v1",
+		"/ip6/2001:db8::1/tcp/1234",
+		"/ip6/2001:db8::1/udp/1234/quic-v1",
+	}, addrs)
+
+	// Hostnames are advertised as DNS addresses.
+	config.ExternalAddrs = []string{"node.example.com:1234"}
+	config.NoQuic = true
+	got, err := libp2pExternalAddrs(config)
+	assert.Nil(err)
+	assert.Equal("/dns/node.example.com/tcp/1234", got[0].String())
+	assert.Equal(1, len(got))
+}
+
+func TestLibp2pPeerBansInvalidBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	peer1 := newTestLibp2pPeer(t)
+	peer2 := newTestLibp2pPeer(t)
+	peer1.OnPrecheckBlock = func(block RawBlock) error {
+		return ErrBlockPOWInvalid
+	}
+	peer1.OnNewBlock = func(block RawBlock) error {
+		t.Error("Block with invalid POW was handled")
+		return nil
+	}
+	connectTestLibp2pPeers(t, peer1, peer2)
+
+	// The peer which relayed the block is banned and disconnected.
+	nonce := byte(0)
+	assert.Eventually(func() bool {
+		nonce++
+		peer2.GossipBlock(RawBlock{BlockHeader: BlockHeader{Nonce: [32]byte{nonce}}})
+		_, banned := peer1.BannedHosts()[peer2.PeerID()]
+		return banned && len(peer1.Peers()) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// It can't reconnect until it's unbanned.
+	peer2.AddPeer(peer1.GetLocalAddr())
+	assert.Never(func() bool {
+		return len(peer1.Peers()) != 0
+	}, 500*time.Millisecond, 10*time.Millisecond)
+	assert.Nil(peer1.UnbanPeer(peer2.PeerID()))
+	assert.Nil(peer2.AddPeer(peer1.GetLocalAddr()))
+	assert.Eventually(func() bool {
+		return len(peer1.Peers()) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestLibp2pPeerRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	peer1 := newTestLibp2pPeer(t)
+	peer2 := newTestLibp2pPeer(t)
+	tip := BlockHeader{Nonce: [32]byte{1}, Graffiti: [32]byte{2}}
+	peer1.OnGetTip = func(msg GetTipMessage) (BlockHeader, error) {
+		return tip, nil
+	}
+	peer1.OnHasBlock = func(blockhash [32]byte) bool {
+		return blockhash == tip.BlockHash()
+	}
+	connectTestLibp2pPeers(t, peer1, peer2)
+	remote := peer2.Peers()[0]
+	assert.Equal(peer1.PeerID(), remote.nodeID)
+	assert.Equal(CLIENT_VERSION, remote.clientVersion)
+
+	got, err := peer2.GetTip(remote)
+	assert.Nil(err)
+	assert.Equal(tip.BlockHash(), got.BlockHash())
+
+	has, err := peer2.HasBlock(remote, tip.BlockHash())
+	assert.Nil(err)
+	assert.True(has)
+
+	// Errors from the handlers are returned to the requester.
+	_, err = peer2.GetCheckpoints(remote, 0, 0)
+	assert.ErrorContains(err, "Checkpoint interval must be positive.")
+}
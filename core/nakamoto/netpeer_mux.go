@@ -0,0 +1,755 @@
+package nakamoto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Messages to a peer are multiplexed as streams over a single long-lived TCP connection, rather than opening a new
+// connection for each request. This saves the TCP handshake on every heartbeat and gossip message, and keeps the number
+// of NAT mappings and sockets in TIME_WAIT down to one per peer. Each message and its reply is a stream, and streams
+// are split into frames which are interleaved on the connection, so a heartbeat isn't stuck behind a bulk block transfer.
+//
+// The connection is set up by upgrading an HTTP request to /peerapi/mux, like a WebSocket, so it shares the peer
+// server's port, and peers which don't support it are sent messages over plain HTTP as before. Each stream carries the
+// same headers and body as the HTTP message would, and the server handles it with the same inbox handler, so signing,
+// wire encodings, compression and limits work the same either way. The client of a connection opens the streams, and
+// the server replies on them, so there's a connection in each direction between two peers which message each other.
+//
+// A frame is:
+//
+//	stream ID (u32) || type (u8) || flags (u8) || length (u32) || payload
+//
+// A stream is a HEADERS frame, with the JSON-encoded status and headers, followed by DATA frames with the body. The last
+// frame of a message has the FIN flag set. A RESET frame aborts a stream, ie. when the client gives up waiting for the
+// reply, or the server has too many streams open.
+//
+// A message is buffered until it's received in full, so the bytes buffered across the streams of a connection are
+// capped, and a message must arrive in full within a deadline of its stream being opened. Otherwise a peer could hold
+// MAX_PEER_MUX_STREAMS messages of MAX_MESSAGE_SIZE open indefinitely, by trickling frames.
+
+const (
+	// The path a peer requests to upgrade to a multiplexed connection, and the protocol it upgrades to.
+	PEER_MUX_PATH     = "/peerapi/mux"
+	PEER_MUX_PROTOCOL = "tinychain-mux/1"
+
+	// The maximum payload of a frame. Larger messages are split into several frames.
+	PEER_MUX_FRAME_SIZE = 64 * 1024
+	// The maximum number of streams open on a connection at once.
+	MAX_PEER_MUX_STREAMS = 256
+	// The maximum number of bytes of messages buffered on a connection at once, across its streams. A stream which would
+	// go over it is reset.
+	MAX_PEER_MUX_BUFFERED = 2 * MAX_MESSAGE_SIZE
+	// How long a message can take to arrive in full once its stream is opened, before the stream is reset.
+	PEER_MUX_STREAM_TIMEOUT = PEER_REQUEST_TIMEOUT
+	// How long a connection can go without a message arriving in full before the server closes it. Clients stop using a
+	// connection after half this, so they don't send a message just as it's closed.
+	PEER_MUX_IDLE_TIMEOUT = 2 * time.Minute
+	// How long we wait to connect to a peer.
+	PEER_MUX_DIAL_TIMEOUT = 10 * time.Second
+	// How long before we retry upgrading the connection to a peer which didn't support it.
+	PEER_MUX_RETRY_UNSUPPORTED = 10 * time.Minute
+)
+
+const (
+	muxFrameHeaders = 1
+	muxFrameData    = 2
+	muxFrameReset   = 3
+
+	// The last frame of a message.
+	muxFlagFin = 1
+
+	muxFrameHeaderSize = 4 + 1 + 1 + 4
+)
+
+var errMuxSessionClosed = errors.New("mux connection closed")
+var errMuxStreamReset = errors.New("mux stream reset by peer")
+var errMuxStreamTimeout = errors.New("mux stream timed out")
+var errMuxUnsupported = errors.New("peer doesn't support mux connections")
+
+// The head of a message on a stream.
+type muxHead struct {
+	// The status code of a reply.
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header"`
+}
+
+type muxStream struct {
+	head    muxHead
+	gotHead bool
+	body    bytes.Buffer
+	// Resets the stream if the message hasn't been received in full by the deadline.
+	timer *time.Timer
+	// Closed when the message has been received in full, or the stream is aborted, with err set.
+	done chan struct{}
+	err  error
+}
+
+// A multiplexed connection to a peer.
+type muxSession struct {
+	conn net.Conn
+	br   *bufio.Reader
+	// Whether we're the server of the connection, which handles the streams the client opens.
+	isServer bool
+	// Handles the requests on streams opened by the client, when we're the server.
+	handler func(head muxHead, body []byte) (muxHead, []byte)
+	// The maximum payload of a frame.
+	frameSize int
+
+	streams       map[uint32]*muxStream
+	nextStreamID  uint32
+	activeStreams int
+	// The bytes of messages buffered on the connection, including those being handled when we're the server.
+	buffered   int
+	lastUsed   time.Time
+	closed     bool
+	mutex      sync.Mutex
+	writeMutex sync.Mutex
+}
+
+func newMuxSession(conn net.Conn, br *bufio.Reader, isServer bool) *muxSession {
+	return &muxSession{
+		conn:         conn,
+		br:           br,
+		isServer:     isServer,
+		frameSize:    PEER_MUX_FRAME_SIZE,
+		streams:      map[uint32]*muxStream{},
+		nextStreamID: 1,
+		lastUsed:     time.Now(),
+	}
+}
+
+// Writes a frame. Frames of different streams are interleaved.
+func (s *muxSession) writeFrame(streamID uint32, frameType byte, flags byte, payload []byte) error {
+	buf := make([]byte, 0, muxFrameHeaderSize+len(payload))
+	buf = binary.BigEndian.AppendUint32(buf, streamID)
+	buf = append(buf, frameType, flags)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = append(buf, payload...)
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(PEER_REQUEST_TIMEOUT))
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+// Writes a message on a stream, as a HEADERS frame followed by DATA frames.
+func (s *muxSession) writeMessage(streamID uint32, head muxHead, body []byte) error {
+	headBuf, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	flags := byte(0)
+	if len(body) == 0 {
+		flags = muxFlagFin
+	}
+	if err := s.writeFrame(streamID, muxFrameHeaders, flags, headBuf); err != nil {
+		return err
+	}
+	for 0 < len(body) {
+		chunk := body
+		if s.frameSize < len(chunk) {
+			chunk = chunk[:s.frameSize]
+		}
+		body = body[len(chunk):]
+		flags := byte(0)
+		if len(body) == 0 {
+			flags = muxFlagFin
+		}
+		if err := s.writeFrame(streamID, muxFrameData, flags, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads frames until the connection is closed, dispatching them to their streams.
+func (s *muxSession) readLoop() {
+	defer s.Close()
+
+	header := make([]byte, muxFrameHeaderSize)
+	if s.isServer {
+		s.conn.SetReadDeadline(time.Now().Add(PEER_MUX_IDLE_TIMEOUT))
+	}
+	for {
+		if _, err := io.ReadFull(s.br, header); err != nil {
+			return
+		}
+		streamID := binary.BigEndian.Uint32(header[0:4])
+		frameType, flags := header[4], header[5]
+		length := binary.BigEndian.Uint32(header[6:10])
+		if uint32(s.frameSize) < length {
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(s.br, payload); err != nil {
+			return
+		}
+		complete, err := s.handleFrame(streamID, frameType, flags, payload)
+		if err != nil {
+			return
+		}
+		// The connection is only kept open by messages arriving in full, not by a trickle of frames.
+		if s.isServer && complete {
+			s.conn.SetReadDeadline(time.Now().Add(PEER_MUX_IDLE_TIMEOUT))
+		}
+	}
+}
+
+// Handles a frame, returning whether it completed a message.
+func (s *muxSession) handleFrame(streamID uint32, frameType byte, flags byte, payload []byte) (bool, error) {
+	s.mutex.Lock()
+	stream, ok := s.streams[streamID]
+
+	if frameType == muxFrameReset {
+		if ok {
+			s.dropStream(streamID, stream, errMuxStreamReset)
+		}
+		s.mutex.Unlock()
+		return false, nil
+	}
+
+	if !ok {
+		// Clients open streams, and servers reply on them. Frames for streams a client has given up on are dropped.
+		if !s.isServer || frameType != muxFrameHeaders {
+			s.mutex.Unlock()
+			return false, nil
+		}
+		if MAX_PEER_MUX_STREAMS <= s.activeStreams {
+			s.mutex.Unlock()
+			return false, s.writeFrame(streamID, muxFrameReset, 0, nil)
+		}
+		stream = s.openStream(streamID)
+		s.activeStreams++
+	}
+
+	switch {
+	case frameType == muxFrameHeaders && !stream.gotHead:
+		if err := json.Unmarshal(payload, &stream.head); err != nil {
+			s.mutex.Unlock()
+			return false, fmt.Errorf("invalid mux headers: %v", err)
+		}
+		stream.gotHead = true
+	case frameType == muxFrameData && stream.gotHead:
+		err := error(nil)
+		if MAX_MESSAGE_SIZE < stream.body.Len()+len(payload) {
+			err = fmt.Errorf("message too large, max is %d bytes", MAX_MESSAGE_SIZE)
+		} else if MAX_PEER_MUX_BUFFERED < s.buffered+len(payload) {
+			err = fmt.Errorf("too many bytes buffered on the connection, max is %d bytes", MAX_PEER_MUX_BUFFERED)
+		}
+		if err != nil {
+			s.dropStream(streamID, stream, err)
+			s.mutex.Unlock()
+			return false, s.writeFrame(streamID, muxFrameReset, 0, nil)
+		}
+		stream.body.Write(payload)
+		s.buffered += len(payload)
+	default:
+		s.mutex.Unlock()
+		return false, fmt.Errorf("unexpected mux frame type %d", frameType)
+	}
+
+	if flags&muxFlagFin == 0 {
+		s.mutex.Unlock()
+		return false, nil
+	}
+	delete(s.streams, streamID)
+	stream.timer.Stop()
+	if !s.isServer {
+		// The reply is handed over to the caller.
+		s.buffered -= stream.body.Len()
+	}
+	s.mutex.Unlock()
+
+	if s.isServer {
+		go s.serveStream(streamID, stream)
+	} else {
+		s.finishStream(stream, nil)
+	}
+	return true, nil
+}
+
+// Opens a stream, which is reset if its message doesn't arrive by the deadline. Called with the mutex held.
+func (s *muxSession) openStream(streamID uint32) *muxStream {
+	stream := &muxStream{done: make(chan struct{})}
+	stream.timer = time.AfterFunc(PEER_MUX_STREAM_TIMEOUT, func() {
+		s.expireStream(streamID, stream)
+	})
+	s.streams[streamID] = stream
+	return stream
+}
+
+// Removes a stream before its message has arrived in full, and aborts it. Called with the mutex held.
+func (s *muxSession) dropStream(streamID uint32, stream *muxStream, err error) {
+	delete(s.streams, streamID)
+	stream.timer.Stop()
+	if s.isServer {
+		s.activeStreams--
+	}
+	s.buffered -= stream.body.Len()
+	s.finishStream(stream, err)
+}
+
+// Resets a stream whose message didn't arrive by the deadline.
+func (s *muxSession) expireStream(streamID uint32, stream *muxStream) {
+	s.mutex.Lock()
+	if s.streams[streamID] != stream {
+		s.mutex.Unlock()
+		return
+	}
+	s.dropStream(streamID, stream, errMuxStreamTimeout)
+	s.mutex.Unlock()
+	s.writeFrame(streamID, muxFrameReset, 0, nil)
+}
+
+func (s *muxSession) finishStream(stream *muxStream, err error) {
+	stream.err = err
+	close(stream.done)
+}
+
+// Handles a request on a stream, and writes the reply.
+func (s *muxSession) serveStream(streamID uint32, stream *muxStream) {
+	defer func() {
+		s.mutex.Lock()
+		s.activeStreams--
+		s.buffered -= stream.body.Len()
+		s.mutex.Unlock()
+	}()
+	head, body := s.handler(stream.head, stream.body.Bytes())
+	if err := s.writeMessage(streamID, head, body); err != nil {
+		s.Close()
+	}
+}
+
+// Sends a request on a new stream, and waits for the reply.
+func (s *muxSession) roundTrip(req *http.Request) (*http.Response, error) {
+	body := []byte{}
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, errMuxSessionClosed
+	}
+	streamID := s.nextStreamID
+	s.nextStreamID++
+	stream := s.openStream(streamID)
+	s.lastUsed = time.Now()
+	s.mutex.Unlock()
+
+	// The request can't have been handled if it wasn't written in full, so it's safe to retry.
+	if err := s.writeMessage(streamID, muxHead{Header: req.Header}, body); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("%w: %v", errMuxSessionClosed, err)
+	}
+
+	select {
+	case <-stream.done:
+	case <-req.Context().Done():
+		s.mutex.Lock()
+		if s.streams[streamID] == stream {
+			s.dropStream(streamID, stream, req.Context().Err())
+		}
+		s.mutex.Unlock()
+		s.writeFrame(streamID, muxFrameReset, 0, nil)
+		return nil, req.Context().Err()
+	}
+	if stream.err != nil {
+		return nil, stream.err
+	}
+
+	s.mutex.Lock()
+	s.lastUsed = time.Now()
+	s.mutex.Unlock()
+
+	return newStreamResponse(req, stream.head, stream.body.Bytes()), nil
+}
+
+// Returns the reply to a request on a stream as an HTTP response.
+func newStreamResponse(req *http.Request, head muxHead, reply []byte) *http.Response {
+	header := head.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", head.Status, http.StatusText(head.Status)),
+		StatusCode:    head.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(reply)),
+		ContentLength: int64(len(reply)),
+		Request:       req,
+	}
+}
+
+// Returns whether the session can take new streams.
+func (s *muxSession) isUsable() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !s.closed && time.Since(s.lastUsed) < PEER_MUX_IDLE_TIMEOUT/2
+}
+
+// Reads the replies to our requests until the connection is closed.
+func (s *muxSession) run() {
+	s.readLoop()
+}
+
+// Closes the connection, aborting its open streams.
+func (s *muxSession) Close() {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	streams := s.streams
+	s.streams = map[uint32]*muxStream{}
+	s.mutex.Unlock()
+
+	s.conn.Close()
+	for _, stream := range streams {
+		stream.timer.Stop()
+		if !s.isServer {
+			s.finishStream(stream, errMuxSessionClosed)
+		}
+	}
+}
+
+// The client.
+// =====================================================================================================================
+
+// A connection to a peer which messages are sent on as streams, either multiplexed over TCP, or over QUIC (see
+// netpeer_quic.go).
+type peerSession interface {
+	// Sends a request on a new stream, and waits for the reply.
+	roundTrip(req *http.Request) (*http.Response, error)
+	// Returns whether the session can take new streams.
+	isUsable() bool
+	// Runs until the connection is closed.
+	run()
+	Close()
+}
+
+// An HTTP transport which sends requests to peers over multiplexed connections, falling back to plain HTTP for peers
+// which don't support them. Peers which advertise NODE_SERVICE_QUIC are dialed over QUIC, falling back to TCP.
+type peerMuxTransport struct {
+	fallback http.RoundTripper
+
+	// The connections to peers by host, which are being dialed until ready is closed.
+	conns map[string]*peerMuxConn
+	// The hosts which didn't support the upgrade, and when to try again.
+	unsupported map[string]time.Time
+	// The hosts which advertised QUIC support, with the node identity their certificate must be for.
+	quicHosts map[string]quicHost
+	mutex     sync.Mutex
+}
+
+type peerMuxConn struct {
+	session peerSession
+	// Whether the session is over QUIC.
+	quic  bool
+	err   error
+	ready chan struct{}
+}
+
+func newPeerMuxTransport(fallback http.RoundTripper) *peerMuxTransport {
+	return &peerMuxTransport{
+		fallback:    fallback,
+		conns:       map[string]*peerMuxConn{},
+		unsupported: map[string]time.Time{},
+		quicHosts:   map[string]quicHost{},
+	}
+}
+
+func (t *peerMuxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "http" {
+		return t.fallback.RoundTrip(req)
+	}
+
+	// A request which couldn't be sent because the connection closed is retried once on a new connection.
+	for attempt := 0; attempt < 2; attempt++ {
+		session, err := t.getSession(req.Context(), req.URL.Host)
+		if errors.Is(err, errMuxUnsupported) {
+			return t.fallback.RoundTrip(req)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res, err := session.roundTrip(req)
+		if errors.Is(err, errMuxSessionClosed) && attempt == 0 && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return res, err
+	}
+	return nil, errMuxSessionClosed
+}
+
+// Gets the connection to a host, dialing it if there's none.
+func (t *peerMuxTransport) getSession(ctx context.Context, host string) (peerSession, error) {
+	t.mutex.Lock()
+	if retryAt, ok := t.unsupported[host]; ok {
+		if time.Now().Before(retryAt) {
+			t.mutex.Unlock()
+			return nil, errMuxUnsupported
+		}
+		delete(t.unsupported, host)
+	}
+	useQuic := t.canDialQuic(host)
+	conn, ok := t.conns[host]
+	if ok {
+		select {
+		case <-conn.ready:
+			if conn.err != nil || !conn.session.isUsable() {
+				if conn.session != nil {
+					conn.session.Close()
+				}
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		conn = &peerMuxConn{quic: useQuic, ready: make(chan struct{})}
+		t.conns[host] = conn
+		go t.dial(conn, host)
+	}
+	t.mutex.Unlock()
+
+	select {
+	case <-conn.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return conn.session, conn.err
+}
+
+// Dials a host over QUIC if it supports it, otherwise over TCP, upgrading the connection.
+func (t *peerMuxTransport) dial(conn *peerMuxConn, host string) {
+	if conn.quic {
+		t.mutex.Lock()
+		nodeID := t.quicHosts[host].nodeID
+		t.mutex.Unlock()
+		var session *quicSession
+		session, conn.err = dialPeerQuic(host, nodeID)
+		if session != nil {
+			conn.session = session
+		} else {
+			t.mutex.Lock()
+			if h, ok := t.quicHosts[host]; ok {
+				h.retryAt = time.Now().Add(PEER_MUX_RETRY_UNSUPPORTED)
+				t.quicHosts[host] = h
+			}
+			conn.quic = false
+			t.mutex.Unlock()
+		}
+	}
+	if !conn.quic {
+		var session *muxSession
+		session, conn.err = dialPeerMux(host)
+		if session != nil {
+			conn.session = session
+		}
+	}
+
+	t.mutex.Lock()
+	if conn.err != nil {
+		if t.conns[host] == conn {
+			delete(t.conns, host)
+		}
+		if errors.Is(conn.err, errMuxUnsupported) {
+			t.unsupported[host] = time.Now().Add(PEER_MUX_RETRY_UNSUPPORTED)
+		}
+	}
+	t.mutex.Unlock()
+	close(conn.ready)
+
+	if conn.session != nil {
+		conn.session.run()
+		t.mutex.Lock()
+		if t.conns[host] == conn {
+			delete(t.conns, host)
+		}
+		t.mutex.Unlock()
+	}
+}
+
+func dialPeerMux(host string) (*muxSession, error) {
+	netConn, err := net.DialTimeout("tcp", host, PEER_MUX_DIAL_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+PEER_MUX_PATH, nil)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", PEER_MUX_PROTOCOL)
+
+	netConn.SetDeadline(time.Now().Add(PEER_MUX_DIAL_TIMEOUT))
+	if err := req.Write(netConn); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(netConn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Upgrade") != PEER_MUX_PROTOCOL {
+		netConn.Close()
+		return nil, fmt.Errorf("%w: status=%d", errMuxUnsupported, res.StatusCode)
+	}
+	netConn.SetDeadline(time.Time{})
+
+	return newMuxSession(netConn, br, false), nil
+}
+
+// Closes the connection to a peer, if there's one.
+func (t *peerMuxTransport) closePeer(peerUrl string) {
+	u, err := url.Parse(peerUrl)
+	if err != nil {
+		return
+	}
+	t.mutex.Lock()
+	conn, ok := t.conns[u.Host]
+	delete(t.conns, u.Host)
+	t.mutex.Unlock()
+	if !ok {
+		return
+	}
+	go func() {
+		<-conn.ready
+		if conn.session != nil {
+			conn.session.Close()
+		}
+	}()
+}
+
+// The server.
+// =====================================================================================================================
+
+// Handler for /peerapi/mux, which upgrades the connection and serves messages on it with the inbox handler.
+func (s *PeerServer) muxHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || r.Header.Get("Upgrade") != PEER_MUX_PROTOCOL {
+		http.Error(w, "Expected upgrade to "+PEER_MUX_PROTOCOL, http.StatusBadRequest)
+		return
+	}
+	if s.AllowRequest != nil && !s.AllowRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		s.log.Printf("Failed to upgrade connection: %s\n", err)
+		return
+	}
+
+	// Clear the deadlines set by the HTTP server, which is done with the connection.
+	conn.SetDeadline(time.Time{})
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + PEER_MUX_PROTOCOL + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+
+	session := newMuxSession(conn, rw.Reader, true)
+	session.handler = func(head muxHead, body []byte) (muxHead, []byte) {
+		return s.handleStreamMessage(head, body, r.RemoteAddr, r.Host)
+	}
+
+	s.muxMutex.Lock()
+	s.muxSessions[session] = true
+	s.muxMutex.Unlock()
+
+	session.readLoop()
+
+	s.muxMutex.Lock()
+	delete(s.muxSessions, session)
+	s.muxMutex.Unlock()
+}
+
+// Handles a message received on a stream from a peer at remoteAddr, with the inbox handler, returning its reply.
+func (s *PeerServer) handleStreamMessage(head muxHead, body []byte, remoteAddr string, host string) (muxHead, []byte) {
+	req, err := http.NewRequest(http.MethodPost, "/peerapi/inbox", bytes.NewReader(body))
+	if err != nil {
+		return muxHead{Status: http.StatusBadRequest}, nil
+	}
+	if head.Header != nil {
+		req.Header = head.Header
+	}
+	req.RemoteAddr = remoteAddr
+	req.Host = host
+
+	res := &muxResponseWriter{header: http.Header{}}
+	s.inboxHandler(res, req)
+	if res.status == 0 {
+		res.status = http.StatusOK
+	}
+	return muxHead{Status: res.status, Header: res.header}, res.body.Bytes()
+}
+
+// Closes the multiplexed connections, which the HTTP server no longer tracks once they're upgraded.
+func (s *PeerServer) closeMuxSessions() {
+	s.muxMutex.Lock()
+	sessions := s.muxSessions
+	s.muxSessions = map[*muxSession]bool{}
+	s.muxMutex.Unlock()
+	for session := range sessions {
+		session.Close()
+	}
+}
+
+// Records the reply of the inbox handler to a message on a stream.
+type muxResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *muxResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *muxResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *muxResponseWriter) Write(buf []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(buf)
+}
@@ -0,0 +1,205 @@
+package nakamoto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newEchoPeerServer() *PeerServer {
+	server := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	server.RegisterMesageHandler("echo", func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg map[string]interface{}
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	})
+	return server
+}
+
+func TestPeerMuxMultiplexesMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newEchoPeerServer()
+	ts := httptest.NewUnstartedServer(server.server.Handler)
+	conns := int32(0)
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+	defer server.closeMuxSessions()
+
+	send := func(padding string) map[string]interface{} {
+		buf, _ := json.Marshal(map[string]interface{}{"type": "echo", "padding": padding})
+		res, _, err := sendRawMessageToPeer(ts.URL, buf, wireCodecs[WIRE_ENCODING_JSON], "", "", &server.log)
+		if err != nil {
+			t.Errorf("Failed to send message: %s", err)
+			return nil
+		}
+		var reply map[string]interface{}
+		assert.Nil(json.Unmarshal(res, &reply))
+		return reply
+	}
+
+	// Messages sent at once, including one split over many frames, share one connection.
+	large := string(bytes.Repeat([]byte("a"), 10*PEER_MUX_FRAME_SIZE+1))
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			padding := "small"
+			if i == 0 {
+				padding = large
+			}
+			reply := send(padding)
+			assert.Equal(padding, reply["padding"])
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(int32(1), atomic.LoadInt32(&conns))
+
+	// Later messages reuse it.
+	send("again")
+	assert.Equal(int32(1), atomic.LoadInt32(&conns))
+
+	// Once it's closed, a new one is opened.
+	server.closeMuxSessions()
+	assert.Eventually(func() bool {
+		peerTransport.mutex.Lock()
+		defer peerTransport.mutex.Unlock()
+		_, ok := peerTransport.conns[ts.Listener.Addr().String()]
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal("closed", send("closed")["padding"])
+	assert.Equal(int32(2), atomic.LoadInt32(&conns))
+}
+
+func TestPeerMuxFallsBackToHTTP(t *testing.T) {
+	assert := assert.New(t)
+
+	// A peer which only serves the inbox.
+	server := newEchoPeerServer()
+	mux := http.NewServeMux()
+	mux.Handle("/peerapi/inbox", http.HandlerFunc(server.inboxHandler))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	buf, _ := json.Marshal(map[string]interface{}{"type": "echo", "padding": "http"})
+	for i := 0; i < 2; i++ {
+		res, _, err := sendRawMessageToPeer(ts.URL, buf, wireCodecs[WIRE_ENCODING_JSON], "", "", &server.log)
+		assert.Nil(err)
+		assert.Equal(buf, res)
+	}
+
+	peerTransport.mutex.Lock()
+	_, unsupported := peerTransport.unsupported[ts.Listener.Addr().String()]
+	peerTransport.mutex.Unlock()
+	assert.True(unsupported)
+}
+
+// Opens a server session on one end of a pipe, returning the frame types it writes to the other.
+func newTestMuxServerSession(t *testing.T) (*muxSession, chan uint32) {
+	serverConn, clientConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	session := newMuxSession(serverConn, nil, true)
+	session.handler = func(head muxHead, body []byte) (muxHead, []byte) {
+		return muxHead{Status: http.StatusOK}, nil
+	}
+	t.Cleanup(session.Close)
+
+	resets := make(chan uint32, 16)
+	go func() {
+		header := make([]byte, muxFrameHeaderSize)
+		for {
+			if _, err := io.ReadFull(clientConn, header); err != nil {
+				return
+			}
+			payload := make([]byte, binary.BigEndian.Uint32(header[6:10]))
+			if _, err := io.ReadFull(clientConn, payload); err != nil {
+				return
+			}
+			if header[4] == muxFrameReset {
+				resets <- binary.BigEndian.Uint32(header[0:4])
+			}
+		}
+	}()
+	return session, resets
+}
+
+func TestPeerMuxBufferedBytesCapped(t *testing.T) {
+	assert := assert.New(t)
+	session, resets := newTestMuxServerSession(t)
+
+	// Messages are buffered up to the cap across the streams of the connection.
+	chunk := make([]byte, MAX_PEER_MUX_BUFFERED/4)
+	for id := uint32(1); id <= 3; id++ {
+		_, err := session.handleFrame(id, muxFrameHeaders, 0, []byte("{}"))
+		assert.Nil(err)
+	}
+	for _, id := range []uint32{1, 1, 2, 2} {
+		_, err := session.handleFrame(id, muxFrameData, 0, chunk)
+		assert.Nil(err)
+	}
+	assert.Equal(MAX_PEER_MUX_BUFFERED, session.buffered)
+
+	// A stream which would go over it is reset.
+	_, err := session.handleFrame(3, muxFrameData, 0, []byte{1})
+	assert.Nil(err)
+	assert.Equal(uint32(3), <-resets)
+	assert.Equal(2, session.activeStreams)
+
+	// Resetting a stream frees its bytes.
+	_, err = session.handleFrame(1, muxFrameReset, 0, nil)
+	assert.Nil(err)
+	assert.Equal(MAX_PEER_MUX_BUFFERED/2, session.buffered)
+
+	// As does handling a message once it's arrived.
+	complete, err := session.handleFrame(2, muxFrameData, muxFlagFin, nil)
+	assert.Nil(err)
+	assert.True(complete)
+	assert.Eventually(func() bool {
+		session.mutex.Lock()
+		defer session.mutex.Unlock()
+		return session.buffered == 0 && session.activeStreams == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPeerMuxStreamTimeout(t *testing.T) {
+	assert := assert.New(t)
+	session, resets := newTestMuxServerSession(t)
+
+	_, err := session.handleFrame(1, muxFrameHeaders, 0, []byte("{}"))
+	assert.Nil(err)
+	_, err = session.handleFrame(1, muxFrameData, 0, []byte("partial"))
+	assert.Nil(err)
+
+	// A stream whose message doesn't arrive by the deadline is reset.
+	session.mutex.Lock()
+	stream := session.streams[1]
+	session.mutex.Unlock()
+	session.expireStream(1, stream)
+	assert.Equal(uint32(1), <-resets)
+	assert.ErrorIs(stream.err, errMuxStreamTimeout)
+	assert.Equal(0, session.buffered)
+	assert.Equal(0, session.activeStreams)
+
+	// Later frames for it are dropped.
+	complete, err := session.handleFrame(1, muxFrameData, muxFlagFin, []byte("rest"))
+	assert.Nil(err)
+	assert.False(complete)
+}
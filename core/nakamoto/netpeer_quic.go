@@ -0,0 +1,515 @@
+package nakamoto
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/quic-go/quic-go"
+)
+
+// Peers which support it are sent messages over QUIC, rather than multiplexed over a TCP connection (see
+// netpeer_mux.go). QUIC streams are independent, so a lost packet of a bulk block transfer doesn't hold up a heartbeat,
+// and a connection survives the peer's address changing, ie. a phone switching from wifi to cellular.
+//
+// A node which accepts QUIC listens on the UDP port of its peer address, and advertises NODE_SERVICE_QUIC in its
+// heartbeats. We dial peers which advertise it over QUIC, and fall back to TCP if that fails. Heartbeats are exchanged
+// over TCP until then, so QUIC is negotiated per peer, and older nodes are messaged over TCP as before.
+//
+// Each message and its reply is a QUIC stream, which carries:
+//
+//	head length (u32) || head || body
+//
+// where the head is the JSON-encoded status and headers, as in the HEADERS frame of a multiplexed stream. The sender
+// closes its side of the stream after the body. The server handles the message with the same inbox handler, so
+// signing, wire encodings, compression and limits work the same as over TCP, and the same limits on streams, buffered
+// bytes and deadlines apply.
+//
+// QUIC is encrypted with TLS 1.3. Servers present a certificate self-signed by their node identity key (see
+// identity.go), and we only dial peers over QUIC once we know their identity from a signed heartbeat reply, so the
+// certificate is checked against it. There's no certificate authority, so the usual chain verification is skipped.
+
+const (
+	// The application protocol negotiated in the QUIC handshake.
+	PEER_QUIC_PROTOCOL = "tinychain-quic/1"
+	// How long we wait for a QUIC handshake, before falling back to TCP. This is shorter than PEER_MUX_DIAL_TIMEOUT, as
+	// a peer whose UDP port is firewalled never replies.
+	PEER_QUIC_DIAL_TIMEOUT = 2 * time.Second
+)
+
+var (
+	errQuicHeadTooLarge       = errors.New("message head too large")
+	errQuicCertificateInvalid = errors.New("peer certificate isn't for its node identity")
+)
+
+func newPeerQuicConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout:  PEER_QUIC_DIAL_TIMEOUT,
+		MaxIdleTimeout:        PEER_MUX_IDLE_TIMEOUT,
+		MaxIncomingStreams:    MAX_PEER_MUX_STREAMS,
+		MaxIncomingUniStreams: -1,
+	}
+}
+
+// Writes a message on a stream, and closes our side of it.
+func writeQuicMessage(stream *quic.Stream, head muxHead, body []byte) error {
+	headBuf, err := json.Marshal(head)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 0, 4+len(headBuf)+len(body))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(headBuf)))
+	buf = append(buf, headBuf...)
+	buf = append(buf, body...)
+	if _, err := stream.Write(buf); err != nil {
+		return err
+	}
+	return stream.Close()
+}
+
+// Reads a message from a stream, until the sender closes its side. If reserve is set, it's called before each chunk of
+// the body is buffered, and aborts the read if it fails.
+func readQuicMessage(stream io.Reader, reserve func(n int) error) (muxHead, []byte, error) {
+	head := muxHead{}
+	lengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(stream, lengthBuf); err != nil {
+		return head, nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBuf)
+	if MAX_MESSAGE_HEADER_BYTES < length {
+		return head, nil, errQuicHeadTooLarge
+	}
+	headBuf := make([]byte, length)
+	if _, err := io.ReadFull(stream, headBuf); err != nil {
+		return head, nil, err
+	}
+	if err := json.Unmarshal(headBuf, &head); err != nil {
+		return head, nil, fmt.Errorf("invalid message head: %v", err)
+	}
+
+	body := []byte{}
+	chunk := make([]byte, PEER_MUX_FRAME_SIZE)
+	for {
+		n, err := stream.Read(chunk)
+		if 0 < n {
+			if MAX_MESSAGE_SIZE < len(body)+n {
+				return head, nil, fmt.Errorf("message too large, max is %d bytes", MAX_MESSAGE_SIZE)
+			}
+			if reserve != nil {
+				if err := reserve(n); err != nil {
+					return head, nil, err
+				}
+			}
+			body = append(body, chunk[:n]...)
+		}
+		if err == io.EOF {
+			return head, body, nil
+		}
+		if err != nil {
+			return head, nil, err
+		}
+	}
+}
+
+// The client.
+// =====================================================================================================================
+
+// A QUIC connection to a peer, with a stream for each message.
+type quicSession struct {
+	conn     *quic.Conn
+	lastUsed time.Time
+	mutex    sync.Mutex
+}
+
+// A host which advertised QUIC support.
+type quicHost struct {
+	// The node identity its certificate must be for.
+	nodeID string
+	// When we can next dial it over QUIC. A zero time means now.
+	retryAt time.Time
+}
+
+// Dials a peer over QUIC, checking its certificate is for its node identity.
+func dialPeerQuic(host string, nodeID string) (*quicSession, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), PEER_QUIC_DIAL_TIMEOUT)
+	defer cancel()
+	tlsConfig := &tls.Config{
+		// The server's certificate is self-signed, so it's checked against the node identity rather than a chain.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPeerQuicCertificate(nodeID),
+		NextProtos:            []string{PEER_QUIC_PROTOCOL},
+	}
+	conn, err := quic.DialAddr(ctx, host, tlsConfig, newPeerQuicConfig())
+	if err != nil {
+		return nil, err
+	}
+	return &quicSession{conn: conn, lastUsed: time.Now()}, nil
+}
+
+func (s *quicSession) roundTrip(req *http.Request) (*http.Response, error) {
+	body := []byte{}
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := req.Context()
+	stream, err := s.conn.OpenStreamSync(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: %v", errMuxSessionClosed, err)
+	}
+	s.touch()
+
+	stop := context.AfterFunc(ctx, func() {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+	})
+	defer stop()
+	stream.SetDeadline(time.Now().Add(PEER_REQUEST_TIMEOUT))
+
+	// The request isn't handled until our side of the stream is closed, so it's safe to retry if the connection closed
+	// before then.
+	if err := writeQuicMessage(stream, muxHead{Header: req.Header}, body); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if s.conn.Context().Err() != nil {
+			return nil, fmt.Errorf("%w: %v", errMuxSessionClosed, err)
+		}
+		return nil, err
+	}
+	head, reply, err := readQuicMessage(stream, nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	s.touch()
+
+	return newStreamResponse(req, head, reply), nil
+}
+
+func (s *quicSession) touch() {
+	s.mutex.Lock()
+	s.lastUsed = time.Now()
+	s.mutex.Unlock()
+}
+
+func (s *quicSession) isUsable() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn.Context().Err() == nil && time.Since(s.lastUsed) < PEER_MUX_IDLE_TIMEOUT/2
+}
+
+func (s *quicSession) run() {
+	<-s.conn.Context().Done()
+}
+
+func (s *quicSession) Close() {
+	s.conn.CloseWithError(0, "")
+}
+
+// Records whether a peer advertised QUIC support in its heartbeat, and its node identity. Peers which support it are
+// dialed over QUIC, and an open TCP connection to them is closed once the requests on it are done. Peers without an
+// identity are messaged over TCP, as their certificate can't be checked.
+func (t *peerMuxTransport) setQuicSupport(peerUrl string, nodeID string, supported bool) {
+	u, err := url.Parse(peerUrl)
+	if err != nil || u.Scheme != "http" {
+		return
+	}
+	host := u.Host
+	supported = supported && nodeID != ""
+
+	t.mutex.Lock()
+	if h, ok := t.quicHosts[host]; (ok && h.nodeID == nodeID) || !supported {
+		if !supported {
+			delete(t.quicHosts, host)
+		}
+		t.mutex.Unlock()
+		return
+	}
+	t.quicHosts[host] = quicHost{nodeID: nodeID}
+	conn, ok := t.conns[host]
+	if ok && !conn.quic {
+		delete(t.conns, host)
+	} else {
+		ok = false
+	}
+	t.mutex.Unlock()
+
+	if ok {
+		go func() {
+			<-conn.ready
+			if conn.session != nil {
+				time.AfterFunc(PEER_REQUEST_TIMEOUT, conn.session.Close)
+			}
+		}()
+	}
+}
+
+// Returns whether to dial a host over QUIC. Called with the mutex held.
+func (t *peerMuxTransport) canDialQuic(host string) bool {
+	h, ok := t.quicHosts[host]
+	return ok && !time.Now().Before(h.retryAt)
+}
+
+// The server.
+// =====================================================================================================================
+
+// A QUIC connection from a peer.
+type quicServerConn struct {
+	conn *quic.Conn
+	// Closes the connection if no message arrives in full before it fires.
+	idle *time.Timer
+	// The bytes of messages buffered on the connection, across its streams.
+	buffered int
+	mutex    sync.Mutex
+}
+
+func (c *quicServerConn) reserve(n int) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if MAX_PEER_MUX_BUFFERED < c.buffered+n {
+		return fmt.Errorf("too many bytes buffered on the connection, max is %d bytes", MAX_PEER_MUX_BUFFERED)
+	}
+	c.buffered += n
+	return nil
+}
+
+func (c *quicServerConn) release(n int) {
+	c.mutex.Lock()
+	c.buffered -= n
+	c.mutex.Unlock()
+}
+
+// Listens for QUIC connections on the UDP port of the peer server's address.
+func (s *PeerServer) listenQuic(addr net.Addr) error {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("unexpected peer server address %s", addr)
+	}
+	cert, err := newPeerQuicCertificate(s.Identity)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{PEER_QUIC_PROTOCOL},
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(s.config.address, strconv.Itoa(tcpAddr.Port)))
+	if err != nil {
+		return err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	// The transport owns the socket, so it's released when we stop listening, rather than once closed connections
+	// have drained.
+	transport := &quic.Transport{Conn: udpConn}
+	listener, err := transport.Listen(tlsConfig, newPeerQuicConfig())
+	if err != nil {
+		udpConn.Close()
+		return err
+	}
+
+	s.muxMutex.Lock()
+	s.quicListener = listener
+	s.quicTransport = transport
+	s.muxMutex.Unlock()
+	s.log.Printf("Accepting peer messages over QUIC on udp/%d\n", tcpAddr.Port)
+
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go s.serveQuicConn(conn)
+		}
+	}()
+	return nil
+}
+
+// Returns whether we accept messages over QUIC.
+func (s *PeerServer) acceptsQuic() bool {
+	s.muxMutex.Lock()
+	defer s.muxMutex.Unlock()
+	return s.quicListener != nil
+}
+
+// Stops accepting QUIC connections, and closes those open.
+func (s *PeerServer) closeQuic() {
+	s.muxMutex.Lock()
+	listener, transport := s.quicListener, s.quicTransport
+	s.quicListener, s.quicTransport = nil, nil
+	conns := s.quicConns
+	s.quicConns = map[*quic.Conn]bool{}
+	s.muxMutex.Unlock()
+	for conn := range conns {
+		conn.CloseWithError(0, "")
+	}
+	if listener != nil {
+		listener.Close()
+		transport.Close()
+		transport.Conn.Close()
+	}
+}
+
+// Serves the messages on a QUIC connection from a peer.
+func (s *PeerServer) serveQuicConn(conn *quic.Conn) {
+	remoteAddr := conn.RemoteAddr().String()
+	r, err := http.NewRequest(http.MethodGet, PEER_MUX_PATH, nil)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return
+	}
+	r.RemoteAddr = remoteAddr
+	if s.AllowRequest != nil && !s.AllowRequest(r) {
+		conn.CloseWithError(0, "Forbidden")
+		return
+	}
+
+	s.muxMutex.Lock()
+	if s.quicListener == nil {
+		s.muxMutex.Unlock()
+		conn.CloseWithError(0, "")
+		return
+	}
+	s.quicConns[conn] = true
+	s.muxMutex.Unlock()
+	defer func() {
+		s.muxMutex.Lock()
+		delete(s.quicConns, conn)
+		s.muxMutex.Unlock()
+	}()
+
+	// The connection is only kept open by messages arriving in full, not by a trickle of packets.
+	c := &quicServerConn{conn: conn}
+	c.idle = time.AfterFunc(PEER_MUX_IDLE_TIMEOUT, func() {
+		conn.CloseWithError(0, "idle")
+	})
+	defer c.idle.Stop()
+
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go s.serveQuicStream(c, stream, remoteAddr)
+	}
+}
+
+// Handles the message on a stream, and writes the reply. The stream is reset if the message is too large, or doesn't
+// arrive in full by the deadline.
+func (s *PeerServer) serveQuicStream(c *quicServerConn, stream *quic.Stream, remoteAddr string) {
+	reserved := 0
+	defer func() {
+		c.release(reserved)
+	}()
+
+	stream.SetReadDeadline(time.Now().Add(PEER_MUX_STREAM_TIMEOUT))
+	head, body, err := readQuicMessage(stream, func(n int) error {
+		if err := c.reserve(n); err != nil {
+			return err
+		}
+		reserved += n
+		return nil
+	})
+	if err != nil {
+		stream.CancelRead(0)
+		stream.CancelWrite(0)
+		return
+	}
+	c.idle.Reset(PEER_MUX_IDLE_TIMEOUT)
+
+	replyHead, reply := s.handleStreamMessage(head, body, remoteAddr, "")
+	stream.SetWriteDeadline(time.Now().Add(PEER_REQUEST_TIMEOUT))
+	if err := writeQuicMessage(stream, replyHead, reply); err != nil {
+		stream.CancelWrite(0)
+	}
+}
+
+// Creates the certificate a peer server presents in QUIC handshakes, self-signed by its node identity. If the server
+// has no identity, the certificate is for a random key, and peers which check it won't dial us over QUIC.
+func newPeerQuicCertificate(identity *core.Wallet) (tls.Certificate, error) {
+	var key *ecdsa.PrivateKey
+	if identity != nil {
+		key = identity.Prvkey()
+	} else {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "tinychain"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Returns a check that a peer's QUIC certificate is for its node identity. The TLS handshake proves the peer holds the
+// certificate's key.
+func verifyPeerQuicCertificate(nodeID string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(rawCerts) != 1 {
+			return errQuicCertificateInvalid
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		pubkey, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok || pubkey.Curve != elliptic.P256() {
+			return errQuicCertificateInvalid
+		}
+		if hex.EncodeToString(elliptic.Marshal(pubkey.Curve, pubkey.X, pubkey.Y)) != nodeID {
+			return errQuicCertificateInvalid
+		}
+		now := time.Now()
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return errQuicCertificateInvalid
+		}
+		return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+	}
+}
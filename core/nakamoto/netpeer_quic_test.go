@@ -0,0 +1,180 @@
+package nakamoto
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// Starts an echo peer server over TCP, with a node identity, counting the TCP connections to it.
+func newTestQuicPeerServer(t *testing.T) (*PeerServer, *httptest.Server, *int32) {
+	server := newEchoPeerServer()
+	identity, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Identity = identity
+	ts := httptest.NewUnstartedServer(server.server.Handler)
+	conns := new(int32)
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	ts.Start()
+	t.Cleanup(ts.Close)
+	t.Cleanup(server.closeMuxSessions)
+	return server, ts, conns
+}
+
+func sendTestEcho(t *testing.T, server *PeerServer, peerUrl string, padding string) string {
+	buf, _ := json.Marshal(map[string]interface{}{"type": "echo", "padding": padding})
+	res, _, err := sendRawMessageToPeer(peerUrl, buf, wireCodecs[WIRE_ENCODING_JSON], "", "", &server.log)
+	if err != nil {
+		t.Errorf("Failed to send message: %s", err)
+		return ""
+	}
+	var reply map[string]interface{}
+	if err := json.Unmarshal(res, &reply); err != nil {
+		t.Errorf("Failed to decode reply: %s", err)
+		return ""
+	}
+	padding, _ = reply["padding"].(string)
+	return padding
+}
+
+func TestPeerQuicSendsMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	server, ts, conns := newTestQuicPeerServer(t)
+	assert.Nil(server.listenQuic(ts.Listener.Addr()))
+	t.Cleanup(server.closeQuic)
+	assert.True(server.acceptsQuic())
+
+	host := ts.Listener.Addr().String()
+	peerTransport.setQuicSupport(ts.URL, NodeID(server.Identity), true)
+	t.Cleanup(func() { peerTransport.setQuicSupport(ts.URL, "", false) })
+
+	// Messages, including one larger than a QUIC packet, are sent over QUIC rather than TCP.
+	large := string(bytes.Repeat([]byte("a"), 10*PEER_MUX_FRAME_SIZE+1))
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			padding := "small"
+			if i == 0 {
+				padding = large
+			}
+			assert.Equal(padding, sendTestEcho(t, server, ts.URL, padding))
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(int32(0), atomic.LoadInt32(conns))
+
+	peerTransport.mutex.Lock()
+	conn := peerTransport.conns[host]
+	peerTransport.mutex.Unlock()
+	assert.NotNil(conn)
+	assert.True(conn.quic)
+
+	// Once the connection is closed, a new one is dialed.
+	server.closeQuic()
+	assert.Nil(server.listenQuic(ts.Listener.Addr()))
+	assert.Eventually(func() bool {
+		peerTransport.mutex.Lock()
+		defer peerTransport.mutex.Unlock()
+		_, ok := peerTransport.conns[host]
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal("again", sendTestEcho(t, server, ts.URL, "again"))
+	assert.Equal(int32(0), atomic.LoadInt32(conns))
+}
+
+func TestPeerQuicFallsBackToTCP(t *testing.T) {
+	assert := assert.New(t)
+
+	// A peer which advertises QUIC, but isn't reachable over it.
+	server, ts, conns := newTestQuicPeerServer(t)
+	host := ts.Listener.Addr().String()
+	peerTransport.setQuicSupport(ts.URL, NodeID(server.Identity), true)
+	t.Cleanup(func() { peerTransport.setQuicSupport(ts.URL, "", false) })
+
+	assert.Equal("tcp", sendTestEcho(t, server, ts.URL, "tcp"))
+	assert.Equal(int32(1), atomic.LoadInt32(conns))
+
+	// It isn't dialed over QUIC again until later.
+	peerTransport.mutex.Lock()
+	assert.False(peerTransport.canDialQuic(host))
+	assert.False(peerTransport.conns[host].quic)
+	peerTransport.mutex.Unlock()
+}
+
+func TestPeerQuicChecksNodeIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	server, ts, conns := newTestQuicPeerServer(t)
+	assert.Nil(server.listenQuic(ts.Listener.Addr()))
+	t.Cleanup(server.closeQuic)
+	host := ts.Listener.Addr().String()
+
+	// A peer without a known identity isn't dialed over QUIC.
+	peerTransport.setQuicSupport(ts.URL, "", true)
+	peerTransport.mutex.Lock()
+	assert.False(peerTransport.canDialQuic(host))
+	peerTransport.mutex.Unlock()
+
+	// Nor is one whose certificate isn't for the identity it claimed.
+	other, err := core.CreateRandomWallet()
+	assert.Nil(err)
+	peerTransport.setQuicSupport(ts.URL, NodeID(other), true)
+	t.Cleanup(func() { peerTransport.setQuicSupport(ts.URL, "", false) })
+	assert.Equal("tcp", sendTestEcho(t, server, ts.URL, "tcp"))
+	assert.Equal(int32(1), atomic.LoadInt32(conns))
+	peerTransport.mutex.Lock()
+	assert.False(peerTransport.canDialQuic(host))
+	assert.False(peerTransport.conns[host].quic)
+	peerTransport.mutex.Unlock()
+}
+
+func TestPeerQuicMovesTCPConnection(t *testing.T) {
+	assert := assert.New(t)
+
+	server, ts, conns := newTestQuicPeerServer(t)
+	assert.Nil(server.listenQuic(ts.Listener.Addr()))
+	t.Cleanup(server.closeQuic)
+	host := ts.Listener.Addr().String()
+
+	// Peers are messaged over TCP until they advertise QUIC.
+	assert.Equal("tcp", sendTestEcho(t, server, ts.URL, "tcp"))
+	assert.Equal(int32(1), atomic.LoadInt32(conns))
+
+	peerTransport.setQuicSupport(ts.URL, NodeID(server.Identity), true)
+	t.Cleanup(func() { peerTransport.setQuicSupport(ts.URL, "", false) })
+	assert.Equal("quic", sendTestEcho(t, server, ts.URL, "quic"))
+	assert.Equal(int32(1), atomic.LoadInt32(conns))
+
+	peerTransport.mutex.Lock()
+	assert.True(peerTransport.conns[host].quic)
+	peerTransport.mutex.Unlock()
+}
+
+func TestPeerQuicBufferedBytesCapped(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &quicServerConn{}
+	assert.Nil(c.reserve(MAX_PEER_MUX_BUFFERED))
+	assert.NotNil(c.reserve(1))
+	c.release(MAX_PEER_MUX_BUFFERED / 2)
+	assert.Nil(c.reserve(1))
+	assert.Equal(MAX_PEER_MUX_BUFFERED/2+1, c.buffered)
+}
@@ -0,0 +1,158 @@
+package nakamoto
+
+import (
+	"errors"
+	"time"
+)
+
+// Messages which expect a reply (get_tip, get_blocks and has_block) carry a request ID, which the peer echoes in its
+// reply, so a reply can be matched to the request it answers. Each attempt at a request gets a new ID, and waits up to
+// PeerCore.RequestTimeout for its reply. An attempt which times out is abandoned, and retried up to
+// PeerCore.RequestRetries times. A reply echoing another ID, such as a late reply to an abandoned attempt, is discarded.
+// Peers which predate request IDs don't echo them, so a reply without one is accepted.
+//
+// The requests awaiting a reply are tracked per peer, and their outcomes are counted by message type, in the peer's
+// request stats, so peers which are slow or unresponsive to requests can be spotted with getpeerinfo.
+
+const (
+	DEFAULT_PEER_REQUEST_TIMEOUT = 15 * time.Second
+	DEFAULT_PEER_REQUEST_RETRIES = 2
+)
+
+var (
+	ErrPeerRequestTimeout = errors.New("peer request timed out")
+	ErrPeerReplyMismatch  = errors.New("peer reply doesn't match the request ID")
+)
+
+// The outcomes of the requests sent to a peer of a message type.
+type PeerRequestStats struct {
+	// Attempts sent, including retries.
+	Sent    uint64 `json:"sent"`
+	Retries uint64 `json:"retries"`
+	Replied uint64 `json:"replied"`
+	// Attempts which weren't replied to in time.
+	TimedOut uint64 `json:"timedOut"`
+	// Replies which echoed another request ID.
+	Mismatched uint64 `json:"mismatched"`
+	// Attempts which failed otherwise, ie. the peer couldn't be reached or replied with an error.
+	Failed uint64 `json:"failed"`
+}
+
+// A request awaiting a reply.
+type peerRequest struct {
+	messageType string
+	sentAt      time.Time
+}
+
+// A reply to a request, which echoes the request's ID.
+type peerReply interface {
+	replyRequestID() uint64
+}
+
+func (m *GetTipMessage) replyRequestID() uint64  { return m.RequestID }
+func (m *GetBlocksReply) replyRequestID() uint64 { return m.RequestID }
+func (m *HasBlockReply) replyRequestID() uint64  { return m.RequestID }
+
+// Records an attempt at a request being sent.
+func (peer *Peer) startRequest(id uint64, messageType string, retry bool, now time.Time) {
+	if peer.requests == nil {
+		peer.requests = make(map[uint64]peerRequest)
+	}
+	peer.requests[id] = peerRequest{messageType: messageType, sentAt: now}
+	peer.recordRequest(messageType, func(s *PeerRequestStats) {
+		s.Sent++
+		if retry {
+			s.Retries++
+		}
+	})
+}
+
+// Records the outcome of an attempt at a request.
+func (peer *Peer) finishRequest(id uint64, err error) {
+	req, ok := peer.requests[id]
+	if !ok {
+		return
+	}
+	delete(peer.requests, id)
+	peer.recordRequest(req.messageType, func(s *PeerRequestStats) {
+		switch {
+		case err == nil:
+			s.Replied++
+		case errors.Is(err, ErrPeerRequestTimeout):
+			s.TimedOut++
+		case errors.Is(err, ErrPeerReplyMismatch):
+			s.Mismatched++
+		default:
+			s.Failed++
+		}
+	})
+}
+
+func (peer *Peer) recordRequest(messageType string, update func(s *PeerRequestStats)) {
+	if peer.requestStats == nil {
+		peer.requestStats = make(map[string]PeerRequestStats)
+	}
+	s := peer.requestStats[messageType]
+	update(&s)
+	peer.requestStats[messageType] = s
+}
+
+// Returns the request timeout, defaulting to DEFAULT_PEER_REQUEST_TIMEOUT.
+func (p *PeerCore) requestTimeout() time.Duration {
+	if p.RequestTimeout == 0 {
+		return DEFAULT_PEER_REQUEST_TIMEOUT
+	}
+	return p.RequestTimeout
+}
+
+// Sends a request to a peer, retrying if it times out, and decodes the reply to it. newMessage builds the message of an
+// attempt with its request ID.
+func (p *PeerCore) sendRequest(peerUrl string, messageType string, newMessage func(requestID uint64) any, reply peerReply) error {
+	var err error
+	for attempt := 0; attempt <= p.RequestRetries; attempt++ {
+		id := p.nextRequestID.Add(1)
+		p.updatePeer(peerUrl, func(peer *Peer) {
+			peer.startRequest(id, messageType, 0 < attempt, time.Now())
+		})
+		err = p.sendRequestAttempt(peerUrl, newMessage(id), id, reply)
+		p.updatePeer(peerUrl, func(peer *Peer) {
+			peer.finishRequest(id, err)
+		})
+		if !errors.Is(err, ErrPeerRequestTimeout) {
+			return err
+		}
+		p.peerLogger.Printf("Request timed out: peer=%s type=%s id=%d attempt=%d\n", peerUrl, messageType, id, attempt+1)
+	}
+	return err
+}
+
+func (p *PeerCore) sendRequestAttempt(peerUrl string, message any, id uint64, reply peerReply) error {
+	type result struct {
+		res   []byte
+		codec WireCodec
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		res, codec, err := p.sendMessage(peerUrl, message)
+		done <- result{res, codec, err}
+	}()
+
+	timer := time.NewTimer(p.requestTimeout())
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return r.err
+		}
+		if err := r.codec.Unmarshal(r.res, reply); err != nil {
+			return err
+		}
+		if replyID := reply.replyRequestID(); replyID != 0 && replyID != id {
+			return ErrPeerReplyMismatch
+		}
+		return nil
+	case <-timer.C:
+		return ErrPeerRequestTimeout
+	}
+}
@@ -0,0 +1,75 @@
+package nakamoto
+
+import (
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	// A remote peer whose first has_block reply is too slow.
+	remote := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	remote.OnGetTip = func(msg GetTipMessage) (BlockHeader, error) {
+		return BlockHeader{Nonce: [32]byte{7}}, nil
+	}
+	calls := atomic.Int32{}
+	remote.OnHasBlock = func(blockhash [32]byte) bool {
+		if calls.Add(1) == 1 {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return blockhash == [32]byte{1}
+	}
+	// Its get_blocks replies carry a fixed request ID. Handlers are registered before the server starts.
+	requestID := atomic.Uint64{}
+	remote.server.RegisterMesageHandler("get_blocks", func(message []byte, codec WireCodec) (interface{}, error) {
+		return GetBlocksReply{Type: "get_blocks_reply", RequestID: requestID.Load(), RawBlockDatas: [][]byte{{1}}}, nil
+	})
+	server := httptest.NewServer(remote.server.server.Handler)
+	defer server.Close()
+
+	local := &PeerCore{
+		peers:          []Peer{{url: server.URL}},
+		bannedHosts:    make(map[string]time.Time),
+		peerLogger:     *NewLogger("peer", "test"),
+		RequestTimeout: 100 * time.Millisecond,
+		RequestRetries: 1,
+	}
+	peer := local.Peers()[0]
+
+	// Replies echo the request ID.
+	tip, err := local.GetTip(peer)
+	assert.Nil(err)
+	assert.Equal([32]byte{7}, tip.Nonce)
+	assert.Equal(PeerRequestStats{Sent: 1, Replied: 1}, local.Peers()[0].requestStats["get_tip"])
+
+	// A request which times out is retried with a new ID.
+	has, err := local.HasBlock(peer, [32]byte{1})
+	assert.Nil(err)
+	assert.True(has)
+	assert.Equal(PeerRequestStats{Sent: 2, Retries: 1, Replied: 1, TimedOut: 1}, local.Peers()[0].requestStats["has_block"])
+	assert.Equal(0, len(local.Peers()[0].requests))
+
+	// Until it runs out of retries.
+	calls.Store(0)
+	local.RequestRetries = 0
+	_, err = local.HasBlock(peer, [32]byte{1})
+	assert.ErrorIs(err, ErrPeerRequestTimeout)
+	info := NewRPCPeerInfo(local.Peers()[0], 0, time.Now())
+	assert.Equal(uint64(2), info.RequestTimeouts)
+	assert.Equal(0, info.OutstandingRequests)
+
+	// A reply to another request is discarded. Replies without an ID, from older peers, are accepted.
+	requestID.Store(1)
+	_, err = local.GetBlocks(peer, [][32]byte{{1}})
+	assert.ErrorIs(err, ErrPeerReplyMismatch)
+	assert.Equal(PeerRequestStats{Sent: 1, Mismatched: 1}, local.Peers()[0].requestStats["get_blocks"])
+	requestID.Store(0)
+	blocks, err := local.GetBlocks(peer, [][32]byte{{1}})
+	assert.Nil(err)
+	assert.Equal([][]byte{{1}}, blocks)
+}
@@ -4,28 +4,101 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"sort"
+	"strconv"
+	"sync"
 	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/pion/webrtc/v3"
+	"github.com/quic-go/quic-go"
 )
 
 // PeerServer is an RPC server running over HTTP.
-// Peers send messages to http://<host>:<port>/peerapi/inbox and receive response messages.
-// All messages are encoded using JSON.
+// Peers send messages to http://<host>:<port>/peerapi/inbox and receive response messages, or send them as streams over
+// a connection upgraded at /peerapi/mux (see netpeer_mux.go), or over QUIC on the same port (see netpeer_quic.go).
+// Browsers send them over WebRTC data channels, which are set up through the API server (see netpeer_webrtc.go).
+// Messages are encoded using JSON, or another wire encoding negotiated with the peer (see wire.go).
 type PeerServer struct {
 	config          PeerConfig
 	messageHandlers map[string]PeerMessageHandler
 	log             log.Logger
 	server          *http.Server
+
+	// AllowRequest is called for each inbound request. If it returns false, the request is rejected.
+	AllowRequest func(r *http.Request) bool
+
+	// OnMessage is called after each inbound message is handled, with the sender's address (if known), and the size of
+	// the message and reply.
+	OnMessage func(peerAddr string, messageType string, bytesReceived int, bytesSent int)
+
+	// OnMessageError is called when a message handler returns an error.
+	OnMessageError func(r *http.Request, messageType string, err error)
+
+	// The node identity replies are signed with. If nil, replies are unsigned. See identity.go.
+	Identity *core.Wallet
+
+	// AllowSender is called with the address a message claims to come from, the host it was received from, and the
+	// node ID which signed it ("" if unsigned). If it returns false, the message is rejected as spoofed.
+	AllowSender func(peerAddr string, remoteHost string, nodeID string) bool
+
+	// The nonces of signed messages we've received, so they can't be replayed. See identity.go.
+	nonces *peerNonceCache
+
+	// The multiplexed connections from peers. See netpeer_mux.go.
+	muxSessions map[*muxSession]bool
+	// The QUIC listener and its transport, if we accept messages over QUIC, and the connections from peers. See
+	// netpeer_quic.go.
+	quicListener  *quic.Listener
+	quicTransport *quic.Transport
+	quicConns     map[*quic.Conn]bool
+	// The WebRTC connections from browsers. See netpeer_webrtc.go.
+	webrtcConns map[*webrtc.PeerConnection]bool
+	muxMutex    sync.Mutex
 }
 
+// The header a peer sets to identify its address when sending messages.
+const PEER_ADDRESS_HEADER = "X-Tinychain-Peer"
+
+// Limits on the messages exchanged with peers, which guard against a peer exhausting our memory or connections.
+const (
+	// The maximum size of a message or reply, after decompression.
+	MAX_MESSAGE_SIZE = 32 * 1024 * 1024
+	// The maximum size of the HTTP headers of a message.
+	MAX_MESSAGE_HEADER_BYTES = 64 * 1024
+	// How long a peer has to send the headers of a message.
+	PEER_READ_HEADER_TIMEOUT = 5 * time.Second
+	// How long we wait for a peer to reply to a message.
+	PEER_REQUEST_TIMEOUT = 60 * time.Second
+)
+
+// Messages are sent to peers over multiplexed connections where they support them. See netpeer_mux.go.
+var peerTransport = newPeerMuxTransport(http.DefaultTransport)
+var peerHttpClient = &http.Client{Timeout: PEER_REQUEST_TIMEOUT, Transport: peerTransport}
+
+// Returned by message handlers when the node is too busy to handle a message, such as when the block queue is full.
+// The sender is replied to with 503 Service Unavailable and a Retry-After header, and should back off from sending
+// that peer messages until then.
+var ErrPeerBusy = errors.New("peer busy")
+
+// How long a busy peer asks senders to back off for.
+const PEER_BUSY_RETRY_AFTER = 5 * time.Second
+
 func NewPeerServer(config PeerConfig) *PeerServer {
 	s := PeerServer{
 		config:          config,
 		messageHandlers: make(map[string]PeerMessageHandler),
+		muxSessions:     make(map[*muxSession]bool),
+		quicConns:       make(map[*quic.Conn]bool),
+		webrtcConns:     make(map[*webrtc.PeerConnection]bool),
+		nonces:          newPeerNonceCache(),
 		log:             *NewLogger("peer-server", fmt.Sprintf(":%s", config.port)),
 	}
 
@@ -36,20 +109,25 @@ func NewPeerServer(config PeerConfig) *PeerServer {
 	// Setup HTTP server mux.
 	mux := http.NewServeMux()
 	mux.Handle("/peerapi/inbox", http.HandlerFunc(s.inboxHandler))
+	mux.Handle(PEER_MUX_PATH, http.HandlerFunc(s.muxHandler))
 
-	// Configure server with no transfer limits and gracious timeouts
+	// Configure server with gracious timeouts. Message sizes are limited in the handler.
 	s.server = &http.Server{
-		Addr:         addr + ":" + port,
-		Handler:      mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		// An unspecified address, ie. "::", listens dual-stack, on both IPv4 and IPv6.
+		Addr:              net.JoinHostPort(addr, port),
+		Handler:           mux,
+		ReadTimeout:       15 * time.Second,
+		ReadHeaderTimeout: PEER_READ_HEADER_TIMEOUT,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		MaxHeaderBytes:    MAX_MESSAGE_HEADER_BYTES,
 	}
 
 	return &s
 }
 
-type PeerMessageHandler = func(message []byte) (interface{}, error)
+// Handles a message, decoding it with the codec it was encoded in. The reply is encoded with the same codec.
+type PeerMessageHandler = func(message []byte, codec WireCodec) (interface{}, error)
 
 func (s *PeerServer) RegisterMesageHandler(messageKey string, handler PeerMessageHandler) {
 	s.log.Printf("Registering message handler for '%s'\n", messageKey)
@@ -67,7 +145,18 @@ func (s *PeerServer) Start() error {
 		return handlers
 	}())
 
-	if err := s.server.ListenAndServe(); err != nil {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		s.log.Printf("Peer server listening on http://%s\n", s.server.Addr)
+		s.log.Println("Error starting server:", err)
+		return err
+	}
+	if !s.config.NoQuic {
+		if err := s.listenQuic(listener.Addr()); err != nil {
+			s.log.Printf("Failed to listen for QUIC, accepting messages over TCP only: %s\n", err)
+		}
+	}
+	if err := s.server.Serve(listener); err != nil {
 		s.log.Printf("Peer server listening on http://%s\n", s.server.Addr)
 		s.log.Println("Error starting server:", err)
 		return err
@@ -79,6 +168,9 @@ func (s *PeerServer) Start() error {
 func (s *PeerServer) Stop() {
 	s.log.Println("Stopping peer server")
 	s.server.Shutdown(context.Background())
+	s.closeMuxSessions()
+	s.closeQuic()
+	s.closeWebRTC()
 }
 
 // Handler for /peerapi/inbox
@@ -88,25 +180,64 @@ func (s *PeerServer) inboxHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	if s.AllowRequest != nil && !s.AllowRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MAX_MESSAGE_SIZE))
 	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Failed to read request body", http.StatusBadRequest)
 		return
 	}
 
-	var payload map[string]interface{}
-	if err := json.Unmarshal(body, &payload); err != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
+	codec, err := GetWireCodec(r.Header.Get(WIRE_ENCODING_HEADER))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	nodeID, err := verifyPeerMessage(r.Header, body, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if nodeID != "" && s.nonces != nil {
+		if err := s.nonces.Check(nodeID, r.Header.Get(PEER_NONCE_HEADER), now); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var payload NetworkMessage
+	if err := codec.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
 		return
 	}
 
 	// Check message type.
-	if _, ok := payload["type"]; !ok {
+	if payload.Type == "" {
 		http.Error(w, "Missing 'type' field in payload", http.StatusBadRequest)
 		return
 	}
+	// Messages declaring a node ID must be signed by it.
+	if payload.NodeID != "" && payload.NodeID != nodeID {
+		http.Error(w, "Node ID doesn't match the message signature", http.StatusUnauthorized)
+		return
+	}
+	if s.AllowSender != nil && !s.AllowSender(r.Header.Get(PEER_ADDRESS_HEADER), clientIP(r), nodeID) {
+		http.Error(w, "Message isn't signed by the sender's identity", http.StatusForbidden)
+		return
+	}
+
 	// Log the message type.
-	messageType := payload["type"].(string)
+	messageType := payload.Type
 	s.log.Printf("Received '%s' message\n", messageType)
 
 	// Check we have a message handler.
@@ -116,67 +247,179 @@ func (s *PeerServer) inboxHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Handle.
-	res, err := s.messageHandlers[messageType](body)
+	res, err := s.messageHandlers[messageType](body, codec)
 	if err != nil {
+		if s.OnMessageError != nil {
+			s.OnMessageError(r, messageType, err)
+		}
+		if errors.Is(err, ErrPeerBusy) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(PEER_BUSY_RETRY_AFTER/time.Second)))
+			http.Error(w, "Busy", http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "Failed to process message", http.StatusInternalServerError)
 		return
 	}
 
 	if res == nil {
-		// Send back HTTP 200 OK with empty JSON.
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("{}"))
+		res = map[string]interface{}{}
+	}
+	reply, err := codec.Marshal(res)
+	if err != nil {
+		http.Error(w, "Failed to encode reply", http.StatusInternalServerError)
 		return
-	} else {
-		// Respond.
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(res)
 	}
 
+	// The reply is signed over the message's nonce, binding it to the message.
+	nonce := r.Header.Get(PEER_NONCE_HEADER)
+	if nonce == "" {
+		nonce = newPeerMessageNonce()
+	}
+	if err := signPeerMessage(w.Header(), s.Identity, reply, nonce, time.Now()); err != nil {
+		http.Error(w, "Failed to sign reply", http.StatusInternalServerError)
+		return
+	}
+
+	// Compress large replies, if the peer accepts it.
+	compression := NegotiateWireCompression([]string{r.Header.Get(WIRE_ACCEPT_COMPRESSION_HEADER)})
+	if compression != "" && WIRE_COMPRESSION_THRESHOLD <= len(reply) {
+		reply, err = compressWireMessage(compression, reply)
+		if err != nil {
+			http.Error(w, "Failed to compress reply", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(WIRE_COMPRESSION_HEADER, compression)
+	}
+
+	if s.OnMessage != nil {
+		s.OnMessage(r.Header.Get(PEER_ADDRESS_HEADER), messageType, len(body), len(reply))
+	}
+
+	// Respond.
+	w.Header().Set("Content-Type", codec.ContentType())
+	w.Header().Set(WIRE_ENCODING_HEADER, codec.Name())
+	w.WriteHeader(http.StatusOK)
+	w.Write(reply)
 }
 
 func SendMessageToPeer(peerUrl string, message any, log *log.Logger) ([]byte, error) {
-	// Dial on HTTP.
-	url := fmt.Sprintf("%s/peerapi/inbox", peerUrl)
-	log.Printf("Sending message to peer at %s\n", url)
-
 	// JSON encode message.
 	messageJson, err := json.Marshal(message)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal message: %v", err)
 	}
 
-	// Print json.
-	log.Printf("Sending message: %s\n", messageJson)
+	res, _, err := sendRawMessageToPeer(peerUrl, messageJson, wireCodecs[WIRE_ENCODING_JSON], "", "", log)
+	return res, err
+}
+
+// Sends an encoded message to a peer. If fromAddr is set, the receiver can attribute the message to us. If
+// compression is set, the peer may compress its reply using it.
+// Returns the decompressed reply, and the number of bytes received on the wire.
+func sendRawMessageToPeer(peerUrl string, messageBytes []byte, codec WireCodec, compression string, fromAddr string, log *log.Logger) ([]byte, int, error) {
+	body, wireSize, _, err := sendSignedMessageToPeer(peerUrl, messageBytes, codec, compression, fromAddr, nil, log)
+	return body, wireSize, err
+}
+
+// Sends an encoded message to a peer, signed by our identity if it's set. See identity.go.
+// Returns the decompressed reply, the number of bytes received on the wire, and the node ID which signed the reply
+// ("" if unsigned).
+func sendSignedMessageToPeer(peerUrl string, messageBytes []byte, codec WireCodec, compression string, fromAddr string, identity *core.Wallet, log *log.Logger) ([]byte, int, string, error) {
+	// Dial on HTTP.
+	url := fmt.Sprintf("%s/peerapi/inbox", peerUrl)
+	log.Printf("Sending message to peer at %s\n", url)
+
+	// Print message.
+	if codec.Name() == WIRE_ENCODING_JSON {
+		log.Printf("Sending message: %s\n", messageBytes)
+	} else {
+		log.Printf("Sending message: encoding=%s size=%d\n", codec.Name(), len(messageBytes))
+	}
 
 	// Create a new HTTP request.
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(messageJson))
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(messageBytes))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+		return nil, 0, "", fmt.Errorf("failed to create request: %v", err)
 	}
 
 	// Set headers.
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", codec.ContentType())
+	req.Header.Set(WIRE_ENCODING_HEADER, codec.Name())
+	if fromAddr != "" {
+		req.Header.Set(PEER_ADDRESS_HEADER, fromAddr)
+	}
+	if compression != "" {
+		req.Header.Set(WIRE_ACCEPT_COMPRESSION_HEADER, compression)
+	}
+	nonce := newPeerMessageNonce()
+	req.Header.Set(PEER_NONCE_HEADER, nonce)
+	if err := signPeerMessage(req.Header, identity, messageBytes, nonce, time.Now()); err != nil {
+		return nil, 0, "", err
+	}
 
 	// Send request.
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := peerHttpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %v", err)
+		return nil, 0, "", fmt.Errorf("failed to send request: %v", err)
 	}
 	defer resp.Body.Close()
 
 	// Read response.
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_MESSAGE_SIZE+1))
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response: %v", err)
+		return nil, 0, "", fmt.Errorf("failed to read response: %v", err)
+	}
+	if MAX_MESSAGE_SIZE < len(body) {
+		return nil, 0, "", fmt.Errorf("response too large, max is %d bytes", MAX_MESSAGE_SIZE)
 	}
 
 	// Print response and status code.
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		return nil, 0, "", &PeerBusyError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("error in request, status=%d, body=\"%s\"", resp.StatusCode, body)
+		return nil, 0, "", fmt.Errorf("error in request, status=%d, body=\"%s\"", resp.StatusCode, body)
+	}
+
+	// Decompress.
+	wireSize := len(body)
+	if replyCompression := resp.Header.Get(WIRE_COMPRESSION_HEADER); replyCompression != "" {
+		body, err = decompressWireMessage(replyCompression, body)
+		if err != nil {
+			return nil, 0, "", fmt.Errorf("failed to decompress response: %v", err)
+		}
+	}
+
+	signer, err := verifyPeerMessage(resp.Header, body, time.Now())
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("failed to verify response: %v", err)
+	}
+	if signer != "" && resp.Header.Get(PEER_NONCE_HEADER) != nonce {
+		return nil, 0, "", fmt.Errorf("failed to verify response: reply isn't signed for this message")
 	}
 
-	return body, nil
+	return body, wireSize, signer, nil
+}
+
+// Returned when a peer replies that it's busy. It wraps ErrPeerBusy.
+type PeerBusyError struct {
+	// How long the peer asked us to back off for.
+	RetryAfter time.Duration
+}
+
+func (e *PeerBusyError) Error() string {
+	return fmt.Sprintf("peer busy, retry after %s", e.RetryAfter)
+}
+
+func (e *PeerBusyError) Unwrap() error {
+	return ErrPeerBusy
+}
+
+// Parses a Retry-After header in seconds, defaulting to PEER_BUSY_RETRY_AFTER.
+func parseRetryAfter(header string) time.Duration {
+	seconds, err := strconv.Atoi(header)
+	if err != nil || seconds <= 0 {
+		return PEER_BUSY_RETRY_AFTER
+	}
+	return time.Duration(seconds) * time.Second
 }
@@ -1,7 +1,10 @@
 package nakamoto
 
 import (
+	"bytes"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -32,3 +35,29 @@ func TestPeerServerStartFailsForPortInUse(t *testing.T) {
 	err := <-errChan
 	assert.Equal(fmt.Sprintf("listen tcp 127.0.0.1:%s: bind: address already in use", port), err.Error())
 }
+
+func TestPeerServerMessageSizeLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	server := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	server.RegisterMesageHandler("new_tx", func(message []byte, codec WireCodec) (interface{}, error) {
+		return nil, nil
+	})
+	ts := httptest.NewServer(server.server.Handler)
+	defer ts.Close()
+
+	send := func(size int) int {
+		msg := []byte(`{"type": "new_tx", "padding": "`)
+		msg = append(msg, bytes.Repeat([]byte("a"), size-len(msg)-2)...)
+		msg = append(msg, []byte(`"}`)...)
+		res, err := http.Post(ts.URL+"/peerapi/inbox", "application/json", bytes.NewReader(msg))
+		if err != nil {
+			t.Fatalf("Failed to send message: %s", err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	assert.Equal(http.StatusOK, send(MAX_MESSAGE_SIZE))
+	assert.Equal(http.StatusRequestEntityTooLarge, send(MAX_MESSAGE_SIZE+1))
+}
@@ -1,14 +1,17 @@
 package nakamoto
 
 import (
-	"encoding/json"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/liamzebedee/tinychain-go/core"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -97,13 +100,13 @@ func TestStartPeerHeartbeat(t *testing.T) {
 
 	// Override message handler.
 	heartbeatChan := make(chan HeartbeatMesage, 1)
-	peer1.server.RegisterMesageHandler("heartbeat", func(message []byte) (interface{}, error) {
+	peer1.server.RegisterMesageHandler("heartbeat", func(message []byte, codec WireCodec) (interface{}, error) {
 		t.Logf("Received heartbeat message: %s", message)
 
 		// Decode message into HeartbeatMessage.
 		var hb HeartbeatMesage
-		if err := json.Unmarshal(message, &hb); err != nil {
-			t.Fatalf(err.Error())
+		if err := codec.Unmarshal(message, &hb); err != nil {
+			t.Fatal(err)
 			return nil, err
 		}
 
@@ -154,3 +157,471 @@ func TestPeerGossip(t *testing.T) {
 	// Gossip a block from peer 1 to peer 2.
 	// raw := RawBlock{}
 }
+
+func TestPeerBanning(t *testing.T) {
+	assert := assert.New(t)
+
+	peer := &PeerCore{
+		peers: []Peer{
+			{url: "http://10.0.0.1:8080"},
+			{url: "http://10.0.0.1:8081"},
+			{url: "http://10.0.0.2:8080"},
+		},
+		bannedHosts: make(map[string]time.Time),
+		peerLogger:  *NewLogger("peer", "test"),
+	}
+	peer.server = NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	peer.server.AllowRequest = func(r *http.Request) bool {
+		return !peer.IsBanned(clientIP(r))
+	}
+
+	// Banning a peer disconnects all peers on its host.
+	assert.Nil(peer.BanPeer("http://10.0.0.1:8080", 0))
+	assert.True(peer.IsBanned("10.0.0.1"))
+	assert.False(peer.IsBanned("10.0.0.2"))
+	assert.Equal(1, len(peer.Peers()))
+	assert.Equal("http://10.0.0.2:8080", peer.Peers()[0].url)
+
+	// Banned peers cannot be added.
+	assert.NotNil(peer.AddPeer("http://10.0.0.1:8082"))
+
+	// Messages from banned hosts are rejected.
+	req := httptest.NewRequest(http.MethodPost, "/peerapi/inbox", strings.NewReader(`{"type": "heartbeat"}`))
+	req.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	peer.server.inboxHandler(w, req)
+	assert.Equal(http.StatusForbidden, w.Code)
+
+	// Unban.
+	assert.Nil(peer.UnbanPeer("10.0.0.1"))
+	assert.False(peer.IsBanned("10.0.0.1"))
+	assert.NotNil(peer.UnbanPeer("10.0.0.1"))
+
+	// Temporary bans expire.
+	assert.Nil(peer.BanPeer("http://10.0.0.2:8080", time.Millisecond))
+	assert.Equal(0, len(peer.Peers()))
+	assert.Equal(1, len(peer.BannedHosts()))
+	time.Sleep(5 * time.Millisecond)
+	assert.False(peer.IsBanned("10.0.0.2"))
+	assert.Equal(0, len(peer.BannedHosts()))
+
+	// Remove peer.
+	peer.peers = []Peer{{url: "http://10.0.0.3:8080"}}
+	assert.Nil(peer.RemovePeer("http://10.0.0.3:8080"))
+	assert.NotNil(peer.RemovePeer("http://10.0.0.3:8080"))
+	assert.Equal(0, len(peer.Peers()))
+}
+
+func TestPeerLatencyAndBandwidthAccounting(t *testing.T) {
+	assert := assert.New(t)
+
+	// A remote peer server, which echoes heartbeats and records inbound messages.
+	remote := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	remote.RegisterMesageHandler("heartbeat", func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg HeartbeatMesage
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+		return HeartbeatMesage{Type: "heartbeat", ClientVersion: "remote", TipHeight: 42, EchoTime: msg.Time}, nil
+	})
+	inbound := make(chan string, 1)
+	remote.OnMessage = func(peerAddr string, messageType string, bytesReceived int, bytesSent int) {
+		assert.Less(0, bytesReceived)
+		assert.Less(0, bytesSent)
+		inbound <- peerAddr
+	}
+	server := httptest.NewServer(remote.server.Handler)
+	defer server.Close()
+
+	local := &PeerCore{
+		peers:        []Peer{{url: server.URL}},
+		externalIp:   "127.0.0.1",
+		externalPort: "9999",
+		bannedHosts:  make(map[string]time.Time),
+		peerLogger:   *NewLogger("peer", "test"),
+	}
+
+	reply, rtt, err := local.sendHeartbeat(server.URL)
+	assert.Nil(err)
+	assert.Equal("remote", reply.ClientVersion)
+	assert.Equal(42, reply.TipHeight)
+	assert.Less(time.Duration(0), rtt)
+
+	// The remote can attribute the message to us.
+	assert.Equal("http://127.0.0.1:9999", <-inbound)
+
+	// Messages and bytes are accounted by message type.
+	peer := local.Peers()[0]
+	stats := peer.messageStats["heartbeat"]
+	assert.Equal(uint64(1), stats.MessagesSent)
+	assert.Less(uint64(0), stats.BytesSent)
+	assert.Less(uint64(0), stats.BytesReceived)
+	assert.Equal(stats, peer.totalMessageStats())
+
+	// Latency is smoothed.
+	peer.recordLatency(100 * time.Millisecond)
+	peer.recordLatency(200 * time.Millisecond)
+	assert.Equal(120*time.Millisecond, peer.latency)
+}
+
+func TestPeerInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	// A remote peer which holds its heartbeat replies until released.
+	release := make(chan struct{})
+	remote := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	remote.RegisterMesageHandler("heartbeat", func(message []byte, codec WireCodec) (interface{}, error) {
+		<-release
+		return HeartbeatMesage{Type: "heartbeat", TipHash: "abcd", TipHeight: 7, WireProtocolVersion: 3}, nil
+	})
+	server := httptest.NewServer(remote.server.Handler)
+	defer server.Close()
+
+	connectedAt := time.Now().Add(-time.Minute)
+	local := &PeerCore{
+		peers:       []Peer{{url: server.URL, connectedAt: connectedAt}},
+		bannedHosts: make(map[string]time.Time),
+		peerLogger:  *NewLogger("peer", "test"),
+	}
+
+	// Requests awaiting a reply are in flight.
+	done := make(chan HeartbeatMesage)
+	go func() {
+		reply, _, err := local.sendHeartbeat(server.URL)
+		assert.Nil(err)
+		done <- reply
+	}()
+	assert.Eventually(func() bool {
+		return local.Peers()[0].inFlight["heartbeat"] == 1
+	}, time.Second, 10*time.Millisecond)
+	info := NewRPCPeerInfo(local.Peers()[0], 0, time.Now())
+	assert.Equal(1, info.InFlightTotal)
+	assert.Equal("outbound", info.Direction)
+	assert.Equal(uint64(0), info.LastHeartbeat)
+
+	close(release)
+	reply := <-done
+	assert.Equal(0, len(local.Peers()[0].inFlight))
+
+	// The advertised tip and protocol version are recorded from heartbeats.
+	now := time.Now()
+	local.updatePeer(server.URL, func(peer *Peer) {
+		peer.recordHeartbeat(reply, now)
+	})
+	local.Misbehaving("127.0.0.1", 10, "test")
+	info = NewRPCPeerInfo(local.Peers()[0], local.MisbehaviourScore("127.0.0.1"), now)
+	assert.Equal("abcd", info.TipHash)
+	assert.Equal(uint64(7), info.TipHeight)
+	assert.Equal(uint(3), info.ProtocolVersion)
+	assert.Equal(uint64(now.Unix()), info.LastHeartbeat)
+	assert.Equal(uint64(60), info.ConnectedSeconds)
+	assert.Equal(10, info.BanScore)
+	assert.Equal(0, info.InFlightTotal)
+}
+
+func TestSortPeersByLatency(t *testing.T) {
+	assert := assert.New(t)
+
+	peers := []Peer{
+		{url: "a", latency: 0},
+		{url: "b", latency: 30 * time.Millisecond},
+		{url: "c", latency: 10 * time.Millisecond},
+		{url: "d", latency: 0},
+		{url: "e", latency: 20 * time.Millisecond},
+	}
+	urls := []string{}
+	for _, peer := range sortPeersByLatency(peers) {
+		urls = append(urls, peer.url)
+	}
+	assert.Equal([]string{"c", "e", "b", "a", "d"}, urls)
+}
+
+func TestPeerEvictStalePeers(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	peer := &PeerCore{
+		peers: []Peer{
+			// Healthy.
+			{url: "http://a", lastSeen: uint64(now.Unix()), tipHeight: 10, tipAdvancedAt: now},
+			// Heartbeats stopped.
+			{url: "http://b", lastSeen: uint64(now.Add(-2 * time.Minute).Unix()), tipHeight: 10, tipAdvancedAt: now},
+			// Tip stale and behind ours.
+			{url: "http://c", lastSeen: uint64(now.Unix()), tipHeight: 5, tipAdvancedAt: now.Add(-time.Hour)},
+			// Tip stale but not behind ours.
+			{url: "http://d", lastSeen: uint64(now.Unix()), tipHeight: 10, tipAdvancedAt: now.Add(-time.Hour)},
+		},
+		HeartbeatTimeoutSeconds: 90,
+		StaleTipTimeoutSeconds:  30 * 60,
+		TargetPeers:             3,
+		MaxPeers:                32,
+		knownPeers:              make(map[string]time.Time),
+		bannedHosts:             make(map[string]time.Time),
+		peerLogger:              *NewLogger("peer", "test"),
+	}
+	peer.OnGetFullTip = func() ([32]byte, uint64) {
+		return [32]byte{}, 10
+	}
+
+	peer.evictStalePeers(now)
+	urls := []string{}
+	for _, p := range peer.Peers() {
+		urls = append(urls, p.url)
+	}
+	assert.Equal([]string{"http://a", "http://d"}, urls)
+
+	// Evicted peers are not redialed until their backoff expires.
+	peer.addKnownPeer("http://e")
+	assert.Equal([]string{"http://e"}, peer.peersToDial(now))
+	assert.Equal(1, len(peer.peersToDial(now.Add(2*time.Minute))))
+	peer.TargetPeers = 5
+	assert.ElementsMatch([]string{"http://b", "http://e"}, peer.peersToDial(now.Add(2*time.Minute)))
+	assert.ElementsMatch([]string{"http://b", "http://c", "http://e"}, peer.peersToDial(now.Add(time.Hour)))
+}
+
+func TestPeerInboundLimitsAndEviction(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	peer := &PeerCore{
+		peers:            []Peer{{url: "http://10.0.0.1:8080", connectedAt: now}},
+		MaxPeers:         4,
+		MinOutboundPeers: 1,
+		knownPeers:       make(map[string]time.Time),
+		bannedHosts:      make(map[string]time.Time),
+		peerLogger:       *NewLogger("peer", "test"),
+	}
+
+	// Accept up to MaxPeers - MinOutboundPeers inbound peers.
+	for i, addr := range []string{"http://1.1.0.1:8080", "http://2.2.0.1:8080", "http://2.2.0.2:8080"} {
+		err := peer.acceptInboundPeer(HeartbeatMesage{ClientAddress: addr, TipHeight: i}, now.Add(time.Duration(i)*time.Second))
+		assert.Nil(err)
+	}
+	assert.Equal(4, len(peer.Peers()))
+
+	// Heartbeats from existing peers update them.
+	assert.Nil(peer.acceptInboundPeer(HeartbeatMesage{ClientAddress: "http://1.1.0.1:8080", TipHeight: 10}, now))
+	assert.Equal(4, len(peer.Peers()))
+	assert.Equal(uint64(10), peer.Peers()[1].tipHeight)
+
+	// Outbound slots are reserved.
+	assert.NotNil(peer.AddPeer("http://10.0.0.2:8080"))
+
+	// A new inbound peer evicts an unprotected inbound peer. With the small numbers here, all peers are protected.
+	assert.NotNil(peer.acceptInboundPeer(HeartbeatMesage{ClientAddress: "http://3.3.0.1:8080"}, now))
+	assert.Equal(4, len(peer.Peers()))
+}
+
+func TestSelectInboundPeerToEvict(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	peers := []Peer{
+		// Outbound peers are never evicted.
+		{url: "http://9.9.9.9:8080", connectedAt: now.Add(-time.Hour)},
+	}
+	// 4 peers in distinct netgroups, protected by netgroup.
+	for i := 1; i <= 4; i++ {
+		peers = append(peers, Peer{url: fmt.Sprintf("http://%d.0.0.1:8080", i), inbound: true, connectedAt: now})
+	}
+	// 8 low-latency peers in the same netgroup, protected by latency.
+	for i := 1; i <= 8; i++ {
+		peers = append(peers, Peer{url: fmt.Sprintf("http://100.100.0.%d:8080", i), inbound: true, latency: time.Duration(i) * time.Millisecond, connectedAt: now})
+	}
+	// 4 long-lived peers, 2 of which are protected by uptime.
+	for i := 1; i <= 4; i++ {
+		peers = append(peers, Peer{url: fmt.Sprintf("http://200.200.0.%d:8080", i), inbound: true, connectedAt: now.Add(-time.Duration(i) * time.Minute)})
+	}
+	// 1 young peer in the same netgroup, which is evicted.
+	peers = append(peers, Peer{url: "http://200.200.0.5:8080", inbound: true, connectedAt: now})
+
+	evict, ok := selectInboundPeerToEvict(peers)
+	assert.True(ok)
+	assert.Equal("http://200.200.0.5:8080", evict)
+
+	// All peers protected.
+	_, ok = selectInboundPeerToEvict(peers[:5])
+	assert.False(ok)
+
+	assert.Equal("10.1.0.0/16", peerNetgroup("http://10.1.2.3:8080"))
+	assert.Equal("example.com", peerNetgroup("http://example.com:8080"))
+}
+
+func TestPeerBlocksOnlyMode(t *testing.T) {
+	assert := assert.New(t)
+
+	// Two remote peers, one of which is in blocks-only mode.
+	received := make(chan string, 2)
+	newRemote := func(name string) *httptest.Server {
+		remote := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+		remote.RegisterMesageHandler("new_tx", func(message []byte, codec WireCodec) (interface{}, error) {
+			received <- name
+			return nil, nil
+		})
+		return httptest.NewServer(remote.server.Handler)
+	}
+	relay := newRemote("relay")
+	defer relay.Close()
+	blocksOnly := newRemote("blocks-only")
+	defer blocksOnly.Close()
+
+	local := &PeerCore{
+		peers: []Peer{
+			{url: relay.URL, services: NODE_SERVICE_TX_RELAY},
+			{url: blocksOnly.URL, services: 0},
+		},
+		bannedHosts: make(map[string]time.Time),
+		peerLogger:  *NewLogger("peer", "test"),
+	}
+	assert.Equal(NODE_SERVICE_TX_RELAY, local.newHeartbeat().Services)
+
+	// Transactions are only relayed to peers which advertise the relay service.
+	local.GossipTransaction(RawTransaction{})
+	assert.Equal("relay", <-received)
+	assert.Equal(0, len(received))
+
+	// In blocks-only mode, we don't advertise the relay service.
+	local.BlocksOnly = true
+	assert.Equal(uint64(0), local.newHeartbeat().Services)
+}
+
+func TestPeerTxFilter(t *testing.T) {
+	assert := assert.New(t)
+	wallets := getTestingWallets(t)
+
+	received := make(chan string, 2)
+	newRemote := func(name string) *httptest.Server {
+		remote := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+		remote.RegisterMesageHandler("new_tx", func(message []byte, codec WireCodec) (interface{}, error) {
+			received <- name
+			return nil, nil
+		})
+		return httptest.NewServer(remote.server.Handler)
+	}
+	unfiltered := newRemote("unfiltered")
+	defer unfiltered.Close()
+	filtered := newRemote("filtered")
+	defer filtered.Close()
+
+	// The filtered peer registers its filter with its heartbeat.
+	local := &PeerCore{
+		peers:       []Peer{},
+		bannedHosts: make(map[string]time.Time),
+		peerLogger:  *NewLogger("peer", "test"),
+		MaxPeers:    8,
+	}
+	remoteCore := &PeerCore{TxFilter: NewPubkeyBloomFilter([][65]byte{wallets[0].PubkeyBytes()}, 0.0001)}
+	heartbeat := remoteCore.newHeartbeat()
+	assert.NotNil(heartbeat.TxFilter)
+	heartbeat.ClientAddress = filtered.URL
+	heartbeat.Services = NODE_SERVICE_TX_RELAY
+	assert.Nil(local.acceptInboundPeer(heartbeat, time.Now()))
+	assert.NotNil(local.Peers()[0].txFilter)
+	local.peers = append(local.peers, Peer{url: unfiltered.URL, services: NODE_SERVICE_TX_RELAY})
+
+	// Only matching transactions are relayed to it.
+	local.GossipTransaction(RawTransaction{FromPubkey: wallets[1].PubkeyBytes(), ToPubkey: wallets[1].PubkeyBytes()})
+	assert.Equal("unfiltered", <-received)
+	assert.Equal(0, len(received))
+	local.GossipTransaction(RawTransaction{FromPubkey: wallets[1].PubkeyBytes(), ToPubkey: wallets[0].PubkeyBytes()})
+	names := []string{<-received, <-received}
+	assert.ElementsMatch([]string{"filtered", "unfiltered"}, names)
+
+	// Invalid filters are ignored.
+	heartbeat.TxFilter = &BloomFilter{Bits: make([]byte, MAX_BLOOM_FILTER_BYTES+1), NumHashes: 1}
+	assert.Nil(local.acceptInboundPeer(heartbeat, time.Now()))
+	assert.Nil(local.Peers()[0].txFilter)
+}
+
+func TestPeerSyncRejectsOversizedReplies(t *testing.T) {
+	assert := assert.New(t)
+
+	// A remote peer which replies with more headers than requested.
+	remote := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	remote.RegisterMesageHandler("get_block_headers", func(message []byte, codec WireCodec) (interface{}, error) {
+		return SyncGetDataReply{Headers: make([]BlockHeader, 100)}, nil
+	})
+	server := httptest.NewServer(remote.server.Handler)
+	defer server.Close()
+
+	local := &PeerCore{
+		peers:       []Peer{{url: server.URL}},
+		bannedHosts: make(map[string]time.Time),
+		peerLogger:  *NewLogger("peer", "test"),
+	}
+
+	heights := core.NewBitset(2048)
+	heights.Insert(0)
+	heights.Insert(1)
+	_, err := local.SyncGetBlockHeaders(local.peers[0], [32]byte{}, *heights)
+	assert.ErrorContains(err, "too many headers")
+}
+
+func TestPeerMisbehaviourBan(t *testing.T) {
+	assert := assert.New(t)
+
+	local := &PeerCore{
+		peers: []Peer{
+			{url: "http://10.0.0.1:8000"},
+			{url: "http://10.0.0.2:8000"},
+		},
+		bannedHosts: make(map[string]time.Time),
+		peerLogger:  *NewLogger("peer", "test"),
+	}
+
+	// Scores accumulate until the host is banned.
+	local.Misbehaving("10.0.0.1", 50, "test")
+	assert.False(local.IsBanned("10.0.0.1"))
+	local.Misbehaving("10.0.0.1", 50, "test")
+	assert.True(local.IsBanned("10.0.0.1"))
+	assert.Equal(1, len(local.Peers()))
+	assert.Equal("http://10.0.0.2:8000", local.Peers()[0].url)
+
+	// The ban expires.
+	until := local.BannedHosts()["10.0.0.1"]
+	assert.WithinDuration(time.Now().Add(MISBEHAVIOUR_BAN_DURATION), until, time.Minute)
+}
+
+func TestPeerServerOnMessageError(t *testing.T) {
+	assert := assert.New(t)
+
+	server := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	server.RegisterMesageHandler("new_block", func(message []byte, codec WireCodec) (interface{}, error) {
+		return nil, &PeerMisbehaviourError{Score: MISBEHAVIOUR_BAN_SCORE, Reason: "invalid POW"}
+	})
+	errs := make(chan error, 1)
+	server.OnMessageError = func(r *http.Request, messageType string, err error) {
+		assert.Equal("new_block", messageType)
+		errs <- err
+	}
+	ts := httptest.NewServer(server.server.Handler)
+	defer ts.Close()
+
+	_, err := SendMessageToPeer(ts.URL, NewBlockMessage{Type: "new_block"}, &server.log)
+	assert.NotNil(err)
+
+	var misbehaviour *PeerMisbehaviourError
+	assert.ErrorAs(<-errs, &misbehaviour)
+	assert.Equal(MISBEHAVIOUR_BAN_SCORE, misbehaviour.Score)
+}
+
+func TestPeerServerBusy(t *testing.T) {
+	assert := assert.New(t)
+
+	server := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	server.RegisterMesageHandler("new_block", func(message []byte, codec WireCodec) (interface{}, error) {
+		return nil, ErrPeerBusy
+	})
+	ts := httptest.NewServer(server.server.Handler)
+	defer ts.Close()
+
+	_, err := SendMessageToPeer(ts.URL, NewBlockMessage{Type: "new_block"}, &server.log)
+	assert.ErrorIs(err, ErrPeerBusy)
+	var busy *PeerBusyError
+	assert.ErrorAs(err, &busy)
+	assert.Equal(PEER_BUSY_RETRY_AFTER, busy.RetryAfter)
+
+	assert.Equal(PEER_BUSY_RETRY_AFTER, parseRetryAfter(""))
+	assert.Equal(PEER_BUSY_RETRY_AFTER, parseRetryAfter("-1"))
+	assert.Equal(30*time.Second, parseRetryAfter("30"))
+}
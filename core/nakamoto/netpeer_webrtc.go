@@ -0,0 +1,365 @@
+package nakamoto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Browsers can't open TCP or QUIC connections to a peer, so light clients in a browser connect to full nodes over
+// WebRTC data channels instead. WebRTC connects through NATs (using ICE), so a browser can reach a node without a
+// public address, and the channel is encrypted (using DTLS).
+//
+// The browser sets up the connection through the node's API server, which it already knows the URL of. It creates a
+// peer connection with a data channel labelled PEER_WEBRTC_CHANNEL, and POSTs its SDP offer to PEER_WEBRTC_SIGNAL_PATH.
+// The node replies with its SDP answer, including all of its ICE candidates, so there's no further signalling.
+//
+// Messages are multiplexed on the data channel like on a TCP connection (see netpeer_mux.go), with each data channel
+// message carrying one frame. Frames are smaller than over TCP, since browsers and WebRTC stacks limit the size of
+// data channel messages. The node handles messages with the same inbox handler, so replies are signed and verified
+// the same way, and a light client doesn't need to trust the node for the headers and proofs it verifies.
+
+const (
+	// The path of the signalling endpoint on the API server, and the label of the data channel messages are sent on.
+	PEER_WEBRTC_SIGNAL_PATH = "/webrtc"
+	PEER_WEBRTC_CHANNEL     = "tinychain-mux/1"
+
+	// The maximum payload of a frame on a data channel.
+	PEER_WEBRTC_FRAME_SIZE = 16 * 1024
+	// The maximum size of an SDP offer.
+	MAX_WEBRTC_OFFER_SIZE = 64 * 1024
+	// The maximum number of WebRTC connections to the node at once.
+	MAX_WEBRTC_CONNS = 64
+	// How long a WebRTC connection has to open its data channel, once its offer is answered.
+	PEER_WEBRTC_CONNECT_TIMEOUT = 30 * time.Second
+)
+
+var errWebRTCFrameTooLarge = errors.New("data channel message too large")
+
+// Creates the WebRTC API, with data channels detached so they can be read and written like a connection.
+func newPeerWebRTCAPI() *webrtc.API {
+	settings := webrtc.SettingEngine{}
+	settings.DetachDataChannels()
+	return webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+}
+
+// A data channel, as a connection which frames are read from and written to. Each data channel message is a frame.
+type webrtcConn struct {
+	channel io.ReadWriteCloser
+	pc      *webrtc.PeerConnection
+	local   net.Addr
+	remote  net.Addr
+
+	// The unread part of the last message received.
+	pending []byte
+	buf     []byte
+}
+
+func newWebRTCConn(channel io.ReadWriteCloser, pc *webrtc.PeerConnection) *webrtcConn {
+	conn := &webrtcConn{
+		channel: channel,
+		pc:      pc,
+		local:   &net.UDPAddr{},
+		remote:  &net.UDPAddr{},
+		buf:     make([]byte, muxFrameHeaderSize+PEER_WEBRTC_FRAME_SIZE),
+	}
+	if pair, err := pc.SCTP().Transport().ICETransport().GetSelectedCandidatePair(); err == nil && pair != nil {
+		conn.local = &net.UDPAddr{IP: net.ParseIP(pair.Local.Address), Port: int(pair.Local.Port)}
+		conn.remote = &net.UDPAddr{IP: net.ParseIP(pair.Remote.Address), Port: int(pair.Remote.Port)}
+	}
+	return conn
+}
+
+func (c *webrtcConn) Read(buf []byte) (int, error) {
+	if len(c.pending) == 0 {
+		n, err := c.channel.Read(c.buf)
+		if errors.Is(err, io.ErrShortBuffer) {
+			return 0, errWebRTCFrameTooLarge
+		}
+		if err != nil {
+			return 0, err
+		}
+		c.pending = c.buf[:n]
+	}
+	n := copy(buf, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *webrtcConn) Write(buf []byte) (int, error) {
+	return c.channel.Write(buf)
+}
+
+func (c *webrtcConn) Close() error {
+	c.channel.Close()
+	return c.pc.Close()
+}
+
+func (c *webrtcConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *webrtcConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *webrtcConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *webrtcConn) SetReadDeadline(t time.Time) error {
+	if channel, ok := c.channel.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return channel.SetReadDeadline(t)
+	}
+	return nil
+}
+
+// Writes to a data channel are buffered rather than blocking, so there's no write deadline.
+func (c *webrtcConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// The client.
+// =====================================================================================================================
+
+// Connects to a node over WebRTC through its signalling endpoint, as a browser would. Returns a session which messages
+// can be sent to the node on, once its run method is reading the replies.
+func dialPeerWebRTC(signalUrl string) (*muxSession, error) {
+	pc, err := newPeerWebRTCAPI().NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	channel, err := pc.CreateDataChannel(PEER_WEBRTC_CHANNEL, nil)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	opened := make(chan io.ReadWriteCloser, 1)
+	channel.OnOpen(func() {
+		raw, err := channel.Detach()
+		if err != nil {
+			pc.Close()
+			return
+		}
+		opened <- raw
+	})
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	<-gathered
+
+	offerBuf, err := json.Marshal(pc.LocalDescription())
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	client := &http.Client{Timeout: PEER_MUX_DIAL_TIMEOUT}
+	res, err := client.Post(signalUrl, "application/json", bytes.NewReader(offerBuf))
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		pc.Close()
+		return nil, fmt.Errorf("signalling failed, status=%d", res.StatusCode)
+	}
+	var answer webrtc.SessionDescription
+	if err := json.NewDecoder(io.LimitReader(res.Body, MAX_WEBRTC_OFFER_SIZE)).Decode(&answer); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	if err := pc.SetRemoteDescription(answer); err != nil {
+		pc.Close()
+		return nil, err
+	}
+
+	select {
+	case raw := <-opened:
+		conn := newWebRTCConn(raw, pc)
+		session := newMuxSession(conn, bufio.NewReader(conn), false)
+		session.frameSize = PEER_WEBRTC_FRAME_SIZE
+		return session, nil
+	case <-time.After(PEER_WEBRTC_CONNECT_TIMEOUT):
+		pc.Close()
+		return nil, fmt.Errorf("timed out connecting over WebRTC")
+	}
+}
+
+// The server.
+// =====================================================================================================================
+
+// Handler for the signalling endpoint. It answers a browser's SDP offer, and serves messages on the data channel of
+// the connection with the inbox handler, until it's closed.
+func (s *PeerServer) WebRTCSignalHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.AllowRequest != nil && !s.AllowRequest(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_WEBRTC_OFFER_SIZE)).Decode(&offer); err != nil || offer.Type != webrtc.SDPTypeOffer {
+		http.Error(w, "Expected an SDP offer", http.StatusBadRequest)
+		return
+	}
+
+	config := webrtc.Configuration{}
+	if !s.config.NoDiscoverIP {
+		config.ICEServers = []webrtc.ICEServer{{URLs: []string{"stun:" + STUN_SERVER}}}
+	}
+	pc, err := newPeerWebRTCAPI().NewPeerConnection(config)
+	if err != nil {
+		http.Error(w, "Failed to create connection", http.StatusInternalServerError)
+		return
+	}
+
+	s.muxMutex.Lock()
+	if MAX_WEBRTC_CONNS <= len(s.webrtcConns) {
+		s.muxMutex.Unlock()
+		pc.Close()
+		w.Header().Set("Retry-After", strconv.Itoa(int(PEER_BUSY_RETRY_AFTER/time.Second)))
+		http.Error(w, "Busy", http.StatusServiceUnavailable)
+		return
+	}
+	s.webrtcConns[pc] = true
+	s.muxMutex.Unlock()
+
+	// The connection is closed if its data channel doesn't open in time, or once it fails.
+	var once sync.Once
+	closeConn := func() {
+		once.Do(func() {
+			pc.Close()
+			s.muxMutex.Lock()
+			delete(s.webrtcConns, pc)
+			s.muxMutex.Unlock()
+		})
+	}
+	timeout := time.AfterFunc(PEER_WEBRTC_CONNECT_TIMEOUT, closeConn)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			closeConn()
+		}
+	})
+
+	// Messages are served on the first data channel the browser opens.
+	var served sync.Once
+	pc.OnDataChannel(func(channel *webrtc.DataChannel) {
+		if channel.Label() != PEER_WEBRTC_CHANNEL {
+			channel.Close()
+			return
+		}
+		channel.OnOpen(func() {
+			served.Do(func() {
+				timeout.Stop()
+				raw, err := channel.Detach()
+				if err != nil {
+					closeConn()
+					return
+				}
+				go func() {
+					s.serveWebRTC(newWebRTCConn(raw, pc), r.Host)
+					closeConn()
+				}()
+			})
+		})
+	})
+
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		closeConn()
+		http.Error(w, "Invalid SDP offer", http.StatusBadRequest)
+		return
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		closeConn()
+		http.Error(w, "Failed to answer SDP offer", http.StatusBadRequest)
+		return
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		closeConn()
+		http.Error(w, "Failed to answer SDP offer", http.StatusInternalServerError)
+		return
+	}
+	select {
+	case <-gathered:
+	case <-r.Context().Done():
+		closeConn()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pc.LocalDescription())
+}
+
+// WebRTCSignaller is implemented by the networking backends browsers can connect to. The node serves its handler for
+// the signalling endpoint on its API server.
+type WebRTCSignaller interface {
+	WebRTCSignalHandler() http.Handler
+}
+
+// Returns the handler for the signalling endpoint, which the node serves on its API server.
+func (p *PeerCore) WebRTCSignalHandler() http.Handler {
+	return http.HandlerFunc(p.server.WebRTCSignalHandler)
+}
+
+// Serves messages on a data channel, until it's closed.
+func (s *PeerServer) serveWebRTC(conn *webrtcConn, host string) {
+	r, err := http.NewRequest(http.MethodGet, PEER_WEBRTC_SIGNAL_PATH, nil)
+	if err != nil {
+		return
+	}
+	r.RemoteAddr = conn.RemoteAddr().String()
+	if s.AllowRequest != nil && !s.AllowRequest(r) {
+		return
+	}
+
+	session := newMuxSession(conn, bufio.NewReader(conn), true)
+	session.frameSize = PEER_WEBRTC_FRAME_SIZE
+	session.handler = func(head muxHead, body []byte) (muxHead, []byte) {
+		return s.handleStreamMessage(head, body, r.RemoteAddr, host)
+	}
+
+	s.muxMutex.Lock()
+	s.muxSessions[session] = true
+	s.muxMutex.Unlock()
+
+	session.readLoop()
+
+	s.muxMutex.Lock()
+	delete(s.muxSessions, session)
+	s.muxMutex.Unlock()
+}
+
+// Closes the WebRTC connections.
+func (s *PeerServer) closeWebRTC() {
+	s.muxMutex.Lock()
+	conns := s.webrtcConns
+	s.webrtcConns = map[*webrtc.PeerConnection]bool{}
+	s.muxMutex.Unlock()
+	for pc := range conns {
+		pc.Close()
+	}
+}
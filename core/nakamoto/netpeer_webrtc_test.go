@@ -0,0 +1,108 @@
+package nakamoto
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Sends an echo message on a session, returning the echoed padding.
+func sendTestEchoOnSession(t *testing.T, session *muxSession, padding string) string {
+	buf, _ := json.Marshal(map[string]interface{}{"type": "echo", "padding": padding})
+	req, _ := http.NewRequest(http.MethodPost, "/peerapi/inbox", bytes.NewReader(buf))
+	req.Header.Set(WIRE_ENCODING_HEADER, WIRE_ENCODING_JSON)
+	res, err := session.roundTrip(req)
+	if err != nil {
+		t.Errorf("Failed to send message: %s", err)
+		return ""
+	}
+	body, _ := io.ReadAll(res.Body)
+	var reply map[string]interface{}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		t.Errorf("Failed to decode reply: %s", body)
+		return ""
+	}
+	padding, _ = reply["padding"].(string)
+	return padding
+}
+
+func TestPeerWebRTCSendsMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newEchoPeerServer()
+	server.config.NoDiscoverIP = true
+	ts := httptest.NewServer(http.HandlerFunc(server.WebRTCSignalHandler))
+	defer ts.Close()
+	defer server.Stop()
+
+	session, err := dialPeerWebRTC(ts.URL)
+	assert.Nil(err)
+	if err != nil {
+		return
+	}
+	go session.run()
+	defer session.Close()
+
+	// Messages, including one split over many data channel messages, are multiplexed on the data channel.
+	large := string(bytes.Repeat([]byte("a"), 10*PEER_WEBRTC_FRAME_SIZE+1))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			padding := "small"
+			if i == 0 {
+				padding = large
+			}
+			assert.Equal(padding, sendTestEchoOnSession(t, session, padding))
+		}(i)
+	}
+	wg.Wait()
+
+	server.muxMutex.Lock()
+	assert.Equal(1, len(server.webrtcConns))
+	assert.Equal(1, len(server.muxSessions))
+	server.muxMutex.Unlock()
+
+	// Closing the connection closes it on the node.
+	session.Close()
+	assert.Eventually(func() bool {
+		server.muxMutex.Lock()
+		defer server.muxMutex.Unlock()
+		return len(server.webrtcConns) == 0 && len(server.muxSessions) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestPeerWebRTCSignalRejectsInvalidOffers(t *testing.T) {
+	assert := assert.New(t)
+
+	server := newEchoPeerServer()
+	server.config.NoDiscoverIP = true
+	ts := httptest.NewServer(http.HandlerFunc(server.WebRTCSignalHandler))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	assert.Nil(err)
+	assert.Equal(http.StatusMethodNotAllowed, res.StatusCode)
+
+	for _, body := range []string{`not json`, `{"type":"answer","sdp":""}`} {
+		res, err := http.Post(ts.URL, "application/json", strings.NewReader(body))
+		assert.Nil(err)
+		assert.Equal(http.StatusBadRequest, res.StatusCode)
+	}
+
+	// Offers from banned hosts are rejected.
+	server.AllowRequest = func(r *http.Request) bool { return false }
+	res, err = http.Post(ts.URL, "application/json", strings.NewReader(`{"type":"offer","sdp":""}`))
+	assert.Nil(err)
+	assert.Equal(http.StatusForbidden, res.StatusCode)
+	assert.Equal(0, len(server.webrtcConns))
+}
@@ -1,49 +1,126 @@
 package nakamoto
 
 import (
-	"fmt"
+	"encoding/json"
+	"errors"
 	"log"
+	"sync/atomic"
 	"time"
 )
 
 type Node struct {
 	Dag           *BlockDAG
 	Miner         *Miner
-	Peer          *PeerCore
+	Peer          PeerInterface
 	StateMachine1 *StateMachine
-	log           *log.Logger
-	syncLog       *log.Logger
-	stateLog      *log.Logger
+	StateCache    *StateCache
+	// The states of every STATE_CHECKPOINT_INTERVAL'th block of the main chain, which bound the blocks GetStateAt
+	// re-executes. See state_at.go.
+	StateCheckpoints *StateCache
+	Mempool          *Mempool
+	Rebroadcaster    *Rebroadcaster
+	TxTracker        *TxTracker
+	ForkMonitor      *ForkMonitor
+	ClockMonitor     *ClockMonitor
+	IBD              *IBDMonitor
+	DBMaintainer     *DBMaintainer
+	Auditor          *ChainAuditor
+	BlockQueue       *BlockQueue
+	Publisher        *Publisher
+	AddressWatcher   *AddressWatcher
+	AddressBook      *AddressBook
+	Analytics        *ChainAnalytics
+	API              *APIServer
+	// Whether to restart the miner once the node leaves initial block download. See ibd.go.
+	resumeMiner atomic.Bool
+
+	log      *log.Logger
+	syncLog  *log.Logger
+	stateLog *log.Logger
 }
 
-func NewNode(dag *BlockDAG, miner *Miner, peer *PeerCore) *Node {
+func NewNode(dag *BlockDAG, miner *Miner, peer PeerInterface) *Node {
 	stateMachine, err := NewStateMachine(nil)
 	if err != nil {
 		panic(err)
 	}
+	stateMachine.CoinbaseMaturity = dag.consensus.CoinbaseMaturity
+	stateMachine.Forks = dag.consensus.Forks
+	if err := stateMachine.ApplyGenesisAlloc(dag.consensus.GenesisAlloc); err != nil {
+		panic(err)
+	}
 
 	n := &Node{
-		Dag:           dag,
-		Miner:         miner,
-		Peer:          peer,
-		StateMachine1: stateMachine,
-		log:           NewLogger("node", ""),
-		syncLog:       NewLogger("node", "sync"),
-		stateLog:      NewLogger("node", "state"),
+		Dag:              dag,
+		Miner:            miner,
+		Peer:             peer,
+		StateMachine1:    stateMachine,
+		StateCache:       NewStateCache(),
+		StateCheckpoints: NewStateCache(),
+		Mempool:          NewMempool(),
+		Rebroadcaster:    NewRebroadcaster(),
+		TxTracker:        NewTxTracker(),
+		ForkMonitor:      NewForkMonitor(dag),
+		ClockMonitor:     NewClockMonitor(),
+		IBD:              NewIBDMonitor(),
+		DBMaintainer:     NewDBMaintainer(dag.db),
+		Auditor:          NewChainAuditor(dag),
+		BlockQueue:       NewBlockQueue(DEFAULT_BLOCK_QUEUE_CAPACITY),
+		AddressWatcher:   NewAddressWatcher(),
+		AddressBook:      NewAddressBook(),
+		Analytics:        NewChainAnalytics(dag),
+		log:              NewLogger("node", ""),
+		syncLog:          NewLogger("node", "sync"),
+		stateLog:         NewLogger("node", "state"),
+	}
+	n.Mempool.SetBaseFee(dag.GetNextBaseFee(dag.FullTip))
+	n.Mempool.GetAccountNonce = dag.GetAccountNonce
+	n.Mempool.SigCache = dag.SigCache
+	if dag.consensus.StateMachine == "" || dag.consensus.StateMachine == STATE_MACHINE_ACCOUNT {
+		n.Mempool.VerifyTx = n.verifyTxState
+		dag.VerifyBlockState = n.verifyBlockState
 	}
+	miner.Mempool = n.Mempool
+	n.ClockMonitor.GetPeerOffsets = peer.PeerTimeOffsets
+	n.IBD.GetSyncStatus = n.GetSyncStatus
+	n.BlockQueue.IsPriority = func(b RawBlock) bool {
+		return b.ParentHash == n.Dag.FullTip.Hash
+	}
+	n.BlockQueue.Ingest = dag.IngestBlock
 	n.setup()
+
+	// Build the state of an existing chain, which blocks are verified against.
+	if 0 < dag.FullTip.Height {
+		if err := n.rebuildState(); err != nil {
+			n.stateLog.Printf("Failed to rebuild state: %s\n", err)
+		}
+	}
 	return n
 }
 
 func (n *Node) setup() {
+	peer := n.Peer.Callbacks()
+
+	// Check the POW of new blocks before ingesting them, so peers can't spam us with invalid blocks.
+	peer.OnPrecheckBlock = func(b RawBlock) error {
+		return n.Dag.PrecheckBlockPOW(b)
+	}
+
+	// Check the signatures of new transactions before relaying them.
+	peer.OnPrecheckTransaction = func(tx RawTransaction) error {
+		return n.Dag.PrecheckTransaction(tx)
+	}
+
 	// Listen for new blocks.
-	n.Peer.OnNewBlock = func(b RawBlock) {
+	peer.OnNewBlock = func(b RawBlock) error {
 		n.log.Printf("New block gossip from peer: block=%s\n", b.HashStr())
 
 		if n.Dag.HasBlock(b.Hash()) {
 			n.log.Printf("Block already in DAG: block=%s\n", b.HashStr())
-			return
+			return nil
 		}
+		n.ClockMonitor.RecordBlockTimestamp(b.Timestamp, time.Now())
+		n.DBMaintainer.RecordActivity()
 
 		isUnknownParent := n.Dag.HasBlock(b.ParentHash)
 		if isUnknownParent {
@@ -51,21 +128,24 @@ func (n *Node) setup() {
 			n.log.Printf("Block parent unknown: block=%s\n", b.HashStr())
 		}
 
-		// Ingest the block.
-		err := n.Dag.IngestBlock(b)
-		if err != nil {
-			n.log.Printf("Failed to ingest block from peer: %s\n", err)
+		// Queue the block for ingestion, telling the peer to back off if we're overwhelmed.
+		if err := n.BlockQueue.Push(b); err != nil {
+			n.log.Printf("Failed to queue block from peer: %s\n", err)
+			if errors.Is(err, ErrBlockQueueFull) {
+				return ErrPeerBusy
+			}
+			return err
 		}
+		return nil
 	}
 
-	// Upload blocks to other peers.
-	n.Peer.OnGetBlocks = func(msg GetBlocksMessage) ([][]byte, error) {
-		// Assert hashes length.
-		MAX_GET_BLOCKS_LEN := 10
-		if MAX_GET_BLOCKS_LEN < len(msg.BlockHashes) {
-			return nil, fmt.Errorf("Too many hashes requested. Max is %d", MAX_GET_BLOCKS_LEN)
-		}
+	peer.OnHasBlock = func(blockhash [32]byte) bool {
+		return n.Dag.HasBlock(blockhash)
+	}
 
+	// Upload blocks to other peers.
+	peer.OnGetBlocks = func(msg GetBlocksMessage) ([][]byte, error) {
+		// The number of hashes is limited to MAX_GET_BLOCKS_HASHES by the peer.
 		reply := make([][]byte, 0)
 		for _, hash := range msg.BlockHashes {
 			blockhash := HexStringToBytes32(hash)
@@ -87,6 +167,7 @@ func (n *Node) setup() {
 	// Gossip blocks when we mine a new solution.
 	n.Miner.OnBlockSolution = func(b RawBlock) {
 		n.log.Printf("Mined new block: %s\n", b.HashStr())
+		n.DBMaintainer.RecordActivity()
 
 		// Ingest the block.
 		err := n.Dag.IngestBlock(b)
@@ -99,12 +180,51 @@ func (n *Node) setup() {
 	}
 
 	// Gossip the latest tip.
-	n.Peer.OnGetTip = func(msg GetTipMessage) (BlockHeader, error) {
+	peer.OnGetTip = func(msg GetTipMessage) (BlockHeader, error) {
 		return n.Dag.FullTip.ToBlockHeader(), nil
 	}
+	peer.OnGetFullTip = func() ([32]byte, uint64) {
+		return n.Dag.FullTip.Hash, n.Dag.FullTip.Height
+	}
+
+	// Serve checkpoints of our main chain to syncing peers.
+	peer.OnGetCheckpoints = func(msg GetCheckpointsMessage) (GetCheckpointsReply, error) {
+		checkpoints, err := n.Dag.GetCheckpoints(msg.FromHeight, msg.Interval)
+		if err != nil {
+			return GetCheckpointsReply{}, err
+		}
+		return GetCheckpointsReply{Type: "get_checkpoints_reply", Checkpoints: checkpoints}, nil
+	}
+
+	// Prove the work of our main chain to light clients.
+	peer.OnGetWorkProof = func(msg GetWorkProofMessage) (GetWorkProofReply, error) {
+		proof, err := n.Dag.GenerateWorkProof(msg.Seed, msg.Samples)
+		if err != nil {
+			return GetWorkProofReply{}, err
+		}
+		return GetWorkProofReply{Type: "get_work_proof_reply", Proof: proof}, nil
+	}
+
+	// Prove the ancestry of blocks to light clients.
+	peer.OnGetAncestryProof = func(msg GetAncestryProofMessage) (GetAncestryProofReply, error) {
+		proof, err := n.Dag.GetAncestryProof(msg.BlockHash, msg.TipHash)
+		if err != nil {
+			return GetAncestryProofReply{}, err
+		}
+		return GetAncestryProofReply{Type: "get_ancestry_proof_reply", Proof: proof}, nil
+	}
+
+	// Serve compact block filters to light wallets.
+	peer.OnGetBlockFilters = func(msg GetBlockFiltersMessage) (GetBlockFiltersReply, error) {
+		filters, err := n.Dag.GetBlockFilters(msg.FromHeight, msg.Count)
+		if err != nil {
+			return GetBlockFiltersReply{}, err
+		}
+		return GetBlockFiltersReply{Type: "get_block_filters_reply", Filters: filters}, nil
+	}
 
 	// Upload blocks to other peers.
-	n.Peer.OnSyncGetData = func(msg SyncGetDataMessage) (SyncGetDataReply, error) {
+	peer.OnSyncGetData = func(msg SyncGetDataMessage) (SyncGetDataReply, error) {
 		reply := SyncGetDataReply{
 			Headers: make([]BlockHeader, 0),
 			Bodies:  make([][]RawTransaction, 0),
@@ -161,10 +281,39 @@ func (n *Node) setup() {
 		// 1. Rebuild state.
 		// 2. Regenerate current mempool.
 
+		n.Mempool.SetBaseFee(n.Dag.GetNextBaseFee(new_tip))
+		if _, err := n.IBD.Check(time.Now()); err != nil {
+			n.log.Printf("Failed to check for initial block download: %s\n", err)
+		}
+
+		if err := n.ForkMonitor.CheckReorg(new_tip, prev_tip, time.Now()); err != nil {
+			n.log.Printf("Failed to check for reorg: %s\n", err)
+		}
+		connected, err := n.getConnectedBlocks(new_tip, prev_tip)
+		if err != nil {
+			n.log.Printf("Failed to get connected blocks: %s\n", err)
+		} else {
+			// Transactions included in the main chain are no longer pending.
+			included := [][32]byte{}
+			for _, block := range connected {
+				for _, tx := range block.Transactions {
+					included = append(included, tx.Hash())
+				}
+			}
+			n.Mempool.RemoveTransactions(included)
+
+			for _, block := range connected {
+				n.AddressWatcher.ProcessBlock(block, time.Now())
+			}
+			if n.Publisher != nil {
+				n.publishNewTip(new_tip, connected)
+			}
+		}
+
 		n.stateLog.Printf("rebuild-state\n")
 		start := time.Now()
 
-		err := n.rebuildState()
+		err = n.rebuildState()
 		if err != nil {
 			n.stateLog.Printf("Failed to rebuild state: %s\n", err)
 			return
@@ -189,27 +338,235 @@ func (n *Node) setup() {
 	//   c. Begin mining on the new tip.
 
 	// When we get new transaction, add it to mempool.
-	n.Peer.OnNewTransaction = func(tx RawTransaction) {
+	peer.OnNewTransaction = func(raw RawTransaction) {
+		// Transactions can't be validated until we've caught up. See ibd.go.
+		if n.IBD.InIBD() {
+			return
+		}
 		// Add transaction to mempool.
-		// TODO.
+		// The mempool checks it against the relay policy and the state of the main chain.
+		tx := raw.ToTransaction()
+		if err := n.Mempool.AddTransaction(&tx); err != nil {
+			n.log.Printf("Rejected transaction %x: %s\n", tx.Hash, err)
+		}
+	}
+
+	// Index new transactions for watched addresses, and publish them to subscribers.
+	n.Mempool.OnNewTransaction = func(tx *Transaction) {
+		raw := tx.ToRawTransaction()
+		n.AddressWatcher.ProcessTransaction(raw, time.Now())
+		if n.Publisher != nil {
+			n.Publisher.Publish(PUB_TOPIC_RAWTX, raw.Bytes())
+		}
+	}
+
+	// Alert the operator to reorgs held for review.
+	n.Dag.OnReorgQuarantined = n.ForkMonitor.AlertQuarantined
+
+	// Notify subscribers of finalized blocks, ie. exchanges crediting deposits.
+	n.Dag.OnFinalized = func(block Block) {
+		if n.Publisher != nil {
+			n.Publisher.Publish(PUB_TOPIC_HASHFINALIZED, block.Hash[:])
+		}
+	}
+
+	// Stream journaled events to subscribers, who resume from the journal after a disconnect.
+	n.Dag.OnEvent = func(event ChainEvent) {
+		if n.Publisher == nil {
+			return
+		}
+		body, err := json.Marshal(NewRPCChainEvent(event))
+		if err != nil {
+			n.log.Printf("Failed to encode event %d: %s\n", event.Seq, err)
+			return
+		}
+		n.Publisher.Publish(PUB_TOPIC_EVENT, body)
+	}
+
+	// Pause the miner during initial block download, since its blocks would be orphaned, and resume it once caught up.
+	n.IBD.OnChange = func(inIBD bool) {
+		if inIBD {
+			if n.Miner.Running() {
+				n.log.Printf("Pausing the miner during initial block download\n")
+				n.resumeMiner.Store(true)
+				n.Miner.Stop()
+			}
+		} else if n.resumeMiner.Swap(false) {
+			n.log.Printf("Resuming the miner\n")
+			go n.Miner.Start(-1)
+		}
+	}
+
+	// Rebroadcast our own transactions until they are confirmed.
+	n.Rebroadcaster.IsConfirmed = n.Dag.IsTransactionInMainChain
+	n.Rebroadcaster.Broadcast = func(tx RawTransaction) {
+		if n.IBD.InIBD() {
+			return
+		}
+		n.log.Printf("Rebroadcasting transaction %x\n", tx.Hash())
+		n.Peer.GossipTransaction(tx)
 	}
 }
 
+// Returns the blocks connected to the main chain by a new tip, oldest first, with their transactions.
+func (n *Node) getConnectedBlocks(newTip Block, prevTip Block) ([]Block, error) {
+	connected := []Block{newTip}
+	if prevTip.Hash != [32]byte{} && newTip.ParentHash != prevTip.Hash {
+		// Reorg (or a jump of several blocks). Walk back to the common ancestor.
+		ancestor, err := n.Dag.GetCommonAncestor(newTip.Hash, prevTip.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if ancestor.Hash == newTip.Hash {
+			connected = []Block{}
+		}
+		for block := newTip; len(connected) > 0 && block.ParentHash != ancestor.Hash; {
+			parent, err := n.Dag.GetBlockByHash(block.ParentHash)
+			if err != nil {
+				return nil, err
+			}
+			block = *parent
+			connected = append(connected, block)
+		}
+	}
+
+	blocks := []Block{}
+	for i := len(connected) - 1; 0 <= i; i-- {
+		block := connected[i]
+		txs, err := n.Dag.GetBlockTransactions(block.Hash)
+		if err != nil {
+			return nil, err
+		}
+		block.Transactions = []RawTransaction{}
+		for _, tx := range *txs {
+			block.Transactions = append(block.Transactions, tx.ToRawTransaction())
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+// Publishes the blocks connected to the main chain by a new tip, followed by the new tip's hash.
+func (n *Node) publishNewTip(newTip Block, connected []Block) {
+	for _, block := range connected {
+		raw := block.ToRawBlock()
+		n.Publisher.Publish(PUB_TOPIC_RAWBLOCK, raw.Bytes())
+	}
+	n.Publisher.Publish(PUB_TOPIC_HASHTIP, newTip.Hash[:])
+}
+
+// Checks a transaction can be executed on the state of the full tip, in the next block.
+func (n *Node) verifyTxState(tx RawTransaction) error {
+	nonce, err := n.Dag.GetAccountNonce(tx.FromPubkey)
+	if err != nil {
+		return err
+	}
+	return n.StateMachine1.VerifyTxState(tx, nonce, n.Dag.FullTip.Height+1)
+}
+
+// Updates the state to the full tip. The execution continues from the state of the nearest ancestor of the tip which is
+// cached, so extending the tip, or a reorg near it, only executes the new blocks. See state_overlay.go.
 func (n *Node) rebuildState() error {
-	longestChainHashList, err := n.Dag.GetLongestChainHashList(n.Dag.FullTip.Hash, n.Dag.FullTip.Height)
+	tip := n.Dag.FullTip
+	recent, err := n.Dag.GetLongestChainHashList(tip.Hash, min(tip.Height, STATE_CACHE_BLOCKS))
 	if err != nil {
 		n.stateLog.Printf("Failed to get longest chain hash list: %s\n", err)
 		return err
 	}
 
-	state2, err := RebuildState(n.Dag, *n.StateMachine1, longestChainHashList)
+	var state *StateMachine
+	hashes := [][32]byte{}
+	for i := len(recent) - 1; 0 <= i; i-- {
+		if cached, ok := n.StateCache.Get(recent[i]); ok {
+			state, hashes = cached, recent[i+1:]
+			break
+		}
+	}
+	if state == nil {
+		// Rebuild the state from genesis.
+		state, err = NewStateMachine(nil)
+		if err != nil {
+			return err
+		}
+		state.CoinbaseMaturity = n.Dag.consensus.CoinbaseMaturity
+		state.Forks = n.Dag.consensus.Forks
+		if err := state.ApplyGenesisAlloc(n.Dag.consensus.GenesisAlloc); err != nil {
+			return err
+		}
+		hashes, err = n.Dag.GetLongestChainHashList(tip.Hash, tip.Height)
+		if err != nil {
+			n.stateLog.Printf("Failed to get longest chain hash list: %s\n", err)
+			return err
+		}
+	}
+
+	receipts := []Receipt{}
+	for _, hash := range hashes {
+		block, err := n.Dag.getBlockWithTransactions(hash)
+		if err != nil {
+			return err
+		}
+		// Recent blocks execute on an overlay, so the state below can be cached.
+		cache := tip.Height < block.Height+STATE_CACHE_BLOCKS
+		if cache {
+			state = state.NewOverlay()
+		}
+		blockReceipts, err := state.ExecuteBlockWithReceipts(*block)
+		if err != nil {
+			n.stateLog.Printf("Failed to rebuild state: %s\n", err)
+			return err
+		}
+		receipts = append(receipts, blockReceipts...)
+		if cache {
+			if MAX_STATE_OVERLAY_DEPTH < state.Depth() {
+				state = state.Flatten()
+			}
+			n.StateCache.Put(*block, state)
+		}
+		if block.Height%STATE_CHECKPOINT_INTERVAL == 0 {
+			n.putStateCheckpoint(*block, state)
+			// The checkpoint must not change, so older blocks continue on an overlay.
+			if !cache {
+				state = state.NewOverlay()
+				if MAX_STATE_OVERLAY_DEPTH < state.Depth() {
+					state = state.Flatten()
+				}
+			}
+		}
+	}
+
+	err = n.Dag.SaveReceipts(receipts)
 	if err != nil {
-		n.stateLog.Printf("Failed to rebuild state: %s\n", err)
+		n.stateLog.Printf("Failed to save receipts: %s\n", err)
 		return err
 	}
 
-	n.StateMachine1 = state2
+	n.StateMachine1 = state
+	if STATE_CACHE_BLOCKS < tip.Height {
+		n.StateCache.Prune(tip.Height - STATE_CACHE_BLOCKS)
+	}
+	return nil
+}
+
+// Registers the node's API endpoints (GraphQL, JSON-RPC, Prometheus metrics and WebRTC signalling) on the API server, which is started along with the node.
+func (n *Node) ServeAPI(api *APIServer) error {
+	graphqlHandler, err := n.GraphQLHandler()
+	if err != nil {
+		return err
+	}
+	api.Handle("/graphql", graphqlHandler)
+
+	rpc := NewRPCHandler()
+	rpc.Authorize = api.Authorize
+	rpc.AllowCalls = api.AllowCalls
+	n.registerRPCMethods(rpc)
+	api.Handle("/rpc", rpc)
+	api.Handle("/metrics", n.Analytics)
+	if signaller, ok := n.Peer.(WebRTCSignaller); ok {
+		api.Handle(PEER_WEBRTC_SIGNAL_PATH, signaller.WebRTCSignalHandler())
+	}
 
+	n.API = api
 	return nil
 }
 
@@ -217,12 +574,33 @@ func (n *Node) Start() {
 	done := make(chan bool)
 
 	go n.Peer.Start()
+	go n.Rebroadcaster.Start()
+	go n.ForkMonitor.Start()
+	go n.ClockMonitor.Start()
+	go n.IBD.Start()
+	go n.DBMaintainer.Start()
+	go n.Auditor.Start()
+	if n.Publisher != nil {
+		if err := n.Publisher.Listen(); err != nil {
+			n.log.Printf("Failed to start publisher: %s\n", err)
+		}
+	}
+	if n.API != nil {
+		go n.API.Start()
+	}
 	// go n.Miner.Start(-1)
 
 	<-done
 }
 
 func (n *Node) Shutdown() {
+	if n.API != nil {
+		n.API.Stop()
+	}
+	if n.Publisher != nil {
+		n.Publisher.Stop()
+	}
+
 	// Close the database.
 	err := n.Dag.db.Close()
 	if err != nil {
@@ -0,0 +1,2169 @@
+package nakamoto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// The JSON-RPC methods of the node. Pubkey params also accept the name of a contact in the node's address book (see
+// addressbook.go).
+//
+// Chain:
+// - getbestblockhash
+// - getblockcount
+// - getblock [hash, verbosity?] (0 = raw hex, 1 = header and tx hashes, 2 = decoded txs and confirmations)
+// - getblocks [hashes]
+// - invalidateblock [hash] (mutating)
+// - reconsiderblock [hash] (mutating)
+// - getchaintips
+// - getforkstatus
+// - getdeploymentinfo
+// - getconsensusparams (the network's consensus config and fork schedule, identified by its chain ID, the genesis hash)
+// - getepochs [limit, offset]
+// - getdifficulty [height]
+// - getclockinfo
+// - getauditstatus
+// - getblockqueueinfo
+// - getworkproof [seed, samples]
+// - getancestryproof [hash, tip]
+// - getblockfilter [hash]
+// - getchainstats [window]
+// - getsyncstatus
+// - getfinalizedblock
+// - getquarantinedbranches
+// - releasequarantinedbranch [hash] (mutating, the first block of the branch)
+//
+// Mining:
+// - getmininginfo
+// - checkblock [block, template?] (the hex-encoded raw block. Templates aren't required to have a POW solution)
+// - miner_start [threads?] (mutating)
+// - miner_stop (mutating)
+// - miner_setCoinbase [pubkey] (mutating, the block reward is paid to the pubkey. Fees go to the miner wallet)
+// - miner_setGraffiti [text] (mutating, at most 32 bytes)
+// - miner_setTipPolicy [policy, preferOwnTransactions?] (mutating, most-work, first-seen or last-seen. See tipselect.go)
+// - miner_hashrate
+//
+// State:
+// - getbalance [pubkey]
+// - getbalanceat [pubkey, block] (the balance as of a block, given by its hash or its height on the main chain)
+// - getaccountstatement [pubkey, block?] (the account's balance and proven history as of a block, by default the tip)
+// - getspendablebalance [pubkey] (the balance which can be spent in the next block, excluding immature coinbase coins)
+// - getaccountactivity [pubkey]
+// - gettoken [name]
+// - gettokenbalance [name, pubkey]
+// - getstateroot
+//
+// Contacts:
+// - contact_list
+// - contact_add [name, pubkey] (mutating)
+// - contact_remove [name] (mutating)
+//
+// Addresses:
+// - watchaddress [pubkey, webhook?] (mutating)
+// - unwatchaddress [pubkey] (mutating)
+// - listwatchedaddresses
+// - getaddressactivity [pubkey]
+// - getaddresshistory [pubkey, limit, offset?] (the main chain transactions to or from the address, newest first, skipping the newest offset)
+// - rescanaddresses [pubkeys, fromHeight] (mutating, replays the main chain from the height through the block filters for the addresses' transactions, recording them for watched addresses. See rescan.go)
+//
+// Events:
+// - getevents [after, limit?] (the journaled chain events after a sequence number, oldest first. See event_journal.go)
+//
+// Transactions:
+// - sendrawtransaction [tx] (mutating)
+// - decoderawtransaction [hex] (the canonical encoding. See encoding.go)
+// - createrawtransaction [tx] (the canonical hex encoding of a transaction, optionally unsigned, given its fields)
+// - submitpackage [txs] (mutating)
+// - gettransaction [txhash]
+// - gettxstatus [txhash]
+// - gettransactionreceipt [txhash]
+// - estimatefee [blocks]
+//
+// Mempool:
+// - mempool_content
+// - mempool_info
+// - mempool_feeHistogram
+// - mempool_account [pubkey]
+//
+// Network:
+// - getpeerinfo [url?] (the detailed state of the peers, or of one peer, for debugging sync stalls)
+//
+// Admin (all require authorisation, as they expose the node's peers and logs):
+// - admin_listPeers
+// - admin_addPeer [url] (mutating)
+// - admin_removePeer [url] (mutating)
+// - admin_listBanned
+// - admin_banPeer [url, seconds] (mutating, 0 seconds bans permanently)
+// - admin_unbanPeer [url or host] (mutating)
+// - admin_logs [count]
+//
+
+// The JSON view of a block returned by the RPC API.
+type RPCBlock struct {
+	Hash                   string `json:"hash"`
+	ParentHash             string `json:"parentHash"`
+	Height                 uint64 `json:"height"`
+	Epoch                  string `json:"epoch"`
+	Timestamp              uint64 `json:"timestamp"`
+	NumTransactions        uint64 `json:"numTransactions"`
+	TransactionsMerkleRoot string `json:"transactionsMerkleRoot"`
+	Nonce                  string `json:"nonce"`
+	Graffiti               string `json:"graffiti"`
+	SizeBytes              uint64 `json:"sizeBytes"`
+	ParentTotalWork        string `json:"parentTotalWork"`
+	AccumulatedWork        string `json:"accumulatedWork"`
+	BaseFee                uint64 `json:"baseFee"`
+	Version                uint32 `json:"version"`
+	HistoryRoot            string `json:"historyRoot"`
+}
+
+func NewRPCBlock(b Block) RPCBlock {
+	return RPCBlock{
+		Hash:                   Bytes32ToHexString(b.Hash),
+		ParentHash:             Bytes32ToHexString(b.ParentHash),
+		Height:                 b.Height,
+		Epoch:                  b.Epoch,
+		Timestamp:              b.Timestamp,
+		NumTransactions:        b.NumTransactions,
+		TransactionsMerkleRoot: Bytes32ToHexString(b.TransactionsMerkleRoot),
+		Nonce:                  Bytes32ToHexString(b.Nonce),
+		Graffiti:               Bytes32ToHexString(b.Graffiti),
+		SizeBytes:              b.SizeBytes,
+		ParentTotalWork:        b.ParentTotalWork.String(),
+		AccumulatedWork:        b.AccumulatedWork.String(),
+		BaseFee:                b.BaseFee,
+		Version:                b.Version,
+		HistoryRoot:            Bytes32ToHexString(b.HistoryRoot),
+	}
+}
+
+// The JSON view of a transaction receipt returned by the RPC API.
+type RPCReceipt struct {
+	TxHash    string            `json:"txHash"`
+	BlockHash string            `json:"blockHash"`
+	TxIndex   uint64            `json:"txIndex"`
+	Status    string            `json:"status"`
+	Error     string            `json:"error,omitempty"`
+	FeePaid   uint64            `json:"feePaid"`
+	Deltas    []RPCBalanceDelta `json:"deltas"`
+}
+
+type RPCBalanceDelta struct {
+	Account string `json:"account"`
+	Token   string `json:"token,omitempty"`
+	Before  uint64 `json:"before"`
+	After   uint64 `json:"after"`
+}
+
+func NewRPCReceipt(r Receipt) RPCReceipt {
+	status := "success"
+	if r.Status == RECEIPT_STATUS_FAILED {
+		status = "failed"
+	}
+	deltas := []RPCBalanceDelta{}
+	for _, d := range r.Deltas {
+		deltas = append(deltas, RPCBalanceDelta{
+			Account: hex.EncodeToString(d.Account[:]),
+			Token:   d.Token,
+			Before:  d.Before,
+			After:   d.After,
+		})
+	}
+	return RPCReceipt{
+		TxHash:    Bytes32ToHexString(r.TxHash),
+		BlockHash: Bytes32ToHexString(r.BlockHash),
+		TxIndex:   r.TxIndex,
+		Status:    status,
+		Error:     r.Error,
+		FeePaid:   r.FeePaid,
+		Deltas:    deltas,
+	}
+}
+
+// The JSON view of a transaction on the main chain returned by the RPC API.
+type RPCTransaction struct {
+	Hash      string `json:"hash"`
+	Version   byte   `json:"version"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Amount    uint64 `json:"amount"`
+	Fee       uint64 `json:"fee"`
+	Nonce     uint64 `json:"nonce"`
+	Token     string `json:"token,omitempty"`
+	BlockHash string `json:"blockHash"`
+	Height    uint64 `json:"height"`
+	TxIndex   uint64 `json:"txIndex"`
+}
+
+func NewRPCTransaction(tx Transaction, location TxLocation) RPCTransaction {
+	return RPCTransaction{
+		Hash:      Bytes32ToHexString(tx.Hash),
+		Version:   tx.Version,
+		From:      hex.EncodeToString(tx.FromPubkey[:]),
+		To:        hex.EncodeToString(tx.ToPubkey[:]),
+		Amount:    tx.Amount,
+		Fee:       tx.Fee,
+		Nonce:     tx.Nonce,
+		Token:     tx.Token,
+		BlockHash: Bytes32ToHexString(location.BlockHash),
+		Height:    location.Height,
+		TxIndex:   location.TxIndex,
+	}
+}
+
+// The JSON view of a raw transaction, returned by decoderawtransaction and taken by createrawtransaction. Byte fields
+// are hex-encoded.
+type RPCRawTransaction struct {
+	// Set by decoderawtransaction, and ignored by createrawtransaction.
+	Hash      string `json:"hash,omitempty"`
+	SizeBytes uint64 `json:"sizeBytes,omitempty"`
+	// The encoded envelope, which is the message signed by the sender. See RawTransaction.Envelope.
+	Envelope string `json:"envelope,omitempty"`
+
+	// Zero in createrawtransaction uses the lowest version which encodes the transaction's fields.
+	Version   byte          `json:"version"`
+	Sig       string        `json:"sig"`
+	From      string        `json:"from"`
+	To        string        `json:"to"`
+	Amount    uint64        `json:"amount"`
+	Fee       uint64        `json:"fee"`
+	Nonce     uint64        `json:"nonce"`
+	Predicate string        `json:"predicate,omitempty"`
+	Witness   string        `json:"witness,omitempty"`
+	TokenOp   byte          `json:"tokenOp,omitempty"`
+	Token     string        `json:"token,omitempty"`
+	Inputs    []RPCOutpoint `json:"inputs,omitempty"`
+}
+
+type RPCOutpoint struct {
+	TxHash string `json:"txHash"`
+	Index  uint32 `json:"index"`
+}
+
+func NewRPCRawTransaction(tx RawTransaction) RPCRawTransaction {
+	inputs := []RPCOutpoint{}
+	for _, input := range tx.Inputs {
+		inputs = append(inputs, RPCOutpoint{TxHash: Bytes32ToHexString(input.TxHash), Index: input.Index})
+	}
+	return RPCRawTransaction{
+		Hash:      Bytes32ToHexString(tx.Hash()),
+		SizeBytes: tx.SizeBytes(),
+		Envelope:  hex.EncodeToString(tx.Envelope()),
+		Version:   tx.Version,
+		Sig:       hex.EncodeToString(tx.Sig[:]),
+		From:      hex.EncodeToString(tx.FromPubkey[:]),
+		To:        hex.EncodeToString(tx.ToPubkey[:]),
+		Amount:    tx.Amount,
+		Fee:       tx.Fee,
+		Nonce:     tx.Nonce,
+		Predicate: hex.EncodeToString(tx.Predicate),
+		Witness:   hex.EncodeToString(tx.Witness),
+		TokenOp:   tx.TokenOp,
+		Token:     tx.Token,
+		Inputs:    inputs,
+	}
+}
+
+// Builds the raw transaction given to createrawtransaction, checking its fields can be encoded. The sender and
+// recipient may be contacts, and the signature may be empty, for transactions to be signed later.
+func (n *Node) parseRPCRawTransaction(r RPCRawTransaction) (RawTransaction, error) {
+	tx := RawTransaction{
+		Amount:  r.Amount,
+		Fee:     r.Fee,
+		Nonce:   r.Nonce,
+		TokenOp: r.TokenOp,
+		Token:   r.Token,
+	}
+	var err error
+	if tx.FromPubkey, err = n.parseAddress(r.From); err != nil {
+		return RawTransaction{}, fmt.Errorf("Invalid from: %s", err)
+	}
+	if tx.ToPubkey, err = n.parseAddress(r.To); err != nil {
+		return RawTransaction{}, fmt.Errorf("Invalid to: %s", err)
+	}
+	if r.Sig != "" {
+		sig, err := hex.DecodeString(r.Sig)
+		if err != nil || len(sig) != 64 {
+			return RawTransaction{}, fmt.Errorf("Sig must be 64 hex-encoded bytes.")
+		}
+		copy(tx.Sig[:], sig)
+	}
+	if tx.Predicate, err = hex.DecodeString(r.Predicate); err != nil {
+		return RawTransaction{}, fmt.Errorf("Invalid predicate: %s", err)
+	}
+	if tx.Witness, err = hex.DecodeString(r.Witness); err != nil {
+		return RawTransaction{}, fmt.Errorf("Invalid witness: %s", err)
+	}
+	// Empty fields are nil, as in decoded transactions.
+	if len(tx.Predicate) == 0 {
+		tx.Predicate = nil
+	}
+	if len(tx.Witness) == 0 {
+		tx.Witness = nil
+	}
+	for i, input := range r.Inputs {
+		hash, err := hex.DecodeString(input.TxHash)
+		if err != nil || len(hash) != 32 {
+			return RawTransaction{}, fmt.Errorf("Invalid input %d: the tx hash must be 32 hex-encoded bytes.", i)
+		}
+		tx.Inputs = append(tx.Inputs, Outpoint{TxHash: [32]byte(hash), Index: input.Index})
+	}
+
+	switch {
+	case MAX_PREDICATE_SIZE < len(tx.Predicate):
+		return RawTransaction{}, fmt.Errorf("Predicate is %d bytes, more than the maximum of %d.", len(tx.Predicate), MAX_PREDICATE_SIZE)
+	case MAX_WITNESS_SIZE < len(tx.Witness):
+		return RawTransaction{}, fmt.Errorf("Witness is %d bytes, more than the maximum of %d.", len(tx.Witness), MAX_WITNESS_SIZE)
+	case MAX_TOKEN_NAME_LENGTH < len(tx.Token):
+		return RawTransaction{}, fmt.Errorf("Token name is %d bytes, more than the maximum of %d.", len(tx.Token), MAX_TOKEN_NAME_LENGTH)
+	case MAX_TX_INPUTS < len(tx.Inputs):
+		return RawTransaction{}, fmt.Errorf("Transaction has %d inputs, more than the maximum of %d.", len(tx.Inputs), MAX_TX_INPUTS)
+	}
+
+	tx.Version = r.Version
+	if tx.Version == 0 {
+		tx.Version = minTxVersion(tx)
+	}
+	if LatestTxVersion() < tx.Version {
+		return RawTransaction{}, fmt.Errorf("Unsupported transaction version: %d", tx.Version)
+	}
+	if tx.Version < minTxVersion(tx) {
+		return RawTransaction{}, fmt.Errorf("Version %d cannot encode the transaction, at least %d is required.", tx.Version, minTxVersion(tx))
+	}
+	return tx, nil
+}
+
+// The JSON view of a transaction's lifecycle status returned by the RPC API.
+type RPCTxStatus struct {
+	Hash          string `json:"hash"`
+	Status        string `json:"status"`
+	BlockHash     string `json:"blockHash,omitempty"`
+	Height        uint64 `json:"height,omitempty"`
+	Confirmations uint64 `json:"confirmations"`
+	SubmittedAt   uint64 `json:"submittedAt,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+}
+
+func NewRPCTxStatus(info TxStatusInfo) RPCTxStatus {
+	status := RPCTxStatus{
+		Hash:          Bytes32ToHexString(info.Hash),
+		Status:        string(info.Status),
+		Confirmations: info.Confirmations,
+		Reason:        info.Reason,
+	}
+	if info.Location != nil {
+		status.BlockHash = Bytes32ToHexString(info.Location.BlockHash)
+		status.Height = info.Location.Height
+	}
+	if !info.SubmittedAt.IsZero() {
+		status.SubmittedAt = uint64(info.SubmittedAt.UnixMilli())
+	}
+	return status
+}
+
+// The verbosity levels of getblock. Without a verbosity, getblock returns the header alone.
+const (
+	RPC_BLOCK_VERBOSITY_RAW      = 0
+	RPC_BLOCK_VERBOSITY_TXHASHES = 1
+	RPC_BLOCK_VERBOSITY_TXS      = 2
+)
+
+// The JSON view of a block with its transaction hashes, returned by getblock at verbosity 1.
+type RPCBlockWithTxHashes struct {
+	RPCBlock
+	Transactions []string `json:"transactions"`
+}
+
+// The JSON view of a block with its decoded transactions, returned by getblock at verbosity 2.
+type RPCBlockWithTxs struct {
+	RPCBlock
+	// The number of blocks on the main chain from the block to the tip, inclusive, or 0 if it isn't on the main chain.
+	Confirmations uint64           `json:"confirmations"`
+	Transactions  []RPCTransaction `json:"transactions"`
+}
+
+// The JSON view of chain statistics returned by the RPC API.
+type RPCChainStats struct {
+	Window                uint64  `json:"window"`
+	FromHeight            uint64  `json:"fromHeight"`
+	ToHeight              uint64  `json:"toHeight"`
+	Blocks                uint64  `json:"blocks"`
+	MeanBlockIntervalMs   int64   `json:"meanBlockIntervalMs"`
+	MedianBlockIntervalMs int64   `json:"medianBlockIntervalMs"`
+	MeanTxsPerBlock       float64 `json:"meanTxsPerBlock"`
+	MedianTxsPerBlock     uint64  `json:"medianTxsPerBlock"`
+	MedianFee             uint64  `json:"medianFee"`
+	Transactions          uint64  `json:"transactions"`
+	Orphans               uint64  `json:"orphans"`
+	OrphanRate            float64 `json:"orphanRate"`
+}
+
+func NewRPCChainStats(s ChainStats) RPCChainStats {
+	return RPCChainStats{
+		Window:                s.Window,
+		FromHeight:            s.FromHeight,
+		ToHeight:              s.ToHeight,
+		Blocks:                s.Blocks,
+		MeanBlockIntervalMs:   s.MeanBlockInterval.Milliseconds(),
+		MedianBlockIntervalMs: s.MedianBlockInterval.Milliseconds(),
+		MeanTxsPerBlock:       s.MeanTxsPerBlock,
+		MedianTxsPerBlock:     s.MedianTxsPerBlock,
+		MedianFee:             s.MedianFee,
+		Transactions:          s.Transactions,
+		Orphans:               s.Orphans,
+		OrphanRate:            s.OrphanRate,
+	}
+}
+
+// The JSON view of a pending transaction returned by the RPC API.
+type RPCMempoolTransaction struct {
+	Hash      string `json:"hash"`
+	Version   byte   `json:"version"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Amount    uint64 `json:"amount"`
+	Fee       uint64 `json:"fee"`
+	Nonce     uint64 `json:"nonce"`
+	Token     string `json:"token,omitempty"`
+	SizeBytes uint64 `json:"sizeBytes"`
+	FeeRate   uint64 `json:"feeRate"`
+}
+
+func NewRPCMempoolTransaction(tx Transaction) RPCMempoolTransaction {
+	raw := tx.ToRawTransaction()
+	return RPCMempoolTransaction{
+		Hash:      Bytes32ToHexString(tx.Hash),
+		Version:   tx.Version,
+		From:      hex.EncodeToString(tx.FromPubkey[:]),
+		To:        hex.EncodeToString(tx.ToPubkey[:]),
+		Amount:    tx.Amount,
+		Fee:       tx.Fee,
+		Nonce:     tx.Nonce,
+		Token:     tx.Token,
+		SizeBytes: raw.SizeBytes(),
+		FeeRate:   raw.FeeRate(),
+	}
+}
+
+// The JSON view of a peer returned by the RPC API.
+type RPCPeer struct {
+	URL              string                      `json:"url"`
+	NodeID           string                      `json:"nodeId"`
+	ClientVersion    string                      `json:"clientVersion"`
+	TipHeight        uint64                      `json:"tipHeight"`
+	LastSeen         uint64                      `json:"lastSeen"`
+	Inbound          bool                        `json:"inbound"`
+	ConnectedAt      uint64                      `json:"connectedAt"`
+	Services         uint64                      `json:"services"`
+	TxFilter         bool                        `json:"txFilter"`
+	Encoding         string                      `json:"encoding"`
+	Compression      string                      `json:"compression"`
+	LatencyMs        float64                     `json:"latencyMs"`
+	TimeOffsetMs     int64                       `json:"timeOffsetMs"`
+	MessagesSent     uint64                      `json:"messagesSent"`
+	MessagesReceived uint64                      `json:"messagesReceived"`
+	BytesSent        uint64                      `json:"bytesSent"`
+	BytesReceived    uint64                      `json:"bytesReceived"`
+	Messages         map[string]PeerMessageStats `json:"messages"`
+}
+
+func NewRPCPeer(p Peer) RPCPeer {
+	total := p.totalMessageStats()
+	messages := p.messageStats
+	if messages == nil {
+		messages = make(map[string]PeerMessageStats)
+	}
+	return RPCPeer{
+		URL:              p.url,
+		NodeID:           p.nodeID,
+		ClientVersion:    p.clientVersion,
+		TipHeight:        p.tipHeight,
+		LastSeen:         p.lastSeen,
+		Inbound:          p.inbound,
+		ConnectedAt:      uint64(p.connectedAt.Unix()),
+		Services:         p.services,
+		TxFilter:         p.txFilter != nil,
+		Encoding:         p.encoding,
+		Compression:      p.compression,
+		LatencyMs:        float64(p.latency.Microseconds()) / 1000,
+		TimeOffsetMs:     p.timeOffset.Milliseconds(),
+		MessagesSent:     total.MessagesSent,
+		MessagesReceived: total.MessagesReceived,
+		BytesSent:        total.BytesSent,
+		BytesReceived:    total.BytesReceived,
+		Messages:         messages,
+	}
+}
+
+// The JSON view of a peer returned by getpeerinfo, with the state useful for debugging sync.
+type RPCPeerInfo struct {
+	RPCPeer
+	// The tip the peer advertised in its last heartbeat.
+	TipHash         string `json:"tipHash"`
+	TipAdvancedAt   uint64 `json:"tipAdvancedAt"`
+	ProtocolVersion uint   `json:"protocolVersion"`
+	// "inbound" or "outbound".
+	Direction        string `json:"direction"`
+	ConnectedSeconds uint64 `json:"connectedSeconds"`
+	// 0 if we haven't exchanged heartbeats with the peer.
+	LastHeartbeat uint64 `json:"lastHeartbeat"`
+	// The misbehaviour score of the peer's host. It's banned at MISBEHAVIOUR_BAN_SCORE.
+	BanScore  int    `json:"banScore"`
+	BusyUntil uint64 `json:"busyUntil"`
+	// The requests sent to the peer awaiting a reply, by message type.
+	InFlight      map[string]int `json:"inFlight"`
+	InFlightTotal int            `json:"inFlightTotal"`
+	// The outcomes of the requests sent to the peer, by message type, and the number awaiting a reply.
+	Requests            map[string]PeerRequestStats `json:"requests"`
+	OutstandingRequests int                         `json:"outstandingRequests"`
+	RequestTimeouts     uint64                      `json:"requestTimeouts"`
+}
+
+func NewRPCPeerInfo(p Peer, banScore int, now time.Time) RPCPeerInfo {
+	direction := "outbound"
+	if p.inbound {
+		direction = "inbound"
+	}
+	unix := func(t time.Time) uint64 {
+		if t.IsZero() {
+			return 0
+		}
+		return uint64(t.Unix())
+	}
+	inFlight := make(map[string]int)
+	total := 0
+	for messageType, n := range p.inFlight {
+		inFlight[messageType] = n
+		total += n
+	}
+	requests := make(map[string]PeerRequestStats)
+	timeouts := uint64(0)
+	for messageType, stats := range p.requestStats {
+		requests[messageType] = stats
+		timeouts += stats.TimedOut
+	}
+	return RPCPeerInfo{
+		RPCPeer:          NewRPCPeer(p),
+		TipHash:          p.tipHash,
+		TipAdvancedAt:    unix(p.tipAdvancedAt),
+		ProtocolVersion:  p.protocolVersion,
+		Direction:        direction,
+		ConnectedSeconds: uint64(max(now.Sub(p.connectedAt), 0).Seconds()),
+		LastHeartbeat:    unix(p.lastHeartbeat),
+		BanScore:         banScore,
+		BusyUntil:        unix(p.busyUntil),
+		InFlight:         inFlight,
+		InFlightTotal:    total,
+
+		Requests:            requests,
+		OutstandingRequests: len(p.requests),
+		RequestTimeouts:     timeouts,
+	}
+}
+
+// The JSON view of a chain tip returned by the RPC API.
+type RPCChainTip struct {
+	Hash            string `json:"hash"`
+	Height          uint64 `json:"height"`
+	Status          string `json:"status"`
+	BranchLength    uint64 `json:"branchLength"`
+	ForkHash        string `json:"forkHash"`
+	ForkHeight      uint64 `json:"forkHeight"`
+	AccumulatedWork string `json:"accumulatedWork"`
+}
+
+func NewRPCChainTip(tip ChainTip) RPCChainTip {
+	return RPCChainTip{
+		Hash:            Bytes32ToHexString(tip.Hash),
+		Height:          tip.Height,
+		Status:          tip.Status,
+		BranchLength:    tip.BranchLength,
+		ForkHash:        Bytes32ToHexString(tip.ForkPoint.Hash),
+		ForkHeight:      tip.ForkPoint.Height,
+		AccumulatedWork: tip.AccumulatedWork.String(),
+	}
+}
+
+// The JSON view of a quarantined branch returned by the RPC API.
+type RPCQuarantinedBranch struct {
+	Hash      string `json:"hash"`
+	ForkHash  string `json:"forkHash"`
+	TipHash   string `json:"tipHash"`
+	Depth     uint64 `json:"depth"`
+	FirstSeen int64  `json:"firstSeen"`
+	Released  bool   `json:"released"`
+}
+
+func NewRPCQuarantinedBranch(branch QuarantinedBranch) RPCQuarantinedBranch {
+	return RPCQuarantinedBranch{
+		Hash:      Bytes32ToHexString(branch.Hash),
+		ForkHash:  Bytes32ToHexString(branch.ForkPoint),
+		TipHash:   Bytes32ToHexString(branch.Tip),
+		Depth:     branch.Depth,
+		FirstSeen: branch.FirstSeen.Unix(),
+		Released:  branch.Released,
+	}
+}
+
+// The JSON view of a difficulty epoch returned by the RPC API.
+type RPCEpoch struct {
+	Number         uint64  `json:"number"`
+	Id             string  `json:"id"`
+	StartBlockHash string  `json:"startBlockHash"`
+	StartHeight    uint64  `json:"startHeight"`
+	StartTime      uint64  `json:"startTime"`
+	Difficulty     string  `json:"difficulty"`
+	Timespan       uint64  `json:"timespan"`
+	RetargetRatio  float64 `json:"retargetRatio"`
+}
+
+func NewRPCEpoch(e EpochInfo) RPCEpoch {
+	return RPCEpoch{
+		Number:         e.Number,
+		Id:             e.Id,
+		StartBlockHash: Bytes32ToHexString(e.StartBlockHash),
+		StartHeight:    e.StartHeight,
+		StartTime:      e.StartTime,
+		Difficulty:     e.Difficulty.String(),
+		Timespan:       e.Timespan,
+		RetargetRatio:  e.RetargetRatio,
+	}
+}
+
+// The JSON view of the consensus parameters returned by the RPC API, so clients can configure themselves for a network.
+type RPCConsensusParams struct {
+	// The genesis block hash, which identifies the network.
+	ChainId                 string `json:"chainId"`
+	GenesisParentBlockHash  string `json:"genesisParentBlockHash"`
+	GenesisDifficulty       string `json:"genesisDifficulty"`
+	EpochLengthBlocks       uint64 `json:"epochLengthBlocks"`
+	TargetEpochLengthMillis uint64 `json:"targetEpochLengthMillis"`
+	TargetBlockTimeMillis   uint64 `json:"targetBlockTimeMillis"`
+	MaxBlockSizeBytes       uint64 `json:"maxBlockSizeBytes"`
+	MaxBlockWeight          uint64 `json:"maxBlockWeight"`
+	CoinbaseMaturity        uint64 `json:"coinbaseMaturity"`
+	InitialBaseFee          uint64 `json:"initialBaseFee"`
+	VersionBitsThreshold    uint64 `json:"versionBitsThreshold"`
+	StateMachine            string `json:"stateMachine"`
+	// The hard forks, in order of activation, and the soft fork deployments.
+	Forks       []RPCForkSchedule `json:"forks"`
+	Deployments []Deployment      `json:"deployments"`
+}
+
+type RPCForkSchedule struct {
+	Name   string `json:"name"`
+	Height uint64 `json:"height"`
+	// Whether the fork is active at the tip, and whether this node implements it.
+	Active    bool `json:"active"`
+	Supported bool `json:"supported"`
+}
+
+func (n *Node) getRPCConsensusParams() (RPCConsensusParams, error) {
+	consensus := n.Dag.consensus
+	genesis, err := n.Dag.GetMainChainBlockAt(0)
+	if err != nil {
+		return RPCConsensusParams{}, err
+	}
+	if genesis == nil {
+		return RPCConsensusParams{}, fmt.Errorf("Genesis block not found.")
+	}
+
+	stateMachine := consensus.StateMachine
+	if stateMachine == "" {
+		stateMachine = STATE_MACHINE_ACCOUNT
+	}
+	params := RPCConsensusParams{
+		ChainId:                 Bytes32ToHexString(genesis.Hash),
+		GenesisParentBlockHash:  Bytes32ToHexString(consensus.GenesisParentBlockHash),
+		GenesisDifficulty:       consensus.GenesisDifficulty.String(),
+		EpochLengthBlocks:       consensus.EpochLengthBlocks,
+		TargetEpochLengthMillis: consensus.TargetEpochLengthMillis,
+		TargetBlockTimeMillis:   consensus.TargetEpochLengthMillis / consensus.EpochLengthBlocks,
+		MaxBlockSizeBytes:       consensus.MaxBlockSizeBytes,
+		MaxBlockWeight:          consensus.MaxBlockWeight,
+		CoinbaseMaturity:        consensus.CoinbaseMaturity,
+		InitialBaseFee:          consensus.InitialBaseFee,
+		VersionBitsThreshold:    n.Dag.VersionBitsThreshold(),
+		StateMachine:            stateMachine,
+		Forks:                   []RPCForkSchedule{},
+		Deployments:             append([]Deployment{}, consensus.Deployments...),
+	}
+
+	unsupported := map[string]bool{}
+	for _, name := range n.Dag.UnsupportedForks() {
+		unsupported[name] = true
+	}
+	tip := n.Dag.FullTip
+	for name, height := range consensus.Forks {
+		params.Forks = append(params.Forks, RPCForkSchedule{
+			Name:      name,
+			Height:    height,
+			Active:    n.Dag.IsForkActive(name, tip.Height),
+			Supported: !unsupported[name],
+		})
+	}
+	sort.Slice(params.Forks, func(i, j int) bool {
+		if params.Forks[i].Height != params.Forks[j].Height {
+			return params.Forks[i].Height < params.Forks[j].Height
+		}
+		return params.Forks[i].Name < params.Forks[j].Name
+	})
+	return params, nil
+}
+
+// The JSON view of a fork alert returned by the RPC API.
+type RPCForkAlert struct {
+	Kind      string  `json:"kind"`
+	Time      uint64  `json:"time"`
+	Tip       string  `json:"tip"`
+	ForkHash  string  `json:"forkHash"`
+	Depth     uint64  `json:"depth"`
+	WorkShare float64 `json:"workShare"`
+	Message   string  `json:"message"`
+}
+
+func NewRPCForkAlert(alert ForkAlert) RPCForkAlert {
+	return RPCForkAlert{
+		Kind:      alert.Kind,
+		Time:      uint64(alert.Time.Unix()),
+		Tip:       Bytes32ToHexString(alert.Tip),
+		ForkHash:  Bytes32ToHexString(alert.ForkPoint),
+		Depth:     alert.Depth,
+		WorkShare: alert.WorkShare,
+		Message:   alert.Message,
+	}
+}
+
+type RPCAuditAlert struct {
+	Time       uint64   `json:"time"`
+	Hash       string   `json:"hash"`
+	Height     uint64   `json:"height"`
+	Mismatches []string `json:"mismatches"`
+	Message    string   `json:"message"`
+}
+
+func NewRPCAuditAlert(alert AuditAlert) RPCAuditAlert {
+	return RPCAuditAlert{
+		Time:       uint64(alert.Time.Unix()),
+		Hash:       Bytes32ToHexString(alert.Hash),
+		Height:     alert.Height,
+		Mismatches: alert.Mismatches,
+		Message:    alert.Message,
+	}
+}
+
+// The JSON view of an address event, returned by the RPC API and delivered to webhooks.
+type RPCAddressEvent struct {
+	Address      string `json:"address"`
+	Direction    string `json:"direction"`
+	Status       string `json:"status"`
+	TxHash       string `json:"txHash"`
+	Counterparty string `json:"counterparty"`
+	Amount       uint64 `json:"amount"`
+	Fee          uint64 `json:"fee"`
+	BlockHash    string `json:"blockHash,omitempty"`
+	Height       uint64 `json:"height,omitempty"`
+	Time         uint64 `json:"time"`
+}
+
+type RPCAddressHistoryEntry struct {
+	TxHash    string `json:"txHash"`
+	BlockHash string `json:"blockHash"`
+	Height    uint64 `json:"height"`
+	Timestamp uint64 `json:"timestamp"`
+	TxIndex   uint64 `json:"txIndex"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Amount    uint64 `json:"amount"`
+	Fee       uint64 `json:"fee"`
+	// The number of blocks including and on top of the transaction's block on the main chain.
+	Confirmations uint64 `json:"confirmations"`
+}
+
+func NewRPCAddressHistoryEntry(entry AddressHistoryEntry, tipHeight uint64) RPCAddressHistoryEntry {
+	// The tip may have moved since the history was read.
+	tipHeight = max(tipHeight, entry.Height)
+	return RPCAddressHistoryEntry{
+		TxHash:        Bytes32ToHexString(entry.TxHash),
+		BlockHash:     Bytes32ToHexString(entry.BlockHash),
+		Height:        entry.Height,
+		Timestamp:     entry.Timestamp,
+		TxIndex:       entry.TxIndex,
+		Confirmations: tipHeight - entry.Height + 1,
+		From:          hex.EncodeToString(entry.From[:]),
+		To:            hex.EncodeToString(entry.To[:]),
+		Amount:        entry.Amount,
+		Fee:           entry.Fee,
+	}
+}
+
+func NewRPCAddressEvent(event AddressEvent) RPCAddressEvent {
+	res := RPCAddressEvent{
+		Address:      hex.EncodeToString(event.Address[:]),
+		Direction:    event.Direction,
+		Status:       event.Status,
+		TxHash:       Bytes32ToHexString(event.TxHash),
+		Counterparty: hex.EncodeToString(event.Counterparty[:]),
+		Amount:       event.Amount,
+		Fee:          event.Fee,
+		Time:         uint64(event.Time.Unix()),
+	}
+	if event.Status == ADDRESS_EVENT_CONFIRMED {
+		res.BlockHash = Bytes32ToHexString(event.BlockHash)
+		res.Height = event.Height
+	}
+	return res
+}
+
+// The JSON view of a journaled chain event returned by the RPC API. See event_journal.go.
+type RPCChainEvent struct {
+	Seq       uint64               `json:"seq"`
+	Type      string               `json:"type"`
+	Time      uint64               `json:"time"`
+	BlockHash string               `json:"blockHash"`
+	Height    uint64               `json:"height"`
+	Tx        *RPCTxConfirmedEvent `json:"tx,omitempty"`
+	Reorg     *RPCReorgEvent       `json:"reorg,omitempty"`
+}
+
+type RPCTxConfirmedEvent struct {
+	Hash   string `json:"hash"`
+	Index  uint64 `json:"index"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount uint64 `json:"amount"`
+	Fee    uint64 `json:"fee"`
+}
+
+type RPCReorgEvent struct {
+	OldTip       string   `json:"oldTip"`
+	ForkPoint    string   `json:"forkPoint"`
+	ForkHeight   uint64   `json:"forkHeight"`
+	Depth        uint64   `json:"depth"`
+	Disconnected []string `json:"disconnected"`
+	Unconfirmed  []string `json:"unconfirmed"`
+}
+
+func NewRPCChainEvent(event ChainEvent) RPCChainEvent {
+	res := RPCChainEvent{
+		Seq:       event.Seq,
+		Type:      event.Type,
+		Time:      uint64(event.Time.UnixMilli()),
+		BlockHash: Bytes32ToHexString(event.BlockHash),
+		Height:    event.Height,
+	}
+	if event.Tx != nil {
+		res.Tx = &RPCTxConfirmedEvent{
+			Hash:   Bytes32ToHexString(event.Tx.Hash),
+			Index:  event.Tx.Index,
+			From:   hex.EncodeToString(event.Tx.From[:]),
+			To:     hex.EncodeToString(event.Tx.To[:]),
+			Amount: event.Tx.Amount,
+			Fee:    event.Tx.Fee,
+		}
+	}
+	if event.Reorg != nil {
+		res.Reorg = &RPCReorgEvent{
+			OldTip:       Bytes32ToHexString(event.Reorg.OldTip),
+			ForkPoint:    Bytes32ToHexString(event.Reorg.ForkPoint),
+			ForkHeight:   event.Reorg.ForkHeight,
+			Depth:        event.Reorg.Depth,
+			Disconnected: []string{},
+			Unconfirmed:  []string{},
+		}
+		for _, hash := range event.Reorg.Disconnected {
+			res.Reorg.Disconnected = append(res.Reorg.Disconnected, Bytes32ToHexString(hash))
+		}
+		for _, hash := range event.Reorg.Unconfirmed {
+			res.Reorg.Unconfirmed = append(res.Reorg.Unconfirmed, Bytes32ToHexString(hash))
+		}
+	}
+	return res
+}
+
+// Parses the params of getblock: a block hash, and an optional verbosity, which is nil if omitted.
+func parseGetBlockParams(params json.RawMessage) ([32]byte, *int, error) {
+	var hashStr string
+	var verbosity int
+	hasVerbosity := true
+	if err := parseRPCParams(params, &hashStr, &verbosity); err != nil {
+		// The verbosity is optional.
+		if err := parseRPCParams(params, &hashStr); err != nil {
+			return [32]byte{}, nil, err
+		}
+		hasVerbosity = false
+	}
+	hash, err := parseHash32(hashStr)
+	if err != nil {
+		return [32]byte{}, nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+	}
+	if !hasVerbosity {
+		return hash, nil, nil
+	}
+	if verbosity < RPC_BLOCK_VERBOSITY_RAW || RPC_BLOCK_VERBOSITY_TXS < verbosity {
+		return [32]byte{}, nil, &RPCError{Code: RPCErrInvalidParams, Message: fmt.Sprintf("Verbosity must be between %d and %d", RPC_BLOCK_VERBOSITY_RAW, RPC_BLOCK_VERBOSITY_TXS)}
+	}
+	return hash, &verbosity, nil
+}
+
+// Returns the view of a block for getblock at a verbosity level, which includes its transactions.
+func (n *Node) getVerboseRPCBlock(block Block, verbosity int) (interface{}, error) {
+	txs, err := n.Dag.GetBlockTransactions(block.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(*txs)) != block.NumTransactions {
+		return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Block body not downloaded"}
+	}
+
+	switch verbosity {
+	case RPC_BLOCK_VERBOSITY_RAW:
+		raws := []RawTransaction{}
+		for _, tx := range *txs {
+			raws = append(raws, tx.ToRawTransaction())
+		}
+		block.Transactions = raws
+		raw := block.ToRawBlock()
+		return hex.EncodeToString(raw.Bytes()), nil
+
+	case RPC_BLOCK_VERBOSITY_TXHASHES:
+		res := RPCBlockWithTxHashes{RPCBlock: NewRPCBlock(block), Transactions: []string{}}
+		for _, tx := range *txs {
+			res.Transactions = append(res.Transactions, Bytes32ToHexString(tx.Hash))
+		}
+		return res, nil
+
+	default:
+		confirmations, err := n.Dag.GetBlockConfirmations(block)
+		if err != nil {
+			return nil, err
+		}
+		res := RPCBlockWithTxs{RPCBlock: NewRPCBlock(block), Confirmations: confirmations, Transactions: []RPCTransaction{}}
+		for _, tx := range *txs {
+			location := TxLocation{BlockHash: block.Hash, Height: block.Height, TxIndex: tx.TxIndex}
+			res.Transactions = append(res.Transactions, NewRPCTransaction(tx, location))
+		}
+		return res, nil
+	}
+}
+
+// Resolves a block param, given as a block hash, or as a height on the main chain.
+func (n *Node) parseRPCBlockParam(param json.RawMessage) (*Block, error) {
+	var block *Block
+	var hashStr string
+	var height uint64
+	var err error
+	if json.Unmarshal(param, &hashStr) == nil {
+		hash, decodeErr := hex.DecodeString(hashStr)
+		if decodeErr != nil || len(hash) != 32 {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Invalid block hash"}
+		}
+		block, err = n.Dag.GetBlockByHash([32]byte(hash))
+	} else if json.Unmarshal(param, &height) == nil {
+		block, err = n.Dag.GetMainChainBlockAt(height)
+	} else {
+		return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Block must be a block hash or a height"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Block not found"}
+	}
+	return block, nil
+}
+
+func (n *Node) registerRPCMethods(rpc *RPCHandler) {
+	rpc.RegisterMethod("getbestblockhash", func(params json.RawMessage) (interface{}, error) {
+		return Bytes32ToHexString(n.Dag.FullTip.Hash), nil
+	}, false)
+
+	rpc.RegisterMethod("getblockcount", func(params json.RawMessage) (interface{}, error) {
+		return n.Dag.FullTip.Height, nil
+	}, false)
+
+	rpc.RegisterMethod("getblock", func(params json.RawMessage) (interface{}, error) {
+		hash, verbosity, err := parseGetBlockParams(params)
+		if err != nil {
+			return nil, err
+		}
+
+		block, err := n.Dag.GetBlockByHash(hash)
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			return nil, nil
+		}
+		if verbosity == nil {
+			return NewRPCBlock(*block), nil
+		}
+		return n.getVerboseRPCBlock(*block, *verbosity)
+	}, false)
+
+	// Resolve all getblock calls within a batch in a single query.
+	rpc.RegisterBatchHandler("getblock", func(params []json.RawMessage) ([]interface{}, []error) {
+		results := make([]interface{}, len(params))
+		errs := make([]error, len(params))
+
+		hashes := make([][32]byte, 0, len(params))
+		idxs := make([]int, 0, len(params))
+		verbosities := make([]*int, 0, len(params))
+		for i, p := range params {
+			hash, verbosity, err := parseGetBlockParams(p)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			hashes = append(hashes, hash)
+			idxs = append(idxs, i)
+			verbosities = append(verbosities, verbosity)
+		}
+
+		blocks, err := n.Dag.GetBlocksByHashes(hashes)
+		for j, i := range idxs {
+			if err != nil {
+				errs[i] = err
+			} else if blocks[j] == nil {
+				continue
+			} else if verbosities[j] == nil {
+				results[i] = NewRPCBlock(*blocks[j])
+			} else {
+				results[i], errs[i] = n.getVerboseRPCBlock(*blocks[j], *verbosities[j])
+			}
+		}
+
+		return results, errs
+	})
+
+	rpc.RegisterMethod("getblocks", func(params json.RawMessage) (interface{}, error) {
+		var hashStrs []string
+		if err := parseRPCParams(params, &hashStrs); err != nil {
+			return nil, err
+		}
+		MAX_GET_BLOCKS_LEN := 1000
+		if MAX_GET_BLOCKS_LEN < len(hashStrs) {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: fmt.Sprintf("Too many hashes requested. Max is %d", MAX_GET_BLOCKS_LEN)}
+		}
+
+		hashes := make([][32]byte, len(hashStrs))
+		for i, hashStr := range hashStrs {
+			hash, err := parseHash32(hashStr)
+			if err != nil {
+				return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+			}
+			hashes[i] = hash
+		}
+
+		blocks, err := n.Dag.GetBlocksByHashes(hashes)
+		if err != nil {
+			return nil, err
+		}
+
+		res := make([]*RPCBlock, len(blocks))
+		for i, block := range blocks {
+			if block != nil {
+				rpcBlock := NewRPCBlock(*block)
+				res[i] = &rpcBlock
+			}
+		}
+		return res, nil
+	}, false)
+
+	rpc.RegisterMethod("invalidateblock", func(params json.RawMessage) (interface{}, error) {
+		var hashStr string
+		if err := parseRPCParams(params, &hashStr); err != nil {
+			return nil, err
+		}
+		hash, err := parseHash32(hashStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+
+		if err := n.Dag.InvalidateBlock(hash); err != nil {
+			return nil, err
+		}
+		return Bytes32ToHexString(n.Dag.FullTip.Hash), nil
+	}, true)
+
+	rpc.RegisterMethod("reconsiderblock", func(params json.RawMessage) (interface{}, error) {
+		var hashStr string
+		if err := parseRPCParams(params, &hashStr); err != nil {
+			return nil, err
+		}
+		hash, err := parseHash32(hashStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+
+		if err := n.Dag.ReconsiderBlock(hash); err != nil {
+			return nil, err
+		}
+		return Bytes32ToHexString(n.Dag.FullTip.Hash), nil
+	}, true)
+
+	rpc.RegisterMethod("getchaintips", func(params json.RawMessage) (interface{}, error) {
+		tips, err := n.Dag.GetChainTips()
+		if err != nil {
+			return nil, err
+		}
+		res := []RPCChainTip{}
+		for _, tip := range tips {
+			res = append(res, NewRPCChainTip(tip))
+		}
+		return res, nil
+	}, false)
+
+	rpc.RegisterMethod("getforkstatus", func(params json.RawMessage) (interface{}, error) {
+		if n.ForkMonitor == nil {
+			return nil, fmt.Errorf("Fork monitor is not running.")
+		}
+		status := n.ForkMonitor.Status()
+
+		alerts := []RPCForkAlert{}
+		for _, alert := range status.Alerts {
+			alerts = append(alerts, NewRPCForkAlert(alert))
+		}
+		numForks := 0
+		for _, tip := range status.Tips {
+			if tip.Status != CHAIN_TIP_ACTIVE {
+				numForks++
+			}
+		}
+		return map[string]interface{}{
+			"lastCheck":      status.LastCheck.Unix(),
+			"numForks":       numForks,
+			"lastReorgDepth": status.LastReorgDepth,
+			"lastReorgTime":  status.LastReorgTime.Unix(),
+			"alerts":         alerts,
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("getclockinfo", func(params json.RawMessage) (interface{}, error) {
+		if n.ClockMonitor == nil {
+			return nil, fmt.Errorf("Clock monitor is not running.")
+		}
+		status := n.ClockMonitor.Status()
+		return map[string]interface{}{
+			"lastCheck":    status.LastCheck.Unix(),
+			"offsetMs":     status.Offset.Milliseconds(),
+			"peerSamples":  status.PeerSamples,
+			"blockDriftMs": status.BlockDrift.Milliseconds(),
+			"blockSamples": status.BlockSamples,
+			"maxDriftMs":   n.ClockMonitor.MaxDrift.Milliseconds(),
+			"warning":      status.Warning,
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("getauditstatus", func(params json.RawMessage) (interface{}, error) {
+		if n.Auditor == nil {
+			return nil, fmt.Errorf("Chain auditor is not running.")
+		}
+		status := n.Auditor.Status()
+
+		alerts := []RPCAuditAlert{}
+		for _, alert := range status.Alerts {
+			alerts = append(alerts, NewRPCAuditAlert(alert))
+		}
+		return map[string]interface{}{
+			"enabled":       n.Auditor.Interval != 0,
+			"intervalMs":    n.Auditor.Interval.Milliseconds(),
+			"lastCheck":     status.LastCheck.Unix(),
+			"blocksAudited": status.BlocksAudited,
+			"blocksFailed":  status.BlocksFailed,
+			"alerts":        alerts,
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("getblockqueueinfo", func(params json.RawMessage) (interface{}, error) {
+		return n.BlockQueue.Stats(), nil
+	}, false)
+
+	rpc.RegisterMethod("getconsensusparams", func(params json.RawMessage) (interface{}, error) {
+		return n.getRPCConsensusParams()
+	}, false)
+
+	rpc.RegisterMethod("getdeploymentinfo", func(params json.RawMessage) (interface{}, error) {
+		tip := n.Dag.FullTip
+		deployments := []map[string]interface{}{}
+		for _, d := range n.Dag.consensus.Deployments {
+			status, err := n.Dag.GetDeploymentState(d, tip)
+			if err != nil {
+				return nil, err
+			}
+			signalling, elapsed, err := n.Dag.GetDeploymentSignalling(d, tip)
+			if err != nil {
+				return nil, err
+			}
+			deployments = append(deployments, map[string]interface{}{
+				"name":          d.Name,
+				"bit":           d.Bit,
+				"startHeight":   d.StartHeight,
+				"timeoutHeight": d.TimeoutHeight,
+				"status":        status,
+				"signalling":    signalling,
+				"elapsed":       elapsed,
+			})
+		}
+		return map[string]interface{}{
+			"hash":         Bytes32ToHexString(tip.Hash),
+			"height":       tip.Height,
+			"periodLength": n.Dag.consensus.EpochLengthBlocks,
+			"threshold":    n.Dag.VersionBitsThreshold(),
+			"deployments":  deployments,
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("getepochs", func(params json.RawMessage) (interface{}, error) {
+		var limit, offset uint64
+		if err := parseRPCParams(params, &limit, &offset); err != nil {
+			return nil, err
+		}
+		MAX_GET_EPOCHS_LEN := uint64(1000)
+		if limit == 0 || MAX_GET_EPOCHS_LEN < limit {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: fmt.Sprintf("Limit must be between 1 and %d", MAX_GET_EPOCHS_LEN)}
+		}
+
+		epochs, err := n.Dag.GetEpochs(limit, offset)
+		if err != nil {
+			return nil, err
+		}
+		res := []RPCEpoch{}
+		for _, epoch := range epochs {
+			res = append(res, NewRPCEpoch(epoch))
+		}
+		return res, nil
+	}, false)
+
+	rpc.RegisterMethod("getworkproof", func(params json.RawMessage) (interface{}, error) {
+		var seedStr string
+		var samples int
+		if err := parseRPCParams(params, &seedStr, &samples); err != nil {
+			return nil, err
+		}
+		seed, err := parseHash32(seedStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		if samples <= 0 || MAX_WORK_PROOF_SAMPLES < samples {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: fmt.Sprintf("Number of samples must be between 1 and %d", MAX_WORK_PROOF_SAMPLES)}
+		}
+		return n.Dag.GenerateWorkProof(seed, samples)
+	}, false)
+
+	rpc.RegisterMethod("getancestryproof", func(params json.RawMessage) (interface{}, error) {
+		var hashStr, tipStr string
+		if err := parseRPCParams(params, &hashStr, &tipStr); err != nil {
+			return nil, err
+		}
+		hash, err := parseHash32(hashStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		tip, err := parseHash32(tipStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		return n.Dag.GetAncestryProof(hash, tip)
+	}, false)
+
+	rpc.RegisterMethod("getblockfilter", func(params json.RawMessage) (interface{}, error) {
+		var hashStr string
+		if err := parseRPCParams(params, &hashStr); err != nil {
+			return nil, err
+		}
+		hash, err := parseHash32(hashStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		filter, err := n.Dag.GetBlockFilter(hash)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"blockHash": Bytes32ToHexString(hash),
+			"filter":    hex.EncodeToString(filter),
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("getchainstats", func(params json.RawMessage) (interface{}, error) {
+		var window uint64
+		if err := parseRPCParams(params, &window); err != nil {
+			return nil, err
+		}
+		if window == 0 || MAX_ANALYTICS_WINDOW < window {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: fmt.Sprintf("Window must be between 1 and %d blocks", MAX_ANALYTICS_WINDOW)}
+		}
+		stats, err := n.Analytics.GetStats(window)
+		if err != nil {
+			return nil, err
+		}
+		return NewRPCChainStats(stats), nil
+	}, false)
+
+	rpc.RegisterMethod("getsyncstatus", func(params json.RawMessage) (interface{}, error) {
+		status, err := n.GetSyncStatus()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"fullTipHeight":    status.FullTipHeight,
+			"headersTipHeight": status.HeadersTipHeight,
+			"bestPeerHeight":   status.BestPeerHeight,
+			"progress":         status.Progress,
+			"ibd":              n.IBD.InIBD(),
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("getfinalizedblock", func(params json.RawMessage) (interface{}, error) {
+		finalized, err := n.Dag.GetFinalizedBlock()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"hash":            Bytes32ToHexString(finalized.Hash),
+			"height":          finalized.Height,
+			"finalityDepth":   n.Dag.FinalityDepth,
+			"allowDeepReorgs": n.Dag.AllowDeepReorgs,
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("getquarantinedbranches", func(params json.RawMessage) (interface{}, error) {
+		branches, err := n.Dag.GetQuarantinedBranches()
+		if err != nil {
+			return nil, err
+		}
+		res := []RPCQuarantinedBranch{}
+		for _, branch := range branches {
+			res = append(res, NewRPCQuarantinedBranch(branch))
+		}
+		return map[string]interface{}{
+			"maxReorgDepth": n.Dag.MaxReorgDepth,
+			"branches":      res,
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("releasequarantinedbranch", func(params json.RawMessage) (interface{}, error) {
+		var hashStr string
+		if err := parseRPCParams(params, &hashStr); err != nil {
+			return nil, err
+		}
+		hash, err := parseHash32(hashStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+
+		if err := n.Dag.ReleaseQuarantinedBranch(hash); err != nil {
+			return nil, err
+		}
+		return Bytes32ToHexString(n.Dag.FullTip.Hash), nil
+	}, true)
+
+	rpc.RegisterMethod("getmininginfo", func(params json.RawMessage) (interface{}, error) {
+		// Estimated over the last 100 blocks.
+		networkHashrate, err := n.Dag.EstimateNetworkHashrate(100)
+		if err != nil {
+			return nil, err
+		}
+		info := map[string]interface{}{
+			"mining":          false,
+			"hashrate":        float64(0),
+			"networkHashrate": networkHashrate,
+		}
+		if n.Miner != nil {
+			info["mining"] = n.Miner.Running()
+			info["hashrate"] = n.Miner.Hashrate()
+			policy, preferOwn := n.Miner.TipPolicy()
+			info["tipPolicy"] = policy
+			info["preferOwnTransactions"] = preferOwn
+			if tip := n.Miner.MiningTip(); tip != [32]byte{} {
+				info["tip"] = Bytes32ToHexString(tip)
+			}
+		}
+		return info, nil
+	}, false)
+
+	rpc.RegisterMethod("checkblock", func(params json.RawMessage) (interface{}, error) {
+		var blockHex string
+		template := false
+		if err := parseRPCParams(params, &blockHex, &template); err != nil {
+			// Blocks are checked in full by default.
+			if err := parseRPCParams(params, &blockHex); err != nil {
+				return nil, err
+			}
+		}
+		buf, err := hex.DecodeString(blockHex)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Block must be hex-encoded"}
+		}
+		raw, err := DecodeRawBlock(buf)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+
+		if template {
+			err = n.Dag.CheckBlockTemplate(raw)
+		} else {
+			err = n.Dag.CheckBlock(raw)
+		}
+		result := map[string]interface{}{
+			"hash":  raw.HashStr(),
+			"valid": err == nil,
+		}
+		if err != nil {
+			result["error"] = err.Error()
+		}
+		return result, nil
+	}, false)
+
+	rpc.RegisterMethod("getdifficulty", func(params json.RawMessage) (interface{}, error) {
+		var height uint64
+		if err := parseRPCParams(params, &height); err != nil {
+			return nil, err
+		}
+		if n.Dag.FullTip.Height < height {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Height is beyond the tip"}
+		}
+
+		difficulty, err := n.Dag.GetDifficultyAt(height)
+		if err != nil {
+			return nil, err
+		}
+		return difficulty.String(), nil
+	}, false)
+
+	rpc.RegisterMethod("getbalance", func(params json.RawMessage) (interface{}, error) {
+		var pubkeyStr string
+		if err := parseRPCParams(params, &pubkeyStr); err != nil {
+			return nil, err
+		}
+		pubkey, err := n.parseAddress(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+
+		return n.StateMachine1.GetBalance(pubkey), nil
+	}, false)
+
+	rpc.RegisterMethod("getbalanceat", func(params json.RawMessage) (interface{}, error) {
+		var pubkeyStr string
+		var blockParam json.RawMessage
+		if err := parseRPCParams(params, &pubkeyStr, &blockParam); err != nil {
+			return nil, err
+		}
+		pubkey, err := n.parseAddress(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		block, err := n.parseRPCBlockParam(blockParam)
+		if err != nil {
+			return nil, err
+		}
+
+		balance, err := n.GetBalanceAt(pubkey, block.Hash)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"balance": balance,
+			"hash":    Bytes32ToHexString(block.Hash),
+			"height":  block.Height,
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("getaccountstatement", func(params json.RawMessage) (interface{}, error) {
+		var pubkeyStr string
+		var blockParam json.RawMessage
+		if err := parseRPCParams(params, &pubkeyStr, &blockParam); err != nil {
+			// Statements are as of the full tip by default.
+			if err := parseRPCParams(params, &pubkeyStr); err != nil {
+				return nil, err
+			}
+		}
+		pubkey, err := n.parseAddress(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		block := &n.Dag.FullTip
+		if blockParam != nil {
+			if block, err = n.parseRPCBlockParam(blockParam); err != nil {
+				return nil, err
+			}
+		}
+		return n.GetAccountStatement(pubkey, block.Hash)
+	}, false)
+
+	rpc.RegisterRestrictedMethod("contact_list", func(params json.RawMessage) (interface{}, error) {
+		return n.AddressBook.Contacts(), nil
+	})
+
+	rpc.RegisterMethod("contact_add", func(params json.RawMessage) (interface{}, error) {
+		var name, pubkeyStr string
+		if err := parseRPCParams(params, &name, &pubkeyStr); err != nil {
+			return nil, err
+		}
+		pubkey, err := parsePubkey(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		if err := n.AddressBook.Add(name, pubkey); err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		return true, nil
+	}, true)
+
+	rpc.RegisterMethod("contact_remove", func(params json.RawMessage) (interface{}, error) {
+		var name string
+		if err := parseRPCParams(params, &name); err != nil {
+			return nil, err
+		}
+		if err := n.AddressBook.Remove(name); err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		return true, nil
+	}, true)
+
+	rpc.RegisterMethod("getspendablebalance", func(params json.RawMessage) (interface{}, error) {
+		var pubkeyStr string
+		if err := parseRPCParams(params, &pubkeyStr); err != nil {
+			return nil, err
+		}
+		pubkey, err := n.parseAddress(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+
+		return n.GetSpendableBalance(pubkey), nil
+	}, false)
+
+	rpc.RegisterMethod("getaccountactivity", func(params json.RawMessage) (interface{}, error) {
+		var pubkeyStr string
+		if err := parseRPCParams(params, &pubkeyStr); err != nil {
+			return nil, err
+		}
+		pubkey, err := n.parseAddress(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+
+		activity, err := n.Dag.GetAccountActivity(pubkey)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"nextNonce":          activity.NextNonce,
+			"lastActivityHeight": activity.LastActivityHeight,
+			"active":             activity.Active,
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("gettoken", func(params json.RawMessage) (interface{}, error) {
+		var name string
+		if err := parseRPCParams(params, &name); err != nil {
+			return nil, err
+		}
+		token, ok := n.StateMachine1.GetToken(name)
+		if !ok {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Unknown token"}
+		}
+		return map[string]interface{}{
+			"name":   token.Name,
+			"issuer": hex.EncodeToString(token.Issuer[:]),
+			"supply": token.Supply,
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("gettokenbalance", func(params json.RawMessage) (interface{}, error) {
+		var name, pubkeyStr string
+		if err := parseRPCParams(params, &name, &pubkeyStr); err != nil {
+			return nil, err
+		}
+		pubkey, err := n.parseAddress(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		if _, ok := n.StateMachine1.GetToken(name); !ok {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Unknown token"}
+		}
+		return n.StateMachine1.GetTokenBalance(name, pubkey), nil
+	}, false)
+
+	rpc.RegisterMethod("getstateroot", func(params json.RawMessage) (interface{}, error) {
+		return Bytes32ToHexString(n.StateMachine1.StateRoot()), nil
+	}, false)
+
+	rpc.RegisterMethod("watchaddress", func(params json.RawMessage) (interface{}, error) {
+		var pubkeyStr, webhook string
+		if err := parseRPCParams(params, &pubkeyStr, &webhook); err != nil {
+			// The webhook is optional.
+			if err := parseRPCParams(params, &pubkeyStr); err != nil {
+				return nil, err
+			}
+		}
+		pubkey, err := n.parseAddress(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		if err := n.AddressWatcher.Watch(pubkey, webhook); err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		return true, nil
+	}, true)
+
+	rpc.RegisterMethod("rescanaddresses", func(params json.RawMessage) (interface{}, error) {
+		var pubkeyStrs []string
+		var fromHeight uint64
+		if err := parseRPCParams(params, &pubkeyStrs, &fromHeight); err != nil {
+			return nil, err
+		}
+		addresses := [][65]byte{}
+		for _, pubkeyStr := range pubkeyStrs {
+			pubkey, err := n.parseAddress(pubkeyStr)
+			if err != nil {
+				return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+			}
+			addresses = append(addresses, pubkey)
+		}
+		rescan, err := n.RescanAddresses(addresses, fromHeight, time.Now())
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		txs := []RPCAddressHistoryEntry{}
+		for _, entry := range rescan.Transactions {
+			txs = append(txs, NewRPCAddressHistoryEntry(entry, n.Dag.FullTip.Height))
+		}
+		return map[string]interface{}{
+			"fromHeight":    rescan.FromHeight,
+			"toHeight":      rescan.ToHeight,
+			"blocksScanned": rescan.BlocksScanned,
+			"blocksMatched": rescan.BlocksMatched,
+			"transactions":  txs,
+		}, nil
+	}, true)
+
+	rpc.RegisterMethod("unwatchaddress", func(params json.RawMessage) (interface{}, error) {
+		var pubkeyStr string
+		if err := parseRPCParams(params, &pubkeyStr); err != nil {
+			return nil, err
+		}
+		pubkey, err := n.parseAddress(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		if err := n.AddressWatcher.Unwatch(pubkey); err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		return true, nil
+	}, true)
+
+	rpc.RegisterMethod("listwatchedaddresses", func(params json.RawMessage) (interface{}, error) {
+		// Map of address to webhook URL.
+		watched := make(map[string]string)
+		for address, webhook := range n.AddressWatcher.Watched() {
+			watched[hex.EncodeToString(address[:])] = webhook
+		}
+		return watched, nil
+	}, false)
+
+	rpc.RegisterMethod("getaddressactivity", func(params json.RawMessage) (interface{}, error) {
+		var pubkeyStr string
+		if err := parseRPCParams(params, &pubkeyStr); err != nil {
+			return nil, err
+		}
+		pubkey, err := n.parseAddress(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		activity, err := n.AddressWatcher.Activity(pubkey)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		res := []RPCAddressEvent{}
+		for _, event := range activity {
+			res = append(res, NewRPCAddressEvent(event))
+		}
+		return res, nil
+	}, false)
+
+	rpc.RegisterMethod("getaddresshistory", func(params json.RawMessage) (interface{}, error) {
+		var pubkeyStr string
+		var limit, offset uint64
+		if err := parseRPCParams(params, &pubkeyStr, &limit, &offset); err != nil {
+			// The offset is optional.
+			if err := parseRPCParams(params, &pubkeyStr, &limit); err != nil {
+				return nil, err
+			}
+		}
+		pubkey, err := n.parseAddress(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		MAX_GET_ADDRESS_HISTORY_LEN := uint64(1000)
+		if limit == 0 || MAX_GET_ADDRESS_HISTORY_LEN < limit {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: fmt.Sprintf("Limit must be between 1 and %d", MAX_GET_ADDRESS_HISTORY_LEN)}
+		}
+
+		tip := n.Dag.FullTip
+		history, err := n.Dag.GetAddressHistoryPage(pubkey, offset, limit)
+		if err != nil {
+			return nil, err
+		}
+		res := []RPCAddressHistoryEntry{}
+		for _, entry := range history {
+			res = append(res, NewRPCAddressHistoryEntry(entry, tip.Height))
+		}
+		return res, nil
+	}, false)
+
+	rpc.RegisterMethod("getevents", func(params json.RawMessage) (interface{}, error) {
+		var after, limit uint64
+		if err := parseRPCParams(params, &after, &limit); err != nil {
+			// The limit is optional.
+			if err := parseRPCParams(params, &after); err != nil {
+				return nil, err
+			}
+			limit = MAX_GET_EVENTS
+		}
+		if limit == 0 || MAX_GET_EVENTS < limit {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: fmt.Sprintf("Limit must be between 1 and %d", MAX_GET_EVENTS)}
+		}
+		events, err := n.Dag.GetEvents(after, limit)
+		if err != nil {
+			return nil, err
+		}
+		latest, err := n.Dag.GetLatestEventSeq()
+		if err != nil {
+			return nil, err
+		}
+		res := []RPCChainEvent{}
+		for _, event := range events {
+			res = append(res, NewRPCChainEvent(event))
+		}
+		return map[string]interface{}{
+			"events":    res,
+			"latestSeq": latest,
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("estimatefee", func(params json.RawMessage) (interface{}, error) {
+		// The number of blocks the transaction should remain includable for.
+		var blocks uint64
+		if err := parseRPCParams(params, &blocks); err != nil {
+			return nil, err
+		}
+		if blocks == 0 || 1000 < blocks {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Blocks must be between 1 and 1000"}
+		}
+
+		// Fees are per byte.
+		tip := n.Dag.FullTip
+		minRelayFee := n.Mempool.MinRelayFeePerByte
+		return map[string]interface{}{
+			"feeMarket":   n.Dag.FeeMarketEnabled(),
+			"baseFee":     n.Dag.GetNextBaseFee(tip),
+			"maxBaseFee":  n.Dag.EstimateMaxBaseFee(tip, blocks),
+			"minRelayFee": minRelayFee,
+			"feePerByte":  n.EstimateFeePerByte(blocks),
+			"txSizeBytes": (&RawTransaction{}).SizeBytes(),
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("gettransaction", func(params json.RawMessage) (interface{}, error) {
+		var hashStr string
+		if err := parseRPCParams(params, &hashStr); err != nil {
+			return nil, err
+		}
+		hash, err := parseHash32(hashStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		location, err := n.Dag.GetTransactionLocation(hash)
+		if err != nil {
+			return nil, err
+		}
+		if location == nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Transaction not found"}
+		}
+		tx, err := n.Dag.getTransactionAt(hash, *location)
+		if err != nil {
+			return nil, err
+		}
+		return NewRPCTransaction(*tx, *location), nil
+	}, false)
+
+	rpc.RegisterMethod("gettxstatus", func(params json.RawMessage) (interface{}, error) {
+		var hashStr string
+		if err := parseRPCParams(params, &hashStr); err != nil {
+			return nil, err
+		}
+		hash, err := parseHash32(hashStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		info, err := n.GetTransactionStatus(hash)
+		if err != nil {
+			return nil, err
+		}
+		return NewRPCTxStatus(info), nil
+	}, false)
+
+	rpc.RegisterMethod("gettransactionreceipt", func(params json.RawMessage) (interface{}, error) {
+		var hashStr string
+		if err := parseRPCParams(params, &hashStr); err != nil {
+			return nil, err
+		}
+		hash, err := parseHash32(hashStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		receipt, err := n.Dag.GetTransactionReceipt(hash)
+		if err != nil {
+			return nil, err
+		}
+		if receipt == nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Receipt not found"}
+		}
+		return NewRPCReceipt(*receipt), nil
+	}, false)
+
+	rpc.RegisterMethod("mempool_content", func(params json.RawMessage) (interface{}, error) {
+		txs := n.Mempool.GetTransactions()
+		sort.Slice(txs, func(i, j int) bool {
+			return bytes.Compare(txs[i].Hash[:], txs[j].Hash[:]) < 0
+		})
+		res := []RPCMempoolTransaction{}
+		for _, tx := range txs {
+			res = append(res, NewRPCMempoolTransaction(*tx))
+		}
+		return res, nil
+	}, false)
+
+	rpc.RegisterMethod("mempool_info", func(params json.RawMessage) (interface{}, error) {
+		info := n.Mempool.GetInfo()
+		return map[string]interface{}{
+			"count":         info.Count,
+			"bytes":         info.Bytes,
+			"minFeeRate":    info.MinFee,
+			"medianFeeRate": info.MedianFee,
+			"maxFeeRate":    info.MaxFee,
+			"minRelayFee":   n.Mempool.MinRelayFeePerByte,
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("mempool_feeHistogram", func(params json.RawMessage) (interface{}, error) {
+		buckets := []map[string]interface{}{}
+		for _, bucket := range n.Mempool.GetFeeHistogram() {
+			buckets = append(buckets, map[string]interface{}{
+				"feeRate": bucket.FeeRate,
+				"count":   bucket.Count,
+				"bytes":   bucket.Bytes,
+			})
+		}
+		return buckets, nil
+	}, false)
+
+	// Reports an account's pending transactions, and the nonces missing before its parked transactions can be included.
+	rpc.RegisterMethod("mempool_account", func(params json.RawMessage) (interface{}, error) {
+		var pubkeyStr string
+		if err := parseRPCParams(params, &pubkeyStr); err != nil {
+			return nil, err
+		}
+		pubkey, err := n.parseAddress(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+
+		status, err := n.Mempool.GetAccountStatus(pubkey)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"nextNonce":  status.NextNonce,
+			"executable": status.Executable,
+			"parked":     status.Parked,
+			"gaps":       status.Gaps,
+		}, nil
+	}, false)
+
+	rpc.RegisterMethod("decoderawtransaction", func(params json.RawMessage) (interface{}, error) {
+		var txHex string
+		if err := parseRPCParams(params, &txHex); err != nil {
+			return nil, err
+		}
+		buf, err := hex.DecodeString(txHex)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Transaction must be hex-encoded"}
+		}
+		tx, err := DecodeRawTransaction(buf)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		return NewRPCRawTransaction(tx), nil
+	}, false)
+
+	rpc.RegisterMethod("createrawtransaction", func(params json.RawMessage) (interface{}, error) {
+		var r RPCRawTransaction
+		if err := parseRPCParams(params, &r); err != nil {
+			return nil, err
+		}
+		tx, err := n.parseRPCRawTransaction(r)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		return hex.EncodeToString(tx.Bytes()), nil
+	}, false)
+
+	rpc.RegisterMethod("sendrawtransaction", func(params json.RawMessage) (interface{}, error) {
+		var raw RawTransaction
+		if err := parseRPCParams(params, &raw); err != nil {
+			return nil, err
+		}
+
+		// Add to our mempool and gossip to peers. Resubmitting a known transaction succeeds, so clients can retry.
+		result, err := n.SubmitTransaction(raw)
+		if err != nil {
+			return nil, err
+		}
+		if result.Status == SUBMIT_REJECTED {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: result.Reason.Error()}
+		}
+
+		return Bytes32ToHexString(result.Hash), nil
+	}, true)
+
+	// Submits a parent and its children, from the same sender with sequential nonces, so the children can pay the fees
+	// of the parent. See Mempool.AddPackage.
+	rpc.RegisterMethod("submitpackage", func(params json.RawMessage) (interface{}, error) {
+		var raws []RawTransaction
+		if err := parseRPCParams(params, &raws); err != nil {
+			return nil, err
+		}
+
+		txs := []*Transaction{}
+		for _, raw := range raws {
+			tx := raw.ToTransaction()
+			txs = append(txs, &tx)
+		}
+		if n.IBD.InIBD() {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Node is in initial block download"}
+		}
+		if err := n.Mempool.AddPackage(txs); err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+
+		// Peers receive the transactions individually, in order, so they only relay a parent which pays the relay fee
+		// by itself.
+		hashes := []string{}
+		for _, raw := range raws {
+			if n.Rebroadcaster != nil {
+				n.Rebroadcaster.Track(raw)
+			}
+			hashes = append(hashes, Bytes32ToHexString(raw.Hash()))
+		}
+		if n.Peer != nil {
+			go func() {
+				for _, raw := range raws {
+					n.Peer.GossipTransaction(raw)
+				}
+			}()
+		}
+		return hashes, nil
+	}, true)
+
+	n.registerMinerRPCMethods(rpc)
+	n.registerAdminRPCMethods(rpc)
+}
+
+func (n *Node) registerMinerRPCMethods(rpc *RPCHandler) {
+	if n.Miner == nil {
+		return
+	}
+
+	rpc.RegisterMethod("miner_start", func(params json.RawMessage) (interface{}, error) {
+		threads := 1
+		if err := parseRPCParams(params, &threads); err != nil {
+			// The number of threads is optional.
+			if err := parseRPCParams(params); err != nil {
+				return nil, err
+			}
+		}
+		if threads < 1 {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: "Threads must be at least 1"}
+		}
+		if n.Miner.Running() {
+			return nil, fmt.Errorf("Miner is already running.")
+		}
+		if n.IBD.InIBD() {
+			return nil, fmt.Errorf("Node is in initial block download, the miner can be started once it's caught up.")
+		}
+		n.Miner.SetThreads(threads)
+		go n.Miner.Start(-1)
+		return true, nil
+	}, true)
+
+	rpc.RegisterMethod("miner_stop", func(params json.RawMessage) (interface{}, error) {
+		// A miner paused for initial block download stays stopped.
+		n.resumeMiner.Store(false)
+		n.Miner.Stop()
+		return true, nil
+	}, true)
+
+	rpc.RegisterMethod("miner_setCoinbase", func(params json.RawMessage) (interface{}, error) {
+		var pubkeyStr string
+		if err := parseRPCParams(params, &pubkeyStr); err != nil {
+			return nil, err
+		}
+		pubkey, err := n.parseAddress(pubkeyStr)
+		if err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		n.Miner.SetCoinbase(pubkey)
+		return true, nil
+	}, true)
+
+	rpc.RegisterMethod("miner_setGraffiti", func(params json.RawMessage) (interface{}, error) {
+		var text string
+		if err := parseRPCParams(params, &text); err != nil {
+			return nil, err
+		}
+		graffiti := [32]byte{}
+		if len(graffiti) < len(text) {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: fmt.Sprintf("Graffiti must be at most %d bytes", len(graffiti))}
+		}
+		copy(graffiti[:], text)
+		n.Miner.SetGraffiti(graffiti)
+		return true, nil
+	}, true)
+
+	rpc.RegisterMethod("miner_setTipPolicy", func(params json.RawMessage) (interface{}, error) {
+		var policy string
+		preferOwn := false
+		if err := parseRPCParams(params, &policy, &preferOwn); err != nil {
+			if err := parseRPCParams(params, &policy); err != nil {
+				return nil, err
+			}
+		}
+		if err := n.Miner.SetTipPolicy(policy, preferOwn); err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		return true, nil
+	}, true)
+
+	rpc.RegisterMethod("miner_hashrate", func(params json.RawMessage) (interface{}, error) {
+		return n.Miner.Hashrate(), nil
+	}, false)
+}
+
+func (n *Node) registerAdminRPCMethods(rpc *RPCHandler) {
+	if n.Peer == nil {
+		return
+	}
+
+	rpc.RegisterRestrictedMethod("getpeerinfo", func(params json.RawMessage) (interface{}, error) {
+		var peerUrl string
+		if err := parseRPCParams(params, &peerUrl); err != nil {
+			// The URL is optional.
+			if err := parseRPCParams(params); err != nil {
+				return nil, err
+			}
+		}
+		now := time.Now()
+		peers := []RPCPeerInfo{}
+		for _, peer := range n.Peer.Peers() {
+			if peerUrl != "" && peer.url != peerUrl {
+				continue
+			}
+			host := ""
+			if u, err := url.Parse(peer.url); err == nil {
+				host = u.Hostname()
+			}
+			peers = append(peers, NewRPCPeerInfo(peer, n.Peer.MisbehaviourScore(host), now))
+		}
+		if peerUrl != "" && len(peers) == 0 {
+			return nil, fmt.Errorf("Peer not found.")
+		}
+		return peers, nil
+	})
+
+	rpc.RegisterMethod("admin_listPeers", func(params json.RawMessage) (interface{}, error) {
+		peers := []RPCPeer{}
+		for _, peer := range n.Peer.Peers() {
+			peers = append(peers, NewRPCPeer(peer))
+		}
+		return peers, nil
+	}, false)
+
+	rpc.RegisterMethod("admin_addPeer", func(params json.RawMessage) (interface{}, error) {
+		var url string
+		if err := parseRPCParams(params, &url); err != nil {
+			return nil, err
+		}
+		if err := n.Peer.AddPeer(url); err != nil {
+			return nil, err
+		}
+		return true, nil
+	}, true)
+
+	rpc.RegisterMethod("admin_removePeer", func(params json.RawMessage) (interface{}, error) {
+		var url string
+		if err := parseRPCParams(params, &url); err != nil {
+			return nil, err
+		}
+		if err := n.Peer.RemovePeer(url); err != nil {
+			return nil, err
+		}
+		return true, nil
+	}, true)
+
+	rpc.RegisterMethod("admin_logs", func(params json.RawMessage) (interface{}, error) {
+		var count int
+		if err := parseRPCParams(params, &count); err != nil {
+			return nil, err
+		}
+		if count <= 0 || RECENT_LOG_LINES < count {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: fmt.Sprintf("Count must be between 1 and %d", RECENT_LOG_LINES)}
+		}
+		return RecentLogLines(count), nil
+	}, false)
+
+	rpc.RegisterMethod("admin_listBanned", func(params json.RawMessage) (interface{}, error) {
+		// Map of host to ban expiry (unix seconds, 0 if permanent).
+		bans := make(map[string]int64)
+		for host, until := range n.Peer.BannedHosts() {
+			if until.IsZero() {
+				bans[host] = 0
+			} else {
+				bans[host] = until.Unix()
+			}
+		}
+		return bans, nil
+	}, false)
+
+	rpc.RegisterMethod("admin_banPeer", func(params json.RawMessage) (interface{}, error) {
+		var url string
+		var seconds uint64
+		if err := parseRPCParams(params, &url, &seconds); err != nil {
+			return nil, err
+		}
+		if err := n.Peer.BanPeer(url, time.Duration(seconds)*time.Second); err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		return true, nil
+	}, true)
+
+	rpc.RegisterMethod("admin_unbanPeer", func(params json.RawMessage) (interface{}, error) {
+		var url string
+		if err := parseRPCParams(params, &url); err != nil {
+			return nil, err
+		}
+		if err := n.Peer.UnbanPeer(url); err != nil {
+			return nil, &RPCError{Code: RPCErrInvalidParams, Message: err.Error()}
+		}
+		return true, nil
+	}, true)
+}
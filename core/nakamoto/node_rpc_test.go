@@ -0,0 +1,160 @@
+package nakamoto
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns a function calling the node's RPC methods directly.
+func newNodeRPCCaller(t *testing.T, node *Node) func(method string, params ...interface{}) RPCResponse {
+	rpc := NewRPCHandler()
+	node.registerRPCMethods(rpc)
+	return func(method string, params ...interface{}) RPCResponse {
+		buf, err := json.Marshal(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rpc.call(httptest.NewRequest("POST", "/rpc", nil), RPCRequest{JSONRPC: "2.0", ID: json.RawMessage("1"), Method: method, Params: buf})
+	}
+}
+
+func TestRawTransactionRPC(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	call := newNodeRPCCaller(t, node)
+
+	// An unsigned transfer is created at the lowest version, and decodes to the same fields.
+	from, to := wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes()
+	res := call("createrawtransaction", RPCRawTransaction{From: hex.EncodeToString(from[:]), To: hex.EncodeToString(to[:]), Amount: 5, Fee: 100, Nonce: 3})
+	assert.Nil(res.Error)
+	txHex := ""
+	assert.Nil(json.Unmarshal(res.Result, &txHex))
+	res = call("decoderawtransaction", txHex)
+	assert.Nil(res.Error)
+	decoded := RPCRawTransaction{}
+	assert.Nil(json.Unmarshal(res.Result, &decoded))
+	assert.Equal(byte(1), decoded.Version)
+	assert.Equal(hex.EncodeToString(to[:]), decoded.To)
+	assert.Equal(uint64(5), decoded.Amount)
+	assert.Equal(uint64(3), decoded.Nonce)
+
+	// Signing the envelope gives the same transaction as signing in Go.
+	envelope, err := hex.DecodeString(decoded.Envelope)
+	assert.Nil(err)
+	sig, err := wallets[0].Sign(envelope)
+	assert.Nil(err)
+	decoded.Sig = hex.EncodeToString(sig)
+	res = call("createrawtransaction", decoded)
+	assert.Nil(res.Error)
+	assert.Nil(json.Unmarshal(res.Result, &txHex))
+	buf, err := hex.DecodeString(txHex)
+	assert.Nil(err)
+	tx, err := DecodeRawTransaction(buf)
+	assert.Nil(err)
+	assert.Nil(node.StateMachine1.VerifyTx(tx))
+	assert.Equal(decoded.Hash, Bytes32ToHexString(tx.Hash()))
+
+	// Token and UTXO fields raise the version.
+	decoded.Version = 0
+	decoded.Token = "TKN"
+	decoded.TokenOp = TOKEN_OP_TRANSFER
+	decoded.Inputs = []RPCOutpoint{{TxHash: decoded.Hash, Index: 1}}
+	res = call("createrawtransaction", decoded)
+	assert.Nil(res.Error)
+	assert.Nil(json.Unmarshal(res.Result, &txHex))
+	res = call("decoderawtransaction", txHex)
+	assert.Nil(json.Unmarshal(res.Result, &decoded))
+	assert.Equal(byte(4), decoded.Version)
+	assert.Equal("TKN", decoded.Token)
+	assert.Equal([]RPCOutpoint{{TxHash: decoded.Inputs[0].TxHash, Index: 1}}, decoded.Inputs)
+
+	// Invalid fields and encodings are rejected.
+	decoded.Version = 2
+	res = call("createrawtransaction", decoded)
+	assert.Equal(RPCErrInvalidParams, res.Error.Code)
+	assert.Contains(res.Error.Message, "at least 4 is required")
+	decoded.Version, decoded.Sig = 0, "00"
+	res = call("createrawtransaction", decoded)
+	assert.Contains(res.Error.Message, "Sig must be")
+	res = call("decoderawtransaction", txHex+"00")
+	assert.Contains(res.Error.Message, "Unexpected 1 bytes after transaction")
+	res = call("decoderawtransaction", "zz")
+	assert.Equal(RPCErrInvalidParams, res.Error.Code)
+}
+
+func TestConsensusParamsRPC(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, conf, _, _ := newBlockdag()
+	dag.consensus.Forks = map[string]uint64{FORK_TOKENS: 1, FORK_PREDICATES: 1, "future": 100}
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	node.Miner.OnBlockSolution = func(block RawBlock) {
+		if err := node.Dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	genesis := node.Dag.FullTip.Hash
+	node.Miner.Start(1)
+	call := newNodeRPCCaller(t, node)
+
+	res := call("getconsensusparams")
+	assert.Nil(res.Error)
+	params := RPCConsensusParams{}
+	assert.Nil(json.Unmarshal(res.Result, &params))
+	assert.Equal(Bytes32ToHexString(genesis), params.ChainId)
+	assert.Equal(conf.EpochLengthBlocks, params.EpochLengthBlocks)
+	assert.Equal(conf.TargetEpochLengthMillis/conf.EpochLengthBlocks, params.TargetBlockTimeMillis)
+	assert.Equal(conf.MaxBlockSizeBytes, params.MaxBlockSizeBytes)
+	assert.Equal(conf.GenesisDifficulty.String(), params.GenesisDifficulty)
+	assert.Equal(STATE_MACHINE_ACCOUNT, params.StateMachine)
+
+	// Forks are listed in order of activation, with whether they're active and implemented.
+	assert.Equal([]RPCForkSchedule{
+		{Name: FORK_PREDICATES, Height: 1, Active: true, Supported: true},
+		{Name: FORK_TOKENS, Height: 1, Active: true, Supported: true},
+		{Name: "future", Height: 100, Active: false, Supported: false},
+	}, params.Forks)
+}
+
+func TestPeerInfoRPCRestricted(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	rpc := NewRPCHandler()
+	rpc.Authorize = func(r *http.Request) bool { return false }
+	node.registerRPCMethods(rpc)
+
+	// The peers' addresses aren't revealed to unauthorised callers.
+	res := rpc.call(httptest.NewRequest("POST", "/rpc", nil), RPCRequest{JSONRPC: "2.0", ID: json.RawMessage("1"), Method: "getpeerinfo"})
+	assert.Equal(RPCErrUnauthorized, res.Error.Code)
+}
+
+func TestContactListRPCRestricted(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	rpc := NewRPCHandler()
+	rpc.Authorize = func(r *http.Request) bool { return false }
+	node.registerRPCMethods(rpc)
+
+	// The address book isn't revealed to unauthorised callers.
+	res := rpc.call(httptest.NewRequest("POST", "/rpc", nil), RPCRequest{JSONRPC: "2.0", ID: json.RawMessage("1"), Method: "contact_list"})
+	assert.Equal(RPCErrUnauthorized, res.Error.Code)
+}
@@ -2,7 +2,6 @@ package nakamoto
 
 import (
 	"encoding/binary"
-	"encoding/json"
 	"math"
 	"testing"
 	"time"
@@ -59,7 +58,7 @@ func TestTwoNodesGossipBlocks(t *testing.T) {
 	go node2.Peer.Start()
 
 	// Wait for peers to come online.
-	waitForPeersOnline([]*PeerCore{node1.Peer, node2.Peer})
+	waitForPeersOnline([]*PeerCore{node1.Peer.(*PeerCore), node2.Peer.(*PeerCore)})
 
 	// Bootstrap.
 	node1.Peer.Bootstrap([]string{
@@ -71,9 +70,9 @@ func TestTwoNodesGossipBlocks(t *testing.T) {
 
 	// Node 1 solves a block, and gossips it to node 2.
 	newBlockChan := make(chan NewBlockMessage)
-	node2.Peer.server.RegisterMesageHandler("new_block", func(message []byte) (interface{}, error) {
+	node2.Peer.(*PeerCore).server.RegisterMesageHandler("new_block", func(message []byte, codec WireCodec) (interface{}, error) {
 		var msg NewBlockMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
+		if err := codec.Unmarshal(message, &msg); err != nil {
 			return nil, err
 		}
 
@@ -105,7 +104,7 @@ func TestTwoNodeEqualMining(t *testing.T) {
 	go node2.Peer.Start()
 
 	// Wait for peers to come online.
-	waitForPeersOnline([]*PeerCore{node1.Peer, node2.Peer})
+	waitForPeersOnline([]*PeerCore{node1.Peer.(*PeerCore), node2.Peer.(*PeerCore)})
 
 	// Bootstrap.
 	node1.Peer.Bootstrap([]string{
@@ -144,7 +143,7 @@ func TestTwoNodeUnequalMining(t *testing.T) {
 	go node2.Peer.Start()
 
 	// Wait for peers to come online.
-	waitForPeersOnline([]*PeerCore{node1.Peer, node2.Peer})
+	waitForPeersOnline([]*PeerCore{node1.Peer.(*PeerCore), node2.Peer.(*PeerCore)})
 
 	// Bootstrap.
 	node1.Peer.Bootstrap([]string{
@@ -193,7 +192,7 @@ func TestNodeSyncMissingBlocks(t *testing.T) {
 	// Start node1 only.
 	go node1.Peer.Start()
 	// Wait for node1 to come online.
-	waitForPeersOnline([]*PeerCore{node1.Peer})
+	waitForPeersOnline([]*PeerCore{node1.Peer.(*PeerCore)})
 
 	// Bootstrap.
 	node1.Peer.Bootstrap([]string{
@@ -208,7 +207,7 @@ func TestNodeSyncMissingBlocks(t *testing.T) {
 	// Start node2.
 	go node2.Peer.Start()
 	// Wait for node2 to come online.
-	waitForPeersOnline([]*PeerCore{node2.Peer})
+	waitForPeersOnline([]*PeerCore{node2.Peer.(*PeerCore)})
 
 	// Wait for node 2 to sync completely.
 
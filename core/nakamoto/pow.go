@@ -51,12 +51,11 @@ func SolvePOW(b RawBlock, startNonce big.Int, target big.Int, maxIterations uint
 
 // Recomputes the difficulty for the next epoch.
 func RecomputeDifficulty(epochStart uint64, epochEnd uint64, currDifficulty big.Int, targetEpochLengthMillis uint64, epochLengthBlocks uint64, height uint64) big.Int {
-	// Compute the epoch duration.
-	epochDuration := epochEnd - epochStart
-
-	// Special case: clamp the epoch duration so it is at least 1.
-	if epochDuration == 0 {
-		epochDuration = 1
+	// Compute the epoch duration. Block timestamps needn't increase, so an epoch can end before it started. Clamp the
+	// epoch duration so it is at least 1, rather than underflowing.
+	epochDuration := uint64(1)
+	if epochStart < epochEnd {
+		epochDuration = epochEnd - epochStart
 	}
 
 	epochIndex := height / epochLengthBlocks
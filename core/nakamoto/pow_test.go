@@ -54,10 +54,12 @@ func TestPOWBuildChainOfBlocks(t *testing.T) {
 		// Create a new block.
 		timestamp := uint64(0)
 		curr_block = RawBlock{
-			ParentHash:      curr_block.Hash(),
-			Timestamp:       timestamp,
-			NumTransactions: 0,
-			Transactions:    []RawTransaction{},
+			BlockHeader: BlockHeader{
+				ParentHash:      curr_block.Hash(),
+				Timestamp:       timestamp,
+				NumTransactions: 0,
+			},
+			Transactions: []RawTransaction{},
 		}
 
 		// Exit if the chain is long enough.
@@ -165,8 +167,10 @@ func TestCalculateWork(t *testing.T) {
 
 		// Setup next block.
 		block_template = RawBlock{
-			ParentHash: block_template.Hash(),
-			Timestamp:  0,
+			BlockHeader: BlockHeader{
+				ParentHash: block_template.Hash(),
+				Timestamp:  0,
+			},
 		}
 
 		// Calculate the work.
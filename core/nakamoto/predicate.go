@@ -0,0 +1,347 @@
+package nakamoto
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// Predicates are locking conditions on coins, which open the door to escrow, atomic swaps and shared custody.
+//
+// Coins are locked by sending them to a predicate address, which commits to the hash of the predicate, in the style of
+// Bitcoin's P2SH. To spend them, a version 2 (or later) transaction from the predicate address reveals the predicate, along with a
+// witness which satisfies it (ie. signatures, or a hash preimage). The predicate is part of the signed envelope, while
+// the witness is not, like the signature of a regular transaction.
+//
+// Predicates are encoded as a tree of nodes, each a type byte followed by its arguments:
+//
+//   - sig <pubkey:65>: a signature by the key.
+//   - multisig <m:1> <n:1> <pubkey:65>...: signatures by m of the n keys.
+//   - after <height:8>: not spendable before the block height.
+//   - hash <sha256:32>: the preimage of the hash.
+//   - and <predicate> <predicate>: both predicates.
+//   - or <predicate> <predicate>: either predicate.
+//
+// The witness is a list of items, each prefixed by its length as a 2-byte big-endian integer, which are consumed as the
+// predicate is evaluated depth-first: one signature for sig, n items for multisig (a signature or an empty item for each
+// key), the preimage for hash, and a selector for or (0 for the first predicate, 1 for the second). Every item must be
+// consumed.
+
+const (
+	PREDICATE_SIG      = 0x01
+	PREDICATE_MULTISIG = 0x02
+	PREDICATE_AFTER    = 0x03
+	PREDICATE_HASH     = 0x04
+	PREDICATE_AND      = 0x05
+	PREDICATE_OR       = 0x06
+
+	// The first byte of a predicate address. Public keys are uncompressed, and so start with 0x04.
+	PREDICATE_ADDRESS_PREFIX = 0x50
+
+	MAX_PREDICATE_SIZE     = 1024
+	MAX_PREDICATE_DEPTH    = 8
+	MAX_MULTISIG_KEYS      = 16
+	MAX_WITNESS_SIZE       = 4096
+	MAX_HASH_PREIMAGE_SIZE = 256
+)
+
+var ErrInvalidPredicate = errors.New("invalid predicate")
+var ErrPredicateMismatch = errors.New("predicate does not match address")
+var ErrPredicateNotSatisfied = errors.New("predicate not satisfied")
+var ErrUnexpectedPredicate = errors.New("unexpected predicate")
+
+type Predicate struct {
+	Type byte
+
+	// sig, multisig.
+	Pubkeys [][65]byte
+	// multisig.
+	M uint8
+	// after.
+	Height uint64
+	// hash.
+	Hash [32]byte
+	// and, or.
+	Left  *Predicate
+	Right *Predicate
+}
+
+func SigPredicate(pubkey [65]byte) *Predicate {
+	return &Predicate{Type: PREDICATE_SIG, Pubkeys: [][65]byte{pubkey}}
+}
+
+func MultisigPredicate(m uint8, pubkeys [][65]byte) *Predicate {
+	return &Predicate{Type: PREDICATE_MULTISIG, M: m, Pubkeys: pubkeys}
+}
+
+func AfterPredicate(height uint64) *Predicate {
+	return &Predicate{Type: PREDICATE_AFTER, Height: height}
+}
+
+func HashPredicate(hash [32]byte) *Predicate {
+	return &Predicate{Type: PREDICATE_HASH, Hash: hash}
+}
+
+func AndPredicate(left *Predicate, right *Predicate) *Predicate {
+	return &Predicate{Type: PREDICATE_AND, Left: left, Right: right}
+}
+
+func OrPredicate(left *Predicate, right *Predicate) *Predicate {
+	return &Predicate{Type: PREDICATE_OR, Left: left, Right: right}
+}
+
+func (p *Predicate) Bytes() []byte {
+	buf := []byte{p.Type}
+	switch p.Type {
+	case PREDICATE_SIG:
+		buf = append(buf, p.Pubkeys[0][:]...)
+	case PREDICATE_MULTISIG:
+		buf = append(buf, p.M, byte(len(p.Pubkeys)))
+		for _, pubkey := range p.Pubkeys {
+			buf = append(buf, pubkey[:]...)
+		}
+	case PREDICATE_AFTER:
+		buf = binary.BigEndian.AppendUint64(buf, p.Height)
+	case PREDICATE_HASH:
+		buf = append(buf, p.Hash[:]...)
+	case PREDICATE_AND, PREDICATE_OR:
+		buf = append(buf, p.Left.Bytes()...)
+		buf = append(buf, p.Right.Bytes()...)
+	}
+	return buf
+}
+
+// Returns the address which coins are sent to, to be locked by the predicate.
+func (p *Predicate) Address() [65]byte {
+	return PredicateAddress(p.Bytes())
+}
+
+func PredicateAddress(predicate []byte) [65]byte {
+	address := [65]byte{PREDICATE_ADDRESS_PREFIX}
+	hash := sha256.Sum256(predicate)
+	copy(address[1:], hash[:])
+	return address
+}
+
+func IsPredicateAddress(address [65]byte) bool {
+	return address[0] == PREDICATE_ADDRESS_PREFIX
+}
+
+func ParsePredicate(buf []byte) (*Predicate, error) {
+	if MAX_PREDICATE_SIZE < len(buf) {
+		return nil, ErrInvalidPredicate
+	}
+	p, n, err := parsePredicate(buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	if n != len(buf) {
+		return nil, ErrInvalidPredicate
+	}
+	return p, nil
+}
+
+// Parses a predicate from the start of the buffer, returning the number of bytes read.
+func parsePredicate(buf []byte, depth int) (*Predicate, int, error) {
+	if MAX_PREDICATE_DEPTH < depth || len(buf) == 0 {
+		return nil, 0, ErrInvalidPredicate
+	}
+
+	p := &Predicate{Type: buf[0]}
+	args := buf[1:]
+	switch p.Type {
+	case PREDICATE_SIG:
+		if len(args) < 65 {
+			return nil, 0, ErrInvalidPredicate
+		}
+		p.Pubkeys = [][65]byte{[65]byte(args[:65])}
+		return p, 1 + 65, nil
+
+	case PREDICATE_MULTISIG:
+		if len(args) < 2 {
+			return nil, 0, ErrInvalidPredicate
+		}
+		m, n := args[0], int(args[1])
+		if m == 0 || n < int(m) || MAX_MULTISIG_KEYS < n || len(args) < 2+n*65 {
+			return nil, 0, ErrInvalidPredicate
+		}
+		p.M = m
+		for i := 0; i < n; i++ {
+			p.Pubkeys = append(p.Pubkeys, [65]byte(args[2+i*65:2+(i+1)*65]))
+		}
+		return p, 1 + 2 + n*65, nil
+
+	case PREDICATE_AFTER:
+		if len(args) < 8 {
+			return nil, 0, ErrInvalidPredicate
+		}
+		p.Height = binary.BigEndian.Uint64(args[:8])
+		return p, 1 + 8, nil
+
+	case PREDICATE_HASH:
+		if len(args) < 32 {
+			return nil, 0, ErrInvalidPredicate
+		}
+		p.Hash = [32]byte(args[:32])
+		return p, 1 + 32, nil
+
+	case PREDICATE_AND, PREDICATE_OR:
+		left, n1, err := parsePredicate(args, depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		right, n2, err := parsePredicate(args[n1:], depth+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		p.Left, p.Right = left, right
+		return p, 1 + n1 + n2, nil
+	}
+	return nil, 0, ErrInvalidPredicate
+}
+
+func EncodeWitness(items [][]byte) []byte {
+	buf := []byte{}
+	for _, item := range items {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(item)))
+		buf = append(buf, item...)
+	}
+	return buf
+}
+
+func DecodeWitness(buf []byte) ([][]byte, error) {
+	if MAX_WITNESS_SIZE < len(buf) {
+		return nil, fmt.Errorf("Witness too large.")
+	}
+	items := [][]byte{}
+	for len(buf) > 0 {
+		if len(buf) < 2 {
+			return nil, fmt.Errorf("Witness item length truncated.")
+		}
+		size := int(binary.BigEndian.Uint16(buf))
+		if len(buf) < 2+size {
+			return nil, fmt.Errorf("Witness item truncated.")
+		}
+		items = append(items, buf[2:2+size])
+		buf = buf[2+size:]
+	}
+	return items, nil
+}
+
+// Checks the predicate of a transaction spending from a predicate address, in a block at the given height.
+func VerifyPredicate(tx RawTransaction, height uint64) error {
+	if !IsPredicateAddress(tx.FromPubkey) || tx.Version < 2 {
+		if len(tx.Predicate) != 0 || len(tx.Witness) != 0 {
+			return ErrUnexpectedPredicate
+		}
+		if IsPredicateAddress(tx.FromPubkey) {
+			return ErrPredicateNotSatisfied
+		}
+		return nil
+	}
+	if PredicateAddress(tx.Predicate) != tx.FromPubkey {
+		return ErrPredicateMismatch
+	}
+	p, err := ParsePredicate(tx.Predicate)
+	if err != nil {
+		return err
+	}
+	items, err := DecodeWitness(tx.Witness)
+	if err != nil {
+		return ErrPredicateNotSatisfied
+	}
+
+	e := predicateEvaluator{
+		items:    items,
+		envelope: tx.Envelope(),
+		height:   height,
+	}
+	if !e.eval(p) || len(e.items) != 0 {
+		return ErrPredicateNotSatisfied
+	}
+	return nil
+}
+
+type predicateEvaluator struct {
+	// The remaining witness items.
+	items    [][]byte
+	envelope []byte
+	height   uint64
+}
+
+func (e *predicateEvaluator) next() ([]byte, bool) {
+	if len(e.items) == 0 {
+		return nil, false
+	}
+	item := e.items[0]
+	e.items = e.items[1:]
+	return item, true
+}
+
+func (e *predicateEvaluator) verifySig(pubkey [65]byte, sig []byte) bool {
+	return len(sig) == 64 && core.VerifySignature(hex.EncodeToString(pubkey[:]), sig, e.envelope)
+}
+
+func (e *predicateEvaluator) eval(p *Predicate) bool {
+	switch p.Type {
+	case PREDICATE_SIG:
+		sig, ok := e.next()
+		return ok && e.verifySig(p.Pubkeys[0], sig)
+
+	case PREDICATE_MULTISIG:
+		signed := 0
+		for _, pubkey := range p.Pubkeys {
+			sig, ok := e.next()
+			if !ok {
+				return false
+			}
+			if len(sig) == 0 {
+				continue
+			}
+			if !e.verifySig(pubkey, sig) {
+				return false
+			}
+			signed++
+		}
+		return int(p.M) <= signed
+
+	case PREDICATE_AFTER:
+		return p.Height <= e.height
+
+	case PREDICATE_HASH:
+		preimage, ok := e.next()
+		return ok && len(preimage) <= MAX_HASH_PREIMAGE_SIZE && sha256.Sum256(preimage) == p.Hash
+
+	case PREDICATE_AND:
+		return e.eval(p.Left) && e.eval(p.Right)
+
+	case PREDICATE_OR:
+		selector, ok := e.next()
+		if !ok || len(selector) != 1 {
+			return false
+		}
+		switch selector[0] {
+		case 0:
+			return e.eval(p.Left)
+		case 1:
+			return e.eval(p.Right)
+		}
+	}
+	return false
+}
+
+// Makes an unsigned transaction spending coins locked by a predicate. The witness must be added before it is sent.
+func MakePredicateSpendTx(p *Predicate, to [65]byte, amount uint64, fee uint64) RawTransaction {
+	return RawTransaction{
+		Version:    2,
+		FromPubkey: p.Address(),
+		ToPubkey:   to,
+		Amount:     amount,
+		Fee:        fee,
+		Predicate:  p.Bytes(),
+	}
+}
@@ -0,0 +1,199 @@
+package nakamoto
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func signEnvelope(t *testing.T, wallet *core.Wallet, tx RawTransaction) []byte {
+	sig, err := wallet.Sign(tx.Envelope())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestPredicateEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	a, b := wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes()
+	p := OrPredicate(
+		AndPredicate(HashPredicate(sha256.Sum256([]byte("secret"))), SigPredicate(a)),
+		AndPredicate(AfterPredicate(100), MultisigPredicate(1, [][65]byte{a, b})),
+	)
+
+	parsed, err := ParsePredicate(p.Bytes())
+	assert.Nil(err)
+	assert.Equal(p, parsed)
+	assert.True(IsPredicateAddress(p.Address()))
+	assert.False(IsPredicateAddress(a))
+
+	// Trailing bytes, truncated arguments and unknown types are invalid.
+	_, err = ParsePredicate(append(p.Bytes(), 0))
+	assert.Equal(ErrInvalidPredicate, err)
+	_, err = ParsePredicate(p.Bytes()[:10])
+	assert.Equal(ErrInvalidPredicate, err)
+	_, err = ParsePredicate([]byte{0xff})
+	assert.Equal(ErrInvalidPredicate, err)
+
+	// Multisig needs 1 <= m <= n.
+	_, err = ParsePredicate(MultisigPredicate(3, [][65]byte{a, b}).Bytes())
+	assert.Equal(ErrInvalidPredicate, err)
+	_, err = ParsePredicate(MultisigPredicate(0, [][65]byte{a, b}).Bytes())
+	assert.Equal(ErrInvalidPredicate, err)
+
+	// Predicates can't be nested too deep.
+	deep := AfterPredicate(1)
+	for i := 0; i < MAX_PREDICATE_DEPTH+1; i++ {
+		deep = AndPredicate(deep, AfterPredicate(1))
+	}
+	_, err = ParsePredicate(deep.Bytes())
+	assert.Equal(ErrInvalidPredicate, err)
+
+	items, err := DecodeWitness(EncodeWitness([][]byte{{1, 2}, {}, {3}}))
+	assert.Nil(err)
+	assert.Equal([][]byte{{1, 2}, {}, {3}}, items)
+	_, err = DecodeWitness([]byte{0, 5, 1})
+	assert.NotNil(err)
+}
+
+func TestVerifyPredicate(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	a, b := wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes()
+	to := [65]byte{9}
+
+	// Single sig.
+	tx := MakePredicateSpendTx(SigPredicate(a), to, 100, 0)
+	assert.Equal(ErrPredicateNotSatisfied, VerifyPredicate(tx, 0))
+	tx.Witness = EncodeWitness([][]byte{signEnvelope(t, &wallets[1], tx)})
+	assert.Equal(ErrPredicateNotSatisfied, VerifyPredicate(tx, 0))
+	tx.Witness = EncodeWitness([][]byte{signEnvelope(t, &wallets[0], tx)})
+	assert.Nil(VerifyPredicate(tx, 0))
+
+	// The signature commits to the transaction.
+	tampered := tx
+	tampered.Amount = 200
+	assert.Equal(ErrPredicateNotSatisfied, VerifyPredicate(tampered, 0))
+
+	// Every witness item must be consumed.
+	tampered = tx
+	tampered.Witness = EncodeWitness([][]byte{signEnvelope(t, &wallets[0], tx), {}})
+	assert.Equal(ErrPredicateNotSatisfied, VerifyPredicate(tampered, 0))
+
+	// The predicate must match the address.
+	tampered = tx
+	tampered.FromPubkey = SigPredicate(b).Address()
+	assert.Equal(ErrPredicateMismatch, VerifyPredicate(tampered, 0))
+
+	// Version 1 transactions can't spend from a predicate address, or carry a predicate.
+	tampered = tx
+	tampered.Version = 1
+	assert.Equal(ErrUnexpectedPredicate, VerifyPredicate(tampered, 0))
+	tampered.Predicate, tampered.Witness = nil, nil
+	assert.Equal(ErrPredicateNotSatisfied, VerifyPredicate(tampered, 0))
+	assert.Equal(ErrUnexpectedPredicate, VerifyPredicate(RawTransaction{Version: 2, FromPubkey: a, Witness: []byte{0, 0}}, 0))
+	assert.Nil(VerifyPredicate(MakeTransferTx(a, b, 1, &wallets[0], 0), 0))
+
+	// 2-of-2 multisig.
+	tx = MakePredicateSpendTx(MultisigPredicate(2, [][65]byte{a, b}), to, 100, 0)
+	tx.Witness = EncodeWitness([][]byte{signEnvelope(t, &wallets[0], tx), {}})
+	assert.Equal(ErrPredicateNotSatisfied, VerifyPredicate(tx, 0))
+	tx.Witness = EncodeWitness([][]byte{signEnvelope(t, &wallets[0], tx), signEnvelope(t, &wallets[1], tx)})
+	assert.Nil(VerifyPredicate(tx, 0))
+
+	// Timelock.
+	tx = MakePredicateSpendTx(AfterPredicate(10), to, 100, 0)
+	assert.Equal(ErrPredicateNotSatisfied, VerifyPredicate(tx, 9))
+	assert.Nil(VerifyPredicate(tx, 10))
+
+	// Hash preimage.
+	tx = MakePredicateSpendTx(HashPredicate(sha256.Sum256([]byte("secret"))), to, 100, 0)
+	tx.Witness = EncodeWitness([][]byte{[]byte("guess")})
+	assert.Equal(ErrPredicateNotSatisfied, VerifyPredicate(tx, 0))
+	tx.Witness = EncodeWitness([][]byte{[]byte("secret")})
+	assert.Nil(VerifyPredicate(tx, 0))
+
+	// Escrow: released by a with the preimage, or refunded to b after a timeout.
+	p := OrPredicate(
+		AndPredicate(HashPredicate(sha256.Sum256([]byte("secret"))), SigPredicate(a)),
+		AndPredicate(AfterPredicate(100), SigPredicate(b)),
+	)
+	tx = MakePredicateSpendTx(p, to, 100, 0)
+	tx.Witness = EncodeWitness([][]byte{{0}, []byte("secret"), signEnvelope(t, &wallets[0], tx)})
+	assert.Nil(VerifyPredicate(tx, 0))
+	tx.Witness = EncodeWitness([][]byte{{1}, signEnvelope(t, &wallets[1], tx)})
+	assert.Equal(ErrPredicateNotSatisfied, VerifyPredicate(tx, 99))
+	assert.Nil(VerifyPredicate(tx, 100))
+	tx.Witness = EncodeWitness([][]byte{{2}, signEnvelope(t, &wallets[1], tx)})
+	assert.Equal(ErrPredicateNotSatisfied, VerifyPredicate(tx, 100))
+}
+
+func TestDagPredicateTx(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := OpenDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	genesisDifficulty := new(big.Int)
+	genesisDifficulty.SetString("0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+	conf := ConsensusConfig{
+		EpochLengthBlocks:       5,
+		TargetEpochLengthMillis: 2000,
+		GenesisDifficulty:       *genesisDifficulty,
+		GenesisParentBlockHash:  HexStringToBytes32("000006b15d1327d67e971d1de9116bd60a3a01556c91b6ebaa416ebc0cfaa646"),
+		MaxBlockSizeBytes:       2 * 1024 * 1024,
+		Forks:                   map[string]uint64{FORK_PREDICATES: 1},
+	}
+	dag, err := NewBlockDAGFromDB(db, newMockStateMachine(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wallets := getTestingWallets(t)
+	spend := MakePredicateSpendTx(MultisigPredicate(1, [][65]byte{wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes()}), [65]byte{9}, 100, 0)
+	spend.Witness = EncodeWitness([][]byte{{}, signEnvelope(t, &wallets[1], spend)})
+
+	newBlock := func(txs ...RawTransaction) RawBlock {
+		txs = append([]RawTransaction{MakeCoinbaseTx(&wallets[0])}, txs...)
+		envelopes := [][]byte{}
+		for _, tx := range txs {
+			envelopes = append(envelopes, tx.Envelope())
+		}
+		b := RawBlock{
+			BlockHeader: BlockHeader{
+				ParentHash:             dag.FullTip.Hash,
+				ParentTotalWork:        BigIntToBytes32(dag.FullTip.AccumulatedWork),
+				Timestamp:              Timestamp(),
+				NumTransactions:        uint64(len(txs)),
+				TransactionsMerkleRoot: core.ComputeMerkleHash(envelopes),
+			},
+			Transactions: txs,
+		}
+		solution, err := SolvePOW(b, *big.NewInt(0), conf.GenesisDifficulty, 1000000000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.SetNonce(solution)
+		return b
+	}
+
+	// An invalid witness is rejected.
+	invalid := spend
+	invalid.Witness = EncodeWitness([][]byte{{}, {}})
+	assert.EqualError(dag.IngestBlock(newBlock(invalid)), "Transaction 1 is invalid: predicate not satisfied.")
+
+	assert.Nil(dag.IngestBlock(newBlock(spend)))
+	txs, err := dag.GetBlockTransactions(dag.FullTip.Hash)
+	assert.Nil(err)
+	assert.Equal(spend, (*txs)[1].ToRawTransaction())
+}
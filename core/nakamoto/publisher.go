@@ -0,0 +1,207 @@
+package nakamoto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// The publisher streams notifications of new blocks and transactions to subscribers over TCP, in the style of Bitcoin
+// Core's ZMQ interface, so that indexers, explorers and wallets can follow the node without polling.
+//
+// Subscribers connect to the publisher's address and receive every notification for the enabled topics:
+//   - rawblock: the raw bytes (RawBlock.Bytes) of each block connected to the main chain, including during a reorg.
+//   - rawtx: the raw bytes (RawTransaction.Bytes) of each transaction added to the mempool.
+//   - hashtip: the 32-byte hash of the new main chain tip.
+//   - hashfinalized: the 32-byte hash of each newly finalized block, in order. See finality.go.
+//   - event: each event appended to the event journal, as JSON (RPCChainEvent). Subscribers resume from the sequence
+//     number of the last event they processed with the getevents RPC method. See event_journal.go.
+//
+// Each notification is a message of three frames: the topic, the body, and a 4-byte little-endian sequence number,
+// which is incremented per topic and lets subscribers detect dropped messages. Each frame is prefixed by its length as a
+// 4-byte big-endian integer. Subscribers which can't keep up have notifications dropped, rather than slowing the node.
+const (
+	PUB_TOPIC_RAWBLOCK = "rawblock"
+	PUB_TOPIC_RAWTX    = "rawtx"
+	PUB_TOPIC_HASHTIP  = "hashtip"
+
+	PUB_TOPIC_HASHFINALIZED = "hashfinalized"
+	PUB_TOPIC_EVENT         = "event"
+
+	// The number of notifications buffered per subscriber before they are dropped.
+	PUB_SUBSCRIBER_BUFFER = 1000
+	// The maximum size of a frame read by ReadPubMessage.
+	PUB_MAX_FRAME_SIZE = MAX_MESSAGE_SIZE
+)
+
+var PUB_TOPICS = []string{PUB_TOPIC_RAWBLOCK, PUB_TOPIC_RAWTX, PUB_TOPIC_HASHTIP, PUB_TOPIC_HASHFINALIZED, PUB_TOPIC_EVENT}
+
+type Publisher struct {
+	address  string
+	topics   map[string]bool
+	listener net.Listener
+
+	subscribers map[net.Conn]chan []byte
+	sequences   map[string]uint32
+	mutex       sync.Mutex
+	log         *log.Logger
+}
+
+func NewPublisher(address string, topics []string) (*Publisher, error) {
+	p := &Publisher{
+		address:     address,
+		topics:      make(map[string]bool),
+		subscribers: make(map[net.Conn]chan []byte),
+		sequences:   make(map[string]uint32),
+		log:         NewLogger("publisher", address),
+	}
+	for _, topic := range topics {
+		known := false
+		for _, t := range PUB_TOPICS {
+			known = known || t == topic
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown topic: %s", topic)
+		}
+		p.topics[topic] = true
+	}
+	return p, nil
+}
+
+// Listens for subscribers. Returns once the publisher is listening.
+func (p *Publisher) Listen() error {
+	listener, err := net.Listen("tcp", p.address)
+	if err != nil {
+		return err
+	}
+	p.listener = listener
+	p.log.Printf("Publishing %v on tcp://%s\n", p.Topics(), listener.Addr())
+	go p.acceptRoutine()
+	return nil
+}
+
+// Returns the address the publisher is listening on.
+func (p *Publisher) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+// Returns the enabled topics.
+func (p *Publisher) Topics() []string {
+	topics := []string{}
+	for _, topic := range PUB_TOPICS {
+		if p.topics[topic] {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// Returns the number of connected subscribers.
+func (p *Publisher) NumSubscribers() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.subscribers)
+}
+
+func (p *Publisher) Stop() {
+	if p.listener != nil {
+		p.listener.Close()
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for conn, ch := range p.subscribers {
+		close(ch)
+		delete(p.subscribers, conn)
+	}
+}
+
+func (p *Publisher) acceptRoutine() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		p.log.Printf("Subscriber connected: %s\n", conn.RemoteAddr())
+
+		ch := make(chan []byte, PUB_SUBSCRIBER_BUFFER)
+		p.mutex.Lock()
+		p.subscribers[conn] = ch
+		p.mutex.Unlock()
+		go p.subscriberRoutine(conn, ch)
+	}
+}
+
+func (p *Publisher) subscriberRoutine(conn net.Conn, ch chan []byte) {
+	defer conn.Close()
+	for msg := range ch {
+		if _, err := conn.Write(msg); err != nil {
+			p.log.Printf("Subscriber disconnected: %s\n", conn.RemoteAddr())
+			p.mutex.Lock()
+			if _, ok := p.subscribers[conn]; ok {
+				delete(p.subscribers, conn)
+				close(ch)
+			}
+			p.mutex.Unlock()
+			// Drain, so the channel can be collected.
+			for range ch {
+			}
+			return
+		}
+	}
+}
+
+// Publishes a notification to all subscribers, if the topic is enabled.
+func (p *Publisher) Publish(topic string, body []byte) {
+	if !p.topics[topic] {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	seq := p.sequences[topic]
+	p.sequences[topic] = seq + 1
+	seqBuf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seqBuf, seq)
+
+	msg := []byte{}
+	for _, frame := range [][]byte{[]byte(topic), body, seqBuf} {
+		msg = binary.BigEndian.AppendUint32(msg, uint32(len(frame)))
+		msg = append(msg, frame...)
+	}
+
+	for conn, ch := range p.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			p.log.Printf("Subscriber %s is too slow, dropped %s notification %d\n", conn.RemoteAddr(), topic, seq)
+		}
+	}
+}
+
+// Reads a notification sent by a publisher.
+func ReadPubMessage(r io.Reader) (topic string, body []byte, seq uint32, err error) {
+	frames := make([][]byte, 3)
+	for i := range frames {
+		lenBuf := make([]byte, 4)
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			return "", nil, 0, err
+		}
+		size := binary.BigEndian.Uint32(lenBuf)
+		if PUB_MAX_FRAME_SIZE < size {
+			return "", nil, 0, fmt.Errorf("Frame too large: %d bytes", size)
+		}
+		frames[i] = make([]byte, size)
+		if _, err := io.ReadFull(r, frames[i]); err != nil {
+			return "", nil, 0, err
+		}
+	}
+	if len(frames[2]) != 4 {
+		return "", nil, 0, fmt.Errorf("Invalid sequence number.")
+	}
+	return string(frames[0]), frames[1], binary.LittleEndian.Uint32(frames[2]), nil
+}
@@ -0,0 +1,89 @@
+package nakamoto
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublisher(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewPublisher("127.0.0.1:0", []string{"rawblock", "sequence"})
+	assert.NotNil(err)
+
+	publisher, err := NewPublisher("127.0.0.1:0", []string{PUB_TOPIC_RAWTX, PUB_TOPIC_HASHTIP})
+	if err != nil {
+		t.Fatalf("Failed to create publisher: %s", err)
+	}
+	if err := publisher.Listen(); err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer publisher.Stop()
+	assert.Equal([]string{PUB_TOPIC_RAWTX, PUB_TOPIC_HASHTIP}, publisher.Topics())
+
+	conn, err := net.Dial("tcp", publisher.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer conn.Close()
+	for publisher.NumSubscribers() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tx, err := newValidTx(t)
+	if err != nil {
+		t.Fatalf("Failed to create tx: %s", err)
+	}
+	tip := [32]byte{0xab}
+	publisher.Publish(PUB_TOPIC_RAWTX, tx.Bytes())
+	// Disabled topics aren't published.
+	publisher.Publish(PUB_TOPIC_RAWBLOCK, []byte("block"))
+	publisher.Publish(PUB_TOPIC_HASHTIP, tip[:])
+	publisher.Publish(PUB_TOPIC_RAWTX, tx.Bytes())
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	topic, body, seq, err := ReadPubMessage(conn)
+	assert.Nil(err)
+	assert.Equal(PUB_TOPIC_RAWTX, topic)
+	assert.Equal(tx.Bytes(), body)
+	assert.Equal(uint32(0), seq)
+
+	topic, body, seq, err = ReadPubMessage(conn)
+	assert.Nil(err)
+	assert.Equal(PUB_TOPIC_HASHTIP, topic)
+	assert.Equal(tip[:], body)
+	assert.Equal(uint32(0), seq)
+
+	// Sequence numbers are per topic.
+	topic, _, seq, err = ReadPubMessage(conn)
+	assert.Nil(err)
+	assert.Equal(PUB_TOPIC_RAWTX, topic)
+	assert.Equal(uint32(1), seq)
+
+	// Disconnected subscribers are removed.
+	conn.Close()
+	for i := 0; i < 100 && publisher.NumSubscribers() != 0; i++ {
+		publisher.Publish(PUB_TOPIC_HASHTIP, tip[:])
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(0, publisher.NumSubscribers())
+}
+
+func TestMempoolOnNewTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	mempool := NewMempool()
+	notified := 0
+	mempool.OnNewTransaction = func(tx *Transaction) {
+		notified++
+	}
+
+	raw := RawTransaction{Version: 1, Amount: DEFAULT_DUST_THRESHOLD, Fee: 1000}
+	tx := raw.ToTransaction()
+	assert.Nil(mempool.AddTransaction(&tx))
+	assert.Nil(mempool.AddTransaction(&tx))
+	assert.Equal(1, notified)
+}
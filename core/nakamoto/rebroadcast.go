@@ -0,0 +1,100 @@
+package nakamoto
+
+import (
+	"sync"
+	"time"
+)
+
+// The rebroadcaster periodically rebroadcasts the node's own unconfirmed transactions until they are included in the
+// main chain. This ensures a transaction isn't silently lost when the initial gossip round happens during a network
+// partition, or when peers drop it from their mempools.
+//
+// Each transaction is rebroadcast with exponential backoff, starting at InitialInterval and doubling up to MaxInterval.
+type Rebroadcaster struct {
+	// Pending transactions, keyed by transaction hash.
+	txs map[[32]byte]*rebroadcastEntry
+
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+
+	// Checks whether a transaction is confirmed. Confirmed transactions are no longer rebroadcast.
+	IsConfirmed func(txhash [32]byte) (bool, error)
+	// Broadcasts a transaction to the network.
+	Broadcast func(tx RawTransaction)
+
+	mutex sync.Mutex
+}
+
+type rebroadcastEntry struct {
+	tx       RawTransaction
+	attempts int
+	nextAt   time.Time
+}
+
+func NewRebroadcaster() *Rebroadcaster {
+	return &Rebroadcaster{
+		txs:             make(map[[32]byte]*rebroadcastEntry),
+		InitialInterval: 1 * time.Minute,
+		MaxInterval:     30 * time.Minute,
+	}
+}
+
+// Tracks a transaction for rebroadcast. The transaction should already have been broadcast once.
+func (r *Rebroadcaster) Track(tx RawTransaction) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.txs[tx.Hash()] = &rebroadcastEntry{
+		tx:     tx,
+		nextAt: time.Now().Add(r.InitialInterval),
+	}
+}
+
+// Returns the number of transactions pending rebroadcast.
+func (r *Rebroadcaster) NumPending() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.txs)
+}
+
+func (r *Rebroadcaster) Start() {
+	for {
+		time.Sleep(r.InitialInterval / 4)
+		r.Tick(time.Now())
+	}
+}
+
+// Removes confirmed transactions, and rebroadcasts the transactions which are due. Returns the number rebroadcast.
+func (r *Rebroadcaster) Tick(now time.Time) int {
+	r.mutex.Lock()
+	due := []RawTransaction{}
+	for hash, entry := range r.txs {
+		if r.IsConfirmed != nil {
+			confirmed, err := r.IsConfirmed(hash)
+			if err == nil && confirmed {
+				delete(r.txs, hash)
+				continue
+			}
+		}
+		if now.Before(entry.nextAt) {
+			continue
+		}
+
+		// Backoff.
+		entry.attempts++
+		interval := r.InitialInterval << entry.attempts
+		if interval <= 0 || r.MaxInterval < interval {
+			interval = r.MaxInterval
+		}
+		entry.nextAt = now.Add(interval)
+		due = append(due, entry.tx)
+	}
+	r.mutex.Unlock()
+
+	if r.Broadcast != nil {
+		for _, tx := range due {
+			r.Broadcast(tx)
+		}
+	}
+	return len(due)
+}
@@ -0,0 +1,46 @@
+package nakamoto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebroadcasterBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	r := NewRebroadcaster()
+	r.InitialInterval = time.Minute
+	r.MaxInterval = 5 * time.Minute
+
+	confirmed := false
+	r.IsConfirmed = func(txhash [32]byte) (bool, error) {
+		return confirmed, nil
+	}
+	broadcasts := 0
+	r.Broadcast = func(tx RawTransaction) {
+		broadcasts++
+	}
+
+	r.Track(RawTransaction{Nonce: 1})
+	now := time.Now()
+
+	// Not due yet.
+	assert.Equal(0, r.Tick(now))
+
+	// Due after the initial interval, then backs off: 2m, 4m, 5m (max), 5m.
+	assert.Equal(1, r.Tick(now.Add(1*time.Minute)))
+	assert.Equal(0, r.Tick(now.Add(2*time.Minute)))
+	assert.Equal(1, r.Tick(now.Add(3*time.Minute)))
+	assert.Equal(0, r.Tick(now.Add(6*time.Minute)))
+	assert.Equal(1, r.Tick(now.Add(7*time.Minute)))
+	assert.Equal(1, r.Tick(now.Add(12*time.Minute)))
+	assert.Equal(1, r.Tick(now.Add(17*time.Minute)))
+	assert.Equal(5, broadcasts)
+
+	// Confirmed transactions are no longer tracked.
+	confirmed = true
+	assert.Equal(0, r.Tick(now.Add(time.Hour)))
+	assert.Equal(0, r.NumPending())
+}
@@ -0,0 +1,225 @@
+package nakamoto
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// A receipt records the outcome of executing a transaction on the main chain, so applications can tell a transaction
+// which was included but failed (ie. overspent its balance) from one which succeeded.
+//
+// A node verifies the blocks it ingests against their parent's state (see BlockDAG.VerifyBlockState), so the transactions
+// of its main chain execute. Without a verifier, such as in a DAG used on its own, blocks are only checked statelessly
+// (see StateMachineInterface.VerifyTx), so a block on the main chain may include transactions which fail when executed.
+// A failed transaction has no effect on the state, and pays no fee. Receipts are keyed by block, so a transaction included in blocks on several forks has a receipt for each,
+// and GetTransactionReceipt returns the one on the main chain.
+
+const (
+	RECEIPT_STATUS_FAILED  = 0
+	RECEIPT_STATUS_SUCCESS = 1
+)
+
+type Receipt struct {
+	TxHash    [32]byte `json:"tx_hash"`
+	BlockHash [32]byte `json:"block_hash"`
+	TxIndex   uint64   `json:"txindex"`
+	Status    uint8    `json:"status"`
+	// The state machine error, if the transaction failed.
+	Error   string         `json:"error"`
+	FeePaid uint64         `json:"fee_paid"`
+	Deltas  []BalanceDelta `json:"deltas"`
+}
+
+// The change in an account's balance of the native coin, or of a token.
+type BalanceDelta struct {
+	Account [65]byte `json:"account"`
+	Token   string   `json:"token,omitempty"`
+	Before  uint64   `json:"before"`
+	After   uint64   `json:"after"`
+}
+
+// Executes the transactions of a block, returning a receipt for each. Unlike ExecuteBlock, a failed transaction is
+// skipped rather than failing the block. Only a failed coinbase fails the block, leaving the state unchanged.
+func (c *StateMachine) ExecuteBlockWithReceipts(block Block) ([]Receipt, error) {
+	receipts := []Receipt{}
+	var minerPubkey [65]byte
+	for i, tx := range block.Transactions {
+		if i == 0 {
+			minerPubkey = tx.FromPubkey
+		}
+		receipt := Receipt{
+			TxHash:    tx.Hash(),
+			BlockHash: block.Hash,
+			TxIndex:   uint64(i),
+			Deltas:    []BalanceDelta{},
+		}
+
+		effects, err := c.Transition(StateMachineInput{
+			RawTransaction: tx,
+			IsCoinbase:     i == 0,
+			MinerPubkey:    minerPubkey,
+			BlockHeight:    block.Height,
+			BaseFee:        block.BaseFee,
+		})
+		if err != nil && i == 0 {
+			return nil, fmt.Errorf("Error transitioning state machine: block=%x txindex=%d error=\"%s\"", block.Hash, i, err)
+		}
+		if err != nil {
+			receipt.Status = RECEIPT_STATUS_FAILED
+			receipt.Error = err.Error()
+			receipts = append(receipts, receipt)
+			continue
+		}
+
+		// Record the balances of the accounts touched, before and after.
+		for _, leaf := range effects {
+			delta := BalanceDelta{Account: leaf.PubKey, Token: leaf.Token}
+			if !containsDelta(receipt.Deltas, delta) {
+				delta.Before = c.getLeafBalance(delta)
+				receipt.Deltas = append(receipt.Deltas, delta)
+			}
+		}
+		c.Apply(effects)
+		deltas := []BalanceDelta{}
+		for _, delta := range receipt.Deltas {
+			delta.After = c.getLeafBalance(delta)
+			if delta.Before != delta.After {
+				deltas = append(deltas, delta)
+			}
+		}
+
+		receipt.Status = RECEIPT_STATUS_SUCCESS
+		receipt.Deltas = deltas
+		if i != 0 {
+			receipt.FeePaid = tx.Fee
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, nil
+}
+
+func containsDelta(deltas []BalanceDelta, delta BalanceDelta) bool {
+	for _, d := range deltas {
+		if d.Account == delta.Account && d.Token == delta.Token {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *StateMachine) getLeafBalance(delta BalanceDelta) uint64 {
+	if delta.Token != "" {
+		return c.GetTokenBalance(delta.Token, delta.Account)
+	}
+	return c.GetBalance(delta.Account)
+}
+
+// Given a block DAG and a list of block hashes, applies each block's transactions in order, and returns the final state
+// along with the receipts of the transactions.
+func RebuildStateWithReceipts(dag *BlockDAG, stateMachine StateMachine, longestChainHashList [][32]byte) (*StateMachine, []Receipt, error) {
+	receipts := []Receipt{}
+	for _, blockHash := range longestChainHashList {
+		block, err := dag.GetBlockByHash(blockHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if block == nil {
+			return nil, nil, fmt.Errorf("Block not found: %x", blockHash)
+		}
+		txs, err := dag.GetBlockTransactions(blockHash)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		block.Transactions = []RawTransaction{}
+		for _, tx := range *txs {
+			block.Transactions = append(block.Transactions, tx.ToRawTransaction())
+		}
+		blockReceipts, err := stateMachine.ExecuteBlockWithReceipts(*block)
+		if err != nil {
+			return nil, nil, err
+		}
+		receipts = append(receipts, blockReceipts...)
+	}
+	return &stateMachine, receipts, nil
+}
+
+// Stores receipts. A block's receipts never change, since they only depend on the chain up to the block, so receipts
+// which are already stored are skipped.
+func (dag *BlockDAG) SaveReceipts(receipts []Receipt) error {
+	tx, err := dag.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, receipt := range receipts {
+		deltas, err := json.Marshal(receipt.Deltas)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(
+			"insert or ignore into receipts (block_hash, txindex, tx_hash, status, error, fee_paid, deltas) values (?, ?, ?, ?, ?, ?, ?)",
+			receipt.BlockHash[:],
+			receipt.TxIndex,
+			receipt.TxHash[:],
+			receipt.Status,
+			receipt.Error,
+			receipt.FeePaid,
+			string(deltas),
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Returns the receipt of a transaction in a block on the main chain, or nil if there is none. If the transaction was
+// included more than once (ie. identical coinbases), the latest receipt is returned.
+func (dag *BlockDAG) GetTransactionReceipt(txhash [32]byte) (*Receipt, error) {
+	// Find the lowest block with a receipt for the transaction, to bound the walk back from the tip.
+	var minHeight sql.NullInt64
+	err := dag.db.QueryRow(
+		`select min(b.height) from receipts r join blocks b on r.block_hash = b.hash where r.tx_hash = ?`,
+		txhash[:],
+	).Scan(&minHeight)
+	if err != nil {
+		return nil, err
+	}
+	if !minHeight.Valid {
+		return nil, nil
+	}
+
+	rows, err := dag.db.Query(`
+		with recursive chain(hash, parent_hash, height) as (
+			select hash, parent_hash, height from blocks where hash = ?
+			union all
+			select b.hash, b.parent_hash, b.height from blocks b join chain c on b.hash = c.parent_hash where ? < c.height
+		)
+		select r.block_hash, r.txindex, r.status, r.error, r.fee_paid, r.deltas from receipts r join chain c on r.block_hash = c.hash where r.tx_hash = ? order by c.height desc limit 1`,
+		dag.FullTip.Hash[:],
+		minHeight.Int64,
+		txhash[:],
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	receipt := Receipt{TxHash: txhash}
+	blockHash := []byte{}
+	deltas := ""
+	if err := rows.Scan(&blockHash, &receipt.TxIndex, &receipt.Status, &receipt.Error, &receipt.FeePaid, &deltas); err != nil {
+		return nil, err
+	}
+	copy(receipt.BlockHash[:], blockHash)
+	if err := json.Unmarshal([]byte(deltas), &receipt.Deltas); err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
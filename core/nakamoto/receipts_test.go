@@ -0,0 +1,112 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateMachineReceipts(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	sender := wallets[0].PubkeyBytes()
+	recipient := wallets[1].PubkeyBytes()
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	miner := minerWallet.PubkeyBytes()
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.Forks = map[string]uint64{FORK_FEE_DEDUCTION: 0}
+	stateMachine.Apply([]*StateLeaf{{PubKey: sender, Balance: 100}})
+
+	// The second transfer overspends, so it fails, but the block doesn't.
+	coinbase := MakeCoinbaseTx(minerWallet)
+	transfer := MakeTransferTx(sender, recipient, 60, &wallets[0], 5)
+	overspend := MakeTransferTx(sender, recipient, 50, &wallets[0], 0)
+	block := Block{
+		Hash:         [32]byte{1},
+		Height:       1,
+		Transactions: []RawTransaction{coinbase, transfer, overspend},
+	}
+	receipts, err := stateMachine.ExecuteBlockWithReceipts(block)
+	assert.Nil(err)
+	assert.Equal(3, len(receipts))
+
+	assert.Equal(uint8(RECEIPT_STATUS_SUCCESS), receipts[0].Status)
+	assert.Equal(uint64(0), receipts[0].FeePaid)
+	assert.Equal([]BalanceDelta{{Account: miner, Before: 0, After: coinbase.Amount}}, receipts[0].Deltas)
+
+	assert.Equal(Receipt{
+		TxHash:    transfer.Hash(),
+		BlockHash: [32]byte{1},
+		TxIndex:   1,
+		Status:    RECEIPT_STATUS_SUCCESS,
+		FeePaid:   5,
+		Deltas: []BalanceDelta{
+			{Account: sender, Before: 100, After: 35},
+			{Account: recipient, Before: 0, After: 60},
+			{Account: miner, Before: coinbase.Amount, After: coinbase.Amount + 5},
+		},
+	}, receipts[1])
+
+	assert.Equal(uint8(RECEIPT_STATUS_FAILED), receipts[2].Status)
+	assert.Equal(ErrInsufficientBalance.Error(), receipts[2].Error)
+	assert.Equal(uint64(0), receipts[2].FeePaid)
+	assert.Empty(receipts[2].Deltas)
+	assert.Equal(uint64(35), stateMachine.GetBalance(sender))
+
+	// A failed coinbase fails the block.
+	block.Transactions = []RawTransaction{{Version: 9}}
+	_, err = stateMachine.ExecuteBlockWithReceipts(block)
+	assert.NotNil(err)
+}
+
+func TestDagReceipts(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForStateMachine()
+	wallets := getTestingWallets(t)
+	miner := NewMiner(dag, &wallets[0])
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	miner.Start(3)
+
+	hashes, err := dag.GetLongestChainHashList(dag.FullTip.Hash, dag.FullTip.Height)
+	assert.Nil(err)
+	stateMachine, err := NewStateMachine(nil)
+	assert.Nil(err)
+	_, receipts, err := RebuildStateWithReceipts(&dag, *stateMachine, hashes)
+	assert.Nil(err)
+	assert.Nil(dag.SaveReceipts(receipts))
+
+	// The receipt of the tip's coinbase. The miner's coinbases are identical, so this is the latest of them.
+	tip := receipts[len(receipts)-1]
+	assert.Equal(dag.FullTip.Hash, tip.BlockHash)
+	receipt, err := dag.GetTransactionReceipt(tip.TxHash)
+	assert.Nil(err)
+	assert.Equal(tip, *receipt)
+
+	// Stored receipts aren't overwritten.
+	changed := tip
+	changed.Status = RECEIPT_STATUS_FAILED
+	assert.Nil(dag.SaveReceipts([]Receipt{changed}))
+	receipt, err = dag.GetTransactionReceipt(tip.TxHash)
+	assert.Nil(err)
+	assert.Equal(uint8(RECEIPT_STATUS_SUCCESS), receipt.Status)
+
+	// Receipts for blocks off the main chain aren't returned.
+	orphan := Receipt{TxHash: [32]byte{7}, BlockHash: [32]byte{8}, Deltas: []BalanceDelta{}}
+	assert.Nil(dag.SaveReceipts([]Receipt{orphan}))
+	receipt, err = dag.GetTransactionReceipt(orphan.TxHash)
+	assert.Nil(err)
+	assert.Nil(receipt)
+}
@@ -0,0 +1,159 @@
+package nakamoto
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The node refuses reorgs which would remove more than MaxReorgDepth blocks from the main chain, and holds the branch
+// in quarantine until an operator reviews it. On a small network, an attacker can cheaply mine a long private branch
+// and release it to rewrite the history services have acted on; the limit turns this into an alert for a human to
+// decide on, rather than an automatic reorg.
+//
+// Quarantined branches are stored in the database, identified by their first block after the fork point, and are
+// passed to OnReorgQuarantined when first seen (the node raises a fork alert). While quarantined, the tip is the
+// heaviest chain extending the current tip. An operator either releases the branch with ReleaseQuarantinedBranch,
+// which allows the reorg, or rejects it by invalidating its first block with InvalidateBlock.
+//
+// Unlike finality, which refuses reorgs of blocks below a fixed depth from the tip outright, the limit is a review
+// step. Both apply: a released branch which reorgs the finalized block also needs AllowDeepReorgs. A MaxReorgDepth of
+// zero disables the limit.
+
+type QuarantinedBranch struct {
+	// The first block of the branch after the fork point.
+	Hash [32]byte
+	// The block the branch forks from the main chain.
+	ForkPoint [32]byte
+	// The heaviest tip of the branch, when last checked.
+	Tip [32]byte
+	// The number of blocks the reorg would remove from the main chain, when last checked.
+	Depth     uint64
+	FirstSeen time.Time
+	// Whether an operator released the branch.
+	Released bool
+}
+
+// Returns the tip to use in place of the heaviest tip: the heaviest tip itself, unless switching to it would reorg more
+// than MaxReorgDepth blocks, in which case its branch is quarantined and the tip is the heaviest chain extending the
+// current tip.
+func (dag *BlockDAG) applyReorgLimit(heaviest Block, full bool) (Block, error) {
+	if dag.MaxReorgDepth == 0 {
+		return heaviest, nil
+	}
+	prevTip := dag.HeadersTip
+	if full {
+		prevTip = dag.FullTip
+	}
+	if prevTip.Hash == [32]byte{} || heaviest.Hash == prevTip.Hash || heaviest.ParentHash == prevTip.Hash {
+		return heaviest, nil
+	}
+	ancestor, err := dag.GetCommonAncestor(heaviest.Hash, prevTip.Hash)
+	if err != nil {
+		return Block{}, err
+	}
+	depth := prevTip.Height - ancestor.Height
+	if depth <= dag.MaxReorgDepth || ancestor.Hash == heaviest.Hash {
+		return heaviest, nil
+	}
+
+	// An operator invalidating the current tip overrides the limit.
+	invalid := false
+	if err := dag.db.QueryRow("select invalid from blocks where hash = ?", prevTip.Hash[:]).Scan(&invalid); err != nil {
+		return Block{}, err
+	}
+	if invalid {
+		return heaviest, nil
+	}
+
+	branch, err := dag.getChainSegment(heaviest.Hash, heaviest.Height-ancestor.Height)
+	if err != nil {
+		return Block{}, err
+	}
+	released, err := dag.quarantineBranch(QuarantinedBranch{
+		Hash:      branch[len(branch)-1].hash,
+		ForkPoint: ancestor.Hash,
+		Tip:       heaviest.Hash,
+		Depth:     depth,
+		FirstSeen: time.Now(),
+	})
+	if err != nil || released {
+		return heaviest, err
+	}
+
+	tip, err := dag.getHeaviestDescendant(prevTip.Hash, full)
+	if err != nil {
+		return Block{}, err
+	}
+	dag.log.Printf("Refusing reorg to height=%d hash=%s: depth %d exceeds the maximum reorg depth %d\n", heaviest.Height, heaviest.HashStr(), depth, dag.MaxReorgDepth)
+	return tip, nil
+}
+
+// Stores a quarantined branch, or updates its tip and depth if it's already stored. Returns whether the branch was
+// released.
+func (dag *BlockDAG) quarantineBranch(branch QuarantinedBranch) (bool, error) {
+	released := false
+	err := dag.db.QueryRow("select released from quarantined_branches where hash = ?", branch.Hash[:]).Scan(&released)
+	if err == nil {
+		_, err = dag.db.Exec("update quarantined_branches set tip_hash = ?, depth = ? where hash = ?", branch.Tip[:], branch.Depth, branch.Hash[:])
+		return released, err
+	}
+	if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	_, err = dag.db.Exec(
+		"insert into quarantined_branches (hash, fork_point_hash, tip_hash, depth, first_seen) values (?, ?, ?, ?, ?)",
+		branch.Hash[:],
+		branch.ForkPoint[:],
+		branch.Tip[:],
+		branch.Depth,
+		branch.FirstSeen.Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+	dag.log.Printf("WARNING: quarantined branch %x with a reorg of depth %d, above the maximum reorg depth %d\n", branch.Hash, branch.Depth, dag.MaxReorgDepth)
+	if dag.OnReorgQuarantined != nil {
+		dag.OnReorgQuarantined(branch)
+	}
+	return false, nil
+}
+
+// Gets the quarantined branches, newest first.
+func (dag *BlockDAG) GetQuarantinedBranches() ([]QuarantinedBranch, error) {
+	rows, err := dag.db.Query("select hash, fork_point_hash, tip_hash, depth, first_seen, released from quarantined_branches order by first_seen desc, rowid desc")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	branches := []QuarantinedBranch{}
+	for rows.Next() {
+		branch := QuarantinedBranch{}
+		hash, forkPoint, tip := []byte{}, []byte{}, []byte{}
+		firstSeen := int64(0)
+		if err := rows.Scan(&hash, &forkPoint, &tip, &branch.Depth, &firstSeen, &branch.Released); err != nil {
+			return nil, err
+		}
+		copy(branch.Hash[:], hash)
+		copy(branch.ForkPoint[:], forkPoint)
+		copy(branch.Tip[:], tip)
+		branch.FirstSeen = time.Unix(firstSeen, 0)
+		branches = append(branches, branch)
+	}
+	return branches, rows.Err()
+}
+
+// Releases a quarantined branch, allowing the reorg to it, after an operator has reviewed it.
+func (dag *BlockDAG) ReleaseQuarantinedBranch(hash [32]byte) error {
+	res, err := dag.db.Exec("update quarantined_branches set released = 1 where hash = ?", hash[:])
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("Quarantined branch not found.")
+	}
+	dag.log.Printf("Released quarantined branch %x\n", hash)
+	return dag.updateTip()
+}
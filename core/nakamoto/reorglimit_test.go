@@ -0,0 +1,83 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxReorgDepth(t *testing.T) {
+	assert := assert.New(t)
+	dag, _, _ := newBlockdagLongEpoch()
+	dag.FinalityDepth = 0
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	hashes := [][32]byte{dag.FullTip.Hash}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+
+	// Mine a main chain of 8 blocks, and a heavier branch forking from block 1, which is set aside. Switching to the
+	// branch reorgs 7 blocks.
+	miner.Start(8)
+	mainTip := dag.FullTip
+	assert.Nil(dag.InvalidateBlock(hashes[2]))
+	miner.Start(8)
+	for dag.FullTip.AccumulatedWork.Cmp(&mainTip.AccumulatedWork) <= 0 {
+		miner.Start(1)
+	}
+	branchTip := dag.FullTip
+	assert.Nil(dag.InvalidateBlock(hashes[9]))
+	assert.Nil(dag.ReconsiderBlock(hashes[2]))
+	assert.Equal(hashes[8], dag.FullTip.Hash)
+
+	quarantined := []QuarantinedBranch{}
+	dag.OnReorgQuarantined = func(branch QuarantinedBranch) {
+		quarantined = append(quarantined, branch)
+	}
+
+	// A reorg within the limit is accepted.
+	dag.MaxReorgDepth = 7
+	assert.Nil(dag.ReconsiderBlock(hashes[9]))
+	assert.Equal(branchTip.Hash, dag.FullTip.Hash)
+	assert.Nil(dag.InvalidateBlock(hashes[9]))
+	assert.Equal(hashes[8], dag.FullTip.Hash)
+
+	// A deeper one is quarantined, and the node stays on its chain.
+	dag.MaxReorgDepth = 6
+	assert.Nil(dag.ReconsiderBlock(hashes[9]))
+	assert.Equal(hashes[8], dag.FullTip.Hash)
+	assert.Equal(hashes[8], dag.HeadersTip.Hash)
+	assert.Equal(1, len(quarantined))
+	assert.Equal(hashes[9], quarantined[0].Hash)
+	assert.Equal(hashes[1], quarantined[0].ForkPoint)
+	assert.Equal(branchTip.Hash, quarantined[0].Tip)
+	assert.Equal(uint64(7), quarantined[0].Depth)
+
+	// The branch is only reported once.
+	assert.Nil(dag.updateTip())
+	assert.Nil(dag.ReconsiderBlock(hashes[9]))
+	assert.Equal(1, len(quarantined))
+	branches, err := dag.GetQuarantinedBranches()
+	assert.Nil(err)
+	assert.Equal(1, len(branches))
+	assert.Equal(hashes[9], branches[0].Hash)
+	assert.False(branches[0].Released)
+
+	// Until an operator releases it.
+	assert.EqualError(dag.ReleaseQuarantinedBranch([32]byte{1}), "Quarantined branch not found.")
+	assert.Nil(dag.ReleaseQuarantinedBranch(hashes[9]))
+	assert.Equal(branchTip.Hash, dag.FullTip.Hash)
+	assert.Equal(branchTip.Hash, dag.HeadersTip.Hash)
+	branches, err = dag.GetQuarantinedBranches()
+	assert.Nil(err)
+	assert.True(branches[0].Released)
+}
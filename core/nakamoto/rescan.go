@@ -0,0 +1,82 @@
+package nakamoto
+
+import (
+	"fmt"
+	"time"
+)
+
+// A rescan replays the main chain from a height, to (re)discover the historical transactions of addresses the node
+// didn't know about when they happened: keys newly imported into a wallet, or addresses newly watched (see watcher.go).
+//
+// The chain is replayed through the compact block filters (see blockfilter.go), a page of MAX_BLOCK_FILTERS blocks at
+// a time, and only the blocks whose filters match one of the addresses are read in full. A filter can give a false
+// positive, so matched blocks which don't involve the addresses are counted but otherwise skipped.
+//
+// The transactions of matched blocks are also passed to the address watcher, so watched addresses have their
+// historical transfers recorded as confirmed activity, and delivered to their webhooks. Transfers which were already
+// recorded aren't delivered again.
+
+type RescanResult struct {
+	FromHeight uint64
+	ToHeight   uint64
+	// The number of blocks replayed, and the number whose filters matched.
+	BlocksScanned uint64
+	BlocksMatched uint64
+	// The transactions to or from the addresses, oldest first.
+	Transactions []AddressHistoryEntry
+}
+
+// Rescans the main chain from a height to the tip for the transactions of addresses.
+func (n *Node) RescanAddresses(addresses [][65]byte, fromHeight uint64, now time.Time) (RescanResult, error) {
+	tip := n.Dag.FullTip
+	if len(addresses) == 0 {
+		return RescanResult{}, fmt.Errorf("No addresses to rescan.")
+	}
+	if tip.Height < fromHeight {
+		return RescanResult{}, fmt.Errorf("Height %d is above the tip at height %d.", fromHeight, tip.Height)
+	}
+	isAddress := map[[65]byte]bool{}
+	for _, address := range addresses {
+		isAddress[address] = true
+	}
+
+	res := RescanResult{FromHeight: fromHeight, ToHeight: tip.Height, Transactions: []AddressHistoryEntry{}}
+	for height := fromHeight; height <= tip.Height; height += MAX_BLOCK_FILTERS {
+		count := min(MAX_BLOCK_FILTERS, tip.Height-height+1)
+		filters, err := n.Dag.GetBlockFilters(height, count)
+		if err != nil {
+			return RescanResult{}, err
+		}
+		res.BlocksScanned += uint64(len(filters))
+		matches, err := MatchBlockFilters(filters, addresses)
+		if err != nil {
+			return RescanResult{}, err
+		}
+
+		for _, hash := range matches {
+			block, err := n.Dag.getBlockWithTransactions(hash)
+			if err != nil {
+				return RescanResult{}, err
+			}
+			res.BlocksMatched++
+			for i, tx := range block.Transactions {
+				if !isAddress[tx.FromPubkey] && !isAddress[tx.ToPubkey] {
+					continue
+				}
+				res.Transactions = append(res.Transactions, AddressHistoryEntry{
+					TxHash:    tx.Hash(),
+					BlockHash: block.Hash,
+					Height:    block.Height,
+					Timestamp: block.Timestamp,
+					TxIndex:   uint64(i),
+					From:      tx.FromPubkey,
+					To:        tx.ToPubkey,
+					Amount:    tx.Amount,
+					Fee:       tx.Fee,
+				})
+			}
+			n.AddressWatcher.ProcessRescannedBlock(*block, now)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,75 @@
+package nakamoto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRescanAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	hashes := [][32]byte{}
+	node.Miner.OnBlockSolution = func(block RawBlock) {
+		if err := node.Dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+	node.Miner.Start(5)
+	miner := wallets[0].PubkeyBytes()
+	// A block paying another address.
+	payee := wallets[1].PubkeyBytes()
+	node.Miner.SetCoinbase(payee)
+	node.Miner.Start(1)
+	now := time.Now()
+
+	// The miner's coinbases from height 3, oldest first. The miner signs the last, so it's sent from the miner.
+	res, err := node.RescanAddresses([][65]byte{miner}, 3, now)
+	assert.Nil(err)
+	assert.Equal(uint64(3), res.FromHeight)
+	assert.Equal(uint64(6), res.ToHeight)
+	assert.Equal(uint64(4), res.BlocksScanned)
+	assert.Equal(uint64(4), res.BlocksMatched)
+	assert.Equal(4, len(res.Transactions))
+	for i, tx := range res.Transactions {
+		assert.Equal(hashes[i+2], tx.BlockHash)
+		assert.Equal(uint64(i+3), tx.Height)
+		assert.Equal(miner, tx.From)
+	}
+	assert.Equal(miner, res.Transactions[2].To)
+	assert.Equal(payee, res.Transactions[3].To)
+
+	// An address in no block, barring false positives.
+	unused, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = node.RescanAddresses([][65]byte{unused.PubkeyBytes()}, 0, now)
+	assert.Nil(err)
+	assert.Equal(uint64(7), res.BlocksScanned)
+	assert.Equal(0, len(res.Transactions))
+
+	// A newly watched address has its historical transfers recorded.
+	assert.Nil(node.AddressWatcher.Watch(payee, ""))
+	res, err = node.RescanAddresses([][65]byte{payee}, 0, now)
+	assert.Nil(err)
+	assert.Equal(1, len(res.Transactions))
+	activity, err := node.AddressWatcher.Activity(payee)
+	assert.Nil(err)
+	assert.Equal(1, len(activity))
+	assert.Equal(ADDRESS_EVENT_INCOMING, activity[0].Direction)
+	assert.Equal(ADDRESS_EVENT_CONFIRMED, activity[0].Status)
+	assert.Equal(hashes[5], activity[0].BlockHash)
+
+	_, err = node.RescanAddresses([][65]byte{miner}, 7, now)
+	assert.NotNil(err)
+	_, err = node.RescanAddresses([][65]byte{}, 0, now)
+	assert.NotNil(err)
+}
@@ -0,0 +1,318 @@
+package nakamoto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// The JSON-RPC API is served at http://<host>:<port>/rpc, and implements the JSON-RPC 2.0 specification.
+// Parameters are positional, ie. `{"jsonrpc": "2.0", "id": 1, "method": "getblock", "params": ["<hash>"]}`.
+// Request bodies are limited to MAX_RPC_REQUEST_SIZE bytes.
+//
+// Batch requests are supported, by sending an array of requests. Methods can register a batch handler, which resolves
+// all calls to the method within a batch at once (ie. in a single database query). A batch holds at most
+// MAX_RPC_BATCH_SIZE requests, and each request in it counts against the client's rate limit.
+//
+// Methods are either read-only or mutating. Mutating methods (which change the node's state, such as submitting a
+// transaction) require the request to be authorised when the API server is configured with credentials. So do the
+// admin_* methods, even the read-only ones, as they expose the node's peers and logs, including the IPs of peers.
+
+// JSON-RPC error codes.
+const (
+	RPCErrParse          = -32700
+	RPCErrInvalidRequest = -32600
+	RPCErrMethodNotFound = -32601
+	RPCErrInvalidParams  = -32602
+	RPCErrInternal       = -32603
+	RPCErrUnauthorized   = -32001
+	RPCErrRateLimited    = -32005
+)
+
+const (
+	// The maximum size of a JSON-RPC request body, in bytes.
+	MAX_RPC_REQUEST_SIZE = 1024 * 1024
+	// The maximum number of requests in a batch.
+	MAX_RPC_BATCH_SIZE = 100
+	// The prefix of the admin methods, which require authorisation.
+	RPC_ADMIN_METHOD_PREFIX = "admin_"
+)
+
+type RPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type RPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+type RPCMethodHandler = func(params json.RawMessage) (interface{}, error)
+
+// Handles all calls to a method within a batch. Returns a result and error for each of the params, in order.
+type RPCBatchHandler = func(params []json.RawMessage) ([]interface{}, []error)
+
+type RPCMethod struct {
+	Handler      RPCMethodHandler
+	BatchHandler RPCBatchHandler
+	Mutating     bool
+	// Whether the method requires authorisation, which mutating and admin methods do.
+	Restricted bool
+}
+
+// RPCHandler dispatches JSON-RPC requests to registered methods.
+type RPCHandler struct {
+	methods map[string]RPCMethod
+
+	// Authorize is called for restricted methods. If nil, all requests are authorised.
+	Authorize func(r *http.Request) bool
+
+	// AllowCalls charges n calls against the client's rate limit, returning false if the client is over it.
+	// The HTTP request itself is charged as one call, so this is only called for the rest of a batch. If nil, calls
+	// are not limited.
+	AllowCalls func(r *http.Request, n int) bool
+
+	log log.Logger
+}
+
+func NewRPCHandler() *RPCHandler {
+	return &RPCHandler{
+		methods: make(map[string]RPCMethod),
+		log:     *NewLogger("rpc", ""),
+	}
+}
+
+func (h *RPCHandler) RegisterMethod(name string, handler RPCMethodHandler, mutating bool) {
+	h.methods[name] = RPCMethod{
+		Handler:    handler,
+		Mutating:   mutating,
+		Restricted: mutating || strings.HasPrefix(name, RPC_ADMIN_METHOD_PREFIX),
+	}
+}
+
+// Registers a read-only method which requires authorisation, since it reveals private data (ie. the node's peers).
+func (h *RPCHandler) RegisterRestrictedMethod(name string, handler RPCMethodHandler) {
+	h.RegisterMethod(name, handler, false)
+	method := h.methods[name]
+	method.Restricted = true
+	h.methods[name] = method
+}
+
+// Registers a batch handler for a previously registered method.
+func (h *RPCHandler) RegisterBatchHandler(name string, handler RPCBatchHandler) {
+	method := h.methods[name]
+	method.BatchHandler = handler
+	h.methods[name] = method
+}
+
+func (h *RPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_RPC_REQUEST_SIZE))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(RPCResponse{
+				JSONRPC: "2.0",
+				ID:      json.RawMessage("null"),
+				Error:   &RPCError{Code: RPCErrInvalidRequest, Message: fmt.Sprintf("Request too large, max %d bytes", MAX_RPC_REQUEST_SIZE)},
+			})
+			return
+		}
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	// Batch request.
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	if 0 < len(trimmed) && trimmed[0] == '[' {
+		var reqs []RPCRequest
+		if err := json.Unmarshal(body, &reqs); err != nil {
+			json.NewEncoder(w).Encode(RPCResponse{
+				JSONRPC: "2.0",
+				ID:      json.RawMessage("null"),
+				Error:   &RPCError{Code: RPCErrParse, Message: "Parse error"},
+			})
+			return
+		}
+		if len(reqs) == 0 {
+			json.NewEncoder(w).Encode(RPCResponse{
+				JSONRPC: "2.0",
+				ID:      json.RawMessage("null"),
+				Error:   &RPCError{Code: RPCErrInvalidRequest, Message: "Invalid request"},
+			})
+			return
+		}
+		if MAX_RPC_BATCH_SIZE < len(reqs) {
+			json.NewEncoder(w).Encode(RPCResponse{
+				JSONRPC: "2.0",
+				ID:      json.RawMessage("null"),
+				Error:   &RPCError{Code: RPCErrInvalidRequest, Message: fmt.Sprintf("Batch too large, max %d requests", MAX_RPC_BATCH_SIZE)},
+			})
+			return
+		}
+		if 1 < len(reqs) && h.AllowCalls != nil && !h.AllowCalls(r, len(reqs)-1) {
+			h.log.Printf("Rate limited batch of %d requests from %s\n", len(reqs), r.RemoteAddr)
+			w.WriteHeader(http.StatusTooManyRequests)
+			json.NewEncoder(w).Encode(RPCResponse{
+				JSONRPC: "2.0",
+				ID:      json.RawMessage("null"),
+				Error:   &RPCError{Code: RPCErrRateLimited, Message: "Too many requests"},
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(h.callBatch(r, reqs))
+		return
+	}
+
+	var req RPCRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		json.NewEncoder(w).Encode(RPCResponse{
+			JSONRPC: "2.0",
+			ID:      json.RawMessage("null"),
+			Error:   &RPCError{Code: RPCErrParse, Message: "Parse error"},
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(h.call(r, req))
+}
+
+// Calls a single method.
+func (h *RPCHandler) call(r *http.Request, req RPCRequest) RPCResponse {
+	method, res := h.prepare(r, req)
+	if res.Error != nil {
+		return res
+	}
+
+	result, err := method.Handler(req.Params)
+	return h.finish(res, result, err)
+}
+
+// Calls a batch of methods. Calls to methods with a batch handler are grouped and resolved together.
+func (h *RPCHandler) callBatch(r *http.Request, reqs []RPCRequest) []RPCResponse {
+	responses := make([]RPCResponse, len(reqs))
+
+	// Group the requests by method, for methods which have a batch handler.
+	batches := make(map[string][]int)
+	for i, req := range reqs {
+		method, res := h.prepare(r, req)
+		if res.Error != nil {
+			responses[i] = res
+			continue
+		}
+		if method.BatchHandler != nil {
+			responses[i] = res
+			batches[req.Method] = append(batches[req.Method], i)
+			continue
+		}
+
+		result, err := method.Handler(req.Params)
+		responses[i] = h.finish(res, result, err)
+	}
+
+	for name, idxs := range batches {
+		params := make([]json.RawMessage, len(idxs))
+		for j, i := range idxs {
+			params[j] = reqs[i].Params
+		}
+
+		results, errs := h.methods[name].BatchHandler(params)
+		for j, i := range idxs {
+			responses[i] = h.finish(responses[i], results[j], errs[j])
+		}
+	}
+
+	return responses
+}
+
+// Validates a request, returning the method to call and the response to fill.
+// If the request is invalid, the response contains an error.
+func (h *RPCHandler) prepare(r *http.Request, req RPCRequest) (RPCMethod, RPCResponse) {
+	res := RPCResponse{JSONRPC: "2.0", ID: req.ID}
+	if res.ID == nil {
+		res.ID = json.RawMessage("null")
+	}
+
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		res.Error = &RPCError{Code: RPCErrInvalidRequest, Message: "Invalid request"}
+		return RPCMethod{}, res
+	}
+
+	method, ok := h.methods[req.Method]
+	if !ok {
+		res.Error = &RPCError{Code: RPCErrMethodNotFound, Message: fmt.Sprintf("Method not found: %s", req.Method)}
+		return RPCMethod{}, res
+	}
+
+	if method.Restricted && h.Authorize != nil && !h.Authorize(r) {
+		h.log.Printf("Unauthorized call to '%s' from %s\n", req.Method, r.RemoteAddr)
+		res.Error = &RPCError{Code: RPCErrUnauthorized, Message: "Unauthorized"}
+		return RPCMethod{}, res
+	}
+
+	return method, res
+}
+
+// Fills the response with the result of a method call.
+func (h *RPCHandler) finish(res RPCResponse, result interface{}, err error) RPCResponse {
+	if err != nil {
+		if rpcErr, ok := err.(*RPCError); ok {
+			res.Error = rpcErr
+		} else {
+			res.Error = &RPCError{Code: RPCErrInternal, Message: err.Error()}
+		}
+		return res
+	}
+
+	res.Result, err = json.Marshal(result)
+	if err != nil {
+		res.Error = &RPCError{Code: RPCErrInternal, Message: err.Error()}
+	}
+	return res
+}
+
+// Decodes positional JSON-RPC params into the given targets.
+func parseRPCParams(params json.RawMessage, targets ...interface{}) error {
+	raw := []json.RawMessage{}
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &raw); err != nil {
+			return &RPCError{Code: RPCErrInvalidParams, Message: "Params must be an array"}
+		}
+	}
+	if len(raw) != len(targets) {
+		return &RPCError{Code: RPCErrInvalidParams, Message: fmt.Sprintf("Expected %d params, got %d", len(targets), len(raw))}
+	}
+	for i, target := range targets {
+		if err := json.Unmarshal(raw[i], target); err != nil {
+			return &RPCError{Code: RPCErrInvalidParams, Message: fmt.Sprintf("Invalid param %d: %s", i, err)}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package nakamoto
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// The signature cache remembers transaction signatures which have been verified, so a transaction verified when it
+// enters the mempool isn't verified again when a block including it arrives. Signature verification is the most
+// expensive part of validating a block, so this cuts block validation latency for nodes which have already seen most of
+// a block's transactions.
+//
+// Only valid signatures are cached. Entries are keyed by the transaction hash and the signature, since the hash doesn't
+// commit to the signature. The cache is bounded, and evicts the oldest entries first.
+
+const (
+	// The default maximum number of signatures in the cache.
+	DEFAULT_SIGNATURE_CACHE_SIZE = 100_000
+)
+
+type signatureCacheKey struct {
+	txhash [32]byte
+	sig    [64]byte
+}
+
+type SignatureCache struct {
+	entries map[signatureCacheKey]bool
+	// The keys in insertion order, for eviction.
+	order   []signatureCacheKey
+	maxSize int
+
+	hits   uint64
+	misses uint64
+
+	mutex sync.Mutex
+}
+
+func NewSignatureCache(maxSize int) *SignatureCache {
+	return &SignatureCache{
+		entries: make(map[signatureCacheKey]bool),
+		order:   []signatureCacheKey{},
+		maxSize: maxSize,
+	}
+}
+
+// Verifies the signature of a transaction, using the cache. A nil cache verifies every signature.
+func (c *SignatureCache) VerifyTransactionSignature(tx RawTransaction) bool {
+	if c == nil {
+		return verifyTransactionSignature(tx)
+	}
+
+	key := signatureCacheKey{txhash: tx.Hash(), sig: tx.Sig}
+	c.mutex.Lock()
+	_, ok := c.entries[key]
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	c.mutex.Unlock()
+	if ok {
+		return true
+	}
+
+	if !verifyTransactionSignature(tx) {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.entries[key]; ok || c.maxSize <= 0 {
+		return true
+	}
+	if c.maxSize <= len(c.order) {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.entries[key] = true
+	c.order = append(c.order, key)
+	return true
+}
+
+// Returns the number of cache hits and misses.
+func (c *SignatureCache) Stats() (hits uint64, misses uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hits, c.misses
+}
+
+func verifyTransactionSignature(tx RawTransaction) bool {
+	return core.VerifySignature(hex.EncodeToString(tx.FromPubkey[:]), tx.Sig[:], tx.Envelope())
+}
@@ -0,0 +1,78 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignatureCache(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	cache := NewSignatureCache(2)
+	tx1 := makePackageTx(t, &wallets[0], 0, 1).ToRawTransaction()
+	tx2 := makePackageTx(t, &wallets[0], 1, 1).ToRawTransaction()
+	tx3 := makePackageTx(t, &wallets[0], 2, 1).ToRawTransaction()
+
+	assert.True(cache.VerifyTransactionSignature(tx1))
+	assert.True(cache.VerifyTransactionSignature(tx1))
+	hits, misses := cache.Stats()
+	assert.Equal(uint64(1), hits)
+	assert.Equal(uint64(1), misses)
+
+	// Invalid signatures aren't cached, and the signature is part of the key.
+	forged := tx1
+	forged.Sig = tx2.Sig
+	assert.False(cache.VerifyTransactionSignature(forged))
+	assert.False(cache.VerifyTransactionSignature(forged))
+	hits, _ = cache.Stats()
+	assert.Equal(uint64(1), hits)
+
+	// The oldest entries are evicted.
+	assert.True(cache.VerifyTransactionSignature(tx2))
+	assert.True(cache.VerifyTransactionSignature(tx3))
+	assert.True(cache.VerifyTransactionSignature(tx1))
+	hits, _ = cache.Stats()
+	assert.Equal(uint64(1), hits)
+
+	// A nil cache verifies every signature.
+	var none *SignatureCache
+	assert.True(none.VerifyTransactionSignature(tx1))
+	assert.False(none.VerifyTransactionSignature(forged))
+}
+
+func TestSignatureCacheSharedWithMempool(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForMiner()
+	wallets := getTestingWallets(t)
+	mempool := NewMempool()
+	mempool.SigCache = dag.SigCache
+
+	// Signatures are verified on entry.
+	forged := makePackageTx(t, &wallets[1], 0, 1)
+	forged.Sig[0] ^= 0xff
+	assert.Equal(ErrInvalidSignature, mempool.AddTransaction(forged))
+	tx := makePackageTx(t, &wallets[1], 0, 1)
+	assert.Nil(mempool.AddTransaction(tx))
+	_, missesBefore := dag.SigCache.Stats()
+
+	// The transaction's signature isn't verified again when its block is ingested.
+	miner := NewMiner(dag, &wallets[0])
+	miner.Mempool = mempool
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	miner.Start(1)
+	txs, err := dag.GetBlockTransactions(dag.FullTip.Hash)
+	assert.Nil(err)
+	assert.Equal(2, len(*txs))
+
+	hits, misses := dag.SigCache.Stats()
+	assert.Equal(uint64(1), hits)
+	// The coinbase is the only new signature.
+	assert.Equal(missesBefore+1, misses)
+}
@@ -0,0 +1,111 @@
+package nakamoto
+
+import (
+	"fmt"
+)
+
+// Historical state queries reconstruct the state as of any fully downloaded, valid block, on the main chain or not, for
+// auditing and "balance at height" views in explorers.
+//
+// The node doesn't persist past states, so the state is re-executed from the nearest ancestor of the block whose state
+// is kept in memory: the recent states cached for reorgs (see state_overlay.go), or the checkpoints taken every
+// STATE_CHECKPOINT_INTERVAL blocks of the main chain as the state is built. Queries are public, so the blocks executed
+// are bounded by MAX_STATE_REPLAY_BLOCKS, and the state of a block with no kept state that close is unavailable, ie.
+// on an old fork, or below the last MAX_STATE_CHECKPOINTS checkpoints. Reconstructed states are layered over the kept
+// states, which they leave unchanged, and aren't kept themselves.
+
+const (
+	// The interval in blocks between checkpoints of the state of the main chain.
+	STATE_CHECKPOINT_INTERVAL = 256
+	// The maximum number of checkpoints kept. Older checkpoints are forgotten.
+	MAX_STATE_CHECKPOINTS = 4096
+	// The maximum number of blocks re-executed to reconstruct a state.
+	MAX_STATE_REPLAY_BLOCKS = STATE_CHECKPOINT_INTERVAL
+)
+
+// Keeps the state after a block as a checkpoint. The state must not be changed afterwards.
+func (n *Node) putStateCheckpoint(block Block, state *StateMachine) {
+	n.StateCheckpoints.Put(block, state)
+	if MAX_STATE_CHECKPOINTS*STATE_CHECKPOINT_INTERVAL <= block.Height {
+		n.StateCheckpoints.Prune(block.Height - (MAX_STATE_CHECKPOINTS-1)*STATE_CHECKPOINT_INTERVAL)
+	}
+}
+
+// Reconstructs the state after a block. The state is an overlay, which can be read while the node's state changes.
+func (n *Node) GetStateAt(hash [32]byte) (*StateMachine, error) {
+	target, err := n.Dag.GetBlockByHash(hash)
+	if err != nil {
+		return nil, err
+	}
+	if target == nil {
+		return nil, fmt.Errorf("Block not found: %x", hash)
+	}
+
+	// Find the nearest ancestor whose state is kept, including the block itself, ie. the tip.
+	recent, err := n.Dag.GetLongestChainHashList(hash, min(target.Height, MAX_STATE_REPLAY_BLOCKS))
+	if err != nil {
+		return nil, err
+	}
+	var state *StateMachine
+	hashes := [][32]byte{}
+	for i := len(recent) - 1; 0 <= i; i-- {
+		cached, ok := n.StateCache.Get(recent[i])
+		if !ok {
+			cached, ok = n.StateCheckpoints.Get(recent[i])
+		}
+		if ok {
+			state, hashes = cached.NewOverlay(), recent[i+1:]
+			break
+		}
+	}
+	if state == nil {
+		if MAX_STATE_REPLAY_BLOCKS < target.Height {
+			return nil, fmt.Errorf("State at block %x is unavailable: no state is kept within %d blocks of it.", hash, MAX_STATE_REPLAY_BLOCKS)
+		}
+
+		// Rebuild the state from genesis.
+		state, err = NewStateMachine(nil)
+		if err != nil {
+			return nil, err
+		}
+		state.CoinbaseMaturity = n.Dag.consensus.CoinbaseMaturity
+		state.Forks = n.Dag.consensus.Forks
+		if err := state.ApplyGenesisAlloc(n.Dag.consensus.GenesisAlloc); err != nil {
+			return nil, err
+		}
+		hashes = recent
+	}
+
+	for _, blockHash := range hashes {
+		block, err := n.Dag.getBlockWithTransactions(blockHash)
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(block.Transactions)) != block.NumTransactions {
+			return nil, fmt.Errorf("Block %x hasn't been downloaded in full.", blockHash)
+		}
+		if err := state.ExecuteBlock(*block); err != nil {
+			return nil, fmt.Errorf("Failed to execute block %x: %s", blockHash, err)
+		}
+	}
+	return state, nil
+}
+
+// Checks a block's transactions execute on the state after its parent. They're executed on an overlay, which leaves the
+// kept states unchanged. Registered with the DAG as its VerifyBlockState.
+func (n *Node) verifyBlockState(block Block) error {
+	state, err := n.GetStateAt(block.ParentHash)
+	if err != nil {
+		return err
+	}
+	return state.ExecuteBlock(block)
+}
+
+// Returns the balance of an account as of a block.
+func (n *Node) GetBalanceAt(pubkey [65]byte, hash [32]byte) (uint64, error) {
+	state, err := n.GetStateAt(hash)
+	if err != nil {
+		return 0, err
+	}
+	return state.GetBalance(pubkey), nil
+}
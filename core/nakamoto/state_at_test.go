@@ -0,0 +1,158 @@
+package nakamoto
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetBalanceAt(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	hashes := [][32]byte{}
+	node.Miner.OnBlockSolution = func(block RawBlock) {
+		if err := node.Dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+	miner := wallets[0].PubkeyBytes()
+	reward := MakeCoinbaseTx(&wallets[0]).Amount
+	genesis := node.Dag.FullTip.Hash
+	node.Miner.Start(3)
+
+	// The balance as of each block, from the cached states.
+	balance, err := node.GetBalanceAt(miner, hashes[0])
+	assert.Nil(err)
+	assert.Equal(reward, balance)
+	balance, err = node.GetBalanceAt(miner, hashes[2])
+	assert.Nil(err)
+	assert.Equal(3*reward, balance)
+
+	// Blocks on a fork. Whichever branch has the most work, one of these is off the main chain.
+	assert.Nil(node.Dag.InvalidateBlock(hashes[2]))
+	node.Miner.Start(2)
+	assert.Nil(node.Dag.ReconsiderBlock(hashes[2]))
+	balance, err = node.GetBalanceAt(miner, hashes[2])
+	assert.Nil(err)
+	assert.Equal(3*reward, balance)
+	balance, err = node.GetBalanceAt(miner, hashes[4])
+	assert.Nil(err)
+	assert.Equal(4*reward, balance)
+
+	// Without cached states, the state is rebuilt from genesis.
+	node.StateCache = NewStateCache()
+	balance, err = node.GetBalanceAt(miner, hashes[2])
+	assert.Nil(err)
+	assert.Equal(3*reward, balance)
+	balance, err = node.GetBalanceAt(miner, hashes[3])
+	assert.Nil(err)
+	assert.Equal(3*reward, balance)
+	balance, err = node.GetBalanceAt(miner, genesis)
+	assert.Nil(err)
+	assert.Equal(uint64(0), balance)
+
+	_, err = node.GetBalanceAt(miner, [32]byte{1})
+	assert.ErrorContains(err, "Block not found")
+}
+
+func TestGetStateAtBoundedReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	hashes := [][32]byte{}
+	node.Miner.OnBlockSolution = func(block RawBlock) {
+		if err := node.Dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+	miner := wallets[0].PubkeyBytes()
+	reward := MakeCoinbaseTx(&wallets[0]).Amount
+	node.Miner.Start(STATE_CHECKPOINT_INTERVAL + 1)
+
+	// The tip's state is an overlay, rather than the node's live state.
+	tip := node.Dag.FullTip
+	state, err := node.GetStateAt(tip.Hash)
+	assert.Nil(err)
+	assert.NotSame(node.StateMachine1, state)
+	assert.Equal(node.StateMachine1.GetBalance(miner), state.GetBalance(miner))
+
+	// Without cached states, states are re-executed from the nearest checkpoint.
+	node.StateCache = NewStateCache()
+	assert.Equal(1, node.StateCheckpoints.Len())
+	balance, err := node.GetBalanceAt(miner, hashes[STATE_CHECKPOINT_INTERVAL])
+	assert.Nil(err)
+	assert.Equal((STATE_CHECKPOINT_INTERVAL+1)*reward, balance)
+	balance, err = node.GetBalanceAt(miner, hashes[STATE_CHECKPOINT_INTERVAL-2])
+	assert.Nil(err)
+	assert.Equal((STATE_CHECKPOINT_INTERVAL-1)*reward, balance)
+
+	// Or from genesis, for blocks within MAX_STATE_REPLAY_BLOCKS of it. Further blocks without a checkpoint are
+	// unavailable.
+	node.StateCheckpoints = NewStateCache()
+	balance, err = node.GetBalanceAt(miner, hashes[STATE_CHECKPOINT_INTERVAL-2])
+	assert.Nil(err)
+	assert.Equal((STATE_CHECKPOINT_INTERVAL-1)*reward, balance)
+	_, err = node.GetBalanceAt(miner, hashes[STATE_CHECKPOINT_INTERVAL])
+	assert.ErrorContains(err, "is unavailable")
+}
+
+func TestIngestBlockVerifiesState(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	node.Miner.OnBlockSolution = func(block RawBlock) {
+		if err := node.Dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	node.Miner.Start(2)
+	tip := node.Dag.FullTip
+
+	// A block spending more than the sender's balance on the parent's state is rejected, though it's valid without
+	// the state.
+	puzzle := node.Miner.MakeNewPuzzle()
+	block := *puzzle.block
+	tx := MakeTransferTx(wallets[1].PubkeyBytes(), wallets[0].PubkeyBytes(), 100, &wallets[1], 0)
+	tx = MakeTransferTx(wallets[1].PubkeyBytes(), wallets[0].PubkeyBytes(), 100, &wallets[1], block.BaseFee*tx.SizeBytes())
+	block.Transactions = append(block.Transactions, tx)
+	block.NumTransactions = uint64(len(block.Transactions))
+	txlist := [][]byte{}
+	for _, blockTx := range block.Transactions {
+		txlist = append(txlist, blockTx.Envelope())
+	}
+	block.TransactionsMerkleRoot = core.ComputeMerkleHash(txlist)
+	nonce, err := SolvePOW(block, *big.NewInt(0), puzzle.target, 0)
+	assert.Nil(err)
+	block.SetNonce(nonce)
+
+	err = node.Dag.IngestBlock(block)
+	assert.ErrorContains(err, "Block is invalid on its parent's state")
+	assert.False(node.Dag.HasBlock(block.Hash()))
+	assert.Equal(tip.Hash, node.Dag.FullTip.Hash)
+	assert.ErrorContains(node.Dag.CheckBlockTemplate(block), "Block is invalid on its parent's state")
+
+	// The states it was checked against are unchanged.
+	state, err := node.GetStateAt(tip.Hash)
+	assert.Nil(err)
+	assert.Equal(uint64(0), state.GetBalance(wallets[1].PubkeyBytes()))
+	assert.Equal(node.StateMachine1.GetBalance(wallets[0].PubkeyBytes()), state.GetBalance(wallets[0].PubkeyBytes()))
+
+	// Blocks which execute are ingested.
+	node.Miner.Start(1)
+	assert.Equal(tip.Height+1, node.Dag.FullTip.Height)
+}
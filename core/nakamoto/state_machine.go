@@ -1,22 +1,40 @@
 package nakamoto
 
 import (
+	"bytes"
 	"database/sql"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/bits"
+	"sort"
+
+	"github.com/liamzebedee/tinychain-go/core"
 )
 
 var ErrInsufficientBalance = errors.New("insufficient balance")
 var ErrToBalanceOverflow = errors.New("\"to\" balance overflow")
 var ErrMinerBalanceOverflow = errors.New("\"miner\" balance overflow")
 var ErrAmountPlusFeeOverflow = errors.New("(amount + fee) overflow")
+var ErrImmatureCoinbaseSpend = errors.New("spends immature coinbase")
+var ErrFeeBelowBaseFee = errors.New("fee below base fee")
+var ErrUnsupportedTxVersion = errors.New("unsupported transaction version")
 
 var stateMachineLogger = NewLogger("state-machine", "")
 
 type StateLeaf struct {
 	PubKey  [65]byte
 	Balance uint64
+
+	// Coins credited to the account by a coinbase (the block reward or transaction fees) in this transition, and the
+	// height of the block. These are locked until they mature.
+	CoinbaseAmount uint64
+	CoinbaseHeight uint64
+
+	// The token keyspace of the balance. Empty for the native coin. See tokens.go.
+	Token string
+	// Set to the token's supply when the transition issues it.
+	TokenSupply uint64
 }
 
 // The input to the state transition function.
@@ -29,48 +47,302 @@ type StateMachineInput struct {
 
 	// Miner address for fees.
 	MinerPubkey [65]byte
+
+	// The height of the block containing the transaction.
+	BlockHeight uint64
+
+	// The base fee per byte of the block containing the transaction, which is burned. See fees.go.
+	BaseFee uint64
 }
 
 // The state machine is the core of the business logic for the Nakamoto blockchain.
 // It performs the state transition function, which encapsulates:
 // 1. Minting coins into circulation via the coinbase transaction.
 // 2. Transferring coins between accounts.
+// 3. Issuing and transferring tokens.
 //
 // It is oblivious to:
 //   - the consensus algorithm, transaction sequencing.
 //   - signatures. The state machine does not care about validating signatures. At Bitcoin's core, it is a sequencing/DA layer.
+//     The exception is coins locked by a predicate (see predicate.go), which the state machine evaluates, since a
+//     predicate may depend on the block height.
+//
+// Coinbase maturity: coins credited by a coinbase (the block reward and fees) cannot be spent until the block is
+// CoinbaseMaturity blocks deep. Otherwise a reorg which orphans the block would leave recipients of those coins holding
+// coins which no longer exist, since unlike a regular transfer, a coinbase can't be included in the new chain.
 type StateMachine struct {
 	// The current state.
 	state map[[65]byte]uint64
+
+	// The number of blocks before coinbase coins can be spent. 0 disables the rule.
+	CoinbaseMaturity uint64
+
+	// The activation heights of forks, which transaction versions are checked against in Transition. If nil, every
+	// supported version is active, ie. for states built outside a chain. Other forks are only active once scheduled here.
+	Forks map[string]uint64
+
+	// Coinbase coins which may not yet be mature, by account, in order of height.
+	immature map[[65]byte][]immatureCoinbase
+
+	// Issued tokens, and their balances by token and account.
+	tokens        map[string]TokenInfo
+	tokenBalances map[string]map[[65]byte]uint64
+
+	// Undoes the leaves applied since the oldest snapshot, in order. Nil when there are no snapshots.
+	journal []func()
+	// The length of the journal when each snapshot was taken, by snapshot ID.
+	snapshots []int
+
+	// The state this state overlays, if it's an overlay (see state_overlay.go). The maps above only hold the keys
+	// written in this layer, and reads of other keys fall through to the parent.
+	parent *StateMachine
+	// The number of states below this one.
+	depth int
+}
+
+type immatureCoinbase struct {
+	height uint64
+	amount uint64
 }
 
 func NewStateMachine(db *sql.DB) (*StateMachine, error) {
 	return &StateMachine{
-		state: make(map[[65]byte]uint64),
+		state:         make(map[[65]byte]uint64),
+		immature:      make(map[[65]byte][]immatureCoinbase),
+		tokens:        make(map[string]TokenInfo),
+		tokenBalances: make(map[string]map[[65]byte]uint64),
 	}, nil
 }
 
+const (
+	STATE_MACHINE_ACCOUNT = "account"
+	STATE_MACHINE_UTXO    = "utxo"
+)
+
+// Creates the state machine selected by the consensus config. The account model is the default.
+func NewStateMachineFromConfig(conf ConsensusConfig) (StateMachineInterface, error) {
+	switch conf.StateMachine {
+	case "", STATE_MACHINE_ACCOUNT:
+		stateMachine, err := NewStateMachine(nil)
+		if err != nil {
+			return nil, err
+		}
+		stateMachine.CoinbaseMaturity = conf.CoinbaseMaturity
+		stateMachine.Forks = conf.Forks
+		if err := stateMachine.ApplyGenesisAlloc(conf.GenesisAlloc); err != nil {
+			return nil, err
+		}
+		return stateMachine, nil
+	case STATE_MACHINE_UTXO:
+		if 0 < len(conf.GenesisAlloc) {
+			return nil, fmt.Errorf("Genesis allocations are not supported by the UTXO state machine.")
+		}
+		stateMachine := NewUTXOStateMachine()
+		stateMachine.CoinbaseMaturity = conf.CoinbaseMaturity
+		return stateMachine, nil
+	}
+	return nil, fmt.Errorf("Unknown state machine: %s", conf.StateMachine)
+}
+
 func (c *StateMachine) Apply(leafs []*StateLeaf) {
 	for _, leaf := range leafs {
+		if c.journal != nil {
+			c.journal = append(c.journal, c.undoLeaf(leaf))
+		}
+		if leaf.Token != "" {
+			c.applyTokenLeaf(leaf)
+			continue
+		}
 		c.state[leaf.PubKey] = leaf.Balance
+
+		if leaf.CoinbaseAmount == 0 || c.CoinbaseMaturity == 0 {
+			continue
+		}
+		// Prune coins which have matured, and track the new coins. The entries may be shared with a snapshot or the
+		// parent layer, so they're copied rather than appended to in place.
+		entries, _ := c.getImmature(leaf.PubKey)
+		for len(entries) > 0 && entries[0].height+c.CoinbaseMaturity <= leaf.CoinbaseHeight {
+			entries = entries[1:]
+		}
+		c.immature[leaf.PubKey] = append(entries[:len(entries):len(entries)], immatureCoinbase{
+			height: leaf.CoinbaseHeight,
+			amount: leaf.CoinbaseAmount,
+		})
+	}
+}
+
+// Returns a function which undoes applying a leaf.
+func (c *StateMachine) undoLeaf(leaf *StateLeaf) func() {
+	if leaf.Token != "" {
+		token, issued := c.GetToken(leaf.Token)
+		balances, hasBalances := c.tokenBalances[leaf.Token]
+		balance, hasBalance := c.getTokenBalance(leaf.Token, leaf.PubKey)
+		return func() {
+			if leaf.TokenSupply != 0 {
+				if issued {
+					c.tokens[leaf.Token] = token
+				} else {
+					delete(c.tokens, leaf.Token)
+				}
+				if hasBalances {
+					c.tokenBalances[leaf.Token] = balances
+				} else {
+					delete(c.tokenBalances, leaf.Token)
+				}
+				return
+			}
+			if hasBalance {
+				c.tokenBalances[leaf.Token][leaf.PubKey] = balance
+			} else {
+				delete(c.tokenBalances[leaf.Token], leaf.PubKey)
+			}
+		}
+	}
+
+	balance, hasBalance := c.getBalance(leaf.PubKey)
+	immature, hasImmature := c.getImmature(leaf.PubKey)
+	return func() {
+		if hasBalance {
+			c.state[leaf.PubKey] = balance
+		} else {
+			delete(c.state, leaf.PubKey)
+		}
+		if hasImmature {
+			c.immature[leaf.PubKey] = immature
+		} else {
+			delete(c.immature, leaf.PubKey)
+		}
+	}
+}
+
+// Checks a transaction is well-formed, independent of the state.
+func (c *StateMachine) VerifyTx(tx RawTransaction) error {
+	if !IsTxVersionSupported(tx.Version, STATE_MACHINE_ACCOUNT) {
+		return ErrUnsupportedTxVersion
+	}
+	return VerifyTxVersion(tx)
+}
+
+// Checks a transaction can be executed on the current state, in a block at a height: it's well-formed, its nonce isn't
+// below the sender's next nonce, and the sender's spendable balance covers the amount and fee. Token amounts aren't in
+// units of the native coin, so only the fee is checked for token operations.
+func (c *StateMachine) VerifyTxState(tx RawTransaction, nextNonce uint64, height uint64) error {
+	if err := c.VerifyTx(tx); err != nil {
+		return err
+	}
+	if tx.Nonce < nextNonce {
+		return ErrNonceTooLow
+	}
+
+	cost := tx.Fee
+	if tx.TokenOp == TOKEN_OP_NONE {
+		var carry uint64
+		if cost, carry = bits.Add64(tx.Amount, tx.Fee, 0); carry != 0 {
+			return ErrAmountPlusFeeOverflow
+		}
+	}
+	if c.GetBalance(tx.FromPubkey) < cost {
+		return ErrInsufficientBalance
+	}
+	if c.GetSpendableBalance(tx.FromPubkey, height) < cost {
+		return ErrImmatureCoinbaseSpend
+	}
+	return nil
+}
+
+// Executes the transactions of a block. The first transaction is the coinbase, whose sender receives the fees. If a
+// transaction fails, the block's effects are undone.
+func (c *StateMachine) ExecuteBlock(block Block) error {
+	snapshot := c.Snapshot()
+
+	var minerPubkey [65]byte
+	for i, tx := range block.Transactions {
+		if i == 0 {
+			minerPubkey = tx.FromPubkey
+		}
+		effects, err := c.Transition(StateMachineInput{
+			RawTransaction: tx,
+			IsCoinbase:     i == 0,
+			MinerPubkey:    minerPubkey,
+			BlockHeight:    block.Height,
+			BaseFee:        block.BaseFee,
+		})
+		if err != nil {
+			if err := c.RevertTo(snapshot); err != nil {
+				return err
+			}
+			return fmt.Errorf("Error transitioning state machine: block=%x txindex=%d error=\"%s\"", block.Hash, i, err)
+		}
+		c.Apply(effects)
+	}
+	c.release(snapshot)
+	return nil
+}
+
+// Snapshots are journaled: while a snapshot is live, applying a leaf records how to undo it, and reverting undoes the
+// leaves applied since the snapshot, newest first. This is cheap enough to snapshot before each block, unlike copying
+// the state.
+func (c *StateMachine) Snapshot() SnapshotID {
+	if c.journal == nil {
+		c.journal = []func(){}
+	}
+	c.snapshots = append(c.snapshots, len(c.journal))
+	return SnapshotID(len(c.snapshots) - 1)
+}
+
+func (c *StateMachine) RevertTo(snapshot SnapshotID) error {
+	if snapshot < 0 || len(c.snapshots) <= int(snapshot) {
+		return fmt.Errorf("Unknown snapshot: %d", snapshot)
+	}
+	mark := c.snapshots[snapshot]
+	for j := len(c.journal) - 1; mark <= j; j-- {
+		c.journal[j]()
+	}
+	c.journal = c.journal[:mark]
+	c.release(snapshot)
+	return nil
+}
+
+// Discards a snapshot, and those taken after it, keeping the state. The journal is kept for the earlier snapshots.
+func (c *StateMachine) release(snapshot SnapshotID) {
+	c.snapshots = c.snapshots[:snapshot]
+	if len(c.snapshots) == 0 {
+		c.journal = nil
 	}
 }
 
 // Transitions the state machine to the next state.
 func (c *StateMachine) Transition(input StateMachineInput) ([]*StateLeaf, error) {
 	// Check transaction version.
-	if input.RawTransaction.Version != 1 {
-		return nil, errors.New("unsupported transaction version")
+	if !IsTxVersionSupported(input.RawTransaction.Version, STATE_MACHINE_ACCOUNT) {
+		return nil, ErrUnsupportedTxVersion
+	}
+	if c.Forks != nil && !IsTxVersionActive(input.RawTransaction.Version, input.BlockHeight, c.Forks) {
+		return nil, ErrTxVersionNotActive
 	}
 
 	if input.IsCoinbase {
 		return c.transitionCoinbase(input)
-	} else {
-		return c.transitionTransfer(input)
 	}
+
+	// Coins locked by a predicate can only be spent by satisfying it.
+	if err := VerifyPredicate(input.RawTransaction, input.BlockHeight); err != nil {
+		return nil, err
+	}
+	if err := VerifyHTLCSpend(input.RawTransaction); err != nil {
+		return nil, err
+	}
+	if err := VerifyTxVersion(input.RawTransaction); err != nil {
+		return nil, err
+	}
+	if input.RawTransaction.TokenOp != TOKEN_OP_NONE {
+		return c.transitionToken(input)
+	}
+	return c.transitionTransfer(input)
 }
 
 func (c *StateMachine) transitionTransfer(input StateMachineInput) ([]*StateLeaf, error) {
+
 	fromBalance := c.GetBalance(input.RawTransaction.FromPubkey)
 	toBalance := c.GetBalance(input.RawTransaction.ToPubkey)
 	minerBalance := c.GetBalance(input.MinerPubkey)
@@ -93,20 +365,35 @@ func (c *StateMachine) transitionTransfer(input StateMachineInput) ([]*StateLeaf
 		return nil, ErrAmountPlusFeeOverflow
 	}
 
+	// The base fee portion of the fee is burned, and the miner receives the rest (the tip).
+	burn := input.BaseFee * input.RawTransaction.SizeBytes()
+	if fee < burn {
+		return nil, ErrFeeBelowBaseFee
+	}
+	tip := fee - burn
+
 	// Check if the `from` account has enough balance.
 	if fromBalance < (amount + fee) {
 		// return nil, fmt.Errorf("insufficient balance. balance=%d, amount=%d", fromBalance, amount)
 		return nil, ErrInsufficientBalance
 	}
 
-	// Deduct the coins from the `from` account balance.
+	// Check the transfer doesn't spend immature coinbase coins.
+	if c.GetSpendableBalance(input.RawTransaction.FromPubkey, input.BlockHeight) < (amount + fee) {
+		return nil, ErrImmatureCoinbaseSpend
+	}
+
+	// Deduct the coins from the `from` account balance, and the fee too, after the fee deduction fork.
 	fromBalance -= amount
+	if c.isForkActive(FORK_FEE_DEDUCTION, input.BlockHeight) {
+		fromBalance -= fee
+	}
 
 	// Add the coins to the `to` account balance.
 	toBalance += amount
 
-	// Add the fee to the `miner` account balance.
-	minerBalance += fee
+	// Add the tip to the `miner` account balance.
+	minerBalance += tip
 
 	// Create the new state leaves.
 	fromLeaf := &StateLeaf{
@@ -118,8 +405,10 @@ func (c *StateMachine) transitionTransfer(input StateMachineInput) ([]*StateLeaf
 		Balance: toBalance,
 	}
 	minerLeaf := &StateLeaf{
-		PubKey:  input.MinerPubkey,
-		Balance: minerBalance,
+		PubKey:         input.MinerPubkey,
+		Balance:        minerBalance,
+		CoinbaseAmount: tip,
+		CoinbaseHeight: input.BlockHeight,
 	}
 	leaves := []*StateLeaf{
 		fromLeaf,
@@ -129,6 +418,13 @@ func (c *StateMachine) transitionTransfer(input StateMachineInput) ([]*StateLeaf
 	return leaves, nil
 }
 
+// Returns whether a fork is active at the given height. Like BlockDAG.IsForkActive, a fork which isn't scheduled is
+// never active.
+func (c *StateMachine) isForkActive(name string, height uint64) bool {
+	activation, ok := c.Forks[name]
+	return ok && activation <= height
+}
+
 func (c *StateMachine) transitionCoinbase(input StateMachineInput) ([]*StateLeaf, error) {
 	toBalance := c.GetBalance(input.RawTransaction.ToPubkey)
 	amount := input.RawTransaction.Amount
@@ -144,8 +440,10 @@ func (c *StateMachine) transitionCoinbase(input StateMachineInput) ([]*StateLeaf
 
 	// Create the new state leaves.
 	toLeaf := &StateLeaf{
-		PubKey:  input.RawTransaction.ToPubkey,
-		Balance: toBalance,
+		PubKey:         input.RawTransaction.ToPubkey,
+		Balance:        toBalance,
+		CoinbaseAmount: amount,
+		CoinbaseHeight: input.BlockHeight,
 	}
 	leaves := []*StateLeaf{
 		toLeaf,
@@ -154,7 +452,76 @@ func (c *StateMachine) transitionCoinbase(input StateMachineInput) ([]*StateLeaf
 }
 
 func (c *StateMachine) GetBalance(account [65]byte) uint64 {
-	return c.state[account]
+	balance, _ := c.getBalance(account)
+	return balance
+}
+
+// Returns the balance of an account which can be spent in a block at the given height, ie. excluding immature coinbase
+// coins.
+func (c *StateMachine) GetSpendableBalance(account [65]byte, height uint64) uint64 {
+	balance := c.GetBalance(account)
+	if c.CoinbaseMaturity == 0 {
+		return balance
+	}
+
+	locked := uint64(0)
+	entries, _ := c.getImmature(account)
+	for i := len(entries) - 1; 0 <= i && height < entries[i].height+c.CoinbaseMaturity; i-- {
+		locked += entries[i].amount
+	}
+	if balance < locked {
+		return 0
+	}
+	return balance - locked
+}
+
+func (c *StateMachine) applyTokenLeaf(leaf *StateLeaf) {
+	if leaf.TokenSupply != 0 {
+		c.tokens[leaf.Token] = TokenInfo{
+			Name:   leaf.Token,
+			Issuer: leaf.PubKey,
+			Supply: leaf.TokenSupply,
+		}
+		c.tokenBalances[leaf.Token] = make(map[[65]byte]uint64)
+	}
+	if c.tokenBalances[leaf.Token] == nil {
+		// The token was issued in a lower layer.
+		c.tokenBalances[leaf.Token] = make(map[[65]byte]uint64)
+	}
+	c.tokenBalances[leaf.Token][leaf.PubKey] = leaf.Balance
+}
+
+// Computes the state root, a merkle root committing to every keyspace of the state: the native balances, the issued
+// tokens, and the token balances. Zero balances are omitted, so the root doesn't depend on accounts which were emptied.
+func (c *StateMachine) StateRoot() [32]byte {
+	state, tokens, tokenBalances := c.mergeLayers()
+	leaves := [][]byte{}
+	for account, balance := range state {
+		if balance == 0 {
+			continue
+		}
+		leaf := append([]byte{0}, account[:]...)
+		leaves = append(leaves, binary.BigEndian.AppendUint64(leaf, balance))
+	}
+	for name, token := range tokens {
+		leaf := append([]byte{1, byte(len(name))}, name...)
+		leaf = append(leaf, token.Issuer[:]...)
+		leaves = append(leaves, binary.BigEndian.AppendUint64(leaf, token.Supply))
+
+		for account, balance := range tokenBalances[name] {
+			if balance == 0 {
+				continue
+			}
+			leaf := append([]byte{2, byte(len(name))}, name...)
+			leaf = append(leaf, account[:]...)
+			leaves = append(leaves, binary.BigEndian.AppendUint64(leaf, balance))
+		}
+	}
+
+	sort.Slice(leaves, func(i, j int) bool {
+		return bytes.Compare(leaves[i], leaves[j]) < 0
+	})
+	return core.ComputeMerkleHash(leaves)
 }
 
 // Returns a list of modified accounts.
@@ -164,49 +531,36 @@ func (c *StateMachine) GetStateSnapshot() []StateLeaf {
 
 // Given a block DAG and a list of block hashes, extracts the transaction sequence, applies each transaction in order, and returns the final state.
 func RebuildState(dag *BlockDAG, stateMachine StateMachine, longestChainHashList [][32]byte) (*StateMachine, error) {
-	for _, blockHash := range longestChainHashList {
-		// 1. Get all transactions for block.
-		// TODO ignore: nonce, sig
+	if err := ExecuteBlocks(dag, &stateMachine, longestChainHashList); err != nil {
+		return nil, err
+	}
+	return &stateMachine, nil
+}
+
+// Executes the blocks with the given hashes, in order, on a state machine.
+func ExecuteBlocks(dag *BlockDAG, vm StateMachineInterface, hashes [][32]byte) error {
+	for _, blockHash := range hashes {
+		block, err := dag.GetBlockByHash(blockHash)
+		if err != nil {
+			return err
+		}
+		if block == nil {
+			return fmt.Errorf("Block not found: %x", blockHash)
+		}
 		txs, err := dag.GetBlockTransactions(blockHash)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		stateMachineLogger.Printf("Processing block %x with %d transactions", blockHash, len(*txs))
 
-		// 2. Map transactions to state leaves through state machine transition function.
-		var stateMachineInput StateMachineInput
-		var minerPubkey [65]byte
-		isCoinbase := false
-
-		for i, tx := range *txs {
-			// Special case: coinbase tx is always the first tx in the block.
-			if i == 0 {
-				minerPubkey = tx.FromPubkey
-				isCoinbase = true
-			}
-
-			// Construct the state machine input.
-			stateMachineInput = StateMachineInput{
-				RawTransaction: tx.ToRawTransaction(),
-				IsCoinbase:     isCoinbase,
-				MinerPubkey:    minerPubkey,
-			}
-
-			// Transition the state machine.
-			effects, err := stateMachine.Transition(stateMachineInput)
-			if err != nil {
-				return nil, fmt.Errorf("Error transitioning state machine: block=%x txindex=%d error=\"%s\"", blockHash, i, err)
-			}
-
-			// Apply the effects.
-			stateMachine.Apply(effects)
-
-			if i == 0 {
-				isCoinbase = false
-			}
+		block.Transactions = []RawTransaction{}
+		for _, tx := range *txs {
+			block.Transactions = append(block.Transactions, tx.ToRawTransaction())
+		}
+		if err := vm.ExecuteBlock(*block); err != nil {
+			return err
 		}
 	}
-
-	return &stateMachine, nil
+	return nil
 }
@@ -476,3 +476,262 @@ func TestStateMachineReconstructState(t *testing.T) {
 		t.Logf("Account %x has balance %d", wallet.PubkeyBytes(), balance)
 	}
 }
+
+func TestStateMachineCoinbaseMaturity(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	miner := wallets[0].PubkeyBytes()
+	recipient := wallets[1].PubkeyBytes()
+	feeRecipient := [65]byte{9}
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.CoinbaseMaturity = 10
+
+	transition := func(input StateMachineInput) error {
+		effects, err := stateMachine.Transition(input)
+		if err != nil {
+			return err
+		}
+		stateMachine.Apply(effects)
+		return nil
+	}
+
+	// Mine a coinbase at height 1.
+	err = transition(StateMachineInput{
+		RawTransaction: newUnsignedTransferTx(miner, miner, 100, &wallets[0], 0),
+		IsCoinbase:     true,
+		BlockHeight:    1,
+	})
+	assert.Nil(err)
+	assert.Equal(uint64(100), stateMachine.GetBalance(miner))
+	assert.Equal(uint64(0), stateMachine.GetSpendableBalance(miner, 10))
+	assert.Equal(uint64(100), stateMachine.GetSpendableBalance(miner, 11))
+
+	// The coinbase can't be spent until it is 10 blocks deep.
+	transfer := StateMachineInput{
+		RawTransaction: newUnsignedTransferTx(miner, recipient, 50, &wallets[0], 0),
+		BlockHeight:    10,
+	}
+	assert.Equal(ErrImmatureCoinbaseSpend, transition(transfer))
+	transfer.BlockHeight = 11
+	assert.Nil(transition(transfer))
+	assert.Equal(uint64(50), stateMachine.GetSpendableBalance(recipient, 11))
+
+	// Fees credited to the miner are also locked.
+	err = transition(StateMachineInput{
+		RawTransaction: newUnsignedTransferTx(recipient, recipient, 10, &wallets[1], 5),
+		MinerPubkey:    feeRecipient,
+		BlockHeight:    12,
+	})
+	assert.Nil(err)
+	assert.Equal(uint64(5), stateMachine.GetBalance(feeRecipient))
+	assert.Equal(uint64(0), stateMachine.GetSpendableBalance(feeRecipient, 21))
+	assert.Equal(uint64(5), stateMachine.GetSpendableBalance(feeRecipient, 22))
+
+	// Newer coinbases stay locked after older ones mature.
+	err = transition(StateMachineInput{
+		RawTransaction: newUnsignedTransferTx(miner, miner, 100, &wallets[0], 0),
+		IsCoinbase:     true,
+		BlockHeight:    15,
+	})
+	assert.Nil(err)
+	assert.Equal(uint64(150), stateMachine.GetBalance(miner))
+	assert.Equal(uint64(50), stateMachine.GetSpendableBalance(miner, 20))
+	assert.Equal(uint64(150), stateMachine.GetSpendableBalance(miner, 25))
+}
+
+func TestStateMachineBaseFeeBurn(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	sender := wallets[0].PubkeyBytes()
+	recipient := wallets[1].PubkeyBytes()
+	miner := [65]byte{9}
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.Forks = map[string]uint64{FORK_FEE_DEDUCTION: 0}
+	stateMachine.Apply([]*StateLeaf{{PubKey: sender, Balance: 10000}})
+
+	txSize := (&RawTransaction{}).SizeBytes()
+	transfer := StateMachineInput{
+		RawTransaction: newUnsignedTransferTx(sender, recipient, 100, &wallets[0], 2*txSize+7),
+		MinerPubkey:    miner,
+		BaseFee:        3,
+	}
+
+	// The fee must cover the base fee.
+	_, err = stateMachine.Transition(transfer)
+	assert.Equal(ErrFeeBelowBaseFee, err)
+
+	// The base fee is burned, and the miner receives the tip.
+	transfer.BaseFee = 2
+	effects, err := stateMachine.Transition(transfer)
+	assert.Nil(err)
+	stateMachine.Apply(effects)
+	assert.Equal(uint64(10000-100-2*txSize-7), stateMachine.GetBalance(sender))
+	assert.Equal(uint64(100), stateMachine.GetBalance(recipient))
+	assert.Equal(uint64(7), stateMachine.GetBalance(miner))
+}
+
+func TestStateMachineFeeDeductionFork(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	sender := wallets[0].PubkeyBytes()
+	recipient := wallets[1].PubkeyBytes()
+	miner := [65]byte{9}
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.Forks = map[string]uint64{FORK_FEE_DEDUCTION: 10}
+	stateMachine.Apply([]*StateLeaf{{PubKey: sender, Balance: 1000}})
+
+	// Before the fork, only the amount is deducted from the sender, and the miner is credited the fee.
+	transfer := StateMachineInput{
+		RawTransaction: newUnsignedTransferTx(sender, recipient, 100, &wallets[0], 5),
+		MinerPubkey:    miner,
+		BlockHeight:    9,
+	}
+	effects, err := stateMachine.Transition(transfer)
+	assert.Nil(err)
+	stateMachine.Apply(effects)
+	assert.Equal(uint64(900), stateMachine.GetBalance(sender))
+	assert.Equal(uint64(100), stateMachine.GetBalance(recipient))
+	assert.Equal(uint64(5), stateMachine.GetBalance(miner))
+
+	// The sender must still have the balance for the fee.
+	transfer.RawTransaction.Amount = 900
+	_, err = stateMachine.Transition(transfer)
+	assert.Equal(ErrInsufficientBalance, err)
+
+	// From the fork, the fee is deducted too.
+	transfer.RawTransaction.Amount = 100
+	transfer.BlockHeight = 10
+	effects, err = stateMachine.Transition(transfer)
+	assert.Nil(err)
+	stateMachine.Apply(effects)
+	assert.Equal(uint64(795), stateMachine.GetBalance(sender))
+	assert.Equal(uint64(200), stateMachine.GetBalance(recipient))
+	assert.Equal(uint64(10), stateMachine.GetBalance(miner))
+
+	// The fork isn't active unless it's scheduled.
+	stateMachine.Forks = nil
+	effects, err = stateMachine.Transition(transfer)
+	assert.Nil(err)
+	stateMachine.Apply(effects)
+	assert.Equal(uint64(695), stateMachine.GetBalance(sender))
+}
+
+func TestStateMachinePredicate(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	owner := wallets[0].PubkeyBytes()
+	recipient := wallets[1].PubkeyBytes()
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.Apply([]*StateLeaf{{PubKey: owner, Balance: 1000}})
+
+	// Lock coins until height 10.
+	p := AndPredicate(AfterPredicate(10), SigPredicate(owner))
+	lock := StateMachineInput{
+		RawTransaction: newUnsignedTransferTx(owner, p.Address(), 500, &wallets[0], 0),
+		BlockHeight:    1,
+	}
+	effects, err := stateMachine.Transition(lock)
+	assert.Nil(err)
+	stateMachine.Apply(effects)
+	assert.Equal(uint64(500), stateMachine.GetBalance(p.Address()))
+
+	spend := MakePredicateSpendTx(p, recipient, 500, 0)
+	sig, err := wallets[0].Sign(spend.Envelope())
+	assert.Nil(err)
+	spend.Witness = EncodeWitness([][]byte{sig})
+
+	// The coins can't be spent before the timelock.
+	_, err = stateMachine.Transition(StateMachineInput{RawTransaction: spend, BlockHeight: 9})
+	assert.Equal(ErrPredicateNotSatisfied, err)
+
+	effects, err = stateMachine.Transition(StateMachineInput{RawTransaction: spend, BlockHeight: 10})
+	assert.Nil(err)
+	stateMachine.Apply(effects)
+	assert.Equal(uint64(0), stateMachine.GetBalance(p.Address()))
+	assert.Equal(uint64(500), stateMachine.GetBalance(recipient))
+}
+
+func TestStateMachineVerifyTxState(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	sender := wallets[0].PubkeyBytes()
+	recipient := wallets[1].PubkeyBytes()
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.CoinbaseMaturity = 10
+	stateMachine.Apply([]*StateLeaf{{PubKey: sender, Balance: 1000, CoinbaseAmount: 400, CoinbaseHeight: 1}})
+
+	tx := newUnsignedTransferTx(sender, recipient, 500, &wallets[0], 100)
+	tx.Nonce = 3
+	assert.Nil(stateMachine.VerifyTxState(tx, 3, 11))
+
+	// The nonce can't be below the sender's next nonce.
+	assert.Equal(ErrNonceTooLow, stateMachine.VerifyTxState(tx, 4, 11))
+
+	// The amount and fee must be covered by the spendable balance.
+	tx.Amount = 950
+	assert.Equal(ErrInsufficientBalance, stateMachine.VerifyTxState(tx, 3, 11))
+	tx.Amount = 550
+	assert.Equal(ErrImmatureCoinbaseSpend, stateMachine.VerifyTxState(tx, 3, 10))
+	assert.Nil(stateMachine.VerifyTxState(tx, 3, 11))
+	tx.Amount = ^uint64(0)
+	assert.Equal(ErrAmountPlusFeeOverflow, stateMachine.VerifyTxState(tx, 3, 11))
+
+	// Token amounts aren't native coins, so only the fee is checked.
+	tx.Version = 3
+	tx.TokenOp = TOKEN_OP_TRANSFER
+	tx.Token = "TKN"
+	tx.Amount = 5000
+	assert.Nil(stateMachine.VerifyTxState(tx, 3, 11))
+
+	tx.Version = 4
+	assert.Equal(ErrUnsupportedTxVersion, stateMachine.VerifyTxState(tx, 3, 11))
+}
+
+func TestStateMachineTxVersionActivation(t *testing.T) {
+	assert := assert.New(t)
+
+	stateMachine, err := NewStateMachine(nil)
+	assert.Nil(err)
+	wallets := getTestingWallets(t)
+	coinbase := MakeCoinbaseTx(&wallets[0])
+	coinbase.Version = 3
+	input := StateMachineInput{RawTransaction: coinbase, IsCoinbase: true, BlockHeight: 9}
+
+	// Without a fork schedule, every supported version is active.
+	_, err = stateMachine.Transition(input)
+	assert.Nil(err)
+
+	// Otherwise versions are active from their fork.
+	stateMachine.Forks = map[string]uint64{FORK_PREDICATES: 0, FORK_TOKENS: 10}
+	_, err = stateMachine.Transition(input)
+	assert.Equal(ErrTxVersionNotActive, err)
+	input.BlockHeight = 10
+	_, err = stateMachine.Transition(input)
+	assert.Nil(err)
+	assert.Equal(stateMachine.Forks, stateMachine.NewOverlay().Forks)
+
+	// Versions of other state machines aren't supported.
+	input.RawTransaction.Version = 4
+	_, err = stateMachine.Transition(input)
+	assert.Equal(ErrUnsupportedTxVersion, err)
+}
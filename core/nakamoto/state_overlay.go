@@ -0,0 +1,163 @@
+package nakamoto
+
+import (
+	"sync"
+)
+
+// The node keeps an executable state for each recent block on the main chain, and on the branches competing with it
+// near the tip, so a small reorg only executes the blocks of the new branch, rather than rebuilding the state from
+// genesis.
+//
+// Keeping a full copy of the state for each block would be too expensive, so the states are layered copy-on-write: an
+// overlay holds only the keys written by its block, and reads of other keys fall through to the state below it. A
+// state must not be changed once it has overlays. Since each layer adds a lookup to reads, chains of overlays are
+// flattened into a standalone state every MAX_STATE_OVERLAY_DEPTH layers.
+
+const (
+	// The number of blocks below the full tip whose states are kept.
+	STATE_CACHE_BLOCKS = 64
+	// The maximum number of overlays stacked on a standalone state.
+	MAX_STATE_OVERLAY_DEPTH = 16
+)
+
+// Returns a state layered over this one. The overlay reads through to this state, and keeps its writes to itself.
+func (c *StateMachine) NewOverlay() *StateMachine {
+	overlay, _ := NewStateMachine(nil)
+	overlay.CoinbaseMaturity = c.CoinbaseMaturity
+	overlay.Forks = c.Forks
+	overlay.parent = c
+	overlay.depth = c.depth + 1
+	return overlay
+}
+
+// Returns the number of states this state is layered over.
+func (c *StateMachine) Depth() int {
+	return c.depth
+}
+
+// Returns a standalone copy of the state, with its layers merged.
+func (c *StateMachine) Flatten() *StateMachine {
+	flat, _ := NewStateMachine(nil)
+	flat.CoinbaseMaturity = c.CoinbaseMaturity
+	flat.Forks = c.Forks
+	flat.state, flat.tokens, flat.tokenBalances = c.mergeLayers()
+	for _, layer := range c.layers() {
+		for account, entries := range layer.immature {
+			flat.immature[account] = entries
+		}
+	}
+	return flat
+}
+
+// Returns the layers of the state, bottom first.
+func (c *StateMachine) layers() []*StateMachine {
+	layers := make([]*StateMachine, c.depth+1)
+	for layer := c; layer != nil; layer = layer.parent {
+		layers[layer.depth] = layer
+	}
+	return layers
+}
+
+// Merges the balances and tokens of the state's layers. The maps of a standalone state are returned as they are.
+func (c *StateMachine) mergeLayers() (map[[65]byte]uint64, map[string]TokenInfo, map[string]map[[65]byte]uint64) {
+	if c.parent == nil {
+		return c.state, c.tokens, c.tokenBalances
+	}
+	state := make(map[[65]byte]uint64)
+	tokens := make(map[string]TokenInfo)
+	tokenBalances := make(map[string]map[[65]byte]uint64)
+	for _, layer := range c.layers() {
+		for account, balance := range layer.state {
+			state[account] = balance
+		}
+		for name, token := range layer.tokens {
+			tokens[name] = token
+		}
+		for name, balances := range layer.tokenBalances {
+			if tokenBalances[name] == nil {
+				tokenBalances[name] = make(map[[65]byte]uint64)
+			}
+			for account, balance := range balances {
+				tokenBalances[name][account] = balance
+			}
+		}
+	}
+	return state, tokens, tokenBalances
+}
+
+func (c *StateMachine) getBalance(account [65]byte) (uint64, bool) {
+	for layer := c; layer != nil; layer = layer.parent {
+		if balance, ok := layer.state[account]; ok {
+			return balance, true
+		}
+	}
+	return 0, false
+}
+
+func (c *StateMachine) getImmature(account [65]byte) ([]immatureCoinbase, bool) {
+	for layer := c; layer != nil; layer = layer.parent {
+		if entries, ok := layer.immature[account]; ok {
+			return entries, true
+		}
+	}
+	return nil, false
+}
+
+func (c *StateMachine) getTokenBalance(name string, account [65]byte) (uint64, bool) {
+	for layer := c; layer != nil; layer = layer.parent {
+		if balance, ok := layer.tokenBalances[name][account]; ok {
+			return balance, true
+		}
+	}
+	return 0, false
+}
+
+// The states of recent blocks, by block hash.
+type StateCache struct {
+	states map[[32]byte]cachedState
+	mutex  sync.Mutex
+}
+
+type cachedState struct {
+	height uint64
+	state  *StateMachine
+}
+
+func NewStateCache() *StateCache {
+	return &StateCache{
+		states: make(map[[32]byte]cachedState),
+	}
+}
+
+// Returns the state after a block, if it's cached.
+func (s *StateCache) Get(hash [32]byte) (*StateMachine, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cached, ok := s.states[hash]
+	return cached.state, ok
+}
+
+// Caches the state after a block. The state must not be changed afterwards.
+func (s *StateCache) Put(block Block, state *StateMachine) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.states[block.Hash] = cachedState{height: block.Height, state: state}
+}
+
+// Forgets the states of blocks below a height.
+func (s *StateCache) Prune(height uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for hash, cached := range s.states {
+		if cached.height < height {
+			delete(s.states, hash)
+		}
+	}
+}
+
+// Returns the number of cached states.
+func (s *StateCache) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.states)
+}
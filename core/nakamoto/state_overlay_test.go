@@ -0,0 +1,111 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateOverlay(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	alice := wallets[0].PubkeyBytes()
+	bob := wallets[1].PubkeyBytes()
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base.CoinbaseMaturity = 10
+	base.Apply([]*StateLeaf{
+		{PubKey: alice, Balance: 1000},
+		{PubKey: alice, Token: "TKN", Balance: 50, TokenSupply: 50},
+	})
+	baseRoot := base.StateRoot()
+	block := Block{
+		Height: 1,
+		Transactions: []RawTransaction{
+			MakeCoinbaseTx(minerWallet),
+			MakeTransferTx(alice, bob, 100, &wallets[0], 0),
+			MakeTokenTransferTx("TKN", bob, 20, &wallets[0], 0),
+		},
+	}
+
+	// Competing branches each execute on their own overlay.
+	a := base.NewOverlay()
+	assert.Nil(a.ExecuteBlock(block))
+	b := base.NewOverlay()
+	block.Transactions = block.Transactions[:2]
+	block.Transactions[1] = MakeTransferTx(alice, bob, 300, &wallets[0], 0)
+	assert.Nil(b.ExecuteBlock(block))
+
+	assert.Equal(uint64(900), a.GetBalance(alice))
+	assert.Equal(uint64(20), a.GetTokenBalance("TKN", bob))
+	assert.Equal(uint64(700), b.GetBalance(alice))
+	assert.Equal(uint64(0), b.GetTokenBalance("TKN", bob))
+	assert.Equal(uint64(1000), base.GetBalance(alice))
+	assert.Equal(baseRoot, base.StateRoot())
+	assert.Equal(1, a.Depth())
+
+	// Overlays stack, and flatten to the same state.
+	c := a.NewOverlay()
+	c.Apply([]*StateLeaf{{PubKey: bob, Balance: 5}})
+	flat := c.Flatten()
+	assert.Equal(0, flat.Depth())
+	assert.Equal(c.StateRoot(), flat.StateRoot())
+	assert.Equal(uint64(5), flat.GetBalance(bob))
+	assert.Equal(uint64(30), flat.GetTokenBalance("TKN", alice))
+	assert.Equal(c.GetSpendableBalance(minerWallet.PubkeyBytes(), 5), flat.GetSpendableBalance(minerWallet.PubkeyBytes(), 5))
+	assert.Equal(uint64(100), a.GetBalance(bob))
+
+	// Reverting an overlay doesn't touch the state below it.
+	snapshot := c.Snapshot()
+	c.Apply([]*StateLeaf{{PubKey: alice, Balance: 1}, {PubKey: alice, Token: "TKN", Balance: 1}})
+	assert.Nil(c.RevertTo(snapshot))
+	assert.Equal(uint64(900), c.GetBalance(alice))
+	assert.Equal(uint64(30), c.GetTokenBalance("TKN", alice))
+	assert.Equal(flat.StateRoot(), c.StateRoot())
+}
+
+func TestNodeStateCache(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	hashes := [][32]byte{}
+	node.Miner.OnBlockSolution = func(block RawBlock) {
+		if err := node.Dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, block.Hash())
+	}
+	miner := wallets[0].PubkeyBytes()
+	reward := MakeCoinbaseTx(&wallets[0]).Amount
+
+	node.Miner.Start(3)
+	assert.Equal(3, node.StateCache.Len())
+	assert.Equal(3*reward, node.StateMachine1.GetBalance(miner))
+
+	// A reorg continues from the cached state of the fork point.
+	assert.Nil(node.Dag.InvalidateBlock(hashes[2]))
+	cached, ok := node.StateCache.Get(hashes[1])
+	assert.True(ok)
+	assert.Same(cached, node.StateMachine1)
+	assert.Equal(2*reward, node.StateMachine1.GetBalance(miner))
+	node.Miner.Start(2)
+	assert.Equal(4*reward, node.StateMachine1.GetBalance(miner))
+	assert.Equal(5, node.StateCache.Len())
+
+	// And matches a rebuild from genesis.
+	root := node.StateMachine1.StateRoot()
+	node.StateCache = NewStateCache()
+	assert.Nil(node.rebuildState())
+	assert.Equal(root, node.StateMachine1.StateRoot())
+}
@@ -0,0 +1,227 @@
+package nakamoto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// An account statement reports an account's balance, and its full transaction history on the main chain, as of a block,
+// for audits and proof-of-funds attestations (eg. an exchange proving its reserves).
+//
+// The node generates the statement, and the account's owner signs it with the account's key, attesting they control
+// the funds. The statement is self-contained: each transaction comes with a Merkle proof of its inclusion in its block,
+// and, once the header_history fork is active, a proof that its block is an ancestor of the statement's block (see
+// history.go). So an auditor who trusts only the statement block's hash, eg. by checking it's on the main chain of their
+// own node, can verify the history offline with VerifyAccountStatement.
+//
+// Block headers don't commit to the state, so the balance isn't proven. It's the balance the node reconstructed as of
+// the block (see state_at.go), and auditors who need it proven must recompute it from a node they trust.
+
+var ErrInvalidStatement = errors.New("invalid account statement")
+
+// A transaction in an account statement.
+type StatementEntry struct {
+	Tx        RawTransaction `json:"tx"`
+	TxHash    [32]byte       `json:"tx_hash"`
+	BlockHash [32]byte       `json:"block_hash"`
+	Height    uint64         `json:"height"`
+	TxIndex   uint64         `json:"tx_index"`
+	// The transactions merkle root of the block, and the number of transactions in it.
+	MerkleRoot      [32]byte `json:"merkle_root"`
+	NumTransactions uint64   `json:"num_transactions"`
+	// The proof of the transaction's inclusion in the block.
+	MerkleProof [][32]byte `json:"merkle_proof"`
+	// The proof the block is an ancestor of the statement's block, if the block has a history root and isn't the
+	// statement's block.
+	AncestryProof *AncestryProof `json:"ancestry_proof,omitempty"`
+}
+
+type AccountStatement struct {
+	Account [65]byte `json:"account"`
+	// The block the statement is as of.
+	BlockHash [32]byte    `json:"block_hash"`
+	Header    BlockHeader `json:"header"`
+	Height    uint64      `json:"height"`
+	Balance   uint64      `json:"balance"`
+	// The account's transactions on the main chain up to and including the block, oldest first.
+	Transactions []StatementEntry `json:"transactions"`
+	// The signature of the account over the statement's digest, if signed.
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// Generates the statement of an account as of a block on the main chain. The statement is unsigned.
+func (n *Node) GetAccountStatement(account [65]byte, blockHash [32]byte) (AccountStatement, error) {
+	block, err := n.Dag.GetBlockByHash(blockHash)
+	if err != nil {
+		return AccountStatement{}, err
+	}
+	if block == nil {
+		return AccountStatement{}, fmt.Errorf("Block not found: %x", blockHash)
+	}
+	mainChainBlock, err := n.Dag.GetMainChainBlockAt(block.Height)
+	if err != nil {
+		return AccountStatement{}, err
+	}
+	if mainChainBlock == nil || mainChainBlock.Hash != blockHash {
+		return AccountStatement{}, fmt.Errorf("Block %x is not on the main chain.", blockHash)
+	}
+
+	balance, err := n.GetBalanceAt(account, blockHash)
+	if err != nil {
+		return AccountStatement{}, err
+	}
+	statement := AccountStatement{
+		Account:      account,
+		BlockHash:    blockHash,
+		Header:       block.ToBlockHeader(),
+		Height:       block.Height,
+		Balance:      balance,
+		Transactions: []StatementEntry{},
+	}
+
+	// Read the history a page at a time, newest first.
+	const pageSize = 1000
+	history := []AddressHistoryEntry{}
+	for offset := uint64(0); ; offset += pageSize {
+		page, err := n.Dag.GetAddressHistoryPage(account, offset, pageSize)
+		if err != nil {
+			return AccountStatement{}, err
+		}
+		history = append(history, page...)
+		if len(page) < pageSize {
+			break
+		}
+	}
+
+	// Prove each transaction up to the block, oldest first.
+	blocks := map[[32]byte]*Block{}
+	for i := len(history) - 1; 0 <= i; i-- {
+		entry := history[i]
+		if block.Height < entry.Height {
+			continue
+		}
+		txBlock, ok := blocks[entry.BlockHash]
+		if !ok {
+			txBlock, err = n.Dag.getBlockWithTransactions(entry.BlockHash)
+			if err != nil {
+				return AccountStatement{}, err
+			}
+			blocks[entry.BlockHash] = txBlock
+		}
+		if uint64(len(txBlock.Transactions)) <= entry.TxIndex {
+			return AccountStatement{}, fmt.Errorf("Block %x hasn't been downloaded in full.", entry.BlockHash)
+		}
+
+		envelopes := [][]byte{}
+		for _, tx := range txBlock.Transactions {
+			envelopes = append(envelopes, tx.Envelope())
+		}
+		statementEntry := StatementEntry{
+			Tx:              txBlock.Transactions[entry.TxIndex],
+			TxHash:          entry.TxHash,
+			BlockHash:       entry.BlockHash,
+			Height:          entry.Height,
+			TxIndex:         entry.TxIndex,
+			MerkleRoot:      txBlock.TransactionsMerkleRoot,
+			NumTransactions: txBlock.NumTransactions,
+			MerkleProof:     core.ComputeMerkleProof(envelopes, int(entry.TxIndex)),
+		}
+		if block.HistoryRoot != [32]byte{} && entry.BlockHash != blockHash {
+			proof, err := n.Dag.GetAncestryProof(entry.BlockHash, blockHash)
+			if err != nil {
+				return AccountStatement{}, err
+			}
+			statementEntry.AncestryProof = &proof
+		}
+		statement.Transactions = append(statement.Transactions, statementEntry)
+	}
+	return statement, nil
+}
+
+// The digest of a statement, which is signed. It's the hash of the statement's canonical JSON without the signature, so
+// other implementations can verify it.
+func (s AccountStatement) Digest() ([32]byte, error) {
+	s.Signature = nil
+	buf, err := core.CanonicalJSON(s)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(buf), nil
+}
+
+// Signs a statement with the account's wallet.
+func SignAccountStatement(statement *AccountStatement, wallet *core.Wallet) error {
+	if wallet.PubkeyBytes() != statement.Account {
+		return fmt.Errorf("Wallet %s is not the account of the statement.", wallet.PubkeyStr())
+	}
+	digest, err := statement.Digest()
+	if err != nil {
+		return err
+	}
+	sig, err := wallet.Sign(digest[:])
+	if err != nil {
+		return err
+	}
+	statement.Signature = sig
+	return nil
+}
+
+// Verifies a statement is signed by its account, and that its transactions are proven to be in the history of its
+// block. The block's hash must be checked against a trusted chain separately.
+func VerifyAccountStatement(statement AccountStatement) error {
+	if statement.Header.BlockHash() != statement.BlockHash {
+		return fmt.Errorf("%w: header doesn't match the block hash", ErrInvalidStatement)
+	}
+	digest, err := statement.Digest()
+	if err != nil {
+		return err
+	}
+	if !core.VerifySignature(hex.EncodeToString(statement.Account[:]), statement.Signature, digest[:]) {
+		return fmt.Errorf("%w: not signed by the account", ErrInvalidStatement)
+	}
+
+	for i, entry := range statement.Transactions {
+		if entry.Tx.Hash() != entry.TxHash {
+			return fmt.Errorf("%w: transaction %d doesn't match its hash", ErrInvalidStatement, i)
+		}
+		if entry.Tx.FromPubkey != statement.Account && entry.Tx.ToPubkey != statement.Account {
+			return fmt.Errorf("%w: transaction %d doesn't involve the account", ErrInvalidStatement, i)
+		}
+		if statement.Height < entry.Height {
+			return fmt.Errorf("%w: transaction %d is after the statement's block", ErrInvalidStatement, i)
+		}
+		if !core.VerifyMerkleProof(entry.Tx.Envelope(), int(entry.TxIndex), int(entry.NumTransactions), entry.MerkleProof, entry.MerkleRoot) {
+			return fmt.Errorf("%w: transaction %d isn't in its block", ErrInvalidStatement, i)
+		}
+
+		// Link the transaction's block to the statement's block.
+		if entry.BlockHash == statement.BlockHash {
+			if entry.MerkleRoot != statement.Header.TransactionsMerkleRoot || entry.NumTransactions != statement.Header.NumTransactions {
+				return fmt.Errorf("%w: transaction %d isn't in the statement's block", ErrInvalidStatement, i)
+			}
+			continue
+		}
+		if entry.AncestryProof == nil {
+			// Blocks before the header_history fork can't be proven.
+			if statement.Header.HistoryRoot != [32]byte{} {
+				return fmt.Errorf("%w: transaction %d is missing an ancestry proof", ErrInvalidStatement, i)
+			}
+			continue
+		}
+		proof := entry.AncestryProof
+		if proof.Header.BlockHash() != entry.BlockHash || proof.Height != entry.Height {
+			return fmt.Errorf("%w: transaction %d's ancestry proof is for another block", ErrInvalidStatement, i)
+		}
+		if proof.Header.TransactionsMerkleRoot != entry.MerkleRoot || proof.Header.NumTransactions != entry.NumTransactions {
+			return fmt.Errorf("%w: transaction %d's merkle root doesn't match its block", ErrInvalidStatement, i)
+		}
+		if err := VerifyAncestryProof(*proof, statement.Header); err != nil {
+			return fmt.Errorf("%w: transaction %d: %s", ErrInvalidStatement, i, err)
+		}
+	}
+	return nil
+}
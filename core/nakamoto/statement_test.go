@@ -0,0 +1,82 @@
+package nakamoto
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountStatement(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	dag.consensus.Forks = map[string]uint64{FORK_HEADER_HISTORY: 2}
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	node.Miner.OnBlockSolution = func(block RawBlock) {
+		if err := node.Dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	account := wallets[0].PubkeyBytes()
+	node.Miner.Start(2)
+	assert.Nil(node.Mempool.AddTransaction(makePackageTx(t, &wallets[0], 0, 2)))
+	node.Miner.Start(2)
+
+	// The statement lists the coinbases and the transfer, oldest first, with the balance as of the block.
+	statement, err := node.GetAccountStatement(account, node.Dag.FullTip.Hash)
+	assert.Nil(err)
+	assert.Equal(node.StateMachine1.GetBalance(account), statement.Balance)
+	assert.Equal(5, len(statement.Transactions))
+	assert.Equal(uint64(1), statement.Transactions[0].Height)
+	assert.Equal(account, statement.Transactions[3].Tx.FromPubkey)
+	assert.Equal(uint64(4), statement.Transactions[4].Height)
+
+	// Transactions in earlier blocks are proven to be ancestors of the statement's block.
+	assert.NotNil(statement.Transactions[0].AncestryProof)
+	assert.Nil(statement.Transactions[4].AncestryProof)
+
+	// Statements must be signed by the account.
+	assert.ErrorIs(VerifyAccountStatement(statement), ErrInvalidStatement)
+	assert.NotNil(SignAccountStatement(&statement, &wallets[1]))
+	assert.Nil(SignAccountStatement(&statement, &wallets[0]))
+	assert.Nil(VerifyAccountStatement(statement))
+
+	// And survive encoding.
+	buf, err := json.Marshal(statement)
+	assert.Nil(err)
+	decoded := AccountStatement{}
+	assert.Nil(json.Unmarshal(buf, &decoded))
+	assert.Nil(VerifyAccountStatement(decoded))
+
+	// Tampering is caught.
+	tampered := decoded
+	tampered.Balance++
+	assert.ErrorContains(VerifyAccountStatement(tampered), "not signed by the account")
+	assert.Nil(json.Unmarshal(buf, &tampered))
+	tampered.Transactions[3].TxIndex = 0
+	assert.Nil(SignAccountStatement(&tampered, &wallets[0]))
+	assert.ErrorContains(VerifyAccountStatement(tampered), "isn't in its block")
+	assert.Nil(json.Unmarshal(buf, &tampered))
+	tampered.Transactions = tampered.Transactions[1:]
+	tampered.Transactions[0].AncestryProof.Height = 0
+	assert.Nil(SignAccountStatement(&tampered, &wallets[0]))
+	assert.ErrorContains(VerifyAccountStatement(tampered), "ancestry proof is for another block")
+
+	// A statement as of an earlier block excludes the later transactions.
+	earlier, err := node.Dag.GetMainChainBlockAt(2)
+	assert.Nil(err)
+	statement, err = node.GetAccountStatement(account, earlier.Hash)
+	assert.Nil(err)
+	assert.Equal(2, len(statement.Transactions))
+	assert.Nil(SignAccountStatement(&statement, &wallets[0]))
+	assert.Nil(VerifyAccountStatement(statement))
+
+	// Blocks off the main chain have no statement.
+	tip := node.Dag.FullTip.Hash
+	assert.Nil(node.Dag.InvalidateBlock(tip))
+	_, err = node.GetAccountStatement(account, tip)
+	assert.ErrorContains(err, "is not on the main chain")
+}
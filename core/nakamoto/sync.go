@@ -1,7 +1,10 @@
 package nakamoto
 
 import (
+	"errors"
 	"math/big"
+	"net/url"
+	"sort"
 	"sync"
 
 	"github.com/liamzebedee/tinychain-go/core"
@@ -66,8 +69,9 @@ func (n *Node) SyncDownloadData(fromNode [32]byte, heightMap core.Bitset, peers
 		workItems[i] = ChunkWorkItem{heights: *heights}
 	}
 
-	// Distribute the work items to our peers.
+	// Distribute the work items to our peers, preferring the fastest peers.
 	// TODO: queue work items only one per peer. if failure, return work item to queue for another peer to fill.
+	peers = sortPeersByLatency(peers)
 	for i, item := range workItems {
 		peer := peers[i%len(peers)]
 		go func(item ChunkWorkItem) {
@@ -90,6 +94,19 @@ func (n *Node) SyncDownloadData(fromNode [32]byte, heightMap core.Bitset, peers
 	return headers
 }
 
+// Sorts peers by their round-trip time, fastest first. Peers whose latency has not been measured are ordered last.
+func sortPeersByLatency(peers []Peer) []Peer {
+	sorted := make([]Peer, len(peers))
+	copy(sorted, peers)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].latency == 0 || sorted[j].latency == 0 {
+			return sorted[j].latency == 0 && sorted[i].latency != 0
+		}
+		return sorted[i].latency < sorted[j].latency
+	})
+	return sorted
+}
+
 // get_tip_at_height(dag_node_hash, depth) -> BlockHeader
 // get_headers(base_node, base_height, height_set) -> []BlockHeader
 // get_blocks(base_node, base_height, height_set) - > [][]Transaction
@@ -150,6 +167,37 @@ func getValidHeaderChain(root [32]byte, headers []BlockHeader) []BlockHeader {
 
 // Syncs the node with the network.
 //
+// How far the node has synced, relative to its headers and its peers.
+type SyncStatus struct {
+	FullTipHeight    uint64
+	HeadersTipHeight uint64
+	// The highest tip advertised by a peer.
+	BestPeerHeight uint64
+	// The share of the best known chain the node has the full blocks of, between 0 and 1.
+	Progress float64
+}
+
+// Returns how far the node has synced.
+func (n *Node) GetSyncStatus() (SyncStatus, error) {
+	headersTip, err := n.Dag.GetLatestHeadersTip()
+	if err != nil {
+		return SyncStatus{}, err
+	}
+	status := SyncStatus{FullTipHeight: n.Dag.FullTip.Height, HeadersTipHeight: headersTip.Height}
+	if n.Peer != nil {
+		for _, peer := range n.Peer.Peers() {
+			status.BestPeerHeight = max(status.BestPeerHeight, peer.tipHeight)
+		}
+	}
+
+	best := max(status.HeadersTipHeight, status.BestPeerHeight)
+	status.Progress = 1
+	if status.FullTipHeight < best {
+		status.Progress = float64(status.FullTipHeight) / float64(best)
+	}
+	return status, nil
+}
+
 // The blockchain sync algorithm is the most complex part of the system. The Nakamoto blockchain is defined simply as a linked list of blocks, where the canonical chain is the one with the most amount of work done on it. A blockchain network is composed of peers who disseminate blocks and transactions, and take turns in being the leader to mine a new block.
 // Due to the properties of the P2P network, namely asynchronicity, network partitions, and latency, it is possible for nodes to have different views of the blockchain. Thus in practice, in order to converge on the canonical chain, blockchain nodes must keep track of the block tree (a type of DAG), where there are multiple differing branches.
 //
@@ -169,6 +217,15 @@ func (n *Node) Sync() {
 	// TODO handle peers joining.
 	WINDOW_SIZE := 2048
 
+	currentTip, err := n.Dag.GetLatestHeadersTip()
+	if err != nil {
+		n.log.Printf("Failed to get latest tip: %s\n", err)
+		return
+	}
+
+	// Find the peers with heavier chains than ours from their checkpoints, before downloading any headers.
+	syncPeers := n.sync_selectPeersByCheckpoints(currentTip)
+
 	// Greedily searches the block DAG from a tip hash, downloading headers in parallel from peers from all subbranches up to a depth.
 	// The depth is referred to as the "window size", and is a constant value of 2048 blocks.
 	search := func(currentTipHash [32]byte) int {
@@ -177,7 +234,7 @@ func (n *Node) Sync() {
 		peersTips := make(map[[32]byte][]Peer)
 		depth := uint64(WINDOW_SIZE)
 
-		for _, peer := range n.Peer.peers {
+		for _, peer := range syncPeers {
 			tip, err := n.Peer.SyncGetTipAtDepth(peer, currentTipHash, depth)
 			if err != nil {
 				// Skip. Peer will not be used for downloading.
@@ -221,12 +278,6 @@ func (n *Node) Sync() {
 		return downloaded
 	}
 
-	currentTip, err := n.Dag.GetLatestHeadersTip()
-	if err != nil {
-		n.log.Printf("Failed to get latest tip: %s\n", err)
-		return
-	}
-
 	for {
 		// Search for headers from current tip.
 		downloaded := search(currentTip.Hash)
@@ -238,6 +289,38 @@ func (n *Node) Sync() {
 	}
 }
 
+// Gets the checkpoints of all our peers, and returns the peers whose chains are heavier than our tip, heaviest first.
+// Peers serving invalid checkpoints, or whose claimed work isn't backed by a sample of valid headers, are skipped in
+// favour of the next-heaviest peer. Peers which don't serve checkpoints are included last.
+func (n *Node) sync_selectPeersByCheckpoints(localTip Block) []Peer {
+	heavier := []Peer{}
+	unknown := []Peer{}
+	for _, result := range n.GetPeerCheckpoints(0) {
+		if errors.Is(result.Err, ErrInvalidCheckpoints) {
+			n.syncLog.Printf("Skipping peer with invalid checkpoints: peer=%s err=%s\n", result.Peer.url, result.Err)
+			continue
+		}
+		if result.Err != nil {
+			unknown = append(unknown, result.Peer)
+			continue
+		}
+		if result.AccumulatedWork.Cmp(&localTip.AccumulatedWork) <= 0 {
+			continue
+		}
+		if err := n.verifyPeerWork(result); err != nil {
+			n.syncLog.Printf("Skipping peer whose claimed work isn't backed: peer=%s err=%s\n", result.Peer.url, err)
+			if errors.Is(err, ErrUnbackedWork) {
+				if u, err := url.Parse(result.Peer.url); err == nil && u.Hostname() != "" {
+					n.Peer.Misbehaving(u.Hostname(), MISBEHAVIOUR_BAN_SCORE, "Claimed work not backed by valid headers")
+				}
+			}
+			continue
+		}
+		heavier = append(heavier, result.Peer)
+	}
+	return append(heavier, unknown...)
+}
+
 func (n *Node) rework() {
 
 }
@@ -248,15 +331,16 @@ func (n *Node) sync_getBestTipFromPeers() [32]byte {
 
 	// 1. Contact all our peers.
 	// 2. Get their current tips in parallel.
-	syncLog.Printf("Getting tips from %d peers...\n", len(n.Peer.peers))
+	peers := n.Peer.Peers()
+	syncLog.Printf("Getting tips from %d peers...\n", len(peers))
 
 	var wg sync.WaitGroup
 
 	tips := make([]BlockHeader, 0)
-	tipsChan := make(chan BlockHeader, len(n.Peer.peers))
+	tipsChan := make(chan BlockHeader, len(peers))
 	// timeout := time.After(5 * time.Second)
 
-	for _, peer := range n.Peer.peers {
+	for _, peer := range peers {
 		wg.Add(1)
 		go func(peer Peer) {
 			defer wg.Done()
@@ -0,0 +1,162 @@
+package nakamoto
+
+import (
+	"fmt"
+)
+
+// The miner builds on the full tip by default, the block with the most accumulated work. A block's work is derived from
+// its hash, so when two blocks are found on the same parent at about the same time, the one with the luckier hash wins,
+// regardless of which the network saw first. Miners can instead follow a tip selection policy among equal-work tips:
+// the blocks competing for the same height on the same parent, with the same difficulty.
+//
+//   - TIP_POLICY_MOST_WORK builds on the full tip.
+//   - TIP_POLICY_FIRST_SEEN builds on the competing block ingested first, like Bitcoin's first-seen rule, which
+//     discourages miners from withholding blocks to race them.
+//   - TIP_POLICY_LAST_SEEN builds on the competing block ingested last.
+//
+// With PreferOwnTransactions, competing blocks which include transactions sent by the miner's wallet are preferred over
+// those that don't, before the policy is applied, so the miner's own transactions are confirmed sooner.
+//
+// Blocks are ordered by when their full bodies were ingested. The mempool tracks the main chain, so blocks built on a
+// competing block other than the full tip only include the coinbase.
+
+const (
+	TIP_POLICY_MOST_WORK  = "most-work"
+	TIP_POLICY_FIRST_SEEN = "first-seen"
+	TIP_POLICY_LAST_SEEN  = "last-seen"
+)
+
+// Parses a tip selection policy.
+func ParseTipPolicy(policy string) (string, error) {
+	switch policy {
+	case TIP_POLICY_MOST_WORK, TIP_POLICY_FIRST_SEEN, TIP_POLICY_LAST_SEEN:
+		return policy, nil
+	}
+	return "", fmt.Errorf("Unknown tip policy: %s. Must be one of %s, %s or %s.", policy, TIP_POLICY_MOST_WORK, TIP_POLICY_FIRST_SEEN, TIP_POLICY_LAST_SEEN)
+}
+
+// Gets the valid, fully downloaded blocks competing with a tip for its height: the tip, and its siblings without
+// children at the same difficulty. Returned in the order they were ingested.
+func (dag *BlockDAG) GetCompetingTips(tip Block) ([]Block, error) {
+	rows, err := dag.db.Query(`
+		select hash from blocks b
+		where b.hash = ? or (
+			b.parent_hash = ? and b.invalid = 0
+			and not exists (select 1 from blocks c where c.parent_hash = b.hash)
+			and b.num_transactions = (select count(*) from transactions_blocks tb where tb.block_hash = b.hash)
+		)
+		order by rowid`,
+		tip.Hash[:],
+		tip.ParentHash[:],
+	)
+	if err != nil {
+		return nil, err
+	}
+	hashes := [][32]byte{}
+	for rows.Next() {
+		hashBuf := []byte{}
+		if err := rows.Scan(&hashBuf); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hash := [32]byte{}
+		copy(hash[:], hashBuf)
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	tipEpoch, err := dag.GetEpochForBlockHash(tip.Hash)
+	if err != nil {
+		return nil, err
+	}
+	tips := []Block{}
+	for _, hash := range hashes {
+		block, err := dag.GetBlockByHash(hash)
+		if err != nil {
+			return nil, err
+		}
+		if block == nil {
+			continue
+		}
+		epoch, err := dag.GetEpochForBlockHash(hash)
+		if err != nil {
+			return nil, err
+		}
+		if epoch.Difficulty.Cmp(&tipEpoch.Difficulty) != 0 {
+			continue
+		}
+		tips = append(tips, *block)
+	}
+	return tips, nil
+}
+
+// Counts the transactions in a block sent from an account, excluding the coinbase.
+func (dag *BlockDAG) countTransactionsFrom(hash [32]byte, from [65]byte) (int, error) {
+	count := 0
+	err := dag.db.QueryRow(`
+		select count(*) from transactions_blocks tb
+		join transactions t on t.hash = tb.transaction_hash
+		where tb.block_hash = ? and 0 < tb.txindex and t.from_pubkey = ?`,
+		hash[:],
+		from[:],
+	).Scan(&count)
+	return count, err
+}
+
+// Selects the tip to mine on, following the miner's tip selection policy. Returns the selected tip, and the full tip.
+func (node *Miner) selectTip() (Block, Block, error) {
+	tip, err := node.dag.GetLatestFullTip()
+	if err != nil {
+		return Block{}, Block{}, err
+	}
+	selected, err := node.selectCompetingTip(tip)
+	return selected, tip, err
+}
+
+func (node *Miner) selectCompetingTip(tip Block) (Block, error) {
+	policy, preferOwn := node.TipPolicy()
+	if policy == TIP_POLICY_MOST_WORK && !preferOwn {
+		return tip, nil
+	}
+
+	candidates, err := node.dag.GetCompetingTips(tip)
+	if err != nil {
+		return Block{}, err
+	}
+	if len(candidates) < 2 {
+		return tip, nil
+	}
+
+	if preferOwn {
+		own := []Block{}
+		for _, candidate := range candidates {
+			count, err := node.dag.countTransactionsFrom(candidate.Hash, node.minerWallet.PubkeyBytes())
+			if err != nil {
+				return Block{}, err
+			}
+			if 0 < count {
+				own = append(own, candidate)
+			}
+		}
+		if 0 < len(own) {
+			candidates = own
+		}
+	}
+
+	switch policy {
+	case TIP_POLICY_FIRST_SEEN:
+		return candidates[0], nil
+	case TIP_POLICY_LAST_SEEN:
+		return candidates[len(candidates)-1], nil
+	}
+	best := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if best.AccumulatedWork.Cmp(&candidate.AccumulatedWork) < 0 {
+			best = candidate
+		}
+	}
+	return best, nil
+}
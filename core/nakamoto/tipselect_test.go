@@ -0,0 +1,63 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinerTipPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForMiner()
+	wallets := getTestingWallets(t)
+	miner := NewMiner(dag, &wallets[0])
+	mined := []RawBlock{}
+	miner.OnBlockSolution = func(block RawBlock) {
+		mined = append(mined, block)
+	}
+	miner.Start(1)
+	assert.Nil(dag.IngestBlock(mined[0]))
+
+	// Two blocks compete for height 2. The second includes a transaction sent by the miner.
+	miner.Start(1)
+	mempool := NewMempool()
+	assert.Nil(mempool.AddPackage([]*Transaction{makePackageTx(t, &wallets[0], 0, 2)}))
+	miner.Mempool = mempool
+	miner.Start(1)
+	first, second := mined[1], mined[2]
+	assert.Equal(first.ParentHash, second.ParentHash)
+	assert.Nil(dag.IngestBlock(first))
+	assert.Nil(dag.IngestBlock(second))
+
+	tips, err := dag.GetCompetingTips(dag.FullTip)
+	assert.Nil(err)
+	assert.Equal([][32]byte{first.Hash(), second.Hash()}, [][32]byte{tips[0].Hash, tips[1].Hash})
+
+	// Returns the tip the puzzle builds on, and checks blocks built on a competing block include only the coinbase.
+	puzzleTip := func() [32]byte {
+		puzzle := miner.MakeNewPuzzle()
+		assert.Equal(puzzle.block.ParentHash, miner.MiningTip())
+		if puzzle.block.ParentHash != dag.FullTip.Hash {
+			assert.Equal(1, len(puzzle.block.Transactions))
+		}
+		return puzzle.block.ParentHash
+	}
+
+	assert.Equal(dag.FullTip.Hash, puzzleTip())
+	assert.Nil(miner.SetTipPolicy(TIP_POLICY_FIRST_SEEN, false))
+	assert.Equal(first.Hash(), puzzleTip())
+	assert.Nil(miner.SetTipPolicy(TIP_POLICY_LAST_SEEN, false))
+	assert.Equal(second.Hash(), puzzleTip())
+
+	// Tips including the miner's own transactions are preferred.
+	assert.Nil(miner.SetTipPolicy(TIP_POLICY_FIRST_SEEN, true))
+	assert.Equal(second.Hash(), puzzleTip())
+	assert.Nil(miner.SetTipPolicy(TIP_POLICY_MOST_WORK, true))
+	assert.Equal(second.Hash(), puzzleTip())
+	policy, preferOwn := miner.TipPolicy()
+	assert.Equal(TIP_POLICY_MOST_WORK, policy)
+	assert.True(preferOwn)
+
+	assert.NotNil(miner.SetTipPolicy("random", false))
+}
@@ -0,0 +1,185 @@
+package nakamoto
+
+import (
+	"errors"
+	"math/bits"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// Tokens are named assets with a fixed supply, which live alongside the native coin, so private networks can model
+// multiple assets.
+//
+// A token is issued by a version 3 transaction with the issue operation, which credits the whole supply (the amount) to
+// the issuer. Token names are unique, and the supply can never be increased. Token balances are moved by transactions
+// with the transfer operation, whose amount is in units of the token. Either way, the fee is paid in the native coin.
+//
+// Each token's balances are tracked in their own keyspace in the state machine, and are committed to in the state root
+// along with the native balances (see StateMachine.StateRoot).
+
+const (
+	TOKEN_OP_NONE     = 0
+	TOKEN_OP_ISSUE    = 1
+	TOKEN_OP_TRANSFER = 2
+
+	MAX_TOKEN_NAME_LENGTH = 32
+)
+
+var ErrInvalidTokenOp = errors.New("invalid token operation")
+var ErrInvalidTokenName = errors.New("invalid token name")
+var ErrInvalidTokenSupply = errors.New("invalid token supply")
+var ErrTokenExists = errors.New("token already exists")
+var ErrUnknownToken = errors.New("unknown token")
+var ErrInsufficientTokenBalance = errors.New("insufficient token balance")
+
+type TokenInfo struct {
+	Name string
+	// The account the supply was issued to.
+	Issuer [65]byte
+	Supply uint64
+}
+
+// Token names are 1 to 32 characters of letters, digits, dashes and underscores.
+func ValidTokenName(name string) bool {
+	if len(name) == 0 || MAX_TOKEN_NAME_LENGTH < len(name) {
+		return false
+	}
+	for _, c := range name {
+		valid := ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || c == '-' || c == '_'
+		if !valid {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks the token operation of a transaction is well-formed. Transactions before version 3 have no token operation.
+func VerifyTokenOp(tx RawTransaction) error {
+	switch {
+	case tx.TokenOp == TOKEN_OP_NONE:
+		if tx.Token != "" {
+			return ErrInvalidTokenOp
+		}
+		return nil
+	case tx.Version < 3:
+		return ErrInvalidTokenOp
+	case tx.TokenOp != TOKEN_OP_ISSUE && tx.TokenOp != TOKEN_OP_TRANSFER:
+		return ErrInvalidTokenOp
+	case !ValidTokenName(tx.Token):
+		return ErrInvalidTokenName
+	case tx.TokenOp == TOKEN_OP_ISSUE && (tx.Amount == 0 || tx.ToPubkey != tx.FromPubkey):
+		return ErrInvalidTokenSupply
+	}
+	return nil
+}
+
+func (c *StateMachine) transitionToken(input StateMachineInput) ([]*StateLeaf, error) {
+	tx := input.RawTransaction
+	fromBalance := c.GetBalance(tx.FromPubkey)
+	minerBalance := c.GetBalance(input.MinerPubkey)
+
+	// The fee is paid in the native coin, with the base fee portion burned, like a regular transfer.
+	if _, carry := bits.Add64(minerBalance, tx.Fee, 0); carry != 0 {
+		return nil, ErrMinerBalanceOverflow
+	}
+	burn := input.BaseFee * tx.SizeBytes()
+	if tx.Fee < burn {
+		return nil, ErrFeeBelowBaseFee
+	}
+	tip := tx.Fee - burn
+	if fromBalance < tx.Fee {
+		return nil, ErrInsufficientBalance
+	}
+	if c.GetSpendableBalance(tx.FromPubkey, input.BlockHeight) < tx.Fee {
+		return nil, ErrImmatureCoinbaseSpend
+	}
+
+	leaves := []*StateLeaf{
+		{
+			PubKey:  tx.FromPubkey,
+			Balance: fromBalance - tx.Fee,
+		},
+		{
+			PubKey:         input.MinerPubkey,
+			Balance:        minerBalance + tip,
+			CoinbaseAmount: tip,
+			CoinbaseHeight: input.BlockHeight,
+		},
+	}
+
+	switch tx.TokenOp {
+	case TOKEN_OP_ISSUE:
+		if _, ok := c.GetToken(tx.Token); ok {
+			return nil, ErrTokenExists
+		}
+		leaves = append(leaves, &StateLeaf{
+			PubKey:      tx.FromPubkey,
+			Token:       tx.Token,
+			Balance:     tx.Amount,
+			TokenSupply: tx.Amount,
+		})
+
+	case TOKEN_OP_TRANSFER:
+		if _, ok := c.GetToken(tx.Token); !ok {
+			return nil, ErrUnknownToken
+		}
+		fromTokens := c.GetTokenBalance(tx.Token, tx.FromPubkey)
+		if fromTokens < tx.Amount {
+			return nil, ErrInsufficientTokenBalance
+		}
+		if tx.FromPubkey == tx.ToPubkey {
+			break
+		}
+		toTokens := c.GetTokenBalance(tx.Token, tx.ToPubkey)
+		if _, carry := bits.Add64(toTokens, tx.Amount, 0); carry != 0 {
+			return nil, ErrToBalanceOverflow
+		}
+		leaves = append(leaves,
+			&StateLeaf{PubKey: tx.FromPubkey, Token: tx.Token, Balance: fromTokens - tx.Amount},
+			&StateLeaf{PubKey: tx.ToPubkey, Token: tx.Token, Balance: toTokens + tx.Amount},
+		)
+	}
+	return leaves, nil
+}
+
+func (c *StateMachine) GetToken(name string) (TokenInfo, bool) {
+	for layer := c; layer != nil; layer = layer.parent {
+		if token, ok := layer.tokens[name]; ok {
+			return token, true
+		}
+	}
+	return TokenInfo{}, false
+}
+
+func (c *StateMachine) GetTokenBalance(name string, account [65]byte) uint64 {
+	balance, _ := c.getTokenBalance(name, account)
+	return balance
+}
+
+// Makes a transaction issuing a token, with the whole supply credited to the wallet.
+func MakeTokenIssueTx(name string, supply uint64, wallet *core.Wallet, fee uint64) RawTransaction {
+	return makeTokenTx(TOKEN_OP_ISSUE, name, wallet.PubkeyBytes(), supply, wallet, fee)
+}
+
+// Makes a transaction transferring an amount of a token from the wallet.
+func MakeTokenTransferTx(name string, to [65]byte, amount uint64, wallet *core.Wallet, fee uint64) RawTransaction {
+	return makeTokenTx(TOKEN_OP_TRANSFER, name, to, amount, wallet, fee)
+}
+
+func makeTokenTx(op byte, name string, to [65]byte, amount uint64, wallet *core.Wallet, fee uint64) RawTransaction {
+	tx := RawTransaction{
+		Version:    3,
+		FromPubkey: wallet.PubkeyBytes(),
+		ToPubkey:   to,
+		Amount:     amount,
+		Fee:        fee,
+		TokenOp:    op,
+		Token:      name,
+	}
+	sig, err := wallet.Sign(tx.Envelope())
+	if err != nil {
+		panic(err)
+	}
+	copy(tx.Sig[:], sig)
+	return tx
+}
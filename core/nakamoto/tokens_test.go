@@ -0,0 +1,100 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyTokenOp(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	a, b := wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes()
+
+	assert.Nil(VerifyTokenOp(MakeTokenIssueTx("GOLD", 1000, &wallets[0], 0)))
+	assert.Nil(VerifyTokenOp(MakeTokenTransferTx("GOLD", b, 10, &wallets[0], 0)))
+	assert.Nil(VerifyTokenOp(MakeTransferTx(a, b, 10, &wallets[0], 0)))
+
+	assert.Equal(ErrInvalidTokenName, VerifyTokenOp(MakeTokenIssueTx("", 1000, &wallets[0], 0)))
+	assert.Equal(ErrInvalidTokenName, VerifyTokenOp(MakeTokenIssueTx("GOLD BARS", 1000, &wallets[0], 0)))
+	assert.Equal(ErrInvalidTokenName, VerifyTokenOp(MakeTokenIssueTx("0123456789012345678901234567890123", 1000, &wallets[0], 0)))
+	assert.Equal(ErrInvalidTokenSupply, VerifyTokenOp(MakeTokenIssueTx("GOLD", 0, &wallets[0], 0)))
+
+	// Only version 3 transactions have token operations.
+	tx := MakeTokenTransferTx("GOLD", b, 10, &wallets[0], 0)
+	tx.Version = 2
+	assert.Equal(ErrInvalidTokenOp, VerifyTokenOp(tx))
+	tx = MakeTransferTx(a, b, 10, &wallets[0], 0)
+	tx.Token = "GOLD"
+	assert.Equal(ErrInvalidTokenOp, VerifyTokenOp(tx))
+	tx = MakeTokenTransferTx("GOLD", b, 10, &wallets[0], 0)
+	tx.TokenOp = 9
+	assert.Equal(ErrInvalidTokenOp, VerifyTokenOp(tx))
+
+	// The token operation is signed.
+	issue := MakeTokenIssueTx("GOLD", 1000, &wallets[0], 0)
+	silver := issue
+	silver.Token = "SILVER"
+	assert.NotEqual(issue.Envelope(), silver.Envelope())
+	assert.Equal(issue.SizeBytes(), uint64(len(issue.Bytes())-64))
+}
+
+func TestStateMachineTokens(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	issuer, holder := wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes()
+	miner := [65]byte{9}
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.Apply([]*StateLeaf{{PubKey: issuer, Balance: 1000}})
+	emptyRoot := stateMachine.StateRoot()
+
+	transition := func(tx RawTransaction) error {
+		effects, err := stateMachine.Transition(StateMachineInput{RawTransaction: tx, MinerPubkey: miner})
+		if err == nil {
+			stateMachine.Apply(effects)
+		}
+		return err
+	}
+
+	// Transfers of unknown tokens fail.
+	assert.Equal(ErrUnknownToken, transition(MakeTokenTransferTx("GOLD", holder, 10, &wallets[0], 0)))
+
+	// Issue the token. The fee is paid in the native coin.
+	assert.Nil(transition(MakeTokenIssueTx("GOLD", 500, &wallets[0], 5)))
+	token, ok := stateMachine.GetToken("GOLD")
+	assert.True(ok)
+	assert.Equal(TokenInfo{Name: "GOLD", Issuer: issuer, Supply: 500}, token)
+	assert.Equal(uint64(500), stateMachine.GetTokenBalance("GOLD", issuer))
+	assert.Equal(uint64(995), stateMachine.GetBalance(issuer))
+	assert.Equal(uint64(5), stateMachine.GetBalance(miner))
+
+	// The supply is fixed.
+	assert.Equal(ErrTokenExists, transition(MakeTokenIssueTx("GOLD", 500, &wallets[1], 0)))
+
+	// Transfer the token.
+	assert.Nil(transition(MakeTokenTransferTx("GOLD", holder, 200, &wallets[0], 0)))
+	assert.Equal(uint64(300), stateMachine.GetTokenBalance("GOLD", issuer))
+	assert.Equal(uint64(200), stateMachine.GetTokenBalance("GOLD", holder))
+	assert.Equal(ErrInsufficientTokenBalance, transition(MakeTokenTransferTx("GOLD", issuer, 201, &wallets[1], 0)))
+
+	// Self-transfers don't change the balance.
+	assert.Nil(transition(MakeTokenTransferTx("GOLD", holder, 200, &wallets[1], 0)))
+	assert.Equal(uint64(200), stateMachine.GetTokenBalance("GOLD", holder))
+
+	// The fee must be covered by the native balance.
+	assert.Equal(ErrInsufficientBalance, transition(MakeTokenTransferTx("GOLD", issuer, 1, &wallets[1], 1)))
+
+	// Token balances are committed to in the state root.
+	root := stateMachine.StateRoot()
+	assert.NotEqual(emptyRoot, root)
+	assert.Equal(root, stateMachine.StateRoot())
+	assert.Nil(transition(MakeTokenTransferTx("GOLD", issuer, 1, &wallets[1], 0)))
+	assert.NotEqual(root, stateMachine.StateRoot())
+	assert.Nil(transition(MakeTokenTransferTx("GOLD", holder, 1, &wallets[0], 0)))
+	assert.Equal(root, stateMachine.StateRoot())
+}
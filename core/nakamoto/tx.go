@@ -15,16 +15,37 @@ type RawTransaction struct {
 	Amount     uint64   `json:"amount"`
 	Fee        uint64   `json:"fee"`
 	Nonce      uint64   `json:"nonce"`
+
+	// Version 2. The predicate locking the coins of the `from` predicate address, and the witness satisfying it. See
+	// predicate.go.
+	Predicate []byte `json:"predicate,omitempty"`
+	Witness   []byte `json:"witness,omitempty"`
+
+	// Version 3. A token operation, and the token it applies to. See tokens.go.
+	TokenOp byte   `json:"token_op,omitempty"`
+	Token   string `json:"token,omitempty"`
+
+	// Version 4. The outputs spent by the transaction, in the UTXO state machine. See utxo.go.
+	Inputs []Outpoint `json:"inputs,omitempty"`
+
+	// A memo, used by the example version registered in tx_versions_test.go. No version of the protocol encodes it, so
+	// it's unexported to keep it out of the JSON and wire codecs.
+	memo string
 }
 
 type Transaction struct {
-	Version    byte     `json:"version"`
-	Sig        [64]byte `json:"sig"`
-	FromPubkey [65]byte `json:"from"`
-	ToPubkey   [65]byte `json:"to"`
-	Amount     uint64   `json:"amount"`
-	Fee        uint64   `json:"fee"`
-	Nonce      uint64   `json:"nonce"`
+	Version    byte       `json:"version"`
+	Sig        [64]byte   `json:"sig"`
+	FromPubkey [65]byte   `json:"from"`
+	ToPubkey   [65]byte   `json:"to"`
+	Amount     uint64     `json:"amount"`
+	Fee        uint64     `json:"fee"`
+	Nonce      uint64     `json:"nonce"`
+	Predicate  []byte     `json:"predicate,omitempty"`
+	Witness    []byte     `json:"witness,omitempty"`
+	TokenOp    byte       `json:"token_op,omitempty"`
+	Token      string     `json:"token,omitempty"`
+	Inputs     []Outpoint `json:"inputs,omitempty"`
 
 	Hash      [32]byte
 	Blockhash [32]byte
@@ -40,12 +61,33 @@ func (tx *Transaction) ToRawTransaction() RawTransaction {
 		Amount:     tx.Amount,
 		Fee:        tx.Fee,
 		Nonce:      tx.Nonce,
+		Predicate:  tx.Predicate,
+		Witness:    tx.Witness,
+		TokenOp:    tx.TokenOp,
+		Token:      tx.Token,
+		Inputs:     tx.Inputs,
 	}
 }
 
+// Returns the size fees are paid on. This is the size of the envelope, plus the witness, and so excludes the signature.
+// Block space is measured by EncodedSizeBytes.
 func (tx *RawTransaction) SizeBytes() uint64 {
-	// Size of the transaction is the size of the envelope.
-	return 1 + 65 + 65 + 8 + 8 + 8
+	size := uint64(1 + 65 + 65 + 8 + 8 + 8)
+	for _, v := range txVersionsUpTo(tx.Version) {
+		size += v.Size(tx)
+	}
+	return size
+}
+
+// Returns the size of the transaction's canonical encoding (see encoding.go), without encoding it. This is the space it
+// takes in a block.
+func (tx *RawTransaction) EncodedSizeBytes() uint64 {
+	return tx.SizeBytes() + 64
+}
+
+// Returns the fee paid per byte, rounded down.
+func (tx *RawTransaction) FeeRate() uint64 {
+	return tx.Fee / tx.SizeBytes()
 }
 
 func (tx *RawTransaction) Bytes() []byte {
@@ -67,6 +109,10 @@ func (tx *RawTransaction) Bytes() []byte {
 	binary.BigEndian.PutUint64(nonce, tx.Nonce)
 	buf = append(buf, nonce...)
 
+	for _, v := range txVersionsUpTo(tx.Version) {
+		buf = v.Encode(buf, tx, true)
+	}
+
 	return buf
 }
 
@@ -88,6 +134,11 @@ func (tx *RawTransaction) Envelope() []byte {
 	binary.BigEndian.PutUint64(nonce, tx.Nonce)
 	buf = append(buf, nonce...)
 
+	// The witness is excluded, as it contains the signatures.
+	for _, v := range txVersionsUpTo(tx.Version) {
+		buf = v.Encode(buf, tx, false)
+	}
+
 	return buf
 }
 
@@ -98,6 +149,8 @@ func (tx *RawTransaction) Hash() [32]byte {
 	return sha256.Sum256(h.Sum(nil))
 }
 
+// Makes a signed transfer with nonce 0. To make a transfer with the account's next nonce and an estimated fee, use a
+// TxBuilder.
 func MakeTransferTx(from [65]byte, to [65]byte, amount uint64, wallet *core.Wallet, fee uint64) RawTransaction {
 	tx := RawTransaction{
 		Version:    1,
@@ -116,3 +169,22 @@ func MakeTransferTx(from [65]byte, to [65]byte, amount uint64, wallet *core.Wall
 	copy(tx.Sig[:], sig)
 	return tx
 }
+
+// Converts a raw transaction into a transaction which has not yet been included in a block.
+func (tx *RawTransaction) ToTransaction() Transaction {
+	return Transaction{
+		Version:    tx.Version,
+		Sig:        tx.Sig,
+		FromPubkey: tx.FromPubkey,
+		ToPubkey:   tx.ToPubkey,
+		Amount:     tx.Amount,
+		Fee:        tx.Fee,
+		Nonce:      tx.Nonce,
+		Predicate:  tx.Predicate,
+		Witness:    tx.Witness,
+		TokenOp:    tx.TokenOp,
+		Token:      tx.Token,
+		Inputs:     tx.Inputs,
+		Hash:       tx.Hash(),
+	}
+}
@@ -0,0 +1,123 @@
+package nakamoto
+
+import (
+	"fmt"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// The number of blocks a TxBuilder's transactions should remain includable for, if the base fee rises.
+const DEFAULT_TX_BUILDER_FEE_BLOCKS = 3
+
+// Constructs transactions from a wallet, filling in the envelope fields from the node's state. The nonce continues
+// after the account's transactions on the main chain and in the mempool, and the fee is estimated from the fee market
+// and the mempool's minimum relay fee.
+type TxBuilder struct {
+	node   *Node
+	wallet *core.Wallet
+
+	// The number of blocks the estimated fee should remain sufficient for.
+	FeeBlocks uint64
+}
+
+func NewTxBuilder(node *Node, wallet *core.Wallet) *TxBuilder {
+	return &TxBuilder{
+		node:      node,
+		wallet:    wallet,
+		FeeBlocks: DEFAULT_TX_BUILDER_FEE_BLOCKS,
+	}
+}
+
+// Builds a transaction transferring an amount to an account. Returns the signed transaction and its hash.
+func (b *TxBuilder) Transfer(to [65]byte, amount uint64) (RawTransaction, [32]byte, error) {
+	return b.Build(RawTransaction{ToPubkey: to, Amount: amount})
+}
+
+// Fills in the envelope of a transaction and signs it. The sender is the builder's wallet. The version, if zero, is the
+// lowest which encodes the transaction's fields. The fee, if zero, is estimated for the transaction's size. The nonce is
+// always fetched from the node. Returns the signed transaction and its hash.
+func (b *TxBuilder) Build(tx RawTransaction) (RawTransaction, [32]byte, error) {
+	tx.FromPubkey = b.wallet.PubkeyBytes()
+	if tx.Version == 0 {
+		tx.Version = minTxVersion(tx)
+	} else if tx.Version < minTxVersion(tx) {
+		return RawTransaction{}, [32]byte{}, fmt.Errorf("Version %d cannot encode the transaction, at least %d is required.", tx.Version, minTxVersion(tx))
+	}
+
+	nonce, err := b.node.GetNextNonce(tx.FromPubkey)
+	if err != nil {
+		return RawTransaction{}, [32]byte{}, err
+	}
+	tx.Nonce = nonce
+	if tx.Fee == 0 {
+		tx.Fee = b.node.EstimateFeePerByte(b.FeeBlocks) * tx.SizeBytes()
+	}
+
+	sig, err := b.wallet.Sign(tx.Envelope())
+	if err != nil {
+		return RawTransaction{}, [32]byte{}, err
+	}
+	copy(tx.Sig[:], sig)
+	return tx, tx.Hash(), nil
+}
+
+// Builds a transaction sending the wallet's whole spendable balance, less the fee, to an account, emptying it. Fails if
+// the account has transactions pending in the mempool, which would spend from the same balance. Returns the signed
+// transaction and its hash.
+func (b *TxBuilder) Sweep(to [65]byte) (RawTransaction, [32]byte, error) {
+	from := b.wallet.PubkeyBytes()
+	status, err := b.node.Mempool.GetAccountStatus(from)
+	if err != nil {
+		return RawTransaction{}, [32]byte{}, err
+	}
+	if 0 < len(status.Executable)+len(status.Parked) {
+		return RawTransaction{}, [32]byte{}, fmt.Errorf("Account has transactions pending in the mempool.")
+	}
+
+	tx := RawTransaction{ToPubkey: to}
+	tx.Amount, tx.Fee, err = SweepAmount(b.node.GetSpendableBalance(from), b.node.EstimateFeePerByte(b.FeeBlocks), tx)
+	if err != nil {
+		return RawTransaction{}, [32]byte{}, err
+	}
+	return b.Build(tx)
+}
+
+// Returns the amount and fee of a transaction sweeping a balance. The fee depends on the transaction's size, which
+// doesn't depend on the amount, so the fee is computed first and the amount is the rest of the balance.
+func SweepAmount(balance uint64, feePerByte uint64, tx RawTransaction) (amount uint64, fee uint64, err error) {
+	if tx.Version == 0 {
+		tx.Version = minTxVersion(tx)
+	}
+	fee = feePerByte * tx.SizeBytes()
+	if balance <= fee {
+		return 0, 0, fmt.Errorf("Balance of %d doesn't cover the fee of %d.", balance, fee)
+	}
+	return balance - fee, fee, nil
+}
+
+// Returns the nonce of an account's next transaction: after its transactions on the main chain, and those pending in
+// the mempool, including any parked behind a gap.
+func (n *Node) GetNextNonce(account [65]byte) (uint64, error) {
+	status, err := n.Mempool.GetAccountStatus(account)
+	if err != nil {
+		return 0, err
+	}
+	nonce := status.NextNonce
+	for _, pending := range append(status.Executable, status.Parked...) {
+		if nonce <= pending {
+			nonce = pending + 1
+		}
+	}
+	return nonce, nil
+}
+
+// Returns the balance of an account which can be spent in the next block, ie. excluding immature coinbase coins.
+func (n *Node) GetSpendableBalance(account [65]byte) uint64 {
+	return n.StateMachine1.GetSpendableBalance(account, n.Dag.FullTip.Height+1)
+}
+
+// Returns the fee per byte for a transaction to remain includable for a number of blocks, if the base fee rises, and
+// to be relayed by the mempool.
+func (n *Node) EstimateFeePerByte(blocks uint64) uint64 {
+	return max(n.Mempool.MinRelayFeePerByte, n.Dag.EstimateMaxBaseFee(n.Dag.FullTip, blocks))
+}
@@ -0,0 +1,74 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxBuilder(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	node.Mempool.MinRelayFeePerByte = 2
+	node.StateMachine1.Apply([]*StateLeaf{{PubKey: wallets[0].PubkeyBytes(), Balance: 1000 * 1000 * 1000}})
+	builder := NewTxBuilder(node, &wallets[0])
+
+	// A transfer is signed by the wallet, with the first nonce and a fee for its size.
+	tx, hash, err := builder.Transfer(wallets[1].PubkeyBytes(), 1000*1000)
+	assert.Nil(err)
+	assert.Equal(hash, tx.Hash())
+	assert.Equal(byte(1), tx.Version)
+	assert.Equal(wallets[0].PubkeyBytes(), tx.FromPubkey)
+	assert.Equal(uint64(0), tx.Nonce)
+	assert.Equal(2*tx.SizeBytes(), tx.Fee)
+	assert.True(core.VerifySignature(wallets[0].PubkeyStr(), tx.Sig[:], tx.Envelope()))
+
+	// The nonce continues after the account's pending transactions.
+	pending := tx.ToTransaction()
+	assert.Nil(node.Mempool.AddTransaction(&pending))
+	tx, _, err = builder.Build(RawTransaction{ToPubkey: wallets[1].PubkeyBytes(), Amount: 5, Fee: 1000})
+	assert.Nil(err)
+	assert.Equal(uint64(1), tx.Nonce)
+	assert.Equal(uint64(1000), tx.Fee)
+
+	// The version is raised to encode the transaction's fields.
+	tx, _, err = builder.Build(RawTransaction{Token: "TKN", TokenOp: TOKEN_OP_TRANSFER})
+	assert.Nil(err)
+	assert.Equal(byte(3), tx.Version)
+	_, _, err = builder.Build(RawTransaction{Version: 1, Predicate: []byte{1}})
+	assert.NotNil(err)
+}
+
+func TestTxBuilderSweep(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	node.Mempool.MinRelayFeePerByte = 2
+	node.StateMachine1.Apply([]*StateLeaf{{PubKey: wallets[0].PubkeyBytes(), Balance: 1000 * 1000 * 1000}})
+	builder := NewTxBuilder(node, &wallets[0])
+
+	// The sweep spends the whole balance, less a fee for its size.
+	tx, _, err := builder.Sweep(wallets[1].PubkeyBytes())
+	assert.Nil(err)
+	assert.Equal(2*tx.SizeBytes(), tx.Fee)
+	assert.Equal(uint64(1000*1000*1000), tx.Amount+tx.Fee)
+	assert.Nil(node.verifyTxState(tx))
+
+	// Not while the account has pending transactions.
+	pending := tx.ToTransaction()
+	assert.Nil(node.Mempool.AddTransaction(&pending))
+	_, _, err = builder.Sweep(wallets[1].PubkeyBytes())
+	assert.EqualError(err, "Account has transactions pending in the mempool.")
+
+	// Or when the balance doesn't cover the fee.
+	_, _, err = SweepAmount(10, 2, RawTransaction{})
+	assert.NotNil(err)
+}
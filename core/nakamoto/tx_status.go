@@ -0,0 +1,175 @@
+package nakamoto
+
+import (
+	"sync"
+	"time"
+)
+
+// Transactions submitted to the node are deduplicated by hash, so a client can safely retry a submission, ie. after a
+// timeout, without knowing whether the first attempt succeeded. The node tracks the lifecycle of the transactions
+// submitted to it:
+//
+//	pending -> confirmed -> finalized
+//	        -> dropped
+//
+// A transaction is pending while it's in the mempool, confirmed once it's on the main chain, and finalized once its
+// block is finalized (see finality.go). It's dropped if it leaves the mempool without being included, ie. when it's
+// evicted, or when the block including it is reorged away.
+
+type SubmitStatus string
+
+const (
+	// The transaction was added to the mempool.
+	SUBMIT_ACCEPTED SubmitStatus = "accepted"
+	// The transaction is already in the mempool or on the main chain. It isn't broadcast again.
+	SUBMIT_ALREADY_KNOWN SubmitStatus = "already-known"
+	// The transaction was rejected by the mempool's policy. The reason is given in the result.
+	SUBMIT_REJECTED SubmitStatus = "rejected"
+)
+
+type TxStatus string
+
+const (
+	// The transaction was never submitted to the node, and isn't in the mempool or on the main chain.
+	TX_STATUS_UNKNOWN   TxStatus = "unknown"
+	TX_STATUS_PENDING   TxStatus = "pending"
+	TX_STATUS_CONFIRMED TxStatus = "confirmed"
+	TX_STATUS_FINALIZED TxStatus = "finalized"
+	TX_STATUS_DROPPED   TxStatus = "dropped"
+	TX_STATUS_REJECTED  TxStatus = "rejected"
+)
+
+// The maximum number of submitted transactions tracked. The oldest are forgotten first.
+const MAX_TRACKED_TXS = 10000
+
+// The result of submitting a transaction.
+type SubmitResult struct {
+	Hash   [32]byte
+	Status SubmitStatus
+	// Why the transaction was rejected.
+	Reason error
+}
+
+// The lifecycle status of a transaction.
+type TxStatusInfo struct {
+	Hash   [32]byte
+	Status TxStatus
+	// The block including the transaction, if it's confirmed or finalized.
+	Location      *TxLocation
+	Confirmations uint64
+	// When the transaction was submitted to the node, if it was.
+	SubmittedAt time.Time
+	// Why the transaction was rejected, if it was.
+	Reason string
+}
+
+// Tracks the transactions submitted to the node.
+type TxTracker struct {
+	txs map[[32]byte]*trackedTx
+	// The tracked hashes, oldest first.
+	order [][32]byte
+	mutex sync.Mutex
+}
+
+type trackedTx struct {
+	submittedAt time.Time
+	reason      string
+}
+
+func NewTxTracker() *TxTracker {
+	return &TxTracker{
+		txs:   make(map[[32]byte]*trackedTx),
+		order: [][32]byte{},
+	}
+}
+
+// Records a submitted transaction. Must be called with the mutex held.
+func (t *TxTracker) track(hash [32]byte, submittedAt time.Time, reason string) {
+	if _, ok := t.txs[hash]; !ok {
+		t.order = append(t.order, hash)
+	}
+	t.txs[hash] = &trackedTx{submittedAt: submittedAt, reason: reason}
+	for MAX_TRACKED_TXS < len(t.order) {
+		delete(t.txs, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// Submits a transaction to the mempool and broadcasts it to peers, unless it's already known. Submitting the same
+// transaction again returns SUBMIT_ALREADY_KNOWN without broadcasting it. Returns ErrInitialBlockDownload while the node
+// is in initial block download.
+func (n *Node) SubmitTransaction(raw RawTransaction) (SubmitResult, error) {
+	// Transactions can't be validated until we've caught up. See ibd.go.
+	if n.IBD.InIBD() {
+		return SubmitResult{}, ErrInitialBlockDownload
+	}
+	hash := raw.Hash()
+	t := n.TxTracker
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if n.Mempool.HasTransaction(hash) {
+		return SubmitResult{Hash: hash, Status: SUBMIT_ALREADY_KNOWN}, nil
+	}
+	included, err := n.Dag.IsTransactionInMainChain(hash)
+	if err != nil {
+		return SubmitResult{}, err
+	}
+	if included {
+		return SubmitResult{Hash: hash, Status: SUBMIT_ALREADY_KNOWN}, nil
+	}
+
+	tx := raw.ToTransaction()
+	if err := n.Mempool.AddTransaction(&tx); err != nil {
+		t.track(hash, time.Now(), err.Error())
+		return SubmitResult{Hash: hash, Status: SUBMIT_REJECTED, Reason: err}, nil
+	}
+	t.track(hash, time.Now(), "")
+
+	if n.Peer != nil {
+		go n.Peer.GossipTransaction(raw)
+	}
+	if n.Rebroadcaster != nil {
+		n.Rebroadcaster.Track(raw)
+	}
+	return SubmitResult{Hash: hash, Status: SUBMIT_ACCEPTED}, nil
+}
+
+// Returns the lifecycle status of a transaction.
+func (n *Node) GetTransactionStatus(hash [32]byte) (TxStatusInfo, error) {
+	t := n.TxTracker
+	t.mutex.Lock()
+	tracked, submitted := t.txs[hash]
+	t.mutex.Unlock()
+
+	info := TxStatusInfo{Hash: hash, Status: TX_STATUS_UNKNOWN}
+	if submitted {
+		info.SubmittedAt = tracked.submittedAt
+		info.Reason = tracked.reason
+	}
+
+	location, err := n.Dag.GetTransactionLocation(hash)
+	if err != nil {
+		return TxStatusInfo{}, err
+	}
+	switch {
+	case location != nil:
+		info.Location = location
+		info.Confirmations = n.Dag.FullTip.Height - location.Height + 1
+		info.Status = TX_STATUS_CONFIRMED
+		finalized, err := n.Dag.GetFinalizedBlock()
+		if err != nil {
+			return TxStatusInfo{}, err
+		}
+		if location.Height <= finalized.Height {
+			info.Status = TX_STATUS_FINALIZED
+		}
+	case n.Mempool.HasTransaction(hash):
+		info.Status = TX_STATUS_PENDING
+	case submitted && tracked.reason != "":
+		info.Status = TX_STATUS_REJECTED
+	case submitted:
+		info.Status = TX_STATUS_DROPPED
+	}
+	return info, nil
+}
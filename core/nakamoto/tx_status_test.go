@@ -0,0 +1,84 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubmitTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _, _ := newBlockdag()
+	wallets := getTestingWallets(t)
+	peer := NewPeerCore(PeerConfig{address: "127.0.0.1", port: getRandomPort(), NoDiscoverIP: true})
+	node := NewNode(&dag, NewMiner(dag, &wallets[0]), peer)
+	node.Dag.FinalityDepth = 2
+	node.Miner.OnBlockSolution = func(block RawBlock) {
+		if err := node.Dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Fund the miner.
+	node.Miner.Start(1)
+	builder := NewTxBuilder(node, &wallets[0])
+
+	// Submitting is idempotent.
+	tx, hash, err := builder.Transfer(wallets[1].PubkeyBytes(), 1000*1000)
+	assert.Nil(err)
+	result, err := node.SubmitTransaction(tx)
+	assert.Nil(err)
+	assert.Equal(SubmitResult{Hash: hash, Status: SUBMIT_ACCEPTED}, result)
+	result, err = node.SubmitTransaction(tx)
+	assert.Nil(err)
+	assert.Equal(SUBMIT_ALREADY_KNOWN, result.Status)
+	assert.Equal(1, node.Rebroadcaster.NumPending())
+
+	info, err := node.GetTransactionStatus(hash)
+	assert.Nil(err)
+	assert.Equal(TX_STATUS_PENDING, info.Status)
+	assert.False(info.SubmittedAt.IsZero())
+
+	// Rejected transactions report why.
+	dust, dustHash, err := builder.Transfer(wallets[1].PubkeyBytes(), 1)
+	assert.Nil(err)
+	result, err = node.SubmitTransaction(dust)
+	assert.Nil(err)
+	assert.Equal(SUBMIT_REJECTED, result.Status)
+	assert.Equal(ErrDustAmount, result.Reason)
+	info, err = node.GetTransactionStatus(dustHash)
+	assert.Nil(err)
+	assert.Equal(TX_STATUS_REJECTED, info.Status)
+	assert.Equal(ErrDustAmount.Error(), info.Reason)
+
+	// Confirmed once mined, and finalized once deep enough.
+	node.Miner.Start(1)
+	info, err = node.GetTransactionStatus(hash)
+	assert.Nil(err)
+	assert.Equal(TX_STATUS_CONFIRMED, info.Status)
+	assert.Equal(uint64(1), info.Confirmations)
+	assert.Equal(node.Dag.FullTip.Hash, info.Location.BlockHash)
+	result, err = node.SubmitTransaction(tx)
+	assert.Nil(err)
+	assert.Equal(SUBMIT_ALREADY_KNOWN, result.Status)
+
+	node.Miner.Start(2)
+	info, err = node.GetTransactionStatus(hash)
+	assert.Nil(err)
+	assert.Equal(TX_STATUS_FINALIZED, info.Status)
+	assert.Equal(uint64(3), info.Confirmations)
+
+	// Dropped if it leaves the mempool without being included.
+	tx, hash, err = builder.Transfer(wallets[1].PubkeyBytes(), 1000*1000)
+	assert.Nil(err)
+	_, err = node.SubmitTransaction(tx)
+	assert.Nil(err)
+	node.Mempool.RemoveTransactions([][32]byte{hash})
+	info, err = node.GetTransactionStatus(hash)
+	assert.Nil(err)
+	assert.Equal(TX_STATUS_DROPPED, info.Status)
+
+	info, err = node.GetTransactionStatus([32]byte{1})
+	assert.Nil(err)
+	assert.Equal(TX_STATUS_UNKNOWN, info.Status)
+}
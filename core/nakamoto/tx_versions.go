@@ -0,0 +1,335 @@
+package nakamoto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Transaction versions are defined in a registry, rather than in the encoding and validation code. Each version extends
+// the previous one with new fields, appended to its encoding, so a version 3 transaction has the fields of versions 1,
+// 2 and 3 (see docs/encoding.md). A version registers:
+//   - how its fields are encoded, decoded and sized.
+//   - whether a transaction sets its fields, which determines the lowest version able to encode a transaction.
+//   - how its fields are checked, independent of the state.
+//   - optionally, how its fields are weighed against the block weight limit (see weight.go).
+//   - the hard fork activating it (see forks.go), scheduled by height in ConsensusConfig.Forks. A version is only active
+//     once the forks of all earlier versions are.
+//   - the state machines supporting it, which check versions against the registry rather than a range of their own.
+//
+// To add a transaction format, such as a memo or multisig, register the next version with a new fork, then support it
+// in the state machine.
+
+var (
+	ErrUnsupportedTxFields = errors.New("transaction sets fields its version doesn't have")
+	ErrTxVersionNotActive  = errors.New("transaction version is not active")
+	ErrTxFieldTooLarge     = errors.New("transaction field too large to encode")
+)
+
+type TxVersion struct {
+	Version byte
+	// The fork activating the version. Version 1 is valid from genesis, so has none.
+	Fork string
+
+	// Returns whether the transaction sets the fields introduced by this version.
+	HasFields func(tx *RawTransaction) bool
+	// Returns the size of the version's fields.
+	Size func(tx *RawTransaction) uint64
+	// Appends the version's fields to the encoding of a transaction. Witness fields are only appended with the witness,
+	// as the envelope (which is signed and hashed) excludes them.
+	Encode func(buf []byte, tx *RawTransaction, withWitness bool) []byte
+	// Reads the version's fields.
+	Decode func(d *decoder, tx *RawTransaction)
+	// Checks the version's fields are well-formed, independent of the state. Optional.
+	Verify func(tx RawTransaction) error
+	// Returns the weight of the version's fields. Optional, defaulting to WEIGHT_PER_TX_BYTE per byte. See weight.go.
+	Weight func(tx *RawTransaction) uint64
+	// The state machines supporting the version, by name (see NewStateMachineFromConfig). Nil if all do.
+	StateMachines []string
+}
+
+// A registry of transaction versions. Versions are registered in init, and read while transactions are encoded and
+// checked, possibly concurrently.
+type txVersionRegistry struct {
+	mutex sync.RWMutex
+	// The registered versions, in order, from version 1.
+	versions []TxVersion
+}
+
+// The transaction versions implemented by this node.
+var txVersions = &txVersionRegistry{}
+
+func init() {
+	for _, v := range defaultTxVersions() {
+		if err := txVersions.register(v); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Returns the transaction versions of the protocol, in order.
+func defaultTxVersions() []TxVersion {
+	return []TxVersion{
+		{
+			Version:   1,
+			HasFields: func(tx *RawTransaction) bool { return false },
+			Size:      func(tx *RawTransaction) uint64 { return 0 },
+			Encode:    func(buf []byte, tx *RawTransaction, withWitness bool) []byte { return buf },
+			Decode:    func(d *decoder, tx *RawTransaction) {},
+		},
+		{
+			Version: 2,
+			Fork:    FORK_PREDICATES,
+			HasFields: func(tx *RawTransaction) bool {
+				return 0 < len(tx.Predicate) || 0 < len(tx.Witness)
+			},
+			Size: func(tx *RawTransaction) uint64 {
+				return 2 + uint64(len(tx.Predicate)) + 2 + uint64(len(tx.Witness))
+			},
+			Encode: func(buf []byte, tx *RawTransaction, withWitness bool) []byte {
+				buf = binary.BigEndian.AppendUint16(buf, uint16(len(tx.Predicate)))
+				buf = append(buf, tx.Predicate...)
+				if withWitness {
+					buf = binary.BigEndian.AppendUint16(buf, uint16(len(tx.Witness)))
+					buf = append(buf, tx.Witness...)
+				}
+				return buf
+			},
+			Decode: func(d *decoder, tx *RawTransaction) {
+				tx.Predicate = d.slice(int(d.uint16()))
+				tx.Witness = d.slice(int(d.uint16()))
+			},
+			// The lengths are encoded as u16s, which the limits are well within.
+			Verify: func(tx RawTransaction) error {
+				if MAX_PREDICATE_SIZE < len(tx.Predicate) || MAX_WITNESS_SIZE < len(tx.Witness) {
+					return ErrTxFieldTooLarge
+				}
+				return nil
+			},
+			StateMachines: []string{STATE_MACHINE_ACCOUNT},
+		},
+		{
+			Version: 3,
+			Fork:    FORK_TOKENS,
+			HasFields: func(tx *RawTransaction) bool {
+				return tx.TokenOp != TOKEN_OP_NONE || 0 < len(tx.Token)
+			},
+			Size: func(tx *RawTransaction) uint64 {
+				return 1 + 1 + uint64(len(tx.Token))
+			},
+			Encode: func(buf []byte, tx *RawTransaction, withWitness bool) []byte {
+				buf = append(buf, tx.TokenOp, byte(len(tx.Token)))
+				return append(buf, tx.Token...)
+			},
+			Decode: func(d *decoder, tx *RawTransaction) {
+				tx.TokenOp = d.uint8()
+				tx.Token = string(d.read(int(d.uint8())))
+			},
+			// The length of the token name is encoded as a byte.
+			Verify: func(tx RawTransaction) error {
+				if 0xff < len(tx.Token) {
+					return ErrTxFieldTooLarge
+				}
+				return VerifyTokenOp(tx)
+			},
+			StateMachines: []string{STATE_MACHINE_ACCOUNT},
+		},
+		{
+			Version: 4,
+			Fork:    FORK_UTXO,
+			HasFields: func(tx *RawTransaction) bool {
+				return 0 < len(tx.Inputs)
+			},
+			Size: func(tx *RawTransaction) uint64 {
+				return 1 + uint64(len(tx.Inputs))*OUTPOINT_SIZE
+			},
+			Encode: func(buf []byte, tx *RawTransaction, withWitness bool) []byte {
+				buf = append(buf, byte(len(tx.Inputs)))
+				return append(buf, EncodeOutpoints(tx.Inputs)...)
+			},
+			Decode: func(d *decoder, tx *RawTransaction) {
+				n := int(d.uint8())
+				inputs, err := DecodeOutpoints(d.read(n * OUTPOINT_SIZE))
+				if err != nil && d.err == nil {
+					d.err = err
+				}
+				tx.Inputs = inputs
+				if len(tx.Inputs) == 0 {
+					tx.Inputs = nil
+				}
+			},
+			Verify: func(tx RawTransaction) error {
+				if MAX_TX_INPUTS < len(tx.Inputs) {
+					return ErrTooManyInputs
+				}
+				return nil
+			},
+			StateMachines: []string{STATE_MACHINE_UTXO},
+		},
+	}
+}
+
+// Registers the next transaction version with this node. Its fork is added to the forks the node implements.
+func RegisterTxVersion(v TxVersion) error {
+	return txVersions.register(v)
+}
+
+func (r *txVersionRegistry) register(v TxVersion) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	latest := byte(len(r.versions))
+	if v.Version != latest+1 {
+		return fmt.Errorf("Transaction version %d must be registered after version %d.", v.Version, latest)
+	}
+	if v.Version != 1 && v.Fork == "" {
+		return fmt.Errorf("Transaction version %d has no activation fork.", v.Version)
+	}
+	if v.HasFields == nil || v.Size == nil || v.Encode == nil || v.Decode == nil {
+		return fmt.Errorf("Transaction version %d must define HasFields, Size, Encode and Decode.", v.Version)
+	}
+	for _, registered := range r.versions {
+		if v.Fork != "" && registered.Fork == v.Fork {
+			return fmt.Errorf("Fork %s already activates transaction version %d.", v.Fork, registered.Version)
+		}
+	}
+
+	r.versions = append(r.versions, v)
+	return nil
+}
+
+// Returns a registered transaction version.
+func GetTxVersion(version byte) (TxVersion, bool) {
+	return txVersions.get(version)
+}
+
+func (r *txVersionRegistry) get(version byte) (TxVersion, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if version == 0 || int(version) > len(r.versions) {
+		return TxVersion{}, false
+	}
+	return r.versions[version-1], true
+}
+
+// Returns the latest registered transaction version.
+func LatestTxVersion() byte {
+	return txVersions.latest()
+}
+
+func (r *txVersionRegistry) latest() byte {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return byte(len(r.versions))
+}
+
+// Returns whether a registered transaction version is activated by a fork.
+func (r *txVersionRegistry) hasFork(name string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, v := range r.versions {
+		if v.Fork != "" && v.Fork == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether a state machine supports a transaction version.
+func IsTxVersionSupported(version byte, stateMachine string) bool {
+	v, ok := GetTxVersion(version)
+	if !ok {
+		return false
+	}
+	if v.StateMachines == nil {
+		return true
+	}
+	for _, name := range v.StateMachines {
+		if name == stateMachine {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether a transaction version is active at a height, given the activation heights of forks. Each version
+// extends the previous one, so it is only active once the forks of all earlier versions are.
+func IsTxVersionActive(version byte, height uint64, forks map[string]uint64) bool {
+	return txVersions.active(version, height, forks)
+}
+
+func (r *txVersionRegistry) active(version byte, height uint64, forks map[string]uint64) bool {
+	if _, ok := r.get(version); !ok {
+		return false
+	}
+	for _, v := range r.upTo(version) {
+		if v.Fork == "" {
+			continue
+		}
+		if activation, ok := forks[v.Fork]; !ok || height < activation {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the registered versions whose fields a transaction of the given version has, in order.
+func txVersionsUpTo(version byte) []TxVersion {
+	return txVersions.upTo(version)
+}
+
+// Versions are only appended, so the returned slice is never written to.
+func (r *txVersionRegistry) upTo(version byte) []TxVersion {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.versions[:min(int(version), len(r.versions))]
+}
+
+func (r *txVersionRegistry) all() []TxVersion {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.versions
+}
+
+// Checks the fields of a transaction are well-formed for its version, independent of the state.
+func VerifyTxVersion(tx RawTransaction) error {
+	return txVersions.verify(tx)
+}
+
+func (r *txVersionRegistry) verify(tx RawTransaction) error {
+	if _, ok := r.get(tx.Version); !ok {
+		return ErrUnsupportedTxVersion
+	}
+	for _, v := range r.all() {
+		if tx.Version < v.Version {
+			if v.HasFields(&tx) {
+				return ErrUnsupportedTxFields
+			}
+			continue
+		}
+		if v.Verify != nil {
+			if err := v.Verify(tx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the lowest transaction version which encodes the transaction's fields.
+func minTxVersion(tx RawTransaction) byte {
+	return txVersions.minVersion(tx)
+}
+
+func (r *txVersionRegistry) minVersion(tx RawTransaction) byte {
+	versions := r.all()
+	for i := len(versions) - 1; 0 < i; i-- {
+		if versions[i].HasFields(&tx) {
+			return versions[i].Version
+		}
+	}
+	return 1
+}
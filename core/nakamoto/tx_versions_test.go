@@ -0,0 +1,131 @@
+package nakamoto
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxVersionRegistry(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(byte(4), LatestTxVersion())
+	v, ok := GetTxVersion(3)
+	assert.True(ok)
+	assert.Equal(FORK_TOKENS, v.Fork)
+	_, ok = GetTxVersion(0)
+	assert.False(ok)
+	_, ok = GetTxVersion(5)
+	assert.False(ok)
+
+	// Versions are registered in order, each with its own fork.
+	noop := TxVersion{
+		HasFields: func(tx *RawTransaction) bool { return false },
+		Size:      func(tx *RawTransaction) uint64 { return 0 },
+		Encode:    func(buf []byte, tx *RawTransaction, withWitness bool) []byte { return buf },
+		Decode:    func(d *decoder, tx *RawTransaction) {},
+	}
+	noop.Version, noop.Fork = 6, "skipped"
+	assert.NotNil(RegisterTxVersion(noop))
+	noop.Version, noop.Fork = 5, ""
+	assert.NotNil(RegisterTxVersion(noop))
+	noop.Fork = FORK_UTXO
+	assert.NotNil(RegisterTxVersion(noop))
+	assert.Equal(byte(4), LatestTxVersion())
+
+	// Checks are cumulative, and fields of later versions are rejected.
+	assert.Nil(VerifyTxVersion(RawTransaction{Version: 1}))
+	assert.Equal(ErrUnsupportedTxVersion, VerifyTxVersion(RawTransaction{Version: 0}))
+	assert.Equal(ErrUnsupportedTxFields, VerifyTxVersion(RawTransaction{Version: 1, Predicate: []byte{1}}))
+	assert.Equal(ErrInvalidTokenOp, VerifyTxVersion(RawTransaction{Version: 4, TokenOp: 42}))
+	assert.Equal(ErrTooManyInputs, VerifyTxVersion(RawTransaction{Version: 4, Inputs: make([]Outpoint, MAX_TX_INPUTS+1)}))
+
+	// Fields are bounded, so their lengths fit their encoding.
+	assert.Equal(ErrTxFieldTooLarge, VerifyTxVersion(RawTransaction{Version: 2, Predicate: make([]byte, MAX_PREDICATE_SIZE+1)}))
+	assert.Equal(ErrTxFieldTooLarge, VerifyTxVersion(RawTransaction{Version: 2, Witness: make([]byte, MAX_WITNESS_SIZE+1)}))
+	assert.Equal(ErrTxFieldTooLarge, VerifyTxVersion(RawTransaction{Version: 3, TokenOp: TOKEN_OP_TRANSFER, Token: string(make([]byte, 256))}))
+
+	// Each state machine supports its own versions.
+	assert.True(IsTxVersionSupported(1, STATE_MACHINE_UTXO))
+	assert.True(IsTxVersionSupported(3, STATE_MACHINE_ACCOUNT))
+	assert.False(IsTxVersionSupported(3, STATE_MACHINE_UTXO))
+	assert.False(IsTxVersionSupported(4, STATE_MACHINE_ACCOUNT))
+	assert.False(IsTxVersionSupported(5, STATE_MACHINE_ACCOUNT))
+}
+
+func TestRegisterTxVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	// A new format, a memo of up to 255 bytes, is added as the next version. It's registered with a registry of its own,
+	// so other tests see only the versions of the protocol.
+	registry := &txVersionRegistry{}
+	for _, v := range defaultTxVersions() {
+		assert.Nil(registry.register(v))
+	}
+	errMemoTooLong := errors.New("memo too long")
+	err := registry.register(TxVersion{
+		Version: 5,
+		Fork:    "memos",
+		HasFields: func(tx *RawTransaction) bool {
+			return tx.memo != ""
+		},
+		Size: func(tx *RawTransaction) uint64 {
+			return 1 + uint64(len(tx.memo))
+		},
+		Encode: func(buf []byte, tx *RawTransaction, withWitness bool) []byte {
+			return append(append(buf, byte(len(tx.memo))), tx.memo...)
+		},
+		Decode: func(d *decoder, tx *RawTransaction) {
+			tx.memo = string(d.read(int(d.uint8())))
+		},
+		Verify: func(tx RawTransaction) error {
+			if 255 < len(tx.memo) {
+				return errMemoTooLong
+			}
+			return nil
+		},
+	})
+	assert.Nil(err)
+	assert.Equal(byte(5), registry.latest())
+	assert.True(registry.hasFork("memos"))
+	assert.Equal(byte(4), LatestTxVersion())
+	assert.False(txVersions.hasFork("memos"))
+
+	wallets := getTestingWallets(t)
+	tx := MakeTransferTx(wallets[0].PubkeyBytes(), wallets[1].PubkeyBytes(), 1, &wallets[0], 0)
+	tx.Version = 5
+	tx.memo = "rent"
+	assert.Equal(byte(5), registry.minVersion(tx))
+	assert.Nil(registry.verify(tx))
+	assert.Equal(errMemoTooLong, registry.verify(RawTransaction{Version: 5, memo: string(make([]byte, 256))}))
+	assert.Equal(ErrUnsupportedTxFields, registry.verify(RawTransaction{Version: 4, memo: "rent"}))
+
+	// The memo roundtrips through the encoding of the version's fields, and is in the envelope, which is signed.
+	buf := []byte{}
+	envelope := []byte{}
+	for _, v := range registry.upTo(tx.Version) {
+		buf = v.Encode(buf, &tx, true)
+		envelope = v.Encode(envelope, &tx, false)
+	}
+	decoded := RawTransaction{Version: tx.Version}
+	d := &decoder{buf: buf}
+	for _, v := range registry.upTo(decoded.Version) {
+		v.Decode(d, &decoded)
+	}
+	assert.Nil(d.err)
+	assert.Equal("rent", decoded.memo)
+	assert.Contains(string(envelope), "rent")
+
+	// The version is active once its fork and those of earlier versions are.
+	forks := map[string]uint64{FORK_PREDICATES: 0, FORK_TOKENS: 0, FORK_UTXO: 0, "memos": 10}
+	assert.False(registry.active(5, 9, forks))
+	assert.True(registry.active(5, 10, forks))
+	delete(forks, FORK_TOKENS)
+	assert.False(registry.active(5, 10, forks))
+
+	// A node which hasn't registered the version doesn't implement its fork.
+	dag, _, _, _ := newBlockdag()
+	dag.consensus.Forks = map[string]uint64{FORK_UTXO: 0, "memos": 10}
+	assert.Equal([]string{"memos"}, dag.UnsupportedForks())
+}
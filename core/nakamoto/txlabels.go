@@ -0,0 +1,189 @@
+package nakamoto
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Transaction labels are local notes attached to transactions by a wallet's user (ie. "rent for March"). They're never
+// broadcast, and are kept in a JSON file alongside the address book (see addressbook.go).
+//
+// A wallet's history can be exported to CSV for accounting, with a row for each transaction on the main chain, newest
+// first. The amount is the signed change to the balance, excluding the fee, which is listed separately and only for the
+// transactions the wallet paid it for. Coinbase transactions, which are the first in their block, are income even
+// though they're sent from the miner's own pubkey.
+
+// The header of the history CSV.
+var HistoryCSVHeader = []string{
+	"date",
+	"tx_hash",
+	"height",
+	"type",
+	"amount",
+	"fee",
+	"counterparty",
+	"counterparty_name",
+	"confirmations",
+	"label",
+}
+
+type TxLabel struct {
+	TxHash string `json:"txHash"`
+	Label  string `json:"label"`
+}
+
+type TxLabels struct {
+	labels map[[32]byte]string
+	// The file the labels are saved to, or "" if they're only kept in memory.
+	path  string
+	mutex sync.Mutex
+}
+
+func NewTxLabels() *TxLabels {
+	return &TxLabels{labels: make(map[[32]byte]string)}
+}
+
+// Loads the labels saved to a file, if it exists, and saves them there on each change.
+func LoadTxLabels(path string) (*TxLabels, error) {
+	l := NewTxLabels()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		data = []byte("[]")
+	} else if err != nil {
+		return nil, err
+	}
+	entries := []TxLabel{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("Failed to read labels from %s: %s", path, err)
+	}
+	for _, entry := range entries {
+		hash, err := parseHash32(entry.TxHash)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read labels from %s: invalid tx hash %s.", path, entry.TxHash)
+		}
+		l.labels[hash] = entry.Label
+	}
+	l.path = path
+	return l, nil
+}
+
+// Labels a transaction. An empty label removes it.
+func (l *TxLabels) Set(hash [32]byte, label string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if label == "" {
+		delete(l.labels, hash)
+	} else {
+		l.labels[hash] = label
+	}
+	return l.save()
+}
+
+// Returns the label of a transaction, or "" if it has none. A nil set has no labels.
+func (l *TxLabels) Get(hash [32]byte) string {
+	if l == nil {
+		return ""
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.labels[hash]
+}
+
+// Returns the labels, ordered by tx hash.
+func (l *TxLabels) Labels() []TxLabel {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.sortedLabels()
+}
+
+func (l *TxLabels) sortedLabels() []TxLabel {
+	labels := []TxLabel{}
+	for hash, label := range l.labels {
+		labels = append(labels, TxLabel{TxHash: Bytes32ToHexString(hash), Label: label})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].TxHash < labels[j].TxHash
+	})
+	return labels
+}
+
+func (l *TxLabels) save() error {
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(l.sortedLabels(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(l.path, append(data, '\n'), 0600)
+}
+
+// Writes an account's history as CSV, with the labels of its transactions and the names of its counterparties in an
+// address book. The labels and address book may be nil.
+func WriteHistoryCSV(w io.Writer, account [65]byte, history []RPCAddressHistoryEntry, labels *TxLabels, contacts *AddressBook) error {
+	names := make(map[string]string)
+	if contacts != nil {
+		for _, contact := range contacts.Contacts() {
+			names[contact.Pubkey] = contact.Name
+		}
+	}
+	accountStr := hex.EncodeToString(account[:])
+
+	out := csv.NewWriter(w)
+	if err := out.Write(HistoryCSVHeader); err != nil {
+		return err
+	}
+	for _, entry := range history {
+		hash, err := parseHash32(entry.TxHash)
+		if err != nil {
+			return err
+		}
+
+		// The type of transaction, the signed change to the balance, the fee we paid, and the other party.
+		txType, amount, fee, counterparty := "", "0", uint64(0), ""
+		switch {
+		case entry.TxIndex == 0 && entry.To == accountStr:
+			txType, amount = "coinbase", strconv.FormatUint(entry.Amount, 10)
+		case entry.TxIndex == 0:
+			// A block we mined, paying the reward to another account.
+			txType, counterparty = "coinbase", entry.To
+		case entry.From == accountStr && entry.To == accountStr:
+			txType, fee, counterparty = "self", entry.Fee, accountStr
+		case entry.From == accountStr:
+			txType, fee, counterparty = "sent", entry.Fee, entry.To
+			if entry.Amount != 0 {
+				amount = "-" + strconv.FormatUint(entry.Amount, 10)
+			}
+		case entry.To == accountStr:
+			txType, amount, counterparty = "received", strconv.FormatUint(entry.Amount, 10), entry.From
+		default:
+			return fmt.Errorf("Transaction %s is not to or from the account.", entry.TxHash)
+		}
+
+		err = out.Write([]string{
+			time.UnixMilli(int64(entry.Timestamp)).UTC().Format(time.RFC3339),
+			entry.TxHash,
+			strconv.FormatUint(entry.Height, 10),
+			txType,
+			amount,
+			strconv.FormatUint(fee, 10),
+			counterparty,
+			names[counterparty],
+			strconv.FormatUint(entry.Confirmations, 10),
+			labels.Get(hash),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
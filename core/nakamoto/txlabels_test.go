@@ -0,0 +1,59 @@
+package nakamoto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxLabels(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "labels.json")
+
+	labels, err := LoadTxLabels(path)
+	assert.Nil(err)
+	assert.Nil(labels.Set([32]byte{1}, "rent"))
+	assert.Nil(labels.Set([32]byte{2}, "coffee"))
+	assert.Nil(labels.Set([32]byte{2}, ""))
+
+	// Labels are saved on each change.
+	labels, err = LoadTxLabels(path)
+	assert.Nil(err)
+	assert.Equal("rent", labels.Get([32]byte{1}))
+	assert.Equal("", labels.Get([32]byte{2}))
+	assert.Equal([]TxLabel{{TxHash: Bytes32ToHexString([32]byte{1}), Label: "rent"}}, labels.Labels())
+}
+
+func TestWriteHistoryCSV(t *testing.T) {
+	assert := assert.New(t)
+	account, alice, bob := [65]byte{1}, [65]byte{2}, [65]byte{3}
+	hexOf := func(pubkey [65]byte) string {
+		return hex.EncodeToString(pubkey[:])
+	}
+	labels := NewTxLabels()
+	assert.Nil(labels.Set([32]byte{2}, "rent, march"))
+	contacts := NewAddressBook()
+	assert.Nil(contacts.Add("alice", alice))
+
+	history := []RPCAddressHistoryEntry{
+		{TxHash: Bytes32ToHexString([32]byte{1}), Height: 3, Timestamp: 1700000000000, TxIndex: 0, From: hexOf(account), To: hexOf(account), Amount: 50, Confirmations: 1},
+		{TxHash: Bytes32ToHexString([32]byte{2}), Height: 2, Timestamp: 1700000000000, TxIndex: 1, From: hexOf(account), To: hexOf(alice), Amount: 10, Fee: 2, Confirmations: 2},
+		{TxHash: Bytes32ToHexString([32]byte{3}), Height: 1, Timestamp: 1700000000000, TxIndex: 2, From: hexOf(bob), To: hexOf(account), Amount: 7, Fee: 1, Confirmations: 3},
+	}
+	buf := new(bytes.Buffer)
+	assert.Nil(WriteHistoryCSV(buf, account, history, labels, contacts))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(4, len(lines))
+	assert.Equal(strings.Join(HistoryCSVHeader, ","), lines[0])
+	assert.Equal("2023-11-14T22:13:20Z,"+history[0].TxHash+",3,coinbase,50,0,,,1,", lines[1])
+	assert.Equal("2023-11-14T22:13:20Z,"+history[1].TxHash+",2,sent,-10,2,"+hexOf(alice)+",alice,2,\"rent, march\"", lines[2])
+	assert.Equal("2023-11-14T22:13:20Z,"+history[2].TxHash+",1,received,7,0,"+hexOf(bob)+",,3,", lines[3])
+
+	// Transactions which don't involve the account are an error.
+	history[2].To = hexOf(alice)
+	assert.NotNil(WriteHistoryCSV(new(bytes.Buffer), account, history, nil, nil))
+}
@@ -7,16 +7,40 @@ import (
 	"time"
 )
 
+// The state machine (or VM) executes the transactions of the main chain. The consensus layer (the block DAG, miner and
+// sync) is oblivious to what transactions do, so embedders can run alternative state machines, ie. UTXO sets, key-value
+// stores or counter apps, by implementing this interface. StateMachine is the default, an account-based ledger.
 type StateMachineInterface interface {
+	// Checks a transaction is well-formed, independent of the state. Called when blocks are ingested, before they are
+	// checked against the state (see BlockDAG.VerifyBlockState).
 	VerifyTx(tx RawTransaction) error
+
+	// Executes the transactions of a block on the current state. The first transaction is the coinbase. If any
+	// transaction fails, the state is left unchanged and an error is returned.
+	ExecuteBlock(block Block) error
+
+	// Returns a commitment to the current state.
+	StateRoot() [32]byte
+
+	// Snapshots the current state, returning an ID which can be passed to RevertTo. Blocks can be executed
+	// speculatively after a snapshot, and rolled back if they turn out to be invalid, or are reorged away.
+	Snapshot() SnapshotID
+
+	// Reverts the state to a snapshot, discarding the snapshot and any taken after it.
+	RevertTo(snapshot SnapshotID) error
 }
 
+// Identifies a snapshot of a state machine's state.
+type SnapshotID int
+
 type Epoch struct {
 	// Epoch number.
 	Number uint64
 
 	// Epoch unique ID.
 	Id string
+	// The ID of the previous epoch on the epoch's branch, or "" for the genesis epoch. See epochs.go.
+	ParentId string
 
 	// Start block.
 	StartBlockHash [32]byte
@@ -42,14 +66,36 @@ type PeerConfig struct {
 	address        string
 	port           string
 	bootstrapPeers []string
+
+	// The addresses to advertise to peers, as host or host:port, instead of those discovered over STUN. At most one
+	// IPv4 address or hostname, and one IPv6 address. See netpeer_dualstack.go.
+	ExternalAddrs []string
+	// Don't discover our external addresses over STUN. Without ExternalAddrs, we don't advertise an address, and only
+	// make outbound connections.
+	NoDiscoverIP bool
+	// Don't accept peer messages over QUIC, only over TCP. See netpeer_quic.go.
+	NoQuic bool
 }
 
 func NewPeerConfig(address string, port string, bootstrapPeers []string) PeerConfig {
 	return PeerConfig{address: address, port: port, bootstrapPeers: bootstrapPeers}
 }
 
+// Limits on the contents of messages, which bound the work a peer can ask of us.
+const (
+	// The maximum number of hashes in a get_blocks message.
+	MAX_GET_BLOCKS_HASHES = 10
+	// The maximum depth of a sync_get_tip_at_depth message, and the maximum size of the height set in a sync_get_data
+	// message (and hence the number of headers or bodies in its reply).
+	MAX_SYNC_WINDOW = 4096
+	// The maximum number of peers in a gossip_peers message.
+	MAX_GOSSIP_PEERS = 1000
+)
+
 type NetworkMessage struct {
 	Type string `json:"type"`
+	// The node ID of the sender, if the message declares one. It must match the message signature. See identity.go.
+	NodeID string `json:"nodeId,omitempty"`
 }
 
 type HeartbeatMesage struct {
@@ -59,14 +105,30 @@ type HeartbeatMesage struct {
 	ClientVersion       string `json:"clientVersion"`
 	WireProtocolVersion uint   `json:"wireProtocolVersion"`
 	ClientAddress       string `json:"clientAddress"`
+	// All the addresses the node can be reached at, including ClientAddress. See netpeer_dualstack.go.
+	ClientAddresses []string `json:"clientAddresses,omitempty"`
+	// The services the node offers, a bitfield of NODE_SERVICE_* flags.
+	Services uint64 `json:"services"`
+	// The wire encodings the node supports, in order of preference. See wire.go.
+	Encodings []string `json:"encodings"`
+	// The compression algorithms the node supports, in order of preference. See wire.go.
+	Compressions []string `json:"compressions"`
+	// The node's identity, which the heartbeat must be signed by. See identity.go.
+	NodeID string `json:"nodeId,omitempty"`
+	// If set, the node only wants unconfirmed transactions matching the filter relayed to it. See bloom.go.
+	TxFilter *BloomFilter `json:"txFilter,omitempty"`
 	// TODO add chain/network ID.
 	Time time.Time
+	// The time of the heartbeat being replied to, used to measure round-trip time.
+	EchoTime time.Time `json:"echoTime"`
 }
 
 // get_tip
 type GetTipMessage struct {
-	Type string      `json:"type"` // "get_tip"
-	Tip  BlockHeader `json:"tip"`
+	Type string `json:"type"` // "get_tip"
+	// Echoed in the reply. See netpeer_requests.go.
+	RequestID uint64      `json:"requestId,omitempty"`
+	Tip       BlockHeader `json:"tip"`
 }
 
 // new_block
@@ -77,30 +139,34 @@ type NewBlockMessage struct {
 
 // new_transaction
 type NewTransactionMessage struct {
-	Type           string         `json:"type"` // "new_transaction"
+	Type           string         `json:"type"` // "new_tx"
 	RawTransaction RawTransaction `json:"rawTransaction"`
 }
 
 // get_blocks
 type GetBlocksMessage struct {
 	Type        string   `json:"type"` // "get_blocks"
+	RequestID   uint64   `json:"requestId,omitempty"`
 	BlockHashes []string `json:"blockHashes"`
 }
 
 type GetBlocksReply struct {
 	Type          string   `json:"type"` // "get_blocks_reply"
+	RequestID     uint64   `json:"requestId,omitempty"`
 	RawBlockDatas [][]byte `json:"rawBlockDatas"`
 }
 
 // has_block
 type HasBlockMessage struct {
-	Type      string `json:"type"` // "have_block"
+	Type      string `json:"type"` // "has_block"
+	RequestID uint64 `json:"requestId,omitempty"`
 	BlockHash string `json:"blockHash"`
 }
 
 type HasBlockReply struct {
-	Type string `json:"type"` // "have_block_reply"
-	Has  bool   `json:"has"`
+	Type      string `json:"type"` // "has_block_reply"
+	RequestID uint64 `json:"requestId,omitempty"`
+	Has       bool   `json:"has"`
 }
 
 // gossip_peers
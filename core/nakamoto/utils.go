@@ -3,20 +3,22 @@ package nakamoto
 import (
 	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"math/big"
 	"net"
 	"os"
-	"time"
+	"regexp"
+	"strings"
+	"sync"
 
 	"github.com/fatih/color"
 	"github.com/pion/stun"
 )
 
+// Returns the current time of the DefaultClock, in milliseconds. See clock_source.go.
 func Timestamp() uint64 {
-	now := time.Now()
-	milliseconds := now.UnixMilli()
-	return uint64(milliseconds)
+	return ClockTimestamp(DefaultClock)
 }
 
 func BigIntToBytes32(i big.Int) (fbuf [32]byte) {
@@ -108,6 +110,110 @@ func DiscoverIP() (string, int, error) {
 	return xorAddr.IP.String(), xorAddr.Port, nil
 }
 
+// The STUN server used to discover our external addresses.
+const STUN_SERVER = "stun.l.google.com:19302"
+
+// Discovers our external IPv4 and IPv6 addresses, by asking a STUN server over each address family. An address is ""
+// if we have no connectivity in its family. Returns an error if we have none in either.
+func DiscoverIPs() (ipv4 string, ipv6 string, err error) {
+	ipv4, err4 := discoverIPOverNetwork("udp4")
+	ipv6, err6 := discoverIPOverNetwork("udp6")
+	if err4 != nil && err6 != nil {
+		return "", "", fmt.Errorf("Failed to discover external IP: %s, %s", err4, err6)
+	}
+	return ipv4, ipv6, nil
+}
+
+// Asks the STUN server for our external IP over a network, ie. "udp4" or "udp6".
+func discoverIPOverNetwork(network string) (string, error) {
+	c, err := stun.Dial(network, STUN_SERVER)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	var xorAddr stun.XORMappedAddress
+	var resErr error
+	message := stun.MustBuild(stun.TransactionID, stun.BindingRequest)
+	err = c.Do(message, func(res stun.Event) {
+		if res.Error != nil {
+			resErr = res.Error
+			return
+		}
+		resErr = xorAddr.GetFrom(res.Message)
+	})
+	if err != nil {
+		return "", err
+	}
+	if resErr != nil {
+		return "", resErr
+	}
+	return xorAddr.IP.String(), nil
+}
+
+// The output of all loggers. See SetLogOutput.
+var logOutput io.Writer = os.Stdout
+
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	recentLogs.add(p)
+	return logOutput.Write(p)
+}
+
+// The number of recent log lines kept in memory, for operators to inspect over RPC. See RecentLogLines.
+const RECENT_LOG_LINES = 500
+
+var recentLogs = &logRing{lines: make([]string, RECENT_LOG_LINES)}
+
+// Matches the ANSI escape codes loggers colour their prefixes with.
+var ansiEscapePattern = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// A ring buffer of the most recent log lines.
+type logRing struct {
+	lines []string
+	// The index the next line is written to, and the number of lines written, up to the capacity.
+	next  int
+	count int
+	mutex sync.Mutex
+}
+
+func (r *logRing) add(p []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		r.lines[r.next] = ansiEscapePattern.ReplaceAllString(line, "")
+		r.next = (r.next + 1) % len(r.lines)
+		if r.count < len(r.lines) {
+			r.count++
+		}
+	}
+}
+
+// Returns up to n of the most recent log lines, oldest first, without colours.
+func RecentLogLines(n int) []string {
+	return recentLogs.last(n)
+}
+
+func (r *logRing) last(n int) []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.count < n {
+		n = r.count
+	}
+	lines := make([]string, 0, n)
+	for i := n; 0 < i; i-- {
+		lines = append(lines, r.lines[(r.next-i+len(r.lines))%len(r.lines)])
+	}
+	return lines
+}
+
+// Redirects the output of all loggers, including those already constructed. ie. io.Discard silences them.
+func SetLogOutput(w io.Writer) {
+	logOutput = w
+}
+
 // Constructs a new logger with the given `prefix` and an optional `prefix2`.
 //
 // Format 1:
@@ -122,5 +228,5 @@ func NewLogger(prefix string, prefix2 string) *log.Logger {
 	if prefix2 != "" {
 		prefixFull += color.HiYellowString(fmt.Sprintf("(%s) ", prefix2))
 	}
-	return log.New(os.Stdout, prefixFull, log.Ldate|log.Ltime|log.Lmsgprefix)
+	return log.New(logWriter{}, prefixFull, log.Ldate|log.Ltime|log.Lmsgprefix)
 }
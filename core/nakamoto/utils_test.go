@@ -0,0 +1,22 @@
+package nakamoto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogRing(t *testing.T) {
+	assert := assert.New(t)
+
+	// Lines are stored without colours.
+	r := &logRing{lines: make([]string, 3)}
+	r.add([]byte("\x1b[34m[node]\x1b[0m one\n"))
+	r.add([]byte("two\nthree\n"))
+	assert.Equal([]string{"[node] one", "two", "three"}, r.last(3))
+	assert.Equal([]string{"two", "three"}, r.last(2))
+
+	// Older lines are overwritten once the ring is full.
+	r.add([]byte("four\n"))
+	assert.Equal([]string{"two", "three", "four"}, r.last(10))
+}
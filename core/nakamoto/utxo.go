@@ -0,0 +1,330 @@
+package nakamoto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/liamzebedee/tinychain-go/core"
+)
+
+// The UTXO state machine is an alternative to the account-based StateMachine, which tracks coins as unspent transaction
+// outputs (UTXOs), like Bitcoin. It is selected per network with ConsensusConfig.StateMachine = "utxo".
+//
+// A transfer is a version 4 transaction, which spends a list of outputs owned by the sender (its inputs), and creates
+// up to two new outputs:
+//
+//  0. the amount, to the recipient.
+//  1. the change, back to the sender: the total of the inputs, less the amount and the fee.
+//
+// Outputs of zero are omitted. Outputs are identified by an outpoint, the hash of the transaction which created them and
+// their index. The inputs are part of the signed envelope, so the sender's signature authorizes spending all of them.
+//
+// The coinbase creates a single output, of its amount plus the tips of the block's transactions. Since coinbase
+// transactions aren't unique (a miner's coinbase is the same in every block), the coinbase output is identified by the
+// block hash instead of the transaction hash. As in StateMachine, the base fee portion of fees is burned, and coinbase
+// outputs can't be spent until they are CoinbaseMaturity blocks deep. Predicates and tokens aren't supported.
+
+const (
+	// The size of an encoded outpoint: the transaction hash, and the output index.
+	OUTPOINT_SIZE = 32 + 4
+
+	MAX_TX_INPUTS = 255
+)
+
+var ErrNoInputs = errors.New("transaction has no inputs")
+var ErrTooManyInputs = errors.New("transaction has too many inputs")
+var ErrUnknownOutput = errors.New("output is unknown or spent")
+var ErrOutputNotOwned = errors.New("output not owned by sender")
+
+type Outpoint struct {
+	TxHash [32]byte `json:"tx_hash"`
+	Index  uint32   `json:"index"`
+}
+
+type UTXO struct {
+	Owner  [65]byte `json:"owner"`
+	Amount uint64   `json:"amount"`
+	// Whether the output was created by a coinbase, and the height of its block.
+	Coinbase bool   `json:"coinbase"`
+	Height   uint64 `json:"height"`
+}
+
+func (o Outpoint) Bytes() []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{}, o.TxHash[:]...), o.Index)
+}
+
+func EncodeOutpoints(outpoints []Outpoint) []byte {
+	buf := []byte{}
+	for _, o := range outpoints {
+		buf = append(buf, o.Bytes()...)
+	}
+	return buf
+}
+
+func DecodeOutpoints(buf []byte) ([]Outpoint, error) {
+	if len(buf)%OUTPOINT_SIZE != 0 {
+		return nil, fmt.Errorf("Outpoints length %d is not a multiple of %d.", len(buf), OUTPOINT_SIZE)
+	}
+	outpoints := []Outpoint{}
+	for ; len(buf) > 0; buf = buf[OUTPOINT_SIZE:] {
+		outpoints = append(outpoints, Outpoint{
+			TxHash: [32]byte(buf[:32]),
+			Index:  binary.BigEndian.Uint32(buf[32:OUTPOINT_SIZE]),
+		})
+	}
+	return outpoints, nil
+}
+
+type UTXOStateMachine struct {
+	// The unspent outputs.
+	utxos map[Outpoint]UTXO
+
+	// The number of blocks before coinbase outputs can be spent. 0 disables the rule.
+	CoinbaseMaturity uint64
+
+	// Copies of the unspent outputs, by snapshot ID.
+	snapshots []map[Outpoint]UTXO
+}
+
+func NewUTXOStateMachine() *UTXOStateMachine {
+	return &UTXOStateMachine{
+		utxos: make(map[Outpoint]UTXO),
+	}
+}
+
+// The changes made by a block's transactions, which are only committed once the whole block is valid.
+type utxoView struct {
+	base    map[Outpoint]UTXO
+	created map[Outpoint]UTXO
+	spent   map[Outpoint]bool
+}
+
+func (v *utxoView) get(o Outpoint) (UTXO, bool) {
+	if v.spent[o] {
+		return UTXO{}, false
+	}
+	if u, ok := v.created[o]; ok {
+		return u, true
+	}
+	u, ok := v.base[o]
+	return u, ok
+}
+
+func (v *utxoView) spend(o Outpoint) {
+	v.spent[o] = true
+	delete(v.created, o)
+}
+
+func (v *utxoView) create(o Outpoint, u UTXO) {
+	if u.Amount != 0 {
+		v.created[o] = u
+	}
+}
+
+func (c *UTXOStateMachine) VerifyTx(tx RawTransaction) error {
+	if !IsTxVersionSupported(tx.Version, STATE_MACHINE_UTXO) {
+		return ErrUnsupportedTxVersion
+	}
+	if len(tx.Predicate) != 0 || len(tx.Witness) != 0 {
+		return ErrUnexpectedPredicate
+	}
+	if tx.TokenOp != TOKEN_OP_NONE || tx.Token != "" {
+		return ErrInvalidTokenOp
+	}
+	return VerifyTxVersion(tx)
+}
+
+// Executes the transactions of a block. The first transaction is the coinbase. If a transaction fails, none of the
+// block's changes are made.
+func (c *UTXOStateMachine) ExecuteBlock(block Block) error {
+	if len(block.Transactions) == 0 {
+		return nil
+	}
+
+	view := &utxoView{
+		base:    c.utxos,
+		created: make(map[Outpoint]UTXO),
+		spent:   make(map[Outpoint]bool),
+	}
+	tips := uint64(0)
+	for i, tx := range block.Transactions[1:] {
+		tip, err := c.transitionTransfer(view, tx, block)
+		if err == nil {
+			var carry uint64
+			tips, carry = bits.Add64(tips, tip, 0)
+			if carry != 0 {
+				err = ErrMinerBalanceOverflow
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("Error transitioning state machine: block=%x txindex=%d error=\"%s\"", block.Hash, i+1, err)
+		}
+	}
+
+	coinbase := block.Transactions[0]
+	amount, carry := bits.Add64(coinbase.Amount, tips, 0)
+	if carry != 0 {
+		return fmt.Errorf("Error transitioning state machine: block=%x txindex=%d error=\"%s\"", block.Hash, 0, ErrToBalanceOverflow)
+	}
+	view.create(Outpoint{TxHash: block.Hash, Index: 0}, UTXO{
+		Owner:    coinbase.ToPubkey,
+		Amount:   amount,
+		Coinbase: true,
+		Height:   block.Height,
+	})
+
+	for o := range view.spent {
+		delete(c.utxos, o)
+	}
+	for o, u := range view.created {
+		c.utxos[o] = u
+	}
+	return nil
+}
+
+// Spends the inputs of a transaction and creates its outputs, returning the tip paid to the miner.
+func (c *UTXOStateMachine) transitionTransfer(view *utxoView, tx RawTransaction, block Block) (uint64, error) {
+	if len(tx.Inputs) == 0 {
+		return 0, ErrNoInputs
+	}
+
+	total := uint64(0)
+	for _, input := range tx.Inputs {
+		u, ok := view.get(input)
+		if !ok {
+			return 0, ErrUnknownOutput
+		}
+		if u.Owner != tx.FromPubkey {
+			return 0, ErrOutputNotOwned
+		}
+		if u.Coinbase && c.CoinbaseMaturity != 0 && block.Height < u.Height+c.CoinbaseMaturity {
+			return 0, ErrImmatureCoinbaseSpend
+		}
+		var carry uint64
+		total, carry = bits.Add64(total, u.Amount, 0)
+		if carry != 0 {
+			return 0, ErrToBalanceOverflow
+		}
+		view.spend(input)
+	}
+
+	burn := block.BaseFee * tx.SizeBytes()
+	if tx.Fee < burn {
+		return 0, ErrFeeBelowBaseFee
+	}
+	spent, carry := bits.Add64(tx.Amount, tx.Fee, 0)
+	if carry != 0 || total < spent {
+		return 0, ErrInsufficientBalance
+	}
+
+	hash := tx.Hash()
+	view.create(Outpoint{TxHash: hash, Index: 0}, UTXO{Owner: tx.ToPubkey, Amount: tx.Amount})
+	view.create(Outpoint{TxHash: hash, Index: 1}, UTXO{Owner: tx.FromPubkey, Amount: total - spent})
+	return tx.Fee - burn, nil
+}
+
+func (c *UTXOStateMachine) GetUTXO(o Outpoint) (UTXO, bool) {
+	u, ok := c.utxos[o]
+	return u, ok
+}
+
+// Returns the outpoints of the unspent outputs owned by an account, sorted.
+func (c *UTXOStateMachine) GetUTXOs(owner [65]byte) []Outpoint {
+	outpoints := []Outpoint{}
+	for o, u := range c.utxos {
+		if u.Owner == owner {
+			outpoints = append(outpoints, o)
+		}
+	}
+	sort.Slice(outpoints, func(i, j int) bool {
+		return bytes.Compare(outpoints[i].Bytes(), outpoints[j].Bytes()) < 0
+	})
+	return outpoints
+}
+
+func (c *UTXOStateMachine) GetBalance(owner [65]byte) uint64 {
+	balance := uint64(0)
+	for _, u := range c.utxos {
+		if u.Owner == owner {
+			balance += u.Amount
+		}
+	}
+	return balance
+}
+
+// Selects unspent outputs of an account totalling at least the amount, for use as the inputs of a transaction.
+func (c *UTXOStateMachine) SelectInputs(owner [65]byte, amount uint64) ([]Outpoint, error) {
+	inputs := []Outpoint{}
+	total := uint64(0)
+	for _, o := range c.GetUTXOs(owner) {
+		if amount <= total || len(inputs) == MAX_TX_INPUTS {
+			break
+		}
+		inputs = append(inputs, o)
+		total += c.utxos[o].Amount
+	}
+	if total < amount {
+		return nil, ErrInsufficientBalance
+	}
+	return inputs, nil
+}
+
+// Returns the merkle root of the unspent outputs, sorted by outpoint.
+func (c *UTXOStateMachine) StateRoot() [32]byte {
+	leaves := [][]byte{}
+	for o, u := range c.utxos {
+		leaf := append(o.Bytes(), u.Owner[:]...)
+		leaf = binary.BigEndian.AppendUint64(leaf, u.Amount)
+		if u.Coinbase {
+			leaf = append(leaf, 1)
+		} else {
+			leaf = append(leaf, 0)
+		}
+		leaves = append(leaves, binary.BigEndian.AppendUint64(leaf, u.Height))
+	}
+	sort.Slice(leaves, func(i, j int) bool {
+		return bytes.Compare(leaves[i], leaves[j]) < 0
+	})
+	return core.ComputeMerkleHash(leaves)
+}
+
+func (c *UTXOStateMachine) Snapshot() SnapshotID {
+	utxos := make(map[Outpoint]UTXO)
+	for o, u := range c.utxos {
+		utxos[o] = u
+	}
+	c.snapshots = append(c.snapshots, utxos)
+	return SnapshotID(len(c.snapshots) - 1)
+}
+
+func (c *UTXOStateMachine) RevertTo(snapshot SnapshotID) error {
+	if snapshot < 0 || len(c.snapshots) <= int(snapshot) {
+		return fmt.Errorf("Unknown snapshot: %d", snapshot)
+	}
+	c.utxos = c.snapshots[snapshot]
+	c.snapshots = c.snapshots[:snapshot]
+	return nil
+}
+
+// Makes a transaction spending the inputs from the wallet, paying the amount to the recipient, and the change back to
+// the wallet.
+func MakeUTXOTransferTx(inputs []Outpoint, to [65]byte, amount uint64, wallet *core.Wallet, fee uint64) RawTransaction {
+	tx := RawTransaction{
+		Version:    4,
+		FromPubkey: wallet.PubkeyBytes(),
+		ToPubkey:   to,
+		Amount:     amount,
+		Fee:        fee,
+		Inputs:     inputs,
+	}
+	sig, err := wallet.Sign(tx.Envelope())
+	if err != nil {
+		panic(err)
+	}
+	copy(tx.Sig[:], sig)
+	return tx
+}
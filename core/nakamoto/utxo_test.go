@@ -0,0 +1,204 @@
+package nakamoto
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutpointEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	outpoints := []Outpoint{
+		{TxHash: [32]byte{1, 2, 3}, Index: 0},
+		{TxHash: [32]byte{4}, Index: 258},
+	}
+	buf := EncodeOutpoints(outpoints)
+	assert.Equal(2*OUTPOINT_SIZE, len(buf))
+
+	decoded, err := DecodeOutpoints(buf)
+	assert.Nil(err)
+	assert.Equal(outpoints, decoded)
+
+	_, err = DecodeOutpoints(buf[1:])
+	assert.NotNil(err)
+
+	// The inputs are signed.
+	tx := RawTransaction{Version: 4, Inputs: outpoints}
+	assert.Equal(uint64(1+65+65+8+8+8+2+2+1+1+1+2*OUTPOINT_SIZE), tx.SizeBytes())
+	other := tx
+	other.Inputs = outpoints[:1]
+	assert.NotEqual(tx.Envelope(), other.Envelope())
+}
+
+func TestUTXOStateMachine(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	alice := wallets[0].PubkeyBytes()
+	bob := wallets[1].PubkeyBytes()
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	miner := minerWallet.PubkeyBytes()
+
+	stateMachine := NewUTXOStateMachine()
+	stateMachine.CoinbaseMaturity = 2
+	coinbase := MakeCoinbaseTx(&wallets[0])
+
+	// The coinbase output is identified by the block hash.
+	assert.Nil(stateMachine.ExecuteBlock(Block{Hash: [32]byte{1}, Height: 1, Transactions: []RawTransaction{coinbase}}))
+	reward := Outpoint{TxHash: [32]byte{1}, Index: 0}
+	assert.Equal([]Outpoint{reward}, stateMachine.GetUTXOs(alice))
+	assert.Equal(coinbase.Amount, stateMachine.GetBalance(alice))
+
+	// Coinbase outputs must mature.
+	spend := MakeUTXOTransferTx([]Outpoint{reward}, bob, 100, &wallets[0], 10)
+	block := Block{Hash: [32]byte{2}, Height: 2, Transactions: []RawTransaction{MakeCoinbaseTx(minerWallet), spend}}
+	assert.ErrorContains(stateMachine.ExecuteBlock(block), ErrImmatureCoinbaseSpend.Error())
+
+	// Bob can spend his output in the same block it's created. The change goes back to the sender, and the fees to the
+	// miner.
+	block.Height = 3
+	respend := MakeUTXOTransferTx([]Outpoint{{TxHash: spend.Hash(), Index: 0}}, alice, 60, &wallets[1], 5)
+	block.Transactions = append(block.Transactions, respend)
+	assert.Nil(stateMachine.ExecuteBlock(block))
+	assert.Equal(coinbase.Amount-100-10+60, stateMachine.GetBalance(alice))
+	assert.Equal(uint64(100-60-5), stateMachine.GetBalance(bob))
+	assert.Equal(coinbase.Amount+10+5, stateMachine.GetBalance(miner))
+	_, ok := stateMachine.GetUTXO(reward)
+	assert.False(ok)
+
+	// A failed block leaves the state unchanged.
+	root := stateMachine.StateRoot()
+	inputs, err := stateMachine.SelectInputs(alice, 100)
+	assert.Nil(err)
+	doubleSpend := Block{
+		Hash:   [32]byte{3},
+		Height: 4,
+		Transactions: []RawTransaction{
+			MakeCoinbaseTx(minerWallet),
+			MakeUTXOTransferTx(inputs, bob, 100, &wallets[0], 0),
+			MakeUTXOTransferTx(inputs, miner, 100, &wallets[0], 0),
+		},
+	}
+	assert.EqualError(
+		stateMachine.ExecuteBlock(doubleSpend),
+		"Error transitioning state machine: block=0300000000000000000000000000000000000000000000000000000000000000 txindex=2 error=\"output is unknown or spent\"",
+	)
+	assert.Equal(root, stateMachine.StateRoot())
+
+	// Outputs can only be spent by their owner.
+	steal := MakeUTXOTransferTx(inputs, bob, 100, &wallets[1], 0)
+	doubleSpend.Transactions = doubleSpend.Transactions[:1]
+	doubleSpend.Transactions = append(doubleSpend.Transactions, steal)
+	assert.ErrorContains(stateMachine.ExecuteBlock(doubleSpend), ErrOutputNotOwned.Error())
+
+	_, err = stateMachine.SelectInputs(bob, 1000)
+	assert.Equal(ErrInsufficientBalance, err)
+
+	// Snapshots restore the outputs.
+	snapshot := stateMachine.Snapshot()
+	doubleSpend.Transactions = doubleSpend.Transactions[:1]
+	assert.Nil(stateMachine.ExecuteBlock(doubleSpend))
+	assert.NotEqual(root, stateMachine.StateRoot())
+	assert.Nil(stateMachine.RevertTo(snapshot))
+	assert.Equal(root, stateMachine.StateRoot())
+
+	// Account model features aren't supported.
+	assert.Nil(stateMachine.VerifyTx(spend))
+	assert.Equal(ErrUnsupportedTxVersion, stateMachine.VerifyTx(RawTransaction{Version: 3}))
+	assert.Equal(ErrUnexpectedPredicate, stateMachine.VerifyTx(RawTransaction{Version: 4, Witness: []byte{1}}))
+}
+
+func TestNewStateMachineFromConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	vm, err := NewStateMachineFromConfig(ConsensusConfig{CoinbaseMaturity: 5})
+	assert.Nil(err)
+	assert.Equal(uint64(5), vm.(*StateMachine).CoinbaseMaturity)
+
+	vm, err = NewStateMachineFromConfig(ConsensusConfig{StateMachine: STATE_MACHINE_UTXO, CoinbaseMaturity: 5})
+	assert.Nil(err)
+	assert.Equal(uint64(5), vm.(*UTXOStateMachine).CoinbaseMaturity)
+
+	_, err = NewStateMachineFromConfig(ConsensusConfig{StateMachine: "evm"})
+	assert.EqualError(err, "Unknown state machine: evm")
+}
+
+func TestDagUTXO(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := OpenDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	genesisDifficulty := new(big.Int)
+	genesisDifficulty.SetString("0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+	conf := ConsensusConfig{
+		EpochLengthBlocks:       5,
+		TargetEpochLengthMillis: 2000,
+		GenesisDifficulty:       *genesisDifficulty,
+		GenesisParentBlockHash:  HexStringToBytes32("000006b15d1327d67e971d1de9116bd60a3a01556c91b6ebaa416ebc0cfaa646"),
+		MaxBlockSizeBytes:       2 * 1024 * 1024,
+		Forks:                   map[string]uint64{FORK_PREDICATES: 0, FORK_TOKENS: 0, FORK_UTXO: 0},
+		StateMachine:            STATE_MACHINE_UTXO,
+	}
+	vm, err := NewStateMachineFromConfig(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dag, err := NewBlockDAGFromDB(db, vm, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wallets := getTestingWallets(t)
+	newBlock := func(txs ...RawTransaction) RawBlock {
+		txs = append([]RawTransaction{MakeCoinbaseTx(&wallets[0])}, txs...)
+		envelopes := [][]byte{}
+		for _, tx := range txs {
+			envelopes = append(envelopes, tx.Envelope())
+		}
+		b := RawBlock{
+			BlockHeader: BlockHeader{
+				ParentHash:             dag.FullTip.Hash,
+				ParentTotalWork:        BigIntToBytes32(dag.FullTip.AccumulatedWork),
+				Timestamp:              Timestamp(),
+				NumTransactions:        uint64(len(txs)),
+				TransactionsMerkleRoot: core.ComputeMerkleHash(envelopes),
+			},
+			Transactions: txs,
+		}
+		solution, err := SolvePOW(b, *big.NewInt(0), conf.GenesisDifficulty, 1000000000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.SetNonce(solution)
+		return b
+	}
+
+	assert.Nil(dag.IngestBlock(newBlock()))
+	reward := Outpoint{TxHash: dag.FullTip.Hash, Index: 0}
+
+	// The inputs are stored with the transaction.
+	spend := MakeUTXOTransferTx([]Outpoint{reward}, wallets[1].PubkeyBytes(), 100, &wallets[0], 0)
+	assert.Nil(dag.IngestBlock(newBlock(spend)))
+	txs, err := dag.GetBlockTransactions(dag.FullTip.Hash)
+	assert.Nil(err)
+	assert.Equal(spend, (*txs)[1].ToRawTransaction())
+
+	// Executing the chain spends the first reward.
+	hashes, err := dag.GetLongestChainHashList(dag.FullTip.Hash, dag.FullTip.Height)
+	assert.Nil(err)
+	assert.Nil(ExecuteBlocks(&dag, vm, hashes))
+	utxos := vm.(*UTXOStateMachine)
+	assert.Equal(uint64(100), utxos.GetBalance(wallets[1].PubkeyBytes()))
+	_, ok := utxos.GetUTXO(reward)
+	assert.False(ok)
+}
@@ -0,0 +1,275 @@
+package nakamoto
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Version bits (BIP9 style) let consensus changes roll out as soft forks, activated once enough of the hashrate is
+// ready, rather than on a flag day.
+//
+// Each deployment is assigned a bit of the block version. While a deployment is started, miners who are ready for it
+// set its bit. The state of a deployment is fixed for each epoch, and changes at epoch boundaries:
+//
+//   - defined: the deployment's start height hasn't been reached.
+//   - started: miners signal. If at least the threshold of blocks in an epoch signal, it locks in.
+//   - locked_in: the deployment activates after one more epoch, giving laggards time to upgrade.
+//   - active: the new rules are enforced. Check with IsDeploymentActive.
+//   - failed: the timeout height was reached before the deployment locked in.
+//
+// Blocks signalling have the top 3 bits of their version set to 001, leaving 29 bits for concurrent deployments. The
+// version field is enabled by the block_version fork (see forks.go), so it must be scheduled for deployments to signal.
+
+const (
+	VERSIONBITS_TOP_BITS = 0x20000000
+	VERSIONBITS_TOP_MASK = 0xE0000000
+	VERSIONBITS_NUM_BITS = 29
+
+	DEPLOYMENT_DEFINED   = "defined"
+	DEPLOYMENT_STARTED   = "started"
+	DEPLOYMENT_LOCKED_IN = "locked_in"
+	DEPLOYMENT_ACTIVE    = "active"
+	DEPLOYMENT_FAILED    = "failed"
+)
+
+type Deployment struct {
+	Name string `json:"name"`
+	// The version bit used to signal, 0-28.
+	Bit uint8 `json:"bit"`
+	// Signalling starts in the first epoch at or after this height.
+	StartHeight uint64 `json:"start_height"`
+	// The deployment fails if it hasn't locked in by the first epoch at or after this height.
+	TimeoutHeight uint64 `json:"timeout_height"`
+}
+
+// Returns whether a block version signals for a bit.
+func VersionSignals(version uint32, bit uint8) bool {
+	return version&VERSIONBITS_TOP_MASK == VERSIONBITS_TOP_BITS && version&(1<<bit) != 0
+}
+
+// Deployment states are cached by deployment and the last block of the epoch before, since an epoch's state only
+// depends on the chain up to that block.
+type deploymentStateCache struct {
+	states map[deploymentStateKey]string
+	mutex  sync.Mutex
+}
+
+type deploymentStateKey struct {
+	name string
+	// The last block of the previous epoch.
+	hash [32]byte
+}
+
+func newDeploymentStateCache() *deploymentStateCache {
+	return &deploymentStateCache{
+		states: make(map[deploymentStateKey]string),
+	}
+}
+
+// A block in a chain segment.
+type chainSegmentBlock struct {
+	hash       [32]byte
+	parentHash [32]byte
+	height     uint64
+	version    uint32
+}
+
+// Returns the deployment with the given name.
+func (dag *BlockDAG) GetDeployment(name string) (Deployment, error) {
+	for _, d := range dag.consensus.Deployments {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return Deployment{}, fmt.Errorf("Unknown deployment: %s", name)
+}
+
+// Returns the number of signalling blocks in an epoch needed for a deployment to lock in.
+func (dag *BlockDAG) VersionBitsThreshold() uint64 {
+	if dag.consensus.VersionBitsThreshold != 0 {
+		return dag.consensus.VersionBitsThreshold
+	}
+	return (dag.consensus.EpochLengthBlocks*95 + 99) / 100
+}
+
+// Returns the state of a deployment for the child of the given block.
+func (dag *BlockDAG) GetDeploymentState(d Deployment, parent Block) (string, error) {
+	epochLength := dag.consensus.EpochLengthBlocks
+	epoch := (parent.Height + 1) / epochLength
+	if epoch == 0 {
+		return DEPLOYMENT_DEFINED, nil
+	}
+
+	// Find the last block of the previous epoch.
+	segment, err := dag.getChainSegment(parent.Hash, parent.Height-(epoch*epochLength-1)+1)
+	if err != nil {
+		return "", err
+	}
+	end := segment[len(segment)-1]
+
+	// Walk back through the epochs, until reaching one whose state is known.
+	state := DEPLOYMENT_DEFINED
+	windows := [][]chainSegmentBlock{}
+	for {
+		if cached, ok := dag.deploymentStates.get(d.Name, end.hash); ok {
+			state = cached
+			break
+		}
+
+		window, err := dag.getChainSegment(end.hash, epochLength)
+		if err != nil {
+			return "", err
+		}
+		windows = append(windows, window)
+
+		// The first epoch is always defined.
+		first := window[len(window)-1]
+		if first.height == 0 {
+			break
+		}
+		end = chainSegmentBlock{hash: first.parentHash, height: first.height - 1}
+	}
+
+	// Then compute the state of each epoch forwards.
+	for i := len(windows) - 1; 0 <= i; i-- {
+		window := windows[i]
+		state = dag.nextDeploymentState(d, state, window)
+		dag.deploymentStates.set(d.Name, window[0].hash, state)
+	}
+	return state, nil
+}
+
+// Computes the state of a deployment for an epoch, from its state in the previous epoch and the blocks of the previous
+// epoch (newest first).
+func (dag *BlockDAG) nextDeploymentState(d Deployment, state string, window []chainSegmentBlock) string {
+	// The height of the first block of the epoch.
+	height := window[0].height + 1
+
+	switch state {
+	case DEPLOYMENT_DEFINED:
+		if d.TimeoutHeight <= height {
+			return DEPLOYMENT_FAILED
+		}
+		if d.StartHeight <= height {
+			return DEPLOYMENT_STARTED
+		}
+	case DEPLOYMENT_STARTED:
+		signalling := uint64(0)
+		for _, block := range window {
+			if VersionSignals(block.version, d.Bit) {
+				signalling++
+			}
+		}
+		if dag.VersionBitsThreshold() <= signalling {
+			return DEPLOYMENT_LOCKED_IN
+		}
+		if d.TimeoutHeight <= height {
+			return DEPLOYMENT_FAILED
+		}
+	case DEPLOYMENT_LOCKED_IN:
+		return DEPLOYMENT_ACTIVE
+	}
+	return state
+}
+
+// Returns whether a deployment's rules are enforced for the child of the given block.
+func (dag *BlockDAG) IsDeploymentActive(name string, parent Block) (bool, error) {
+	d, err := dag.GetDeployment(name)
+	if err != nil {
+		return false, err
+	}
+	state, err := dag.GetDeploymentState(d, parent)
+	if err != nil {
+		return false, err
+	}
+	return state == DEPLOYMENT_ACTIVE, nil
+}
+
+// Returns the version for a child of the given block, which signals for all started and locked in deployments. Returns
+// 0 if there are no deployments, or the block version fork isn't active.
+func (dag *BlockDAG) ComputeBlockVersion(parent Block) (uint32, error) {
+	if len(dag.consensus.Deployments) == 0 || !dag.IsForkActive(FORK_BLOCK_VERSION, parent.Height+1) {
+		return 0, nil
+	}
+
+	version := uint32(VERSIONBITS_TOP_BITS)
+	for _, d := range dag.consensus.Deployments {
+		state, err := dag.GetDeploymentState(d, parent)
+		if err != nil {
+			return 0, err
+		}
+		if state == DEPLOYMENT_STARTED || state == DEPLOYMENT_LOCKED_IN {
+			version |= 1 << d.Bit
+		}
+	}
+	return version, nil
+}
+
+// Counts the blocks signalling for a deployment in the current epoch, up to and including the given block. Returns the
+// count and the number of blocks of the epoch so far.
+func (dag *BlockDAG) GetDeploymentSignalling(d Deployment, tip Block) (uint64, uint64, error) {
+	elapsed := tip.Height%dag.consensus.EpochLengthBlocks + 1
+	window, err := dag.getChainSegment(tip.Hash, elapsed)
+	if err != nil {
+		return 0, 0, err
+	}
+	signalling := uint64(0)
+	for _, block := range window {
+		if VersionSignals(block.version, d.Bit) {
+			signalling++
+		}
+	}
+	return signalling, elapsed, nil
+}
+
+// Returns the chain of `n` blocks ending at the given block, newest first.
+func (dag *BlockDAG) getChainSegment(hash [32]byte, n uint64) ([]chainSegmentBlock, error) {
+	if segment, ok := dag.blockCache.getChainSegment(hash, n); ok && uint64(len(segment)) == n {
+		return segment, nil
+	}
+	rows, err := dag.db.Query(`
+		with recursive chain(hash, parent_hash, height, version, depth) as (
+			select hash, parent_hash, height, version, 1 from blocks where hash = ?
+			union all
+			select b.hash, b.parent_hash, b.height, b.version, c.depth + 1 from blocks b join chain c on b.hash = c.parent_hash where c.depth < ?
+		)
+		select hash, parent_hash, height, version from chain order by depth asc`,
+		hash[:],
+		n,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segment := []chainSegmentBlock{}
+	for rows.Next() {
+		block := chainSegmentBlock{}
+		hashBuf := []byte{}
+		parentHashBuf := []byte{}
+		if err := rows.Scan(&hashBuf, &parentHashBuf, &block.height, &block.version); err != nil {
+			return nil, err
+		}
+		copy(block.hash[:], hashBuf)
+		copy(block.parentHash[:], parentHashBuf)
+		dag.blockCache.putBlock(block, "")
+		segment = append(segment, block)
+	}
+	if uint64(len(segment)) != n {
+		return nil, fmt.Errorf("Chain segment incomplete. Expected %d blocks, got %d.", n, len(segment))
+	}
+	return segment, nil
+}
+
+func (c *deploymentStateCache) get(name string, hash [32]byte) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	state, ok := c.states[deploymentStateKey{name, hash}]
+	return state, ok
+}
+
+func (c *deploymentStateCache) set(name string, hash [32]byte, state string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.states[deploymentStateKey{name, hash}] = state
+}
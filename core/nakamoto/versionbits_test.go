@@ -0,0 +1,125 @@
+package nakamoto
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersionSignals(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(VersionSignals(VERSIONBITS_TOP_BITS|1<<3, 3))
+	assert.False(VersionSignals(VERSIONBITS_TOP_BITS|1<<3, 2))
+	// Versions without the top bits set don't signal.
+	assert.False(VersionSignals(1<<3, 3))
+	assert.False(VersionSignals(0x60000000|1<<3, 3))
+}
+
+func TestDagDeployments(t *testing.T) {
+	assert := assert.New(t)
+
+	db, err := OpenDB(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	genesisDifficulty := new(big.Int)
+	genesisDifficulty.SetString("0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+	conf := ConsensusConfig{
+		EpochLengthBlocks:       5,
+		TargetEpochLengthMillis: 2000,
+		GenesisDifficulty:       *genesisDifficulty,
+		GenesisParentBlockHash:  HexStringToBytes32("000006b15d1327d67e971d1de9116bd60a3a01556c91b6ebaa416ebc0cfaa646"),
+		MaxBlockSizeBytes:       2 * 1024 * 1024,
+		Deployments: []Deployment{
+			{Name: "signalled", Bit: 0, StartHeight: 0, TimeoutHeight: 1000},
+			{Name: "future", Bit: 1, StartHeight: 1000, TimeoutHeight: 2000},
+			{Name: "expired", Bit: 2, StartHeight: 0, TimeoutHeight: 5},
+		},
+		Forks: map[string]uint64{FORK_BLOCK_VERSION: 0},
+	}
+	dag, err := NewBlockDAGFromDB(db, newMockStateMachine(), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(uint64(5), dag.VersionBitsThreshold())
+
+	states := func() []string {
+		res := []string{}
+		for _, d := range conf.Deployments {
+			state, err := dag.GetDeploymentState(d, dag.FullTip)
+			assert.Nil(err)
+			res = append(res, state)
+		}
+		return res
+	}
+
+	// Deployments are defined in the first epoch.
+	assert.Equal([]string{DEPLOYMENT_DEFINED, DEPLOYMENT_DEFINED, DEPLOYMENT_DEFINED}, states())
+	version, err := dag.ComputeBlockVersion(dag.FullTip)
+	assert.Nil(err)
+	assert.Equal(uint32(VERSIONBITS_TOP_BITS), version)
+
+	wallets := getTestingWallets(t)
+	miner := NewMiner(dag, &wallets[0])
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+
+	// Epoch 1: started, and the miner signals.
+	miner.Start(4)
+	assert.Equal(uint64(4), dag.FullTip.Height)
+	assert.Equal([]string{DEPLOYMENT_STARTED, DEPLOYMENT_DEFINED, DEPLOYMENT_FAILED}, states())
+	version, err = dag.ComputeBlockVersion(dag.FullTip)
+	assert.Nil(err)
+	assert.Equal(uint32(VERSIONBITS_TOP_BITS|1<<0), version)
+
+	// Epoch 2: every block of epoch 1 signalled, so the deployment locks in.
+	miner.Start(5)
+	assert.Equal(uint32(VERSIONBITS_TOP_BITS|1<<0), dag.FullTip.Version)
+	signalling, elapsed, err := dag.GetDeploymentSignalling(conf.Deployments[0], dag.FullTip)
+	assert.Nil(err)
+	assert.Equal(uint64(5), signalling)
+	assert.Equal(uint64(5), elapsed)
+	assert.Equal([]string{DEPLOYMENT_LOCKED_IN, DEPLOYMENT_DEFINED, DEPLOYMENT_FAILED}, states())
+	active, err := dag.IsDeploymentActive("signalled", dag.FullTip)
+	assert.Nil(err)
+	assert.False(active)
+
+	// Epoch 3: active.
+	miner.Start(5)
+	assert.Equal([]string{DEPLOYMENT_ACTIVE, DEPLOYMENT_DEFINED, DEPLOYMENT_FAILED}, states())
+	active, err = dag.IsDeploymentActive("signalled", dag.FullTip)
+	assert.Nil(err)
+	assert.True(active)
+	version, err = dag.ComputeBlockVersion(dag.FullTip)
+	assert.Nil(err)
+	assert.Equal(uint32(VERSIONBITS_TOP_BITS), version)
+
+	// The state of earlier blocks is unchanged.
+	block, err := dag.GetBlockByHash(dag.FullTip.ParentHash)
+	assert.Nil(err)
+	state, err := dag.GetDeploymentState(conf.Deployments[0], *block)
+	assert.Nil(err)
+	assert.Equal(DEPLOYMENT_LOCKED_IN, state)
+
+	_, err = dag.IsDeploymentActive("unknown", dag.FullTip)
+	assert.EqualError(err, "Unknown deployment: unknown")
+}
+
+func TestBlockVersionHash(t *testing.T) {
+	assert := assert.New(t)
+
+	// Blocks without a version have the same hash as before version bits.
+	block := RawBlock{BlockHeader: BlockHeader{Timestamp: 1}}
+	hash := block.Hash()
+	block.Version = VERSIONBITS_TOP_BITS
+	assert.NotEqual(hash, block.Hash())
+	block.Version = 0
+	assert.Equal(hash, block.Hash())
+}
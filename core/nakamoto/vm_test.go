@@ -0,0 +1,199 @@
+package nakamoto
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+// A minimal VM, which counts the transactions executed by each account.
+type CounterVM struct {
+	counts    map[[65]byte]uint64
+	snapshots []map[[65]byte]uint64
+}
+
+func newCounterVM() *CounterVM {
+	return &CounterVM{counts: make(map[[65]byte]uint64)}
+}
+
+func (vm *CounterVM) VerifyTx(tx RawTransaction) error {
+	if tx.Amount != 0 && tx.Fee == 0 {
+		return fmt.Errorf("Only the coinbase may have no fee.")
+	}
+	return nil
+}
+
+func (vm *CounterVM) ExecuteBlock(block Block) error {
+	for _, tx := range block.Transactions {
+		vm.counts[tx.FromPubkey]++
+	}
+	return nil
+}
+
+func (vm *CounterVM) StateRoot() [32]byte {
+	h := sha256.New()
+	for account, count := range vm.counts {
+		h.Write(account[:])
+		h.Write(binary.BigEndian.AppendUint64(nil, count))
+	}
+	return [32]byte(h.Sum(nil))
+}
+
+func (vm *CounterVM) Snapshot() SnapshotID {
+	counts := make(map[[65]byte]uint64)
+	for account, count := range vm.counts {
+		counts[account] = count
+	}
+	vm.snapshots = append(vm.snapshots, counts)
+	return SnapshotID(len(vm.snapshots) - 1)
+}
+
+func (vm *CounterVM) RevertTo(snapshot SnapshotID) error {
+	if len(vm.snapshots) <= int(snapshot) {
+		return fmt.Errorf("Unknown snapshot: %d", snapshot)
+	}
+	vm.counts = vm.snapshots[snapshot]
+	vm.snapshots = vm.snapshots[:snapshot]
+	return nil
+}
+
+func TestExecuteBlocksCustomVM(t *testing.T) {
+	assert := assert.New(t)
+
+	dag, _, _ := newBlockdagForStateMachine()
+	wallets := getTestingWallets(t)
+	miner := NewMiner(dag, &wallets[0])
+	miner.OnBlockSolution = func(block RawBlock) {
+		err := dag.IngestBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	miner.Start(5)
+
+	tip, err := dag.GetLatestFullTip()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, err := dag.GetLongestChainHashList(tip.Hash, tip.Height)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := newCounterVM()
+	err = ExecuteBlocks(&dag, vm, hashes)
+	assert.Nil(err)
+	// One coinbase for each block mined.
+	assert.Equal(uint64(5), vm.counts[wallets[0].PubkeyBytes()])
+}
+
+func TestStateMachineSnapshotRevert(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	account := wallets[0].PubkeyBytes()
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.Apply([]*StateLeaf{{PubKey: account, Balance: 100}})
+	root := stateMachine.StateRoot()
+
+	snapshot := stateMachine.Snapshot()
+	stateMachine.Apply([]*StateLeaf{{PubKey: account, Balance: 50}})
+	stateMachine.Snapshot()
+	assert.NotEqual(root, stateMachine.StateRoot())
+
+	assert.Nil(stateMachine.RevertTo(snapshot))
+	assert.Equal(uint64(100), stateMachine.GetBalance(account))
+	assert.Equal(root, stateMachine.StateRoot())
+
+	// Reverting discards the snapshot, and those taken after it.
+	assert.Equal("Unknown snapshot: 1", stateMachine.RevertTo(1).Error())
+	assert.NotNil(stateMachine.RevertTo(snapshot))
+}
+
+func TestStateMachineExecuteBlockRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	sender := wallets[0].PubkeyBytes()
+	recipient := wallets[1].PubkeyBytes()
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.Apply([]*StateLeaf{{PubKey: sender, Balance: 100}})
+	root := stateMachine.StateRoot()
+
+	// The second transfer overspends, so the whole block is undone.
+	block := Block{
+		Height: 1,
+		Transactions: []RawTransaction{
+			MakeCoinbaseTx(minerWallet),
+			MakeTransferTx(sender, recipient, 60, &wallets[0], 0),
+			MakeTransferTx(sender, recipient, 60, &wallets[0], 0),
+		},
+	}
+	err = stateMachine.ExecuteBlock(block)
+	assert.ErrorContains(err, "txindex=2")
+	assert.Equal(root, stateMachine.StateRoot())
+	assert.Equal(uint64(100), stateMachine.GetBalance(sender))
+	assert.Equal(uint64(0), stateMachine.GetBalance(recipient))
+	assert.Equal(uint64(0), stateMachine.GetBalance(minerWallet.PubkeyBytes()))
+
+	block.Transactions = block.Transactions[:2]
+	assert.Nil(stateMachine.ExecuteBlock(block))
+	assert.Equal(uint64(60), stateMachine.GetBalance(recipient))
+}
+
+func TestStateMachineSpeculativeExecution(t *testing.T) {
+	assert := assert.New(t)
+
+	wallets := getTestingWallets(t)
+	sender := wallets[0].PubkeyBytes()
+	recipient := wallets[1].PubkeyBytes()
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine, err := NewStateMachine(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMachine.Apply([]*StateLeaf{{PubKey: sender, Balance: 100}})
+	root := stateMachine.StateRoot()
+	block := func(height uint64, amount uint64) Block {
+		return Block{
+			Height: height,
+			Transactions: []RawTransaction{
+				MakeCoinbaseTx(minerWallet),
+				MakeTransferTx(sender, recipient, amount, &wallets[0], 0),
+			},
+		}
+	}
+
+	// Execute two blocks of a branch speculatively, the second of which fails.
+	snapshot := stateMachine.Snapshot()
+	assert.Nil(stateMachine.ExecuteBlock(block(1, 30)))
+	afterFirst := stateMachine.StateRoot()
+	assert.NotNil(stateMachine.ExecuteBlock(block(2, 80)))
+	assert.Equal(afterFirst, stateMachine.StateRoot())
+	assert.Nil(stateMachine.ExecuteBlock(block(2, 20)))
+	assert.Equal(uint64(50), stateMachine.GetBalance(recipient))
+
+	// Roll back the branch, ie. on a reorg.
+	assert.Nil(stateMachine.RevertTo(snapshot))
+	assert.Equal(root, stateMachine.StateRoot())
+	assert.Equal(uint64(100), stateMachine.GetBalance(sender))
+	assert.Equal(uint64(0), stateMachine.GetBalance(minerWallet.PubkeyBytes()))
+	assert.Nil(stateMachine.journal)
+}
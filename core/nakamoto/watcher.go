@@ -0,0 +1,248 @@
+package nakamoto
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The address watcher lets merchants and wallets detect payments to and from addresses of interest, without scanning
+// the chain themselves. Addresses are registered with Watch, after which the watcher indexes their activity in the
+// mempool and the main chain, and emits an event for each incoming or outgoing transfer: once when the transaction
+// enters the mempool (pending), and again when it is included in the main chain (confirmed).
+//
+// Events are passed to OnEvent, and POSTed as JSON to the address's webhook URL, if it has one. Note that events are
+// not retracted when a block is reorged out of the main chain; the transaction is confirmed again when it is included
+// in the new main chain.
+type AddressWatcher struct {
+	watches map[[65]byte]*addressWatch
+
+	OnEvent func(event AddressEvent)
+
+	client *http.Client
+	mutex  sync.Mutex
+	log    *log.Logger
+}
+
+type addressWatch struct {
+	webhook string
+	// Recent activity, oldest first.
+	activity []AddressEvent
+}
+
+const (
+	ADDRESS_EVENT_INCOMING = "incoming"
+	ADDRESS_EVENT_OUTGOING = "outgoing"
+
+	ADDRESS_EVENT_PENDING   = "pending"
+	ADDRESS_EVENT_CONFIRMED = "confirmed"
+
+	// The number of recent events kept per watched address.
+	MAX_ADDRESS_ACTIVITY = 1000
+	// The timeout for delivering an event to a webhook.
+	ADDRESS_WEBHOOK_TIMEOUT = 10 * time.Second
+)
+
+type AddressEvent struct {
+	Address [65]byte
+	// Incoming or outgoing.
+	Direction string
+	// Pending or confirmed.
+	Status string
+	TxHash [32]byte
+	// The sender of an incoming transfer, or the recipient of an outgoing transfer.
+	Counterparty [65]byte
+	Amount       uint64
+	Fee          uint64
+	// The block the transaction was confirmed in. Empty if pending.
+	BlockHash [32]byte
+	Height    uint64
+	Time      time.Time
+}
+
+func NewAddressWatcher() *AddressWatcher {
+	return &AddressWatcher{
+		watches: make(map[[65]byte]*addressWatch),
+		client:  &http.Client{Timeout: ADDRESS_WEBHOOK_TIMEOUT},
+		log:     NewLogger("address-watcher", ""),
+	}
+}
+
+// Watches an address. Events for the address are POSTed to the webhook URL, if it isn't empty. Watching an address
+// which is already watched updates its webhook, and keeps its activity.
+func (w *AddressWatcher) Watch(address [65]byte, webhook string) error {
+	if webhook != "" {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid webhook URL: %s", webhook)
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if watch, ok := w.watches[address]; ok {
+		watch.webhook = webhook
+		return nil
+	}
+	w.watches[address] = &addressWatch{webhook: webhook}
+	return nil
+}
+
+func (w *AddressWatcher) Unwatch(address [65]byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.watches[address]; !ok {
+		return fmt.Errorf("Address not watched.")
+	}
+	delete(w.watches, address)
+	return nil
+}
+
+// Returns the watched addresses, and their webhook URLs.
+func (w *AddressWatcher) Watched() map[[65]byte]string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	watched := make(map[[65]byte]string)
+	for address, watch := range w.watches {
+		watched[address] = watch.webhook
+	}
+	return watched
+}
+
+func (w *AddressWatcher) NumWatched() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.watches)
+}
+
+// Returns the recent activity of a watched address, oldest first.
+func (w *AddressWatcher) Activity(address [65]byte) ([]AddressEvent, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	watch, ok := w.watches[address]
+	if !ok {
+		return nil, fmt.Errorf("Address not watched.")
+	}
+	return append([]AddressEvent{}, watch.activity...), nil
+}
+
+// Indexes a transaction which entered the mempool.
+func (w *AddressWatcher) ProcessTransaction(tx RawTransaction, now time.Time) {
+	w.process(tx, false, ADDRESS_EVENT_PENDING, [32]byte{}, 0, now, false)
+}
+
+// Indexes the transactions of a block which was connected to the main chain. The first transaction is the coinbase.
+func (w *AddressWatcher) ProcessBlock(block Block, now time.Time) {
+	for i, tx := range block.Transactions {
+		w.process(tx, i == 0, ADDRESS_EVENT_CONFIRMED, block.Hash, block.Height, now, false)
+	}
+}
+
+// Indexes the transactions of a block replayed by a rescan (see rescan.go). The block may have been processed when it
+// was connected, so transfers already recorded as confirmed in it are skipped.
+func (w *AddressWatcher) ProcessRescannedBlock(block Block, now time.Time) {
+	for i, tx := range block.Transactions {
+		w.process(tx, i == 0, ADDRESS_EVENT_CONFIRMED, block.Hash, block.Height, now, true)
+	}
+}
+
+func (w *AddressWatcher) process(tx RawTransaction, isCoinbase bool, status string, blockhash [32]byte, height uint64, now time.Time, skipRecorded bool) {
+	events := []AddressEvent{}
+	newEvent := func(address [65]byte, direction string, counterparty [65]byte) AddressEvent {
+		return AddressEvent{
+			Address:      address,
+			Direction:    direction,
+			Status:       status,
+			TxHash:       tx.Hash(),
+			Counterparty: counterparty,
+			Amount:       tx.Amount,
+			Fee:          tx.Fee,
+			BlockHash:    blockhash,
+			Height:       height,
+			Time:         now,
+		}
+	}
+
+	w.mutex.Lock()
+	record := func(watch *addressWatch, event AddressEvent) {
+		if skipRecorded && watch.isRecorded(event) {
+			return
+		}
+		watch.record(event)
+		events = append(events, event)
+	}
+	// The coinbase has no sender, and a transfer to oneself is only recorded as outgoing, since it only pays the fee.
+	if !isCoinbase {
+		if watch, ok := w.watches[tx.FromPubkey]; ok {
+			record(watch, newEvent(tx.FromPubkey, ADDRESS_EVENT_OUTGOING, tx.ToPubkey))
+		}
+	}
+	if isCoinbase || tx.FromPubkey != tx.ToPubkey {
+		if watch, ok := w.watches[tx.ToPubkey]; ok {
+			record(watch, newEvent(tx.ToPubkey, ADDRESS_EVENT_INCOMING, tx.FromPubkey))
+		}
+	}
+	webhooks := make([]string, len(events))
+	for i, event := range events {
+		webhooks[i] = w.watches[event.Address].webhook
+	}
+	w.mutex.Unlock()
+
+	for i, event := range events {
+		w.log.Printf("%s %s transfer of %d for %x: tx=%x\n", event.Status, event.Direction, event.Amount, event.Address[:8], event.TxHash)
+		if w.OnEvent != nil {
+			w.OnEvent(event)
+		}
+		if webhooks[i] != "" {
+			go w.deliver(webhooks[i], event)
+		}
+	}
+}
+
+// Records an event in the address's activity. An earlier event for the same transfer is replaced, ie. when a pending
+// transaction is confirmed, or confirmed in a different block after a reorg.
+func (watch *addressWatch) record(event AddressEvent) {
+	for i, prev := range watch.activity {
+		if prev.TxHash == event.TxHash && prev.Direction == event.Direction {
+			watch.activity = append(watch.activity[:i], watch.activity[i+1:]...)
+			break
+		}
+	}
+
+	watch.activity = append(watch.activity, event)
+	if MAX_ADDRESS_ACTIVITY < len(watch.activity) {
+		watch.activity = watch.activity[len(watch.activity)-MAX_ADDRESS_ACTIVITY:]
+	}
+}
+
+// Returns true if the transfer is already recorded, with the same status and block.
+func (watch *addressWatch) isRecorded(event AddressEvent) bool {
+	for _, prev := range watch.activity {
+		if prev.TxHash == event.TxHash && prev.Direction == event.Direction {
+			return prev.Status == event.Status && prev.BlockHash == event.BlockHash
+		}
+	}
+	return false
+}
+
+func (w *AddressWatcher) deliver(webhook string, event AddressEvent) {
+	body, err := json.Marshal(NewRPCAddressEvent(event))
+	if err != nil {
+		w.log.Printf("Failed to encode event: %s\n", err)
+		return
+	}
+	res, err := w.client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		w.log.Printf("Failed to deliver event to webhook %s: %s\n", webhook, err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || 300 <= res.StatusCode {
+		w.log.Printf("Failed to deliver event to webhook %s: status=%d\n", webhook, res.StatusCode)
+	}
+}
@@ -0,0 +1,90 @@
+package nakamoto
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressWatcher(t *testing.T) {
+	assert := assert.New(t)
+
+	merchant := [65]byte{1}
+	customer := [65]byte{2}
+	other := [65]byte{3}
+
+	webhookEvents := make(chan RPCAddressEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event RPCAddressEvent
+		assert.Nil(json.NewDecoder(r.Body).Decode(&event))
+		webhookEvents <- event
+	}))
+	defer server.Close()
+
+	watcher := NewAddressWatcher()
+	events := []AddressEvent{}
+	watcher.OnEvent = func(event AddressEvent) {
+		events = append(events, event)
+	}
+	assert.NotNil(watcher.Watch(merchant, "ftp://example.com"))
+	assert.Nil(watcher.Watch(merchant, server.URL))
+	assert.Equal(map[[65]byte]string{merchant: server.URL}, watcher.Watched())
+
+	payment := RawTransaction{Version: 1, FromPubkey: customer, ToPubkey: merchant, Amount: 100, Fee: 1}
+	unrelated := RawTransaction{Version: 1, FromPubkey: customer, ToPubkey: other, Amount: 50, Fee: 1}
+	now := time.Unix(1000, 0)
+
+	// Pending.
+	watcher.ProcessTransaction(payment, now)
+	watcher.ProcessTransaction(unrelated, now)
+	assert.Equal(1, len(events))
+	assert.Equal(ADDRESS_EVENT_INCOMING, events[0].Direction)
+	assert.Equal(ADDRESS_EVENT_PENDING, events[0].Status)
+	assert.Equal(customer, events[0].Counterparty)
+	assert.Equal(uint64(100), events[0].Amount)
+
+	// Confirmed. The coinbase paying the merchant is incoming.
+	coinbase := RawTransaction{Version: 1, FromPubkey: merchant, ToPubkey: merchant, Amount: 1000}
+	refund := RawTransaction{Version: 1, FromPubkey: merchant, ToPubkey: customer, Amount: 10, Fee: 1}
+	block := Block{Hash: [32]byte{0xb}, Height: 5, Transactions: []RawTransaction{coinbase, payment, refund, unrelated}}
+	watcher.ProcessBlock(block, now)
+	assert.Equal(4, len(events))
+	assert.Equal(ADDRESS_EVENT_INCOMING, events[1].Direction)
+	assert.Equal(coinbase.Hash(), events[1].TxHash)
+	assert.Equal(ADDRESS_EVENT_CONFIRMED, events[2].Status)
+	assert.Equal(payment.Hash(), events[2].TxHash)
+	assert.Equal(uint64(5), events[2].Height)
+	assert.Equal(ADDRESS_EVENT_OUTGOING, events[3].Direction)
+	assert.Equal(customer, events[3].Counterparty)
+
+	// A rescan of the block doesn't emit the transfers again.
+	watcher.ProcessRescannedBlock(block, now)
+	assert.Equal(4, len(events))
+
+	activity, err := watcher.Activity(merchant)
+	assert.Nil(err)
+	assert.Equal(3, len(activity))
+	_, err = watcher.Activity(other)
+	assert.NotNil(err)
+
+	// Events are delivered to the webhook.
+	delivered := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		select {
+		case event := <-webhookEvents:
+			delivered[event.Status+"/"+event.TxHash] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for webhook")
+		}
+	}
+	assert.True(delivered[ADDRESS_EVENT_PENDING+"/"+Bytes32ToHexString(payment.Hash())])
+	assert.True(delivered[ADDRESS_EVENT_CONFIRMED+"/"+Bytes32ToHexString(refund.Hash())])
+
+	assert.Nil(watcher.Unwatch(merchant))
+	assert.NotNil(watcher.Unwatch(merchant))
+	assert.Equal(0, watcher.NumWatched())
+}
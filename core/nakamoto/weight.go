@@ -0,0 +1,66 @@
+package nakamoto
+
+import (
+	"fmt"
+	"math"
+)
+
+// Block weight is a limit on the space a block takes, alongside MaxBlockSizeBytes, which weighs each byte by what it
+// costs the network. Header bytes are cheap, at WEIGHT_PER_HEADER_BYTE, since headers are small and synced first.
+// Transaction bytes are relayed, validated and stored by every node, so weigh WEIGHT_PER_TX_BYTE. A transaction
+// version can weigh its own fields differently (see TxVersion.Weight), so a data-carrying transaction type can be
+// given its own budget without hard-forking the raw size limit.
+//
+// The limit is set per network, by ConsensusConfig.MaxBlockWeight. A limit of 0 disables it, leaving only the size
+// limit.
+
+const (
+	WEIGHT_PER_HEADER_BYTE = 1
+	WEIGHT_PER_TX_BYTE     = 4
+)
+
+// Returns the weight of the header.
+func (b *BlockHeader) Weight() uint64 {
+	return b.SizeBytes() * WEIGHT_PER_HEADER_BYTE
+}
+
+// Returns the weight of the transaction, from the weight of each version's fields.
+func (tx *RawTransaction) Weight() uint64 {
+	weight := uint64(TX_BASE_SIZE) * WEIGHT_PER_TX_BYTE
+	for _, v := range txVersionsUpTo(tx.Version) {
+		if v.Weight != nil {
+			weight += v.Weight(tx)
+		} else {
+			weight += v.Size(tx) * WEIGHT_PER_TX_BYTE
+		}
+	}
+	return weight
+}
+
+// Returns the weight of the block, its header plus its transactions.
+func (b *RawBlock) Weight() uint64 {
+	weight := b.BlockHeader.Weight()
+	for i := range b.Transactions {
+		weight += b.Transactions[i].Weight()
+	}
+	return weight
+}
+
+// Returns the maximum weight of a block, which is unlimited if the network doesn't set one.
+func (dag *BlockDAG) MaxBlockWeight() uint64 {
+	if dag.consensus.MaxBlockWeight == 0 {
+		return math.MaxUint64
+	}
+	return dag.consensus.MaxBlockWeight
+}
+
+// Verifies a block is within the size and weight limits.
+func (dag *BlockDAG) verifyBlockSpace(raw RawBlock) error {
+	if size := raw.SizeBytes(); dag.consensus.MaxBlockSizeBytes < size {
+		return fmt.Errorf("Block size of %d bytes exceeds the maximum of %d bytes.", size, dag.consensus.MaxBlockSizeBytes)
+	}
+	if weight := raw.Weight(); dag.MaxBlockWeight() < weight {
+		return fmt.Errorf("Block weight of %d exceeds the maximum of %d.", weight, dag.MaxBlockWeight())
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package nakamoto
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockWeight(t *testing.T) {
+	assert := assert.New(t)
+
+	// Header bytes weigh less than transaction bytes.
+	tx := RawTransaction{Version: 2, Predicate: []byte{1, 2, 3}}
+	assert.Equal(tx.EncodedSizeBytes()*WEIGHT_PER_TX_BYTE, tx.Weight())
+	block := RawBlock{BlockHeader: BlockHeader{BaseFee: 1}, Transactions: []RawTransaction{{Version: 1}, tx}}
+	assert.Equal(uint64(BLOCK_HEADER_BASE_SIZE+BLOCK_HEADER_EXTENSION_SIZE)*WEIGHT_PER_HEADER_BYTE, block.BlockHeader.Weight())
+	assert.Equal(block.BlockHeader.Weight()+block.Transactions[0].Weight()+tx.Weight(), block.Weight())
+
+	// The network only limits weight if it sets a maximum, and then the miner fills blocks up to it.
+	dag, _, _ := newBlockdagForMiner()
+	assert.Equal(uint64(math.MaxUint64), dag.MaxBlockWeight())
+	txWeight := (&RawTransaction{Version: 1}).Weight()
+	dag.consensus.MaxBlockWeight = BLOCK_HEADER_BASE_SIZE*WEIGHT_PER_HEADER_BYTE + 2*txWeight
+	wallets := getTestingWallets(t)
+	mempool := NewMempool()
+	for nonce := uint64(0); nonce < 2; nonce++ {
+		assert.Nil(mempool.AddTransaction(makePackageTx(t, &wallets[1], nonce, 2)))
+	}
+
+	miner := NewMiner(dag, &wallets[0])
+	miner.Mempool = mempool
+	miner.OnBlockSolution = func(block RawBlock) {
+		dag.consensus.MaxBlockWeight--
+		assert.NotNil(dag.IngestBlock(block))
+		dag.consensus.MaxBlockWeight++
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	miner.Start(1)
+	assert.Equal(uint64(2), dag.FullTip.NumTransactions)
+}
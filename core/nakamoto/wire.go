@@ -0,0 +1,169 @@
+package nakamoto
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Wire encodings.
+//
+// The wire messages are the Go structs in types.go and sync.go. Their schema is defined by the struct fields and their
+// `json` tags, which name the keys in both encodings. Each encoding is identified by a name and a schema version, ie.
+// "cbor/1". A new version is introduced whenever a message changes incompatibly.
+//
+// Peers advertise the encodings they support in the heartbeat, and the sender chooses the most preferred encoding
+// that both peers support. The heartbeat itself is always encoded as JSON, so peers can negotiate before they know
+// each other's capabilities. The encoding of a message is indicated by the WIRE_ENCODING_HEADER, and the reply is
+// encoded the same way. Messages without the header are JSON.
+//
+// JSON is the default encoding, and encodes byte arrays as arrays of numbers and byte slices as base64. CBOR (RFC 8949)
+// encodes both as raw byte strings, which is faster and more compact for block payloads.
+const (
+	WIRE_ENCODING_JSON = "json/1"
+	WIRE_ENCODING_CBOR = "cbor/1"
+
+	WIRE_ENCODING_HEADER = "X-Tinychain-Encoding"
+)
+
+// The encodings we support, in order of preference.
+var SUPPORTED_WIRE_ENCODINGS = []string{WIRE_ENCODING_CBOR, WIRE_ENCODING_JSON}
+
+type WireCodec interface {
+	Name() string
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                       { return WIRE_ENCODING_JSON }
+func (jsonCodec) ContentType() string                { return "application/json" }
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type cborCodec struct {
+	enc cbor.EncMode
+	dec cbor.DecMode
+}
+
+func (cborCodec) Name() string                         { return WIRE_ENCODING_CBOR }
+func (cborCodec) ContentType() string                  { return "application/cbor" }
+func (c cborCodec) Marshal(v any) ([]byte, error)      { return c.enc.Marshal(v) }
+func (c cborCodec) Unmarshal(data []byte, v any) error { return c.dec.Unmarshal(data, v) }
+
+func newCborCodec() cborCodec {
+	enc, err := cbor.EncOptions{
+		Time: cbor.TimeRFC3339Nano,
+	}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+	dec, err := cbor.DecOptions{
+		// Limit the resources used decoding untrusted messages. The size of messages is limited by MAX_MESSAGE_SIZE.
+		MaxNestedLevels:  32,
+		MaxArrayElements: 1 << 20,
+		MaxMapPairs:      1 << 16,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	return cborCodec{enc: enc, dec: dec}
+}
+
+var wireCodecs = map[string]WireCodec{
+	WIRE_ENCODING_JSON: jsonCodec{},
+	WIRE_ENCODING_CBOR: newCborCodec(),
+}
+
+// Returns the codec for an encoding. An empty encoding is JSON.
+func GetWireCodec(encoding string) (WireCodec, error) {
+	if encoding == "" {
+		return wireCodecs[WIRE_ENCODING_JSON], nil
+	}
+	codec, ok := wireCodecs[encoding]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported wire encoding: %s", encoding)
+	}
+	return codec, nil
+}
+
+// Chooses our most preferred encoding which the peer supports. Falls back to JSON, which all peers support.
+func NegotiateWireEncoding(peerEncodings []string) string {
+	for _, ours := range SUPPORTED_WIRE_ENCODINGS {
+		for _, theirs := range peerEncodings {
+			if ours == theirs {
+				return ours
+			}
+		}
+	}
+	return WIRE_ENCODING_JSON
+}
+
+// Wire compression.
+//
+// Peers advertise the compression algorithms they support in the heartbeat. When sending a message, the sender
+// indicates the algorithm it accepts in the WIRE_ACCEPT_COMPRESSION_HEADER. The receiver compresses replies larger
+// than WIRE_COMPRESSION_THRESHOLD using that algorithm, and indicates it in the WIRE_COMPRESSION_HEADER. In practice
+// this applies to the block data sent during sync (get_blocks_reply, sync_get_data), which dominates the bandwidth
+// used by a node.
+const (
+	WIRE_COMPRESSION_ZSTD   = "zstd"
+	WIRE_COMPRESSION_SNAPPY = "snappy"
+
+	WIRE_COMPRESSION_HEADER        = "X-Tinychain-Compression"
+	WIRE_ACCEPT_COMPRESSION_HEADER = "X-Tinychain-Accept-Compression"
+
+	// Replies smaller than this are sent uncompressed, as the savings aren't worth the CPU.
+	WIRE_COMPRESSION_THRESHOLD = 4096
+)
+
+// The compression algorithms we support, in order of preference.
+var SUPPORTED_WIRE_COMPRESSIONS = []string{WIRE_COMPRESSION_ZSTD, WIRE_COMPRESSION_SNAPPY}
+
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MAX_MESSAGE_SIZE))
+
+func compressWireMessage(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case WIRE_COMPRESSION_ZSTD:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	case WIRE_COMPRESSION_SNAPPY:
+		return s2.EncodeSnappy(nil, data), nil
+	}
+	return nil, fmt.Errorf("Unsupported wire compression: %s", compression)
+}
+
+func decompressWireMessage(compression string, data []byte) ([]byte, error) {
+	switch compression {
+	case WIRE_COMPRESSION_ZSTD:
+		return zstdDecoder.DecodeAll(data, nil)
+	case WIRE_COMPRESSION_SNAPPY:
+		size, err := s2.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if MAX_MESSAGE_SIZE < size {
+			return nil, fmt.Errorf("Decompressed message too large: %d bytes", size)
+		}
+		return s2.Decode(nil, data)
+	}
+	return nil, fmt.Errorf("Unsupported wire compression: %s", compression)
+}
+
+// Chooses our most preferred compression algorithm which the peer supports. Returns "" if there are none, in which
+// case messages are sent uncompressed.
+func NegotiateWireCompression(peerCompressions []string) string {
+	for _, ours := range SUPPORTED_WIRE_COMPRESSIONS {
+		for _, theirs := range peerCompressions {
+			if ours == theirs {
+				return ours
+			}
+		}
+	}
+	return ""
+}
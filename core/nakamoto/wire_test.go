@@ -0,0 +1,184 @@
+package nakamoto
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWireCodecRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, err := newValidTx(t)
+	if err != nil {
+		t.Fatalf("Failed to create tx: %s", err)
+	}
+	msg := NewBlockMessage{
+		Type: "new_block",
+		RawBlock: RawBlock{
+			BlockHeader: BlockHeader{
+				ParentHash:      [32]byte{1, 2, 3},
+				Timestamp:       1234,
+				NumTransactions: 1,
+				Nonce:           [32]byte{0xff},
+			},
+			Transactions: []RawTransaction{tx},
+		},
+	}
+
+	sizes := make(map[string]int)
+	for _, encoding := range SUPPORTED_WIRE_ENCODINGS {
+		codec, err := GetWireCodec(encoding)
+		if err != nil {
+			t.Fatalf("Failed to get codec: %s", err)
+		}
+
+		buf, err := codec.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to marshal: %s", err)
+		}
+		sizes[encoding] = len(buf)
+
+		// The message type can be decoded before the message itself.
+		var networkMsg NetworkMessage
+		assert.Nil(codec.Unmarshal(buf, &networkMsg))
+		assert.Equal("new_block", networkMsg.Type)
+
+		var decoded NewBlockMessage
+		assert.Nil(codec.Unmarshal(buf, &decoded))
+		assert.Equal(msg, decoded)
+	}
+
+	// CBOR encodes byte arrays as byte strings, rather than arrays of numbers.
+	assert.Less(sizes[WIRE_ENCODING_CBOR]*2, sizes[WIRE_ENCODING_JSON])
+
+	_, err = GetWireCodec("xml/1")
+	assert.NotNil(err)
+}
+
+func TestNegotiateWireEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(WIRE_ENCODING_CBOR, NegotiateWireEncoding([]string{WIRE_ENCODING_JSON, WIRE_ENCODING_CBOR}))
+	assert.Equal(WIRE_ENCODING_JSON, NegotiateWireEncoding([]string{WIRE_ENCODING_JSON}))
+	assert.Equal(WIRE_ENCODING_JSON, NegotiateWireEncoding([]string{"cbor/2"}))
+	// Older peers don't advertise any encodings.
+	assert.Equal(WIRE_ENCODING_JSON, NegotiateWireEncoding(nil))
+}
+
+func TestPeerServerInboxEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	server := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	server.RegisterMesageHandler("has_block", func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg HasBlockMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+		return HasBlockReply{Type: "have_block_reply", Has: msg.BlockHash == "abcd"}, nil
+	})
+	ts := httptest.NewServer(http.HandlerFunc(server.inboxHandler))
+	defer ts.Close()
+
+	for _, encoding := range SUPPORTED_WIRE_ENCODINGS {
+		codec, _ := GetWireCodec(encoding)
+		buf, _ := codec.Marshal(HasBlockMessage{Type: "has_block", BlockHash: "abcd"})
+
+		res, _, err := sendRawMessageToPeer(ts.URL, buf, codec, "", "", &server.log)
+		if err != nil {
+			t.Fatalf("Failed to send message: %s", err)
+		}
+
+		// The reply is encoded the same way as the message.
+		var reply HasBlockReply
+		assert.Nil(codec.Unmarshal(res, &reply))
+		assert.True(reply.Has)
+	}
+
+	// Unknown encodings are rejected.
+	buf, _ := wireCodecs[WIRE_ENCODING_JSON].Marshal(HasBlockMessage{Type: "has_block"})
+	req, _ := http.NewRequest(http.MethodPost, ts.URL, bytes.NewReader(buf))
+	req.Header.Set(WIRE_ENCODING_HEADER, "xml/1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %s", err)
+	}
+	res.Body.Close()
+	assert.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func TestWireCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	data := bytes.Repeat([]byte("tinychain"), 1000)
+	for _, compression := range SUPPORTED_WIRE_COMPRESSIONS {
+		compressed, err := compressWireMessage(compression, data)
+		assert.Nil(err)
+		assert.Less(len(compressed), len(data)/10)
+
+		decompressed, err := decompressWireMessage(compression, compressed)
+		assert.Nil(err)
+		assert.Equal(data, decompressed)
+
+		_, err = decompressWireMessage(compression, []byte("garbage"))
+		assert.NotNil(err)
+	}
+
+	assert.Equal(WIRE_COMPRESSION_ZSTD, NegotiateWireCompression([]string{WIRE_COMPRESSION_SNAPPY, WIRE_COMPRESSION_ZSTD}))
+	assert.Equal(WIRE_COMPRESSION_SNAPPY, NegotiateWireCompression([]string{WIRE_COMPRESSION_SNAPPY}))
+	assert.Equal("", NegotiateWireCompression(nil))
+}
+
+func TestPeerServerInboxCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	server := NewPeerServer(PeerConfig{address: "127.0.0.1", port: "0"})
+	server.RegisterMesageHandler("get_blocks", func(message []byte, codec WireCodec) (interface{}, error) {
+		var msg GetBlocksMessage
+		if err := codec.Unmarshal(message, &msg); err != nil {
+			return nil, err
+		}
+		reply := GetBlocksReply{Type: "get_blocks_reply"}
+		for range msg.BlockHashes {
+			reply.RawBlockDatas = append(reply.RawBlockDatas, make([]byte, 2048))
+		}
+		return reply, nil
+	})
+	sentBytes := 0
+	server.OnMessage = func(peerAddr string, messageType string, bytesReceived int, bytesSent int) {
+		sentBytes = bytesSent
+	}
+	ts := httptest.NewServer(http.HandlerFunc(server.inboxHandler))
+	defer ts.Close()
+
+	codec := wireCodecs[WIRE_ENCODING_CBOR]
+	send := func(numBlocks int, compression string) (GetBlocksReply, int) {
+		buf, _ := codec.Marshal(GetBlocksMessage{Type: "get_blocks", BlockHashes: make([]string, numBlocks)})
+		res, wireSize, err := sendRawMessageToPeer(ts.URL, buf, codec, compression, "", &server.log)
+		if err != nil {
+			t.Fatalf("Failed to send message: %s", err)
+		}
+		var reply GetBlocksReply
+		assert.Nil(codec.Unmarshal(res, &reply))
+		return reply, wireSize
+	}
+
+	// Large replies are compressed.
+	reply, wireSize := send(10, WIRE_COMPRESSION_ZSTD)
+	assert.Equal(10, len(reply.RawBlockDatas))
+	assert.Equal(make([]byte, 2048), reply.RawBlockDatas[9])
+	assert.Less(wireSize, 1024)
+	assert.Equal(wireSize, sentBytes)
+
+	// Unless the peer doesn't support compression.
+	reply, wireSize = send(10, "")
+	assert.Equal(10, len(reply.RawBlockDatas))
+	assert.Less(10*2048, wireSize)
+
+	// Small replies aren't compressed.
+	_, wireSize = send(1, WIRE_COMPRESSION_SNAPPY)
+	assert.Less(2048, wireSize)
+}
@@ -0,0 +1,410 @@
+package nakamoto
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+)
+
+// Work proofs are succinct proofs of the cumulative work of a chain, in the style of FlyClient. They let ultra-light
+// clients find the heaviest chain by downloading a logarithmic number of headers, rather than all of them.
+//
+// The prover builds a Merkle sum tree over the blocks of its main chain. Each leaf commits to a block hash and the
+// block's work, which is derived from the hash itself (see CalculateWork), and each node commits to its children and
+// the sum of their work. The root commits to the whole chain and its total work.
+//
+// The verifier samples points of the chain's cumulative work at random, weighted towards the tip, and the prover opens
+// the tree at the blocks covering those points, with their headers. For each sample the verifier checks:
+//   - The Merkle path hashes to the root, and the leaf covers the sampled point of work.
+//   - The header hashes to the leaf's block hash, so the block's work is real.
+//   - The header's parent total work equals the work of all the leaves before it, so it's on the same chain.
+//
+// An adversary with a minority of the hash power can only mine a fraction of the work it claims, so most samples land
+// on blocks it can't open, and it's caught with overwhelming probability. The proof also opens the first block, which
+// must be the genesis block, and includes the last WORK_PROOF_SUFFIX_LENGTH headers in full.
+//
+// Unlike FlyClient, headers don't commit to the tree root, so the samples can't be derived from the root without
+// letting the prover grind roots until it finds favourable samples. Instead the verifier picks a random seed, and the
+// prover builds the proof for it.
+//
+// Generating a proof reads the hashes of the whole main chain, so it's O(n), while the proof is O(samples * log n).
+
+const (
+	DEFAULT_WORK_PROOF_SAMPLES = 40
+	MAX_WORK_PROOF_SAMPLES     = 256
+
+	// The number of headers at the tip included in full.
+	WORK_PROOF_SUFFIX_LENGTH = 6
+
+	// Samples are drawn at the fraction 1 - δ^u of the chain's work, for u uniform in [0, 1). Smaller values of δ
+	// weight the samples more towards the tip, where a forking adversary's blocks are.
+	WORK_PROOF_SAMPLING_DELTA = 1.0 / 1024
+)
+
+var ErrInvalidWorkProof = errors.New("invalid work proof")
+
+// A node of the work tree, committing to a subtree and the total work of its blocks.
+type WorkTreeNode struct {
+	Hash [32]byte `json:"hash"`
+	Work [32]byte `json:"work"`
+}
+
+// A block opened in a work proof.
+type WorkProofSample struct {
+	Height uint64      `json:"height"`
+	Header BlockHeader `json:"header"`
+	// The siblings on the path from the block's leaf to the root, bottom-up.
+	Path []WorkTreeNode `json:"path"`
+}
+
+type WorkProof struct {
+	Seed [32]byte `json:"seed"`
+	// The number of blocks in the chain, including the genesis block.
+	Length uint64       `json:"length"`
+	Root   WorkTreeNode `json:"root"`
+	// The sampled blocks, in ascending order of height.
+	Samples []WorkProofSample `json:"samples"`
+	// The last headers of the chain, in ascending order of height.
+	Suffix []BlockHeader `json:"suffix"`
+}
+
+// Returns the total work proven by the proof.
+func (p WorkProof) TotalWork() *big.Int {
+	work := Bytes32ToBigInt(p.Root.Work)
+	return &work
+}
+
+// get_work_proof
+type GetWorkProofMessage struct {
+	Type    string   `json:"type"` // "get_work_proof"
+	Seed    [32]byte `json:"seed"`
+	Samples int      `json:"samples"`
+}
+
+type GetWorkProofReply struct {
+	Type  string    `json:"type"` // "get_work_proof_reply"
+	Proof WorkProof `json:"proof"`
+}
+
+// Work tree.
+// =====================================================================================================================
+
+func workTreeLeaf(blockHash [32]byte) WorkTreeNode {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(blockHash[:])
+	leaf := WorkTreeNode{Work: BigIntToBytes32(*CalculateWork(Bytes32ToBigInt(blockHash)))}
+	copy(leaf.Hash[:], h.Sum(nil))
+	return leaf
+}
+
+func workTreeParent(left WorkTreeNode, right WorkTreeNode) WorkTreeNode {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left.Hash[:])
+	h.Write(left.Work[:])
+	h.Write(right.Hash[:])
+	h.Write(right.Work[:])
+
+	leftWork, rightWork := Bytes32ToBigInt(left.Work), Bytes32ToBigInt(right.Work)
+	parent := WorkTreeNode{Work: BigIntToBytes32(*new(big.Int).Add(&leftWork, &rightWork))}
+	copy(parent.Hash[:], h.Sum(nil))
+	return parent
+}
+
+// Returns the size of the left subtree of a tree of n leaves - the largest power of two less than n.
+func workTreeSplit(n uint64) uint64 {
+	k := uint64(1)
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+// A work tree over a list of leaves, with its nodes memoised by (start, size).
+type workTree struct {
+	leaves []WorkTreeNode
+	nodes  map[[2]uint64]WorkTreeNode
+}
+
+func newWorkTree(leaves []WorkTreeNode) *workTree {
+	t := &workTree{leaves: leaves, nodes: make(map[[2]uint64]WorkTreeNode)}
+	t.node(0, uint64(len(leaves)))
+	return t
+}
+
+func (t *workTree) node(start uint64, size uint64) WorkTreeNode {
+	if size == 1 {
+		return t.leaves[start]
+	}
+	if node, ok := t.nodes[[2]uint64{start, size}]; ok {
+		return node
+	}
+	k := workTreeSplit(size)
+	node := workTreeParent(t.node(start, k), t.node(start+k, size-k))
+	t.nodes[[2]uint64{start, size}] = node
+	return node
+}
+
+func (t *workTree) root() WorkTreeNode {
+	return t.node(0, uint64(len(t.leaves)))
+}
+
+// Returns the siblings on the path from a leaf to the root, bottom-up.
+func (t *workTree) path(index uint64) []WorkTreeNode {
+	path := []WorkTreeNode{}
+	start, size := uint64(0), uint64(len(t.leaves))
+	for 1 < size {
+		k := workTreeSplit(size)
+		if index < start+k {
+			path = append(path, t.node(start+k, size-k))
+			size = k
+		} else {
+			path = append(path, t.node(start, k))
+			start, size = start+k, size-k
+		}
+	}
+
+	// Reverse to bottom-up.
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// Computes the root of a tree of n leaves from a leaf and its path, and the total work of the leaves before it.
+func verifyWorkTreePath(index uint64, n uint64, leaf WorkTreeNode, path []WorkTreeNode) (WorkTreeNode, *big.Int, error) {
+	if n == 1 {
+		if len(path) != 0 {
+			return WorkTreeNode{}, nil, fmt.Errorf("%w: path too long", ErrInvalidWorkProof)
+		}
+		return leaf, big.NewInt(0), nil
+	}
+	if len(path) == 0 {
+		return WorkTreeNode{}, nil, fmt.Errorf("%w: path too short", ErrInvalidWorkProof)
+	}
+
+	k := workTreeSplit(n)
+	sibling, rest := path[len(path)-1], path[:len(path)-1]
+	if index < k {
+		left, before, err := verifyWorkTreePath(index, k, leaf, rest)
+		if err != nil {
+			return WorkTreeNode{}, nil, err
+		}
+		return workTreeParent(left, sibling), before, nil
+	}
+	right, before, err := verifyWorkTreePath(index-k, n-k, leaf, rest)
+	if err != nil {
+		return WorkTreeNode{}, nil, err
+	}
+	siblingWork := Bytes32ToBigInt(sibling.Work)
+	return workTreeParent(sibling, right), before.Add(before, &siblingWork), nil
+}
+
+// Returns the i'th sampled point of the chain's work, in [0, totalWork).
+func sampleWorkPoint(seed [32]byte, i int, totalWork *big.Int) *big.Int {
+	buf := make([]byte, 40)
+	copy(buf, seed[:])
+	binary.BigEndian.PutUint64(buf[32:], uint64(i))
+	digest := sha256.Sum256(buf)
+
+	// u uniform in [0, 1), with 53 bits of precision.
+	u := float64(binary.BigEndian.Uint64(digest[:8])>>11) / float64(uint64(1)<<53)
+	x := 1 - math.Pow(WORK_PROOF_SAMPLING_DELTA, u)
+
+	point, _ := new(big.Float).Mul(new(big.Float).SetInt(totalWork), big.NewFloat(x)).Int(nil)
+	if point.Cmp(totalWork) >= 0 {
+		point.Sub(totalWork, big.NewInt(1))
+	}
+	return point
+}
+
+// Proving and verifying.
+// =====================================================================================================================
+
+// Generates a proof of the work of the main chain, opening numSamples blocks sampled using the seed.
+func (dag *BlockDAG) GenerateWorkProof(seed [32]byte, numSamples int) (WorkProof, error) {
+	if numSamples <= 0 || MAX_WORK_PROOF_SAMPLES < numSamples {
+		return WorkProof{}, fmt.Errorf("Number of samples must be between 1 and %d.", MAX_WORK_PROOF_SAMPLES)
+	}
+
+	// Read the hashes of the main chain.
+	tip := dag.FullTip
+	it, err := dag.IterateMainChain(0, tip.Height)
+	if err != nil {
+		return WorkProof{}, err
+	}
+	hashes := [][32]byte{}
+	for it.Next() {
+		hashes = append(hashes, it.Block().Hash)
+	}
+	err = it.Err()
+	it.Close()
+	if err != nil {
+		return WorkProof{}, err
+	}
+	n := uint64(len(hashes))
+	if n == 0 {
+		return WorkProof{}, fmt.Errorf("Main chain is empty.")
+	}
+
+	// Build the tree, and the cumulative work at the end of each block for locating samples.
+	leaves := make([]WorkTreeNode, n)
+	cumulativeWork := make([]*big.Int, n)
+	total := big.NewInt(0)
+	for i, hash := range hashes {
+		leaves[i] = workTreeLeaf(hash)
+		work := Bytes32ToBigInt(leaves[i].Work)
+		total = new(big.Int).Add(total, &work)
+		cumulativeWork[i] = total
+	}
+	tree := newWorkTree(leaves)
+
+	// Sample the genesis block, the tip, and the blocks covering the sampled points of work.
+	heights := map[uint64]bool{0: true, n - 1: true}
+	for i := 0; i < numSamples; i++ {
+		point := sampleWorkPoint(seed, i, total)
+		index := sort.Search(int(n), func(j int) bool { return point.Cmp(cumulativeWork[j]) < 0 })
+		heights[uint64(index)] = true
+	}
+	sortedHeights := []uint64{}
+	for height := range heights {
+		sortedHeights = append(sortedHeights, height)
+	}
+	sort.Slice(sortedHeights, func(i, j int) bool { return sortedHeights[i] < sortedHeights[j] })
+
+	proof := WorkProof{
+		Seed:    seed,
+		Length:  n,
+		Root:    tree.root(),
+		Samples: []WorkProofSample{},
+		Suffix:  []BlockHeader{},
+	}
+	for _, height := range sortedHeights {
+		header, err := dag.getBlockHeader(hashes[height])
+		if err != nil {
+			return WorkProof{}, err
+		}
+		proof.Samples = append(proof.Samples, WorkProofSample{Height: height, Header: header, Path: tree.path(height)})
+	}
+	suffixStart := uint64(0)
+	if WORK_PROOF_SUFFIX_LENGTH < n {
+		suffixStart = n - WORK_PROOF_SUFFIX_LENGTH
+	}
+	for height := suffixStart; height < n; height++ {
+		header, err := dag.getBlockHeader(hashes[height])
+		if err != nil {
+			return WorkProof{}, err
+		}
+		proof.Suffix = append(proof.Suffix, header)
+	}
+	return proof, nil
+}
+
+func (dag *BlockDAG) getBlockHeader(hash [32]byte) (BlockHeader, error) {
+	block, err := dag.GetBlockByHash(hash)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+	if block == nil {
+		return BlockHeader{}, fmt.Errorf("Block not found: %x", hash)
+	}
+	return block.ToBlockHeader(), nil
+}
+
+// Verifies a proof of work for a chain starting at the genesis block, generated for the seed and number of samples.
+// Returns the total work of the chain.
+func VerifyWorkProof(proof WorkProof, seed [32]byte, numSamples int, genesisHash [32]byte) (*big.Int, error) {
+	if proof.Seed != seed {
+		return nil, fmt.Errorf("%w: wrong seed", ErrInvalidWorkProof)
+	}
+	if proof.Length == 0 {
+		return nil, fmt.Errorf("%w: empty chain", ErrInvalidWorkProof)
+	}
+	if numSamples+2 < len(proof.Samples) {
+		return nil, fmt.Errorf("%w: too many samples", ErrInvalidWorkProof)
+	}
+
+	// Verify each sample is in the tree, and record the span of work it covers.
+	type span struct{ start, end *big.Int }
+	spans := []span{}
+	heights := map[uint64]BlockHeader{}
+	for i, sample := range proof.Samples {
+		if proof.Length <= sample.Height {
+			return nil, fmt.Errorf("%w: sample height %d beyond the chain", ErrInvalidWorkProof, sample.Height)
+		}
+		if 0 < i && sample.Height <= proof.Samples[i-1].Height {
+			return nil, fmt.Errorf("%w: samples aren't in ascending order", ErrInvalidWorkProof)
+		}
+
+		leaf := workTreeLeaf(sample.Header.BlockHash())
+		root, before, err := verifyWorkTreePath(sample.Height, proof.Length, leaf, sample.Path)
+		if err != nil {
+			return nil, err
+		}
+		if root != proof.Root {
+			return nil, fmt.Errorf("%w: sample at height %d isn't in the tree", ErrInvalidWorkProof, sample.Height)
+		}
+		parentTotalWork := Bytes32ToBigInt(sample.Header.ParentTotalWork)
+		if parentTotalWork.Cmp(before) != 0 {
+			return nil, fmt.Errorf("%w: sample at height %d has the wrong parent total work", ErrInvalidWorkProof, sample.Height)
+		}
+
+		work := Bytes32ToBigInt(leaf.Work)
+		spans = append(spans, span{start: before, end: new(big.Int).Add(before, &work)})
+		heights[sample.Height] = sample.Header
+	}
+
+	// Check the chain starts at the genesis block, and the tip is opened.
+	genesis, ok := heights[0]
+	if !ok || genesis.BlockHash() != genesisHash {
+		return nil, fmt.Errorf("%w: chain doesn't start at the genesis block", ErrInvalidWorkProof)
+	}
+	tip, ok := heights[proof.Length-1]
+	if !ok {
+		return nil, fmt.Errorf("%w: tip isn't opened", ErrInvalidWorkProof)
+	}
+
+	// Check every sampled point of work is covered by an opened block.
+	total := proof.TotalWork()
+	if total.Sign() <= 0 {
+		return nil, fmt.Errorf("%w: no work", ErrInvalidWorkProof)
+	}
+	for i := 0; i < numSamples; i++ {
+		point := sampleWorkPoint(seed, i, total)
+		j := sort.Search(len(spans), func(j int) bool { return point.Cmp(spans[j].end) < 0 })
+		if j == len(spans) || point.Cmp(spans[j].start) < 0 {
+			return nil, fmt.Errorf("%w: sample %d isn't opened", ErrInvalidWorkProof, i)
+		}
+	}
+
+	// Check the suffix is a chain of headers ending at the tip.
+	expectedSuffix := uint64(WORK_PROOF_SUFFIX_LENGTH)
+	if proof.Length < expectedSuffix {
+		expectedSuffix = proof.Length
+	}
+	if uint64(len(proof.Suffix)) != expectedSuffix {
+		return nil, fmt.Errorf("%w: wrong suffix length", ErrInvalidWorkProof)
+	}
+	for i := 1; i < len(proof.Suffix); i++ {
+		prev, next := proof.Suffix[i-1], proof.Suffix[i]
+		if next.ParentHash != prev.BlockHash() {
+			return nil, fmt.Errorf("%w: suffix isn't a chain", ErrInvalidWorkProof)
+		}
+		prevParentTotalWork := Bytes32ToBigInt(prev.ParentTotalWork)
+		prevWork := CalculateWork(Bytes32ToBigInt(prev.BlockHash()))
+		nextParentTotalWork := Bytes32ToBigInt(next.ParentTotalWork)
+		if nextParentTotalWork.Cmp(prevWork.Add(prevWork, &prevParentTotalWork)) != 0 {
+			return nil, fmt.Errorf("%w: suffix work doesn't add up", ErrInvalidWorkProof)
+		}
+	}
+	if proof.Suffix[len(proof.Suffix)-1].BlockHash() != tip.BlockHash() {
+		return nil, fmt.Errorf("%w: suffix doesn't end at the tip", ErrInvalidWorkProof)
+	}
+
+	return total, nil
+}
@@ -0,0 +1,109 @@
+package nakamoto
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkTreePaths(t *testing.T) {
+	assert := assert.New(t)
+
+	for n := 1; n <= 20; n++ {
+		leaves := []WorkTreeNode{}
+		for i := 0; i < n; i++ {
+			leaves = append(leaves, workTreeLeaf([32]byte{byte(i), 0xff}))
+		}
+		tree := newWorkTree(leaves)
+
+		before := big.NewInt(0)
+		for i := 0; i < n; i++ {
+			root, workBefore, err := verifyWorkTreePath(uint64(i), uint64(n), leaves[i], tree.path(uint64(i)))
+			assert.Nil(err)
+			assert.Equal(tree.root(), root)
+			assert.Equal(0, before.Cmp(workBefore))
+
+			work := Bytes32ToBigInt(leaves[i].Work)
+			before.Add(before, &work)
+		}
+		assert.Equal(BigIntToBytes32(*before), tree.root().Work)
+	}
+
+	// Paths don't verify at other positions.
+	leaves := []WorkTreeNode{workTreeLeaf([32]byte{1}), workTreeLeaf([32]byte{2}), workTreeLeaf([32]byte{3})}
+	tree := newWorkTree(leaves)
+	root, _, _ := verifyWorkTreePath(1, 3, leaves[0], tree.path(0))
+	assert.NotEqual(tree.root(), root)
+	_, _, err := verifyWorkTreePath(0, 3, leaves[0], tree.path(0)[:1])
+	assert.ErrorIs(err, ErrInvalidWorkProof)
+}
+
+func TestDagWorkProof(t *testing.T) {
+	assert := assert.New(t)
+	dag, conf, _ := newBlockdagLongEpoch()
+	genesis := GetRawGenesisBlockFromConfig(conf)
+	genesisHash := genesis.Hash()
+
+	minerWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		t.Fatalf("Failed to create miner wallet: %s", err)
+	}
+	miner := NewMiner(dag, minerWallet)
+	miner.OnBlockSolution = func(block RawBlock) {
+		if err := dag.IngestBlock(block); err != nil {
+			t.Fatalf("Failed to ingest block: %s", err)
+		}
+	}
+	miner.Start(30)
+
+	seed := [32]byte{0xab}
+	proof, err := dag.GenerateWorkProof(seed, 10)
+	assert.Nil(err)
+	assert.Equal(uint64(31), proof.Length)
+	assert.LessOrEqual(len(proof.Samples), 12)
+	assert.Equal(WORK_PROOF_SUFFIX_LENGTH, len(proof.Suffix))
+
+	work, err := VerifyWorkProof(proof, seed, 10, genesisHash)
+	assert.Nil(err)
+	assert.Equal(0, work.Cmp(&dag.FullTip.AccumulatedWork))
+
+	// The proof is for a different seed.
+	_, err = VerifyWorkProof(proof, [32]byte{0xcd}, 10, genesisHash)
+	assert.ErrorIs(err, ErrInvalidWorkProof)
+
+	// The chain has a different genesis.
+	_, err = VerifyWorkProof(proof, seed, 10, [32]byte{1})
+	assert.ErrorIs(err, ErrInvalidWorkProof)
+
+	// Tampering with a sampled header.
+	tampered := proof
+	tampered.Samples = append([]WorkProofSample{}, proof.Samples...)
+	tampered.Samples[1].Header.Nonce = [32]byte{1}
+	_, err = VerifyWorkProof(tampered, seed, 10, genesisHash)
+	assert.ErrorIs(err, ErrInvalidWorkProof)
+
+	// Claiming more work.
+	tampered = proof
+	inflated := new(big.Int).Mul(work, big.NewInt(2))
+	tampered.Root.Work = BigIntToBytes32(*inflated)
+	_, err = VerifyWorkProof(tampered, seed, 10, genesisHash)
+	assert.ErrorIs(err, ErrInvalidWorkProof)
+
+	// Withholding a sample.
+	tampered = proof
+	tampered.Samples = append([]WorkProofSample{}, proof.Samples[:len(proof.Samples)-2]...)
+	tampered.Samples = append(tampered.Samples, proof.Samples[len(proof.Samples)-1])
+	_, err = VerifyWorkProof(tampered, seed, 10, genesisHash)
+	assert.ErrorIs(err, ErrInvalidWorkProof)
+
+	// A truncated suffix.
+	tampered = proof
+	tampered.Suffix = proof.Suffix[1:]
+	_, err = VerifyWorkProof(tampered, seed, 10, genesisHash)
+	assert.ErrorIs(err, ErrInvalidWorkProof)
+
+	_, err = dag.GenerateWorkProof(seed, 0)
+	assert.NotNil(err)
+}
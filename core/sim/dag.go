@@ -0,0 +1,51 @@
+package sim
+
+import (
+	"math/big"
+
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+)
+
+type noopStateMachine struct{}
+
+func (m *noopStateMachine) VerifyTx(tx nakamoto.RawTransaction) error {
+	return nil
+}
+func (m *noopStateMachine) ExecuteBlock(block nakamoto.Block) error {
+	return nil
+}
+func (m *noopStateMachine) StateRoot() [32]byte {
+	return [32]byte{}
+}
+func (m *noopStateMachine) Snapshot() nakamoto.SnapshotID {
+	return 0
+}
+func (m *noopStateMachine) RevertTo(snapshot nakamoto.SnapshotID) error {
+	return nil
+}
+
+// Creates an in-memory block DAG with an easy difficulty and a single epoch, so blocks are cheap to mine.
+func newMemoryBlockDAG() (*nakamoto.BlockDAG, error) {
+	db, err := nakamoto.OpenDB(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1) // :memory: only
+
+	genesisDifficulty := new(big.Int)
+	genesisDifficulty.SetString("0fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
+
+	conf := nakamoto.ConsensusConfig{
+		EpochLengthBlocks:       1 << 32,
+		TargetEpochLengthMillis: 1000,
+		GenesisDifficulty:       *genesisDifficulty,
+		GenesisParentBlockHash:  nakamoto.HexStringToBytes32("000006b15d1327d67e971d1de9116bd60a3a01556c91b6ebaa416ebc0cfaa646"),
+		MaxBlockSizeBytes:       2 * 1024 * 1024, // 2MB
+	}
+
+	dag, err := nakamoto.NewBlockDAGFromDB(db, &noopStateMachine{}, conf)
+	if err != nil {
+		return nil, err
+	}
+	return &dag, nil
+}
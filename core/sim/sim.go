@@ -0,0 +1,448 @@
+// Package sim simulates mining on a network of honest miners and a single adversary, which controls a share of the
+// hashrate and follows a configurable strategy. It measures how the strategy affects the quality of the resulting
+// chain: how many of its blocks are the adversary's, how many blocks go stale, and how deep the reorgs are.
+//
+// Blocks are real blocks, mined at an easy difficulty and ingested into real block DAGs, so the simulation follows the
+// node's fork choice rule. There are two DAGs:
+//   - the public DAG, which is the honest miners' view of the network. Honest miners mine on its full tip, and publish
+//     their blocks immediately.
+//   - the private DAG, which is the adversary's view. It includes every honest block, and the adversary's blocks,
+//     whether they've been published or not.
+//
+// Time is simulated: the DAGs share a clock which advances by SIM_BLOCK_INTERVAL for each block mined, starting at the
+// genesis block's timestamp, so block timestamps don't depend on how fast the simulation runs.
+//
+// Note that the chain is chosen by accumulated work, and the work of a block is computed from its hash rather than the
+// difficulty target (see CalculateWork), so strategies compare branches by work rather than length.
+package sim
+
+import (
+	"fmt"
+	"math/big"
+	"math/rand"
+	"time"
+
+	"github.com/liamzebedee/tinychain-go/core"
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+)
+
+// An adversarial mining strategy.
+type Strategy string
+
+const (
+	// Publishes blocks immediately, and mines on the public tip. The baseline for the other strategies.
+	STRATEGY_HONEST Strategy = "honest"
+
+	// Selfish mining (Eyal and Sirer, 2013). The adversary mines on a private branch, and only publishes enough of it
+	// to overtake each new honest block, wasting the honest miners' work. It abandons its branch when overtaken.
+	STRATEGY_SELFISH Strategy = "selfish"
+
+	// Withholds blocks and releases them in batches of WithholdBlocks, abandoning the batch if overtaken first.
+	STRATEGY_WITHHOLD Strategy = "withhold"
+
+	// Mines a private branch from the public tip, and publishes it once it has more work than a public chain which
+	// has advanced at least ReorgDepth blocks since the fork, reorging those blocks. The attempt is abandoned when the
+	// public chain is GiveUpBlocks blocks ahead of the branch.
+	STRATEGY_DEEP_REORG Strategy = "deepreorg"
+)
+
+var Strategies = []Strategy{STRATEGY_HONEST, STRATEGY_SELFISH, STRATEGY_WITHHOLD, STRATEGY_DEEP_REORG}
+
+// The simulated time between blocks, by all miners.
+const SIM_BLOCK_INTERVAL = 1 * time.Second
+
+type Config struct {
+	Strategy Strategy
+
+	// The adversary's share of the total hashrate, between 0 and 1.
+	AdversaryShare float64
+
+	// The number of blocks to mine, by all miners.
+	Blocks int
+
+	// The seed for the random source deciding who mines each block. Block hashes, and so their work, aren't seeded, so
+	// runs with the same seed can still differ in the outcome of close races.
+	Seed int64
+
+	// The batch size for STRATEGY_WITHHOLD.
+	WithholdBlocks int
+
+	// The reorg depth targeted by STRATEGY_DEEP_REORG, and how far it can fall behind before giving up.
+	ReorgDepth   int
+	GiveUpBlocks int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Strategy:       STRATEGY_SELFISH,
+		AdversaryShare: 0.3,
+		Blocks:         500,
+		Seed:           1,
+		WithholdBlocks: 3,
+		ReorgDepth:     6,
+		GiveUpBlocks:   3,
+	}
+}
+
+// The chain quality metrics of a simulation.
+type Report struct {
+	Strategy       Strategy `json:"strategy"`
+	AdversaryShare float64  `json:"adversary_share"`
+
+	// The blocks mined by each party.
+	HonestBlocks    uint64 `json:"honest_blocks"`
+	AdversaryBlocks uint64 `json:"adversary_blocks"`
+
+	// The main chain of the public DAG, excluding genesis, and how many of its blocks each party mined.
+	MainChainLength          uint64 `json:"main_chain_length"`
+	HonestMainChainBlocks    uint64 `json:"honest_main_chain_blocks"`
+	AdversaryMainChainBlocks uint64 `json:"adversary_main_chain_blocks"`
+
+	// The share of the main chain mined by honest miners. 1 - AdversaryShare when everyone is honest.
+	ChainQuality float64 `json:"chain_quality"`
+	// The share of the main chain mined by the adversary, ie. its share of the block rewards. The strategy is
+	// profitable when this exceeds AdversaryShare.
+	AdversaryRevenueShare float64 `json:"adversary_revenue_share"`
+
+	// Blocks which didn't make it into the main chain, including the adversary's unpublished blocks.
+	StaleBlocks uint64  `json:"stale_blocks"`
+	StaleRate   float64 `json:"stale_rate"`
+
+	// Reorgs of the public DAG's full tip.
+	Reorgs        uint64 `json:"reorgs"`
+	MaxReorgDepth uint64 `json:"max_reorg_depth"`
+
+	// STRATEGY_DEEP_REORG attempts, and those which reorged at least ReorgDepth blocks.
+	ReorgAttempts    uint64 `json:"reorg_attempts"`
+	SuccessfulReorgs uint64 `json:"successful_reorgs"`
+}
+
+type Simulation struct {
+	config Config
+	rng    *rand.Rand
+	clock  *nakamoto.SimClock
+
+	public  *nakamoto.BlockDAG
+	private *nakamoto.BlockDAG
+
+	honestWallet    *core.Wallet
+	adversaryWallet *core.Wallet
+
+	// The tip of the adversary's branch, which is in the private DAG.
+	privateTip nakamoto.Block
+	// The adversary's unpublished blocks, in chain order.
+	withheld []nakamoto.RawBlock
+	// The block the current STRATEGY_DEEP_REORG attempt forked from.
+	forkPoint nakamoto.Block
+
+	// The hashes of the blocks mined by the adversary.
+	adversaryBlocks map[[32]byte]bool
+
+	report Report
+}
+
+func NewSimulation(config Config) (*Simulation, error) {
+	if !isStrategy(config.Strategy) {
+		return nil, fmt.Errorf("Unknown strategy: %s.", config.Strategy)
+	}
+	if config.AdversaryShare < 0 || 1 < config.AdversaryShare {
+		return nil, fmt.Errorf("Adversary share must be between 0 and 1.")
+	}
+	if config.Blocks <= 0 {
+		return nil, fmt.Errorf("Number of blocks must be positive.")
+	}
+	if config.Strategy == STRATEGY_WITHHOLD && config.WithholdBlocks <= 0 {
+		return nil, fmt.Errorf("Withhold blocks must be positive.")
+	}
+	if config.Strategy == STRATEGY_DEEP_REORG && (config.ReorgDepth <= 0 || config.GiveUpBlocks < 0) {
+		return nil, fmt.Errorf("Reorg depth must be positive.")
+	}
+
+	public, err := newMemoryBlockDAG()
+	if err != nil {
+		return nil, err
+	}
+	private, err := newMemoryBlockDAG()
+	if err != nil {
+		return nil, err
+	}
+	clock := nakamoto.NewSimClock(time.UnixMilli(int64(public.FullTip.Timestamp)))
+	public.Clock, private.Clock = clock, clock
+	honestWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		return nil, err
+	}
+	adversaryWallet, err := core.CreateRandomWallet()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Simulation{
+		config:          config,
+		rng:             rand.New(rand.NewSource(config.Seed)),
+		clock:           clock,
+		public:          public,
+		private:         private,
+		honestWallet:    honestWallet,
+		adversaryWallet: adversaryWallet,
+		privateTip:      public.FullTip,
+		forkPoint:       public.FullTip,
+		adversaryBlocks: make(map[[32]byte]bool),
+		report: Report{
+			Strategy:       config.Strategy,
+			AdversaryShare: config.AdversaryShare,
+		},
+	}, nil
+}
+
+func isStrategy(strategy Strategy) bool {
+	for _, s := range Strategies {
+		if s == strategy {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs the simulation, and returns its chain quality metrics.
+func (s *Simulation) Run() (Report, error) {
+	for i := 0; i < s.config.Blocks; i++ {
+		var err error
+		s.clock.Advance(SIM_BLOCK_INTERVAL)
+		if s.rng.Float64() < s.config.AdversaryShare {
+			err = s.adversaryMines()
+		} else {
+			err = s.honestMines()
+		}
+		if err != nil {
+			return Report{}, fmt.Errorf("Block %d: %s", i, err)
+		}
+	}
+
+	if err := s.computeChainQuality(); err != nil {
+		return Report{}, err
+	}
+	return s.report, nil
+}
+
+func (s *Simulation) honestMines() error {
+	raw, err := s.mineBlock(s.public, s.public.FullTip, s.honestWallet)
+	if err != nil {
+		return err
+	}
+	s.report.HonestBlocks++
+
+	// Honest blocks are published immediately, and the adversary sees them.
+	if err := s.publish(raw); err != nil {
+		return err
+	}
+	if err := s.private.IngestBlock(raw); err != nil {
+		return err
+	}
+
+	return s.onHonestBlock()
+}
+
+func (s *Simulation) adversaryMines() error {
+	if s.config.Strategy == STRATEGY_HONEST {
+		s.privateTip = s.public.FullTip
+	}
+	raw, err := s.mineBlock(s.private, s.privateTip, s.adversaryWallet)
+	if err != nil {
+		return err
+	}
+	s.report.AdversaryBlocks++
+	s.adversaryBlocks[raw.Hash()] = true
+
+	if err := s.private.IngestBlock(raw); err != nil {
+		return err
+	}
+	block, err := s.private.GetBlockByHash(raw.Hash())
+	if err != nil {
+		return err
+	}
+	s.privateTip = *block
+	s.withheld = append(s.withheld, raw)
+
+	return s.onAdversaryBlock()
+}
+
+func (s *Simulation) onHonestBlock() error {
+	publicTip := s.public.FullTip
+
+	switch s.config.Strategy {
+	case STRATEGY_SELFISH:
+		if s.overtaken() {
+			s.abandon()
+			return nil
+		}
+		// Publish just enough of the branch to overtake the new honest block.
+		for i, raw := range s.withheld {
+			block, err := s.private.GetBlockByHash(raw.Hash())
+			if err != nil {
+				return err
+			}
+			if publicTip.AccumulatedWork.Cmp(&block.AccumulatedWork) < 0 {
+				return s.publishWithheld(i + 1)
+			}
+		}
+	case STRATEGY_WITHHOLD:
+		if s.overtaken() {
+			s.abandon()
+		}
+	case STRATEGY_DEEP_REORG:
+		return s.checkReorgAttempt()
+	}
+	return nil
+}
+
+func (s *Simulation) onAdversaryBlock() error {
+	switch s.config.Strategy {
+	case STRATEGY_HONEST:
+		return s.publishWithheld(len(s.withheld))
+	case STRATEGY_WITHHOLD:
+		if s.config.WithholdBlocks <= len(s.withheld) {
+			return s.publishWithheld(len(s.withheld))
+		}
+	case STRATEGY_DEEP_REORG:
+		return s.checkReorgAttempt()
+	}
+	return nil
+}
+
+func (s *Simulation) checkReorgAttempt() error {
+	if len(s.withheld) == 0 {
+		// Not attempting a reorg, so follow the public chain.
+		s.abandon()
+		return nil
+	}
+	if len(s.withheld) == 1 && s.privateTip.ParentHash == s.forkPoint.Hash {
+		s.report.ReorgAttempts++
+	}
+
+	publicTip := s.public.FullTip
+	if uint64(s.config.ReorgDepth) <= publicTip.Height-s.forkPoint.Height && !s.overtaken() {
+		if err := s.publishWithheld(len(s.withheld)); err != nil {
+			return err
+		}
+		if s.public.FullTip.Hash == s.privateTip.Hash {
+			s.report.SuccessfulReorgs++
+		}
+		s.abandon()
+		return nil
+	}
+
+	if s.privateTip.Height+uint64(s.config.GiveUpBlocks) < publicTip.Height {
+		s.abandon()
+	}
+	return nil
+}
+
+// Returns whether the public chain has more work than the adversary's branch.
+func (s *Simulation) overtaken() bool {
+	return s.privateTip.AccumulatedWork.Cmp(&s.public.FullTip.AccumulatedWork) < 0
+}
+
+// Abandons the adversary's branch, and continues from the public tip.
+func (s *Simulation) abandon() {
+	s.withheld = nil
+	s.privateTip = s.public.FullTip
+	s.forkPoint = s.public.FullTip
+}
+
+// Publishes the first n withheld blocks.
+func (s *Simulation) publishWithheld(n int) error {
+	for _, raw := range s.withheld[:n] {
+		if err := s.publish(raw); err != nil {
+			return err
+		}
+	}
+	s.withheld = s.withheld[n:]
+	return nil
+}
+
+// Ingests a block into the public DAG, and records any reorg of its tip.
+func (s *Simulation) publish(raw nakamoto.RawBlock) error {
+	prevTip := s.public.FullTip
+	if err := s.public.IngestBlock(raw); err != nil {
+		return err
+	}
+	currTip := s.public.FullTip
+	if currTip.Hash == prevTip.Hash || currTip.ParentHash == prevTip.Hash {
+		return nil
+	}
+
+	ancestor, err := s.public.GetCommonAncestor(currTip.Hash, prevTip.Hash)
+	if err != nil {
+		return err
+	}
+	depth := prevTip.Height - ancestor.Height
+	if 0 < depth {
+		s.report.Reorgs++
+		if s.report.MaxReorgDepth < depth {
+			s.report.MaxReorgDepth = depth
+		}
+	}
+	return nil
+}
+
+func (s *Simulation) computeChainQuality() error {
+	tip := s.public.FullTip
+	hashes, err := s.public.GetLongestChainHashList(tip.Hash, tip.Height+1)
+	if err != nil {
+		return err
+	}
+
+	r := &s.report
+	// Skip genesis.
+	for _, hash := range hashes[1:] {
+		if s.adversaryBlocks[hash] {
+			r.AdversaryMainChainBlocks++
+		} else {
+			r.HonestMainChainBlocks++
+		}
+	}
+	r.MainChainLength = uint64(len(hashes) - 1)
+	r.StaleBlocks = r.HonestBlocks + r.AdversaryBlocks - r.MainChainLength
+	r.StaleRate = float64(r.StaleBlocks) / float64(r.HonestBlocks+r.AdversaryBlocks)
+	if 0 < r.MainChainLength {
+		r.ChainQuality = float64(r.HonestMainChainBlocks) / float64(r.MainChainLength)
+		r.AdversaryRevenueShare = float64(r.AdversaryMainChainBlocks) / float64(r.MainChainLength)
+	}
+	return nil
+}
+
+// Mines a block on the given parent, which must be in the DAG.
+func (s *Simulation) mineBlock(dag *nakamoto.BlockDAG, parent nakamoto.Block, miner *core.Wallet) (nakamoto.RawBlock, error) {
+	version, err := dag.ComputeBlockVersion(parent)
+	if err != nil {
+		return nakamoto.RawBlock{}, err
+	}
+	epoch, err := dag.GetEpochForBlockHash(parent.Hash)
+	if err != nil {
+		return nakamoto.RawBlock{}, err
+	}
+
+	raw := nakamoto.RawBlock{
+		BlockHeader: nakamoto.BlockHeader{
+			ParentHash:      parent.Hash,
+			ParentTotalWork: nakamoto.BigIntToBytes32(parent.AccumulatedWork),
+			Difficulty:      nakamoto.EncodeDifficulty(epoch.Difficulty),
+			Timestamp:       dag.Timestamp(),
+			BaseFee:         dag.GetNextBaseFee(parent),
+			Version:         version,
+		},
+		Transactions: []nakamoto.RawTransaction{nakamoto.MakeCoinbaseTx(miner)},
+	}
+	// Make every block unique, even when mined on the same parent in the same millisecond.
+	s.rng.Read(raw.Graffiti[:])
+	raw.NumTransactions = 1
+	raw.TransactionsMerkleRoot = core.ComputeMerkleHash([][]byte{raw.Transactions[0].Envelope()})
+
+	solution, err := nakamoto.SolvePOW(raw, *big.NewInt(0), epoch.Difficulty, 0)
+	if err != nil {
+		return nakamoto.RawBlock{}, err
+	}
+	raw.SetNonce(solution)
+	return raw, nil
+}
@@ -0,0 +1,71 @@
+package sim
+
+import (
+	"io"
+	"testing"
+
+	"github.com/liamzebedee/tinychain-go/core/nakamoto"
+	"github.com/stretchr/testify/assert"
+)
+
+func runSimulation(t *testing.T, config Config) Report {
+	nakamoto.SetLogOutput(io.Discard)
+	s, err := NewSimulation(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := s.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestSimulationHonest(t *testing.T) {
+	assert := assert.New(t)
+
+	config := DefaultConfig()
+	config.Strategy = STRATEGY_HONEST
+	config.Blocks = 60
+	report := runSimulation(t, config)
+
+	// Everyone mines on the tip, so nothing goes stale.
+	assert.Equal(uint64(60), report.HonestBlocks+report.AdversaryBlocks)
+	assert.Equal(uint64(60), report.MainChainLength)
+	assert.Equal(report.AdversaryBlocks, report.AdversaryMainChainBlocks)
+	assert.Equal(uint64(0), report.StaleBlocks)
+	assert.Equal(uint64(0), report.Reorgs)
+	assert.InDelta(1.0, report.ChainQuality+report.AdversaryRevenueShare, 1e-9)
+}
+
+func TestSimulationAdversarial(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, strategy := range []Strategy{STRATEGY_SELFISH, STRATEGY_WITHHOLD, STRATEGY_DEEP_REORG} {
+		config := DefaultConfig()
+		config.Strategy = strategy
+		config.AdversaryShare = 0.45
+		config.Blocks = 80
+		config.ReorgDepth = 2
+		report := runSimulation(t, config)
+
+		assert.Equal(uint64(80), report.HonestBlocks+report.AdversaryBlocks, strategy)
+		assert.Equal(report.HonestBlocks+report.AdversaryBlocks, report.MainChainLength+report.StaleBlocks, strategy)
+		assert.Equal(report.MainChainLength, report.HonestMainChainBlocks+report.AdversaryMainChainBlocks, strategy)
+		assert.LessOrEqual(report.SuccessfulReorgs, report.ReorgAttempts, strategy)
+	}
+}
+
+func TestSimulationConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	config := DefaultConfig()
+	config.Strategy = "nothing-at-stake"
+	_, err := NewSimulation(config)
+	assert.NotNil(err)
+
+	config = DefaultConfig()
+	config.AdversaryShare = 1.5
+	_, err = NewSimulation(config)
+	assert.NotNil(err)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"math/big"
@@ -42,6 +43,10 @@ func (w *Wallet) PubkeyStr() string {
 	return hex.EncodeToString(pubkey[:])
 }
 
+func (w *Wallet) Prvkey() *ecdsa.PrivateKey {
+	return w.prvkey
+}
+
 func (w *Wallet) PrvkeyStr() string {
 	return hex.EncodeToString(w.prvkey.D.Bytes())
 }
@@ -73,6 +78,24 @@ func WalletFromPrivateKey(privateKeyHex string) (*Wallet, error) {
 	return &Wallet{prvkey: prvkey}, nil
 }
 
+// Derives a wallet from a seed and an index, so test networks can be set up reproducibly. The private key is the hash
+// of the seed and index, so anyone knowing the seed knows the key: these wallets must never hold real funds.
+func WalletFromSeed(seed string, index uint64) (*Wallet, error) {
+	curve := elliptic.P256()
+	for counter := uint64(0); ; counter++ {
+		h := sha256.New()
+		h.Write([]byte(seed))
+		h.Write(binary.BigEndian.AppendUint64(nil, index))
+		h.Write(binary.BigEndian.AppendUint64(nil, counter))
+		d := new(big.Int).SetBytes(h.Sum(nil))
+		// The key must be in [1, N-1]. This is retried with negligible probability.
+		if d.Sign() == 0 || curve.Params().N.Cmp(d) <= 0 {
+			continue
+		}
+		return WalletFromPrivateKey(hex.EncodeToString(d.Bytes()))
+	}
+}
+
 func padBytes(src []byte, length int) []byte {
 	if len(src) >= length {
 		return src
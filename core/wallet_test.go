@@ -129,3 +129,28 @@ func TestWalletSigningDeterminism(t *testing.T) {
 		}
 	}
 }
+
+func TestWalletFromSeed(t *testing.T) {
+	assert := assert.New(t)
+
+	a, err := WalletFromSeed("devnet", 0)
+	assert.Nil(err)
+	b, err := WalletFromSeed("devnet", 0)
+	assert.Nil(err)
+	assert.Equal(a.PrvkeyStr(), b.PrvkeyStr())
+	assert.Equal(a.PubkeyBytes(), b.PubkeyBytes())
+
+	// Each index and seed derives a different wallet.
+	c, err := WalletFromSeed("devnet", 1)
+	assert.Nil(err)
+	assert.NotEqual(a.PubkeyBytes(), c.PubkeyBytes())
+	d, err := WalletFromSeed("other", 0)
+	assert.Nil(err)
+	assert.NotEqual(a.PubkeyBytes(), d.PubkeyBytes())
+
+	// The wallet signs like any other.
+	msg := []byte("Gday, world!")
+	sig, err := a.Sign(msg)
+	assert.Nil(err)
+	assert.True(VerifySignature(a.PubkeyStr(), sig, msg))
+}